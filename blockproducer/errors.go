@@ -79,6 +79,8 @@ var (
 	ErrInvalidGasPrice = errors.New("gas price is invalid")
 	// ErrInvalidMinerCount indicates that the miner node count is invalid.
 	ErrInvalidMinerCount = errors.New("miner node count is invalid")
+	// ErrInvalidConsistencyLevel indicates that the consistency level is out of range.
+	ErrInvalidConsistencyLevel = errors.New("consistency level is invalid")
 	// ErrLocalNodeNotFound indicates that the local node id is not found in the given peer list.
 	ErrLocalNodeNotFound = errors.New("local node id not found in peer list")
 	// ErrNoAvailableBranch indicates that there is no available branch from the state storage.
@@ -18,6 +18,7 @@ package blockproducer
 
 import (
 	"bytes"
+	"math"
 	"sort"
 	"time"
 
@@ -633,6 +634,10 @@ func (s *metaState) matchProvidersWithUser(tx *types.CreateDatabase) (err error)
 		err = ErrInvalidMinerCount
 		return
 	}
+	if lvl := tx.ResourceMeta.ConsistencyLevel; math.IsNaN(lvl) || lvl < 0.0 || lvl > 1.0 {
+		err = errors.Wrapf(ErrInvalidConsistencyLevel, "consistency level %f out of range [0, 1]", lvl)
+		return
+	}
 	minerCount := uint64(tx.ResourceMeta.Node)
 
 	minAdvancePayment := minDeposit(tx.GasPrice, minerCount)
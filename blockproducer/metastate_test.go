@@ -798,6 +798,21 @@ func TestMetaState(t *testing.T) {
 				}
 				err = invalidCd8.Sign(privKey2)
 				So(err, ShouldBeNil)
+				invalidCd9 := types.CreateDatabase{
+					CreateDatabaseHeader: types.CreateDatabaseHeader{
+						Owner: addr3,
+						ResourceMeta: types.ResourceMeta{
+							TargetMiners:     []proto.AccountAddress{addr2},
+							Node:             1,
+							ConsistencyLevel: 1.5,
+						},
+						Nonce:          1,
+						GasPrice:       1,
+						AdvancePayment: uint64(conf.GConf.QPS) * conf.GConf.BillingBlockCount * 1,
+					},
+				}
+				err = invalidCd9.Sign(privKey3)
+				So(err, ShouldBeNil)
 
 				err = ms.apply(&invalidPs)
 				So(errors.Cause(err), ShouldEqual, ErrInsufficientBalance)
@@ -813,6 +828,8 @@ func TestMetaState(t *testing.T) {
 				So(errors.Cause(err), ShouldEqual, ErrNoEnoughMiner)
 				err = ms.apply(&invalidCd6)
 				So(errors.Cause(err), ShouldEqual, ErrInvalidMinerCount)
+				err = ms.apply(&invalidCd9)
+				So(errors.Cause(err), ShouldEqual, ErrInvalidConsistencyLevel)
 				ms.dirty.provider[proto.AccountAddress(hash.HashH([]byte("1")))] = &types.ProviderProfile{
 					TargetUser: nil,
 				}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"sync/atomic"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/kms"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/rpc"
+	"github.com/pkg/errors"
+)
+
+// signAdminRequestFunc builds an admin request of the database and signs it with the local
+// private key.
+type signAdminRequestFunc func(dbID proto.DatabaseID, privKey *asymmetric.PrivateKey) (
+	req interface{}, err error)
+
+// callAdmin sends the signed admin request to the leader of the database, the leader checks the
+// admin permission of the signer and replicates the request to the other miners if needed.
+func callAdmin(
+	dsn string, method route.RemoteFunc, sign signAdminRequestFunc, resp interface{},
+) (dbID proto.DatabaseID, leader proto.NodeID, err error) {
+	if atomic.LoadUint32(&driverInitialized) == 0 {
+		err = ErrNotInitialized
+		return
+	}
+
+	var cfg *Config
+	if cfg, err = ParseDSN(dsn); err != nil {
+		return
+	}
+
+	var privKey *asymmetric.PrivateKey
+	if privKey, err = kms.GetLocalPrivateKey(); err != nil {
+		return
+	}
+
+	dbID = proto.DatabaseID(cfg.DatabaseID)
+
+	var peers *proto.Peers
+	if peers, err = getPeers(dbID, privKey); err != nil {
+		return
+	}
+	leader = peers.Leader
+
+	err = callAdminNode(leader, dbID, method, sign, resp)
+	return
+}
+
+// callAdminNode sends the signed admin request of the database to the node directly, e.g. the
+// leader which serves the previous requests of a chunked transfer.
+func callAdminNode(
+	node proto.NodeID, dbID proto.DatabaseID, method route.RemoteFunc, sign signAdminRequestFunc, resp interface{},
+) (err error) {
+	var privKey *asymmetric.PrivateKey
+	if privKey, err = kms.GetLocalPrivateKey(); err != nil {
+		return
+	}
+
+	var req interface{}
+	if req, err = sign(dbID, privKey); err != nil {
+		return
+	}
+
+	if err = rpc.NewCaller().CallNode(node, method.String(), req, resp); err != nil {
+		err = errors.Wrapf(err, "call %s on leader %v failed", method.String(), node)
+	}
+	return
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	"github.com/pkg/errors"
+)
+
+// Backup takes a signed backup archive of the database from the database leader, the archive data
+// is fetched in chunks, admin permission of the database is required.
+func Backup(dsn string) (archive *types.BackupArchive, err error) {
+	newReq := func(archiveHash hash.Hash, offset uint64) signAdminRequestFunc {
+		return func(dbID proto.DatabaseID, privKey *asymmetric.PrivateKey) (interface{}, error) {
+			req := &types.BackupReq{
+				Header: types.SignedBackupRequestHeader{
+					BackupRequestHeader: types.BackupRequestHeader{
+						DatabaseID: dbID,
+						Timestamp:  getLocalTime(),
+					},
+				},
+				ArchiveHash: archiveHash,
+				Offset:      offset,
+			}
+			return req, req.Header.Sign(privKey)
+		}
+	}
+
+	resp := &types.BackupResp{}
+	dbID, leader, err := callAdmin(dsn, route.DBSBackup, newReq(hash.Hash{}, 0), resp)
+	if err != nil {
+		return
+	}
+
+	if resp.Header == nil || resp.Size == 0 {
+		err = errors.Wrap(types.ErrInvalidBackupArchive, "empty archive")
+		return
+	}
+
+	var (
+		header = resp.Header
+		size   = resp.Size
+		data   = make([]byte, 0, size)
+	)
+	for {
+		if len(resp.Chunk) == 0 || uint64(len(data)+len(resp.Chunk)) > size {
+			err = errors.Wrapf(types.ErrInvalidBackupArchive, "invalid archive chunk at %d", len(data))
+			return
+		}
+		data = append(data, resp.Chunk...)
+		if uint64(len(data)) == size {
+			break
+		}
+		resp = &types.BackupResp{}
+		if err = callAdminNode(
+			leader, dbID, route.DBSBackup, newReq(header.Hash(), uint64(len(data))), resp,
+		); err != nil {
+			return
+		}
+	}
+
+	archive = &types.BackupArchive{
+		Header: *header,
+		Data:   data,
+	}
+	if err = archive.Verify(); err != nil {
+		archive = nil
+	}
+
+	return
+}
+
+// Restore seeds the database with the backup archive through its leader, which replicates the
+// restore to all miners by kayak, admin permission of the database is required. The archive data
+// is uploaded in chunks, the miners fetch it from the leader. The archive could be taken from
+// another database, while the target database must not have executed any write query.
+func Restore(dsn string, archive *types.BackupArchive) (err error) {
+	if archive == nil {
+		err = errors.Wrap(types.ErrInvalidBackupArchive, "nil archive")
+		return
+	}
+
+	if err = archive.Verify(); err != nil {
+		return
+	}
+
+	newReq := func(offset int) signAdminRequestFunc {
+		end := offset + types.BackupChunkSize
+		if end > len(archive.Data) {
+			end = len(archive.Data)
+		}
+		return func(dbID proto.DatabaseID, privKey *asymmetric.PrivateKey) (interface{}, error) {
+			req := &types.RestoreReq{
+				Header: types.SignedRestoreRequestHeader{
+					RestoreRequestHeader: types.RestoreRequestHeader{
+						DatabaseID:  dbID,
+						ArchiveHash: archive.Header.Hash(),
+						Timestamp:   getLocalTime(),
+					},
+				},
+				ArchiveHeader: &archive.Header,
+				Size:          uint64(len(archive.Data)),
+				Offset:        uint64(offset),
+				Chunk:         archive.Data[offset:end],
+			}
+			return req, req.Header.Sign(privKey)
+		}
+	}
+
+	// the restore is applied along with the last chunk
+	dbID, leader, err := callAdmin(dsn, route.DBSRestore, newReq(0), &types.RestoreResp{})
+	for offset := types.BackupChunkSize; err == nil && offset < len(archive.Data); offset += types.BackupChunkSize {
+		err = callAdminNode(leader, dbID, route.DBSRestore, newReq(offset), &types.RestoreResp{})
+	}
+	if err != nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"db":     dbID,
+		"leader": leader,
+	}).Info("database restored")
+
+	return
+}
+
+// EncodeBackupArchive encodes the backup archive for storage.
+func EncodeBackupArchive(archive *types.BackupArchive) (data []byte, err error) {
+	buf, err := utils.EncodeMsgPack(archive)
+	if err != nil {
+		return
+	}
+	data = buf.Bytes()
+	return
+}
+
+// DecodeBackupArchive decodes and verifies the stored backup archive.
+func DecodeBackupArchive(data []byte) (archive *types.BackupArchive, err error) {
+	archive = &types.BackupArchive{}
+	if err = utils.DecodeMsgPack(data, archive); err != nil {
+		err = errors.Wrap(err, "decode backup archive failed")
+		return
+	}
+	if err = archive.Verify(); err != nil {
+		archive = nil
+	}
+	return
+}
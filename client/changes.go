@@ -0,0 +1,144 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/kms"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/rpc"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ChangesPollInterval defines the interval to poll new row changes when a subscription is
+	// caught up.
+	ChangesPollInterval = time.Second
+	// ChangesFetchLimit defines the max row change count fetched by each poll.
+	ChangesFetchLimit = 1000
+)
+
+// ChangeHandler handles a batch of row changes in log offset order, the subscription stops if
+// an error is returned.
+type ChangeHandler func(changes []types.RowChange) error
+
+// FetchChanges returns the row changes of the database from the log offset, which are captured
+// by the database leader. The changes of a single write query are never split across fetches,
+// and the returned next offset should be passed to resume fetching. Offset 0 fetches from the
+// earliest retained change.
+func FetchChanges(dsn string, offset uint64, limit int) (changes []types.RowChange, next uint64, err error) {
+	if atomic.LoadUint32(&driverInitialized) == 0 {
+		err = ErrNotInitialized
+		return
+	}
+
+	var cfg *Config
+	if cfg, err = ParseDSN(dsn); err != nil {
+		return
+	}
+
+	var peers *proto.Peers
+	if peers, err = getDatabasePeers(proto.DatabaseID(cfg.DatabaseID)); err != nil {
+		return
+	}
+
+	return fetchChanges(peers.Leader, proto.DatabaseID(cfg.DatabaseID), offset, limit)
+}
+
+// SubscribeChanges polls the row changes of the database from the log offset and passes them to
+// handler in order until ctx is done or an error occurs. The returned offset follows the last
+// batch handled successfully, so the subscription can be resumed from it without losing changes.
+func SubscribeChanges(
+	ctx context.Context, dsn string, offset uint64, handler ChangeHandler) (next uint64, err error,
+) {
+	next = offset
+	if atomic.LoadUint32(&driverInitialized) == 0 {
+		err = ErrNotInitialized
+		return
+	}
+
+	var cfg *Config
+	if cfg, err = ParseDSN(dsn); err != nil {
+		return
+	}
+
+	var (
+		dbID  = proto.DatabaseID(cfg.DatabaseID)
+		peers *proto.Peers
+	)
+	if peers, err = getDatabasePeers(dbID); err != nil {
+		return
+	}
+
+	for {
+		var (
+			changes []types.RowChange
+			fetched uint64
+		)
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if changes, fetched, err = fetchChanges(peers.Leader, dbID, next, ChangesFetchLimit); err != nil {
+			return
+		}
+		if len(changes) > 0 {
+			if err = handler(changes); err != nil {
+				return
+			}
+			next = fetched
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(ChangesPollInterval):
+		}
+	}
+}
+
+func getDatabasePeers(dbID proto.DatabaseID) (peers *proto.Peers, err error) {
+	var privKey *asymmetric.PrivateKey
+	if privKey, err = kms.GetLocalPrivateKey(); err != nil {
+		return
+	}
+	return getPeers(dbID, privKey)
+}
+
+func fetchChanges(
+	leader proto.NodeID, dbID proto.DatabaseID, offset uint64, limit int,
+) (changes []types.RowChange, next uint64, err error) {
+	var (
+		req = &types.FetchChangesReq{
+			DatabaseID: dbID,
+			Offset:     offset,
+			Limit:      limit,
+		}
+		resp = &types.FetchChangesResp{}
+	)
+	if err = rpc.NewCaller().CallNode(leader, route.DBSFetchChanges.String(), req, resp); err != nil {
+		err = errors.Wrap(err, "fetch database changes failed")
+		return
+	}
+	return resp.Changes, resp.Next, nil
+}
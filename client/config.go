@@ -20,11 +20,21 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/pkg/errors"
 )
 
 const (
-	paramUseLeader   = "use_leader"
-	paramUseFollower = "use_follower"
+	paramUseLeader    = "use_leader"
+	paramUseFollower  = "use_follower"
+	paramMaxStaleness = "max_staleness"
+	paramAsOfHeight   = "as_of_height"
+	paramDialect      = "dialect"
+	paramVerify       = "verify"
+	paramCursorBatch  = "cursor_batch"
+	paramColumnKey    = "column_key"
+	paramEncColumns   = "encrypted_columns"
 )
 
 // Config is a configuration parsed from a DSN string.
@@ -40,6 +50,36 @@ type Config struct {
 
 	// UseFollower use follower nodes to do queries
 	UseFollower bool
+
+	// MaxStaleness is the maximum number of log offsets a follower read may lag behind
+	// the latest log offset observed by the driver, 0 means no bound.
+	MaxStaleness uint64
+
+	// AsOfHeight is the sqlchain height to read the database state as of, 0 means the latest
+	// state. Only read queries are allowed on such a connection.
+	AsOfHeight int32
+
+	// Dialect is the SQL dialect of the queries, which are translated to SQLite by the miner.
+	Dialect types.QueryDialect
+
+	// Verify verifies the response signatures against the keys registered by the miners, and
+	// the inclusion of the responses in the sqlchain blocks.
+	Verify bool
+
+	// CursorBatch streams the results of read queries through server-side cursors, which are
+	// fetched in batches of CursorBatch rows, 0 means the whole results are returned at once.
+	// It doesn't apply to historical reads, or the verified ones as the following batches are
+	// not signed.
+	CursorBatch int
+
+	// ColumnKey is the secret to derive the keys of the encrypted columns, which is held only by
+	// the client.
+	ColumnKey string
+
+	// EncryptedColumns are the table columns encrypted by the client with ColumnKey, so the
+	// miners never see the plain values of them. The arguments bound to the columns are
+	// encrypted and the selected columns are decrypted transparently.
+	EncryptedColumns []ColumnEncryption
 }
 
 // NewConfig creates a new config with default value.
@@ -63,6 +103,28 @@ func (cfg *Config) FormatDSN() string {
 		if cfg.UseLeader {
 			newQuery.Add(paramUseLeader, strconv.FormatBool(cfg.UseLeader))
 		}
+
+		if cfg.MaxStaleness > 0 {
+			newQuery.Add(paramMaxStaleness, strconv.FormatUint(cfg.MaxStaleness, 10))
+		}
+	}
+	if cfg.AsOfHeight != 0 {
+		newQuery.Add(paramAsOfHeight, strconv.FormatInt(int64(cfg.AsOfHeight), 10))
+	}
+	if cfg.Dialect != types.SQLiteDialect {
+		newQuery.Add(paramDialect, cfg.Dialect.String())
+	}
+	if cfg.Verify {
+		newQuery.Add(paramVerify, strconv.FormatBool(cfg.Verify))
+	}
+	if cfg.CursorBatch > 0 {
+		newQuery.Add(paramCursorBatch, strconv.Itoa(cfg.CursorBatch))
+	}
+	if cfg.ColumnKey != "" {
+		newQuery.Add(paramColumnKey, cfg.ColumnKey)
+	}
+	if len(cfg.EncryptedColumns) > 0 {
+		newQuery.Add(paramEncColumns, formatColumnEncryptions(cfg.EncryptedColumns))
 	}
 	u.RawQuery = newQuery.Encode()
 
@@ -90,6 +152,31 @@ func ParseDSN(dsn string) (cfg *Config, err error) {
 	if !cfg.UseLeader && !cfg.UseFollower {
 		cfg.UseLeader = true
 	}
+	// option: max_staleness, only takes effect on follower reads
+	if s := q.Get(paramMaxStaleness); cfg.UseFollower && s != "" {
+		if cfg.MaxStaleness, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", paramMaxStaleness)
+		}
+	}
+	// option: as_of_height
+	if height, _ := strconv.ParseInt(q.Get(paramAsOfHeight), 10, 32); height > 0 {
+		cfg.AsOfHeight = int32(height)
+	}
+	// option: dialect
+	if strings.EqualFold(q.Get(paramDialect), types.MySQLDialect.String()) {
+		cfg.Dialect = types.MySQLDialect
+	}
+	// option: verify
+	cfg.Verify, _ = strconv.ParseBool(q.Get(paramVerify))
+	// option: cursor_batch
+	if batch, _ := strconv.Atoi(q.Get(paramCursorBatch)); batch > 0 {
+		cfg.CursorBatch = batch
+	}
+	// option: column_key, encrypted_columns
+	cfg.ColumnKey = q.Get(paramColumnKey)
+	if cfg.EncryptedColumns, err = parseColumnEncryptions(q.Get(paramEncColumns)); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
@@ -19,6 +19,8 @@ package client
 import (
 	"testing"
 
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/pkg/errors"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -72,6 +74,124 @@ func TestConfig(t *testing.T) {
 		So(cfg, ShouldResemble, recoveredCfg)
 	})
 
+	Convey("test dsn with max staleness", t, func() {
+		cfg, err := ParseDSN("covenantsql://db?use_follower=true&max_staleness=10")
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, &Config{
+			DatabaseID:   "db",
+			UseLeader:    false,
+			UseFollower:  true,
+			MaxStaleness: 10,
+		})
+
+		recoveredCfg, err := ParseDSN(cfg.FormatDSN())
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, recoveredCfg)
+
+		// max staleness is ignored without follower reads
+		cfg, err = ParseDSN("covenantsql://db?max_staleness=10")
+		So(err, ShouldBeNil)
+		So(cfg.MaxStaleness, ShouldEqual, 0)
+
+		_, err = ParseDSN("covenantsql://db?use_follower=true&max_staleness=-1")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("test dsn with as of height", t, func() {
+		cfg, err := ParseDSN("covenantsql://db?as_of_height=100")
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, &Config{
+			DatabaseID: "db",
+			UseLeader:  true,
+			AsOfHeight: 100,
+		})
+
+		recoveredCfg, err := ParseDSN(cfg.FormatDSN())
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, recoveredCfg)
+
+		// invalid heights are ignored
+		cfg, err = ParseDSN("covenantsql://db?as_of_height=-1")
+		So(err, ShouldBeNil)
+		So(cfg.AsOfHeight, ShouldEqual, 0)
+	})
+
+	Convey("test dsn with dialect", t, func() {
+		cfg, err := ParseDSN("covenantsql://db?dialect=MySQL")
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, &Config{
+			DatabaseID: "db",
+			UseLeader:  true,
+			Dialect:    types.MySQLDialect,
+		})
+
+		recoveredCfg, err := ParseDSN(cfg.FormatDSN())
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, recoveredCfg)
+
+		// unknown dialects fall back to sqlite
+		cfg, err = ParseDSN("covenantsql://db?dialect=oracle")
+		So(err, ShouldBeNil)
+		So(cfg.Dialect, ShouldEqual, types.SQLiteDialect)
+	})
+
+	Convey("test dsn with verify", t, func() {
+		cfg, err := ParseDSN("covenantsql://db?verify=true")
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, &Config{
+			DatabaseID: "db",
+			UseLeader:  true,
+			Verify:     true,
+		})
+
+		recoveredCfg, err := ParseDSN(cfg.FormatDSN())
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, recoveredCfg)
+	})
+
+	Convey("test dsn with cursor batch", t, func() {
+		cfg, err := ParseDSN("covenantsql://db?cursor_batch=100")
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, &Config{
+			DatabaseID:  "db",
+			UseLeader:   true,
+			CursorBatch: 100,
+		})
+
+		recoveredCfg, err := ParseDSN(cfg.FormatDSN())
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, recoveredCfg)
+
+		// invalid batch size disables the cursors
+		cfg, err = ParseDSN("covenantsql://db?cursor_batch=-1")
+		So(err, ShouldBeNil)
+		So(cfg.CursorBatch, ShouldEqual, 0)
+	})
+
+	Convey("test dsn with encrypted columns", t, func() {
+		cfg, err := ParseDSN(
+			"covenantsql://db?column_key=secret&encrypted_columns=users.email:deterministic,users.ssn")
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, &Config{
+			DatabaseID: "db",
+			UseLeader:  true,
+			ColumnKey:  "secret",
+			EncryptedColumns: []ColumnEncryption{
+				{Table: "users", Column: "email", Mode: DeterministicEncryption},
+				{Table: "users", Column: "ssn", Mode: RandomizedEncryption},
+			},
+		})
+
+		recoveredCfg, err := ParseDSN(cfg.FormatDSN())
+		So(err, ShouldBeNil)
+		So(cfg, ShouldResemble, recoveredCfg)
+
+		for _, v := range []string{"users", "users.email:unknown", ".email", "users."} {
+			_, err = ParseDSN("covenantsql://db?encrypted_columns=" + v)
+			So(errors.Cause(err), ShouldEqual, ErrColumnEncryption)
+		}
+	})
+
 	Convey("test dsn with use all kinds of options", t, func(c C) {
 		testFormatAndParse := func(cfg *Config) {
 			newCfg, err := ParseDSN(cfg.FormatDSN())
@@ -90,5 +210,10 @@ func TestConfig(t *testing.T) {
 			UseLeader:   true,
 			UseFollower: true,
 		})
+		testFormatAndParse(&Config{
+			UseLeader:    true,
+			UseFollower:  true,
+			MaxStaleness: 5,
+		})
 	})
 }
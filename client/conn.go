@@ -46,8 +46,19 @@ type conn struct {
 	inTransaction bool
 	closed        int32
 
-	leader   *pconn
-	follower *pconn
+	useLeader    bool
+	useFollower  bool
+	leader       *pconn
+	followers    []*pconn
+	retired      []*pconn
+	nextFollower uint32
+	maxStaleness uint64
+	asOfHeight   int32
+	dialect      types.QueryDialect
+	verify       bool
+	cursorBatch  int
+	cursorConnID uint64
+	encryptor    *columnEncryptor
 }
 
 // pconn represents a connection to a peer
@@ -75,6 +86,19 @@ func newConn(cfg *Config) (c *conn, err error) {
 		localNodeID: localNodeID,
 		privKey:     privKey,
 		queries:     make([]types.Query, 0),
+		useLeader:   cfg.UseLeader,
+		useFollower: cfg.UseFollower,
+		asOfHeight:  cfg.AsOfHeight,
+		dialect:     cfg.Dialect,
+		verify:      cfg.Verify,
+		cursorBatch: cfg.CursorBatch,
+	}
+	if c.encryptor, err = newColumnEncryptor(cfg.ColumnKey, cfg.EncryptedColumns); err != nil {
+		return nil, err
+	}
+	if c.cursorBatch > 0 {
+		// the cursors are tracked by connection on the peers
+		c.cursorConnID, _ = allocateConnAndSeq()
 	}
 
 	// get peers from BP
@@ -83,43 +107,78 @@ func newConn(cfg *Config) (c *conn, err error) {
 		return nil, errors.WithMessage(err, "cacheGetPeers failed")
 	}
 
-	if cfg.UseLeader {
-		c.leader = &pconn{
-			parent:  c,
-			pCaller: rpc.NewPersistentCaller(peers.Leader),
-		}
+	if cfg.UseFollower {
+		c.maxStaleness = cfg.MaxStaleness
+	}
+	if err = c.connectPeers(peers); err != nil {
+		return nil, err
 	}
 
-	// choose a random follower node
-	if cfg.UseFollower && len(peers.Servers) > 1 {
-		for {
-			node := peers.Servers[randSource.Intn(len(peers.Servers))]
-			if node != peers.Leader {
-				c.follower = &pconn{
-					parent:  c,
-					pCaller: rpc.NewPersistentCaller(node),
-				}
-				break
+	log.WithField("db", c.dbID).Debug("new connection to database")
+	return
+}
+
+// connectPeers connects the leader and followers of peers. The connected pconns are reused if
+// the nodes are still serving, the others are retired till the connection closes, since they
+// may still be used by the open cursor rows.
+func (c *conn) connectPeers(peers *proto.Peers) (err error) {
+	var (
+		leader    *pconn
+		followers []*pconn
+		current   = make(map[proto.NodeID]*pconn)
+		connect   = func(node proto.NodeID) (uc *pconn, err error) {
+			if uc = current[node]; uc != nil {
+				delete(current, node)
+				return
+			}
+			uc = &pconn{
+				parent:  c,
+				pCaller: rpc.NewPersistentCaller(node),
 			}
+			if err = uc.startAckWorkers(2); err != nil {
+				uc.pCaller.Close()
+				uc, err = nil, errors.WithMessage(err, "startAckWorkers failed")
+			}
+			return
 		}
-	}
+	)
 
-	if c.leader == nil && c.follower == nil {
-		return nil, errors.New("no follower peers found")
+	if !c.useLeader && (!c.useFollower || len(peers.Servers) <= 1) {
+		return errors.New("no follower peers found")
 	}
-
 	if c.leader != nil {
-		if err := c.leader.startAckWorkers(2); err != nil {
-			return nil, errors.WithMessage(err, "leader startAckWorkers failed")
+		current[c.leader.pCaller.TargetID] = c.leader
+	}
+	for _, f := range c.followers {
+		current[f.pCaller.TargetID] = f
+	}
+
+	if c.useLeader {
+		if leader, err = connect(peers.Leader); err != nil {
+			return
 		}
 	}
-	if c.follower != nil {
-		if err := c.follower.startAckWorkers(2); err != nil {
-			return nil, errors.WithMessage(err, "follower startAckWorkers failed")
+	// read queries are spread across all follower nodes
+	if c.useFollower {
+		for _, node := range peers.Servers {
+			if node != peers.Leader {
+				var f *pconn
+				if f, err = connect(node); err != nil {
+					return
+				}
+				followers = append(followers, f)
+			}
 		}
 	}
 
-	log.WithField("db", c.dbID).Debug("new connection to database")
+	for _, uc := range current {
+		c.retired = append(c.retired, uc)
+	}
+	c.leader, c.followers = leader, followers
+	if len(c.followers) > 0 {
+		// start from a random follower to balance the load among connections
+		c.nextFollower = uint32(randSource.Intn(len(c.followers)))
+	}
 	return
 }
 
@@ -193,8 +252,15 @@ func (c *conn) Close() error {
 	if c.leader != nil {
 		c.leader.close()
 	}
-	if c.follower != nil {
-		c.follower.close()
+	for _, f := range c.followers {
+		f.close()
+	}
+	for _, r := range c.retired {
+		r.close()
+	}
+	if c.cursorConnID != 0 {
+		putBackConn(c.cursorConnID)
+		c.cursorConnID = 0
 	}
 	return nil
 }
@@ -245,6 +311,12 @@ func (c *conn) ExecContext(ctx context.Context, query string, args []driver.Name
 		return
 	}
 
+	if c.encryptor != nil {
+		if args, _, err = c.encryptor.encryptArgs(query, args); err != nil {
+			return
+		}
+	}
+
 	// TODO(xq262144): make use of the ctx argument
 	sq := convertQuery(query, args)
 
@@ -270,9 +342,18 @@ func (c *conn) QueryContext(ctx context.Context, query string, args []driver.Nam
 		return
 	}
 
+	var dec *resultDecrypter
+	if c.encryptor != nil {
+		if args, dec, err = c.encryptor.encryptArgs(query, args); err != nil {
+			return
+		}
+	}
+
 	// TODO(xq262144): make use of the ctx argument
 	sq := convertQuery(query, args)
-	_, _, rows, err = c.addQuery(ctx, types.ReadQuery, sq)
+	if _, _, rows, err = c.addQuery(ctx, types.ReadQuery, sq); err == nil && dec != nil {
+		rows = dec.wrap(rows)
+	}
 
 	return
 }
@@ -325,6 +406,11 @@ func (c *conn) Rollback() error {
 }
 
 func (c *conn) addQuery(ctx context.Context, queryType types.QueryType, query *types.Query) (affectedRows int64, lastInsertID int64, rows driver.Rows, err error) {
+	if queryType != types.ReadQuery && c.queryAsOfHeight(ctx) != 0 {
+		err = ErrWriteAsOfHeight
+		return
+	}
+
 	if c.inTransaction {
 		// check query type, enqueue query
 		if queryType == types.ReadQuery {
@@ -353,34 +439,150 @@ func (c *conn) addQuery(ctx context.Context, queryType types.QueryType, query *t
 }
 
 func (c *conn) sendQuery(ctx context.Context, queryType types.QueryType, queries []types.Query) (affectedRows int64, lastInsertID int64, rows driver.Rows, err error) {
-	var uc *pconn // peer connection used to execute the queries
+	var (
+		response *types.Response
+		cur      *cursor
+		req      *types.Request
+		batch    = c.queryCursorBatch(ctx, queryType, queries)
+	)
+
+	if req, err = c.buildRequest(ctx, queryType, queries, batch); err != nil {
+		return
+	}
+	if batch == 0 {
+		defer putBackConn(req.Header.ConnectionID)
+	}
+
+	// the request is resent as is on retries, so that the miners could recognize a duplicate
+	// write by its query key
+	for retries := 0; ; retries++ {
+		if response, cur, err = c.sendRequest(ctx, req, batch); err == nil {
+			break
+		}
+		class, leader := ClassifyError(err)
+		if class == PermanentError || retries >= MaxQueryRetries {
+			return
+		}
+		log.WithFields(log.Fields{
+			"db":      c.dbID,
+			"key":     req.Header.GetQueryKey(),
+			"class":   class.String(),
+			"leader":  leader,
+			"retries": retries,
+		}).WithError(err).Debug("query failed, retry with refreshed peers")
+		if waitRetry(ctx, retries) != nil {
+			// give up with the last query error
+			return
+		}
+		c.refreshPeers(leader)
+	}
+
+	var verification *Verification
+	if c.verify {
+		verification = verifyInclusion(c.dbID, c.privKey, &response.Header)
+	}
+	if cur != nil {
+		rows = newCursorRows(response, cur, batch)
+	} else {
+		rows = newRows(response, verification)
+	}
+
+	if queryType == types.WriteQuery {
+		affectedRows = response.Header.AffectedRows
+		lastInsertID = response.Header.LastInsertID
+	}
 
-	uc = c.leader
+	if info := responseInfoFromContext(ctx); info != nil {
+		info.NodeID = response.Header.NodeID
+		info.LogOffset = response.Header.LogOffset
+		info.AsOfHeight = response.Header.AsOfHeight
+		info.Verification = verification
+	}
+
+	return
+}
+
+// sendRequest sends the request to the leader, or the followers if the request is readonly.
+func (c *conn) sendRequest(
+	ctx context.Context, req *types.Request, batch int) (response *types.Response, cur *cursor, err error,
+) {
 	// use follower pconn only when the query is readonly
-	if queryType == types.ReadQuery && c.follower != nil {
-		uc = c.follower
+	if req.Header.QueryType == types.ReadQuery && len(c.followers) > 0 {
+		if response, cur, err = c.sendFollowerQuery(ctx, req, batch); err != nil && c.leader != nil &&
+			errors.Cause(err) != ErrRateLimitExceeded && !isQueryLimitError(err) {
+			log.WithField("db", c.dbID).WithError(err).Debug("follower read failed, fallback to leader")
+			response, cur, err = c.sendPeerQuery(ctx, c.leader, req, batch)
+		}
+	} else if c.leader != nil {
+		response, cur, err = c.sendPeerQuery(ctx, c.leader, req, batch)
+	} else {
+		response, cur, err = c.sendPeerQuery(ctx, c.pickFollower(), req, batch)
+	}
+	return
+}
+
+// sendFollowerQuery sends a read query to the next follower in turn, the follower rejects the
+// query before executing it if it lags behind the max staleness.
+func (c *conn) sendFollowerQuery(
+	ctx context.Context, req *types.Request, batch int) (response *types.Response, cur *cursor, err error,
+) {
+	return c.sendPeerQuery(ctx, c.pickFollower(), req, batch)
+}
+
+// minLogOffset returns the min log offset a node must have applied to serve the read query
+// within the max staleness, 0 means no bound.
+func (c *conn) minLogOffset(ctx context.Context, queryType types.QueryType) uint64 {
+	if queryType != types.ReadQuery || c.maxStaleness == 0 || c.queryAsOfHeight(ctx) != 0 {
+		// historical reads are not stale by design
+		return 0
 	}
-	if uc == nil {
-		uc = c.follower
+	if head := getLogOffset(c.dbID); head > c.maxStaleness {
+		return head - c.maxStaleness
 	}
+	return 0
+}
 
-	// allocate sequence
-	connID, seqNo := allocateConnAndSeq()
-	defer putBackConn(connID)
+// queryCursorBatch returns the batch size to stream the query results through a server-side
+// cursor, 0 means the results are returned at once.
+func (c *conn) queryCursorBatch(ctx context.Context, queryType types.QueryType, queries []types.Query) int {
+	if queryType != types.ReadQuery || len(queries) != 1 || c.verify || c.queryAsOfHeight(ctx) != 0 {
+		return 0
+	}
+	return c.cursorBatch
+}
 
-	defer func() {
-		log.WithFields(log.Fields{
-			"count":  len(queries),
-			"type":   queryType.String(),
-			"connID": connID,
-			"seqNo":  seqNo,
-			"target": uc.pCaller.TargetID,
-			"source": c.localNodeID,
-		}).WithError(err).Debug("send query")
-	}()
+// queryAsOfHeight returns the sqlchain height to read as of, the context setting takes precedence
+// over the DSN one.
+func (c *conn) queryAsOfHeight(ctx context.Context) int32 {
+	if height := asOfHeightFromContext(ctx); height != 0 {
+		return height
+	}
+	return c.asOfHeight
+}
 
-	// build request
-	req := &types.Request{
+// pickFollower returns the follower pconn to use in round-robin manner.
+func (c *conn) pickFollower() *pconn {
+	i := atomic.AddUint32(&c.nextFollower, 1)
+	return c.followers[int(i)%len(c.followers)]
+}
+
+// buildRequest builds and signs the request of queries. The connection id of the request should
+// be put back by the caller if batch is 0.
+func (c *conn) buildRequest(
+	ctx context.Context, queryType types.QueryType, queries []types.Query, batch int,
+) (
+	req *types.Request, err error,
+) {
+	var connID, seqNo uint64
+	if batch > 0 {
+		// open cursor on the stable connection
+		connID, seqNo = c.cursorConnID, atomic.AddUint64(&globalSeqNo, 1)
+	} else {
+		// allocate sequence
+		connID, seqNo = allocateConnAndSeq()
+	}
+
+	req = &types.Request{
 		Header: types.SignedRequestHeader{
 			RequestHeader: types.RequestHeader{
 				QueryType:    queryType,
@@ -389,6 +591,9 @@ func (c *conn) sendQuery(ctx context.Context, queryType types.QueryType, queries
 				ConnectionID: connID,
 				SeqNo:        seqNo,
 				Timestamp:    getLocalTime(),
+				AsOfHeight:   c.queryAsOfHeight(ctx),
+				Dialect:      c.dialect,
+				MinLogOffset: c.minLogOffset(ctx, queryType),
 			},
 		},
 		Payload: types.RequestPayload{
@@ -397,38 +602,93 @@ func (c *conn) sendQuery(ctx context.Context, queryType types.QueryType, queries
 	}
 
 	if err = req.Sign(c.privKey); err != nil {
-		return
+		if batch == 0 {
+			putBackConn(connID)
+		}
+		req = nil
 	}
+	return
+}
 
-	var response types.Response
-	if err = uc.pCaller.Call(route.DBSQuery.String(), req, &response); err != nil {
+func (c *conn) sendPeerQuery(
+	ctx context.Context, uc *pconn, req *types.Request, batch int,
+) (
+	response *types.Response, cur *cursor, err error,
+) {
+	defer func() {
+		log.WithFields(log.Fields{
+			"count":  len(req.Payload.Queries),
+			"type":   req.Header.QueryType.String(),
+			"connID": req.Header.ConnectionID,
+			"seqNo":  req.Header.SeqNo,
+			"target": uc.pCaller.TargetID,
+			"source": c.localNodeID,
+		}).WithError(err).Debug("send query")
+	}()
+
+	if batch > 0 {
+		var resp = new(types.OpenCursorResp)
+		err = uc.pCaller.Call(route.DBSOpenCursor.String(), &types.OpenCursorReq{
+			Request:   *req,
+			BatchSize: batch,
+		}, resp)
+		if err == nil {
+			response = &resp.Response
+			if resp.CursorID != 0 {
+				cur = &cursor{uc: uc, dbID: c.dbID, id: resp.CursorID, reqHash: req.Header.Hash()}
+			}
+		}
+	} else {
+		response = new(types.Response)
+		err = uc.pCaller.Call(route.DBSQuery.String(), req, response)
+	}
+	if err != nil {
+		if IsRateLimited(err) {
+			err = errors.Wrapf(ErrRateLimitExceeded, "query throttled by node %s", uc.pCaller.TargetID)
+		} else if qle, ok := IsQueryLimitExceeded(err); ok {
+			err = errors.Wrapf(qle, "query aborted by node %s", uc.pCaller.TargetID)
+		}
+		response = nil
 		return
 	}
-	rows = newRows(&response)
+	if c.verify {
+		if err = verifyResponse(response, uc.pCaller.TargetID); err != nil {
+			response = nil
+			return
+		}
+	}
+	if response.Header.AsOfHeight == 0 {
+		observeLogOffset(c.dbID, response.Header.LogOffset)
+	}
 
-	if queryType == types.WriteQuery {
-		affectedRows = response.Header.AffectedRows
-		lastInsertID = response.Header.LastInsertID
+	if cur != nil {
+		// the whole cursor is acknowledged once it's closed
+		return
 	}
 
 	// build ack
 	func() {
 		defer trace.StartRegion(ctx, "ackEnqueue").End()
-		uc.ackCh <- &types.Ack{
-			Header: types.SignedAckHeader{
-				AckHeader: types.AckHeader{
-					Response:     response.Header.ResponseHeader,
-					ResponseHash: response.Header.Hash(),
-					NodeID:       c.localNodeID,
-					Timestamp:    getLocalTime(),
-				},
-			},
-		}
+		uc.ack(&response.Header)
 	}()
 
 	return
 }
 
+// ack enqueues the ack of the response header, which is signed and sent by the ack workers.
+func (c *pconn) ack(header *types.SignedResponseHeader) {
+	c.ackCh <- &types.Ack{
+		Header: types.SignedAckHeader{
+			AckHeader: types.AckHeader{
+				Response:     header.ResponseHeader,
+				ResponseHash: header.Hash(),
+				NodeID:       c.parent.localNodeID,
+				Timestamp:    getLocalTime(),
+			},
+		},
+	}
+}
+
 func getLocalTime() time.Time {
 	return time.Now().UTC()
 }
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"database/sql/driver"
+
+	"github.com/pkg/errors"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// cursor is a server-side cursor of read query opened on the peer.
+type cursor struct {
+	uc      *pconn
+	dbID    proto.DatabaseID
+	id      uint64
+	reqHash hash.Hash
+}
+
+func (cur *cursor) fetch(batch int) (rows []types.ResponseRow, done bool, err error) {
+	var (
+		req = &types.FetchCursorReq{
+			DatabaseID: cur.dbID,
+			CursorID:   cur.id,
+			BatchSize:  batch,
+		}
+		resp = &types.FetchCursorResp{}
+	)
+	if err = cur.uc.pCaller.Call(route.DBSFetchCursor.String(), req, resp); err != nil {
+		if qle, ok := IsQueryLimitExceeded(err); ok {
+			err = errors.Wrapf(qle, "query aborted by node %s", cur.uc.pCaller.TargetID)
+		}
+		return
+	}
+	if resp.Done {
+		cur.ack(resp.Response)
+	}
+	return resp.Rows, resp.Done, nil
+}
+
+func (cur *cursor) close() (err error) {
+	req := &types.CloseCursorReq{
+		DatabaseID: cur.dbID,
+		CursorID:   cur.id,
+	}
+	resp := &types.CloseCursorResp{}
+	if err = cur.uc.pCaller.Call(route.DBSCloseCursor.String(), req, resp); err != nil {
+		log.WithFields(log.Fields{
+			"db":     cur.dbID,
+			"cursor": cur.id,
+			"target": cur.uc.pCaller.TargetID,
+		}).WithError(err).Debug("close cursor failed")
+		return
+	}
+	cur.ack(resp.Response)
+	return
+}
+
+// ack acknowledges the response of the whole cursor, which accounts the rows and cost of all the
+// fetched batches.
+func (cur *cursor) ack(header *types.SignedResponseHeader) {
+	if header == nil {
+		return
+	}
+	if err := header.Verify(); err != nil || header.RequestHash != cur.reqHash {
+		log.WithFields(log.Fields{
+			"db":     cur.dbID,
+			"cursor": cur.id,
+			"target": cur.uc.pCaller.TargetID,
+		}).WithError(err).Debug("invalid cursor response")
+		return
+	}
+	cur.uc.ack(header)
+}
+
+// cursorRows streams the result rows of a server-side cursor, the following rows are fetched in
+// batches once the buffered rows are consumed.
+type cursorRows struct {
+	*rows
+	cur   *cursor
+	batch int
+}
+
+func newCursorRows(res *types.Response, cur *cursor, batch int) *cursorRows {
+	return &cursorRows{
+		rows:  newRows(res, nil),
+		cur:   cur,
+		batch: batch,
+	}
+}
+
+// Close implements driver.Rows.Close method.
+func (r *cursorRows) Close() (err error) {
+	r.rows.Close()
+	if r.cur != nil {
+		err = r.cur.close()
+		r.cur = nil
+	}
+	return
+}
+
+// Next implements driver.Rows.Next method.
+func (r *cursorRows) Next(dest []driver.Value) error {
+	for len(r.data) == 0 && r.cur != nil {
+		data, done, err := r.cur.fetch(r.batch)
+		if err != nil {
+			// the cursor is closed by the peer on failure or expired
+			r.cur = nil
+			return err
+		}
+		if done {
+			r.cur = nil
+		}
+		r.data = data
+	}
+	return r.rows.Next(dest)
+}
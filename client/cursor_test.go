@@ -0,0 +1,74 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"database/sql"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCursor(t *testing.T) {
+	Convey("test streaming read through cursors", t, func() {
+		var stopTestService func()
+		var err error
+		stopTestService, _, err = startTestService()
+		So(err, ShouldBeNil)
+		defer stopTestService()
+
+		var db *sql.DB
+		db, err = sql.Open("covenantsql", "covenantsql://db?cursor_batch=2")
+		So(err, ShouldBeNil)
+		defer db.Close()
+
+		_, err = db.Exec("create table test_cursor (k int, v text)")
+		So(err, ShouldBeNil)
+		_, err = db.Exec("insert into test_cursor values (1, 'a'), (2, 'b'), (3, 'c'), (4, 'd'), (5, 'e')")
+		So(err, ShouldBeNil)
+
+		// all the rows are fetched in batches
+		rows, err := db.Query("select k, v from test_cursor order by k")
+		So(err, ShouldBeNil)
+		var keys []int
+		for rows.Next() {
+			var (
+				k int
+				v string
+			)
+			So(rows.Scan(&k, &v), ShouldBeNil)
+			keys = append(keys, k)
+		}
+		So(rows.Err(), ShouldBeNil)
+		So(rows.Close(), ShouldBeNil)
+		So(keys, ShouldResemble, []int{1, 2, 3, 4, 5})
+
+		// close the cursor before all the rows are fetched
+		for i := 0; i < 8; i++ {
+			rows, err = db.Query("select k from test_cursor")
+			So(err, ShouldBeNil)
+			So(rows.Next(), ShouldBeTrue)
+			So(rows.Close(), ShouldBeNil)
+		}
+
+		// results within a batch are returned at once
+		var count int
+		err = db.QueryRow("select count(1) from test_cursor").Scan(&count)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 5)
+	})
+}
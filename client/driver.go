@@ -56,10 +56,13 @@ const (
 var (
 	// PeersUpdateInterval defines peers list refresh interval for client.
 	PeersUpdateInterval = time.Second * 5
+	// QueryPeersTimeout defines the timeout to query the live peers from database miners.
+	QueryPeersTimeout = time.Second * 3
 
 	driverInitialized   uint32
 	peersUpdaterRunning uint32
 	peerList            sync.Map // map[proto.DatabaseID]*proto.Peers
+	logOffsets          sync.Map // map[proto.DatabaseID]*uint64
 	connIDLock          sync.Mutex
 	connIDAvail         []uint64
 	globalSeqNo         uint64
@@ -246,6 +249,41 @@ func Drop(dsn string) (err error) {
 	return
 }
 
+// QueryUsage returns the resource usage of the database reported by the database leader.
+func QueryUsage(dsn string) (usage *types.DatabaseUsage, err error) {
+	if atomic.LoadUint32(&driverInitialized) == 0 {
+		err = ErrNotInitialized
+		return
+	}
+
+	var cfg *Config
+	if cfg, err = ParseDSN(dsn); err != nil {
+		return
+	}
+
+	var privKey *asymmetric.PrivateKey
+	if privKey, err = kms.GetLocalPrivateKey(); err != nil {
+		return
+	}
+
+	dbID := proto.DatabaseID(cfg.DatabaseID)
+
+	var peers *proto.Peers
+	if peers, err = getPeers(dbID, privKey); err != nil {
+		return
+	}
+
+	req := &types.QueryUsageReq{DatabaseID: dbID}
+	resp := &types.QueryUsageResp{}
+	if err = rpc.NewCaller().CallNode(peers.Leader, route.DBSQueryUsage.String(), req, resp); err != nil {
+		err = errors.Wrap(err, "call database usage query failed")
+		return
+	}
+
+	usage = &resp.Usage
+	return
+}
+
 // GetTokenBalance get the token balance of current account.
 func GetTokenBalance(tt types.TokenType) (balance uint64, err error) {
 	if atomic.LoadUint32(&driverInitialized) == 0 {
@@ -505,6 +543,7 @@ func runPeerListUpdater() (err error) {
 							log.WithField("db", dbID).
 								Warning("database no longer exists, stopping peers update")
 							peerList.Delete(dbID)
+							logOffsets.Delete(dbID)
 						}
 					}
 				}(dbID)
@@ -579,8 +618,11 @@ func getPeers(dbID proto.DatabaseID, privKey *asymmetric.PrivateKey) (peers *pro
 			Servers: nodeIDs[:],
 		},
 	}
-	err = peers.Sign(privKey)
-	if err != nil {
+
+	// follow the leader elected by miners, the live peers are signed by the leader
+	if live := queryLivePeers(dbID, nodeIDs); live != nil {
+		peers = live
+	} else if err = peers.Sign(privKey); err != nil {
 		err = errors.Wrap(err, "sign peers failed in getPeers")
 		return
 	}
@@ -591,6 +633,126 @@ func getPeers(dbID proto.DatabaseID, privKey *asymmetric.PrivateKey) (peers *pro
 	return
 }
 
+// queryLivePeers returns the verified peers of the latest term agreed by a majority of the database
+// miners, the servers of the returned peers are ensured to be the registered miners.
+func queryLivePeers(dbID proto.DatabaseID, servers []proto.NodeID) (peers *proto.Peers) {
+	var (
+		respCh      = make(chan *proto.Peers, len(servers))
+		replies     = make([]*proto.Peers, 0, len(servers))
+		ctx, cancel = context.WithTimeout(context.Background(), QueryPeersTimeout)
+	)
+	defer cancel()
+
+	for _, s := range servers {
+		go func(s proto.NodeID) {
+			var live *proto.Peers
+			defer func() { respCh <- live }()
+
+			req := &types.QueryPeersReq{DatabaseID: dbID}
+			resp := &types.QueryPeersResp{}
+			if err := rpc.NewCaller().CallNodeWithContext(
+				ctx, s, route.DBSQueryPeers.String(), req, resp,
+			); err != nil {
+				log.WithFields(log.Fields{
+					"db":   dbID,
+					"node": s,
+				}).WithError(err).Debug("query peers from miner failed")
+				return
+			}
+			if resp.Peers == nil {
+				return
+			}
+			if err := verifyPeers(resp.Peers); err != nil {
+				log.WithFields(log.Fields{
+					"db":   dbID,
+					"node": s,
+				}).WithError(err).Warning("untrusted peers reported by miner")
+				return
+			}
+			live = resp.Peers
+		}(s)
+	}
+
+collectLoop:
+	for range servers {
+		select {
+		case <-ctx.Done():
+			break collectLoop
+		case live := <-respCh:
+			if live != nil {
+				replies = append(replies, live)
+			}
+		}
+	}
+
+	return agreedPeers(servers, replies)
+}
+
+// agreedPeers returns the peers of the latest term reported by a majority of servers, the peers
+// must have the same servers as registered, a single miner could not pin the term by itself.
+func agreedPeers(servers []proto.NodeID, replies []*proto.Peers) (peers *proto.Peers) {
+	var (
+		quorum = len(servers)/2 + 1
+		agreed = make(map[hash.Hash]int)
+	)
+	for _, live := range replies {
+		if live == nil || !isServer(servers, live.Leader) || !sameServers(servers, live.Servers) {
+			continue
+		}
+		agreed[live.DataHash]++
+		if agreed[live.DataHash] >= quorum && (peers == nil || live.Term > peers.Term) {
+			peers = live
+		}
+	}
+	return
+}
+
+// verifyPeers verifies the peers are signed by the leader, or by the block producer which signs
+// the initial peers of the database.
+func verifyPeers(peers *proto.Peers) (err error) {
+	if err = peers.Verify(); err != nil {
+		return
+	}
+	if kms.BP != nil && kms.BP.PublicKey != nil && kms.BP.PublicKey.IsEqual(peers.Signee) {
+		return
+	}
+	var nodeInfo *proto.Node
+	if nodeInfo, err = rpc.GetNodeInfo(peers.Leader.ToRawNodeID()); err != nil {
+		return
+	}
+	if !nodeInfo.PublicKey.IsEqual(peers.Signee) {
+		err = errors.Wrapf(ErrUntrustedPeers, "peers of term %d not signed by leader %s", peers.Term, peers.Leader)
+	}
+	return
+}
+
+func isServer(servers []proto.NodeID, node proto.NodeID) bool {
+	for _, s := range servers {
+		if s.IsEqual(&node) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameServers reports whether the two server lists have the same members.
+func sameServers(a, b []proto.NodeID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, s := range b {
+		if !isServer(a, s) {
+			return false
+		}
+	}
+	for _, s := range a {
+		if !isServer(b, s) {
+			return false
+		}
+	}
+	return true
+}
+
 func allocateConnAndSeq() (connID uint64, seqNo uint64) {
 	connIDLock.Lock()
 	defer connIDLock.Unlock()
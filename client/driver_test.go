@@ -133,3 +133,43 @@ func TestGetTokenBalance(t *testing.T) {
 		So(err, ShouldEqual, ErrNoSuchTokenBalance)
 	})
 }
+
+func TestAgreedPeers(t *testing.T) {
+	Convey("test peers agreed by majority of servers", t, func() {
+		node1 := proto.NodeID("000005aa62048f85da4ae9698ed59c14ec0d48a88a07c15a32265634e7e64ade")
+		node2 := proto.NodeID("000005f4f22c06f76c43c4f48d5a7ec1309cc94030cbf9ebae814172884ac8b5")
+		node3 := proto.NodeID("000003f49592f83d0473bddb70d543f1096b4ffed5e5f942a3117e256b7052b8")
+		servers := []proto.NodeID{node1, node2, node3}
+
+		privKey, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		newPeers := func(term uint64, leader proto.NodeID, servers ...proto.NodeID) *proto.Peers {
+			p := &proto.Peers{
+				PeersHeader: proto.PeersHeader{
+					Term:    term,
+					Leader:  leader,
+					Servers: servers,
+				},
+			}
+			So(p.Sign(privKey), ShouldBeNil)
+			return p
+		}
+
+		term1 := newPeers(1, node2, node1, node2, node3)
+		term2 := newPeers(2, node3, node3, node2, node1)
+
+		// single miner could not pin the term
+		So(agreedPeers(servers, []*proto.Peers{term1, newPeers(9, node1, servers...)}), ShouldBeNil)
+		So(agreedPeers(servers, []*proto.Peers{
+			term1, term1, newPeers(9, node1, servers...),
+		}), ShouldEqual, term1)
+		So(agreedPeers(servers, []*proto.Peers{term1, term2, term2, term1}), ShouldEqual, term2)
+
+		// servers must be the registered miners
+		changed := newPeers(3, node1, node1, node2)
+		So(agreedPeers(servers, []*proto.Peers{changed, changed, changed}), ShouldBeNil)
+		outsider := proto.NodeID("0000000000000000000000000000000000000000000000000000000000000001")
+		foreign := newPeers(3, outsider, node1, node2, node3)
+		So(agreedPeers(servers, []*proto.Peers{foreign, foreign, foreign}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,586 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/CovenantSQL/sqlparser"
+	"github.com/pkg/errors"
+)
+
+// EncryptionMode defines the client-side encryption mode of a column.
+type EncryptionMode int
+
+const (
+	// RandomizedEncryption encrypts the same value to different cipher texts, the column could
+	// not be looked up by value.
+	RandomizedEncryption EncryptionMode = iota + 1
+	// DeterministicEncryption encrypts the same value to the same cipher text, so that the column
+	// could be looked up by equality.
+	DeterministicEncryption
+)
+
+// String implements fmt.Stringer.
+func (m EncryptionMode) String() string {
+	switch m {
+	case RandomizedEncryption:
+		return "randomized"
+	case DeterministicEncryption:
+		return "deterministic"
+	default:
+		return "unknown"
+	}
+}
+
+// ColumnEncryption defines the client-side encryption of a table column.
+type ColumnEncryption struct {
+	Table  string
+	Column string
+	Mode   EncryptionMode
+}
+
+// String implements fmt.Stringer, which is also the DSN format of the column encryption.
+func (e ColumnEncryption) String() string {
+	return e.Table + "." + e.Column + ":" + e.Mode.String()
+}
+
+// parseColumnEncryptions parses the comma separated column encryptions in format of
+// "table.column[:mode]", the mode defaults to randomized.
+func parseColumnEncryptions(s string) (columns []ColumnEncryption, err error) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		var (
+			e    = ColumnEncryption{Mode: RandomizedEncryption}
+			name = v
+		)
+		if i := strings.LastIndex(v, ":"); i >= 0 {
+			name = v[:i]
+			switch strings.ToLower(v[i+1:]) {
+			case "randomized":
+			case "deterministic":
+				e.Mode = DeterministicEncryption
+			default:
+				return nil, errors.Wrapf(ErrColumnEncryption, "unknown encryption mode in %s", v)
+			}
+		}
+		if i := strings.Index(name, "."); i > 0 && i < len(name)-1 {
+			e.Table, e.Column = name[:i], name[i+1:]
+		} else {
+			return nil, errors.Wrapf(ErrColumnEncryption, "invalid encrypted column %s", v)
+		}
+		columns = append(columns, e)
+	}
+	return
+}
+
+func formatColumnEncryptions(columns []ColumnEncryption) string {
+	var s = make([]string, len(columns))
+	for i, v := range columns {
+		s[i] = v.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// encryptedValueMagic leads the cipher text of encrypted values.
+const encryptedValueMagic byte = 0xce
+
+// encoded value types in plain text.
+const (
+	valueInt64 byte = iota + 1
+	valueFloat64
+	valueBool
+	valueBytes
+	valueString
+	valueTime
+)
+
+// columnCipher encrypts and decrypts the values of an encrypted column.
+type columnCipher struct {
+	name     string
+	mode     EncryptionMode
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+func deriveColumnKey(secret []byte, purpose, name string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+func newColumnCipher(secret []byte, e ColumnEncryption) (c *columnCipher, err error) {
+	var (
+		name  = strings.ToLower(e.Table + "." + e.Column)
+		block cipher.Block
+	)
+	if e.Mode != RandomizedEncryption && e.Mode != DeterministicEncryption {
+		return nil, errors.Wrapf(ErrColumnEncryption, "unknown encryption mode of column %s", name)
+	}
+	c = &columnCipher{
+		name:     name,
+		mode:     e.Mode,
+		nonceKey: deriveColumnKey(secret, "nonce", name),
+	}
+	if block, err = aes.NewCipher(deriveColumnKey(secret, "data", name)); err != nil {
+		return
+	}
+	c.aead, err = cipher.NewGCM(block)
+	return
+}
+
+// encrypt encrypts the value, a NULL value is kept as is.
+func (c *columnCipher) encrypt(v driver.Value) (out driver.Value, err error) {
+	var plain []byte
+	if v == nil {
+		return
+	}
+	if plain, err = encodeValue(v); err != nil {
+		return nil, errors.Wrapf(ErrColumnEncryption, "%v of column %s", err, c.name)
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if c.mode == DeterministicEncryption {
+		// synthetic nonce, the same plain text always produces the same cipher text
+		mac := hmac.New(sha256.New, c.nonceKey)
+		mac.Write(plain)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return
+	}
+	sealed := make([]byte, 0, 2+len(nonce)+len(plain)+c.aead.Overhead())
+	sealed = append(sealed, encryptedValueMagic, byte(c.mode))
+	sealed = append(sealed, nonce...)
+	return c.aead.Seal(sealed, nonce, plain, []byte(c.name)), nil
+}
+
+// decrypt decrypts the value encrypted by the cipher, a NULL value is kept as is.
+func (c *columnCipher) decrypt(v driver.Value) (out driver.Value, err error) {
+	if v == nil {
+		return
+	}
+	var (
+		sealed, ok = v.([]byte)
+		size       = 2 + c.aead.NonceSize()
+		plain      []byte
+	)
+	if !ok || len(sealed) < size+c.aead.Overhead() || sealed[0] != encryptedValueMagic {
+		return nil, errors.Wrapf(ErrColumnEncryption, "unencrypted value of column %s", c.name)
+	}
+	if plain, err = c.aead.Open(nil, sealed[2:size], sealed[size:], []byte(c.name)); err != nil {
+		return nil, errors.Wrapf(ErrColumnEncryption, "decrypt value of column %s failed", c.name)
+	}
+	if out, err = decodeValue(plain); err != nil {
+		return nil, errors.Wrapf(ErrColumnEncryption, "%v of column %s", err, c.name)
+	}
+	return
+}
+
+func encodeValue(v driver.Value) (plain []byte, err error) {
+	switch v := v.(type) {
+	case int64:
+		plain = make([]byte, 9)
+		plain[0] = valueInt64
+		binary.BigEndian.PutUint64(plain[1:], uint64(v))
+	case float64:
+		plain = make([]byte, 9)
+		plain[0] = valueFloat64
+		binary.BigEndian.PutUint64(plain[1:], math.Float64bits(v))
+	case bool:
+		plain = []byte{valueBool, 0}
+		if v {
+			plain[1] = 1
+		}
+	case []byte:
+		plain = append([]byte{valueBytes}, v...)
+	case string:
+		plain = append([]byte{valueString}, v...)
+	case time.Time:
+		var b []byte
+		if b, err = v.MarshalBinary(); err != nil {
+			return
+		}
+		plain = append([]byte{valueTime}, b...)
+	default:
+		err = fmt.Errorf("unsupported value type %T", v)
+	}
+	return
+}
+
+func decodeValue(plain []byte) (v driver.Value, err error) {
+	if len(plain) == 0 {
+		return nil, errors.New("empty value")
+	}
+	var data = plain[1:]
+	switch plain[0] {
+	case valueInt64, valueFloat64:
+		if len(data) != 8 {
+			return nil, errors.New("malformed number value")
+		}
+		if u := binary.BigEndian.Uint64(data); plain[0] == valueInt64 {
+			v = int64(u)
+		} else {
+			v = math.Float64frombits(u)
+		}
+	case valueBool:
+		if len(data) != 1 {
+			return nil, errors.New("malformed bool value")
+		}
+		v = data[0] != 0
+	case valueBytes:
+		v = append([]byte{}, data...)
+	case valueString:
+		v = string(data)
+	case valueTime:
+		var t time.Time
+		if err = t.UnmarshalBinary(data); err != nil {
+			return
+		}
+		v = t
+	default:
+		err = fmt.Errorf("unknown value type %d", plain[0])
+	}
+	return
+}
+
+// columnEncryptor encrypts the query arguments bound to the encrypted columns and decrypts the
+// query results of them.
+type columnEncryptor struct {
+	// ciphers by lowered table and column names
+	ciphers map[string]map[string]*columnCipher
+}
+
+func newColumnEncryptor(key string, columns []ColumnEncryption) (e *columnEncryptor, err error) {
+	if len(columns) == 0 {
+		return
+	}
+	if key == "" {
+		return nil, errors.Wrap(ErrColumnEncryption, "missing column encryption key")
+	}
+	e = &columnEncryptor{ciphers: make(map[string]map[string]*columnCipher)}
+	for _, v := range columns {
+		var c *columnCipher
+		if c, err = newColumnCipher([]byte(key), v); err != nil {
+			return nil, err
+		}
+		table := strings.ToLower(v.Table)
+		if e.ciphers[table] == nil {
+			e.ciphers[table] = make(map[string]*columnCipher)
+		}
+		e.ciphers[table][strings.ToLower(v.Column)] = c
+	}
+	return
+}
+
+// encryptArgs encrypts the arguments of query bound to the encrypted columns, and returns the
+// decrypter of the query results, which is nil if no encrypted column is selected.
+//
+// An argument is bound to a column if it's assigned to the column by INSERT or UPDATE, or compared
+// with the column by equality. Both the named arguments and the positional ones are supported, and
+// any other expression assigned to or compared with an encrypted column is rejected.
+func (e *columnEncryptor) encryptArgs(query string, args []driver.NamedValue) (
+	out []driver.NamedValue, dec *resultDecrypter, err error,
+) {
+	var statements []sqlparser.Statement
+	if _, statements, err = sqlparser.ParseMultiple(sqlparser.NewStringTokenizer(query)); err != nil {
+		return nil, nil, errors.Wrapf(ErrColumnEncryption, "unrecognized query %s: %v", query, err)
+	}
+	var bound = make(map[string]*columnCipher)
+	for _, stmt := range statements {
+		b := &argBinder{enc: e, tables: make(map[string]string), bound: bound}
+		if err = b.bindStatement(stmt); err != nil {
+			return nil, nil, errors.Wrapf(ErrColumnEncryption, "%v in query %s", err, query)
+		}
+		if len(statements) == 1 {
+			dec = b.resultDecrypter(stmt)
+		}
+	}
+	out = make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		var name = v.Name
+		if name == "" {
+			// positional arguments are named by order in parser
+			name = fmt.Sprintf("v%d", v.Ordinal)
+		}
+		out[i] = v
+		if c, ok := bound[strings.ToLower(name)]; ok {
+			if out[i].Value, err = c.encrypt(v.Value); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return
+}
+
+// argBinder binds the query arguments to the encrypted columns in a parsed statement.
+type argBinder struct {
+	enc *columnEncryptor
+	// real tables by lowered name and alias
+	tables map[string]string
+	bound  map[string]*columnCipher
+}
+
+func (b *argBinder) bindStatement(stmt sqlparser.Statement) (err error) {
+	// collect table references
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if n, ok := node.(*sqlparser.AliasedTableExpr); ok {
+			if t, ok := n.Expr.(sqlparser.TableName); ok {
+				name := strings.ToLower(t.Name.String())
+				b.tables[name] = name
+				if !n.As.IsEmpty() {
+					b.tables[strings.ToLower(n.As.String())] = name
+				}
+			}
+		}
+		return true, nil
+	}, stmt)
+	if s, ok := stmt.(*sqlparser.Insert); ok {
+		table := strings.ToLower(s.Table.Name.String())
+		b.tables[table] = table
+		if err = b.bindInsert(table, s); err != nil {
+			return
+		}
+	}
+	return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.UpdateExpr:
+			return true, b.bind(n.Name, n.Expr)
+		case *sqlparser.ComparisonExpr:
+			var (
+				col, lok = n.Left.(*sqlparser.ColName)
+				val      = n.Right
+			)
+			if !lok {
+				if col, lok = n.Right.(*sqlparser.ColName); !lok {
+					return true, nil
+				}
+				val = n.Left
+			}
+			c, err := b.resolve(col)
+			if err != nil || c == nil {
+				return true, err
+			}
+			switch {
+			case c.mode != DeterministicEncryption:
+				return false, fmt.Errorf("randomized encrypted column %s compared", c.name)
+			case n.Operator != sqlparser.EqualStr && n.Operator != sqlparser.NotEqualStr &&
+				n.Operator != sqlparser.NullSafeEqualStr && n.Operator != sqlparser.NullSafeNotEqualStr &&
+				n.Operator != sqlparser.InStr && n.Operator != sqlparser.NotInStr:
+				return false, fmt.Errorf("encrypted column %s compared by %s", c.name, n.Operator)
+			}
+			return true, b.bindCipher(c, val)
+		case *sqlparser.RangeCond:
+			if col, ok := n.Left.(*sqlparser.ColName); ok {
+				if c, err := b.resolve(col); err != nil || c != nil {
+					if err == nil {
+						err = fmt.Errorf("encrypted column %s compared by %s", c.name, n.Operator)
+					}
+					return false, err
+				}
+			}
+		}
+		return true, nil
+	}, stmt)
+}
+
+func (b *argBinder) bindInsert(table string, s *sqlparser.Insert) (err error) {
+	var ciphers = b.enc.ciphers[table]
+	if len(ciphers) == 0 {
+		return
+	}
+	if len(s.Columns) == 0 {
+		return fmt.Errorf("column list is required to insert into table %s", table)
+	}
+	rows, ok := s.Rows.(sqlparser.Values)
+	if !ok {
+		// the selected values are neither bound nor encrypted
+		for _, col := range s.Columns {
+			if c := ciphers[col.Lowered()]; c != nil {
+				return fmt.Errorf("encrypted column %s inserted by select", c.name)
+			}
+		}
+		return
+	}
+	for _, row := range rows {
+		for i, col := range s.Columns {
+			if c := ciphers[col.Lowered()]; c != nil && i < len(row) {
+				if err = b.bindCipher(c, row[i]); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// resolve returns the cipher of the column, which is nil if the column is not encrypted.
+func (b *argBinder) resolve(col *sqlparser.ColName) (c *columnCipher, err error) {
+	var name = col.Name.Lowered()
+	if !col.Qualifier.IsEmpty() {
+		return b.enc.ciphers[b.tables[strings.ToLower(col.Qualifier.Name.String())]][name], nil
+	}
+	for _, table := range b.tables {
+		if v := b.enc.ciphers[table][name]; v != nil {
+			if c != nil && c != v {
+				return nil, fmt.Errorf("ambiguous encrypted column %s", name)
+			}
+			c = v
+		}
+	}
+	return
+}
+
+func (b *argBinder) bind(col *sqlparser.ColName, expr sqlparser.Expr) (err error) {
+	var c *columnCipher
+	if c, err = b.resolve(col); err != nil || c == nil {
+		return
+	}
+	return b.bindCipher(c, expr)
+}
+
+// bindCipher binds the arguments in expr to the encrypted column c. The expr must be a bare
+// argument, a tuple of arguments, NULL or the column of the same cipher, any other expression
+// would pass the plain text of the arguments to the miners.
+func (b *argBinder) bindCipher(c *columnCipher, expr sqlparser.Expr) (err error) {
+	switch e := expr.(type) {
+	case sqlparser.ValTuple:
+		for _, v := range e {
+			if err = b.bindCipher(c, v); err != nil {
+				return
+			}
+		}
+	case *sqlparser.ParenExpr:
+		return b.bindCipher(c, e.Expr)
+	case *sqlparser.NullVal:
+	case *sqlparser.ColName:
+		var v *columnCipher
+		if v, err = b.resolve(e); err != nil {
+			return
+		}
+		if v != c {
+			return fmt.Errorf("encrypted column %s compared with column %s", c.name, e.Name.String())
+		}
+	case *sqlparser.SQLVal:
+		if e.Type != sqlparser.ValArg {
+			// the plain text would be exposed to the miners
+			return fmt.Errorf("literal value of encrypted column %s", c.name)
+		}
+		name := strings.ToLower(strings.TrimLeft(string(e.Val), ":"))
+		if v, ok := b.bound[name]; ok && v != c {
+			return fmt.Errorf("argument %s bound to encrypted columns %s and %s", name, v.name, c.name)
+		}
+		b.bound[name] = c
+	default:
+		return fmt.Errorf("expression %s of encrypted column %s", sqlparser.String(expr), c.name)
+	}
+	return
+}
+
+// resultDecrypter returns the decrypter of the encrypted columns selected by stmt.
+func (b *argBinder) resultDecrypter(stmt sqlparser.Statement) (dec *resultDecrypter) {
+	s, ok := stmt.(*sqlparser.Select)
+	if !ok {
+		return
+	}
+	var ciphers = make(map[string]*columnCipher)
+	for _, expr := range s.SelectExprs {
+		switch e := expr.(type) {
+		case *sqlparser.StarExpr:
+			for alias, table := range b.tables {
+				if !e.TableName.IsEmpty() && alias != strings.ToLower(e.TableName.Name.String()) {
+					continue
+				}
+				for col, c := range b.enc.ciphers[table] {
+					ciphers[col] = c
+				}
+			}
+		case *sqlparser.AliasedExpr:
+			if col, ok := e.Expr.(*sqlparser.ColName); ok {
+				if c, err := b.resolve(col); err == nil && c != nil {
+					name := col.Name.Lowered()
+					if !e.As.IsEmpty() {
+						name = e.As.Lowered()
+					}
+					ciphers[name] = c
+				}
+			}
+		}
+	}
+	if len(ciphers) > 0 {
+		dec = &resultDecrypter{ciphers: ciphers}
+	}
+	return
+}
+
+// resultDecrypter decrypts the encrypted columns in query results by column name.
+type resultDecrypter struct {
+	ciphers map[string]*columnCipher
+}
+
+func (d *resultDecrypter) wrap(r driver.Rows) driver.Rows {
+	var (
+		columns = r.Columns()
+		ciphers = make([]*columnCipher, len(columns))
+	)
+	for i, v := range columns {
+		ciphers[i] = d.ciphers[strings.ToLower(v)]
+	}
+	return &decryptedRows{Rows: r, ciphers: ciphers}
+}
+
+// decryptedRows decrypts the encrypted columns of the underlying rows.
+type decryptedRows struct {
+	driver.Rows
+	ciphers []*columnCipher
+}
+
+// Next implements driver.Rows.Next method.
+func (r *decryptedRows) Next(dest []driver.Value) (err error) {
+	if err = r.Rows.Next(dest); err != nil {
+		return
+	}
+	for i, c := range r.ciphers {
+		if c != nil && i < len(dest) {
+			if dest[i], err = c.decrypt(dest[i]); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// ColumnTypeDatabaseTypeName implements driver.RowsColumnTypeDatabaseTypeName.ColumnTypeDatabaseTypeName method.
+func (r *decryptedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if t, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return t.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestColumnCipher(t *testing.T) {
+	Convey("test column cipher", t, func() {
+		det, err := newColumnCipher([]byte("key"), ColumnEncryption{
+			Table: "users", Column: "email", Mode: DeterministicEncryption,
+		})
+		So(err, ShouldBeNil)
+		rnd, err := newColumnCipher([]byte("key"), ColumnEncryption{
+			Table: "users", Column: "ssn", Mode: RandomizedEncryption,
+		})
+		So(err, ShouldBeNil)
+		_, err = newColumnCipher([]byte("key"), ColumnEncryption{Table: "users", Column: "x"})
+		So(errors.Cause(err), ShouldEqual, ErrColumnEncryption)
+
+		now := time.Now()
+		for _, v := range []driver.Value{
+			int64(-42), 3.14, true, false, []byte("bytes"), "string", now,
+		} {
+			for _, c := range []*columnCipher{det, rnd} {
+				sealed, err := c.encrypt(v)
+				So(err, ShouldBeNil)
+				So(sealed, ShouldHaveSameTypeAs, []byte{})
+				plain, err := c.decrypt(sealed)
+				So(err, ShouldBeNil)
+				if tm, ok := v.(time.Time); ok {
+					So(plain.(time.Time).Equal(tm), ShouldBeTrue)
+				} else {
+					So(plain, ShouldResemble, v)
+				}
+			}
+		}
+
+		// NULL is kept as is
+		sealed, err := det.encrypt(nil)
+		So(err, ShouldBeNil)
+		So(sealed, ShouldBeNil)
+		plain, err := det.decrypt(nil)
+		So(err, ShouldBeNil)
+		So(plain, ShouldBeNil)
+		_, err = det.encrypt(uint8(1))
+		So(errors.Cause(err), ShouldEqual, ErrColumnEncryption)
+
+		// deterministic encryption produces the same cipher text
+		s1, err := det.encrypt("a@b.c")
+		So(err, ShouldBeNil)
+		s2, err := det.encrypt("a@b.c")
+		So(err, ShouldBeNil)
+		So(s1, ShouldResemble, s2)
+		s1, err = rnd.encrypt("123")
+		So(err, ShouldBeNil)
+		s2, err = rnd.encrypt("123")
+		So(err, ShouldBeNil)
+		So(s1, ShouldNotResemble, s2)
+
+		// cipher text is bound to the column and the key
+		other, err := newColumnCipher([]byte("key"), ColumnEncryption{
+			Table: "users", Column: "ssn2", Mode: RandomizedEncryption,
+		})
+		So(err, ShouldBeNil)
+		_, err = other.decrypt(s1)
+		So(errors.Cause(err), ShouldEqual, ErrColumnEncryption)
+		other, err = newColumnCipher([]byte("key2"), ColumnEncryption{
+			Table: "users", Column: "ssn", Mode: RandomizedEncryption,
+		})
+		So(err, ShouldBeNil)
+		_, err = other.decrypt(s1)
+		So(errors.Cause(err), ShouldEqual, ErrColumnEncryption)
+		tampered := append([]byte{}, s1.([]byte)...)
+		tampered[len(tampered)-1] ^= 1
+		_, err = rnd.decrypt(tampered)
+		So(errors.Cause(err), ShouldEqual, ErrColumnEncryption)
+		_, err = rnd.decrypt("plain")
+		So(errors.Cause(err), ShouldEqual, ErrColumnEncryption)
+	})
+}
+
+func TestColumnEncryptor(t *testing.T) {
+	Convey("test column encryptor", t, func() {
+		_, err := newColumnEncryptor("", []ColumnEncryption{
+			{Table: "users", Column: "email", Mode: DeterministicEncryption},
+		})
+		So(errors.Cause(err), ShouldEqual, ErrColumnEncryption)
+		e, err := newColumnEncryptor("", nil)
+		So(err, ShouldBeNil)
+		So(e, ShouldBeNil)
+
+		e, err = newColumnEncryptor("key", []ColumnEncryption{
+			{Table: "Users", Column: "Email", Mode: DeterministicEncryption},
+			{Table: "users", Column: "ssn", Mode: RandomizedEncryption},
+		})
+		So(err, ShouldBeNil)
+		var (
+			email = e.ciphers["users"]["email"]
+			ssn   = e.ciphers["users"]["ssn"]
+			named = func(name string, v driver.Value) driver.NamedValue {
+				return driver.NamedValue{Name: name, Value: v}
+			}
+			pos = func(i int, v driver.Value) driver.NamedValue {
+				return driver.NamedValue{Ordinal: i, Value: v}
+			}
+			encrypted = func(c *columnCipher, v driver.Value) driver.Value {
+				sealed, err := c.encrypt(v)
+				So(err, ShouldBeNil)
+				return sealed
+			}
+			decrypted = func(c *columnCipher, v driver.Value) driver.Value {
+				plain, err := c.decrypt(v)
+				So(err, ShouldBeNil)
+				return plain
+			}
+		)
+
+		// insert with named arguments
+		out, dec, err := e.encryptArgs(
+			"INSERT INTO users (id, email, ssn) VALUES (:id, :email, :ssn)",
+			[]driver.NamedValue{named("id", int64(1)), named("email", "a@b.c"), named("ssn", "123")})
+		So(err, ShouldBeNil)
+		So(dec, ShouldBeNil)
+		So(out[0].Value, ShouldEqual, 1)
+		So(out[1].Value, ShouldResemble, encrypted(email, "a@b.c"))
+		So(decrypted(ssn, out[2].Value), ShouldEqual, "123")
+
+		// update with positional arguments
+		out, _, err = e.encryptArgs("UPDATE users SET ssn = ?, name = ? WHERE email = ?",
+			[]driver.NamedValue{pos(1, "456"), pos(2, "name"), pos(3, "a@b.c")})
+		So(err, ShouldBeNil)
+		So(decrypted(ssn, out[0].Value), ShouldEqual, "456")
+		So(out[1].Value, ShouldEqual, "name")
+		So(out[2].Value, ShouldResemble, encrypted(email, "a@b.c"))
+
+		// lookup by equality and select the encrypted columns
+		out, dec, err = e.encryptArgs(
+			"SELECT u.id, u.email AS mail, ssn FROM users u WHERE u.email IN (:a, :b) OR email = :a",
+			[]driver.NamedValue{named("a", "a@b.c"), named("b", "d@e.f")})
+		So(err, ShouldBeNil)
+		So(out[0].Value, ShouldResemble, encrypted(email, "a@b.c"))
+		So(out[1].Value, ShouldResemble, encrypted(email, "d@e.f"))
+		So(dec, ShouldNotBeNil)
+		So(dec.ciphers, ShouldResemble, map[string]*columnCipher{"mail": email, "ssn": ssn})
+		_, dec, err = e.encryptArgs("SELECT * FROM users", nil)
+		So(err, ShouldBeNil)
+		So(dec.ciphers, ShouldResemble, map[string]*columnCipher{"email": email, "ssn": ssn})
+		_, dec, err = e.encryptArgs("SELECT * FROM orders WHERE id = ?", []driver.NamedValue{pos(1, 1)})
+		So(err, ShouldBeNil)
+		So(dec, ShouldBeNil)
+
+		// parenthesized arguments, NULL and the columns of the same cipher are allowed
+		out, _, err = e.encryptArgs(
+			"UPDATE users SET ssn = NULL WHERE email = (?)",
+			[]driver.NamedValue{pos(1, "a@b.c")})
+		So(err, ShouldBeNil)
+		So(out[0].Value, ShouldResemble, encrypted(email, "a@b.c"))
+		_, _, err = e.encryptArgs(
+			"SELECT a.id FROM users a, users b WHERE a.email = b.email", nil)
+		So(err, ShouldBeNil)
+
+		// queries exposing or comparing encrypted values are rejected
+		for _, q := range []string{
+			"SELECT * FROM users WHERE ssn = ?",
+			"SELECT * FROM users WHERE email > ?",
+			"SELECT * FROM users WHERE email LIKE ?",
+			"SELECT * FROM users WHERE email BETWEEN ? AND ?",
+			"SELECT * FROM users WHERE email = 'a@b.c'",
+			"INSERT INTO users VALUES (?, ?, ?)",
+			"INSERT INTO users (email) VALUES ('a@b.c')",
+			"UPDATE users SET ssn = :x WHERE email = :x",
+			"UPDATE users SET ssn = lower(?)",
+			"UPDATE users SET email = ? || ''",
+			"SELECT * FROM users WHERE email = (? || '')",
+			"SELECT * FROM users WHERE email = id",
+			"SELECT * FROM users WHERE email IN (SELECT ?)",
+			"INSERT INTO users (id, email) SELECT ?, ?",
+			"INSERT INTO users (id, email) VALUES (?, upper(?))",
+			"SELECT * FROM",
+		} {
+			_, _, err = e.encryptArgs(q, nil)
+			So(errors.Cause(err), ShouldEqual, ErrColumnEncryption)
+		}
+	})
+}
+
+func TestEncryption(t *testing.T) {
+	Convey("test transparent column encryption", t, func() {
+		var stopTestService func()
+		var err error
+		stopTestService, _, err = startTestService()
+		So(err, ShouldBeNil)
+		defer stopTestService()
+
+		var db, plainDB *sql.DB
+		db, err = sql.Open("covenantsql",
+			"covenantsql://db?column_key=secret&encrypted_columns=users.email:deterministic,users.ssn")
+		So(err, ShouldBeNil)
+		defer db.Close()
+		plainDB, err = sql.Open("covenantsql", "covenantsql://db")
+		So(err, ShouldBeNil)
+		defer plainDB.Close()
+
+		_, err = db.Exec("CREATE TABLE users (id INT, email TEXT, ssn TEXT)")
+		So(err, ShouldBeNil)
+		_, err = db.Exec("INSERT INTO users (id, email, ssn) VALUES (:id, :email, :ssn)",
+			sql.Named("id", 1), sql.Named("email", "a@b.c"), sql.Named("ssn", "123"))
+		So(err, ShouldBeNil)
+		_, err = db.Exec("INSERT INTO users (id, email, ssn) VALUES (?, ?, ?)", 2, "d@e.f", nil)
+		So(err, ShouldBeNil)
+
+		var (
+			id         int
+			email, ssn sql.NullString
+		)
+		err = db.QueryRow("SELECT id, email, ssn FROM users WHERE email = ?", "a@b.c").Scan(
+			&id, &email, &ssn)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, 1)
+		So(email.String, ShouldEqual, "a@b.c")
+		So(ssn.String, ShouldEqual, "123")
+		err = db.QueryRow("SELECT * FROM users WHERE email = :email", sql.Named("email", "d@e.f")).Scan(
+			&id, &email, &ssn)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, 2)
+		So(ssn.Valid, ShouldBeFalse)
+
+		// the miners only see the cipher texts
+		var raw []byte
+		err = plainDB.QueryRow("SELECT ssn FROM users WHERE id = 1").Scan(&raw)
+		So(err, ShouldBeNil)
+		So(raw, ShouldNotBeEmpty)
+		So(string(raw), ShouldNotContainSubstring, "123")
+		err = plainDB.QueryRow("SELECT id FROM users WHERE email = ?", "a@b.c").Scan(&id)
+		So(err, ShouldEqual, sql.ErrNoRows)
+	})
+}
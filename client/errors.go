@@ -30,6 +30,18 @@ var (
 	ErrInvalidRequestSeq = errors.New("invalid request sequence applied")
 	// ErrInvalidProfile indicates the SQLChain profile is invalid.
 	ErrInvalidProfile = errors.New("invalid sqlchain profile")
+	// ErrUntrustedPeers indicates the peers reported by miner are not signed by the leader.
+	ErrUntrustedPeers = errors.New("untrusted database peers")
 	// ErrNoSuchTokenBalance indicates no such token balance in chain.
 	ErrNoSuchTokenBalance = errors.New("no such token balance")
+	// ErrWriteAsOfHeight indicates a write query is presented with a historical read context.
+	ErrWriteAsOfHeight = errors.New("only read is supported as of height")
+	// ErrRateLimitExceeded indicates the query is throttled by the rate limits of the database.
+	ErrRateLimitExceeded = errors.New("rate limit exceeded")
+	// ErrResponseVerification indicates the response could not be verified against the miner key
+	// or the sqlchain blocks.
+	ErrResponseVerification = errors.New("response verification failed")
+	// ErrColumnEncryption indicates the query could not be processed with the client-side
+	// column encryption.
+	ErrColumnEncryption = errors.New("column encryption failed")
 )
@@ -54,6 +54,8 @@ const (
 var (
 	rootHash                      = hash.Hash{}
 	stubNextNonce pi.AccountNonce = 1
+	// stubGenesis is the genesis block of the test database registered on the stub BP
+	stubGenesis *types.Block
 )
 
 // fake BPDB service
@@ -78,6 +80,13 @@ func (s *stubBPService) QuerySQLChainProfile(req *types.QuerySQLChainProfileReq,
 			},
 		},
 	}
+	if stubGenesis != nil {
+		var enc *bytes.Buffer
+		if enc, err = utils.EncodeMsgPack(stubGenesis); err != nil {
+			return
+		}
+		resp.Profile.EncodedGenesis = enc.Bytes()
+	}
 	return
 }
 
@@ -139,7 +148,10 @@ func startTestService() (stopTestService func(), tempDir string, err error) {
 	dbID := proto.DatabaseID("db")
 
 	// create sqlchain block
-	block, err = createRandomBlock(rootHash, true)
+	if block, err = createRandomBlock(rootHash, true); err != nil {
+		return
+	}
+	stubGenesis = block
 
 	// get database peers
 	if peers, err = genPeers(1); err != nil {
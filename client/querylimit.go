@@ -0,0 +1,65 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// SetQueryLimit updates the per-user read query limits of the database through its leader, which
+// replicates the limits to all miners by kayak, admin permission of the database is required.
+// The limits are capped by the defaults of each miner.
+func SetQueryLimit(dsn string, limits *types.QueryLimitConfig) (err error) {
+	dbID, leader, err := callAdmin(dsn, route.DBSSetQueryLimit, func(
+		dbID proto.DatabaseID, privKey *asymmetric.PrivateKey) (interface{}, error) {
+		req := &types.SetQueryLimitReq{
+			Header: types.SignedQueryLimitRequestHeader{
+				QueryLimitRequestHeader: types.QueryLimitRequestHeader{
+					DatabaseID: dbID,
+					Config:     *limits,
+					Timestamp:  getLocalTime(),
+				},
+			},
+		}
+		return req, req.Header.Sign(privKey)
+	}, &types.SetQueryLimitResp{})
+	if err != nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"db":     dbID,
+		"leader": leader,
+	}).Info("database query limit updated")
+
+	return
+}
+
+// IsQueryLimitExceeded returns the exceeded limit if the read query is aborted by the query
+// limits of the database, retrying the same query will fail again.
+func IsQueryLimitExceeded(err error) (qle *types.QueryLimitError, ok bool) {
+	return types.ParseQueryLimitError(err)
+}
+
+func isQueryLimitError(err error) bool {
+	_, ok := types.ParseQueryLimitError(err)
+	return ok
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"strings"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	"github.com/pkg/errors"
+)
+
+// SetRateLimit updates the per-user query rate limits of the database through its leader, which
+// replicates the limits to all miners by kayak, admin permission of the database is required.
+// The limits are capped by the defaults of each miner, and the read rate is shared by the miners
+// serving the reads.
+func SetRateLimit(dsn string, limits *types.RateLimitConfig) (err error) {
+	dbID, leader, err := callAdmin(dsn, route.DBSSetRateLimit, func(
+		dbID proto.DatabaseID, privKey *asymmetric.PrivateKey) (interface{}, error) {
+		req := &types.SetRateLimitReq{
+			Header: types.SignedRateLimitRequestHeader{
+				RateLimitRequestHeader: types.RateLimitRequestHeader{
+					DatabaseID: dbID,
+					Config:     *limits,
+					Timestamp:  getLocalTime(),
+				},
+			},
+		}
+		return req, req.Header.Sign(privKey)
+	}, &types.SetRateLimitResp{})
+	if err != nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"db":     dbID,
+		"leader": leader,
+	}).Info("database rate limit updated")
+
+	return
+}
+
+// IsRateLimited returns whether the query is throttled by the rate limits of the database,
+// the caller should back off before retrying.
+func IsRateLimited(err error) bool {
+	return err != nil && (errors.Cause(err) == ErrRateLimitExceeded ||
+		strings.Contains(err.Error(), ErrRateLimitExceeded.Error()))
+}
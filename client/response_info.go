@@ -0,0 +1,104 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+type responseInfoKey struct{}
+
+// ResponseInfo describes the peer which served a query and the log offset it was at.
+type ResponseInfo struct {
+	// NodeID is the miner node answering the query.
+	NodeID proto.NodeID
+	// LogOffset is the log offset of the database on the answering node.
+	LogOffset uint64
+	// AsOfHeight is the chain height of the state read by a historical query.
+	AsOfHeight int32
+	// Verification reports the block including the response, it's only set on the connections
+	// with the verify option.
+	Verification *Verification
+}
+
+// WithResponseInfo returns a context which asks the driver to fill info on query completion.
+//
+// Example:
+//
+//	var info client.ResponseInfo
+//	rows, err := db.QueryContext(client.WithResponseInfo(ctx, &info), "SELECT 1")
+//	// info.NodeID and info.LogOffset are set after the query returns.
+func WithResponseInfo(ctx context.Context, info *ResponseInfo) context.Context {
+	return context.WithValue(ctx, responseInfoKey{}, info)
+}
+
+func responseInfoFromContext(ctx context.Context) *ResponseInfo {
+	if ctx == nil {
+		return nil
+	}
+	info, _ := ctx.Value(responseInfoKey{}).(*ResponseInfo)
+	return info
+}
+
+type asOfHeightKey struct{}
+
+// WithAsOfHeight returns a context which asks the driver to read the database state as of the
+// sqlchain height, the miners answer from their retained history and reject the heights out of
+// the retention window. Only read queries are allowed with such a context.
+//
+// Example:
+//
+//	var info client.ResponseInfo
+//	ctx = client.WithResponseInfo(client.WithAsOfHeight(ctx, height), &info)
+//	rows, err := db.QueryContext(ctx, "SELECT balance FROM accounts WHERE id = ?", id)
+//	// info.AsOfHeight is the height of the last block applied to the state read.
+func WithAsOfHeight(ctx context.Context, height int32) context.Context {
+	return context.WithValue(ctx, asOfHeightKey{}, height)
+}
+
+func asOfHeightFromContext(ctx context.Context) int32 {
+	if ctx == nil {
+		return 0
+	}
+	height, _ := ctx.Value(asOfHeightKey{}).(int32)
+	return height
+}
+
+// observeLogOffset records the log offset seen from a peer and returns the database head.
+func observeLogOffset(dbID proto.DatabaseID, offset uint64) (head uint64) {
+	rawHead, _ := logOffsets.LoadOrStore(dbID, new(uint64))
+	headPtr := rawHead.(*uint64)
+	for {
+		if head = atomic.LoadUint64(headPtr); head >= offset {
+			return
+		}
+		if atomic.CompareAndSwapUint64(headPtr, head, offset) {
+			return offset
+		}
+	}
+}
+
+// getLogOffset returns the highest log offset observed on the database.
+func getLogOffset(dbID proto.DatabaseID) uint64 {
+	if rawHead, ok := logOffsets.Load(dbID); ok {
+		return atomic.LoadUint64(rawHead.(*uint64))
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResponseInfo(t *testing.T) {
+	Convey("test log offset observation", t, func() {
+		dbID := proto.DatabaseID("response_info_test")
+		defer logOffsets.Delete(dbID)
+
+		So(getLogOffset(dbID), ShouldEqual, 0)
+		So(observeLogOffset(dbID, 10), ShouldEqual, 10)
+		So(observeLogOffset(dbID, 5), ShouldEqual, 10)
+		So(getLogOffset(dbID), ShouldEqual, 10)
+		So(observeLogOffset(dbID, 12), ShouldEqual, 12)
+		So(getLogOffset(dbID), ShouldEqual, 12)
+	})
+	Convey("test response info context", t, func() {
+		So(responseInfoFromContext(context.Background()), ShouldBeNil)
+
+		var info ResponseInfo
+		ctx := WithResponseInfo(context.Background(), &info)
+		So(responseInfoFromContext(ctx), ShouldEqual, &info)
+	})
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	nrpc "net/rpc"
+	"strings"
+	"time"
+
+	kt "github.com/CovenantSQL/CovenantSQL/kayak/types"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	"github.com/pkg/errors"
+)
+
+var (
+	// MaxQueryRetries defines the max retries of a query failed with retryable errors.
+	MaxQueryRetries = 3
+	// QueryRetryBackoff defines the initial backoff before retrying a query, which doubles
+	// on each retry.
+	QueryRetryBackoff = 100 * time.Millisecond
+	// MaxQueryRetryBackoff defines the max backoff before retrying a query.
+	MaxQueryRetryBackoff = 2 * time.Second
+)
+
+// ErrorClass defines the class of query errors to decide whether the query could be retried.
+type ErrorClass int
+
+const (
+	// PermanentError indicates the query fails regardless of the peers, retrying makes no sense.
+	PermanentError ErrorClass = iota
+	// RetryableError indicates the query may succeed on retry against refreshed peers.
+	RetryableError
+	// NotLeaderError indicates the write query is sent to a peer which is not the leader.
+	NotLeaderError
+)
+
+// String implements fmt.Stringer for logging purpose.
+func (c ErrorClass) String() string {
+	switch c {
+	case PermanentError:
+		return "permanent"
+	case RetryableError:
+		return "retryable"
+	case NotLeaderError:
+		return "not leader"
+	default:
+		return "unknown"
+	}
+}
+
+// ClassifyError returns the class of the query error, and the leader hint given by the peer if
+// the error is a NotLeaderError. The leader hint is empty if it's unknown to the peer.
+func ClassifyError(err error) (class ErrorClass, leader proto.NodeID) {
+	if err == nil {
+		return
+	}
+	var cause = errors.Cause(err)
+	switch {
+	case cause == context.Canceled || cause == context.DeadlineExceeded:
+		return
+	case cause == ErrResponseVerification || isQueryLimitError(err):
+		return
+	case IsRateLimited(err):
+		class = RetryableError
+		return
+	}
+	if e, ok := types.ParseNotLeaderError(err); ok {
+		class, leader = NotLeaderError, e.Leader
+		return
+	}
+	var msg = err.Error()
+	switch {
+	case strings.Contains(msg, kt.ErrNotLeader.Error()):
+		class = NotLeaderError
+	case strings.Contains(msg, types.ErrStaleRead.Error()):
+		// the follower lags behind the max staleness, the leader or another follower may serve it
+		class = RetryableError
+	case strings.Contains(msg, types.ErrDatabaseNotExists.Error()):
+		// the peer no longer serves the database, the peers are stale
+		class = RetryableError
+	case strings.Contains(msg, "init PersistentCaller client failed"):
+		// the peer is unreachable, the error may also carry remote errors of node resolving
+		class = RetryableError
+	default:
+		// errors returned by the remote peer are permanent, the others are transport errors
+		if _, ok := cause.(nrpc.ServerError); !ok {
+			class = RetryableError
+		}
+	}
+	return
+}
+
+// retryBackoff returns the backoff duration before the next retry of the query.
+func retryBackoff(retries int) (backoff time.Duration) {
+	backoff = QueryRetryBackoff << uint(retries)
+	if backoff <= 0 || backoff > MaxQueryRetryBackoff {
+		backoff = MaxQueryRetryBackoff
+	}
+	return
+}
+
+// waitRetry waits for the backoff duration before the next retry, or returns the context error
+// if the context is done in the meantime.
+func waitRetry(ctx context.Context, retries int) (err error) {
+	var timer = time.NewTimer(retryBackoff(retries))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+	}
+	return
+}
+
+// refreshPeers reloads the peers of the database bypassing the peers cache, and reconnects the
+// leader and followers if they are changed. The leader hint takes precedence over the leader of
+// the reloaded peers if it's one of the servers.
+func (c *conn) refreshPeers(leader proto.NodeID) {
+	var (
+		peers *proto.Peers
+		err   error
+	)
+	if peers, err = getPeers(c.dbID, c.privKey); err != nil {
+		log.WithField("db", c.dbID).WithError(err).Debug("refresh peers failed")
+		return
+	}
+	if leader != "" && leader != peers.Leader && isServer(peers.Servers, leader) {
+		var hinted = peers.Clone()
+		hinted.Leader = leader
+		peers = &hinted
+	}
+	if err = c.connectPeers(peers); err != nil {
+		log.WithField("db", c.dbID).WithError(err).Debug("reconnect peers failed")
+	}
+}
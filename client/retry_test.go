@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"database/sql"
+	nrpc "net/rpc"
+	"testing"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/kms"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClassifyError(t *testing.T) {
+	Convey("query errors should be classified", t, func() {
+		var remote = func(msg string) error {
+			return errors.Wrap(nrpc.ServerError(msg), "call DBS.Query failed")
+		}
+		for _, c := range []struct {
+			err    error
+			class  ErrorClass
+			leader proto.NodeID
+		}{
+			{nil, PermanentError, ""},
+			{context.DeadlineExceeded, PermanentError, ""},
+			{errors.Wrap(ErrResponseVerification, "bad signature"), PermanentError, ""},
+			{remote((&types.QueryLimitError{Kind: types.MaxRowsLimit, Limit: 1}).Error()), PermanentError, ""},
+			{remote("invalid request sequence applied"), PermanentError, ""},
+			{remote("no such table: t"), PermanentError, ""},
+			{remote(errors.Wrap(types.ErrStaleRead, "state at log offset 1, required 2").Error()), RetryableError, ""},
+			{remote(ErrRateLimitExceeded.Error()), RetryableError, ""},
+			{remote("database instance not exists"), RetryableError, ""},
+			{errors.New("dial tcp: connection refused"), RetryableError, ""},
+			{errors.Wrap(remote("node key not found"), "init PersistentCaller client failed"), RetryableError, ""},
+			{remote("apply failed: not leader"), NotLeaderError, ""},
+			{remote((&types.NotLeaderError{}).Error()), NotLeaderError, ""},
+			{remote((&types.NotLeaderError{Leader: "00000abc"}).Error()), NotLeaderError, "00000abc"},
+		} {
+			class, leader := ClassifyError(c.err)
+			So(class, ShouldEqual, c.class)
+			So(leader, ShouldEqual, c.leader)
+		}
+		So(NotLeaderError.String(), ShouldEqual, "not leader")
+	})
+	Convey("retry backoff should be capped", t, func() {
+		So(retryBackoff(0), ShouldEqual, QueryRetryBackoff)
+		So(retryBackoff(1), ShouldEqual, 2*QueryRetryBackoff)
+		So(retryBackoff(10), ShouldEqual, MaxQueryRetryBackoff)
+		So(retryBackoff(100), ShouldEqual, MaxQueryRetryBackoff)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		So(waitRetry(ctx, 10), ShouldEqual, context.Canceled)
+	})
+}
+
+func TestRetry(t *testing.T) {
+	Convey("test query retry with stale peers", t, func() {
+		var stopTestService func()
+		var err error
+		stopTestService, _, err = startTestService()
+		So(err, ShouldBeNil)
+		defer stopTestService()
+
+		var nodeID proto.NodeID
+		nodeID, err = kms.GetLocalNodeID()
+		So(err, ShouldBeNil)
+
+		// poison the peers cache with a leader which does not exist
+		var stale = proto.NodeID("0000000000000000000000000000000000000000000000000000000000000001")
+		peerList.Store(proto.DatabaseID("db"), &proto.Peers{
+			PeersHeader: proto.PeersHeader{
+				Leader:  stale,
+				Servers: []proto.NodeID{stale},
+			},
+		})
+		defer peerList.Delete(proto.DatabaseID("db"))
+
+		var db *sql.DB
+		db, err = sql.Open("covenantsql", "covenantsql://db")
+		So(err, ShouldBeNil)
+		defer db.Close()
+
+		start := time.Now()
+		_, err = db.Exec("create table test_retry (k int)")
+		So(err, ShouldBeNil)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, QueryRetryBackoff)
+		_, err = db.Exec("insert into test_retry values (1)")
+		So(err, ShouldBeNil)
+
+		var count int
+		err = db.QueryRow("select count(1) from test_retry").Scan(&count)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 1)
+
+		// the peers cache is refreshed
+		var peers *proto.Peers
+		peers, err = cacheGetPeers(proto.DatabaseID("db"), nil)
+		So(err, ShouldBeNil)
+		So(peers.Leader, ShouldEqual, nodeID)
+	})
+}
@@ -25,19 +25,27 @@ import (
 )
 
 type rows struct {
-	columns []string
-	types   []string
-	data    []types.ResponseRow
+	columns      []string
+	types        []string
+	data         []types.ResponseRow
+	verification *Verification
 }
 
-func newRows(res *types.Response) *rows {
+func newRows(res *types.Response, verification *Verification) *rows {
 	return &rows{
-		columns: res.Payload.Columns,
-		types:   res.Payload.DeclTypes,
-		data:    res.Payload.Rows,
+		columns:      res.Payload.Columns,
+		types:        res.Payload.DeclTypes,
+		data:         res.Payload.Rows,
+		verification: verification,
 	}
 }
 
+// Verification returns the verification of the response of the rows, which reports the height
+// of the block including the response once verified. It's nil if the verification is not enabled.
+func (r *rows) Verification() *Verification {
+	return r.verification
+}
+
 // Columns implements driver.Rows.Columns method.
 func (r *rows) Columns() []string {
 	return r.columns[:]
@@ -41,7 +41,7 @@ func TestRowsStructure(t *testing.T) {
 					},
 				},
 			},
-		})
+		}, nil)
 		columns := r.Columns()
 		So(columns, ShouldResemble, []string{"a"})
 		So(r.ColumnTypeDatabaseTypeName(0), ShouldEqual, "INT")
@@ -55,5 +55,6 @@ func TestRowsStructure(t *testing.T) {
 		err = r.Close()
 		So(err, ShouldBeNil)
 		So(r.data, ShouldBeNil)
+		So(r.Verification(), ShouldBeNil)
 	})
 }
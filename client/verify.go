@@ -0,0 +1,468 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/merkle"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/rpc"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	"github.com/pkg/errors"
+)
+
+var (
+	// VerifyTimeout is the max time to wait for a verified response to be packed in a block.
+	VerifyTimeout = 5 * time.Minute
+	// VerifyPollInterval is the interval to poll the peers for new blocks.
+	VerifyPollInterval = time.Second
+	// VerifyClockSkew is the max clock skew tolerated between the response and the block timestamps.
+	VerifyClockSkew = time.Minute
+)
+
+// Verification tracks the verification of a query response. The response signature is checked
+// against the registered key of the miner on receipt, the inclusion of the response is checked
+// asynchronously in the sqlchain blocks once the ack is packed.
+type Verification struct {
+	done   chan struct{}
+	height int32
+	block  hash.Hash
+	err    error
+}
+
+func newVerification() *Verification {
+	return &Verification{done: make(chan struct{})}
+}
+
+// Done returns a channel which is closed when the verification completes.
+func (v *Verification) Done() <-chan struct{} {
+	return v.done
+}
+
+// Wait waits for the verification to complete and returns the height of the block including the
+// response.
+func (v *Verification) Wait(ctx context.Context) (height int32, err error) {
+	select {
+	case <-v.done:
+		return v.height, v.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// VerifiedHeight returns the height of the block including the response, ok is false if the
+// verification is not completed yet or failed.
+func (v *Verification) VerifiedHeight() (height int32, ok bool) {
+	select {
+	case <-v.done:
+		return v.height, v.err == nil
+	default:
+		return 0, false
+	}
+}
+
+// Block returns the hash of the block including the response, it's only valid once verified.
+func (v *Verification) Block() hash.Hash {
+	select {
+	case <-v.done:
+		return v.block
+	default:
+		return hash.Hash{}
+	}
+}
+
+// Err returns the verification error, nil if the verification is not completed yet or succeeded.
+func (v *Verification) Err() error {
+	select {
+	case <-v.done:
+		return v.err
+	default:
+		return nil
+	}
+}
+
+func (v *Verification) finish(height int32, block hash.Hash, err error) {
+	v.height, v.block, v.err = height, block, err
+	close(v.done)
+}
+
+// nodeKeys caches the public keys registered by the miner nodes.
+var nodeKeys sync.Map // map[proto.NodeID]*asymmetric.PublicKey
+
+// getNodePublicKey returns the public key registered by the node.
+func getNodePublicKey(node proto.NodeID) (pk *asymmetric.PublicKey, err error) {
+	if v, ok := nodeKeys.Load(node); ok {
+		return v.(*asymmetric.PublicKey), nil
+	}
+	var info *proto.Node
+	if info, err = rpc.GetNodeInfo(node.ToRawNodeID()); err != nil {
+		return
+	}
+	if info.PublicKey == nil {
+		err = errors.Wrapf(ErrResponseVerification, "no public key registered by node %s", node)
+		return
+	}
+	nodeKeys.Store(node, info.PublicKey)
+	return info.PublicKey, nil
+}
+
+// verifyResponse verifies the response served by node against the key registered by the node.
+func verifyResponse(response *types.Response, node proto.NodeID) (err error) {
+	if response.Header.NodeID != node {
+		return errors.Wrapf(ErrResponseVerification,
+			"response from node %s is signed as node %s", node, response.Header.NodeID)
+	}
+	if err = response.Verify(); err != nil {
+		return errors.Wrapf(ErrResponseVerification, "response from node %s: %v", node, err)
+	}
+	var pk *asymmetric.PublicKey
+	if pk, err = getNodePublicKey(node); err != nil {
+		return
+	}
+	if !pk.IsEqual(response.Header.Signee) {
+		return errors.Wrapf(ErrResponseVerification,
+			"response is not signed by the registered key of node %s", node)
+	}
+	return
+}
+
+// inclusionSource fetches the block headers with the response inclusion proofs of a sqlchain.
+type inclusionSource interface {
+	// FetchInclusion returns the header of the block at height with the inclusion proof of the
+	// response, the zero response hash fetches the header only.
+	FetchInclusion(ctx context.Context, height int32, response *hash.Hash) (
+		resp *types.FetchInclusionResp, err error)
+}
+
+// remoteInclusionSource fetches the headers and proofs from the database peers, the nodes are
+// tried in order until one of them serves the request.
+type remoteInclusionSource struct {
+	caller *rpc.Caller
+	dbID   proto.DatabaseID
+	nodes  []proto.NodeID
+}
+
+func (s *remoteInclusionSource) FetchInclusion(
+	ctx context.Context, height int32, response *hash.Hash,
+) (resp *types.FetchInclusionResp, err error) {
+	var req = &types.FetchInclusionReq{
+		DatabaseID: s.dbID,
+		Height:     height,
+		Response:   *response,
+	}
+	for len(s.nodes) > 0 {
+		resp = &types.FetchInclusionResp{}
+		if err = s.caller.CallNodeWithContext(
+			ctx, s.nodes[0], route.SQLCFetchInclusion.String(), req, resp,
+		); err == nil || ctx.Err() != nil {
+			break
+		}
+		err = errors.Wrapf(err, "fetch inclusion %d from %s", height, s.nodes[0])
+		if len(s.nodes) == 1 {
+			break
+		}
+		s.nodes = s.nodes[1:]
+	}
+	return
+}
+
+// newInclusionSource returns the inclusion source of the response, which is served by the peers
+// other than the node serving the response. The serving node is only used if it's the single peer
+// of the database, in which case the inclusion is anchored by the chain check only.
+func newInclusionSource(
+	dbID proto.DatabaseID, peers *proto.Peers, response *types.SignedResponseHeader,
+) inclusionSource {
+	var nodes []proto.NodeID
+	for _, v := range peers.Servers {
+		if v != response.NodeID {
+			nodes = append(nodes, v)
+		}
+	}
+	if len(nodes) == 0 {
+		nodes = append(nodes, response.NodeID)
+	}
+	return &remoteInclusionSource{caller: rpc.NewCaller(), dbID: dbID, nodes: nodes}
+}
+
+// verifyHeader verifies the signature of the block header produced by the peers.
+func verifyHeader(header *types.SignedHeader, peers *proto.Peers) (err error) {
+	var bh = header.HSV.DataHash
+	if _, found := peers.Find(header.Producer); !found {
+		return errors.Wrapf(ErrResponseVerification,
+			"block %s is produced by non-peer node %s", bh, header.Producer)
+	}
+	var pk *asymmetric.PublicKey
+	if pk, err = getNodePublicKey(header.Producer); err != nil {
+		return
+	}
+	if !pk.IsEqual(header.HSV.Signee) {
+		return errors.Wrapf(ErrResponseVerification,
+			"block %s is not signed by the registered key of node %s", bh, header.Producer)
+	}
+	if err = header.Verify(); err != nil {
+		return errors.Wrapf(ErrResponseVerification, "block %s: %v", bh, err)
+	}
+	return
+}
+
+// verifyProof verifies the merkle proof of the response against the block header, the response
+// packed as an ack must be acked by the client key.
+func verifyProof(
+	resp *types.FetchInclusionResp, response *types.SignedResponseHeader,
+	client *asymmetric.PublicKey,
+) (err error) {
+	var (
+		bh   = resp.Header.HSV.DataHash
+		rh   = response.Hash()
+		leaf = rh
+	)
+	if ack := resp.Ack; ack != nil {
+		if err = ack.Verify(); err != nil {
+			return errors.Wrapf(ErrResponseVerification, "ack in block %s: %v", bh, err)
+		}
+		if ack.GetResponseHash() != rh || !client.IsEqual(ack.Signee) {
+			return errors.Wrapf(ErrResponseVerification,
+				"ack in block %s is not the ack of response %s", bh, rh)
+		}
+		leaf = ack.Hash()
+	}
+	if !merkle.VerifyProof(&leaf, &resp.Header.MerkleRoot, resp.Proof) {
+		return errors.Wrapf(ErrResponseVerification,
+			"invalid inclusion proof of response %s in block %s", rh, bh)
+	}
+	return
+}
+
+// findResponseBlock finds the block header including the response from the inclusion source, the
+// blocks produced since the response and the new blocks are checked until ctx is done.
+func findResponseBlock(
+	ctx context.Context, src inclusionSource, peers *proto.Peers,
+	response *types.SignedResponseHeader, client *asymmetric.PublicKey,
+) (header *types.SignedHeader, height int32, err error) {
+	var (
+		rh   = response.Hash()
+		head int32
+		resp *types.FetchInclusionResp
+	)
+	if resp, err = src.FetchInclusion(ctx, -1, &hash.Hash{}); err != nil {
+		return
+	}
+	head = resp.Head
+	check := func(h int32) (found bool, err error) {
+		if resp, err = src.FetchInclusion(ctx, h, &rh); err != nil || resp.Header == nil {
+			return
+		}
+		if resp.Proof == nil {
+			return
+		}
+		if err = verifyHeader(resp.Header, peers); err != nil {
+			return
+		}
+		if err = verifyProof(resp, response, client); err != nil {
+			return
+		}
+		header, height, found = resp.Header, h, true
+		return
+	}
+
+	// the response may be packed before the verification starts
+	since := response.Timestamp.Add(-VerifyClockSkew)
+	for h := head; h > 0; h-- {
+		var found bool
+		if found, err = check(h); err != nil || found {
+			return
+		}
+		if resp.Header != nil && resp.Header.Timestamp.Before(since) {
+			break
+		}
+	}
+
+	// wait for the following blocks
+	for next := head + 1; ; {
+		if resp, err = src.FetchInclusion(ctx, -1, &hash.Hash{}); err != nil {
+			return
+		}
+		for last := resp.Head; next <= last; next++ {
+			var found bool
+			if found, err = check(next); err != nil || found {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			err = errors.Wrapf(ErrResponseVerification,
+				"response %s is not packed: %v", rh, ctx.Err())
+			return
+		case <-time.After(VerifyPollInterval):
+		}
+	}
+}
+
+// chainAnchor is the highest verified block of a database chain, which is linked to the genesis
+// block registered on the block producers by the parent hashes.
+type chainAnchor struct {
+	sync.Mutex
+	height int32
+	hash   hash.Hash
+}
+
+// chainAnchors caches the chain anchors of the databases.
+var chainAnchors sync.Map // map[proto.DatabaseID]*chainAnchor
+
+// getChainAnchor returns the chain anchor of database dbID, which starts from the genesis block.
+func getChainAnchor(dbID proto.DatabaseID) (anchor *chainAnchor, err error) {
+	if v, ok := chainAnchors.Load(dbID); ok {
+		return v.(*chainAnchor), nil
+	}
+	var (
+		req     = &types.QuerySQLChainProfileReq{DBID: dbID}
+		resp    = &types.QuerySQLChainProfileResp{}
+		genesis = &types.Block{}
+	)
+	if err = rpc.RequestBP(route.MCCQuerySQLChainProfile.String(), req, resp); err != nil {
+		err = errors.Wrap(err, "get sqlchain profile failed")
+		return
+	}
+	if err = utils.DecodeMsgPack(resp.Profile.EncodedGenesis, genesis); err != nil {
+		err = errors.Wrapf(ErrResponseVerification, "decode genesis block: %v", err)
+		return
+	}
+	v, _ := chainAnchors.LoadOrStore(dbID, &chainAnchor{hash: *genesis.BlockHash()})
+	return v.(*chainAnchor), nil
+}
+
+// link checks that the block header at height is on the chain of the anchor, by walking the
+// parent hashes between them. The anchor is moved to the header if it's higher.
+func (a *chainAnchor) link(
+	ctx context.Context, src inclusionSource, height int32, header *types.SignedHeader,
+) (err error) {
+	a.Lock()
+	defer a.Unlock()
+	if height == a.height {
+		if header.HSV.DataHash != a.hash {
+			return errors.Wrapf(ErrResponseVerification, "block %s is not on the chain of %s",
+				header.HSV.DataHash, a.hash)
+		}
+		return
+	}
+	var (
+		top, bottom           = height, a.height
+		topHeader, bottomHash = header, a.hash
+	)
+	if height < a.height {
+		// walk down from the anchor to the header
+		top, bottom, bottomHash = a.height, height, header.HSV.DataHash
+		var resp *types.FetchInclusionResp
+		if resp, err = src.FetchInclusion(ctx, top, &hash.Hash{}); err != nil {
+			return
+		}
+		if topHeader = resp.Header; topHeader == nil || topHeader.HSV.DataHash != a.hash {
+			return errors.Wrapf(ErrResponseVerification, "anchor block %s is not found at %d",
+				a.hash, a.height)
+		}
+	}
+	for h, child := top-1, topHeader; ; h-- {
+		if h < bottom {
+			return errors.Wrapf(ErrResponseVerification, "block %s is not linked to block %s",
+				topHeader.HSV.DataHash, bottomHash)
+		}
+		var resp *types.FetchInclusionResp
+		if resp, err = src.FetchInclusion(ctx, h, &hash.Hash{}); err != nil {
+			return
+		}
+		if resp.Header == nil {
+			continue
+		}
+		if err = resp.Header.Verify(); err != nil {
+			return errors.Wrapf(ErrResponseVerification, "block at %d: %v", h, err)
+		}
+		if resp.Header.HSV.DataHash != child.ParentHash {
+			return errors.Wrapf(ErrResponseVerification, "block at %d is not the parent of %s",
+				h, child.HSV.DataHash)
+		}
+		if h == bottom {
+			if resp.Header.HSV.DataHash != bottomHash {
+				return errors.Wrapf(ErrResponseVerification,
+					"block %s is not linked to block %s", topHeader.HSV.DataHash, bottomHash)
+			}
+			break
+		}
+		child = resp.Header
+	}
+	if height > a.height {
+		a.height, a.hash = height, header.HSV.DataHash
+	}
+	return
+}
+
+// verifyInclusion starts the verification of the response inclusion in the sqlchain blocks of
+// database dbID. The block header and the merkle proof of the response are fetched from the peers
+// other than the node serving the response, and the block is checked to be on the chain from the
+// genesis block registered on the block producers.
+func verifyInclusion(
+	dbID proto.DatabaseID, privKey *asymmetric.PrivateKey, response *types.SignedResponseHeader,
+) (v *Verification) {
+	v = newVerification()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), VerifyTimeout)
+		defer cancel()
+
+		var (
+			peers  *proto.Peers
+			anchor *chainAnchor
+			header *types.SignedHeader
+			height int32
+			err    error
+		)
+		defer func() {
+			var bh hash.Hash
+			if err == nil && header != nil {
+				bh = header.HSV.DataHash
+			}
+			log.WithFields(log.Fields{
+				"db":       dbID,
+				"response": response.Hash().String(),
+				"block":    bh.String(),
+				"height":   height,
+			}).WithError(err).Debug("verify response inclusion")
+			v.finish(height, bh, err)
+		}()
+
+		if peers, err = cacheGetPeers(dbID, privKey); err != nil {
+			return
+		}
+		if anchor, err = getChainAnchor(dbID); err != nil {
+			return
+		}
+		src := newInclusionSource(dbID, peers, response)
+		if header, height, err = findResponseBlock(
+			ctx, src, peers, response, privKey.PubKey(),
+		); err != nil {
+			return
+		}
+		err = anchor.link(ctx, src, height, header)
+	}()
+	return
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/crypto/kms"
+	"github.com/CovenantSQL/CovenantSQL/merkle"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVerification(t *testing.T) {
+	Convey("verification should report the block height once finished", t, func() {
+		v := newVerification()
+		_, ok := v.VerifiedHeight()
+		So(ok, ShouldBeFalse)
+		So(v.Err(), ShouldBeNil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := v.Wait(ctx)
+		So(err, ShouldNotBeNil)
+
+		var bh hash.Hash
+		bh[0] = 1
+		v.finish(10, bh, nil)
+		height, ok := v.VerifiedHeight()
+		So(ok, ShouldBeTrue)
+		So(height, ShouldEqual, 10)
+		So(v.Block(), ShouldResemble, bh)
+		height, err = v.Wait(context.Background())
+		So(err, ShouldBeNil)
+		So(height, ShouldEqual, 10)
+	})
+	Convey("failed verification should report the error", t, func() {
+		v := newVerification()
+		v.finish(0, hash.Hash{}, ErrResponseVerification)
+		_, ok := v.VerifiedHeight()
+		So(ok, ShouldBeFalse)
+		So(v.Err(), ShouldEqual, ErrResponseVerification)
+		_, err := v.Wait(context.Background())
+		So(err, ShouldEqual, ErrResponseVerification)
+	})
+}
+
+// fakeInclusionSource serves the headers and proofs of blocks by height.
+type fakeInclusionSource struct {
+	blocks map[int32]*types.Block
+	head   int32
+}
+
+func (s *fakeInclusionSource) FetchInclusion(
+	ctx context.Context, height int32, response *hash.Hash,
+) (resp *types.FetchInclusionResp, err error) {
+	resp = &types.FetchInclusionResp{Height: height, Head: s.head}
+	b := s.blocks[height]
+	if b == nil {
+		return
+	}
+	resp.Header = &b.SignedHeader
+	if response.IsEqual(&hash.Hash{}) {
+		return
+	}
+	var proof *merkle.Proof
+	if proof, resp.Ack, err = b.ResponseProof(response); err != nil || proof == nil {
+		return
+	}
+	resp.Proof, err = proof.MarshalBinary()
+	return
+}
+
+func TestVerifyProof(t *testing.T) {
+	Convey("the responses packed as query txs or acks should be proved", t, func() {
+		newResponse := func(seqNo uint64) *types.SignedResponseHeader {
+			resp := &types.SignedResponseHeader{
+				ResponseHeader: types.ResponseHeader{
+					Request: types.RequestHeader{SeqNo: seqNo},
+				},
+			}
+			So(resp.BuildHash(), ShouldBeNil)
+			return resp
+		}
+		var (
+			write = newResponse(1)
+			read  = newResponse(2)
+			other = newResponse(3)
+			ack   = &types.SignedAckHeader{
+				AckHeader: types.AckHeader{
+					Response:     read.ResponseHeader,
+					ResponseHash: read.Hash(),
+				},
+			}
+		)
+		client, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		So(ack.Sign(client), ShouldBeNil)
+		block, err := createRandomBlock(rootHash, false)
+		So(err, ShouldBeNil)
+		block.QueryTxs = []*types.QueryAsTx{{Response: write}}
+		block.Acks = []*types.SignedAckHeader{ack}
+		producer, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		So(block.PackAndSignBlock(producer), ShouldBeNil)
+		src := &fakeInclusionSource{blocks: map[int32]*types.Block{1: block}, head: 1}
+
+		fetch := func(response *types.SignedResponseHeader) *types.FetchInclusionResp {
+			h := response.Hash()
+			resp, err := src.FetchInclusion(context.Background(), 1, &h)
+			So(err, ShouldBeNil)
+			return resp
+		}
+		So(verifyProof(fetch(write), write, client.PubKey()), ShouldBeNil)
+		So(verifyProof(fetch(read), read, client.PubKey()), ShouldBeNil)
+		So(fetch(other).Proof, ShouldBeNil)
+
+		// the ack must be signed by the client
+		another, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		err = verifyProof(fetch(read), read, another.PubKey())
+		So(errors.Cause(err), ShouldEqual, ErrResponseVerification)
+
+		// the proof of another response is rejected
+		err = verifyProof(fetch(write), other, client.PubKey())
+		So(errors.Cause(err), ShouldEqual, ErrResponseVerification)
+		resp := fetch(write)
+		resp.Proof[len(resp.Proof)-1]++
+		err = verifyProof(resp, write, client.PubKey())
+		So(errors.Cause(err), ShouldEqual, ErrResponseVerification)
+	})
+}
+
+func TestChainAnchor(t *testing.T) {
+	Convey("the blocks should be linked to the anchor by parent hashes", t, func() {
+		var (
+			ctx    = context.Background()
+			blocks = map[int32]*types.Block{}
+			parent = rootHash
+		)
+		// no block at height 3
+		for _, h := range []int32{0, 1, 2, 4, 5} {
+			b, err := createRandomBlock(parent, false)
+			So(err, ShouldBeNil)
+			blocks[h], parent = b, *b.BlockHash()
+		}
+		src := &fakeInclusionSource{blocks: blocks, head: 5}
+		anchor := &chainAnchor{hash: *blocks[0].BlockHash()}
+
+		So(anchor.link(ctx, src, 4, &blocks[4].SignedHeader), ShouldBeNil)
+		So(anchor.height, ShouldEqual, 4)
+		So(anchor.hash, ShouldResemble, *blocks[4].BlockHash())
+		So(anchor.link(ctx, src, 2, &blocks[2].SignedHeader), ShouldBeNil)
+		So(anchor.link(ctx, src, 4, &blocks[4].SignedHeader), ShouldBeNil)
+		So(anchor.height, ShouldEqual, 4)
+
+		// forked blocks are rejected
+		fork, err := createRandomBlock(*blocks[1].BlockHash(), false)
+		So(err, ShouldBeNil)
+		err = anchor.link(ctx, src, 2, &fork.SignedHeader)
+		So(errors.Cause(err), ShouldEqual, ErrResponseVerification)
+		err = anchor.link(ctx, src, 4, &fork.SignedHeader)
+		So(errors.Cause(err), ShouldEqual, ErrResponseVerification)
+		fork, err = createRandomBlock(*blocks[2].BlockHash(), false)
+		So(err, ShouldBeNil)
+		err = anchor.link(ctx, src, 6, &fork.SignedHeader)
+		So(errors.Cause(err), ShouldEqual, ErrResponseVerification)
+		So(anchor.height, ShouldEqual, 4)
+
+		So(anchor.link(ctx, src, 5, &blocks[5].SignedHeader), ShouldBeNil)
+		So(anchor.height, ShouldEqual, 5)
+	})
+}
+
+func TestVerify(t *testing.T) {
+	Convey("test verified queries", t, func() {
+		var stopTestService func()
+		var err error
+		stopTestService, _, err = startTestService()
+		So(err, ShouldBeNil)
+		defer stopTestService()
+
+		var db *sql.DB
+		db, err = sql.Open("covenantsql", "covenantsql://db?verify=true")
+		So(err, ShouldBeNil)
+		defer db.Close()
+
+		var (
+			ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+			wInfo       ResponseInfo
+			rInfo       ResponseInfo
+		)
+		defer cancel()
+		_, err = db.ExecContext(WithResponseInfo(ctx, &wInfo), "create table test (test int)")
+		So(err, ShouldBeNil)
+		So(wInfo.Verification, ShouldNotBeNil)
+
+		var result int
+		err = db.QueryRowContext(WithResponseInfo(ctx, &rInfo), "select count(1) from test").Scan(&result)
+		So(err, ShouldBeNil)
+		So(result, ShouldEqual, 0)
+		So(rInfo.Verification, ShouldNotBeNil)
+
+		// both the write response and the acked read response are packed in blocks
+		height, err := wInfo.Verification.Wait(ctx)
+		So(err, ShouldBeNil)
+		So(height, ShouldBeGreaterThan, 0)
+		height, err = rInfo.Verification.Wait(ctx)
+		So(err, ShouldBeNil)
+		So(height, ShouldBeGreaterThan, 0)
+		verified, ok := rInfo.Verification.VerifiedHeight()
+		So(ok, ShouldBeTrue)
+		So(verified, ShouldEqual, height)
+		So(rInfo.Verification.Block(), ShouldNotResemble, hash.Hash{})
+
+		Convey("response signed by unregistered key should be rejected", func() {
+			nodeID, err := kms.GetLocalNodeID()
+			So(err, ShouldBeNil)
+			priv, _, err := asymmetric.GenSecp256k1KeyPair()
+			So(err, ShouldBeNil)
+			resp := &types.Response{
+				Header: types.SignedResponseHeader{
+					ResponseHeader: types.ResponseHeader{NodeID: nodeID},
+				},
+			}
+			So(resp.Sign(priv), ShouldBeNil)
+			err = verifyResponse(resp, nodeID)
+			So(errors.Cause(err), ShouldEqual, ErrResponseVerification)
+			err = verifyResponse(resp, proto.NodeID("0000"))
+			So(errors.Cause(err), ShouldEqual, ErrResponseVerification)
+
+			localKey, err := kms.GetLocalPrivateKey()
+			So(err, ShouldBeNil)
+			So(resp.Sign(localKey), ShouldBeNil)
+			So(verifyResponse(resp, nodeID), ShouldBeNil)
+		})
+	})
+}
@@ -44,11 +44,32 @@ func startDBMS(server *rpc.Server, onCreateDB func()) (dbms *worker.DBMS, err er
 		return
 	}
 
+	rateLimit := conf.GConf.Miner.RateLimit
+	queryLimit := conf.GConf.Miner.QueryLimit
 	cfg := &worker.DBMSConfig{
 		RootDir:          conf.GConf.Miner.RootDir,
 		Server:           server,
 		MaxReqTimeGap:    conf.GConf.Miner.MaxReqTimeGap,
 		OnCreateDatabase: onCreateDB,
+		RateLimit: types.RateLimitConfig{
+			Read:  types.RateLimit{Rate: rateLimit.ReadRate, Burst: rateLimit.ReadBurst},
+			Write: types.RateLimit{Rate: rateLimit.WriteRate, Burst: rateLimit.WriteBurst},
+		},
+		QueryLimit: types.QueryLimitConfig{
+			Default: types.QueryLimit{
+				Timeout:    uint64(queryLimit.Timeout / time.Millisecond),
+				MaxRows:    queryLimit.MaxRows,
+				MaxBytes:   queryLimit.MaxBytes,
+				MaxVMSteps: queryLimit.MaxVMSteps,
+			},
+		},
+		HistoryPeriod:     conf.GConf.Miner.History.Period,
+		HistoryRetention:  conf.GConf.Miner.History.Retention,
+		CursorTTL:         conf.GConf.Miner.Cursor.TTL,
+		MaxCursorsPerConn: conf.GConf.Miner.Cursor.MaxPerConn,
+		MaxCursorsPerNode: conf.GConf.Miner.Cursor.MaxPerNode,
+		MaxCursorsPerDB:   conf.GConf.Miner.Cursor.MaxPerDB,
+		ChangeRetention:   conf.GConf.Miner.Changes.Retention,
 	}
 
 	if dbms, err = worker.NewDBMS(cfg); err != nil {
@@ -25,7 +25,9 @@ import (
 	"sync"
 
 	"github.com/CovenantSQL/CovenantSQL/client"
+	"github.com/CovenantSQL/CovenantSQL/types"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	"github.com/CovenantSQL/sqlparser"
 	my "github.com/siddontang/go-mysql/mysql"
 )
 
@@ -57,6 +59,7 @@ type Cursor struct {
 	curDBLock     sync.Mutex
 	curDB         string
 	curDBInstance *sql.DB
+	schema        *virtualSchema
 }
 
 // NewCursor returns a new cursor.
@@ -64,7 +67,7 @@ func NewCursor(s *Server) (c *Cursor) {
 	return &Cursor{server: s}
 }
 
-func (c *Cursor) buildResultSet(rows *sql.Rows) (r *my.Result, err error) {
+func (c *Cursor) buildResultSet(rows *sql.Rows, binary bool) (r *my.Result, err error) {
 	// get columns
 	var columns []string
 	if columns, err = rows.Columns(); err != nil {
@@ -80,7 +83,12 @@ func (c *Cursor) buildResultSet(rows *sql.Rows) (r *my.Result, err error) {
 	}
 
 	var resultSet *my.Resultset
-	if resultSet, err = my.BuildSimpleTextResultset(columns, resultData); err != nil {
+	if binary {
+		resultSet, err = buildBinaryResultset(columns, resultData)
+	} else {
+		resultSet, err = my.BuildSimpleTextResultset(columns, resultData)
+	}
+	if err != nil {
 		err = my.NewError(my.ER_UNKNOWN_ERROR, err.Error())
 		return
 	}
@@ -108,6 +116,62 @@ func (c *Cursor) ensureDatabase() (conn *sql.DB, err error) {
 	return
 }
 
+func (c *Cursor) currentDB() string {
+	c.curDBLock.Lock()
+	defer c.curDBLock.Unlock()
+
+	return c.curDB
+}
+
+// queryRows executes the read query, the information_schema queries are executed on the virtual
+// information_schema built from the schema of current database.
+func (c *Cursor) queryRows(conn *sql.DB, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	if !isInformationSchemaQuery(query) {
+		return conn.Query(query, args...)
+	}
+
+	if c.schema == nil {
+		if c.schema, err = newVirtualSchema(c); err != nil {
+			return
+		}
+	}
+	if err = c.schema.refresh(conn, c.currentDB()); err != nil {
+		return
+	}
+
+	return c.schema.Query(query, args...)
+}
+
+// isInformationSchemaQuery reports whether the query reads any table of information_schema, the
+// queries which can't be parsed are left to the database.
+func isInformationSchemaQuery(query string) (found bool) {
+	var stmt, err = sqlparser.Parse(query)
+	if err != nil {
+		return
+	}
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+		if t, ok := node.(sqlparser.TableName); ok &&
+			strings.EqualFold(t.Qualifier.String(), informationSchema) {
+			found = true
+		}
+		return !found, nil
+	}, stmt)
+	return
+}
+
+// Close releases the resources of the cursor after the connection is closed.
+func (c *Cursor) Close() {
+	c.curDBLock.Lock()
+	defer c.curDBLock.Unlock()
+
+	if c.curDBInstance != nil {
+		_ = c.curDBInstance.Close()
+	}
+	if c.schema != nil {
+		_ = c.schema.Close()
+	}
+}
+
 func (c *Cursor) detectColumnType(typeStr string) (typeByte uint8) {
 	typeStr = strings.ToUpper(typeStr)
 
@@ -276,6 +340,7 @@ func (c *Cursor) UseDB(dbName string) (err error) {
 	// connect database
 	cfg := client.NewConfig()
 	cfg.DatabaseID = dbName
+	cfg.Dialect = types.MySQLDialect
 
 	var db *sql.DB
 
@@ -309,13 +374,13 @@ func (c *Cursor) HandleQuery(query string) (r *my.Result, err error) {
 	// as normal query
 	if readQuery.MatchString(query) {
 		var rows *sql.Rows
-		if rows, err = conn.Query(query); err != nil {
+		if rows, err = c.queryRows(conn, query); err != nil {
 			err = my.NewError(my.ER_UNKNOWN_ERROR, err.Error())
 			return
 		}
 
 		// build result set
-		return c.buildResultSet(rows)
+		return c.buildResultSet(rows, false)
 	}
 
 	var result sql.Result
@@ -324,17 +389,19 @@ func (c *Cursor) HandleQuery(query string) (r *my.Result, err error) {
 		return
 	}
 
+	return c.buildExecResult(result), nil
+}
+
+func (c *Cursor) buildExecResult(result sql.Result) *my.Result {
 	lastInsertID, _ := result.LastInsertId()
 	affectedRows, _ := result.RowsAffected()
 
-	r = &my.Result{
+	return &my.Result{
 		Status:       0,
 		InsertId:     uint64(lastInsertID),
 		AffectedRows: uint64(affectedRows),
 		Resultset:    nil,
 	}
-
-	return
 }
 
 // HandleFieldList handle COM_FILED_LIST command.
@@ -347,7 +414,7 @@ func (c *Cursor) HandleFieldList(table string, fieldWildcard string) (fields []*
 
 	// send show tables command
 	var columns *sql.Rows
-	if columns, err = conn.Query(fmt.Sprintf("DESC `%s`", table)); err != nil {
+	if columns, err = conn.Query(fmt.Sprintf(tableInfoQuery, table)); err != nil {
 		// wrap error
 		err = my.NewError(my.ER_UNKNOWN_ERROR, err.Error())
 		return
@@ -406,22 +473,97 @@ func (c *Cursor) HandleFieldList(table string, fieldWildcard string) (fields []*
 
 // HandleStmtPrepare handle COM_STMT_PREPARE, params is the param number for this statement, columns is the column number
 // context will be used later for statement execute.
+//
+// According to the libmysql standard: https://github.com/mysql/mysql-server/blob/8.0/libmysql/libmysql.cc#L1599
+// the COM_STMT_PREPARE should return the correct bind parameter count, which is counted from the parsed statement,
+// and the correct number of return fields, which is detected by dry-running the read query against the database.
 func (c *Cursor) HandleStmtPrepare(query string) (params int, columns int, context interface{}, err error) {
-	// TODO(xq26144), not implemented
-	// According to the libmysql standard: https://github.com/mysql/mysql-server/blob/8.0/libmysql/libmysql.cc#L1599
-	// the COM_STMT_PREPARE should return the correct bind parameter count (which can be implemented by newly created parser)
-	// and should return the correct number of return fields (which can not be implemented right now with new query plan logic embedded)
+	log.WithField("query", query).Info("received prepare")
 
-	err = my.NewError(my.ER_NOT_SUPPORTED_YET, "stmt prepare is not supported yet")
-	return
+	if emptyResultQuery.MatchString(query) {
+		context = &preparedStmt{empty: true}
+		return
+	}
+
+	var conn *sql.DB
+
+	if conn, err = c.ensureDatabase(); err != nil {
+		return
+	}
+
+	if params, err = countStmtParams(query); err != nil {
+		err = my.NewError(my.ER_PARSE_ERROR, err.Error())
+		return
+	}
+
+	stmt := &preparedStmt{params: params, read: readQuery.MatchString(query)}
+
+	if stmt.read {
+		// dry-run the query with null parameters to get the result columns
+		var rows *sql.Rows
+		if rows, err = c.queryRows(conn, describeQuery(query), make([]interface{}, params)...); err != nil {
+			err = my.NewError(my.ER_UNKNOWN_ERROR, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		var names []string
+		if names, err = rows.Columns(); err != nil {
+			err = my.NewError(my.ER_UNKNOWN_ERROR, err.Error())
+			return
+		}
+		stmt.columns = len(names)
+	}
+
+	return stmt.params, stmt.columns, stmt, nil
 }
 
 // HandleStmtExecute handle COM_STMT_EXECUTE, context is the previous one set in prepare
 // query is the statement prepare query, and args is the params for this statement.
-func (c *Cursor) HandleStmtExecute(context interface{}, query string, args []interface{}) (result *my.Result, err error) {
-	// same to COM_STMT_PREPARE
-	err = my.NewError(my.ER_NOT_SUPPORTED_YET, "stmt execute is not supported yet")
-	return
+func (c *Cursor) HandleStmtExecute(context interface{}, query string, args []interface{}) (r *my.Result, err error) {
+	stmt, ok := context.(*preparedStmt)
+	if !ok {
+		err = my.NewError(my.ER_UNKNOWN_STMT_HANDLER, "unknown prepared statement")
+		return
+	}
+
+	if stmt.empty {
+		r = &my.Result{
+			Status:       0,
+			InsertId:     0,
+			AffectedRows: 0,
+			Resultset:    nil,
+		}
+		return
+	}
+
+	var conn *sql.DB
+
+	if conn, err = c.ensureDatabase(); err != nil {
+		return
+	}
+
+	// arguments are sent as positional named args of the query
+	args = convertStmtArgs(args)
+
+	if stmt.read {
+		var rows *sql.Rows
+		if rows, err = c.queryRows(conn, query, args...); err != nil {
+			err = my.NewError(my.ER_UNKNOWN_ERROR, err.Error())
+			return
+		}
+
+		// build binary protocol result set
+		return c.buildResultSet(rows, true)
+	}
+
+	var result sql.Result
+	if result, err = conn.Exec(query, args...); err != nil {
+		err = my.NewError(my.ER_UNKNOWN_ERROR, err.Error())
+		return
+	}
+
+	return c.buildExecResult(result), nil
 }
 
 // HandleStmtClose handle COM_STMT_CLOSE, context is the previous one set in prepare
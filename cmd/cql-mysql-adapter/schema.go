@@ -0,0 +1,520 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	sqlite3 "github.com/CovenantSQL/go-sqlite3-encrypt"
+)
+
+const (
+	informationSchema = "information_schema"
+	defaultCatalog    = "def"
+	defaultCharset    = "utf8"
+	defaultCollation  = "utf8_general_ci"
+	serverVersion     = "5.7.0"
+)
+
+var (
+	// tableInfoQuery is translated to the table_info pragma by the database, unlike DESC which
+	// returns the MySQL DESCRIBE format in the mysql dialect.
+	tableInfoQuery = "SHOW TABLE `%s`"
+	// schemaVersionQuery reads the schema version of the database, which is changed by every
+	// schema change.
+	schemaVersionQuery = "SELECT schema_version FROM pragma_schema_version"
+
+	createIndexSQL = regexp.MustCompile(
+		"(?is)^\\s*CREATE\\s+(UNIQUE\\s+)?INDEX\\s+.*?\\bON\\s+[^(]+\\((.*)\\)\\s*(?:WHERE\\b.*)?$")
+	indexColumnSuffix = regexp.MustCompile("(?i)\\s+(?:COLLATE\\s+\\S+\\s*)?(ASC|DESC)?\\s*$")
+	typeParams        = regexp.MustCompile("^([^(]*)(?:\\((\\s*\\d+)\\s*(?:,\\s*(\\d+)\\s*)?\\))?")
+
+	// mysqlTypes maps the declared type names to mysql data types with the default numeric precision.
+	mysqlTypes = map[string]struct {
+		name      string
+		precision int64
+	}{
+		"tinyint":    {"tinyint", 3},
+		"smallint":   {"smallint", 5},
+		"mediumint":  {"mediumint", 7},
+		"int":        {"int", 10},
+		"integer":    {"int", 10},
+		"bigint":     {"bigint", 19},
+		"bool":       {"tinyint", 3},
+		"boolean":    {"tinyint", 3},
+		"float":      {"float", 12},
+		"double":     {"double", 22},
+		"real":       {"double", 22},
+		"decimal":    {"decimal", 10},
+		"numeric":    {"decimal", 10},
+		"bit":        {"bit", 1},
+		"char":       {"char", 0},
+		"varchar":    {"varchar", 0},
+		"tinytext":   {"tinytext", 0},
+		"text":       {"text", 0},
+		"mediumtext": {"mediumtext", 0},
+		"longtext":   {"longtext", 0},
+		"binary":     {"binary", 0},
+		"varbinary":  {"varbinary", 0},
+		"tinyblob":   {"tinyblob", 0},
+		"blob":       {"blob", 0},
+		"mediumblob": {"mediumblob", 0},
+		"longblob":   {"longblob", 0},
+		"date":       {"date", 0},
+		"datetime":   {"datetime", 0},
+		"timestamp":  {"timestamp", 0},
+		"time":       {"time", 0},
+		"year":       {"year", 0},
+		"json":       {"json", 0},
+	}
+
+	informationSchemaTables = []string{
+		`CREATE TABLE information_schema.SCHEMATA (CATALOG_NAME TEXT, SCHEMA_NAME TEXT,
+	DEFAULT_CHARACTER_SET_NAME TEXT, DEFAULT_COLLATION_NAME TEXT, SQL_PATH TEXT)`,
+		`CREATE TABLE information_schema.TABLES (TABLE_CATALOG TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT,
+	TABLE_TYPE TEXT, ENGINE TEXT, VERSION BIGINT, ROW_FORMAT TEXT, TABLE_ROWS BIGINT, AVG_ROW_LENGTH BIGINT,
+	DATA_LENGTH BIGINT, MAX_DATA_LENGTH BIGINT, INDEX_LENGTH BIGINT, DATA_FREE BIGINT, AUTO_INCREMENT BIGINT,
+	CREATE_TIME DATETIME, UPDATE_TIME DATETIME, CHECK_TIME DATETIME, TABLE_COLLATION TEXT, CHECKSUM BIGINT,
+	CREATE_OPTIONS TEXT, TABLE_COMMENT TEXT)`,
+		`CREATE TABLE information_schema.COLUMNS (TABLE_CATALOG TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT,
+	COLUMN_NAME TEXT, ORDINAL_POSITION BIGINT, COLUMN_DEFAULT TEXT, IS_NULLABLE TEXT, DATA_TYPE TEXT,
+	CHARACTER_MAXIMUM_LENGTH BIGINT, CHARACTER_OCTET_LENGTH BIGINT, NUMERIC_PRECISION BIGINT,
+	NUMERIC_SCALE BIGINT, DATETIME_PRECISION BIGINT, CHARACTER_SET_NAME TEXT, COLLATION_NAME TEXT,
+	COLUMN_TYPE TEXT, COLUMN_KEY TEXT, EXTRA TEXT, PRIVILEGES TEXT, COLUMN_COMMENT TEXT,
+	GENERATION_EXPRESSION TEXT)`,
+		`CREATE TABLE information_schema.STATISTICS (TABLE_CATALOG TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT,
+	NON_UNIQUE BIGINT, INDEX_SCHEMA TEXT, INDEX_NAME TEXT, SEQ_IN_INDEX BIGINT, COLUMN_NAME TEXT,
+	COLLATION TEXT, CARDINALITY BIGINT, SUB_PART BIGINT, PACKED TEXT, NULLABLE TEXT, INDEX_TYPE TEXT,
+	COMMENT TEXT, INDEX_COMMENT TEXT)`,
+		`CREATE TABLE information_schema.VIEWS (TABLE_CATALOG TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT,
+	VIEW_DEFINITION TEXT, CHECK_OPTION TEXT, IS_UPDATABLE TEXT, DEFINER TEXT, SECURITY_TYPE TEXT,
+	CHARACTER_SET_CLIENT TEXT, COLLATION_CONNECTION TEXT)`,
+		`CREATE TABLE information_schema.TABLE_CONSTRAINTS (CONSTRAINT_CATALOG TEXT, CONSTRAINT_SCHEMA TEXT,
+	CONSTRAINT_NAME TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT, CONSTRAINT_TYPE TEXT)`,
+		`CREATE TABLE information_schema.KEY_COLUMN_USAGE (CONSTRAINT_CATALOG TEXT, CONSTRAINT_SCHEMA TEXT,
+	CONSTRAINT_NAME TEXT, TABLE_CATALOG TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT, COLUMN_NAME TEXT,
+	ORDINAL_POSITION BIGINT, POSITION_IN_UNIQUE_CONSTRAINT BIGINT, REFERENCED_TABLE_SCHEMA TEXT,
+	REFERENCED_TABLE_NAME TEXT, REFERENCED_COLUMN_NAME TEXT)`,
+	}
+)
+
+// schemaObject is a table, view or index in sqlite_master.
+type schemaObject struct {
+	typ, name, table string
+	sql              sql.NullString
+}
+
+// schemaColumn is a column in the table_info pragma.
+type schemaColumn struct {
+	name     string
+	declType string
+	notNull  bool
+	dflt     sql.NullString
+	pk       int64
+}
+
+// schemaIndex is an index of table, with the primary key as the index named PRIMARY.
+type schemaIndex struct {
+	name    string
+	unique  bool
+	columns []string
+	desc    []bool
+}
+
+// schemaConnector connects to the memory database with the information_schema attached.
+type schemaConnector struct {
+	drv *sqlite3.SQLiteDriver
+}
+
+func (c *schemaConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.drv.Open(":memory:")
+}
+
+func (c *schemaConnector) Driver() driver.Driver {
+	return c.drv
+}
+
+// virtualSchema is the information_schema emulation in a memory sqlite database, which is
+// rebuilt from sqlite_master and table_info pragma of the database when the schema version
+// changes.
+type virtualSchema struct {
+	*sql.DB
+	database string
+	version  int64
+	loaded   bool
+}
+
+func newVirtualSchema(c *Cursor) (s *virtualSchema, err error) {
+	var functions = map[string]interface{}{
+		"database": c.currentDB,
+		"schema":   c.currentDB,
+		"user":     func() string { return c.server.mysqlUser },
+		"version":  func() string { return serverVersion },
+		"concat": func(args ...interface{}) (s string) {
+			for _, v := range args {
+				if b, ok := v.([]byte); ok {
+					s += string(b)
+				} else if v != nil {
+					s += fmt.Sprint(v)
+				}
+			}
+			return
+		},
+	}
+	s = &virtualSchema{DB: sql.OpenDB(&schemaConnector{drv: &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) (err error) {
+			for k, v := range functions {
+				if err = conn.RegisterFunc(k, v, true); err != nil {
+					return
+				}
+			}
+			return
+		},
+	}})}
+	// every connection has its own memory database
+	s.SetMaxOpenConns(1)
+	s.SetConnMaxLifetime(0)
+	defer func() {
+		if err != nil {
+			_ = s.Close()
+			s = nil
+		}
+	}()
+	if _, err = s.Exec(`ATTACH DATABASE ':memory:' AS information_schema`); err != nil {
+		return
+	}
+	for _, v := range informationSchemaTables {
+		if _, err = s.Exec(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *virtualSchema) insert(table string, rows [][]interface{}) (err error) {
+	for _, row := range rows {
+		var holders = strings.TrimSuffix(strings.Repeat("?, ", len(row)), ", ")
+		if _, err = s.Exec(fmt.Sprintf(
+			"INSERT INTO information_schema.%s VALUES (%s)", table, holders), row...); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// refresh reloads the information_schema if the schema version of the database changed.
+func (s *virtualSchema) refresh(src *sql.DB, database string) (err error) {
+	var (
+		rows    *sql.Rows
+		objects []*schemaObject
+		version int64
+	)
+	if err = src.QueryRow(schemaVersionQuery).Scan(&version); err != nil {
+		return
+	}
+	if s.loaded && database == s.database && version == s.version {
+		return
+	}
+	s.loaded = false
+
+	if rows, err = src.Query(`SELECT type, name, tbl_name, sql FROM sqlite_master
+WHERE type IN ('table', 'view', 'index') AND name NOT LIKE 'sqlite%'`); err != nil {
+		return
+	}
+	for rows.Next() {
+		var o = &schemaObject{}
+		if err = rows.Scan(&o.typ, &o.name, &o.table, &o.sql); err != nil {
+			_ = rows.Close()
+			return
+		}
+		objects = append(objects, o)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, v := range []string{"SCHEMATA", "TABLES", "COLUMNS", "STATISTICS", "VIEWS",
+		"TABLE_CONSTRAINTS", "KEY_COLUMN_USAGE"} {
+		if _, err = s.Exec("DELETE FROM information_schema." + v); err != nil {
+			return
+		}
+	}
+	var data = make(map[string][][]interface{})
+	for _, v := range []string{informationSchema, database} {
+		data["SCHEMATA"] = append(data["SCHEMATA"], []interface{}{
+			defaultCatalog, v, defaultCharset, defaultCollation, nil})
+	}
+
+	var indexes = make(map[string][]*schemaIndex)
+	for _, o := range objects {
+		if o.typ != "index" {
+			continue
+		}
+		if m := createIndexSQL.FindStringSubmatch(o.sql.String); m != nil {
+			var idx = &schemaIndex{name: o.name, unique: m[1] != ""}
+			for _, v := range splitColumns(m[2]) {
+				var suffix = indexColumnSuffix.FindStringSubmatch(v)
+				if suffix != nil {
+					v = strings.TrimSuffix(v, suffix[0])
+				}
+				idx.columns = append(idx.columns, unquoteIdentifier(v))
+				idx.desc = append(idx.desc, suffix != nil && strings.EqualFold(suffix[1], "DESC"))
+			}
+			indexes[o.table] = append(indexes[o.table], idx)
+		}
+	}
+
+	for _, o := range objects {
+		switch o.typ {
+		case "table", "view":
+		default:
+			continue
+		}
+		var columns []*schemaColumn
+		if columns, err = tableColumns(src, o.name); err != nil {
+			return
+		}
+		if o.typ == "view" {
+			data["TABLES"] = append(data["TABLES"], []interface{}{
+				defaultCatalog, database, o.name, "VIEW", nil, nil, nil, nil, nil, nil, nil, nil, nil,
+				nil, nil, nil, nil, nil, nil, nil, "VIEW"})
+			data["VIEWS"] = append(data["VIEWS"], []interface{}{
+				defaultCatalog, database, o.name, o.sql.String, "NONE", "NO", "", "DEFINER",
+				defaultCharset, defaultCollation})
+		} else {
+			data["TABLES"] = append(data["TABLES"], []interface{}{
+				defaultCatalog, database, o.name, "BASE TABLE", "SQLite", 10, "Dynamic", 0, 0, 0, 0, 0, 0,
+				nil, nil, nil, nil, defaultCollation, nil, "", ""})
+		}
+
+		// primary key is reported as the index named PRIMARY
+		var (
+			pk         = &schemaIndex{name: "PRIMARY", unique: true}
+			pkColumns  = make(map[int64]string)
+			tableIndex = indexes[o.name]
+		)
+		for _, v := range columns {
+			if v.pk > 0 {
+				pkColumns[v.pk] = v.name
+			}
+		}
+		for i := int64(1); i <= int64(len(pkColumns)); i++ {
+			pk.columns, pk.desc = append(pk.columns, pkColumns[i]), append(pk.desc, false)
+		}
+		if len(pk.columns) > 0 {
+			tableIndex = append([]*schemaIndex{pk}, tableIndex...)
+		}
+
+		for i, v := range columns {
+			var (
+				dataType, columnType, charLen, precision, scale = mysqlColumnType(v.declType)
+				nullable, key, extra                            = "YES", "", ""
+				charset, collation                              interface{}
+				dflt                                            interface{}
+			)
+			if v.notNull || v.pk > 0 {
+				nullable = "NO"
+			}
+			if v.dflt.Valid {
+				dflt = strings.Trim(v.dflt.String, "'")
+			}
+			if charLen.Valid && !strings.Contains(dataType, "blob") && !strings.Contains(dataType, "binary") {
+				// binary strings have no character set
+				charset, collation = defaultCharset, defaultCollation
+			}
+			for _, idx := range tableIndex {
+				if idx.columns[0] != v.name {
+					continue
+				}
+				if idx.name == "PRIMARY" {
+					key = "PRI"
+				} else if idx.unique && len(idx.columns) == 1 && key == "" {
+					key = "UNI"
+				} else if key == "" {
+					key = "MUL"
+				}
+			}
+			if v.pk > 0 && len(pk.columns) == 1 && strings.EqualFold(v.declType, "INTEGER") {
+				// INTEGER PRIMARY KEY is the alias of rowid
+				extra = "auto_increment"
+			}
+			data["COLUMNS"] = append(data["COLUMNS"], []interface{}{
+				defaultCatalog, database, o.name, v.name, i + 1, dflt, nullable, dataType, charLen, charLen,
+				precision, scale, nil, charset, collation, columnType, key, extra,
+				"select,insert,update,references", "", ""})
+		}
+
+		var nullable = make(map[string]string)
+		for _, v := range columns {
+			if !v.notNull && v.pk == 0 {
+				nullable[v.name] = "YES"
+			}
+		}
+		for _, idx := range tableIndex {
+			var nonUnique = 1
+			if idx.unique {
+				nonUnique = 0
+				var typ = "UNIQUE"
+				if idx.name == "PRIMARY" {
+					typ = "PRIMARY KEY"
+				}
+				data["TABLE_CONSTRAINTS"] = append(data["TABLE_CONSTRAINTS"], []interface{}{
+					defaultCatalog, database, idx.name, database, o.name, typ})
+			}
+			for j, col := range idx.columns {
+				var order = "A"
+				if idx.desc[j] {
+					order = "D"
+				}
+				data["STATISTICS"] = append(data["STATISTICS"], []interface{}{
+					defaultCatalog, database, o.name, nonUnique, database, idx.name, j + 1, col, order,
+					nil, nil, nil, nullable[col], "BTREE", "", ""})
+				if idx.unique {
+					data["KEY_COLUMN_USAGE"] = append(data["KEY_COLUMN_USAGE"], []interface{}{
+						defaultCatalog, database, idx.name, defaultCatalog, database, o.name, col, j + 1,
+						nil, nil, nil, nil})
+				}
+			}
+		}
+	}
+	for k, v := range data {
+		if err = s.insert(k, v); err != nil {
+			return
+		}
+	}
+	s.database, s.version, s.loaded = database, version, true
+	return
+}
+
+func tableColumns(src *sql.DB, table string) (columns []*schemaColumn, err error) {
+	var rows *sql.Rows
+	if rows, err = src.Query(fmt.Sprintf(tableInfoQuery, table)); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid interface{}
+			v   = &schemaColumn{}
+		)
+		if err = rows.Scan(&cid, &v.name, &v.declType, &v.notNull, &v.dflt, &v.pk); err != nil {
+			return
+		}
+		columns = append(columns, v)
+	}
+	err = rows.Err()
+	return
+}
+
+// splitColumns splits the column list of index definition by the top-level commas.
+func splitColumns(s string) (columns []string) {
+	var depth, start int
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				columns = append(columns, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(columns, strings.TrimSpace(s[start:]))
+}
+
+func unquoteIdentifier(s string) string {
+	if len(s) >= 2 {
+		switch s[0] {
+		case '`', '"', '[':
+			return s[1 : len(s)-1]
+		}
+	}
+	return s
+}
+
+// mysqlColumnType maps the sqlite declared type to mysql data type and column type, types unknown
+// to mysql are mapped by the sqlite type affinity rules.
+func mysqlColumnType(declType string) (
+	dataType, columnType string, charLen, precision, scale sql.NullInt64,
+) {
+	var (
+		m        = typeParams.FindStringSubmatch(strings.ToLower(strings.TrimSpace(declType)))
+		base     = strings.Join(strings.Fields(m[1]), " ")
+		size, _  = strconv.ParseInt(strings.TrimSpace(m[2]), 10, 64)
+		digit, _ = strconv.ParseInt(m[3], 10, 64)
+		words    = strings.Fields(base)
+	)
+	if t, ok := mysqlTypes[base]; ok {
+		dataType = t.name
+	} else if len(words) > 0 && mysqlTypes[words[len(words)-1]].name != "" {
+		// like UNSIGNED BIG INT or CHARACTER VARYING
+		dataType = mysqlTypes[words[len(words)-1]].name
+	} else {
+		switch {
+		case strings.Contains(base, "int"):
+			dataType = "bigint"
+		case strings.Contains(base, "char") || strings.Contains(base, "clob") || strings.Contains(base, "text"):
+			dataType = "text"
+		case strings.Contains(base, "blob") || base == "":
+			dataType = "blob"
+		case strings.Contains(base, "real") || strings.Contains(base, "floa") || strings.Contains(base, "doub"):
+			dataType = "double"
+		default:
+			dataType = "decimal"
+		}
+	}
+
+	columnType = dataType
+	switch dataType {
+	case "char", "varchar", "binary", "varbinary":
+		if size == 0 {
+			size = 255
+		}
+		charLen = sql.NullInt64{Int64: size, Valid: true}
+		columnType = fmt.Sprintf("%s(%d)", dataType, size)
+	case "tinytext", "tinyblob":
+		charLen = sql.NullInt64{Int64: 255, Valid: true}
+	case "text", "blob":
+		charLen = sql.NullInt64{Int64: 65535, Valid: true}
+	case "mediumtext", "mediumblob":
+		charLen = sql.NullInt64{Int64: 16777215, Valid: true}
+	case "longtext", "longblob", "json":
+		charLen = sql.NullInt64{Int64: 4294967295, Valid: true}
+	case "decimal":
+		if size == 0 {
+			size = mysqlTypes[dataType].precision
+		}
+		precision = sql.NullInt64{Int64: size, Valid: true}
+		scale = sql.NullInt64{Int64: digit, Valid: true}
+		columnType = fmt.Sprintf("decimal(%d,%d)", size, digit)
+	default:
+		if p := mysqlTypes[dataType].precision; p > 0 {
+			precision = sql.NullInt64{Int64: p, Valid: true}
+			scale = sql.NullInt64{Valid: dataType != "float" && dataType != "double"}
+		}
+	}
+	return
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func queryStrings(db *sql.DB, query string) (rows [][]string, err error) {
+	var result *sql.Rows
+	if result, err = db.Query(query); err != nil {
+		return
+	}
+	defer result.Close()
+	var values [][]interface{}
+	if values, err = readAllRows(result); err != nil {
+		return
+	}
+	for _, v := range values {
+		var row = make([]string, len(v))
+		for i, f := range v {
+			if f == nil {
+				row[i] = "NULL"
+			} else {
+				row[i] = string(formatTextValue(f))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return
+}
+
+func TestVirtualSchema(t *testing.T) {
+	Convey("Given a virtual information_schema of a local database", t, func() {
+		dir, err := ioutil.TempDir("", "mysql-adapter")
+		So(err, ShouldBeNil)
+		Reset(func() { _ = os.RemoveAll(dir) })
+		src, err := sql.Open("sqlite3", filepath.Join(dir, "test.db"))
+		So(err, ShouldBeNil)
+		Reset(func() { _ = src.Close() })
+		for _, v := range []string{
+			"CREATE TABLE t (id INTEGER PRIMARY KEY, name VARCHAR(32) NOT NULL DEFAULT 'x', score DECIMAL(8,2))",
+			"CREATE UNIQUE INDEX t_name ON t (name)",
+			"CREATE INDEX t_score ON t (score DESC, `id`)",
+			"CREATE TABLE u (a TEXT, b BLOB, PRIMARY KEY (b, a))",
+			"CREATE VIEW v AS SELECT id FROM t",
+		} {
+			_, err = src.Exec(v)
+			So(err, ShouldBeNil)
+		}
+
+		tableInfoQuery = "PRAGMA table_info(`%s`)"
+		var c = &Cursor{server: &Server{mysqlUser: "root"}, curDB: "db"}
+		s, err := newVirtualSchema(c)
+		So(err, ShouldBeNil)
+		Reset(func() { _ = s.Close() })
+		So(s.refresh(src, "db"), ShouldBeNil)
+
+		Convey("The tables and views should be listed", func() {
+			rows, err := queryStrings(s.DB, `SELECT TABLE_SCHEMA, TABLE_NAME, TABLE_TYPE
+FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() ORDER BY TABLE_NAME`)
+			So(err, ShouldBeNil)
+			So(rows, ShouldResemble, [][]string{
+				{"db", "t", "BASE TABLE"},
+				{"db", "u", "BASE TABLE"},
+				{"db", "v", "VIEW"},
+			})
+			rows, err = queryStrings(s.DB, "SELECT `SCHEMA_NAME` FROM `information_schema`.`schemata`")
+			So(err, ShouldBeNil)
+			So(rows, ShouldResemble, [][]string{{"information_schema"}, {"db"}})
+		})
+		Convey("The columns should be described", func() {
+			rows, err := queryStrings(s.DB, `SELECT COLUMN_NAME, COLUMN_DEFAULT, IS_NULLABLE, DATA_TYPE,
+	CHARACTER_MAXIMUM_LENGTH, NUMERIC_PRECISION, NUMERIC_SCALE, COLUMN_TYPE, COLUMN_KEY, EXTRA
+FROM information_schema.COLUMNS WHERE TABLE_NAME = 't' ORDER BY ORDINAL_POSITION`)
+			So(err, ShouldBeNil)
+			So(rows, ShouldResemble, [][]string{
+				{"id", "NULL", "NO", "int", "NULL", "10", "0", "int", "PRI", "auto_increment"},
+				{"name", "x", "NO", "varchar", "32", "NULL", "NULL", "varchar(32)", "UNI", ""},
+				{"score", "NULL", "YES", "decimal", "NULL", "8", "2", "decimal(8,2)", "MUL", ""},
+			})
+		})
+		Convey("The indexes should be listed", func() {
+			rows, err := queryStrings(s.DB, `SELECT TABLE_NAME, NON_UNIQUE, INDEX_NAME, SEQ_IN_INDEX,
+	COLUMN_NAME, COLLATION FROM information_schema.STATISTICS ORDER BY TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX`)
+			So(err, ShouldBeNil)
+			So(rows, ShouldResemble, [][]string{
+				{"t", "0", "PRIMARY", "1", "id", "A"},
+				{"t", "0", "t_name", "1", "name", "A"},
+				{"t", "1", "t_score", "1", "score", "D"},
+				{"t", "1", "t_score", "2", "id", "A"},
+				{"u", "0", "PRIMARY", "1", "b", "A"},
+				{"u", "0", "PRIMARY", "2", "a", "A"},
+			})
+			rows, err = queryStrings(s.DB, `SELECT CONSTRAINT_NAME, TABLE_NAME, CONSTRAINT_TYPE
+FROM information_schema.TABLE_CONSTRAINTS ORDER BY TABLE_NAME, CONSTRAINT_NAME`)
+			So(err, ShouldBeNil)
+			So(rows, ShouldResemble, [][]string{
+				{"PRIMARY", "t", "PRIMARY KEY"},
+				{"t_name", "t", "UNIQUE"},
+				{"PRIMARY", "u", "PRIMARY KEY"},
+			})
+		})
+		Convey("The schema should be reloaded after the schema changes", func() {
+			// unchanged schema is not reloaded
+			tableInfoQuery = "SHOW TABLE `%s`"
+			So(s.refresh(src, "db"), ShouldBeNil)
+			tableInfoQuery = "PRAGMA table_info(`%s`)"
+			_, err = src.Exec("CREATE TABLE w (x INT)")
+			So(err, ShouldBeNil)
+			So(s.refresh(src, "db"), ShouldBeNil)
+			rows, err := queryStrings(s.DB, `SELECT COUNT(*) FROM information_schema.TABLES`)
+			So(err, ShouldBeNil)
+			So(rows, ShouldResemble, [][]string{{"4"}})
+		})
+	})
+	Convey("test information_schema query routing", t, func() {
+		for query, expected := range map[string]bool{
+			"SELECT * FROM information_schema.TABLES":                                true,
+			"SELECT * FROM `INFORMATION_SCHEMA`.`columns` c":                         true,
+			"SELECT a FROM t WHERE b IN (SELECT 1 FROM information_schema.SCHEMATA)": true,
+			"SELECT * FROM t WHERE note = 'information_schema'":                      false,
+			"SELECT information_schema FROM t":                                       false,
+			"INSERT INTO t VALUES ('see information_schema.TABLES')":                 false,
+			"SHOW TABLES": false,
+		} {
+			So(isInformationSchemaQuery(query), ShouldEqual, expected)
+		}
+	})
+	Convey("test mysql column type", t, func() {
+		for decl, expected := range map[string][2]string{
+			"INTEGER":          {"int", "int"},
+			"UNSIGNED BIG INT": {"int", "int"},
+			"VARCHAR( 10 )":    {"varchar", "varchar(10)"},
+			"NVARCHAR(20)":     {"text", "text"},
+			"DOUBLE PRECISION": {"double", "double"},
+			"":                 {"blob", "blob"},
+			"DATETIME":         {"datetime", "datetime"},
+			"NUMERIC":          {"decimal", "decimal(10,0)"},
+			"MONEY":            {"decimal", "decimal(10,0)"},
+		} {
+			dataType, columnType, _, _, _ := mysqlColumnType(decl)
+			So(dataType, ShouldEqual, expected[0])
+			So(columnType, ShouldEqual, expected[1])
+		}
+	})
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/CovenantSQL/sqlparser"
+	my "github.com/siddontang/go-mysql/mysql"
+)
+
+var (
+	selectQuery        = regexp.MustCompile("^(?i)\\s*(?:/\\*.*?\\*/)?\\s*SELECT\\b")
+	trailingDelimiters = regexp.MustCompile("[\\s;]+$")
+)
+
+// preparedStmt is the statement context created by COM_STMT_PREPARE.
+type preparedStmt struct {
+	params  int
+	columns int
+	read    bool
+	empty   bool // statement is answered with an empty result without sending to the database
+}
+
+// countStmtParams returns the number of the positional parameters in the query.
+func countStmtParams(query string) (params int, err error) {
+	var (
+		tokenizer = sqlparser.NewStringTokenizer(query)
+		stmt      sqlparser.Statement
+	)
+	tokenizer.SeparatePositionalArgs = true
+	if stmt, err = sqlparser.ParseNext(tokenizer); err != nil {
+		return
+	}
+	if _, err = sqlparser.ParseNext(tokenizer); err != io.EOF {
+		err = fmt.Errorf("only one statement is allowed in prepared statement")
+		return
+	}
+	err = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if v, ok := node.(*sqlparser.SQLVal); ok && v.Type == sqlparser.PosArg {
+			params++
+		}
+		return true, nil
+	}, stmt)
+	return
+}
+
+// describeQuery returns the query to dry-run for the result columns of the read query.
+func describeQuery(query string) string {
+	if selectQuery.MatchString(query) {
+		return fmt.Sprintf("SELECT * FROM (%s) LIMIT 0", trailingDelimiters.ReplaceAllString(query, ""))
+	}
+	return query
+}
+
+// convertStmtArgs converts the binary protocol arguments to query arguments, strings are sent
+// as the length encoded bytes by the protocol.
+func convertStmtArgs(args []interface{}) (converted []interface{}) {
+	converted = make([]interface{}, len(args))
+	for i, v := range args {
+		if b, ok := v.([]byte); ok {
+			converted[i] = string(b)
+		} else {
+			converted[i] = v
+		}
+	}
+	return
+}
+
+func binaryFieldType(value interface{}) uint8 {
+	switch value.(type) {
+	case nil:
+		return my.MYSQL_TYPE_NULL
+	case int8, int16, int32, int64, int, uint8, uint16, uint32, uint64, uint:
+		return my.MYSQL_TYPE_LONGLONG
+	case float32, float64:
+		return my.MYSQL_TYPE_DOUBLE
+	default:
+		return my.MYSQL_TYPE_VAR_STRING
+	}
+}
+
+func formatTextValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case int8:
+		return strconv.AppendInt(nil, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(nil, v, 10)
+	case float64:
+		return strconv.AppendFloat(nil, v, 'f', -1, 64)
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
+
+// buildBinaryResultset builds the binary protocol result set of COM_STMT_EXECUTE.
+//
+// Column type is decided by the non-null values, a column with values of different types is
+// sent as strings since sqlite columns are dynamically typed.
+func buildBinaryResultset(columns []string, values [][]interface{}) (r *my.Resultset, err error) {
+	r = &my.Resultset{Fields: make([]*my.Field, len(columns))}
+	var types = make([]uint8, len(columns))
+	for _, row := range values {
+		if len(row) != len(columns) {
+			err = my.NewError(my.ER_UNKNOWN_ERROR,
+				fmt.Sprintf("row has %d columns not equal to %d", len(row), len(columns)))
+			return
+		}
+		for i, v := range row {
+			switch typ := binaryFieldType(v); {
+			case typ == my.MYSQL_TYPE_NULL:
+			case types[i] == 0:
+				types[i] = typ
+			case types[i] != typ:
+				types[i] = my.MYSQL_TYPE_VAR_STRING
+			}
+		}
+	}
+	for i, name := range columns {
+		var field = &my.Field{Name: []byte(name), Type: types[i], Charset: 33}
+		switch types[i] {
+		case my.MYSQL_TYPE_LONGLONG, my.MYSQL_TYPE_DOUBLE:
+			field.Charset = 63
+			field.Flag = my.BINARY_FLAG
+		default:
+			field.Type = my.MYSQL_TYPE_VAR_STRING
+		}
+		r.Fields[i] = field
+	}
+
+	// null bitmap of binary protocol row has an offset of 2 bits
+	var bitmapLen = (len(columns) + 7 + 2) >> 3
+	r.RowDatas = make([]my.RowData, 0, len(values))
+	for _, row := range values {
+		var data = make([]byte, 1+bitmapLen, 1+bitmapLen+8*len(row))
+		for i, v := range row {
+			if v == nil {
+				data[1+(i+2)>>3] |= 1 << (uint(i+2) % 8)
+				continue
+			}
+			switch r.Fields[i].Type {
+			case my.MYSQL_TYPE_LONGLONG:
+				var n int64
+				switch iv := v.(type) {
+				case int8:
+					n = int64(iv)
+				case int64:
+					n = iv
+				}
+				data = append(data, my.Uint64ToBytes(uint64(n))...)
+			case my.MYSQL_TYPE_DOUBLE:
+				var f, _ = v.(float64)
+				data = append(data, my.Uint64ToBytes(math.Float64bits(f))...)
+			default:
+				data = append(data, my.PutLengthEncodedString(formatTextValue(v))...)
+			}
+		}
+		r.RowDatas = append(r.RowDatas, data)
+	}
+	return
+}
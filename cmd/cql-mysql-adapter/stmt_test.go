@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	my "github.com/siddontang/go-mysql/mysql"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPreparedStmt(t *testing.T) {
+	Convey("test count statement params", t, func() {
+		params, err := countStmtParams("SELECT * FROM t WHERE a = ? AND b = '?' AND c IN (?, ?)")
+		So(err, ShouldBeNil)
+		So(params, ShouldEqual, 3)
+		params, err = countStmtParams("INSERT INTO t (a, b) VALUES (?, ?);")
+		So(err, ShouldBeNil)
+		So(params, ShouldEqual, 2)
+		params, err = countStmtParams("SHOW TABLES")
+		So(err, ShouldBeNil)
+		So(params, ShouldEqual, 0)
+		_, err = countStmtParams("SELECT ?; SELECT ?")
+		So(err, ShouldNotBeNil)
+		_, err = countStmtParams("SELECT FROM WHERE")
+		So(err, ShouldNotBeNil)
+	})
+	Convey("test describe query", t, func() {
+		So(describeQuery("SELECT a FROM t WHERE b = ?; "), ShouldEqual,
+			"SELECT * FROM (SELECT a FROM t WHERE b = ?) LIMIT 0")
+		So(describeQuery("SHOW TABLES"), ShouldEqual, "SHOW TABLES")
+	})
+	Convey("test convert statement args", t, func() {
+		So(convertStmtArgs([]interface{}{[]byte("a"), int64(1), nil}), ShouldResemble,
+			[]interface{}{"a", int64(1), nil})
+	})
+	Convey("test build binary result set", t, func() {
+		rs, err := buildBinaryResultset(
+			[]string{"i", "f", "s", "n", "m"},
+			[][]interface{}{
+				{nil, float64(1.5), "a", nil, int64(1)},
+				{int64(2), nil, "b", nil, "x"},
+			},
+		)
+		So(err, ShouldBeNil)
+		So(rs.Fields, ShouldHaveLength, 5)
+		So(rs.Fields[0].Type, ShouldEqual, my.MYSQL_TYPE_LONGLONG)
+		So(rs.Fields[1].Type, ShouldEqual, my.MYSQL_TYPE_DOUBLE)
+		So(rs.Fields[2].Type, ShouldEqual, my.MYSQL_TYPE_VAR_STRING)
+		So(rs.Fields[3].Type, ShouldEqual, my.MYSQL_TYPE_VAR_STRING)
+		So(rs.Fields[4].Type, ShouldEqual, my.MYSQL_TYPE_VAR_STRING)
+		So(rs.RowDatas, ShouldHaveLength, 2)
+		row, err := rs.RowDatas[0].ParseBinary(rs.Fields)
+		So(err, ShouldBeNil)
+		So(row, ShouldResemble, []interface{}{nil, float64(1.5), []byte("a"), nil, []byte("1")})
+		row, err = rs.RowDatas[1].ParseBinary(rs.Fields)
+		So(err, ShouldBeNil)
+		So(row, ShouldResemble, []interface{}{int64(2), nil, []byte("b"), nil, []byte("x")})
+
+		_, err = buildBinaryResultset([]string{"a"}, [][]interface{}{{1, 2}})
+		So(err, ShouldNotBeNil)
+	})
+}
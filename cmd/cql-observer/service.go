@@ -240,6 +240,30 @@ func (s *Service) AdviseNewBlock(req *sqlchain.MuxAdviseNewBlockReq, resp *sqlch
 	return s.addBlock(req.DatabaseID, req.Count, req.Block)
 }
 
+// FetchBlock serves the replicated block of the specified height, it shares the request/response
+// entity with the sqlchain FetchBlock api, so that blocks can be read from miners and observers
+// in the same way.
+func (s *Service) FetchBlock(req *sqlchain.MuxFetchBlockReq, resp *sqlchain.MuxFetchBlockResp) (err error) {
+	if atomic.LoadInt32(&s.stopped) == 1 {
+		// stopped
+		return ErrStopped
+	}
+
+	resp.Envelope = req.Envelope
+	resp.DatabaseID = req.DatabaseID
+	resp.Height = req.Height
+
+	if resp.Head, _, err = s.getHighestBlock(req.DatabaseID); err != nil {
+		return
+	}
+	if _, resp.Block, err = s.getBlockByHeight(req.DatabaseID, req.Height); err == ErrNotFound {
+		// no block replicated at this height
+		resp.Block, err = nil, nil
+	}
+
+	return
+}
+
 func (s *Service) start() (err error) {
 	if atomic.LoadInt32(&s.stopped) == 1 {
 		// stopped
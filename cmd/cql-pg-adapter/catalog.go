@@ -0,0 +1,394 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+
+	sqlite3 "github.com/CovenantSQL/go-sqlite3-encrypt"
+)
+
+const (
+	oidPgCatalog         = 11
+	oidPublic            = 2200
+	oidInformationSchema = 13000
+	oidDatabase          = 16384
+	oidFirstRelation     = 16385
+	serverVersion        = "9.6.0"
+)
+
+var (
+	// tableInfoQuery is translated to the table_info pragma by the database.
+	tableInfoQuery = "DESC `%s`"
+
+	// pgTypes lists the built-in types in the virtual catalog, with the name returned by format_type.
+	pgTypes = []struct {
+		oid     int32
+		name    string
+		display string
+		size    int16
+	}{
+		{oidBool, "bool", "boolean", 1},
+		{oidBytea, "bytea", "bytea", -1},
+		{18, "char", "\"char\"", 1},
+		{19, "name", "name", 64},
+		{oidInt8, "int8", "bigint", 8},
+		{oidInt2, "int2", "smallint", 2},
+		{oidInt4, "int4", "integer", 4},
+		{oidText, "text", "text", -1},
+		{oidOid, "oid", "oid", 4},
+		{oidFloat4, "float4", "real", 4},
+		{oidFloat8, "float8", "double precision", 8},
+		{1042, "bpchar", "character", -1},
+		{oidVarchar, "varchar", "character varying", -1},
+		{1082, "date", "date", 4},
+		{1083, "time", "time without time zone", 8},
+		{1114, "timestamp", "timestamp without time zone", 8},
+		{1184, "timestamptz", "timestamp with time zone", 8},
+		{1700, "numeric", "numeric", -1},
+	}
+
+	catalogSchema = []string{
+		`CREATE TABLE pg_namespace (oid INTEGER, nspname TEXT, nspowner INTEGER)`,
+		`CREATE TABLE pg_database (oid INTEGER, datname TEXT, datdba INTEGER, encoding INTEGER,
+	datcollate TEXT, datctype TEXT, datistemplate BOOLEAN, datallowconn BOOLEAN)`,
+		`CREATE TABLE pg_roles (oid INTEGER, rolname TEXT, rolsuper BOOLEAN, rolcanlogin BOOLEAN)`,
+		`CREATE TABLE pg_type (oid INTEGER, typname TEXT, typnamespace INTEGER, typowner INTEGER,
+	typlen INTEGER, typtype TEXT, typcategory TEXT, typelem INTEGER, typarray INTEGER, typbasetype INTEGER,
+	typrelid INTEGER, typnotnull BOOLEAN, typtypmod INTEGER)`,
+		`CREATE TABLE pg_class (oid INTEGER, relname TEXT, relnamespace INTEGER, reltype INTEGER,
+	relowner INTEGER, relkind TEXT, relpersistence TEXT, relhasindex BOOLEAN, relhasrules BOOLEAN,
+	relhastriggers BOOLEAN, relchecks INTEGER, reltuples REAL, relnatts INTEGER, relispartition BOOLEAN)`,
+		`CREATE TABLE pg_attribute (attrelid INTEGER, attname TEXT, atttypid INTEGER, attlen INTEGER,
+	attnum INTEGER, atttypmod INTEGER, attnotnull BOOLEAN, atthasdef BOOLEAN, attisdropped BOOLEAN,
+	attidentity TEXT, attcollation INTEGER)`,
+		`CREATE TABLE pg_attrdef (oid INTEGER, adrelid INTEGER, adnum INTEGER, adbin TEXT, adsrc TEXT)`,
+		`CREATE TABLE pg_index (indexrelid INTEGER, indrelid INTEGER, indnatts INTEGER, indisunique BOOLEAN,
+	indisprimary BOOLEAN, indisvalid BOOLEAN, indkey TEXT)`,
+		`CREATE VIEW pg_user AS SELECT rolname AS usename, oid AS usesysid, rolsuper AS usesuper FROM pg_roles`,
+		`CREATE VIEW pg_tables AS SELECT n.nspname AS schemaname, c.relname AS tablename,
+	current_user() AS tableowner, c.relhasindex AS hasindexes
+	FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.relkind = 'r'`,
+		`CREATE VIEW information_schema_schemata AS SELECT current_database() AS catalog_name,
+	nspname AS schema_name, current_user() AS schema_owner FROM pg_namespace`,
+		`CREATE VIEW information_schema_tables AS SELECT current_database() AS table_catalog,
+	n.nspname AS table_schema, c.relname AS table_name,
+	CASE c.relkind WHEN 'v' THEN 'VIEW' ELSE 'BASE TABLE' END AS table_type
+	FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.relkind IN ('r', 'v')`,
+		`CREATE VIEW information_schema_columns AS SELECT current_database() AS table_catalog,
+	n.nspname AS table_schema, c.relname AS table_name, a.attname AS column_name,
+	a.attnum AS ordinal_position, d.adsrc AS column_default,
+	CASE WHEN a.attnotnull THEN 'NO' ELSE 'YES' END AS is_nullable,
+	format_type(a.atttypid, a.atttypmod) AS data_type, t.typname AS udt_name
+	FROM pg_attribute a JOIN pg_class c ON c.oid = a.attrelid
+	JOIN pg_namespace n ON n.oid = c.relnamespace JOIN pg_type t ON t.oid = a.atttypid
+	LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+	WHERE c.relkind IN ('r', 'v')`,
+	}
+
+	catalogTables = regexp.MustCompile(
+		"(?i)\\b(?:pg_catalog\\s*\\.\\s*)?(?:information_schema\\s*\\.|" +
+			"pg_(?:class|namespace|attribute|attrdef|index|type|tables|database|roles|user)\\b)")
+	catalogPrefix    = regexp.MustCompile("(?i)\\bpg_catalog\\s*\\.\\s*")
+	catalogSchemaRef = regexp.MustCompile("(?i)\\binformation_schema\\s*\\.\\s*(\\w+)")
+	catalogOperator  = regexp.MustCompile("(?i)OPERATOR\\s*\\(\\s*([~!*]+)\\s*\\)")
+	regexOperator    = regexp.MustCompile("!~\\*|~\\*|!~|~")
+	defaultCollation = regexp.MustCompile("(?i)\\bCOLLATE\\s+\"?default\"?")
+	sessionUser      = regexp.MustCompile("(?i)\\b(?:current_user|session_user)\\b(?:\\s*\\(\\s*\\))?")
+	regexOperators   = map[string]string{
+		"~":   " REGEXP ",
+		"!~":  " NOT REGEXP ",
+		"~*":  " REGEXP '(?i)' || ",
+		"!~*": " NOT REGEXP '(?i)' || ",
+	}
+)
+
+// rewriteCatalogQuery rewrites the PostgreSQL specific syntax of the catalog queries to sqlite.
+func rewriteCatalogQuery(text string) string {
+	text = catalogPrefix.ReplaceAllString(text, "")
+	text = catalogSchemaRef.ReplaceAllStringFunc(text, func(s string) string {
+		return "information_schema_" + strings.ToLower(catalogSchemaRef.FindStringSubmatch(s)[1])
+	})
+	text = catalogOperator.ReplaceAllString(text, "$1")
+	text = regexOperator.ReplaceAllStringFunc(text, func(s string) string { return regexOperators[s] })
+	text = defaultCollation.ReplaceAllString(text, "")
+	text = sessionUser.ReplaceAllString(text, "current_user()")
+	return text
+}
+
+// catalog is the virtual PostgreSQL catalog in a memory sqlite database, which is built from the
+// sqlite schema of the database.
+type catalog struct {
+	*sql.DB
+}
+
+// catalogConnector connects to the memory database with the catalog functions of the session.
+type catalogConnector struct {
+	drv *sqlite3.SQLiteDriver
+}
+
+func (c *catalogConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.drv.Open(":memory:")
+}
+
+func (c *catalogConnector) Driver() driver.Driver {
+	return c.drv
+}
+
+func catalogFunctions(s *session) map[string]interface{} {
+	var (
+		null      = func(...interface{}) []byte { return nil }
+		yes       = func(...interface{}) bool { return true }
+		typeNames = make(map[int64]string, len(pgTypes))
+		regexps   = make(map[string]*regexp.Regexp)
+	)
+	for _, v := range pgTypes {
+		typeNames[int64(v.oid)] = v.display
+	}
+	return map[string]interface{}{
+		"version": func() string {
+			return fmt.Sprintf("PostgreSQL %s on CovenantSQL, compatible with %s", serverVersion, name)
+		},
+		"current_database": func() string { return s.database },
+		"current_schema":   func() string { return "public" },
+		"current_schemas":  func(...interface{}) string { return "{pg_catalog,public}" },
+		"current_user":     func() string { return s.user },
+		"pg_backend_pid":   func() int64 { return int64(s.pid) },
+		"pg_get_userbyid":  func(...interface{}) string { return s.user },
+		"format_type": func(oid int64, _ ...interface{}) string {
+			if v, ok := typeNames[oid]; ok {
+				return v
+			}
+			return "???"
+		},
+		"pg_get_expr": func(expr string, _ ...interface{}) string { return expr },
+		"pg_encoding_to_char": func(...interface{}) string {
+			return "UTF8"
+		},
+		"quote_ident": func(s string) string {
+			return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+		},
+		"regexp": func(pattern, s string) (bool, error) {
+			re, ok := regexps[pattern]
+			if !ok {
+				var err error
+				if re, err = regexp.Compile(pattern); err != nil {
+					return false, err
+				}
+				regexps[pattern] = re
+			}
+			return re.MatchString(s), nil
+		},
+		"pg_table_is_visible":    yes,
+		"pg_type_is_visible":     yes,
+		"has_table_privilege":    yes,
+		"has_schema_privilege":   yes,
+		"has_database_privilege": yes,
+		"obj_description":        null,
+		"col_description":        null,
+		"shobj_description":      null,
+	}
+}
+
+func newCatalog(s *session) (c *catalog, err error) {
+	var conn = &catalogConnector{drv: &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) (err error) {
+			for k, v := range catalogFunctions(s) {
+				if err = conn.RegisterFunc(k, v, true); err != nil {
+					return
+				}
+			}
+			return
+		},
+	}}
+	c = &catalog{DB: sql.OpenDB(conn)}
+	// every connection has its own memory database
+	c.SetMaxOpenConns(1)
+	defer func() {
+		if err != nil {
+			_ = c.Close()
+			c = nil
+		}
+	}()
+	for _, v := range catalogSchema {
+		if _, err = c.Exec(v); err != nil {
+			return
+		}
+	}
+	if err = c.insert("pg_namespace", [][]interface{}{
+		{oidPgCatalog, "pg_catalog", 10},
+		{oidPublic, "public", 10},
+		{oidInformationSchema, "information_schema", 10},
+	}); err != nil {
+		return
+	}
+	if err = c.insert("pg_database", [][]interface{}{
+		{oidDatabase, s.database, 10, 6, "C", "C", false, true},
+	}); err != nil {
+		return
+	}
+	if err = c.insert("pg_roles", [][]interface{}{{10, s.user, true, true}}); err != nil {
+		return
+	}
+	var types [][]interface{}
+	for _, v := range pgTypes {
+		types = append(types, []interface{}{
+			v.oid, v.name, oidPgCatalog, 10, v.size, "b", "U", 0, 0, 0, 0, false, -1})
+	}
+	err = c.insert("pg_type", types)
+	return
+}
+
+func (c *catalog) insert(table string, rows [][]interface{}) (err error) {
+	for _, row := range rows {
+		var holders = strings.TrimSuffix(strings.Repeat("?, ", len(row)), ", ")
+		if _, err = c.Exec(fmt.Sprintf("INSERT INTO %s VALUES (%s)", table, holders), row...); err != nil {
+			return
+		}
+	}
+	return
+}
+
+type schemaColumn struct {
+	name     string
+	declType string
+	notNull  bool
+	dflt     sql.NullString
+	pk       int64
+}
+
+// load builds the relations of the virtual catalog from the database schema.
+func (c *catalog) load(src *sql.DB) (err error) {
+	type object struct {
+		typ, name, table string
+		sql              sql.NullString
+	}
+	var (
+		rows    *sql.Rows
+		objects []*object
+	)
+	if rows, err = src.Query(`SELECT type, name, tbl_name, sql FROM sqlite_master
+WHERE type IN ('table', 'view', 'index') AND name NOT LIKE 'sqlite%'`); err != nil {
+		return
+	}
+	for rows.Next() {
+		var o = &object{}
+		if err = rows.Scan(&o.typ, &o.name, &o.table, &o.sql); err != nil {
+			_ = rows.Close()
+			return
+		}
+		objects = append(objects, o)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	var (
+		oids    = make(map[string]int64)
+		indexes = make(map[string]int)
+		next    = int64(oidFirstRelation)
+		class   [][]interface{}
+		attrs   [][]interface{}
+		defs    [][]interface{}
+		index   [][]interface{}
+	)
+	for _, o := range objects {
+		oids[o.name] = next
+		next++
+		if o.typ == "index" {
+			indexes[o.table]++
+		}
+	}
+	for _, o := range objects {
+		var oid = oids[o.name]
+		switch o.typ {
+		case "index":
+			var unique = strings.Contains(strings.ToUpper(o.sql.String), "UNIQUE")
+			index = append(index, []interface{}{oid, oids[o.table], 0, unique, false, true, ""})
+			class = append(class, []interface{}{
+				oid, o.name, oidPublic, 0, 10, "i", "p", false, false, false, 0, 0, 0, false})
+			continue
+		}
+		var columns []*schemaColumn
+		if columns, err = tableColumns(src, o.name); err != nil {
+			return
+		}
+		var (
+			kind   = "r"
+			hasPK  bool
+			hasIdx = indexes[o.name] > 0
+		)
+		if o.typ == "view" {
+			kind = "v"
+		}
+		for i, v := range columns {
+			var typ = typeOID(v.declType)
+			attrs = append(attrs, []interface{}{
+				oid, v.name, typ, typeSize(typ), i + 1, -1, v.notNull || v.pk > 0, v.dflt.Valid,
+				false, "", 0})
+			if v.dflt.Valid {
+				defs = append(defs, []interface{}{next, oid, i + 1, v.dflt.String, v.dflt.String})
+				next++
+			}
+			hasPK = hasPK || v.pk > 0
+		}
+		if hasPK {
+			// primary key is reported as the index named by the PostgreSQL convention
+			index = append(index, []interface{}{next, oid, 0, true, true, true, ""})
+			class = append(class, []interface{}{
+				next, o.name + "_pkey", oidPublic, 0, 10, "i", "p", false, false, false, 0, 0, 0, false})
+			next++
+		}
+		class = append(class, []interface{}{
+			oid, o.name, oidPublic, 0, 10, kind, "p", hasIdx || hasPK, false, false, 0, 0,
+			len(columns), false})
+	}
+	for _, v := range []struct {
+		table string
+		rows  [][]interface{}
+	}{{"pg_class", class}, {"pg_attribute", attrs}, {"pg_attrdef", defs}, {"pg_index", index}} {
+		if err = c.insert(v.table, v.rows); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func tableColumns(src *sql.DB, table string) (columns []*schemaColumn, err error) {
+	var rows *sql.Rows
+	if rows, err = src.Query(fmt.Sprintf(tableInfoQuery, table)); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid interface{}
+			v   = &schemaColumn{}
+		)
+		if err = rows.Scan(&cid, &v.name, &v.declType, &v.notNull, &v.dflt, &v.pk); err != nil {
+			return
+		}
+		columns = append(columns, v)
+	}
+	err = rows.Err()
+	return
+}
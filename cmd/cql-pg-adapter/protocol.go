@@ -0,0 +1,265 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// protocolVersion is the PostgreSQL frontend/backend protocol version 3.0.
+	protocolVersion = 196608
+	sslRequestCode  = 80877103
+	cancelRequest   = 80877102
+	maxMessageSize  = 64 << 20
+)
+
+// frontend message types.
+const (
+	msgBind      = 'B'
+	msgClose     = 'C'
+	msgDescribe  = 'D'
+	msgExecute   = 'E'
+	msgFlush     = 'H'
+	msgParse     = 'P'
+	msgPassword  = 'p'
+	msgQuery     = 'Q'
+	msgSync      = 'S'
+	msgTerminate = 'X'
+)
+
+// backend message types.
+const (
+	msgAuthentication       = 'R'
+	msgBackendKeyData       = 'K'
+	msgBindComplete         = '2'
+	msgCloseComplete        = '3'
+	msgCommandComplete      = 'C'
+	msgDataRow              = 'D'
+	msgEmptyQueryResponse   = 'I'
+	msgErrorResponse        = 'E'
+	msgNoData               = 'n'
+	msgParameterDescription = 't'
+	msgParameterStatus      = 'S'
+	msgParseComplete        = '1'
+	msgPortalSuspended      = 's'
+	msgReadyForQuery        = 'Z'
+	msgRowDescription       = 'T'
+)
+
+// authentication request codes.
+const (
+	authOK          = 0
+	authMD5Password = 5
+)
+
+// pgError is an error sent to the frontend as ErrorResponse.
+type pgError struct {
+	severity string
+	code     string
+	message  string
+}
+
+func (e *pgError) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", e.severity, e.message, e.code)
+}
+
+func newError(code string, format string, args ...interface{}) *pgError {
+	return &pgError{severity: "ERROR", code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func newFatal(code string, format string, args ...interface{}) *pgError {
+	return &pgError{severity: "FATAL", code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// SQLSTATE error codes used by the adapter.
+const (
+	codeProtocolViolation       = "08P01"
+	codeFeatureNotSupported     = "0A000"
+	codeInvalidPassword         = "28P01"
+	codeInvalidCatalogName      = "3D000"
+	codeInvalidSQLStatementName = "26000"
+	codeInvalidCursorName       = "34000"
+	codeDuplicatePreparedStmt   = "42P05"
+	codeSyntaxError             = "42601"
+	codeUndefinedParameter      = "42P02"
+	codeUndefinedObject         = "42704"
+	codeInvalidParameterValue   = "22023"
+	codeInternalError           = "XX000"
+)
+
+// message is a backend message being built.
+type message []byte
+
+func newMessage(typ byte) message {
+	return message{typ, 0, 0, 0, 0}
+}
+
+func (m message) byte(b byte) message {
+	return append(m, b)
+}
+
+func (m message) int16(v int16) message {
+	return append(m, byte(v>>8), byte(v))
+}
+
+func (m message) int32(v int32) message {
+	return append(m, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (m message) string(s string) message {
+	return append(append(m, s...), 0)
+}
+
+func (m message) bytes(b []byte) message {
+	return append(m, b...)
+}
+
+// reader reads the fields of a frontend message.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) fail() {
+	if r.err == nil {
+		r.err = newError(codeProtocolViolation, "invalid message format")
+	}
+	r.data = nil
+}
+
+func (r *reader) byte() (b byte) {
+	if len(r.data) < 1 {
+		r.fail()
+		return
+	}
+	b, r.data = r.data[0], r.data[1:]
+	return
+}
+
+func (r *reader) int16() (v int16) {
+	if len(r.data) < 2 {
+		r.fail()
+		return
+	}
+	v, r.data = int16(binary.BigEndian.Uint16(r.data)), r.data[2:]
+	return
+}
+
+func (r *reader) int32() (v int32) {
+	if len(r.data) < 4 {
+		r.fail()
+		return
+	}
+	v, r.data = int32(binary.BigEndian.Uint32(r.data)), r.data[4:]
+	return
+}
+
+func (r *reader) string() (s string) {
+	for i, b := range r.data {
+		if b == 0 {
+			s, r.data = string(r.data[:i]), r.data[i+1:]
+			return
+		}
+	}
+	r.fail()
+	return
+}
+
+func (r *reader) bytes(n int) (b []byte) {
+	if n < 0 || len(r.data) < n {
+		r.fail()
+		return
+	}
+	b, r.data = r.data[:n], r.data[n:]
+	return
+}
+
+// conn wraps the network connection with the message framing of the protocol.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{Conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+}
+
+func (c *conn) readBody(size int32) (data []byte, err error) {
+	if size < 4 || size > maxMessageSize {
+		err = newFatal(codeProtocolViolation, "invalid message length %d", size)
+		return
+	}
+	data = make([]byte, size-4)
+	_, err = io.ReadFull(c.r, data)
+	return
+}
+
+// readStartup reads a startup packet, which has no message type.
+func (c *conn) readStartup() (code int32, r *reader, err error) {
+	var header [4]byte
+	if _, err = io.ReadFull(c.r, header[:]); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = c.readBody(int32(binary.BigEndian.Uint32(header[:]))); err != nil {
+		return
+	}
+	r = &reader{data: data}
+	code = r.int32()
+	err = r.err
+	return
+}
+
+// readMessage reads a frontend message.
+func (c *conn) readMessage() (typ byte, r *reader, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(c.r, header[:]); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = c.readBody(int32(binary.BigEndian.Uint32(header[1:]))); err != nil {
+		return
+	}
+	typ, r = header[0], &reader{data: data}
+	return
+}
+
+// send buffers a backend message, the buffer is sent on flush.
+func (c *conn) send(m message) (err error) {
+	binary.BigEndian.PutUint32(m[1:5], uint32(len(m)-1))
+	_, err = c.w.Write(m)
+	return
+}
+
+func (c *conn) flush() error {
+	return c.w.Flush()
+}
+
+func (c *conn) sendError(e *pgError) error {
+	return c.send(newMessage(msgErrorResponse).
+		byte('S').string(e.severity).
+		byte('V').string(e.severity).
+		byte('C').string(e.code).
+		byte('M').string(e.message).
+		byte(0))
+}
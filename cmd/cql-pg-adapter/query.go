@@ -0,0 +1,506 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statement kinds.
+const (
+	kindEmpty   = iota // no statement, answered with EmptyQueryResponse
+	kindNoop           // session and transaction control, answered with the command tag only
+	kindShow           // SHOW of a run-time parameter
+	kindCatalog        // catalog query executed on the virtual catalog
+	kindRead           // read query sent to the database
+	kindWrite          // write query sent to the database
+)
+
+var (
+	noopTags = map[string]string{
+		"SET":        "SET",
+		"RESET":      "RESET",
+		"BEGIN":      "BEGIN",
+		"START":      "START TRANSACTION",
+		"COMMIT":     "COMMIT",
+		"END":        "COMMIT",
+		"ROLLBACK":   "ROLLBACK",
+		"ABORT":      "ROLLBACK",
+		"DISCARD":    "DISCARD ALL",
+		"DEALLOCATE": "DEALLOCATE",
+		"LISTEN":     "LISTEN",
+		"UNLISTEN":   "UNLISTEN",
+	}
+	readKeywords = map[string]bool{
+		"SELECT":   true,
+		"WITH":     true,
+		"VALUES":   true,
+		"EXPLAIN":  true,
+		"DESC":     true,
+		"DESCRIBE": true,
+	}
+	objectKeywords = map[string]bool{
+		"TABLE":   true,
+		"INDEX":   true,
+		"VIEW":    true,
+		"TRIGGER": true,
+	}
+	leadingComments = regexp.MustCompile("^(?:\\s+|--[^\\n]*|/\\*(?s:.*?)\\*/)+")
+	firstWords      = regexp.MustCompile("[A-Za-z_]+")
+	catalogQuery    = regexp.MustCompile(
+		"(?i)\\b(?:pg_catalog\\s*\\.|information_schema\\s*\\.|" +
+			"pg_(?:class|namespace|attribute|attrdef|index|type|tables|database|roles|user)\\b|" +
+			"(?:version|current_database|current_schema|current_schemas|pg_backend_pid)\\s*\\(|" +
+			"current_user\\b|session_user\\b)")
+	selectQuery        = regexp.MustCompile("^(?i)SELECT\\b")
+	trailingDelimiters = regexp.MustCompile("[\\s;]+$")
+)
+
+// query is a single statement rewritten for CovenantSQL, the PostgreSQL $n parameters are
+// rewritten to the positional ? parameters and type casts are removed.
+type query struct {
+	text   string
+	kind   int
+	tag    string
+	params int   // number of the $n parameters
+	order  []int // parameter index of each ? placeholder
+}
+
+// splitQuery splits the query string to statements.
+func splitQuery(text string) (queries []*query, err error) {
+	var (
+		buf   strings.Builder
+		q     = &query{}
+		flush = func() {
+			q.text = strings.TrimSpace(buf.String())
+			queries = append(queries, q)
+			buf.Reset()
+			q = &query{}
+		}
+	)
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '\'' || c == '"':
+			// quoted string or identifier, quote is escaped by doubling
+			j := i + 1
+			for ; j < len(text); j++ {
+				if text[j] == c {
+					if j+1 < len(text) && text[j+1] == c {
+						j++
+						continue
+					}
+					break
+				}
+			}
+			if j >= len(text) {
+				err = newError(codeSyntaxError, "unterminated quoted string")
+				return
+			}
+			buf.WriteString(text[i : j+1])
+			i = j
+		case c == '-' && i+1 < len(text) && text[i+1] == '-':
+			j := strings.IndexByte(text[i:], '\n')
+			if j < 0 {
+				j = len(text) - i
+			}
+			i += j
+			buf.WriteByte(' ')
+		case c == '/' && i+1 < len(text) && text[i+1] == '*':
+			j := strings.Index(text[i+2:], "*/")
+			if j < 0 {
+				err = newError(codeSyntaxError, "unterminated /* comment")
+				return
+			}
+			i += j + 3
+			buf.WriteByte(' ')
+		case c == '$' && i+1 < len(text) && isDigit(text[i+1]):
+			j := i + 1
+			for j < len(text) && isDigit(text[j]) {
+				j++
+			}
+			n, _ := strconv.Atoi(text[i+1 : j])
+			if n < 1 {
+				err = newError(codeUndefinedParameter, "there is no parameter $%d", n)
+				return
+			}
+			if n > q.params {
+				q.params = n
+			}
+			q.order = append(q.order, n-1)
+			buf.WriteByte('?')
+			i = j - 1
+		case c == ':' && i+1 < len(text) && text[i+1] == ':':
+			// remove type cast like ::int8, ::pg_catalog.regclass, ::varchar(10) or ::text[]
+			j := i + 2
+			for j < len(text) && (isIdentChar(text[j]) || text[j] == '.' || text[j] == '"') {
+				j++
+			}
+			if j < len(text) && text[j] == '(' {
+				if k := strings.IndexByte(text[j:], ')'); k > 0 {
+					j += k + 1
+				}
+			}
+			for strings.HasPrefix(text[j:], "[]") {
+				j += 2
+			}
+			i = j - 1
+		case c == ';':
+			flush()
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	flush()
+
+	// drop the empty statements between delimiters, but keep one for an empty query string
+	var filtered = queries[:0]
+	for _, v := range queries {
+		if v.text != "" {
+			filtered = append(filtered, v)
+		}
+	}
+	if len(filtered) == 0 {
+		filtered = queries[:1]
+	}
+	queries = filtered
+	for _, v := range queries {
+		v.classify()
+	}
+	return
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (q *query) classify() {
+	var (
+		text  = leadingComments.ReplaceAllString(q.text, "")
+		words = firstWords.FindAllString(text, 4)
+	)
+	if len(words) == 0 {
+		if q.kind = kindWrite; text == "" {
+			q.kind = kindEmpty
+		}
+		return
+	}
+	var first = strings.ToUpper(words[0])
+	if tag, ok := noopTags[first]; ok {
+		q.kind, q.tag = kindNoop, tag
+		return
+	}
+	if first == "SHOW" {
+		q.kind, q.tag = kindShow, "SHOW"
+		return
+	}
+	if catalogQuery.MatchString(text) {
+		q.kind, q.tag = kindCatalog, "SELECT"
+		return
+	}
+	if readKeywords[first] {
+		q.kind, q.tag = kindRead, "SELECT"
+		return
+	}
+	q.kind, q.tag = kindWrite, first
+	switch first {
+	case "CREATE", "DROP", "ALTER":
+		for _, v := range words[1:] {
+			if v = strings.ToUpper(v); objectKeywords[v] {
+				q.tag = first + " " + v
+				break
+			}
+		}
+	}
+}
+
+// commandTag returns the tag of CommandComplete message.
+func (q *query) commandTag(rows int64) string {
+	switch q.tag {
+	case "SELECT", "UPDATE", "DELETE":
+		return q.tag + " " + strconv.FormatInt(rows, 10)
+	case "INSERT":
+		return "INSERT 0 " + strconv.FormatInt(rows, 10)
+	default:
+		return q.tag
+	}
+}
+
+// describeText returns the query to dry-run for the result columns of the read query.
+func (q *query) describeText() string {
+	if q.kind == kindRead && selectQuery.MatchString(q.text) {
+		return "SELECT * FROM (" + trailingDelimiters.ReplaceAllString(q.text, "") + ") LIMIT 0"
+	}
+	return q.text
+}
+
+// type oids of the PostgreSQL built-in types.
+const (
+	oidBool    = 16
+	oidBytea   = 17
+	oidInt8    = 20
+	oidInt2    = 21
+	oidInt4    = 23
+	oidText    = 25
+	oidOid     = 26
+	oidFloat4  = 700
+	oidFloat8  = 701
+	oidVarchar = 1043
+)
+
+// typeOID maps the sqlite declared type to the PostgreSQL type by the sqlite type affinity rules.
+func typeOID(declType string) int32 {
+	declType = strings.ToUpper(declType)
+	switch {
+	case strings.Contains(declType, "BOOL"):
+		return oidBool
+	case strings.Contains(declType, "INT"):
+		return oidInt8
+	case strings.Contains(declType, "CHAR") || strings.Contains(declType, "CLOB") ||
+		strings.Contains(declType, "TEXT"):
+		return oidText
+	case strings.Contains(declType, "BLOB"):
+		return oidBytea
+	case strings.Contains(declType, "REAL") || strings.Contains(declType, "FLOA") ||
+		strings.Contains(declType, "DOUB") || strings.Contains(declType, "NUMERIC") ||
+		strings.Contains(declType, "DECIMAL"):
+		return oidFloat8
+	default:
+		return oidText
+	}
+}
+
+// column is a field of RowDescription.
+type column struct {
+	name string
+	oid  int32
+}
+
+func typeSize(oid int32) int16 {
+	switch oid {
+	case oidBool:
+		return 1
+	case oidInt8, oidFloat8:
+		return 8
+	default:
+		return -1
+	}
+}
+
+func toInt64(v interface{}) (n int64, ok bool) {
+	switch x := v.(type) {
+	case int64:
+		return x, true
+	case float64:
+		return int64(x), true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	case []byte:
+		n, err := strconv.ParseInt(string(x), 10, 64)
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseInt(x, 10, 64)
+		return n, err == nil
+	}
+	return
+}
+
+func toFloat64(v interface{}) (f float64, ok bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	case []byte:
+		f, err := strconv.ParseFloat(string(x), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(x, 64)
+		return f, err == nil
+	}
+	return
+}
+
+func formatText(v interface{}) []byte {
+	switch x := v.(type) {
+	case []byte:
+		return x
+	case string:
+		return []byte(x)
+	case int64:
+		return strconv.AppendInt(nil, x, 10)
+	case float64:
+		return strconv.AppendFloat(nil, x, 'g', -1, 64)
+	case bool:
+		if x {
+			return []byte("t")
+		}
+		return []byte("f")
+	case time.Time:
+		return []byte(x.Format("2006-01-02 15:04:05.999999Z07:00"))
+	default:
+		return []byte(fmt.Sprint(x))
+	}
+}
+
+// encodeValue encodes the value of the column in text (0) or binary (1) format.
+func encodeValue(v interface{}, oid int32, format int16) (data []byte, err error) {
+	if v == nil {
+		return
+	}
+	switch oid {
+	case oidBool:
+		n, ok := toInt64(v)
+		if s, isStr := v.(string); isStr && !ok {
+			n, ok = boolValue(s)
+		}
+		if !ok {
+			err = newError(codeInvalidParameterValue, "invalid boolean value %v", v)
+			return
+		}
+		if format == 1 {
+			data = []byte{0}
+			if n != 0 {
+				data[0] = 1
+			}
+		} else if n != 0 {
+			data = []byte("t")
+		} else {
+			data = []byte("f")
+		}
+		return
+	case oidBytea:
+		var raw = formatText(v)
+		if format == 1 {
+			data = raw
+		} else {
+			data = append([]byte("\\x"), hex.EncodeToString(raw)...)
+		}
+		return
+	}
+	if format == 0 {
+		data = formatText(v)
+		return
+	}
+	switch oid {
+	case oidInt8:
+		n, ok := toInt64(v)
+		if !ok {
+			err = newError(codeInvalidParameterValue, "invalid integer value %v", v)
+			return
+		}
+		data = make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(n))
+	case oidFloat8:
+		f, ok := toFloat64(v)
+		if !ok {
+			err = newError(codeInvalidParameterValue, "invalid float value %v", v)
+			return
+		}
+		data = make([]byte, 8)
+		binary.BigEndian.PutUint64(data, math.Float64bits(f))
+	default:
+		data = formatText(v)
+	}
+	return
+}
+
+func boolValue(s string) (n int64, ok bool) {
+	switch strings.ToLower(s) {
+	case "t", "true", "y", "yes", "on", "1":
+		return 1, true
+	case "f", "false", "n", "no", "off", "0":
+		return 0, true
+	}
+	return
+}
+
+// decodeParam decodes the parameter of the type in text (0) or binary (1) format.
+func decodeParam(data []byte, oid int32, format int16) (v interface{}, err error) {
+	if data == nil {
+		return
+	}
+	if format == 0 {
+		var s = string(data)
+		switch oid {
+		case oidBool:
+			n, ok := boolValue(s)
+			if !ok {
+				err = newError(codeInvalidParameterValue, "invalid input syntax for type boolean: %q", s)
+			}
+			v = n
+		case oidInt2, oidInt4, oidInt8, oidOid:
+			if v, err = strconv.ParseInt(s, 10, 64); err != nil {
+				err = newError(codeInvalidParameterValue, "invalid input syntax for integer: %q", s)
+			}
+		case oidFloat4, oidFloat8:
+			if v, err = strconv.ParseFloat(s, 64); err != nil {
+				err = newError(codeInvalidParameterValue, "invalid input syntax for type double precision: %q", s)
+			}
+		case oidBytea:
+			if strings.HasPrefix(s, "\\x") {
+				if v, err = hex.DecodeString(s[2:]); err != nil {
+					err = newError(codeInvalidParameterValue, "invalid hexadecimal data")
+				}
+			} else {
+				v = data
+			}
+		default:
+			v = s
+		}
+		return
+	}
+	var size = map[int32]int{oidBool: 1, oidInt2: 2, oidInt4: 4, oidOid: 4, oidInt8: 8, oidFloat4: 4, oidFloat8: 8}
+	if n, ok := size[oid]; ok && len(data) != n {
+		err = newError(codeProtocolViolation, "invalid binary parameter length %d for type %d", len(data), oid)
+		return
+	}
+	switch oid {
+	case oidBool:
+		v = int64(data[0])
+	case oidInt2:
+		v = int64(int16(binary.BigEndian.Uint16(data)))
+	case oidInt4:
+		v = int64(int32(binary.BigEndian.Uint32(data)))
+	case oidOid:
+		v = int64(binary.BigEndian.Uint32(data))
+	case oidInt8:
+		v = int64(binary.BigEndian.Uint64(data))
+	case oidFloat4:
+		v = float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case oidFloat8:
+		v = math.Float64frombits(binary.BigEndian.Uint64(data))
+	case oidBytea:
+		v = append([]byte(nil), data...)
+	default:
+		v = string(data)
+	}
+	return
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSplitQuery(t *testing.T) {
+	Convey("test split and rewrite query", t, func() {
+		queries, err := splitQuery(`INSERT INTO t VALUES ($2, '$1;''', "a;b") -- comment;
+; /* ; */ SELECT $1::text[], $1 FROM t WHERE v = $2::varchar(10)`)
+		So(err, ShouldBeNil)
+		So(queries, ShouldHaveLength, 2)
+		So(queries[0].text, ShouldEqual, `INSERT INTO t VALUES (?, '$1;''', "a;b")`)
+		So(queries[0].params, ShouldEqual, 2)
+		So(queries[0].order, ShouldResemble, []int{1})
+		So(queries[0].kind, ShouldEqual, kindWrite)
+		So(queries[0].commandTag(1), ShouldEqual, "INSERT 0 1")
+		So(queries[1].text, ShouldEqual, "SELECT ?, ? FROM t WHERE v = ?")
+		So(queries[1].order, ShouldResemble, []int{0, 0, 1})
+		So(queries[1].kind, ShouldEqual, kindRead)
+		So(queries[1].describeText(), ShouldEqual, "SELECT * FROM (SELECT ?, ? FROM t WHERE v = ?) LIMIT 0")
+
+		queries, err = splitQuery(" ; ")
+		So(err, ShouldBeNil)
+		So(queries, ShouldHaveLength, 1)
+		So(queries[0].kind, ShouldEqual, kindEmpty)
+
+		_, err = splitQuery("SELECT 'a")
+		So(err, ShouldNotBeNil)
+		_, err = splitQuery("SELECT $0")
+		So(err, ShouldNotBeNil)
+	})
+	Convey("test classify query", t, func() {
+		for text, expected := range map[string]struct {
+			kind int
+			tag  string
+		}{
+			"begin":                            {kindNoop, "BEGIN"},
+			"SET extra_float_digits = 3":       {kindNoop, "SET"},
+			"show TimeZone":                    {kindShow, "SHOW"},
+			"select version()":                 {kindCatalog, "SELECT"},
+			"SELECT * FROM pg_catalog.pg_type": {kindCatalog, "SELECT"},
+			"/* x */ SELECT 1":                 {kindRead, "SELECT"},
+			"CREATE UNIQUE INDEX i ON t (v)":   {kindWrite, "CREATE INDEX"},
+			"UPDATE t SET v = 1":               {kindWrite, "UPDATE"},
+		} {
+			queries, err := splitQuery(text)
+			So(err, ShouldBeNil)
+			So(queries[0].kind, ShouldEqual, expected.kind)
+			So(queries[0].tag, ShouldEqual, expected.tag)
+		}
+	})
+	Convey("test encode value and decode param", t, func() {
+		data, err := encodeValue([]byte{0xde, 0xad}, oidBytea, 0)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `\xdead`)
+		data, err = encodeValue(int64(1), oidBool, 0)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "t")
+		data, err = encodeValue("1.5", oidFloat8, 1)
+		So(err, ShouldBeNil)
+		So(data, ShouldResemble, []byte{0x3f, 0xf8, 0, 0, 0, 0, 0, 0})
+		_, err = encodeValue("x", oidInt8, 1)
+		So(err, ShouldNotBeNil)
+		data, err = encodeValue(nil, oidText, 0)
+		So(err, ShouldBeNil)
+		So(data, ShouldBeNil)
+
+		v, err := decodeParam([]byte("42"), oidInt4, 0)
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, int64(42))
+		v, err = decodeParam([]byte{0, 0, 0, 42}, oidInt4, 1)
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, int64(42))
+		v, err = decodeParam([]byte(`\x0102`), oidBytea, 0)
+		So(err, ShouldBeNil)
+		So(v, ShouldResemble, []byte{1, 2})
+		v, err = decodeParam([]byte("on"), oidBool, 0)
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, int64(1))
+		v, err = decodeParam([]byte("abc"), oidText, 0)
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, "abc")
+		_, err = decodeParam([]byte{0, 1}, oidInt8, 1)
+		So(err, ShouldNotBeNil)
+		_, err = decodeParam([]byte("x"), oidInt8, 0)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("test rewrite catalog query", t, func() {
+		So(rewriteCatalogQuery(
+			"SELECT current_user FROM pg_catalog.pg_class c, information_schema.TABLES "+
+				"WHERE c.relname OPERATOR(pg_catalog.~) '^t$' COLLATE pg_catalog.default AND c.relname !~* 'x'"),
+			ShouldEqual,
+			"SELECT current_user() FROM pg_class c, information_schema_tables "+
+				"WHERE c.relname  REGEXP  '^t$'  AND c.relname  NOT REGEXP '(?i)' ||  'x'")
+	})
+}
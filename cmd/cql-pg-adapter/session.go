@@ -0,0 +1,727 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/CovenantSQL/CovenantSQL/client"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+var (
+	dbIDRegex  = regexp.MustCompile("^[a-zA-Z0-9_\\.]+$")
+	showParam  = regexp.MustCompile("^(?i)SHOW\\s+(.*?)\\s*$")
+	serverInfo = map[string]string{
+		"server_version":                serverVersion,
+		"server_encoding":               "UTF8",
+		"client_encoding":               "UTF8",
+		"DateStyle":                     "ISO, MDY",
+		"IntervalStyle":                 "postgres",
+		"TimeZone":                      "UTC",
+		"integer_datetimes":             "on",
+		"standard_conforming_strings":   "on",
+		"is_superuser":                  "off",
+		"transaction_isolation":         "serializable",
+		"default_transaction_isolation": "serializable",
+	}
+)
+
+// statement is a prepared statement created by the Parse message.
+type statement struct {
+	*query
+	paramTypes []int32
+	columns    []column // result columns, nil for the statement without result
+	described  bool
+}
+
+// portal is a bound statement ready for execution.
+type portal struct {
+	stmt    *statement
+	args    []interface{}
+	formats []int16
+	result  *result
+	sent    int // rows already sent by the previous executions
+}
+
+// result is the result of a statement.
+type result struct {
+	columns  []column
+	rows     [][]interface{}
+	affected int64
+}
+
+// session handles a frontend connection, like a cursor of normal database.
+type session struct {
+	server   *Server
+	conn     *conn
+	user     string
+	database string
+	pid      int32
+	params   map[string]string
+	db       *sql.DB
+
+	stmts   map[string]*statement
+	portals map[string]*portal
+	// failed is set when an error occurs in the extended query, until the next Sync
+	failed bool
+}
+
+func newSession(s *Server, c *conn) *session {
+	return &session{
+		server:  s,
+		conn:    c,
+		params:  make(map[string]string),
+		stmts:   make(map[string]*statement),
+		portals: make(map[string]*portal),
+	}
+}
+
+// startup processes the startup packets and the authentication of the connection.
+func (s *session) startup() (err error) {
+	var (
+		code int32
+		r    *reader
+	)
+	for {
+		if code, r, err = s.conn.readStartup(); err != nil {
+			return
+		}
+		if code != sslRequestCode {
+			break
+		}
+		// ssl is not supported
+		if _, err = s.conn.Write([]byte{'N'}); err != nil {
+			return
+		}
+	}
+	switch code {
+	case protocolVersion:
+	case cancelRequest:
+		// query cancellation is not supported
+		return io.EOF
+	default:
+		return s.fatal(newFatal(codeFeatureNotSupported,
+			"unsupported frontend protocol %d.%d", code>>16, code&0xffff))
+	}
+
+	for {
+		var key = r.string()
+		if key == "" || r.err != nil {
+			break
+		}
+		s.params[key] = r.string()
+	}
+	if r.err != nil {
+		return s.fatal(r.err.(*pgError))
+	}
+	s.user = s.params["user"]
+	if s.database = s.params["database"]; s.database == "" {
+		s.database = s.user
+	}
+
+	if err = s.authenticate(); err != nil {
+		return
+	}
+
+	if !dbIDRegex.MatchString(s.database) {
+		return s.fatal(newFatal(codeInvalidCatalogName, "invalid database: %s", s.database))
+	}
+	cfg := client.NewConfig()
+	cfg.DatabaseID = s.database
+	if s.db, err = sql.Open("covenantsql", cfg.FormatDSN()); err != nil {
+		return s.fatal(newFatal(codeInvalidCatalogName, "open database failed: %v", err))
+	}
+
+	var secret [8]byte
+	if _, err = rand.Read(secret[:]); err != nil {
+		return
+	}
+	s.pid = int32(binary.BigEndian.Uint32(secret[:4]) & 0x7fffffff)
+
+	if err = s.conn.send(newMessage(msgAuthentication).int32(authOK)); err != nil {
+		return
+	}
+	var keys []string
+	for k := range serverInfo {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err = s.conn.send(newMessage(msgParameterStatus).string(k).string(serverInfo[k])); err != nil {
+			return
+		}
+	}
+	if err = s.conn.send(newMessage(msgParameterStatus).
+		string("session_authorization").string(s.user)); err != nil {
+		return
+	}
+	if err = s.conn.send(newMessage(msgBackendKeyData).int32(s.pid).bytes(secret[4:])); err != nil {
+		return
+	}
+	return s.readyForQuery()
+}
+
+// authenticate requests the md5 password of the user.
+func (s *session) authenticate() (err error) {
+	var salt [4]byte
+	if _, err = rand.Read(salt[:]); err != nil {
+		return
+	}
+	if err = s.conn.send(newMessage(msgAuthentication).int32(authMD5Password).bytes(salt[:])); err != nil {
+		return
+	}
+	if err = s.conn.flush(); err != nil {
+		return
+	}
+	var (
+		typ byte
+		r   *reader
+	)
+	if typ, r, err = s.conn.readMessage(); err != nil {
+		return
+	}
+	if typ != msgPassword {
+		return s.fatal(newFatal(codeProtocolViolation, "expected password response, got message type %c", typ))
+	}
+	var (
+		password = r.string()
+		expected = "md5" + md5Hex(md5Hex(s.server.pgPassword+s.server.pgUser)+string(salt[:]))
+	)
+	if r.err != nil || s.user != s.server.pgUser || password != expected {
+		return s.fatal(newFatal(codeInvalidPassword, "password authentication failed for user %q", s.user))
+	}
+	return
+}
+
+func md5Hex(s string) string {
+	var sum = md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// fatal sends the fatal error and ends the session.
+func (s *session) fatal(e *pgError) error {
+	if err := s.conn.sendError(e); err != nil {
+		return err
+	}
+	if err := s.conn.flush(); err != nil {
+		return err
+	}
+	return e
+}
+
+func (s *session) readyForQuery() (err error) {
+	// transactions are executed as single queries, so the session is always idle
+	if err = s.conn.send(newMessage(msgReadyForQuery).byte('I')); err != nil {
+		return
+	}
+	return s.conn.flush()
+}
+
+func (s *session) close() {
+	if s.db != nil {
+		_ = s.db.Close()
+	}
+}
+
+// serve handles the frontend messages until the connection is terminated.
+func (s *session) serve() (err error) {
+	for {
+		var (
+			typ byte
+			r   *reader
+		)
+		if typ, r, err = s.conn.readMessage(); err != nil {
+			return
+		}
+		switch typ {
+		case msgTerminate:
+			return
+		case msgQuery:
+			err = s.handleQuery(r)
+		case msgSync:
+			s.failed = false
+			err = s.readyForQuery()
+		case msgFlush:
+			err = s.conn.flush()
+		case msgParse, msgBind, msgDescribe, msgExecute, msgClose:
+			if s.failed {
+				// discard messages until Sync after an error
+				continue
+			}
+			if e := s.handleExtended(typ, r); e != nil {
+				s.failed = true
+				err = s.sendError(e)
+			}
+		default:
+			err = s.fatal(newFatal(codeProtocolViolation, "invalid frontend message type %c", typ))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *session) sendError(err error) error {
+	e, ok := err.(*pgError)
+	if !ok {
+		e = newError(codeInternalError, "%v", err)
+	}
+	log.WithError(err).Debug("query failed")
+	return s.conn.sendError(e)
+}
+
+// handleQuery handles the simple query protocol.
+func (s *session) handleQuery(r *reader) (err error) {
+	var (
+		text    = r.string()
+		queries []*query
+	)
+	if r.err != nil {
+		return s.fatal(r.err.(*pgError))
+	}
+	log.WithField("query", text).Info("received query")
+	if queries, err = splitQuery(text); err != nil {
+		if err = s.sendError(err); err != nil {
+			return
+		}
+		return s.readyForQuery()
+	}
+	for _, q := range queries {
+		var res *result
+		if q.params > 0 {
+			err = newError(codeUndefinedParameter, "there is no parameter $%d", q.params)
+		} else {
+			res, err = s.execute(q, nil)
+		}
+		if err != nil {
+			if err = s.sendError(err); err != nil {
+				return
+			}
+			break
+		}
+		if q.kind == kindEmpty {
+			err = s.conn.send(newMessage(msgEmptyQueryResponse))
+		} else if res.columns != nil {
+			if err = s.sendRowDescription(res.columns, nil); err != nil {
+				return
+			}
+			err = s.sendRows(q, res, nil, 0, 0)
+		} else {
+			err = s.sendCommandComplete(q, res)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return s.readyForQuery()
+}
+
+// handleExtended handles the messages of the extended query protocol, the returned error is
+// sent to the frontend as ErrorResponse.
+func (s *session) handleExtended(typ byte, r *reader) (err error) {
+	switch typ {
+	case msgParse:
+		err = s.handleParse(r)
+	case msgBind:
+		err = s.handleBind(r)
+	case msgDescribe:
+		err = s.handleDescribe(r)
+	case msgExecute:
+		err = s.handleExecute(r)
+	case msgClose:
+		err = s.handleClose(r)
+	}
+	if _, ok := err.(*pgError); !ok && err != nil {
+		// network errors are returned after the message is sent
+		err = newError(codeInternalError, "%v", err)
+	}
+	return
+}
+
+func (s *session) handleParse(r *reader) (err error) {
+	var (
+		name  = r.string()
+		text  = r.string()
+		types = make([]int32, r.int16())
+	)
+	for i := range types {
+		types[i] = r.int32()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	log.WithField("query", text).Info("received prepare")
+	if _, ok := s.stmts[name]; ok && name != "" {
+		return newError(codeDuplicatePreparedStmt, "prepared statement %q already exists", name)
+	}
+	var queries []*query
+	if queries, err = splitQuery(text); err != nil {
+		return
+	}
+	if len(queries) > 1 {
+		return newError(codeSyntaxError, "cannot insert multiple commands into a prepared statement")
+	}
+	var stmt = &statement{query: queries[0], paramTypes: make([]int32, queries[0].params)}
+	for i := range stmt.paramTypes {
+		if stmt.paramTypes[i] = oidText; i < len(types) && types[i] != 0 {
+			stmt.paramTypes[i] = types[i]
+		}
+	}
+	s.stmts[name] = stmt
+	return s.conn.send(newMessage(msgParseComplete))
+}
+
+func readFormats(r *reader) (formats []int16) {
+	formats = make([]int16, r.int16())
+	for i := range formats {
+		formats[i] = r.int16()
+	}
+	return
+}
+
+// format returns the format of the i-th field, a single format applies to all fields.
+func format(formats []int16, i int) int16 {
+	switch len(formats) {
+	case 0:
+		return 0
+	case 1:
+		return formats[0]
+	default:
+		return formats[i]
+	}
+}
+
+func (s *session) handleBind(r *reader) (err error) {
+	var (
+		name     = r.string()
+		stmtName = r.string()
+		formats  = readFormats(r)
+		values   = make([][]byte, r.int16())
+	)
+	for i := range values {
+		if size := r.int32(); size >= 0 {
+			values[i] = r.bytes(int(size))
+		}
+	}
+	var p = &portal{formats: readFormats(r)}
+	if r.err != nil {
+		return r.err
+	}
+	var ok bool
+	if p.stmt, ok = s.stmts[stmtName]; !ok {
+		return newError(codeInvalidSQLStatementName, "prepared statement %q does not exist", stmtName)
+	}
+	if len(values) != p.stmt.params {
+		return newError(codeProtocolViolation,
+			"bind message supplies %d parameters, but prepared statement requires %d",
+			len(values), p.stmt.params)
+	}
+	if len(formats) > 1 && len(formats) != len(values) {
+		return newError(codeProtocolViolation, "invalid parameter format count %d", len(formats))
+	}
+	var params = make([]interface{}, len(values))
+	for i, v := range values {
+		if params[i], err = decodeParam(v, p.stmt.paramTypes[i], format(formats, i)); err != nil {
+			return
+		}
+	}
+	// arguments are sent as positional named args of the rewritten query
+	p.args = make([]interface{}, len(p.stmt.order))
+	for i, v := range p.stmt.order {
+		p.args[i] = params[v]
+	}
+	s.portals[name] = p
+	return s.conn.send(newMessage(msgBindComplete))
+}
+
+func (s *session) handleDescribe(r *reader) (err error) {
+	var (
+		kind = r.byte()
+		name = r.string()
+	)
+	if r.err != nil {
+		return r.err
+	}
+	switch kind {
+	case 'S':
+		stmt, ok := s.stmts[name]
+		if !ok {
+			return newError(codeInvalidSQLStatementName, "prepared statement %q does not exist", name)
+		}
+		if err = s.describe(stmt); err != nil {
+			return
+		}
+		var m = newMessage(msgParameterDescription).int16(int16(len(stmt.paramTypes)))
+		for _, v := range stmt.paramTypes {
+			m = m.int32(v)
+		}
+		if err = s.conn.send(m); err != nil {
+			return
+		}
+		if stmt.columns == nil {
+			return s.conn.send(newMessage(msgNoData))
+		}
+		return s.sendRowDescription(stmt.columns, nil)
+	case 'P':
+		p, ok := s.portals[name]
+		if !ok {
+			return newError(codeInvalidCursorName, "portal %q does not exist", name)
+		}
+		if !p.stmt.hasResult() {
+			return s.conn.send(newMessage(msgNoData))
+		}
+		// the query of the portal is executed on describe to return the result columns
+		if p.result == nil {
+			if p.result, err = s.execute(p.stmt.query, p.args); err != nil {
+				return
+			}
+		}
+		return s.sendRowDescription(p.result.columns, p.formats)
+	default:
+		return newError(codeProtocolViolation, "invalid describe kind %c", kind)
+	}
+}
+
+func (q *query) hasResult() bool {
+	switch q.kind {
+	case kindShow, kindCatalog, kindRead:
+		return true
+	}
+	return false
+}
+
+// describe gets the result columns of the statement by dry-running the query with null parameters.
+func (s *session) describe(stmt *statement) (err error) {
+	if stmt.described || !stmt.hasResult() {
+		return
+	}
+	var (
+		q    = *stmt.query
+		args = make([]interface{}, len(q.order))
+		res  *result
+	)
+	q.text = stmt.describeText()
+	if res, err = s.execute(&q, args); err != nil {
+		return
+	}
+	stmt.columns, stmt.described = res.columns, true
+	return
+}
+
+func (s *session) handleExecute(r *reader) (err error) {
+	var (
+		name    = r.string()
+		maxRows = r.int32()
+	)
+	if r.err != nil {
+		return r.err
+	}
+	p, ok := s.portals[name]
+	if !ok {
+		return newError(codeInvalidCursorName, "portal %q does not exist", name)
+	}
+	if p.stmt.kind == kindEmpty {
+		return s.conn.send(newMessage(msgEmptyQueryResponse))
+	}
+	if p.result == nil {
+		if p.result, err = s.execute(p.stmt.query, p.args); err != nil {
+			return
+		}
+	}
+	if !p.stmt.hasResult() {
+		return s.sendCommandComplete(p.stmt.query, p.result)
+	}
+	return s.sendRows(p.stmt.query, p.result, p, int(maxRows), p.sent)
+}
+
+func (s *session) handleClose(r *reader) (err error) {
+	var (
+		kind = r.byte()
+		name = r.string()
+	)
+	if r.err != nil {
+		return r.err
+	}
+	switch kind {
+	case 'S':
+		delete(s.stmts, name)
+	case 'P':
+		delete(s.portals, name)
+	default:
+		return newError(codeProtocolViolation, "invalid close kind %c", kind)
+	}
+	return s.conn.send(newMessage(msgCloseComplete))
+}
+
+func (s *session) sendRowDescription(columns []column, formats []int16) (err error) {
+	var m = newMessage(msgRowDescription).int16(int16(len(columns)))
+	for i, v := range columns {
+		m = m.string(v.name).int32(0).int16(0).int32(v.oid).int16(typeSize(v.oid)).int32(-1).
+			int16(format(formats, i))
+	}
+	return s.conn.send(m)
+}
+
+// sendRows sends the rows of the result from offset, at most maxRows rows are sent if maxRows
+// is positive, and the portal is suspended if there are more rows.
+func (s *session) sendRows(q *query, res *result, p *portal, maxRows, offset int) (err error) {
+	var (
+		rows    = res.rows[offset:]
+		formats []int16
+	)
+	if p != nil {
+		formats = p.formats
+	}
+	if maxRows > 0 && len(rows) > maxRows {
+		rows = rows[:maxRows]
+	}
+	for _, row := range rows {
+		var m = newMessage(msgDataRow).int16(int16(len(row)))
+		for i, v := range row {
+			var data []byte
+			if data, err = encodeValue(v, res.columns[i].oid, format(formats, i)); err != nil {
+				return
+			}
+			if v == nil {
+				m = m.int32(-1)
+			} else {
+				m = m.int32(int32(len(data))).bytes(data)
+			}
+		}
+		if err = s.conn.send(m); err != nil {
+			return
+		}
+	}
+	if p != nil {
+		if p.sent = offset + len(rows); p.sent < len(res.rows) {
+			return s.conn.send(newMessage(msgPortalSuspended))
+		}
+	}
+	return s.conn.send(newMessage(msgCommandComplete).string(q.commandTag(int64(offset + len(rows)))))
+}
+
+func (s *session) sendCommandComplete(q *query, res *result) error {
+	return s.conn.send(newMessage(msgCommandComplete).string(q.commandTag(res.affected)))
+}
+
+// execute executes the query with the positional arguments.
+func (s *session) execute(q *query, args []interface{}) (res *result, err error) {
+	res = &result{}
+	switch q.kind {
+	case kindEmpty, kindNoop:
+		return
+	case kindShow:
+		return s.show(q)
+	case kindCatalog:
+		var c *catalog
+		if c, err = newCatalog(s); err != nil {
+			return
+		}
+		defer c.Close()
+		if catalogTables.MatchString(q.text) {
+			if err = c.load(s.db); err != nil {
+				return
+			}
+		}
+		var rows *sql.Rows
+		if rows, err = c.Query(rewriteCatalogQuery(q.text), args...); err != nil {
+			return
+		}
+		return readResult(rows)
+	case kindRead:
+		var rows *sql.Rows
+		if rows, err = s.db.Query(q.text, args...); err != nil {
+			return
+		}
+		return readResult(rows)
+	default:
+		var r sql.Result
+		if r, err = s.db.Exec(q.text, args...); err != nil {
+			return
+		}
+		res.affected, _ = r.RowsAffected()
+		return
+	}
+}
+
+func (s *session) show(q *query) (res *result, err error) {
+	var (
+		param = strings.ToLower(showParam.FindStringSubmatch(q.text)[1])
+		info  = make(map[string]string, len(serverInfo)+2)
+	)
+	for k, v := range serverInfo {
+		info[strings.ToLower(k)] = v
+	}
+	info["session_authorization"] = s.user
+	info["application_name"] = s.params["application_name"]
+
+	res = &result{columns: []column{{name: param, oid: oidText}}}
+	if param == "all" {
+		var keys []string
+		for k := range info {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		res.columns = []column{{name: "name", oid: oidText}, {name: "setting", oid: oidText}}
+		for _, k := range keys {
+			res.rows = append(res.rows, []interface{}{k, info[k]})
+		}
+		return
+	}
+	if v, ok := info[param]; ok {
+		res.rows = [][]interface{}{{v}}
+		return
+	}
+	err = newError(codeUndefinedObject, "unrecognized configuration parameter %q", param)
+	return
+}
+
+func readResult(rows *sql.Rows) (res *result, err error) {
+	defer rows.Close()
+	var types []*sql.ColumnType
+	if types, err = rows.ColumnTypes(); err != nil {
+		return
+	}
+	res = &result{columns: make([]column, len(types))}
+	for i, v := range types {
+		res.columns[i] = column{name: v.Name(), oid: typeOID(v.DatabaseTypeName())}
+	}
+	for rows.Next() {
+		var (
+			row  = make([]interface{}, len(types))
+			dest = make([]interface{}, len(types))
+		)
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return
+		}
+		res.rows = append(res.rows, row)
+	}
+	err = rows.Err()
+	return
+}
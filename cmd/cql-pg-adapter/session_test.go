@@ -0,0 +1,284 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// frontend is a minimal protocol client for testing.
+type frontend struct {
+	*conn
+}
+
+type backendMessage struct {
+	typ  byte
+	data []byte
+}
+
+func (f *frontend) sendStartup(params ...string) (err error) {
+	var m = message{0, 0, 0, 0}.int32(protocolVersion)
+	for _, v := range params {
+		m = m.string(v)
+	}
+	m = m.byte(0)
+	binary.BigEndian.PutUint32(m, uint32(len(m)))
+	if _, err = f.w.Write(m); err != nil {
+		return
+	}
+	return f.flush()
+}
+
+func (f *frontend) sendMessages(msgs ...message) (err error) {
+	for _, v := range msgs {
+		if err = f.send(v); err != nil {
+			return
+		}
+	}
+	return f.flush()
+}
+
+// receive reads the backend messages until ReadyForQuery.
+func (f *frontend) receive() (msgs []backendMessage, err error) {
+	for {
+		var (
+			typ byte
+			r   *reader
+		)
+		if typ, r, err = f.readMessage(); err != nil {
+			return
+		}
+		msgs = append(msgs, backendMessage{typ: typ, data: r.data})
+		if typ == msgReadyForQuery || (typ == msgAuthentication && len(r.data) > 4) {
+			return
+		}
+	}
+}
+
+func messageTypes(msgs []backendMessage) (types string) {
+	for _, v := range msgs {
+		types += string(v.typ)
+	}
+	return
+}
+
+// dataRows returns the text values of the DataRow messages.
+func dataRows(msgs []backendMessage) (rows [][]string) {
+	for _, v := range msgs {
+		if v.typ != msgDataRow {
+			continue
+		}
+		var (
+			r   = &reader{data: v.data}
+			row = make([]string, r.int16())
+		)
+		for i := range row {
+			if n := r.int32(); n >= 0 {
+				row[i] = string(r.bytes(int(n)))
+			} else {
+				row[i] = "NULL"
+			}
+		}
+		rows = append(rows, row)
+	}
+	return
+}
+
+func commandTags(msgs []backendMessage) (tags []string) {
+	for _, v := range msgs {
+		if v.typ == msgCommandComplete {
+			tags = append(tags, (&reader{data: v.data}).string())
+		}
+	}
+	return
+}
+
+func simpleQuery(text string) message {
+	return newMessage(msgQuery).string(text)
+}
+
+func TestSession(t *testing.T) {
+	Convey("Given a postgresql adapter session on a local database", t, func() {
+		dir, err := ioutil.TempDir("", "pg-adapter")
+		So(err, ShouldBeNil)
+		Reset(func() { _ = os.RemoveAll(dir) })
+		db, err := sql.Open("sqlite3", filepath.Join(dir, "test.db"))
+		So(err, ShouldBeNil)
+		Reset(func() { _ = db.Close() })
+
+		tableInfoQuery = "PRAGMA table_info(`%s`)"
+		var (
+			server     = &Server{pgUser: "postgres", pgPassword: "calvin"}
+			serverSide net.Conn
+			clientSide net.Conn
+			done       = make(chan error, 1)
+		)
+		serverSide, clientSide = net.Pipe()
+		Reset(func() { _ = clientSide.Close() })
+		var s = newSession(server, newConn(serverSide))
+		go func() {
+			defer serverSide.Close()
+			var err = s.startup()
+			if err == nil {
+				_ = s.db.Close()
+				s.db = db
+				err = s.serve()
+			}
+			done <- err
+		}()
+
+		var f = &frontend{conn: newConn(clientSide)}
+		So(f.sendStartup("user", "postgres", "database", "testdb"), ShouldBeNil)
+		msgs, err := f.receive()
+		So(err, ShouldBeNil)
+		So(messageTypes(msgs), ShouldEqual, "R")
+		var salt = string(msgs[0].data[4:])
+
+		Convey("A wrong password should be rejected", func() {
+			So(f.sendMessages(newMessage(msgPassword).string("md5wrong")), ShouldBeNil)
+			msgs, err = f.receive()
+			So(err, ShouldEqual, io.EOF)
+			So(messageTypes(msgs), ShouldEqual, "E")
+			So((<-done).(*pgError).code, ShouldEqual, codeInvalidPassword)
+		})
+		Convey("The authenticated session should serve queries", func() {
+			So(f.sendMessages(newMessage(msgPassword).string(
+				"md5"+md5Hex(md5Hex("calvin"+"postgres")+salt))), ShouldBeNil)
+			msgs, err = f.receive()
+			So(err, ShouldBeNil)
+			So(messageTypes(msgs), ShouldStartWith, "RS")
+			So(messageTypes(msgs), ShouldEndWith, "KZ")
+
+			So(f.sendMessages(simpleQuery(`CREATE TABLE t (k INTEGER PRIMARY KEY, v TEXT NOT NULL);
+INSERT INTO t VALUES (1, 'a'), (2, 'b'); SET application_name = 'test'`)), ShouldBeNil)
+			msgs, err = f.receive()
+			So(err, ShouldBeNil)
+			So(commandTags(msgs), ShouldResemble, []string{"CREATE TABLE", "INSERT 0 2", "SET"})
+
+			Convey("The simple query should be served", func() {
+				So(f.sendMessages(simpleQuery("SELECT k, v FROM t ORDER BY k; ;")), ShouldBeNil)
+				msgs, err = f.receive()
+				So(err, ShouldBeNil)
+				So(messageTypes(msgs), ShouldEqual, "TDDCZ")
+				So(dataRows(msgs), ShouldResemble, [][]string{{"1", "a"}, {"2", "b"}})
+				So(commandTags(msgs), ShouldResemble, []string{"SELECT 2"})
+
+				So(f.sendMessages(simpleQuery("")), ShouldBeNil)
+				msgs, err = f.receive()
+				So(err, ShouldBeNil)
+				So(messageTypes(msgs), ShouldEqual, "IZ")
+
+				So(f.sendMessages(simpleQuery("SELECT * FROM missing; SELECT 1")), ShouldBeNil)
+				msgs, err = f.receive()
+				So(err, ShouldBeNil)
+				So(messageTypes(msgs), ShouldEqual, "EZ")
+			})
+			Convey("The extended query should be served", func() {
+				var param = make([]byte, 8)
+				binary.BigEndian.PutUint64(param, 2)
+				So(f.sendMessages(
+					newMessage(msgParse).string("s1").string("SELECT v, k::int8 FROM t WHERE k >= $1").
+						int16(1).int32(oidInt8),
+					newMessage(msgDescribe).byte('S').string("s1"),
+					newMessage(msgBind).string("").string("s1").int16(1).int16(1).
+						int16(1).int32(8).bytes(param).int16(0),
+					newMessage(msgExecute).string("").int32(0),
+					newMessage(msgSync),
+				), ShouldBeNil)
+				msgs, err = f.receive()
+				So(err, ShouldBeNil)
+				So(messageTypes(msgs), ShouldEqual, "1tT2DCZ")
+				So(dataRows(msgs), ShouldResemble, [][]string{{"b", "2"}})
+
+				// rows are sent in batches with suspended portal
+				So(f.sendMessages(
+					newMessage(msgBind).string("p1").string("s1").int16(0).
+						int16(1).int32(1).bytes([]byte("1")).int16(1).int16(1),
+					newMessage(msgDescribe).byte('P').string("p1"),
+					newMessage(msgExecute).string("p1").int32(1),
+					newMessage(msgExecute).string("p1").int32(1),
+					newMessage(msgClose).byte('P').string("p1"),
+					newMessage(msgSync),
+				), ShouldBeNil)
+				msgs, err = f.receive()
+				So(err, ShouldBeNil)
+				So(messageTypes(msgs), ShouldEqual, "2TDsDC3Z")
+				var rows = dataRows(msgs)
+				So(rows, ShouldHaveLength, 2)
+				So(rows[1][0], ShouldEqual, "b")
+				So([]byte(rows[1][1]), ShouldResemble, param)
+
+				// messages after an error are discarded until sync
+				So(f.sendMessages(
+					newMessage(msgBind).string("").string("missing").int16(0).int16(0).int16(0),
+					newMessage(msgExecute).string("").int32(0),
+					newMessage(msgSync),
+				), ShouldBeNil)
+				msgs, err = f.receive()
+				So(err, ShouldBeNil)
+				So(messageTypes(msgs), ShouldEqual, "EZ")
+			})
+			Convey("The catalog queries should be translated", func() {
+				So(f.sendMessages(simpleQuery(`SELECT n.nspname as "Schema", c.relname as "Name",
+  CASE c.relkind WHEN 'r' THEN 'table' WHEN 'v' THEN 'view' END as "Type",
+  pg_catalog.pg_get_userbyid(c.relowner) as "Owner"
+FROM pg_catalog.pg_class c
+     LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r','p','v','m','S','f','')
+      AND n.nspname <> 'pg_catalog'
+      AND n.nspname <> 'information_schema'
+      AND n.nspname !~ '^pg_toast'
+      AND c.relname OPERATOR(pg_catalog.~) '^(t)$' COLLATE pg_catalog.default
+  AND pg_catalog.pg_table_is_visible(c.oid)
+ORDER BY 1,2;`)), ShouldBeNil)
+				msgs, err = f.receive()
+				So(err, ShouldBeNil)
+				So(dataRows(msgs), ShouldResemble, [][]string{{"public", "t", "table", "postgres"}})
+
+				So(f.sendMessages(simpleQuery(`SELECT column_name, data_type, is_nullable
+FROM information_schema.columns WHERE table_schema = 'public' AND table_name = 't'
+ORDER BY ordinal_position`)), ShouldBeNil)
+				msgs, err = f.receive()
+				So(err, ShouldBeNil)
+				So(dataRows(msgs), ShouldResemble, [][]string{
+					{"k", "bigint", "NO"},
+					{"v", "text", "NO"},
+				})
+
+				So(f.sendMessages(simpleQuery(
+					"SELECT current_database(), current_user; SHOW server_version; SHOW missing")), ShouldBeNil)
+				msgs, err = f.receive()
+				So(err, ShouldBeNil)
+				So(messageTypes(msgs), ShouldEqual, "TDCTDCEZ")
+				So(dataRows(msgs), ShouldResemble, [][]string{{"testdb", "postgres"}, {serverVersion}})
+			})
+			Convey("The session should be terminated", func() {
+				So(f.sendMessages(newMessage(msgTerminate)), ShouldBeNil)
+				So(<-done, ShouldBeNil)
+			})
+		})
+	})
+}
@@ -43,7 +43,7 @@ const name = "cql-utils"
 func init() {
 	log.SetLevel(log.InfoLevel)
 
-	flag.StringVar(&tool, "tool", "", "Tool type, miner, keytool, rpc, nonce, confgen, addrgen, adapterconfgen")
+	flag.StringVar(&tool, "tool", "", "Tool type, miner, keytool, rpc, nonce, confgen, addrgen, adapterconfgen, reconstruct")
 	flag.StringVar(&publicKeyHex, "public", "", "Public key hex string to mine node id/nonce")
 	flag.StringVar(&privateKeyFile, "private", "~/.cql/private.key", "Private key file to generate/show")
 	flag.StringVar(&configFile, "config", "~/.cql/config.yaml", "Config file to use")
@@ -100,6 +100,8 @@ func main() {
 			os.Exit(1)
 		}
 		runAddrgen()
+	case "reconstruct":
+		runReconstruct()
 	default:
 		flag.Usage()
 		os.Exit(1)
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/client"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/sqlchain"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+var (
+	reconstructDatabase string
+	reconstructNode     string
+	reconstructObserver bool
+	reconstructGenesis  string
+	reconstructHeight   int
+	reconstructTime     string
+	reconstructOutput   string
+)
+
+func init() {
+	flag.StringVar(&reconstructDatabase, "reconstruct-db", "", "database id to reconstruct")
+	flag.StringVar(&reconstructNode, "reconstruct-node", "", "node id of the miner or observer to read blocks from")
+	flag.BoolVar(&reconstructObserver, "reconstruct-observer", false, "read blocks from an observer instead of a miner")
+	flag.StringVar(&reconstructGenesis, "reconstruct-genesis", "", "expected genesis block hash, optional")
+	flag.IntVar(&reconstructHeight, "reconstruct-height", -1, "block height to reconstruct to, -1 for the newest block")
+	flag.StringVar(&reconstructTime, "reconstruct-time", "", "time to reconstruct to in RFC3339 format, optional")
+	flag.StringVar(&reconstructOutput, "reconstruct-out", "", "sqlite file to write the reconstructed database into")
+}
+
+func runReconstruct() {
+	if configFile == "" {
+		log.Fatal("config file path is required for reconstruct tool")
+		return
+	}
+	if reconstructDatabase == "" || reconstructNode == "" || reconstructOutput == "" {
+		log.Fatal("database id, source node id and output file are required for reconstruct tool")
+		return
+	}
+
+	var cfg = &sqlchain.ReconstructConfig{
+		DataFile: reconstructOutput,
+		Height:   int32(reconstructHeight),
+	}
+	if reconstructGenesis != "" {
+		if err := hash.Decode(&cfg.GenesisHash, reconstructGenesis); err != nil {
+			log.Fatalf("decode genesis hash failed: %v\n", err)
+			return
+		}
+	}
+	if reconstructTime != "" {
+		var err error
+		if cfg.Time, err = time.Parse(time.RFC3339Nano, reconstructTime); err != nil {
+			log.Fatalf("parse reconstruct time failed: %v\n", err)
+			return
+		}
+	}
+
+	if err := client.Init(configFile, []byte("")); err != nil {
+		log.Fatalf("init rpc client failed: %v\n", err)
+		return
+	}
+
+	var (
+		node = proto.NodeID(reconstructNode)
+		dbID = proto.DatabaseID(reconstructDatabase)
+	)
+	if reconstructObserver {
+		cfg.Source = sqlchain.NewObserverBlockSource(node, dbID)
+	} else {
+		cfg.Source = sqlchain.NewMinerBlockSource(node, dbID)
+	}
+
+	res, err := sqlchain.Reconstruct(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("reconstruct database failed: %v\n", err)
+		return
+	}
+
+	log.Infof("genesis block: %s\n", res.Genesis.BlockHash())
+	log.Infof("reconstructed to block %s at height %d (%s)\n",
+		res.Head.BlockHash(), res.Height, res.Head.Timestamp().Format(time.RFC3339Nano))
+	log.Infof("replayed %d blocks with %d write queries into %s\n",
+		res.Blocks, res.Queries, reconstructOutput)
+}
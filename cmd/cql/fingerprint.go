@@ -0,0 +1,128 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// patternRecorder records the fingerprints of the succeeded queries in a trial run.
+type patternRecorder struct {
+	sync.Mutex
+	patterns map[string]bool
+}
+
+func newPatternRecorder() *patternRecorder {
+	return &patternRecorder{
+		patterns: make(map[string]bool),
+	}
+}
+
+func (r *patternRecorder) record(query string) {
+	fingerprint, err := types.QueryFingerprint(query)
+	if err != nil {
+		log.WithError(err).WithField("query", query).Warning("record query pattern failed")
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.patterns[fingerprint] = true
+}
+
+// save writes the recorded patterns to file as a json array, which could be used as the patterns
+// of the -update-perm payload.
+func (r *patternRecorder) save(file string) (err error) {
+	r.Lock()
+	patterns := make([]string, 0, len(r.patterns))
+	for p := range r.patterns {
+		patterns = append(patterns, p)
+	}
+	r.Unlock()
+	sort.Strings(patterns)
+
+	var data []byte
+	if data, err = json.MarshalIndent(patterns, "", "  "); err != nil {
+		return
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
+
+// recordingConnector opens the connections recording queries to the recorder.
+type recordingConnector struct {
+	dsn      string
+	driver   driver.Driver
+	recorder *patternRecorder
+}
+
+// Connect implements driver.Connector.Connect.
+func (c *recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: conn, recorder: c.recorder}, nil
+}
+
+// Driver implements driver.Connector.Driver.
+func (c *recordingConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// recordingConn wraps a covenantsql connection to record the succeeded queries.
+type recordingConn struct {
+	driver.Conn
+	recorder *patternRecorder
+}
+
+// BeginTx implements driver.ConnBeginTx.BeginTx.
+func (c *recordingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+// PrepareContext implements driver.ConnPrepareContext.PrepareContext.
+func (c *recordingConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
+	if stmt, err = c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query); err == nil {
+		c.recorder.record(query)
+	}
+	return
+}
+
+// ExecContext implements driver.ExecerContext.ExecContext.
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (
+	result driver.Result, err error) {
+	if result, err = c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args); err == nil {
+		c.recorder.record(query)
+	}
+	return
+}
+
+// QueryContext implements driver.QueryerContext.QueryContext.
+func (c *recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (
+	rows driver.Rows, err error) {
+	if rows, err = c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args); err == nil {
+		c.recorder.record(query)
+	}
+	return
+}
@@ -24,6 +24,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"regexp"
@@ -64,6 +65,8 @@ var (
 	singleTransaction bool
 	showVersion       bool
 	variables         varsFlag
+	recordPatterns    string
+	recorder          *patternRecorder
 
 	// DML variables
 	createDB                string // as a instance meta json string or simply a node count
@@ -73,6 +76,12 @@ var (
 	getBalance              bool   // get balance of current account
 	getBalanceWithTokenName string // get specific token's balance of current account
 	waitTxConfirmation      bool   // wait for transaction confirmation before exiting
+	backupDB                string // database id to backup
+	restoreDB               string // database id to restore
+	backupFile              string // backup archive file
+	usageDB                 string // database id to query resource usage
+	rateLimit               string // per-user rate limits of database as a json string
+	queryLimit              string // per-user read query limits of database as a json string
 
 	waitTxConfirmationMaxDuration time.Duration
 )
@@ -89,6 +98,55 @@ type userPermPayload struct {
 	// SQL pattern regulations for user queries
 	// only a fully matched (case-sensitive) sql query is permitted to execute.
 	Patterns []string `json:"patterns"`
+	// Match queries to patterns by fingerprint instead of the exact query.
+	MatchFingerprint bool `json:"match_fingerprint"`
+	// Table and column grants narrowing the user role.
+	Grants []types.TableGrant `json:"grants"`
+}
+
+type rateLimitValue struct {
+	Rate  float64 `json:"rate"`
+	Burst uint32  `json:"burst"`
+}
+
+type userRateLimit struct {
+	User  proto.AccountAddress `json:"user"`
+	Read  rateLimitValue       `json:"read"`
+	Write rateLimitValue       `json:"write"`
+}
+
+type dbRateLimit struct {
+	TargetDB string          `json:"db"`
+	Read     rateLimitValue  `json:"read"`
+	Write    rateLimitValue  `json:"write"`
+	Users    []userRateLimit `json:"users"`
+}
+
+type queryLimitValue struct {
+	Timeout    uint64 `json:"timeout"`
+	MaxRows    uint64 `json:"max_rows"`
+	MaxBytes   uint64 `json:"max_bytes"`
+	MaxVMSteps uint64 `json:"max_vm_steps"`
+}
+
+func (v queryLimitValue) toQueryLimit() types.QueryLimit {
+	return types.QueryLimit{
+		Timeout:    v.Timeout,
+		MaxRows:    v.MaxRows,
+		MaxBytes:   v.MaxBytes,
+		MaxVMSteps: v.MaxVMSteps,
+	}
+}
+
+type userQueryLimit struct {
+	User  proto.AccountAddress `json:"user"`
+	Limit queryLimitValue      `json:"limit"`
+}
+
+type dbQueryLimit struct {
+	TargetDB string           `json:"db"`
+	Limit    queryLimitValue  `json:"limit"`
+	Users    []userQueryLimit `json:"users"`
 }
 
 type tranToken struct {
@@ -192,7 +250,19 @@ func usqlRegister() {
 				return
 			}
 
-			return sql.Open, nil
+			if recorder == nil {
+				return sql.Open, nil
+			}
+
+			return func(driverName string, dsn string) (db *sql.DB, err error) {
+				// open to get the underlying driver only, no connection is made
+				if db, err = sql.Open(driverName, dsn); err != nil {
+					return
+				}
+				drv := db.Driver()
+				_ = db.Close()
+				return sql.OpenDB(&recordingConnector{dsn: dsn, driver: drv, recorder: recorder}), nil
+			}, nil
 		},
 	})
 
@@ -229,6 +299,8 @@ func init() {
 	flag.StringVar(&password, "password", "", "Master key password for covenantsql")
 	flag.BoolVar(&singleTransaction, "single-transaction", false, "Execute as a single transaction (if non-interactive)")
 	flag.Var(&variables, "variable", "Set variable")
+	flag.StringVar(&recordPatterns, "record-patterns", "",
+		"Record fingerprints of succeeded queries to file as query patterns for -update-perm with match_fingerprint")
 
 	// DML flags
 	flag.StringVar(&createDB, "create", "", "Create database, argument can be instance requirement json or simply a node count requirement")
@@ -238,6 +310,12 @@ func init() {
 	flag.BoolVar(&getBalance, "get-balance", false, "Get balance of current account")
 	flag.StringVar(&getBalanceWithTokenName, "token-balance", "", "Get specific token's balance of current account, e.g. Particle, Wave, and etc.")
 	flag.BoolVar(&waitTxConfirmation, "wait-tx-confirm", false, "Wait for transaction confirmation")
+	flag.StringVar(&backupDB, "backup", "", "Backup database to archive file specified by -backup-file, argument should be a database id")
+	flag.StringVar(&restoreDB, "restore", "", "Restore database from archive file specified by -backup-file, argument should be a database id")
+	flag.StringVar(&backupFile, "backup-file", "", "Backup archive file for -backup and -restore")
+	flag.StringVar(&usageDB, "usage", "", "Show resource usage of database, argument should be a database id")
+	flag.StringVar(&rateLimit, "rate-limit", "", "Set per-user query rate limits of database, argument should be a rate limit json")
+	flag.StringVar(&queryLimit, "query-limit", "", "Set per-user read query limits of database, argument should be a query limit json")
 }
 
 func main() {
@@ -309,12 +387,7 @@ func main() {
 
 	if dropDB != "" {
 		// drop database
-		if _, err := client.ParseDSN(dropDB); err != nil {
-			// not a dsn
-			cfg := client.NewConfig()
-			cfg.DatabaseID = dropDB
-			dropDB = cfg.FormatDSN()
-		}
+		dropDB = toDSN(dropDB)
 
 		if err := client.Drop(dropDB); err != nil {
 			// drop database failed
@@ -327,6 +400,159 @@ func main() {
 		return
 	}
 
+	if backupDB != "" {
+		// backup database
+		if backupFile == "" {
+			log.Error("backup database failed: -backup-file is required")
+			os.Exit(-1)
+			return
+		}
+
+		archive, err := client.Backup(toDSN(backupDB))
+		if err != nil {
+			log.WithField("db", backupDB).WithError(err).Error("backup database failed")
+			os.Exit(-1)
+			return
+		}
+
+		data, err := client.EncodeBackupArchive(archive)
+		if err != nil {
+			log.WithError(err).Error("encode backup archive failed")
+			os.Exit(-1)
+			return
+		}
+
+		if err = ioutil.WriteFile(backupFile, data, 0600); err != nil {
+			log.WithError(err).Error("write backup archive failed")
+			os.Exit(-1)
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"db":     backupDB,
+			"height": archive.Header.Height,
+			"commit": archive.Header.CommitIndex,
+			"file":   backupFile,
+		}).Info("backup database success")
+		return
+	}
+
+	if restoreDB != "" {
+		// restore database
+		if backupFile == "" {
+			log.Error("restore database failed: -backup-file is required")
+			os.Exit(-1)
+			return
+		}
+
+		data, err := ioutil.ReadFile(backupFile)
+		if err != nil {
+			log.WithError(err).Error("read backup archive failed")
+			os.Exit(-1)
+			return
+		}
+
+		archive, err := client.DecodeBackupArchive(data)
+		if err != nil {
+			log.WithError(err).Error("decode backup archive failed")
+			os.Exit(-1)
+			return
+		}
+
+		if err = client.Restore(toDSN(restoreDB), archive); err != nil {
+			log.WithField("db", restoreDB).WithError(err).Error("restore database failed")
+			os.Exit(-1)
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"db":     restoreDB,
+			"source": archive.Header.DatabaseID,
+			"height": archive.Header.Height,
+			"commit": archive.Header.CommitIndex,
+		}).Info("restore database success")
+		return
+	}
+
+	if usageDB != "" {
+		// query database resource usage
+		usage, err := client.QueryUsage(toDSN(usageDB))
+		if err != nil {
+			log.WithField("db", usageDB).WithError(err).Error("query database usage failed")
+			os.Exit(-1)
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"db":             usageDB,
+			"space_used":     usage.SpaceUsed,
+			"space_limit":    usage.SpaceLimit,
+			"memory_ceiling": usage.MemoryCeiling,
+			"memory_limit":   usage.MemoryLimit,
+		}).Info("query database usage success")
+		return
+	}
+
+	if rateLimit != "" {
+		// set database rate limits
+		var limit dbRateLimit
+		if err := json.Unmarshal([]byte(rateLimit), &limit); err != nil || limit.TargetDB == "" {
+			log.WithError(err).Error("set rate limit failed: invalid rate limit description")
+			os.Exit(-1)
+			return
+		}
+
+		cfg := &types.RateLimitConfig{
+			Read:  types.RateLimit{Rate: limit.Read.Rate, Burst: limit.Read.Burst},
+			Write: types.RateLimit{Rate: limit.Write.Rate, Burst: limit.Write.Burst},
+		}
+		for _, u := range limit.Users {
+			cfg.Users = append(cfg.Users, types.UserRateLimit{
+				User:  u.User,
+				Read:  types.RateLimit{Rate: u.Read.Rate, Burst: u.Read.Burst},
+				Write: types.RateLimit{Rate: u.Write.Rate, Burst: u.Write.Burst},
+			})
+		}
+
+		if err := client.SetRateLimit(toDSN(limit.TargetDB), cfg); err != nil {
+			log.WithField("db", limit.TargetDB).WithError(err).Error("set rate limit failed")
+			os.Exit(-1)
+			return
+		}
+
+		log.WithField("db", limit.TargetDB).Info("set rate limit success")
+		return
+	}
+
+	if queryLimit != "" {
+		// set database read query limits
+		var limit dbQueryLimit
+		if err := json.Unmarshal([]byte(queryLimit), &limit); err != nil || limit.TargetDB == "" {
+			log.WithError(err).Error("set query limit failed: invalid query limit description")
+			os.Exit(-1)
+			return
+		}
+
+		cfg := &types.QueryLimitConfig{
+			Default: limit.Limit.toQueryLimit(),
+		}
+		for _, u := range limit.Users {
+			cfg.Users = append(cfg.Users, types.UserQueryLimit{
+				User:  u.User,
+				Limit: u.Limit.toQueryLimit(),
+			})
+		}
+
+		if err := client.SetQueryLimit(toDSN(limit.TargetDB), cfg); err != nil {
+			log.WithField("db", limit.TargetDB).WithError(err).Error("set query limit failed")
+			os.Exit(-1)
+			return
+		}
+
+		log.WithField("db", limit.TargetDB).Info("set query limit success")
+		return
+	}
+
 	if createDB != "" {
 		// create database
 		// parse instance requirement
@@ -390,8 +616,10 @@ func main() {
 		}
 
 		p := &types.UserPermission{
-			Role:     permPayload.Role,
-			Patterns: permPayload.Patterns,
+			Role:             permPayload.Role,
+			Patterns:         permPayload.Patterns,
+			MatchFingerprint: permPayload.MatchFingerprint,
+			Grants:           permPayload.Grants,
 		}
 
 		if !p.IsValid() {
@@ -495,8 +723,21 @@ func main() {
 		}
 	}
 
+	if recordPatterns != "" {
+		recorder = newPatternRecorder()
+	}
+
 	// run
 	err = run(curUser)
+
+	if recorder != nil {
+		if err := recorder.save(recordPatterns); err != nil {
+			log.WithError(err).Error("save query patterns failed")
+		} else {
+			log.WithField("file", recordPatterns).Info("query patterns recorded")
+		}
+	}
+
 	if err != nil && err != io.EOF && err != rline.ErrInterrupt {
 		log.WithError(err).Error("run cli error")
 
@@ -511,6 +752,18 @@ func main() {
 	}
 }
 
+// toDSN converts a database id to dsn, dsn is returned as is.
+func toDSN(db string) string {
+	if _, err := client.ParseDSN(db); err == nil {
+		return db
+	}
+
+	// not a dsn
+	cfg := client.NewConfig()
+	cfg.DatabaseID = db
+	return cfg.FormatDSN()
+}
+
 func wait(txHash hash.Hash) {
 	var ctx, cancel = context.WithTimeout(context.Background(), waitTxConfirmationMaxDuration)
 	defer cancel()
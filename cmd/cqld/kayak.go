@@ -45,11 +45,15 @@ func (s *KayakService) Apply(req *kt.ApplyRequest, _ *interface{}) (err error) {
 
 // Fetch handles kayak log fetch call.
 func (s *KayakService) Fetch(req *kt.FetchRequest, resp *kt.FetchResponse) (err error) {
-	var l *kt.Log
-	if l, err = s.rt.Fetch(req.GetContext(), req.Index); err != nil {
+	var (
+		l    *kt.Log
+		snap *kt.Snapshot
+	)
+	if l, snap, err = s.rt.Fetch(req.GetContext(), req.Index); err != nil {
 		return
 	}
 
 	resp.Log = l
+	resp.Snapshot = snap
 	return
 }
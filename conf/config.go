@@ -86,6 +86,46 @@ type MinerDatabaseFixture struct {
 	AutoGenerateGenesisBlock bool             `yaml:"AutoGenerateGenesisBlock,omitempty"`
 }
 
+// MinerRateLimit defines the default per-user query rate limits of databases on miner,
+// zero rate means unlimited.
+type MinerRateLimit struct {
+	ReadRate   float64 `yaml:"ReadRate,omitempty"`
+	ReadBurst  uint32  `yaml:"ReadBurst,omitempty"`
+	WriteRate  float64 `yaml:"WriteRate,omitempty"`
+	WriteBurst uint32  `yaml:"WriteBurst,omitempty"`
+}
+
+// MinerQueryLimit defines the default per-user execution limits of read queries on miner,
+// zero value means unlimited.
+type MinerQueryLimit struct {
+	Timeout    time.Duration `yaml:"Timeout,omitempty"`
+	MaxRows    uint64        `yaml:"MaxRows,omitempty"`
+	MaxBytes   uint64        `yaml:"MaxBytes,omitempty"`
+	MaxVMSteps uint64        `yaml:"MaxVMSteps,omitempty"`
+}
+
+// MinerHistory defines the state history retained by miner for the historical reads of databases,
+// zero period disables the historical reads.
+type MinerHistory struct {
+	Period    int32 `yaml:"Period,omitempty"`    // block count between state snapshots
+	Retention int32 `yaml:"Retention,omitempty"` // block count below the head to read as of
+}
+
+// MinerCursor defines the server-side cursors of the streaming reads on miner, zero value means
+// the default.
+type MinerCursor struct {
+	TTL        time.Duration `yaml:"TTL,omitempty"`        // idle time before a cursor expires
+	MaxPerConn int           `yaml:"MaxPerConn,omitempty"` // max open cursors of a connection
+	MaxPerNode int           `yaml:"MaxPerNode,omitempty"` // max open cursors of a client node
+	MaxPerDB   int           `yaml:"MaxPerDB,omitempty"`   // max open cursors of a database
+}
+
+// MinerChanges defines the row level change capture of databases on miner, zero retention
+// disables the capture.
+type MinerChanges struct {
+	Retention int `yaml:"Retention,omitempty"` // count of captured row changes to retain
+}
+
 // MinerInfo for miner config.
 type MinerInfo struct {
 	// node basic config.
@@ -93,6 +133,11 @@ type MinerInfo struct {
 	MaxReqTimeGap          time.Duration          `yaml:"MaxReqTimeGap,omitempty"`
 	ProvideServiceInterval time.Duration          `yaml:"ProvideServiceInterval,omitempty"`
 	TargetUsers            []proto.AccountAddress `yaml:"TargetUsers,omitempty"`
+	RateLimit              MinerRateLimit         `yaml:"RateLimit,omitempty"`
+	QueryLimit             MinerQueryLimit        `yaml:"QueryLimit,omitempty"`
+	History                MinerHistory           `yaml:"History,omitempty"`
+	Cursor                 MinerCursor            `yaml:"Cursor,omitempty"`
+	Changes                MinerChanges           `yaml:"Changes,omitempty"`
 
 	// when test mode, fixture database config is used.
 	IsTestMode   bool                    `yaml:"IsTestMode,omitempty"`
@@ -19,6 +19,7 @@ package hash
 import (
 	"encoding/binary"
 	"hash/fnv"
+	"io"
 
 	// "crypto/sha256" benchmark is at least 10% faster on
 	// i7-4870HQ CPU @ 2.50GHz than "github.com/minio/sha256-simd"
@@ -90,3 +91,14 @@ func THashH(b []byte) Hash {
 	first := blake2b.Sum512(b)
 	return Hash(sha256.Sum256(first[:]))
 }
+
+// THashReader calculates sha256(blake2b-512(data)) of the data read from r until EOF, the result
+// is the same as THashH of the whole data.
+func THashReader(r io.Reader) (h Hash, err error) {
+	first := blake2b.New512()
+	if _, err = io.Copy(first, r); err != nil {
+		return
+	}
+	h = Hash(sha256.Sum256(first.Sum(nil)))
+	return
+}
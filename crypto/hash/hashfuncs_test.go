@@ -220,6 +220,15 @@ func TestTHashH(t *testing.T) {
 	})
 }
 
+func TestTHashReader(t *testing.T) {
+	Convey("THashReader THashH", t, func() {
+		b := bytes.Repeat([]byte{0x43, 0x9c, 0x2f, 0x4b}, 100000)
+		h, err := THashReader(bytes.NewReader(b))
+		So(err, ShouldBeNil)
+		So(h, ShouldEqual, THashH(b))
+	})
+}
+
 func BenchmarkTHashB(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
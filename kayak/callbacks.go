@@ -19,6 +19,7 @@ package kayak
 import (
 	"context"
 
+	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/utils/trace"
 	"github.com/pkg/errors"
 )
@@ -50,5 +51,11 @@ func (r *Runtime) doDecodePayload(ctx context.Context, data []byte) (req interfa
 
 func (r *Runtime) doCommit(ctx context.Context, req interface{}, isLeader bool) (result interface{}, err error) {
 	defer trace.StartRegion(ctx, "commitCallback").End()
+
+	if peers, ok := req.(*proto.Peers); ok {
+		// membership change, the peers are applied by the commit cycle before next commit
+		return peers, nil
+	}
+
 	return r.sh.Commit(req, isLeader)
 }
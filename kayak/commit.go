@@ -84,7 +84,7 @@ func (r *Runtime) followerCommitResult(ctx context.Context, tm *timer.Timer, com
 	// decode prepare log
 	var logReq interface{}
 	var err error
-	if logReq, err = r.doDecodePayload(ctx, prepareLog.Data); err != nil {
+	if logReq, err = r.decodeLogPayload(ctx, prepareLog); err != nil {
 		res.Set(&commitResult{err: errors.Wrap(err, "decode log payload failed")})
 		return
 	}
@@ -125,7 +125,7 @@ func (r *Runtime) commitCycle() {
 	}
 }
 
-func (r *Runtime) leaderDoCommit(req *commitReq) {
+func (r *Runtime) leaderDoCommit(req *commitReq) (cr *commitResult) {
 	if req.log != nil {
 		// mis-use follower commit for leader
 		log.Fatal("INVALID EXISTING LOG FOR LEADER COMMIT")
@@ -134,11 +134,20 @@ func (r *Runtime) leaderDoCommit(req *commitReq) {
 
 	req.tm.Add("queue")
 
+	// the peers lock is released by leader before waiting for the commit, check the role again
+	r.peersLock.RLock()
+	role, followers, minCommitFollowers := r.role, r.followers, r.minCommitFollowers
+	r.peersLock.RUnlock()
+
+	if role != proto.Leader {
+		cr = &commitResult{err: kt.ErrNotLeader}
+		return
+	}
+
 	// create leader log
 	var (
 		l       *kt.Log
 		logData []byte
-		cr      = &commitResult{}
 		err     error
 	)
 
@@ -152,6 +161,8 @@ func (r *Runtime) leaderDoCommit(req *commitReq) {
 
 	req.tm.Add("write_wal")
 
+	cr = &commitResult{}
+
 	// not wrapping underlying handler commit error
 	cr.result, err = r.doCommit(req.ctx, req.data, true)
 
@@ -161,7 +172,7 @@ func (r *Runtime) leaderDoCommit(req *commitReq) {
 	atomic.StoreUint64(&r.lastCommit, l.Index)
 
 	// send commit
-	cr.rpc = r.applyRPC(l, r.minCommitFollowers)
+	cr.rpc = r.applyRPC(l, followers, minCommitFollowers)
 	cr.index = l.Index
 	cr.err = err
 
@@ -169,19 +180,25 @@ func (r *Runtime) leaderDoCommit(req *commitReq) {
 
 	// TODO(): mark uncommitted nodes and remove from peers
 
-	req.result.Set(cr)
-
 	req.tm.Add("send_follower_commit")
 
+	r.maybeSnapshot(req.ctx, l.Index, req)
+
 	return
 }
 
-func (r *Runtime) followerDoCommit(req *commitReq) {
+func (r *Runtime) followerDoCommit(req *commitReq) (cr *commitResult) {
 	if req.log == nil {
 		log.Fatal("NO LOG FOR FOLLOWER COMMIT")
 		return
 	}
 
+	if r.isCompacted(req.log.Index) {
+		// already covered by installed snapshot
+		cr = &commitResult{}
+		return
+	}
+
 	waitCommitTask := trace.StartRegion(req.ctx, "waitForLastCommit")
 
 	// check for last commit availability
@@ -218,9 +235,11 @@ func (r *Runtime) followerDoCommit(req *commitReq) {
 	// mark last commit
 	atomic.StoreUint64(&r.lastCommit, req.log.Index)
 
-	req.result.Set(&commitResult{
+	cr = &commitResult{
 		err: err,
-	})
+	}
+
+	r.maybeSnapshot(req.ctx, req.log.Index, req)
 
 	return
 }
@@ -245,7 +264,10 @@ func (r *Runtime) getPrepareLog(ctx context.Context, l *kt.Log) (lastCommitIndex
 	if len(l.Data) >= 16 {
 		lastCommitIndex, _ = r.bytesToUint64(l.Data[8:])
 
-		if _, err = r.waitForLog(ctx, lastCommitIndex); err != nil {
+		if _, err = r.waitForLog(ctx, lastCommitIndex); errors.Cause(err) == kt.ErrLogCompacted {
+			// last commit is covered by snapshot
+			err = nil
+		} else if err != nil {
 			err = errors.Wrap(err, "wait for last commit log failed")
 			return
 		}
@@ -255,13 +277,30 @@ func (r *Runtime) getPrepareLog(ctx context.Context, l *kt.Log) (lastCommitIndex
 }
 
 func (r *Runtime) doCommitCycle(req *commitReq) {
-	r.peersLock.RLock()
-	defer r.peersLock.RUnlock()
+	cr := func() *commitResult {
+		r.commitLock.Lock()
+		defer r.commitLock.Unlock()
+
+		if req.log == nil {
+			defer trace.StartRegion(req.ctx, "commitCycle").End()
+			return r.leaderDoCommit(req)
+		}
+
+		return r.followerDoCommit(req)
+	}()
 
-	if r.role == proto.Leader {
-		defer trace.StartRegion(req.ctx, "commitCycle").End()
-		r.leaderDoCommit(req)
-	} else {
-		r.followerDoCommit(req)
+	if cr == nil {
+		// re-queued or failed to write log
+		return
+	}
+
+	// committed membership change takes effect before the following logs are committed, the
+	// peers are applied after the commit lock is released as snapshots read peers under it
+	if peers, ok := req.data.(*proto.Peers); ok && cr.err == nil {
+		if err := r.commitPeers(peers); req.log == nil {
+			cr.err = err
+		}
 	}
+
+	req.result.Set(cr)
 }
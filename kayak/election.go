@@ -0,0 +1,544 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	kt "github.com/CovenantSQL/CovenantSQL/kayak/types"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	"github.com/CovenantSQL/CovenantSQL/utils/timer"
+	"github.com/pkg/errors"
+)
+
+// Leader election overview:
+//
+// Leader sends heartbeats carrying the current peers to all followers every heartbeat interval.
+// A follower which does not hear from the leader for a randomized election timeout, increases
+// the peers term and requests votes from all other servers. A server grants at most one vote
+// per term, which is persisted in wal before granted, and only if it also lost contact with the
+// leader and the candidate has committed at least as many logs as itself. The candidate which
+// collects votes from a majority of servers signs and publishes the new peers with itself as
+// leader, followers learn the new peers from heartbeats sent and signed by the new leader. The
+// granted votes are signed by the voters and carried in heartbeats, a follower accepts the peers
+// of a new term only if the votes of a quorum of the current servers back the new leader, and the
+// servers are unchanged since membership is only changed through LogConfig logs.
+//
+// With election enabled, a commit is returned only after it reaches a majority of servers, so
+// that the elected leader has every returned commit. The pending prepares of the previous leader
+// are never returned as committed, and they are rolled back by the new leader.
+
+// Vote defines entry for leader election vote requests.
+func (r *Runtime) Vote(ctx context.Context, req *kt.VoteRequest) (
+	granted bool, nextIndex uint64, signature *asymmetric.Signature, err error,
+) {
+	if atomic.LoadUint32(&r.started) != 1 {
+		err = kt.ErrStopped
+		return
+	}
+
+	if req == nil {
+		err = errors.Wrap(kt.ErrInvalidConfig, "nil vote request")
+		return
+	}
+
+	defer func() {
+		log.WithFields(log.Fields{
+			"instance":  r.instanceID,
+			"term":      req.Term,
+			"candidate": req.Candidate,
+			"granted":   granted,
+		}).WithError(err).Debug("kayak vote")
+	}()
+
+	if r.electionTimeout <= 0 {
+		err = errors.Wrap(kt.ErrInvalidConfig, "election disabled")
+		return
+	}
+
+	// the sender is authenticated by the rpc session, the candidate must be the sender itself
+	candidate := req.GetNodeID().ToNodeID()
+	if !candidate.IsEqual(&req.Candidate) {
+		err = errors.Wrapf(kt.ErrInvalidSender, "vote for candidate %v requested by %v", req.Candidate, candidate)
+		return
+	}
+
+	r.peersLock.Lock()
+	defer r.peersLock.Unlock()
+
+	if _, found := r.peers.Find(candidate); !found {
+		err = errors.Wrapf(kt.ErrNotInPeer, "candidate %v not in peers", candidate)
+		return
+	}
+
+	nextIndex = r.getNextIndex()
+
+	switch {
+	case req.Term <= r.peers.Term || req.Term < r.votedTerm:
+		// outdated candidate
+	case req.Term == r.votedTerm:
+		// already voted, grant again only for the retries of the same candidate
+		granted = r.votedFor.IsEqual(&candidate)
+	case r.role == proto.Leader:
+		// leader is still alive
+	case r.leaderSilence() < r.electionTimeout:
+		// leader is still alive in the view of this node
+	case req.LastCommit < atomic.LoadUint64(&r.lastCommit):
+		// candidate is lagging behind
+	default:
+		if err = r.saveVote(req.Term, candidate); err != nil {
+			return
+		}
+		granted = true
+	}
+
+	if granted {
+		// the signed vote proves the election of candidate to the other servers
+		if signature, err = r.signVote(req.Term, candidate); err != nil {
+			granted = false
+		}
+	}
+
+	return
+}
+
+// Heartbeat defines entry for leader heartbeat requests.
+func (r *Runtime) Heartbeat(ctx context.Context, req *kt.HeartbeatRequest) (err error) {
+	if atomic.LoadUint32(&r.started) != 1 {
+		err = kt.ErrStopped
+		return
+	}
+
+	if r.electionTimeout <= 0 {
+		err = errors.Wrap(kt.ErrInvalidConfig, "election disabled")
+		return
+	}
+
+	if req == nil || req.Peers == nil {
+		err = errors.Wrap(kt.ErrInvalidConfig, "nil peers")
+		return
+	}
+
+	// the sender is authenticated by the rpc session, only the leader sends heartbeats
+	peers := req.Peers
+	sender := req.GetNodeID().ToNodeID()
+	if !sender.IsEqual(&peers.Leader) {
+		err = errors.Wrapf(kt.ErrInvalidSender, "heartbeat of leader %v sent by %v", peers.Leader, sender)
+		return
+	}
+
+	r.peersLock.RLock()
+	current := r.peers
+	r.peersLock.RUnlock()
+
+	if peers.Term < current.Term {
+		err = errors.Wrapf(kt.ErrStaleTerm, "current term: %v, supplied term: %v", current.Term, peers.Term)
+		return
+	} else if peers.Term == current.Term {
+		if !peers.Leader.IsEqual(&current.Leader) {
+			err = errors.Wrapf(kt.ErrStaleTerm, "conflicted leader %v in term %v", peers.Leader, peers.Term)
+			return
+		}
+
+		r.touchLeaderContact()
+		return
+	}
+
+	// elected leader of a new term
+	if err = r.verifyElectedPeers(current, peers, req.Votes); err != nil {
+		return
+	}
+
+	r.touchLeaderContact()
+
+	return r.publishPeers(peers)
+}
+
+// verifyLeaderPeers verifies the peers are signed by the registered key of the leader.
+func (r *Runtime) verifyLeaderPeers(peers *proto.Peers) (err error) {
+	if err = peers.Verify(); err != nil {
+		err = errors.Wrap(err, "verify peers failed")
+		return
+	}
+
+	var key *asymmetric.PublicKey
+	if key, err = r.nodeKey(peers.Leader); err != nil {
+		err = errors.Wrapf(err, "get public key of leader %v failed", peers.Leader)
+		return
+	}
+
+	if !key.IsEqual(peers.Signee) {
+		err = errors.Wrapf(kt.ErrUntrustedPeers, "peers of term %v not signed by leader %v", peers.Term, peers.Leader)
+	}
+
+	return
+}
+
+// verifyElectedPeers verifies the peers of a new term are signed by the leader, and the leader is
+// elected by a quorum of the current servers without membership changes.
+func (r *Runtime) verifyElectedPeers(current, peers *proto.Peers, votes []*kt.GrantedVote) (err error) {
+	if err = r.verifyLeaderPeers(peers); err != nil {
+		return
+	}
+
+	if _, found := current.Find(peers.Leader); !found {
+		err = errors.Wrapf(kt.ErrNotInPeer, "leader %v of term %v not in peers", peers.Leader, peers.Term)
+		return
+	}
+
+	if !sameServers(current.Servers, peers.Servers) {
+		err = errors.Wrapf(kt.ErrInvalidPeersChange, "servers changed in term %v", peers.Term)
+		return
+	}
+
+	var (
+		h       = kt.VoteHash(r.instanceID, peers.Term, peers.Leader)
+		quorum  = len(current.Servers)/2 + 1
+		granted = make(map[proto.NodeID]bool)
+	)
+	for _, v := range votes {
+		if v == nil || v.Signature == nil || granted[v.Voter] {
+			continue
+		}
+		if _, found := current.Find(v.Voter); !found {
+			continue
+		}
+		key, kerr := r.nodeKey(v.Voter)
+		if kerr != nil || !v.Signature.Verify(h[:], key) {
+			continue
+		}
+		granted[v.Voter] = true
+	}
+
+	if len(granted) < quorum {
+		err = errors.Wrapf(kt.ErrUntrustedPeers, "term %v backed by %v votes, quorum: %v",
+			peers.Term, len(granted), quorum)
+	}
+
+	return
+}
+
+// signVote signs the vote of term granted to candidate.
+func (r *Runtime) signVote(term uint64, candidate proto.NodeID) (signature *asymmetric.Signature, err error) {
+	h := kt.VoteHash(r.instanceID, term, candidate)
+	if signature, err = r.privKey.Sign(h[:]); err != nil {
+		err = errors.Wrap(err, "sign vote failed")
+	}
+	return
+}
+
+// sameServers reports whether the two server lists have the same members.
+func sameServers(a, b []proto.NodeID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	members := make(map[proto.NodeID]int, len(a))
+	for _, s := range a {
+		members[s]++
+	}
+	for _, s := range b {
+		if members[s] == 0 {
+			return false
+		}
+		members[s]--
+	}
+	return true
+}
+
+// saveVote persists the vote before it's granted, must be called with peersLock held.
+func (r *Runtime) saveVote(term uint64, candidate proto.NodeID) (err error) {
+	if err = r.wal.(kt.ElectionWal).SaveVote(&kt.Vote{Term: term, Candidate: candidate}); err != nil {
+		err = errors.Wrap(err, "save vote failed")
+		return
+	}
+
+	r.votedTerm, r.votedFor = term, candidate
+	return
+}
+
+func (r *Runtime) electionCycle() {
+	interval := r.heartbeatInterval
+	if interval <= 0 {
+		interval = r.electionTimeout / 3
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		timeout = r.randomElectionTimeout()
+		// next election is not started before retryAt, in case of split votes
+		retryAt time.Time
+	)
+
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		r.peersLock.RLock()
+		role := r.role
+		r.peersLock.RUnlock()
+
+		if role == proto.Leader {
+			r.sendHeartbeats()
+			continue
+		}
+
+		if r.leaderSilence() < timeout || time.Now().Before(retryAt) {
+			continue
+		}
+
+		if err := r.elect(); err != nil {
+			log.WithField("instance", r.instanceID).WithError(err).Warning("kayak leader election failed")
+		}
+
+		timeout = r.randomElectionTimeout()
+		retryAt = time.Now().Add(timeout)
+	}
+}
+
+func (r *Runtime) sendHeartbeats() {
+	r.peersLock.RLock()
+	req := &kt.HeartbeatRequest{
+		Instance: r.instanceID,
+		Peers:    r.peers,
+		Votes:    r.electedVotes,
+	}
+	nodes := append([]proto.NodeID(nil), r.followers...)
+	r.peersLock.RUnlock()
+
+	var wg sync.WaitGroup
+
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node proto.NodeID) {
+			defer wg.Done()
+			if err := r.getCaller(node).Call(r.heartbeatRPCMethod, req, nil); err != nil {
+				log.WithFields(log.Fields{
+					"instance": r.instanceID,
+					"node":     node,
+				}).WithError(err).Debug("send heartbeat failed")
+			}
+		}(node)
+	}
+
+	wg.Wait()
+}
+
+func (r *Runtime) elect() (err error) {
+	r.peersLock.Lock()
+
+	if r.role == proto.Leader {
+		r.peersLock.Unlock()
+		return
+	}
+
+	term := r.peers.Term
+	if r.votedTerm > term {
+		term = r.votedTerm
+	}
+	term++
+
+	// vote for self
+	if err = r.saveVote(term, r.nodeID); err != nil {
+		r.peersLock.Unlock()
+		return
+	}
+	peers := r.peers
+
+	r.peersLock.Unlock()
+
+	req := &kt.VoteRequest{
+		Instance:   r.instanceID,
+		Term:       term,
+		Candidate:  r.nodeID,
+		LastCommit: atomic.LoadUint64(&r.lastCommit),
+	}
+
+	type voteResult struct {
+		node proto.NodeID
+		resp *kt.VoteResponse
+	}
+
+	var (
+		quorum    = len(peers.Servers)/2 + 1
+		nextIndex = r.getNextIndex()
+		respCh    = make(chan voteResult, len(peers.Servers))
+		votes     = make([]*kt.GrantedVote, 1, quorum)
+		h         = kt.VoteHash(r.instanceID, term, r.nodeID)
+	)
+
+	if votes[0], err = r.selfVote(term); err != nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"instance": r.instanceID,
+		"term":     term,
+	}).Info("kayak leader lost, start election")
+
+	for _, node := range peers.Servers {
+		if node.IsEqual(&r.nodeID) {
+			continue
+		}
+
+		go func(node proto.NodeID) {
+			resp := &kt.VoteResponse{}
+			if err := r.getCaller(node).Call(r.voteRPCMethod, req, resp); err != nil {
+				log.WithFields(log.Fields{
+					"instance": r.instanceID,
+					"node":     node,
+				}).WithError(err).Debug("request vote failed")
+				resp = nil
+			}
+			respCh <- voteResult{node: node, resp: resp}
+		}(node)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.electionTimeout)
+	defer cancel()
+
+collectLoop:
+	for i := 1; i < len(peers.Servers) && len(votes) < quorum; i++ {
+		select {
+		case <-ctx.Done():
+			break collectLoop
+		case res := <-respCh:
+			if res.resp == nil || !res.resp.Granted || !r.verifyVote(res.node, h, res.resp.Signature) {
+				continue
+			}
+			votes = append(votes, &kt.GrantedVote{Voter: res.node, Signature: res.resp.Signature})
+			if res.resp.NextIndex > nextIndex {
+				nextIndex = res.resp.NextIndex
+			}
+		}
+	}
+
+	if len(votes) < quorum {
+		err = errors.Wrapf(kt.ErrElectionFailed, "term: %v, votes: %v, quorum: %v", term, len(votes), quorum)
+		return
+	}
+
+	// skip log indexes allocated by the previous leader
+	r.nextIndexLock.Lock()
+	if r.nextIndex < nextIndex {
+		r.nextIndex = nextIndex
+	}
+	r.nextIndexLock.Unlock()
+
+	newPeers := peers.Clone()
+	newPeers.Version++
+	newPeers.Term = term
+	newPeers.Leader = r.nodeID
+	if err = newPeers.Sign(r.privKey); err != nil {
+		err = errors.Wrap(err, "sign peers of elected term failed")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"instance": r.instanceID,
+		"term":     term,
+		"votes":    len(votes),
+	}).Info("kayak leader elected")
+
+	r.peersLock.Lock()
+	r.electedVotes = votes
+	r.peersLock.Unlock()
+
+	return r.publishPeers(&newPeers)
+}
+
+// selfVote returns the signed vote of term granted to this node by itself.
+func (r *Runtime) selfVote(term uint64) (vote *kt.GrantedVote, err error) {
+	vote = &kt.GrantedVote{Voter: r.nodeID}
+	vote.Signature, err = r.signVote(term, r.nodeID)
+	return
+}
+
+// verifyVote verifies the vote signature against the registered key of voter.
+func (r *Runtime) verifyVote(voter proto.NodeID, h hash.Hash, signature *asymmetric.Signature) bool {
+	if signature == nil {
+		return false
+	}
+	key, err := r.nodeKey(voter)
+	return err == nil && signature.Verify(h[:], key)
+}
+
+func (r *Runtime) publishPeers(peers *proto.Peers) (err error) {
+	if r.onPeersChange != nil {
+		return r.onPeersChange(peers)
+	}
+
+	return r.applyPeers(peers)
+}
+
+func (r *Runtime) rollbackPendingPrepares() {
+	r.pendingPreparesLock.RLock()
+	indexes := make([]uint64, 0, len(r.pendingPrepares))
+	for i := range r.pendingPrepares {
+		indexes = append(indexes, i)
+	}
+	r.pendingPreparesLock.RUnlock()
+
+	if len(indexes) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	tm := timer.NewTimer()
+
+	r.peersLock.RLock()
+	defer r.peersLock.RUnlock()
+
+	for _, i := range indexes {
+		r.doLeaderRollback(ctx, tm, &kt.Log{LogHeader: kt.LogHeader{Index: i}})
+		r.markPrepareFinished(ctx, i)
+	}
+
+	log.WithFields(log.Fields{
+		"instance": r.instanceID,
+		"count":    len(indexes),
+	}).Info("rollback pending prepares of previous leader")
+}
+
+func (r *Runtime) getNextIndex() uint64 {
+	r.nextIndexLock.Lock()
+	defer r.nextIndexLock.Unlock()
+	return r.nextIndex
+}
+
+func (r *Runtime) touchLeaderContact() {
+	atomic.StoreInt64(&r.lastLeaderContact, time.Now().UnixNano())
+}
+
+func (r *Runtime) leaderSilence() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&r.lastLeaderContact)))
+}
+
+func (r *Runtime) randomElectionTimeout() time.Duration {
+	return r.electionTimeout + time.Duration(rand.Int63n(int64(r.electionTimeout)))
+}
@@ -17,6 +17,8 @@
 package kayak
 
 import (
+	"context"
+
 	kt "github.com/CovenantSQL/CovenantSQL/kayak/types"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
 )
@@ -47,13 +49,13 @@ func (r *Runtime) missingLogCycle() {
 
 		// execute
 		func() {
-			r.peersLock.RLock()
-			defer r.peersLock.RUnlock()
-
 			if waitItem == nil {
 				return
 			}
 
+			// fetched logs are applied without peers lock, commits wait for the commit cycle
+			leader := r.Peers().Leader
+
 			waitItem.waitLock.Lock()
 			defer waitItem.waitLock.Unlock()
 
@@ -77,7 +79,7 @@ func (r *Runtime) missingLogCycle() {
 				return
 			}
 
-			if err = r.getCaller(r.peers.Leader).Call(r.fetchRPCMethod, req, resp); err != nil {
+			if err = r.getCaller(leader).Call(r.fetchRPCMethod, req, resp); err != nil {
 				log.WithFields(log.Fields{
 					"index":    waitItem.index,
 					"instance": r.instanceID,
@@ -85,6 +87,18 @@ func (r *Runtime) missingLogCycle() {
 				return
 			}
 
+			// install snapshot if the log is already compacted in leader
+			if resp.Snapshot != nil {
+				if err = r.installSnapshot(context.Background(), resp.Snapshot, leader); err != nil {
+					log.WithFields(log.Fields{
+						"index":    waitItem.index,
+						"snapshot": resp.Snapshot.Index,
+						"instance": r.instanceID,
+					}).WithError(err).Warning("install snapshot failed")
+				}
+				return
+			}
+
 			// call follower apply
 			if resp.Log != nil {
 				if err = r.FollowerApply(resp.Log); err != nil {
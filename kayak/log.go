@@ -19,9 +19,10 @@ package kayak
 import (
 	"context"
 	"io"
-	"log"
 
 	kt "github.com/CovenantSQL/CovenantSQL/kayak/types"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
 	"github.com/CovenantSQL/CovenantSQL/utils/trace"
 	"github.com/pkg/errors"
 )
@@ -63,7 +64,22 @@ func (r *Runtime) writeWAL(ctx context.Context, l *kt.Log) (err error) {
 
 func (r *Runtime) readLogs() (err error) {
 	// load logs, only called during init
-	var l *kt.Log
+	var (
+		l *kt.Log
+		s *kt.Snapshot
+		// peers of the latest committed membership change
+		peers *proto.Peers
+	)
+
+	// restore indexes from snapshot
+	if s, err = r.loadSnapshot(); err != nil {
+		return
+	} else if s != nil {
+		r.snapshotIndex = s.Index
+		r.lastCommit = s.Index
+		r.updateNextIndex(context.Background(), &kt.Log{LogHeader: kt.LogHeader{Index: s.Index}})
+		peers = s.Peers
+	}
 
 	for {
 		if l, err = r.wal.Read(); err != nil && err != io.EOF {
@@ -74,8 +90,20 @@ func (r *Runtime) readLogs() (err error) {
 			break
 		}
 
+		if r.isCompacted(l.Index) && (l.Type == kt.LogCommit || l.Type == kt.LogRollback) {
+			// already covered by snapshot, just resolve previous prepared
+			var prepareIndex uint64
+			if prepareIndex, err = r.bytesToUint64(l.Data); err != nil {
+				err = errors.Wrap(err, "log does not contain valid prepare index")
+				return
+			}
+			delete(r.pendingPrepares, prepareIndex)
+			r.updateNextIndex(context.Background(), l)
+			continue
+		}
+
 		switch l.Type {
-		case kt.LogPrepare:
+		case kt.LogPrepare, kt.LogConfig:
 			// record in pending prepares
 			r.pendingPrepares[l.Index] = true
 		case kt.LogCommit:
@@ -98,6 +126,14 @@ func (r *Runtime) readLogs() (err error) {
 			r.lastCommit = l.Index
 			// resolve previous prepared
 			delete(r.pendingPrepares, prepareLog.Index)
+			// record committed membership change
+			if prepareLog.Type == kt.LogConfig {
+				var req interface{}
+				if req, err = r.decodeLogPayload(context.Background(), prepareLog); err != nil {
+					return
+				}
+				peers = req.(*proto.Peers)
+			}
 		case kt.LogRollback:
 			var prepareLog *kt.Log
 			if _, prepareLog, err = r.getPrepareLog(context.Background(), l); err != nil {
@@ -119,5 +155,34 @@ func (r *Runtime) readLogs() (err error) {
 		r.updateNextIndex(context.Background(), l)
 	}
 
+	// peers in config may miss the membership change committed before the node stopped
+	if peers != nil && isNewerPeers(peers, r.peers) {
+		err = r.reloadPeers(peers)
+	}
+
+	return
+}
+
+// reloadPeers re-applies the committed peers recovered from wal, only called during init.
+func (r *Runtime) reloadPeers(peers *proto.Peers) (err error) {
+	followers, role, err := resolvePeers(peers, r.nodeID)
+	if err != nil {
+		err = errors.Wrap(err, "resolve committed peers in wal failed")
+		return
+	}
+
+	r.peers = peers
+	r.followers = followers
+	r.role = role
+	r.minPreparedFollowers, r.minCommitFollowers = calcMinFollowers(
+		peers, r.prepareThreshold, r.commitThreshold, r.electionTimeout > 0)
+
+	log.WithFields(log.Fields{
+		"instance": r.instanceID,
+		"term":     peers.Term,
+		"version":  peers.Version,
+		"role":     role.String(),
+	}).Info("kayak committed peers reloaded")
+
 	return
 }
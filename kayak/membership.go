@@ -0,0 +1,354 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+
+	kt "github.com/CovenantSQL/CovenantSQL/kayak/types"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	"github.com/CovenantSQL/CovenantSQL/utils/timer"
+	"github.com/CovenantSQL/CovenantSQL/utils/trace"
+	"github.com/pkg/errors"
+)
+
+// Membership change overview:
+//
+// Peers are changed by the leader one server at a time, so the majorities of the old and the new
+// peers always overlap. A new member is synced to the head of the leader logs before the change,
+// and it does not count toward quorum until the change is committed. The change is written as a
+// LogConfig prepare log carrying the new peers through the normal prepare/commit path, the commit
+// cycle applies the new peers once the config log is committed and before the following logs are
+// committed. Committed peers are re-applied from the wal and snapshot on reload.
+
+const (
+	// max log count sent in a single sync request.
+	syncBatchSize = 100
+)
+
+// ChangePeers defines entry for membership change in leader node, exactly one server could be
+// added to or removed from the current peers in each change.
+func (r *Runtime) ChangePeers(ctx context.Context, peers *proto.Peers) (logIndex uint64, err error) {
+	if atomic.LoadUint32(&r.started) != 1 {
+		err = kt.ErrStopped
+		return
+	}
+
+	if peers == nil {
+		err = errors.Wrap(kt.ErrInvalidConfig, "nil peers")
+		return
+	}
+
+	if err = peers.Verify(); err != nil {
+		err = errors.Wrap(err, "verify peers during kayak membership change failed")
+		return
+	}
+
+	ctx, task := trace.NewTask(ctx, "Kayak.ChangePeers")
+	defer task.End()
+
+	defer func() {
+		log.WithFields(log.Fields{
+			"instance": r.instanceID,
+			"version":  peers.Version,
+			"servers":  peers.Servers,
+			"r":        logIndex,
+		}).WithError(err).Info("kayak membership change")
+	}()
+
+	current := r.Peers()
+
+	var added proto.NodeID
+	if added, err = checkPeersChange(current, peers, r.nodeID); err != nil {
+		return
+	}
+
+	if added != "" {
+		// new member syncs to the head before counting toward quorum
+		if err = r.syncPeer(ctx, added); err != nil {
+			err = errors.Wrapf(err, "sync new member %v failed", added)
+			return
+		}
+	}
+
+	logIndex, err = r.applyPeersChange(ctx, current, peers)
+
+	return
+}
+
+// Sync defines entry for new member to catch up with leader logs before joining the peers.
+func (r *Runtime) Sync(ctx context.Context, req *kt.SyncRequest) (lastCommit uint64, nextIndex uint64, err error) {
+	if atomic.LoadUint32(&r.started) != 1 {
+		err = kt.ErrStopped
+		return
+	}
+
+	if req == nil {
+		err = errors.Wrap(kt.ErrInvalidConfig, "nil sync request")
+		return
+	}
+
+	// only the leader syncs logs and snapshot to members
+	sender := req.GetNodeID().ToNodeID()
+	if leader := r.Peers().Leader; !sender.IsEqual(&leader) {
+		err = errors.Wrapf(kt.ErrInvalidSender, "sync from %v, current leader: %v", sender, leader)
+		return
+	}
+
+	r.touchLeaderContact()
+
+	if req.Snapshot != nil {
+		if err = r.installSnapshot(ctx, req.Snapshot, sender); err != nil {
+			return
+		}
+	}
+
+	for _, l := range req.Logs {
+		if r.isCompacted(l.Index) {
+			continue
+		}
+		if _, getErr := r.wal.Get(l.Index); getErr == nil {
+			// already synced
+			continue
+		}
+		if err = r.FollowerApply(l); err != nil {
+			err = errors.Wrapf(err, "apply synced log %d failed", l.Index)
+			return
+		}
+	}
+
+	lastCommit = atomic.LoadUint64(&r.lastCommit)
+	nextIndex = r.getNextIndex()
+
+	return
+}
+
+func (r *Runtime) applyPeersChange(ctx context.Context, current *proto.Peers, peers *proto.Peers) (
+	logIndex uint64, err error) {
+	tm := timer.NewTimer()
+
+	var encBuf *bytes.Buffer
+	if encBuf, err = utils.EncodeMsgPack(peers); err != nil {
+		err = errors.Wrap(err, "encode peers failed")
+		return
+	}
+
+	r.peersLock.RLock()
+
+	tm.Add("peers_lock")
+
+	if r.role != proto.Leader {
+		r.peersLock.RUnlock()
+		err = kt.ErrNotLeader
+		return
+	}
+
+	if r.peers != current {
+		r.peersLock.RUnlock()
+		err = errors.Wrap(kt.ErrInvalidPeersChange, "peers changed during membership change")
+		return
+	}
+
+	// prepare
+	prepareLog, err := r.doLeaderReplicate(ctx, tm, kt.LogConfig, encBuf.Bytes())
+
+	if prepareLog != nil {
+		defer r.markPrepareFinished(ctx, prepareLog.Index)
+	}
+
+	if err == nil {
+		// the commit cycle applies the peers, peers lock is not held while waiting for the commit
+		r.peersLock.RUnlock()
+		// commit
+		_, logIndex, err = r.doLeaderCommit(ctx, tm, prepareLog, peers)
+		return
+	}
+
+	// rollback
+	if prepareLog != nil {
+		r.doLeaderRollback(ctx, tm, prepareLog)
+	}
+
+	r.peersLock.RUnlock()
+
+	return
+}
+
+// commitPeers applies peers of a committed membership change,
+// stale peers replayed from old logs are ignored.
+func (r *Runtime) commitPeers(peers *proto.Peers) (err error) {
+	if !isNewerPeers(peers, r.Peers()) {
+		return
+	}
+
+	if err = r.applyPeers(peers); err != nil {
+		log.WithFields(log.Fields{
+			"instance": r.instanceID,
+			"version":  peers.Version,
+		}).WithError(err).Warning("apply committed peers failed")
+		return
+	}
+
+	if r.onPeersChange != nil {
+		err = r.onPeersChange(peers)
+	}
+
+	return
+}
+
+// syncPeer sends snapshot and logs to the new member until it reaches the head of leader logs.
+func (r *Runtime) syncPeer(ctx context.Context, node proto.NodeID) (err error) {
+	var (
+		caller   = r.getCaller(node)
+		req      = &kt.SyncRequest{Instance: r.instanceID}
+		lastNext uint64
+	)
+
+	for round := 0; ; round++ {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		default:
+		}
+
+		resp := &kt.SyncResponse{}
+		if err = caller.Call(r.syncRPCMethod, req, resp); err != nil {
+			return
+		}
+
+		if round > 0 && resp.NextIndex <= lastNext {
+			err = errors.Wrapf(kt.ErrInvalidPeersChange, "sync stalled at log %d", resp.NextIndex)
+			return
+		}
+		lastNext = resp.NextIndex
+
+		head := r.getNextIndex()
+		if resp.NextIndex >= head {
+			break
+		}
+
+		from := resp.NextIndex
+		req = &kt.SyncRequest{Instance: r.instanceID}
+
+		if r.isCompacted(from) {
+			if req.Snapshot, err = r.loadSnapshot(); err != nil {
+				return
+			} else if req.Snapshot != nil {
+				from = req.Snapshot.Index + 1
+			}
+		}
+
+		for i := from; i < head && len(req.Logs) < syncBatchSize; i++ {
+			var l *kt.Log
+			if l, err = r.wal.Get(i); err != nil {
+				// log index skipped by leader election
+				err = nil
+				continue
+			}
+			req.Logs = append(req.Logs, l)
+		}
+
+		if req.Snapshot == nil && len(req.Logs) == 0 {
+			break
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"instance": r.instanceID,
+		"node":     node,
+		"next":     lastNext,
+	}).Info("new member synced")
+
+	return
+}
+
+// decodeLogPayload decodes the prepare log payload, config logs carry peers instead of handler payload.
+func (r *Runtime) decodeLogPayload(ctx context.Context, l *kt.Log) (req interface{}, err error) {
+	if l.Type != kt.LogConfig {
+		return r.doDecodePayload(ctx, l.Data)
+	}
+
+	peers := &proto.Peers{}
+	if err = utils.DecodeMsgPack(l.Data, peers); err != nil {
+		err = errors.Wrap(err, "decode peers failed")
+		return
+	}
+
+	if err = peers.Verify(); err != nil {
+		err = errors.Wrap(err, "verify peers in config log failed")
+		return
+	}
+
+	req = peers
+
+	return
+}
+
+// isNewerPeers reports whether peers is a later membership than current.
+func isNewerPeers(peers *proto.Peers, current *proto.Peers) bool {
+	return peers.Term > current.Term || (peers.Term == current.Term && peers.Version > current.Version)
+}
+
+// checkPeersChange validates single-step membership change and returns the added server if any.
+func checkPeersChange(current *proto.Peers, peers *proto.Peers, nodeID proto.NodeID) (added proto.NodeID, err error) {
+	switch {
+	case !current.Leader.IsEqual(&nodeID):
+		err = kt.ErrNotLeader
+		return
+	case !peers.Leader.IsEqual(&current.Leader):
+		err = errors.Wrap(kt.ErrInvalidPeersChange, "leader could not be changed in membership change")
+		return
+	case peers.Term != current.Term:
+		err = errors.Wrapf(kt.ErrInvalidPeersChange, "term mismatched, current: %v, supplied: %v",
+			current.Term, peers.Term)
+		return
+	case peers.Version <= current.Version:
+		err = errors.Wrapf(kt.ErrInvalidPeersChange, "version not increased, current: %v, supplied: %v",
+			current.Version, peers.Version)
+		return
+	}
+
+	var changes int
+
+	for _, s := range peers.Servers {
+		if _, found := current.Find(s); !found {
+			added = s
+			changes++
+		}
+	}
+
+	for _, s := range current.Servers {
+		if _, found := peers.Find(s); !found {
+			if s.IsEqual(&current.Leader) {
+				err = errors.Wrap(kt.ErrInvalidPeersChange, "leader could not be removed")
+				return
+			}
+			changes++
+		}
+	}
+
+	if changes != 1 {
+		err = errors.Wrapf(kt.ErrInvalidPeersChange, "exactly one server change is allowed, got %v", changes)
+	}
+
+	return
+}
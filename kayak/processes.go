@@ -46,8 +46,13 @@ func (r *Runtime) doLeaderPrepare(ctx context.Context, tm *timer.Timer, req inte
 
 	tm.Add("leader_encode_payload")
 
+	return r.doLeaderReplicate(ctx, tm, kt.LogPrepare, encBuf)
+}
+
+func (r *Runtime) doLeaderReplicate(ctx context.Context, tm *timer.Timer, logType kt.LogType, data []byte) (
+	prepareLog *kt.Log, err error) {
 	// create prepare request
-	if prepareLog, err = r.leaderLogPrepare(ctx, tm, encBuf); err != nil {
+	if prepareLog, err = r.leaderLogPrepare(ctx, tm, logType, data); err != nil {
 		// serve error, leader could not write logs, change leader in block producer
 		// TODO(): CHANGE LEADER
 		return
@@ -59,7 +64,7 @@ func (r *Runtime) doLeaderPrepare(ctx context.Context, tm *timer.Timer, req inte
 	tm.Add("leader_prepare")
 
 	// send prepare to all nodes
-	prepareTracker := r.applyRPC(prepareLog, r.minPreparedFollowers)
+	prepareTracker := r.applyRPC(prepareLog, r.followers, r.minPreparedFollowers)
 	prepareCtx, prepareCtxCancelFunc := context.WithTimeout(ctx, r.prepareTimeout)
 	defer prepareCtxCancelFunc()
 	prepareErrors, prepareDone, _ := prepareTracker.get(prepareCtx)
@@ -112,16 +117,16 @@ func (r *Runtime) doLeaderRollback(ctx context.Context, tm *timer.Timer, prepare
 	defer trace.StartRegion(ctx, "followerRollback").End()
 
 	// async send rollback to all nodes
-	r.applyRPC(rollbackLog, 0)
+	r.applyRPC(rollbackLog, r.followers, 0)
 
 	tm.Add("follower_rollback")
 }
 
-func (r *Runtime) leaderLogPrepare(ctx context.Context, tm *timer.Timer, data []byte) (*kt.Log, error) {
+func (r *Runtime) leaderLogPrepare(ctx context.Context, tm *timer.Timer, logType kt.LogType, data []byte) (*kt.Log, error) {
 	defer trace.StartRegion(ctx, "leaderLogPrepare").End()
 	defer tm.Add("leader_log_prepare")
 	// just write new log
-	return r.newLog(ctx, kt.LogPrepare, data)
+	return r.newLog(ctx, logType, data)
 }
 
 func (r *Runtime) leaderLogRollback(ctx context.Context, tm *timer.Timer, i uint64) (*kt.Log, error) {
@@ -138,13 +143,15 @@ func (r *Runtime) followerPrepare(ctx context.Context, tm *timer.Timer, l *kt.Lo
 
 	// decode
 	var req interface{}
-	if req, err = r.doDecodePayload(ctx, l.Data); err != nil {
+	if req, err = r.decodeLogPayload(ctx, l); err != nil {
 		return
 	}
 	tm.Add("decode")
 
-	if err = r.doCheck(ctx, req); err != nil {
-		return
+	if l.Type != kt.LogConfig {
+		if err = r.doCheck(ctx, req); err != nil {
+			return
+		}
 	}
 	tm.Add("check")
 
@@ -182,7 +189,7 @@ func (r *Runtime) followerRollback(ctx context.Context, tm *timer.Timer, l *kt.L
 	}
 	tm.Add("write_wal")
 
-	r.markPrepareFinished(ctx, l.Index)
+	r.markPrepareFinished(ctx, prepareLog.Index)
 	tm.Add("mark")
 
 	return
@@ -217,7 +224,7 @@ func (r *Runtime) followerCommit(ctx context.Context, tm *timer.Timer, l *kt.Log
 		err = cResult.err
 	}
 
-	r.markPrepareFinished(ctx, l.Index)
+	r.markPrepareFinished(ctx, prepareLog.Index)
 	tm.Add("mark")
 
 	return
@@ -39,13 +39,13 @@ func (r *Runtime) errorSummary(errs map[proto.NodeID]error) error {
 }
 
 /// rpc related
-func (r *Runtime) applyRPC(l *kt.Log, minCount int) (tracker *rpcTracker) {
+func (r *Runtime) applyRPC(l *kt.Log, nodes []proto.NodeID, minCount int) (tracker *rpcTracker) {
 	req := &kt.ApplyRequest{
 		Instance: r.instanceID,
 		Log:      l,
 	}
 
-	tracker = newTracker(r, req, minCount)
+	tracker = newTracker(r, nodes, req, minCount)
 	tracker.send()
 
 	// TODO(): track this rpc
@@ -19,10 +19,12 @@ package kayak
 import (
 	"context"
 	"math"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
 	kt "github.com/CovenantSQL/CovenantSQL/kayak/types"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
@@ -86,6 +88,12 @@ type Runtime struct {
 	applyRPCMethod string
 	// rpc method for fetch requests.
 	fetchRPCMethod string
+	// rpc method for vote requests.
+	voteRPCMethod string
+	// rpc method for heartbeat requests.
+	heartbeatRPCMethod string
+	// rpc method for new member sync requests.
+	syncRPCMethod string
 
 	//// Parameters
 	// prepare threshold defines the minimum node count requirement for prepare operation.
@@ -104,6 +112,42 @@ type Runtime struct {
 	missingLogCh chan *waitItem
 	waitLogMap   sync.Map // map[uint64]*waitItem
 
+	/// Election related
+	// max leader silence before starting an election, election is disabled if not positive.
+	electionTimeout time.Duration
+	// leader heartbeat interval.
+	heartbeatInterval time.Duration
+	// last time in unix nano the leader is known to be alive.
+	lastLeaderContact int64
+	// last term this node voted for and the candidate it voted, guarded by peersLock.
+	votedTerm uint64
+	votedFor  proto.NodeID
+	// votes granted to this node in the term it's elected, sent with heartbeats, guarded by
+	// peersLock.
+	electedVotes []*kt.GrantedVote
+	// private key to sign the peers of elected terms.
+	privKey *asymmetric.PrivateKey
+	// returns the registered public key of node.
+	nodeKey func(node proto.NodeID) (*asymmetric.PublicKey, error)
+	// callback to publish peers changed by leader election.
+	onPeersChange func(peers *proto.Peers) error
+
+	/// Snapshot related
+	// commit log count between snapshots, snapshot is disabled if zero.
+	snapshotInterval uint64
+	// directory of the snapshot files.
+	snapshotDir string
+	// last commit log index covered by the latest snapshot.
+	snapshotIndex uint64
+	// set while a snapshot file is being written in background.
+	snapshotting uint32
+	// commit lock serializes commits and snapshot install.
+	commitLock sync.Mutex
+	// snapshot lock serializes the saving of snapshots taken in background and installed.
+	snapshotLock sync.Mutex
+	// install lock serializes the downloads and installs of snapshots from other nodes.
+	installLock sync.Mutex
+
 	/// Sub-routines management.
 	started uint32
 	stopCh  chan struct{}
@@ -181,33 +225,43 @@ func NewRuntime(cfg *kt.RuntimeConfig) (rt *Runtime, err error) {
 		return
 	}
 
-	followers := make([]proto.NodeID, 0, len(peers.Servers))
-	exists := false
-	var role proto.ServerRole
+	followers, role, err := resolvePeers(peers, cfg.NodeID)
+	if err != nil {
+		return
+	}
 
-	for _, v := range peers.Servers {
-		if !v.IsEqual(&peers.Leader) {
-			followers = append(followers, v)
+	// the vote must survive restarts and the peers of elected terms must be signed and verified
+	var vote *kt.Vote
+	if cfg.ElectionTimeout > 0 {
+		ew, ok := cfg.Wal.(kt.ElectionWal)
+		if !ok || cfg.PrivateKey == nil || cfg.NodeKey == nil {
+			err = errors.Wrap(kt.ErrInvalidConfig, "election requires vote wal, private key and node key")
+			return
 		}
-
-		if v.IsEqual(&cfg.NodeID) {
-			exists = true
-			if v.IsEqual(&peers.Leader) {
-				role = proto.Leader
-			} else {
-				role = proto.Follower
-			}
+		if vote, err = ew.LoadVote(); err != nil {
+			err = errors.Wrap(err, "load vote failed")
+			return
 		}
 	}
+	if vote == nil || vote.Term < peers.Term {
+		vote = &kt.Vote{Term: peers.Term}
+	}
 
-	if !exists {
-		err = errors.Wrapf(kt.ErrNotInPeer, "node %v not in peers %v", cfg.NodeID, peers)
-		return
+	// snapshot files are written off the commit path and transferred from the snapshot directory
+	if cfg.SnapshotInterval > 0 {
+		if cfg.SnapshotDir == "" {
+			err = errors.Wrap(kt.ErrInvalidConfig, "snapshot requires snapshot directory")
+			return
+		}
+		if err = os.MkdirAll(cfg.SnapshotDir, 0700); err != nil {
+			err = errors.Wrap(err, "create snapshot directory failed")
+			return
+		}
 	}
 
 	// calculate fan-out count according to threshold and peers info
-	minPreparedFollowers := int(math.Max(math.Ceil(cfg.PrepareThreshold*float64(len(peers.Servers))), 1) - 1)
-	minCommitFollowers := int(math.Max(math.Ceil(cfg.CommitThreshold*float64(len(peers.Servers))), 1) - 1)
+	minPreparedFollowers, minCommitFollowers := calcMinFollowers(
+		peers, cfg.PrepareThreshold, cfg.CommitThreshold, cfg.ElectionTimeout > 0)
 
 	rt = &Runtime{
 		// indexes
@@ -227,9 +281,12 @@ func NewRuntime(cfg *kt.RuntimeConfig) (rt *Runtime, err error) {
 		minCommitFollowers:   minCommitFollowers,
 
 		// rpc related
-		serviceName:    cfg.ServiceName,
-		applyRPCMethod: cfg.ServiceName + "." + cfg.ApplyMethodName,
-		fetchRPCMethod: cfg.ServiceName + "." + cfg.FetchMethodName,
+		serviceName:        cfg.ServiceName,
+		applyRPCMethod:     cfg.ServiceName + "." + cfg.ApplyMethodName,
+		fetchRPCMethod:     cfg.ServiceName + "." + cfg.FetchMethodName,
+		voteRPCMethod:      cfg.ServiceName + "." + cfg.VoteMethodName,
+		heartbeatRPCMethod: cfg.ServiceName + "." + cfg.HeartbeatMethodName,
+		syncRPCMethod:      cfg.ServiceName + "." + cfg.SyncMethodName,
 
 		// commits related
 		prepareThreshold: cfg.PrepareThreshold,
@@ -240,6 +297,20 @@ func NewRuntime(cfg *kt.RuntimeConfig) (rt *Runtime, err error) {
 		commitCh:         make(chan *commitReq, commitWindow),
 		missingLogCh:     make(chan *waitItem, missingLogWindow),
 
+		// election related
+		electionTimeout:   cfg.ElectionTimeout,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		lastLeaderContact: time.Now().UnixNano(),
+		votedTerm:         vote.Term,
+		votedFor:          vote.Candidate,
+		privKey:           cfg.PrivateKey,
+		nodeKey:           cfg.NodeKey,
+		onPeersChange:     cfg.OnPeersChange,
+
+		// snapshot related
+		snapshotInterval: cfg.SnapshotInterval,
+		snapshotDir:      cfg.SnapshotDir,
+
 		// stop coordinator
 		stopCh: make(chan struct{}),
 	}
@@ -264,6 +335,10 @@ func (r *Runtime) Start() (err error) {
 	for i := 0; i != missingLogConcurrency; i++ {
 		r.goFunc(r.missingLogCycle)
 	}
+	// start leader election worker
+	if r.electionTimeout > 0 {
+		r.goFunc(r.electionCycle)
+	}
 
 	return
 }
@@ -304,11 +379,11 @@ func (r *Runtime) Apply(ctx context.Context, req interface{}) (result interface{
 	}()
 
 	r.peersLock.RLock()
-	defer r.peersLock.RUnlock()
 
 	tm.Add("peers_lock")
 
 	if r.role != proto.Leader {
+		r.peersLock.RUnlock()
 		// not leader
 		err = kt.ErrNotLeader
 		return
@@ -322,6 +397,9 @@ func (r *Runtime) Apply(ctx context.Context, req interface{}) (result interface{
 	}
 
 	if err == nil {
+		// the commit cycle applies committed membership changes, peers lock is not held while
+		// waiting for the commit
+		r.peersLock.RUnlock()
 		// commit
 		return r.doLeaderCommit(ctx, tm, prepareLog, req)
 	}
@@ -331,11 +409,13 @@ func (r *Runtime) Apply(ctx context.Context, req interface{}) (result interface{
 		r.doLeaderRollback(ctx, tm, prepareLog)
 	}
 
+	r.peersLock.RUnlock()
+
 	return
 }
 
-// Fetch defines entry for missing log fetch.
-func (r *Runtime) Fetch(ctx context.Context, index uint64) (l *kt.Log, err error) {
+// Fetch defines entry for missing log fetch, snapshot is returned if the log is already compacted.
+func (r *Runtime) Fetch(ctx context.Context, index uint64) (l *kt.Log, s *kt.Snapshot, err error) {
 	if atomic.LoadUint32(&r.started) != 1 {
 		err = kt.ErrStopped
 		return
@@ -362,7 +442,14 @@ func (r *Runtime) Fetch(ctx context.Context, index uint64) (l *kt.Log, err error
 	}
 
 	// wal get
-	return r.wal.Get(index)
+	if l, err = r.wal.Get(index); err != nil && r.isCompacted(index) {
+		// log compacted, transfer snapshot instead
+		if s, err = r.loadSnapshot(); err == nil && s == nil {
+			err = errors.Wrapf(kt.ErrLogCompacted, "snapshot of log %d not found", index)
+		}
+	}
+
+	return
 }
 
 // FollowerApply defines entry for follower node.
@@ -392,12 +479,15 @@ func (r *Runtime) FollowerApply(l *kt.Log) (err error) {
 			Debug("kayak follower apply")
 	}()
 
+	// peers lock is not held while waiting for the commit, the commit cycle applies committed
+	// membership changes
 	r.peersLock.RLock()
-	defer r.peersLock.RUnlock()
+	role, leader := r.role, r.peers.Leader
+	r.peersLock.RUnlock()
 
 	tm.Add("peers_lock")
 
-	if r.role == proto.Leader {
+	if role == proto.Leader {
 		// not follower
 		err = kt.ErrNotFollower
 		return
@@ -405,7 +495,7 @@ func (r *Runtime) FollowerApply(l *kt.Log) (err error) {
 
 	// verify log structure
 	switch l.Type {
-	case kt.LogPrepare:
+	case kt.LogPrepare, kt.LogConfig:
 		err = r.followerPrepare(ctx, tm, l)
 	case kt.LogRollback:
 		err = r.followerRollback(ctx, tm, l)
@@ -414,6 +504,9 @@ func (r *Runtime) FollowerApply(l *kt.Log) (err error) {
 	}
 
 	if err == nil {
+		if l.Producer.IsEqual(&leader) {
+			r.touchLeaderContact()
+		}
 		r.updateNextIndex(ctx, l)
 		r.triggerLogAwaits(l.Index)
 	}
@@ -423,8 +516,77 @@ func (r *Runtime) FollowerApply(l *kt.Log) (err error) {
 
 // UpdatePeers defines entry for peers update logic.
 func (r *Runtime) UpdatePeers(peers *proto.Peers) (err error) {
+	if peers == nil {
+		err = errors.Wrap(kt.ErrInvalidConfig, "nil peers")
+		return
+	}
+
+	if err = peers.Verify(); err != nil {
+		err = errors.Wrap(err, "verify peers during kayak update failed")
+		return
+	}
+
+	return r.applyPeers(peers)
+}
+
+// Peers returns the current peers.
+func (r *Runtime) Peers() *proto.Peers {
+	r.peersLock.RLock()
+	defer r.peersLock.RUnlock()
+	return r.peers
+}
+
+// Quorum returns the effective min follower counts of the prepare and commit phases, the commit
+// quorum is raised to a majority of peers if leader election is enabled.
+func (r *Runtime) Quorum() (minPreparedFollowers int, minCommitFollowers int) {
+	r.peersLock.RLock()
+	defer r.peersLock.RUnlock()
+	return r.minPreparedFollowers, r.minCommitFollowers
+}
+
+func (r *Runtime) applyPeers(peers *proto.Peers) (err error) {
+	followers, role, err := resolvePeers(peers, r.nodeID)
+	if err != nil {
+		return
+	}
+
 	r.peersLock.Lock()
-	defer r.peersLock.Unlock()
+
+	if peers.Term < r.peers.Term {
+		r.peersLock.Unlock()
+		err = errors.Wrapf(kt.ErrStaleTerm, "current term: %v, supplied term: %v", r.peers.Term, peers.Term)
+		return
+	}
+
+	promoted := r.role != proto.Leader && role == proto.Leader
+	leaderChanged := !r.peers.Leader.IsEqual(&peers.Leader)
+
+	r.peers = peers
+	r.followers = followers
+	r.role = role
+	r.minPreparedFollowers, r.minCommitFollowers = calcMinFollowers(
+		peers, r.prepareThreshold, r.commitThreshold, r.electionTimeout > 0)
+	if r.votedTerm < peers.Term {
+		r.votedTerm, r.votedFor = peers.Term, ""
+	}
+
+	r.peersLock.Unlock()
+
+	if leaderChanged {
+		// new leader is given a full election timeout to send heartbeats
+		r.touchLeaderContact()
+	}
+
+	log.WithFields(log.Fields{
+		"instance": r.instanceID,
+		"term":     peers.Term,
+		"leader":   peers.Leader,
+		"role":     role.String(),
+	}).Info("kayak peers updated")
+
+	if promoted {
+		r.rollbackPendingPrepares()
+	}
 
 	return
 }
@@ -466,3 +628,41 @@ func (r *Runtime) markPrepareFinished(ctx context.Context, index uint64) {
 
 	delete(r.pendingPrepares, index)
 }
+
+func resolvePeers(peers *proto.Peers, nodeID proto.NodeID) (
+	followers []proto.NodeID, role proto.ServerRole, err error) {
+	followers = make([]proto.NodeID, 0, len(peers.Servers))
+	exists := false
+
+	for _, v := range peers.Servers {
+		if !v.IsEqual(&peers.Leader) {
+			followers = append(followers, v)
+		}
+
+		if v.IsEqual(&nodeID) {
+			exists = true
+			if v.IsEqual(&peers.Leader) {
+				role = proto.Leader
+			} else {
+				role = proto.Follower
+			}
+		}
+	}
+
+	if !exists {
+		err = errors.Wrapf(kt.ErrNotInPeer, "node %v not in peers %v", nodeID, peers)
+	}
+
+	return
+}
+
+func calcMinFollowers(peers *proto.Peers, prepareThreshold, commitThreshold float64, election bool) (
+	minPreparedFollowers int, minCommitFollowers int) {
+	minPreparedFollowers = int(math.Max(math.Ceil(prepareThreshold*float64(len(peers.Servers))), 1) - 1)
+	minCommitFollowers = int(math.Max(math.Ceil(commitThreshold*float64(len(peers.Servers))), 1) - 1)
+	if election && minCommitFollowers < len(peers.Servers)/2 {
+		// a commit returned to the client must reach a majority, so that any elected leader has it
+		minCommitFollowers = len(peers.Servers) / 2
+	}
+	return
+}
@@ -22,6 +22,7 @@ import (
 	"database/sql"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/rpc"
@@ -124,6 +125,52 @@ func (s *sqliteStorage) Query(ctx context.Context, queries []storage.Query) (col
 	return s.st.Query(ctx, queries)
 }
 
+func (s *sqliteStorage) Snapshot() (meta []byte, write func(path string) error, err error) {
+	var rows [][]interface{}
+	if _, _, rows, err = s.st.Query(context.Background(), []storage.Query{
+		{Pattern: "SELECT t1, t2, t3 FROM test"},
+	}); err != nil {
+		return
+	}
+	write = func(path string) (err error) {
+		var buf *bytes.Buffer
+		if buf, err = utils.EncodeMsgPack(rows); err != nil {
+			return
+		}
+		return ioutil.WriteFile(path, buf.Bytes(), 0600)
+	}
+	return
+}
+
+func (s *sqliteStorage) Restore(meta []byte, path string) (err error) {
+	var (
+		data []byte
+		rows [][]interface{}
+	)
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	if err = utils.DecodeMsgPack(data, &rows); err != nil {
+		return
+	}
+	queries := []storage.Query{
+		{Pattern: "CREATE TABLE IF NOT EXISTS test (t1 text, t2 text, t3 text)"},
+		{Pattern: "DELETE FROM test"},
+	}
+	for _, row := range rows {
+		queries = append(queries, storage.Query{
+			Pattern: "INSERT INTO test (t1, t2, t3) VALUES(?, ?, ?)",
+			Args: []sql.NamedArg{
+				sql.Named("", row[0]),
+				sql.Named("", row[1]),
+				sql.Named("", row[2]),
+			},
+		})
+	}
+	_, err = s.st.Exec(context.Background(), queries)
+	return
+}
+
 func (s *sqliteStorage) Close() {
 	if s.st != nil {
 		s.st.Close()
@@ -170,27 +217,53 @@ func (s *fakeService) Apply(req *kt.ApplyRequest, resp *interface{}) (err error)
 }
 
 func (s *fakeService) Fetch(req *kt.FetchRequest, resp *kt.FetchResponse) (err error) {
-	var l *kt.Log
-	if l, err = s.rt.Fetch(req.GetContext(), req.Index); err != nil {
+	var (
+		l    *kt.Log
+		snap *kt.Snapshot
+	)
+	if req.Attachment != "" {
+		resp.SnapshotChunk, err = s.rt.FetchAttachment(req.GetContext(), req.Attachment, req.SnapshotOffset)
+		return
+	}
+	if req.SnapshotIndex != 0 {
+		resp.SnapshotChunk, err = s.rt.FetchSnapshot(req.GetContext(), req.SnapshotIndex, req.SnapshotOffset)
+		return
+	}
+	if l, snap, err = s.rt.Fetch(req.GetContext(), req.Index); err != nil {
 		return
 	}
 
 	resp.Log = l
+	resp.Snapshot = snap
 	return
 }
 
-func (s *fakeService) serveConn(c net.Conn) {
-	var r proto.NodeID
-	s.s.ServeCodec(crpc.NewNodeAwareServerCodec(context.Background(), utils.GetMsgPackServerCodec(c), r.ToRawNodeID()))
+func (s *fakeService) Vote(req *kt.VoteRequest, resp *kt.VoteResponse) (err error) {
+	resp.Granted, resp.NextIndex, resp.Signature, err = s.rt.Vote(req.GetContext(), req)
+	return
+}
+
+func (s *fakeService) Heartbeat(req *kt.HeartbeatRequest, resp *interface{}) (err error) {
+	return s.rt.Heartbeat(req.GetContext(), req)
+}
+
+func (s *fakeService) Sync(req *kt.SyncRequest, resp *kt.SyncResponse) (err error) {
+	resp.LastCommit, resp.NextIndex, err = s.rt.Sync(req.GetContext(), req)
+	return
+}
+
+func (s *fakeService) serveConn(c net.Conn, source proto.NodeID) {
+	s.s.ServeCodec(crpc.NewNodeAwareServerCodec(context.Background(), utils.GetMsgPackServerCodec(c), source.ToRawNodeID()))
 }
 
 type fakeCaller struct {
 	m      *fakeMux
+	source proto.NodeID
 	target proto.NodeID
 	s      *smux.Session
 }
 
-func newFakeCaller(m *fakeMux, nodeID proto.NodeID) (c *fakeCaller) {
+func newFakeCaller(m *fakeMux, source, nodeID proto.NodeID) (c *fakeCaller) {
 	fakeConn := mock_conn.NewConn()
 	cipher1 := etls.NewCipher([]byte("123"))
 	cipher2 := etls.NewCipher([]byte("123"))
@@ -205,7 +278,7 @@ func newFakeCaller(m *fakeMux, nodeID proto.NodeID) (c *fakeCaller) {
 				break
 			}
 
-			go c.m.get(c.target).serveConn(s)
+			go c.m.get(c.target).serveConn(s, c.source)
 		}
 	}()
 
@@ -213,6 +286,7 @@ func newFakeCaller(m *fakeMux, nodeID proto.NodeID) (c *fakeCaller) {
 
 	c = &fakeCaller{
 		m:      m,
+		source: source,
 		target: nodeID,
 		s:      muxClientSess,
 	}
@@ -307,8 +381,8 @@ func TestRuntime(t *testing.T) {
 		fs2 := newFakeService(rt2)
 		m.register(node2, fs2)
 
-		rt1.SetCaller(node2, newFakeCaller(m, node2))
-		rt2.SetCaller(node1, newFakeCaller(m, node1))
+		rt1.SetCaller(node2, newFakeCaller(m, node1, node2))
+		rt2.SetCaller(node1, newFakeCaller(m, node2, node1))
 
 		err = rt1.Start()
 		So(err, ShouldBeNil)
@@ -449,6 +523,30 @@ func TestRuntime(t *testing.T) {
 			NodeID: node3,
 		})
 		So(err, ShouldNotBeNil)
+
+		// commit quorum is raised to a majority of peers by leader election
+		node4 := proto.NodeID("00000b8b73c1a4e2c01e3c0ec9ab1bd2e0c74d1dd6ee3bde1cd3d32e5ba3d2f2")
+		peers.Servers = []proto.NodeID{node1, node2, node3, node4}
+		err = peers.Sign(privKey)
+		So(err, ShouldBeNil)
+		wal := kl.NewMemWal()
+		defer wal.Close()
+		rt, err := kayak.NewRuntime(&kt.RuntimeConfig{
+			PrepareThreshold: 1.0,
+			CommitThreshold:  0,
+			Peers:            peers,
+			Wal:              wal,
+			NodeID:           node1,
+			ElectionTimeout:  time.Second,
+			PrivateKey:       privKey,
+			NodeKey: func(node proto.NodeID) (*asymmetric.PublicKey, error) {
+				return privKey.PubKey(), nil
+			},
+		})
+		So(err, ShouldBeNil)
+		minPrepared, minCommit := rt.Quorum()
+		So(minPrepared, ShouldEqual, 3)
+		So(minCommit, ShouldEqual, 2)
 	})
 	Convey("test log loading", t, func() {
 		w, err := kl.NewLevelDBWal("testLoad.db")
@@ -536,6 +634,606 @@ func TestRuntime(t *testing.T) {
 		So(rt.Shutdown(), ShouldBeNil)
 		So(func() { rt.Shutdown() }, ShouldNotPanic)
 	})
+	Convey("test committed peers reloading", t, func() {
+		node1 := proto.NodeID("000005aa62048f85da4ae9698ed59c14ec0d48a88a07c15a32265634e7e64ade")
+		node2 := proto.NodeID("000005f4f22c06f76c43c4f48d5a7ec1309cc94030cbf9ebae814172884ac8b5")
+		privKey, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		newPeers := func(version uint64, servers ...proto.NodeID) *proto.Peers {
+			p := &proto.Peers{
+				PeersHeader: proto.PeersHeader{
+					Version: version,
+					Leader:  node1,
+					Servers: servers,
+				},
+			}
+			So(p.Sign(privKey), ShouldBeNil)
+			return p
+		}
+
+		w, err := kl.NewLevelDBWal("testLoadPeers.db")
+		defer os.RemoveAll("testLoadPeers.db")
+		So(err, ShouldBeNil)
+		enc, err := utils.EncodeMsgPack(newPeers(1, node1, node2))
+		So(err, ShouldBeNil)
+		err = w.Write(&kt.Log{
+			LogHeader: kt.LogHeader{
+				Index:    0,
+				Type:     kt.LogConfig,
+				Producer: node1,
+			},
+			Data: enc.Bytes(),
+		})
+		So(err, ShouldBeNil)
+		data := make([]byte, 16)
+		binary.BigEndian.PutUint64(data, 0) // prepare log index
+		err = w.Write(&kt.Log{
+			LogHeader: kt.LogHeader{
+				Index:    1,
+				Type:     kt.LogCommit,
+				Producer: node1,
+			},
+			Data: data,
+		})
+		So(err, ShouldBeNil)
+		w.Close()
+
+		w, err = kl.NewLevelDBWal("testLoadPeers.db")
+		So(err, ShouldBeNil)
+		defer w.Close()
+
+		// node stopped before the committed membership change is published
+		rt, err := kayak.NewRuntime(&kt.RuntimeConfig{
+			PrepareThreshold: 1.0,
+			CommitThreshold:  1.0,
+			PrepareTimeout:   time.Second,
+			CommitTimeout:    10 * time.Second,
+			LogWaitTimeout:   10 * time.Second,
+			Peers:            newPeers(0, node1),
+			Wal:              w,
+			NodeID:           node1,
+			ServiceName:      "Test",
+			ApplyMethodName:  "Apply",
+		})
+		So(err, ShouldBeNil)
+		So(rt.Peers().Version, ShouldEqual, 1)
+		So(rt.Peers().Servers, ShouldResemble, []proto.NodeID{node1, node2})
+		minPrepared, _ := rt.Quorum()
+		So(minPrepared, ShouldEqual, 1)
+	})
+	Convey("leader election", t, func() {
+		node1 := proto.NodeID("000005aa62048f85da4ae9698ed59c14ec0d48a88a07c15a32265634e7e64ade")
+		node2 := proto.NodeID("000005f4f22c06f76c43c4f48d5a7ec1309cc94030cbf9ebae814172884ac8b5")
+		node3 := proto.NodeID("000003f49592f83d0473bddb70d543f1096b4ffed5e5f942a3117e256b7052b8")
+		nodes := []proto.NodeID{node1, node2, node3}
+
+		peers := &proto.Peers{
+			PeersHeader: proto.PeersHeader{
+				Leader:  node1,
+				Servers: nodes,
+			},
+		}
+
+		privKey, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		err = peers.Sign(privKey)
+		So(err, ShouldBeNil)
+
+		// each node signs the peers of the terms it wins with its own key
+		nodeKeys := make(map[proto.NodeID]*asymmetric.PrivateKey)
+		for _, node := range nodes {
+			nodeKeys[node], _, err = asymmetric.GenSecp256k1KeyPair()
+			So(err, ShouldBeNil)
+		}
+		getNodeKey := func(node proto.NodeID) (*asymmetric.PublicKey, error) {
+			if k, ok := nodeKeys[node]; ok {
+				return k.PubKey(), nil
+			}
+			return nil, errors.New("unknown node")
+		}
+
+		m := newFakeMux()
+		rts := make([]*kayak.Runtime, len(nodes))
+
+		for i, node := range nodes {
+			dbFile := fmt.Sprintf("test_election%d.db", i)
+			db, err := newSQLiteStorage(dbFile)
+			So(err, ShouldBeNil)
+			defer func() {
+				db.Close()
+				os.Remove(dbFile)
+			}()
+
+			wal := kl.NewMemWal()
+			defer wal.Close()
+
+			rts[i], err = kayak.NewRuntime(&kt.RuntimeConfig{
+				Handler:             db,
+				PrepareThreshold:    0.5,
+				CommitThreshold:     0.5,
+				PrepareTimeout:      time.Second,
+				CommitTimeout:       10 * time.Second,
+				LogWaitTimeout:      10 * time.Second,
+				ElectionTimeout:     200 * time.Millisecond,
+				HeartbeatInterval:   50 * time.Millisecond,
+				Peers:               peers,
+				Wal:                 wal,
+				NodeID:              node,
+				ServiceName:         "Test",
+				ApplyMethodName:     "Apply",
+				VoteMethodName:      "Vote",
+				HeartbeatMethodName: "Heartbeat",
+				PrivateKey:          nodeKeys[node],
+				NodeKey:             getNodeKey,
+			})
+			So(err, ShouldBeNil)
+			m.register(node, newFakeService(rts[i]))
+		}
+
+		for i := range nodes {
+			for j, node := range nodes {
+				if i != j {
+					rts[i].SetCaller(node, newFakeCaller(m, nodes[i], node))
+				}
+			}
+		}
+
+		// leader node1 is never started
+		for _, rt := range rts[1:] {
+			So(rt.Start(), ShouldBeNil)
+			defer rt.Shutdown()
+		}
+
+		var newLeader proto.NodeID
+		for i := 0; i != 100 && newLeader == ""; i++ {
+			time.Sleep(50 * time.Millisecond)
+			p2, p3 := rts[1].Peers(), rts[2].Peers()
+			if p2.Term > 0 && p2.Term == p3.Term && p2.Leader == p3.Leader {
+				newLeader = p2.Leader
+			}
+		}
+		So(newLeader, ShouldBeIn, []proto.NodeID{node2, node3})
+
+		leaderRt := rts[1]
+		if newLeader == node3 {
+			leaderRt = rts[2]
+		}
+
+		// the error from stopped node1 may arrive before the quorum is reached, retry in this case
+		for i := 0; i != 10; i++ {
+			if _, _, err = leaderRt.Apply(context.Background(), &queryStructure{
+				Queries: []storage.Query{
+					{Pattern: "CREATE TABLE IF NOT EXISTS test (t1 text, t2 text, t3 text)"},
+				},
+			}); err == nil {
+				break
+			}
+		}
+		So(err, ShouldBeNil)
+
+		// stale heartbeat from previous leader is rejected
+		hb := &kt.HeartbeatRequest{Peers: peers}
+		hb.SetNodeID(node1.ToRawNodeID())
+		err = leaderRt.Heartbeat(context.Background(), hb)
+		So(errors.Cause(err), ShouldEqual, kt.ErrStaleTerm)
+
+		// heartbeat must be sent by the leader of peers
+		forged := rts[0].Peers().Clone()
+		forged.Term = leaderRt.Peers().Term + 1
+		forged.Leader = node1
+		So(forged.Sign(nodeKeys[node1]), ShouldBeNil)
+		hb = &kt.HeartbeatRequest{Peers: &forged}
+		hb.SetNodeID(newLeader.ToRawNodeID())
+		err = leaderRt.Heartbeat(context.Background(), hb)
+		So(errors.Cause(err), ShouldEqual, kt.ErrInvalidSender)
+
+		// peers of new term must be signed by the leader
+		So(forged.Sign(privKey), ShouldBeNil)
+		hb.SetNodeID(node1.ToRawNodeID())
+		err = leaderRt.Heartbeat(context.Background(), hb)
+		So(errors.Cause(err), ShouldEqual, kt.ErrUntrustedPeers)
+		So(leaderRt.Peers().Leader, ShouldEqual, newLeader)
+
+		// leader of new term must be elected by a quorum of votes
+		So(forged.Sign(nodeKeys[node1]), ShouldBeNil)
+		err = leaderRt.Heartbeat(context.Background(), hb)
+		So(errors.Cause(err), ShouldEqual, kt.ErrUntrustedPeers)
+		signVote := func(voter proto.NodeID, term uint64, candidate proto.NodeID) *kt.GrantedVote {
+			h := kt.VoteHash("", term, candidate)
+			sig, err := nodeKeys[voter].Sign(h[:])
+			So(err, ShouldBeNil)
+			return &kt.GrantedVote{Voter: voter, Signature: sig}
+		}
+		hb.Votes = []*kt.GrantedVote{
+			signVote(node1, forged.Term, node1),
+			signVote(node1, forged.Term, node1),
+			signVote(newLeader, forged.Term-1, node1),
+		}
+		err = leaderRt.Heartbeat(context.Background(), hb)
+		So(errors.Cause(err), ShouldEqual, kt.ErrUntrustedPeers)
+		So(leaderRt.Peers().Leader, ShouldEqual, newLeader)
+
+		// servers could not be changed by new term
+		changed := forged.Clone()
+		changed.Servers = []proto.NodeID{node1, newLeader}
+		So(changed.Sign(nodeKeys[node1]), ShouldBeNil)
+		hb = &kt.HeartbeatRequest{
+			Peers: &changed,
+			Votes: []*kt.GrantedVote{
+				signVote(node1, forged.Term, node1),
+				signVote(newLeader, forged.Term, node1),
+			},
+		}
+		hb.SetNodeID(node1.ToRawNodeID())
+		err = leaderRt.Heartbeat(context.Background(), hb)
+		So(errors.Cause(err), ShouldEqual, kt.ErrInvalidPeersChange)
+
+		// vote must be requested by the candidate itself
+		vote := &kt.VoteRequest{Term: forged.Term, Candidate: node1}
+		vote.SetNodeID(newLeader.ToRawNodeID())
+		_, _, _, err = leaderRt.Vote(context.Background(), vote)
+		So(errors.Cause(err), ShouldEqual, kt.ErrInvalidSender)
+
+		// leader elected by a quorum is accepted
+		hb.Peers = &forged
+		err = leaderRt.Heartbeat(context.Background(), hb)
+		So(err, ShouldBeNil)
+		So(leaderRt.Peers().Leader, ShouldEqual, node1)
+		So(leaderRt.Peers().Term, ShouldEqual, forged.Term)
+	})
+	Convey("snapshot and log compaction", t, func() {
+		node1 := proto.NodeID("000005aa62048f85da4ae9698ed59c14ec0d48a88a07c15a32265634e7e64ade")
+		node2 := proto.NodeID("000005f4f22c06f76c43c4f48d5a7ec1309cc94030cbf9ebae814172884ac8b5")
+		nodes := []proto.NodeID{node1, node2}
+
+		peers := &proto.Peers{
+			PeersHeader: proto.PeersHeader{
+				Leader:  node1,
+				Servers: nodes,
+			},
+		}
+
+		privKey, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		err = peers.Sign(privKey)
+		So(err, ShouldBeNil)
+
+		m := newFakeMux()
+		dbs := make([]*sqliteStorage, len(nodes))
+		rts := make([]*kayak.Runtime, len(nodes))
+		walFile := "test_snapshot_wal.ldb"
+		defer os.RemoveAll(walFile)
+		leaderWal, err := kl.NewLevelDBWal(walFile)
+		So(err, ShouldBeNil)
+
+		newConfig := func(i int, wal kt.Wal) *kt.RuntimeConfig {
+			return &kt.RuntimeConfig{
+				Handler:          dbs[i],
+				PrepareThreshold: 0,
+				CommitThreshold:  0,
+				PrepareTimeout:   time.Second,
+				CommitTimeout:    10 * time.Second,
+				LogWaitTimeout:   100 * time.Millisecond,
+				Peers:            peers,
+				Wal:              wal,
+				NodeID:           nodes[i],
+				ServiceName:      "Test",
+				ApplyMethodName:  "Apply",
+				FetchMethodName:  "Fetch",
+				SnapshotInterval: 4,
+				SnapshotDir:      fmt.Sprintf("test_snapshot%d.snap", i),
+			}
+		}
+
+		for i := range nodes {
+			dbFile := fmt.Sprintf("test_snapshot%d.db", i)
+			dbs[i], err = newSQLiteStorage(dbFile)
+			So(err, ShouldBeNil)
+			defer func(i int) {
+				dbs[i].Close()
+				os.Remove(dbFile)
+				os.RemoveAll(fmt.Sprintf("test_snapshot%d.snap", i))
+			}(i)
+		}
+
+		rts[0], err = kayak.NewRuntime(newConfig(0, leaderWal))
+		So(err, ShouldBeNil)
+		followerWal := kl.NewMemWal()
+		defer followerWal.Close()
+		rts[1], err = kayak.NewRuntime(newConfig(1, followerWal))
+		So(err, ShouldBeNil)
+
+		for i, node := range nodes {
+			m.register(node, newFakeService(rts[i]))
+			rts[i].SetCaller(nodes[1-i], newFakeCaller(m, nodes[i], nodes[1-i]))
+		}
+
+		// follower is not started and lags behind
+		So(rts[0].Start(), ShouldBeNil)
+
+		insert := &queryStructure{
+			Queries: []storage.Query{
+				{
+					Pattern: "INSERT INTO test (t1, t2, t3) VALUES(?, ?, ?)",
+					Args: []sql.NamedArg{
+						sql.Named("", "a"),
+						sql.Named("", "b"),
+						sql.Named("", "c"),
+					},
+				},
+			},
+		}
+		_, _, err = rts[0].Apply(context.Background(), &queryStructure{
+			Queries: []storage.Query{
+				{Pattern: "CREATE TABLE IF NOT EXISTS test (t1 text, t2 text, t3 text)"},
+			},
+		})
+		So(err, ShouldBeNil)
+		for i := 0; i != 9; i++ {
+			_, _, err = rts[0].Apply(context.Background(), insert)
+			So(err, ShouldBeNil)
+		}
+
+		// early logs are compacted in background, snapshot is returned instead
+		var (
+			l    *kt.Log
+			snap *kt.Snapshot
+		)
+		for i := 0; i != 100 && snap == nil; i++ {
+			if l, snap, err = rts[0].Fetch(context.Background(), 0); snap == nil {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		So(err, ShouldBeNil)
+		So(l, ShouldBeNil)
+		So(snap, ShouldNotBeNil)
+		So(snap.Index, ShouldBeGreaterThan, 0)
+		So(snap.Size, ShouldBeGreaterThan, 0)
+		_, err = leaderWal.Get(0)
+		So(err, ShouldNotBeNil)
+
+		// snapshot file is fetched in chunks
+		chunk, err := rts[0].FetchSnapshot(context.Background(), snap.Index, 0)
+		So(err, ShouldBeNil)
+		So(len(chunk), ShouldEqual, snap.Size)
+		chunk, err = rts[0].FetchSnapshot(context.Background(), snap.Index, snap.Size)
+		So(err, ShouldNotBeNil)
+		_, err = rts[0].FetchSnapshot(context.Background(), snap.Index+1, 0)
+		So(errors.Cause(err), ShouldEqual, kt.ErrLogCompacted)
+		l, snap, err = rts[0].Fetch(context.Background(), 19)
+		So(err, ShouldBeNil)
+		So(l, ShouldNotBeNil)
+		So(snap, ShouldBeNil)
+
+		// lagging follower catches up from snapshot
+		So(rts[1].Start(), ShouldBeNil)
+		defer rts[1].Shutdown()
+		_, _, err = rts[0].Apply(context.Background(), insert)
+		So(err, ShouldBeNil)
+
+		var count int64
+		for i := 0; i != 100 && count != 10; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, _, data, err := dbs[1].Query(context.Background(), []storage.Query{
+				{Pattern: "SELECT COUNT(1) FROM test"},
+			}); err == nil && len(data) > 0 {
+				count = data[0][0].(int64)
+			}
+		}
+		So(count, ShouldEqual, 10)
+
+		// attachment of leader is downloaded by follower in chunks
+		attachment := bytes.Repeat([]byte("attachment"), 300000)
+		err = ioutil.WriteFile(rts[0].AttachmentFile("archive"), attachment, 0600)
+		So(err, ShouldBeNil)
+		file, err := rts[1].DownloadAttachment(context.Background(), "archive", uint64(len(attachment)))
+		So(err, ShouldBeNil)
+		So(file, ShouldEqual, rts[1].AttachmentFile("archive"))
+		downloaded, err := ioutil.ReadFile(file)
+		So(err, ShouldBeNil)
+		So(downloaded, ShouldResemble, attachment)
+		_, err = rts[1].DownloadAttachment(context.Background(), "missing", 1)
+		So(err, ShouldNotBeNil)
+		_, err = rts[0].FetchAttachment(context.Background(), "../archive", 0)
+		So(errors.Cause(err), ShouldEqual, kt.ErrInvalidConfig)
+
+		// restart leader from compacted wal
+		So(rts[0].Shutdown(), ShouldBeNil)
+		leaderWal.Close()
+		leaderWal, err = kl.NewLevelDBWal(walFile)
+		So(err, ShouldBeNil)
+		defer leaderWal.Close()
+		rts[0], err = kayak.NewRuntime(newConfig(0, leaderWal))
+		So(err, ShouldBeNil)
+		So(rts[0].Start(), ShouldBeNil)
+		defer rts[0].Shutdown()
+		_, logIndex, err := rts[0].Apply(context.Background(), insert)
+		So(err, ShouldBeNil)
+		So(logIndex, ShouldEqual, 23)
+
+		// current snapshot for backup
+		backupFile := "test_snapshot_backup"
+		defer os.Remove(backupFile)
+		snap, err = rts[0].CurrentSnapshot(backupFile)
+		So(err, ShouldBeNil)
+		So(snap.Index, ShouldEqual, logIndex)
+		So(snap.Size, ShouldBeGreaterThan, 0)
+	})
+}
+
+func TestRuntimeMembershipChange(t *testing.T) {
+	Convey("membership change", t, func() {
+		node1 := proto.NodeID("000005aa62048f85da4ae9698ed59c14ec0d48a88a07c15a32265634e7e64ade")
+		node2 := proto.NodeID("000005f4f22c06f76c43c4f48d5a7ec1309cc94030cbf9ebae814172884ac8b5")
+		node3 := proto.NodeID("000003f49592f83d0473bddb70d543f1096b4ffed5e5f942a3117e256b7052b8")
+		nodes := []proto.NodeID{node1, node2, node3}
+
+		privKey, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		newPeers := func(version uint64, servers ...proto.NodeID) *proto.Peers {
+			p := &proto.Peers{
+				PeersHeader: proto.PeersHeader{
+					Version: version,
+					Leader:  node1,
+					Servers: servers,
+				},
+			}
+			So(p.Sign(privKey), ShouldBeNil)
+			return p
+		}
+
+		m := newFakeMux()
+		dbs := make([]*sqliteStorage, len(nodes))
+		rts := make([]*kayak.Runtime, len(nodes))
+
+		for i, node := range nodes {
+			dbFile := fmt.Sprintf("test_membership%d.db", i)
+			snapDir := fmt.Sprintf("test_membership%d.snap", i)
+			dbs[i], err = newSQLiteStorage(dbFile)
+			So(err, ShouldBeNil)
+			defer func(i int) {
+				dbs[i].Close()
+				os.Remove(dbFile)
+				os.RemoveAll(snapDir)
+			}(i)
+
+			// new member starts with the target peers
+			peers := newPeers(0, node1, node2)
+			if node.IsEqual(&node3) {
+				peers = newPeers(0, nodes...)
+			}
+
+			wal := kl.NewMemWal()
+			defer wal.Close()
+			rts[i], err = kayak.NewRuntime(&kt.RuntimeConfig{
+				Handler:          dbs[i],
+				PrepareThreshold: 1.0,
+				CommitThreshold:  0,
+				PrepareTimeout:   time.Second,
+				CommitTimeout:    10 * time.Second,
+				LogWaitTimeout:   100 * time.Millisecond,
+				Peers:            peers,
+				Wal:              wal,
+				NodeID:           node,
+				ServiceName:      "Test",
+				ApplyMethodName:  "Apply",
+				FetchMethodName:  "Fetch",
+				SyncMethodName:   "Sync",
+				SnapshotInterval: 4,
+				SnapshotDir:      snapDir,
+			})
+			So(err, ShouldBeNil)
+			m.register(node, newFakeService(rts[i]))
+		}
+
+		for i := range nodes {
+			for j := range nodes {
+				if i != j {
+					rts[i].SetCaller(nodes[j], newFakeCaller(m, nodes[i], nodes[j]))
+				}
+			}
+			So(rts[i].Start(), ShouldBeNil)
+			defer rts[i].Shutdown()
+		}
+
+		insert := &queryStructure{
+			Queries: []storage.Query{
+				{
+					Pattern: "INSERT INTO test (t1, t2, t3) VALUES(?, ?, ?)",
+					Args: []sql.NamedArg{
+						sql.Named("", "a"),
+						sql.Named("", "b"),
+						sql.Named("", "c"),
+					},
+				},
+			},
+		}
+		countRows := func(i int, expected int64) (count int64) {
+			for r := 0; r != 100 && count != expected; r++ {
+				if _, _, data, err := dbs[i].Query(context.Background(), []storage.Query{
+					{Pattern: "SELECT COUNT(1) FROM test"},
+				}); err == nil && len(data) > 0 {
+					count = data[0][0].(int64)
+				}
+				if count != expected {
+					time.Sleep(50 * time.Millisecond)
+				}
+			}
+			return
+		}
+
+		_, _, err = rts[0].Apply(context.Background(), &queryStructure{
+			Queries: []storage.Query{
+				{Pattern: "CREATE TABLE IF NOT EXISTS test (t1 text, t2 text, t3 text)"},
+			},
+		})
+		So(err, ShouldBeNil)
+		for i := 0; i != 5; i++ {
+			_, _, err = rts[0].Apply(context.Background(), insert)
+			So(err, ShouldBeNil)
+		}
+
+		// invalid changes
+		_, err = rts[1].ChangePeers(context.Background(), newPeers(1, nodes...))
+		So(errors.Cause(err), ShouldEqual, kt.ErrNotLeader)
+		_, err = rts[0].ChangePeers(context.Background(), newPeers(0, nodes...))
+		So(errors.Cause(err), ShouldEqual, kt.ErrInvalidPeersChange)
+		_, err = rts[0].ChangePeers(context.Background(), newPeers(1, node1, node3))
+		So(errors.Cause(err), ShouldEqual, kt.ErrInvalidPeersChange)
+		_, err = rts[0].ChangePeers(context.Background(), newPeers(1, node2, node3))
+		So(errors.Cause(err), ShouldEqual, kt.ErrInvalidPeersChange)
+
+		// only leader syncs logs and snapshot to members
+		err = newFakeCaller(m, node2, node3).Call("Test.Sync", &kt.SyncRequest{
+			Logs: []*kt.Log{
+				{
+					LogHeader: kt.LogHeader{
+						Index:    0,
+						Type:     kt.LogPrepare,
+						Producer: node2,
+					},
+				},
+			},
+		}, &kt.SyncResponse{})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, kt.ErrInvalidSender.Error())
+
+		// peers in snapshot must be signed by the signer of current peers or the leader
+		forgedKey, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		forged := newPeers(5, node1, node3)
+		So(forged.Sign(forgedKey), ShouldBeNil)
+		err = newFakeCaller(m, node1, node3).Call("Test.Sync", &kt.SyncRequest{
+			Snapshot: &kt.Snapshot{Index: 1000, Size: 1, Peers: forged},
+		}, &kt.SyncResponse{})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, kt.ErrUntrustedPeers.Error())
+		So(rts[2].Peers().Version, ShouldEqual, 0)
+
+		// add new member, synced before the change is committed
+		_, err = rts[0].ChangePeers(context.Background(), newPeers(1, nodes...))
+		So(err, ShouldBeNil)
+		So(rts[0].Peers().Servers, ShouldHaveLength, 3)
+		So(countRows(2, 5), ShouldEqual, 5)
+
+		// new member counts toward prepare quorum
+		_, _, err = rts[0].Apply(context.Background(), insert)
+		So(err, ShouldBeNil)
+		So(countRows(2, 6), ShouldEqual, 6)
+		So(countRows(1, 6), ShouldEqual, 6)
+		for r := 0; r != 100 && rts[1].Peers().Version != 1; r++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		So(rts[1].Peers().Servers, ShouldHaveLength, 3)
+
+		// remove follower
+		_, err = rts[0].ChangePeers(context.Background(), newPeers(2, node1, node3))
+		So(err, ShouldBeNil)
+		So(rts[0].Peers().Servers, ShouldHaveLength, 2)
+		_, _, err = rts[0].Apply(context.Background(), insert)
+		So(err, ShouldBeNil)
+		So(countRows(2, 7), ShouldEqual, 7)
+	})
 }
 
 func BenchmarkRuntime(b *testing.B) {
@@ -619,8 +1317,8 @@ func BenchmarkRuntime(b *testing.B) {
 		fs2 := newFakeService(rt2)
 		m.register(node2, fs2)
 
-		rt1.SetCaller(node2, newFakeCaller(m, node2))
-		rt2.SetCaller(node1, newFakeCaller(m, node1))
+		rt1.SetCaller(node2, newFakeCaller(m, node1, node2))
+		rt2.SetCaller(node1, newFakeCaller(m, node2, node1))
 
 		err = rt1.Start()
 		So(err, ShouldBeNil)
@@ -0,0 +1,625 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	kt "github.com/CovenantSQL/CovenantSQL/kayak/types"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	"github.com/CovenantSQL/CovenantSQL/utils/trace"
+	"github.com/pkg/errors"
+)
+
+const (
+	// snapshot file extension.
+	snapshotFileExt = ".snap"
+	// extension of the snapshot file being written or transferred.
+	snapshotTempFileExt = ".tmp"
+	// attachment file extension.
+	attachmentFileExt = ".att"
+	// max byte size of the snapshot file chunk returned by a single fetch.
+	snapshotChunkSize = 1 << 20
+)
+
+func (r *Runtime) snapshotEnabled() (sh kt.Snapshotter, sw kt.SnapshotWal, ok bool) {
+	if r.snapshotDir == "" {
+		return
+	}
+	if sh, ok = r.sh.(kt.Snapshotter); !ok {
+		return
+	}
+	sw, ok = r.wal.(kt.SnapshotWal)
+	return
+}
+
+// snapshotFile returns the file path of the snapshot at commit log index.
+func (r *Runtime) snapshotFile(index uint64) string {
+	return filepath.Join(r.snapshotDir, fmt.Sprint(index, snapshotFileExt))
+}
+
+// maybeSnapshot takes snapshot after commit log if snapshot interval is reached,
+// req is the commit request of the commit log.
+func (r *Runtime) maybeSnapshot(ctx context.Context, commitIndex uint64, req *commitReq) {
+	if r.snapshotInterval == 0 || commitIndex < atomic.LoadUint64(&r.snapshotIndex)+r.snapshotInterval {
+		return
+	}
+
+	// the previous snapshot is still being written
+	if !atomic.CompareAndSwapUint32(&r.snapshotting, 0, 1) {
+		return
+	}
+
+	defer trace.StartRegion(ctx, "snapshot").End()
+
+	if err := r.doSnapshot(commitIndex, req); err != nil {
+		log.WithFields(log.Fields{
+			"index":    commitIndex,
+			"instance": r.instanceID,
+		}).WithError(err).Warning("take kayak snapshot failed")
+	}
+}
+
+// doSnapshot pins the fsm state at the commit log in the commit path, the state is written and
+// saved in background.
+func (r *Runtime) doSnapshot(commitIndex uint64, req *commitReq) (err error) {
+	var started bool
+	defer func() {
+		if !started {
+			atomic.StoreUint32(&r.snapshotting, 0)
+		}
+	}()
+
+	sh, sw, ok := r.snapshotEnabled()
+	if !ok {
+		return
+	}
+
+	s := &kt.Snapshot{
+		Index: commitIndex,
+		Peers: r.Peers(),
+	}
+	if peers, ok := req.data.(*proto.Peers); ok && isNewerPeers(peers, s.Peers) {
+		// membership change of the commit log is applied after the commit lock is released
+		s.Peers = peers
+	}
+
+	// keep uncommitted prepares in snapshot, logs since the earliest prepare are not truncated
+	truncateIndex := commitIndex
+	for _, i := range r.getPendingPrepares() {
+		if i == req.index || i > commitIndex {
+			continue
+		}
+		var l *kt.Log
+		if l, err = r.wal.Get(i); err != nil {
+			err = errors.Wrapf(err, "get pending prepare log %d failed", i)
+			return
+		}
+		s.Prepares = append(s.Prepares, l)
+		if i < truncateIndex {
+			truncateIndex = i
+		}
+	}
+
+	var write func(string) error
+	if s.Meta, write, err = sh.Snapshot(); err != nil {
+		err = errors.Wrap(err, "pin fsm snapshot failed")
+		return
+	}
+
+	started = true
+	r.goFunc(func() {
+		defer atomic.StoreUint32(&r.snapshotting, 0)
+
+		if err := r.writeSnapshot(s, write); err != nil {
+			log.WithFields(log.Fields{
+				"index":    s.Index,
+				"instance": r.instanceID,
+			}).WithError(err).Warning("write kayak snapshot failed")
+			return
+		}
+
+		if err := r.saveSnapshot(sw, s, truncateIndex); err != nil {
+			log.WithFields(log.Fields{
+				"index":    s.Index,
+				"instance": r.instanceID,
+			}).WithError(err).Warning("save kayak snapshot failed")
+		}
+	})
+
+	return
+}
+
+// writeSnapshot writes the pinned fsm state to the snapshot file and sets the file size.
+func (r *Runtime) writeSnapshot(s *kt.Snapshot, write func(string) error) (err error) {
+	var (
+		file = r.snapshotFile(s.Index)
+		temp = file + snapshotTempFileExt
+		info os.FileInfo
+	)
+	defer func() {
+		if err != nil {
+			_ = os.Remove(temp)
+		}
+	}()
+	if err = write(temp); err != nil {
+		err = errors.Wrap(err, "dump fsm snapshot failed")
+		return
+	}
+	if info, err = os.Stat(temp); err != nil {
+		err = errors.Wrap(err, "stat snapshot file failed")
+		return
+	}
+	if err = os.Rename(temp, file); err != nil {
+		err = errors.Wrap(err, "rename snapshot file failed")
+		return
+	}
+	s.Size = uint64(info.Size())
+	return
+}
+
+// saveSnapshot saves the snapshot of which the file is ready, the file of previous snapshot is
+// removed. It's skipped if a later snapshot is already saved.
+func (r *Runtime) saveSnapshot(sw kt.SnapshotWal, s *kt.Snapshot, truncateIndex uint64) (err error) {
+	r.snapshotLock.Lock()
+	defer r.snapshotLock.Unlock()
+
+	prev := atomic.LoadUint64(&r.snapshotIndex)
+	if s.Index <= prev {
+		_ = os.Remove(r.snapshotFile(s.Index))
+		return
+	}
+
+	if err = sw.SaveSnapshot(s, truncateIndex); err != nil {
+		err = errors.Wrap(err, "save snapshot failed")
+		return
+	}
+
+	atomic.StoreUint64(&r.snapshotIndex, s.Index)
+	if prev > 0 {
+		_ = os.Remove(r.snapshotFile(prev))
+	}
+
+	log.WithFields(log.Fields{
+		"index":    s.Index,
+		"truncate": truncateIndex,
+		"prepares": len(s.Prepares),
+		"size":     s.Size,
+		"instance": r.instanceID,
+	}).Info("kayak snapshot saved")
+
+	return
+}
+
+// downloadSnapshot fetches the snapshot file from node chunk by chunk.
+func (r *Runtime) downloadSnapshot(ctx context.Context, node proto.NodeID, s *kt.Snapshot) (err error) {
+	defer trace.StartRegion(ctx, "downloadSnapshot").End()
+
+	return r.downloadFile(node, r.snapshotFile(s.Index), s.Size, func(offset uint64) *kt.FetchRequest {
+		return &kt.FetchRequest{
+			Instance:       r.instanceID,
+			SnapshotIndex:  s.Index,
+			SnapshotOffset: offset,
+		}
+	})
+}
+
+// downloadFile fetches the file of size from node chunk by chunk, the file is renamed into place
+// once all chunks are written.
+func (r *Runtime) downloadFile(
+	node proto.NodeID, file string, size uint64, newReq func(offset uint64) *kt.FetchRequest,
+) (err error) {
+	var (
+		temp = file + snapshotTempFileExt
+		f    *os.File
+	)
+	if f, err = os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600); err != nil {
+		err = errors.Wrap(err, "create file failed")
+		return
+	}
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+		if err != nil {
+			_ = os.Remove(temp)
+		}
+	}()
+
+	for offset := uint64(0); offset < size; {
+		var (
+			req  = newReq(offset)
+			resp = &kt.FetchResponse{}
+		)
+		if err = r.getCaller(node).Call(r.fetchRPCMethod, req, resp); err != nil {
+			err = errors.Wrapf(err, "fetch chunk at %d failed", offset)
+			return
+		}
+		if len(resp.SnapshotChunk) == 0 || offset+uint64(len(resp.SnapshotChunk)) > size {
+			err = errors.Wrapf(kt.ErrInvalidLog, "invalid chunk at %d", offset)
+			return
+		}
+		if _, err = f.Write(resp.SnapshotChunk); err != nil {
+			err = errors.Wrap(err, "write file failed")
+			return
+		}
+		offset += uint64(len(resp.SnapshotChunk))
+	}
+
+	if err = f.Sync(); err != nil {
+		err = errors.Wrap(err, "sync file failed")
+		return
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		err = errors.Wrap(err, "close file failed")
+		return
+	}
+	if err = os.Rename(temp, file); err != nil {
+		err = errors.Wrap(err, "rename file failed")
+	}
+	return
+}
+
+// FetchSnapshot returns the chunk of the snapshot file at offset, the snapshot must be the
+// latest one.
+func (r *Runtime) FetchSnapshot(ctx context.Context, index uint64, offset uint64) (chunk []byte, err error) {
+	if atomic.LoadUint32(&r.started) != 1 {
+		err = kt.ErrStopped
+		return
+	}
+
+	defer trace.StartRegion(ctx, "fetchSnapshot").End()
+
+	r.snapshotLock.Lock()
+	defer r.snapshotLock.Unlock()
+
+	if current := atomic.LoadUint64(&r.snapshotIndex); index == 0 || index != current {
+		err = errors.Wrapf(kt.ErrLogCompacted, "snapshot %d is replaced by %d", index, current)
+		return
+	}
+
+	return readChunk(r.snapshotFile(index), offset)
+}
+
+// AttachmentFile returns the file path of the named attachment. Attachments are files referred by
+// the logs, e.g. the archive of a database restore, which are kept in the snapshot directory and
+// fetched by the followers in chunks like snapshots.
+func (r *Runtime) AttachmentFile(name string) string {
+	return filepath.Join(r.snapshotDir, name+attachmentFileExt)
+}
+
+// FetchAttachment returns the chunk of the named attachment file at offset.
+func (r *Runtime) FetchAttachment(ctx context.Context, name string, offset uint64) (chunk []byte, err error) {
+	if atomic.LoadUint32(&r.started) != 1 {
+		err = kt.ErrStopped
+		return
+	}
+
+	defer trace.StartRegion(ctx, "fetchAttachment").End()
+
+	if err = checkAttachmentName(name); err != nil {
+		return
+	}
+
+	return readChunk(r.AttachmentFile(name), offset)
+}
+
+// DownloadAttachment fetches the named attachment file of size from the leader chunk by chunk, it
+// returns the local file path of the attachment.
+func (r *Runtime) DownloadAttachment(ctx context.Context, name string, size uint64) (file string, err error) {
+	if err = checkAttachmentName(name); err != nil {
+		return
+	}
+
+	defer trace.StartRegion(ctx, "downloadAttachment").End()
+
+	file = r.AttachmentFile(name)
+	if _, err = os.Stat(file); err == nil {
+		// already downloaded or uploaded to this node
+		return
+	}
+
+	leader := r.Peers().Leader
+	if leader.IsEqual(&r.nodeID) {
+		err = errors.Wrapf(kt.ErrNotLeader, "attachment %s is missing in leader", name)
+		return
+	}
+
+	err = r.downloadFile(leader, file, size, func(offset uint64) *kt.FetchRequest {
+		return &kt.FetchRequest{
+			Instance:       r.instanceID,
+			Attachment:     name,
+			SnapshotOffset: offset,
+		}
+	})
+
+	return
+}
+
+// checkAttachmentName ensures the attachment name is a plain file name in the snapshot directory.
+func checkAttachmentName(name string) (err error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		err = errors.Wrapf(kt.ErrInvalidConfig, "invalid attachment name: %s", name)
+	}
+	return
+}
+
+// readChunk reads the chunk of file at offset.
+func readChunk(file string, offset uint64) (chunk []byte, err error) {
+	var (
+		f *os.File
+		n int
+	)
+	if f, err = os.Open(file); err != nil {
+		err = errors.Wrap(err, "open file failed")
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	chunk = make([]byte, snapshotChunkSize)
+	if n, err = f.ReadAt(chunk, int64(offset)); err == io.EOF && n > 0 {
+		err = nil
+	} else if err != nil {
+		err = errors.Wrapf(err, "read file at %d failed", offset)
+		chunk = nil
+		return
+	}
+	chunk = chunk[:n]
+
+	return
+}
+
+// installSnapshot replaces the fsm state and log indexes with snapshot from node, the snapshot
+// file is downloaded from node before commits are blocked.
+func (r *Runtime) installSnapshot(ctx context.Context, s *kt.Snapshot, node proto.NodeID) (err error) {
+	defer trace.StartRegion(ctx, "installSnapshot").End()
+
+	sh, sw, ok := r.snapshotEnabled()
+	if !ok {
+		err = errors.Wrap(kt.ErrInvalidConfig, "snapshot is not supported")
+		return
+	}
+
+	// concurrent fetches of compacted logs return the same snapshot, download it once
+	r.installLock.Lock()
+	defer r.installLock.Unlock()
+
+	if s.Index <= atomic.LoadUint64(&r.lastCommit) {
+		// already applied
+		return
+	}
+
+	// peers are supplied by the serving node, verify them before the snapshot is applied
+	if s.Peers != nil {
+		if err = r.verifySnapshotPeers(r.Peers(), s.Peers); err != nil {
+			return
+		}
+	}
+
+	if err = r.downloadSnapshot(ctx, node, s); err != nil {
+		return
+	}
+
+	if err = r.applySnapshot(ctx, sh, sw, s); err != nil {
+		return
+	}
+
+	// membership changes in the compacted logs take effect along with the snapshot
+	if s.Peers != nil {
+		if err = r.commitPeers(s.Peers); err != nil {
+			err = errors.Wrap(err, "commit snapshot peers failed")
+		}
+	}
+
+	return
+}
+
+// verifySnapshotPeers verifies the newer peers in snapshot are changed through LogConfig logs in
+// the current term, which are signed by the current leader or the signer of current peers. Peers
+// of new terms are only learned from heartbeats carrying the votes.
+func (r *Runtime) verifySnapshotPeers(current, peers *proto.Peers) (err error) {
+	if !isNewerPeers(peers, current) {
+		// not applied
+		return
+	}
+
+	if err = peers.Verify(); err != nil {
+		err = errors.Wrap(err, "verify snapshot peers failed")
+		return
+	}
+
+	if peers.Term != current.Term || !peers.Leader.IsEqual(&current.Leader) {
+		err = errors.Wrapf(kt.ErrUntrustedPeers, "snapshot peers of term %v led by %v, current term: %v",
+			peers.Term, peers.Leader, current.Term)
+		return
+	}
+
+	if current.Signee != nil && current.Signee.IsEqual(peers.Signee) {
+		return
+	}
+
+	if r.nodeKey == nil {
+		err = errors.Wrapf(kt.ErrUntrustedPeers, "snapshot peers of version %v not signed by peers signer",
+			peers.Version)
+		return
+	}
+
+	var key *asymmetric.PublicKey
+	if key, err = r.nodeKey(current.Leader); err != nil {
+		err = errors.Wrapf(err, "get public key of leader %v failed", current.Leader)
+		return
+	}
+
+	if !key.IsEqual(peers.Signee) {
+		err = errors.Wrapf(kt.ErrUntrustedPeers, "snapshot peers of version %v not signed by leader %v",
+			peers.Version, current.Leader)
+	}
+
+	return
+}
+
+// applySnapshot restores the fsm state from the snapshot file and replaces the log indexes.
+func (r *Runtime) applySnapshot(
+	ctx context.Context, sh kt.Snapshotter, sw kt.SnapshotWal, s *kt.Snapshot) (err error,
+) {
+	// block commits during snapshot install
+	r.commitLock.Lock()
+	defer r.commitLock.Unlock()
+
+	file := r.snapshotFile(s.Index)
+
+	if s.Index <= atomic.LoadUint64(&r.lastCommit) {
+		// already applied
+		_ = os.Remove(file)
+		return
+	}
+
+	if err = sh.Restore(s.Meta, file); err != nil {
+		_ = os.Remove(file)
+		err = errors.Wrap(err, "restore fsm snapshot failed")
+		return
+	}
+
+	// reset pending prepares to the ones in snapshot
+	truncateIndex := s.Index
+	r.pendingPreparesLock.Lock()
+	for i := range r.pendingPrepares {
+		if i <= s.Index {
+			delete(r.pendingPrepares, i)
+		}
+	}
+	r.pendingPreparesLock.Unlock()
+	for _, l := range s.Prepares {
+		if _, err = r.wal.Get(l.Index); err != nil {
+			if err = r.writeWAL(ctx, l); err != nil {
+				return
+			}
+		}
+		r.markPendingPrepare(ctx, l.Index)
+		if l.Index < truncateIndex {
+			truncateIndex = l.Index
+		}
+	}
+
+	if err = r.saveSnapshot(sw, s, truncateIndex); err != nil {
+		return
+	}
+
+	atomic.StoreUint64(&r.lastCommit, s.Index)
+	r.updateNextIndex(ctx, &kt.Log{LogHeader: kt.LogHeader{Index: s.Index}})
+
+	// wake up log waiters covered by the snapshot
+	r.waitLogMap.Range(func(rawIndex, _ interface{}) bool {
+		if index := rawIndex.(uint64); index <= s.Index {
+			r.triggerLogAwaits(index)
+		}
+		return true
+	})
+
+	log.WithFields(log.Fields{
+		"index":    s.Index,
+		"prepares": len(s.Prepares),
+		"size":     s.Size,
+		"instance": r.instanceID,
+	}).Info("kayak snapshot installed")
+
+	return
+}
+
+// CurrentSnapshot writes the snapshot of committed state at the last commit log to the file at
+// path, commits are only blocked while the state is pinned and logs are not compacted.
+func (r *Runtime) CurrentSnapshot(path string) (s *kt.Snapshot, err error) {
+	sh, ok := r.sh.(kt.Snapshotter)
+	if !ok {
+		err = errors.Wrap(kt.ErrInvalidConfig, "snapshot is not supported")
+		return
+	}
+
+	var (
+		write func(string) error
+		info  os.FileInfo
+	)
+	if s, write, err = func() (s *kt.Snapshot, write func(string) error, err error) {
+		// block commits while the state is pinned
+		r.commitLock.Lock()
+		defer r.commitLock.Unlock()
+
+		s = &kt.Snapshot{
+			Index: atomic.LoadUint64(&r.lastCommit),
+		}
+		if s.Meta, write, err = sh.Snapshot(); err != nil {
+			err = errors.Wrap(err, "pin fsm snapshot failed")
+		}
+		return
+	}(); err != nil {
+		return
+	}
+
+	if err = write(path); err != nil {
+		err = errors.Wrap(err, "dump fsm snapshot failed")
+		return
+	}
+	if info, err = os.Stat(path); err != nil {
+		err = errors.Wrap(err, "stat snapshot file failed")
+		return
+	}
+	s.Size = uint64(info.Size())
+
+	return
+}
+
+// isCompacted returns whether the log index is covered by snapshot.
+func (r *Runtime) isCompacted(index uint64) bool {
+	snapshotIndex := atomic.LoadUint64(&r.snapshotIndex)
+	return snapshotIndex > 0 && index <= snapshotIndex
+}
+
+// loadSnapshot returns the latest saved snapshot, nil if not exists.
+func (r *Runtime) loadSnapshot() (s *kt.Snapshot, err error) {
+	sw, ok := r.wal.(kt.SnapshotWal)
+	if !ok {
+		return
+	}
+
+	if s, err = sw.LoadSnapshot(); err != nil {
+		err = errors.Wrap(err, "load snapshot failed")
+	}
+
+	return
+}
+
+func (r *Runtime) getPendingPrepares() (indexes []uint64) {
+	r.pendingPreparesLock.RLock()
+	defer r.pendingPreparesLock.RUnlock()
+
+	indexes = make([]uint64, 0, len(r.pendingPrepares))
+	for i := range r.pendingPrepares {
+		indexes = append(indexes, i)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return
+}
@@ -51,9 +51,9 @@ type rpcTracker struct {
 	closed   uint32
 }
 
-func newTracker(r *Runtime, req interface{}, minCount int) (t *rpcTracker) {
+func newTracker(r *Runtime, nodes []proto.NodeID, req interface{}, minCount int) (t *rpcTracker) {
 	// copy nodes
-	nodes := append([]proto.NodeID(nil), r.followers...)
+	nodes = append([]proto.NodeID(nil), nodes...)
 
 	if minCount > len(nodes) {
 		minCount = len(nodes)
@@ -19,6 +19,7 @@ package types
 import (
 	"time"
 
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 )
 
@@ -50,4 +51,25 @@ type RuntimeConfig struct {
 	FetchMethodName string
 	// fetch timeout.
 	LogWaitTimeout time.Duration
+	// max leader silence before a follower starts leader election, election is disabled if not positive.
+	ElectionTimeout time.Duration
+	// leader heartbeat interval.
+	HeartbeatInterval time.Duration
+	// vote service method.
+	VoteMethodName string
+	// heartbeat service method.
+	HeartbeatMethodName string
+	// new member sync service method.
+	SyncMethodName string
+	// callback to publish peers changed by leader election, peers are updated in place if not set.
+	OnPeersChange func(peers *proto.Peers) error
+	// commit log count between snapshots, snapshot is disabled if zero.
+	SnapshotInterval uint64
+	// directory of the snapshot files, required by snapshot.
+	SnapshotDir string
+	// private key of current node to sign the peers of elected terms, required by election.
+	PrivateKey *asymmetric.PrivateKey
+	// returns the registered public key of node to verify the peers signed by leader, required
+	// by election.
+	NodeKey func(node proto.NodeID) (*asymmetric.PublicKey, error)
 }
@@ -35,4 +35,16 @@ var (
 	ErrInvalidConfig = errors.New("invalid runtime config")
 	// ErrStopped represents runtime not started.
 	ErrStopped = errors.New("stopped")
+	// ErrStaleTerm represents the supplied peers term is older than the current one.
+	ErrStaleTerm = errors.New("stale term")
+	// ErrElectionFailed represents failure for leader election.
+	ErrElectionFailed = errors.New("election failed")
+	// ErrLogCompacted represents the log is already compacted into snapshot.
+	ErrLogCompacted = errors.New("log compacted")
+	// ErrUntrustedPeers represents the peers are not signed by the leader.
+	ErrUntrustedPeers = errors.New("untrusted peers")
+	// ErrInvalidSender represents the request is not sent by the node it claims.
+	ErrInvalidSender = errors.New("invalid sender")
+	// ErrInvalidPeersChange represents the peers membership change is not allowed.
+	ErrInvalidPeersChange = errors.New("invalid peers change")
 )
@@ -23,3 +23,13 @@ type Handler interface {
 	Check(request interface{}) error
 	Commit(request interface{}, isLeader bool) (result interface{}, err error)
 }
+
+// Snapshotter defines the optional snapshot capability of the underlying fsm.
+type Snapshotter interface {
+	// Snapshot pins the committed fsm state, it's called with commits blocked and should return
+	// quickly. The write function is called exactly once after commits resume to write the pinned
+	// state described by meta to the file at path.
+	Snapshot() (meta []byte, write func(path string) error, err error)
+	// Restore replaces the fsm state with the snapshot file at path described by meta.
+	Restore(meta []byte, path string) error
+}
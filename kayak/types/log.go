@@ -36,6 +36,8 @@ const (
 	LogBarrier
 	// LogNoop defines noop log.
 	LogNoop
+	// LogConfig defines the prepare phase of a peers membership change.
+	LogConfig
 )
 
 func (t LogType) String() (s string) {
@@ -52,6 +54,8 @@ func (t LogType) String() (s string) {
 		return "LogBarrier"
 	case LogNoop:
 		return "LogNoop"
+	case LogConfig:
+		return "LogConfig"
 	default:
 		return "Unknown"
 	}
@@ -72,3 +76,18 @@ type Log struct {
 	// Data could be detected and handle decode properly by log layer
 	Data []byte
 }
+
+// Snapshot defines the fsm state snapshot at a commit log index.
+type Snapshot struct {
+	// Index is the last commit log index covered by the snapshot.
+	Index uint64
+	// Prepares are the uncommitted prepare logs at snapshot time.
+	Prepares []*Log
+	// Meta is the fsm state description returned by Snapshotter.
+	Meta []byte
+	// Size is the byte size of the snapshot file, the file is transferred in chunks by fetch.
+	Size uint64
+	// Peers are the peers in effect at the snapshot index, membership changes in compacted logs
+	// are re-applied from it on reload.
+	Peers *proto.Peers
+}
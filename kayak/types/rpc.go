@@ -16,7 +16,13 @@
 
 package types
 
-import "github.com/CovenantSQL/CovenantSQL/proto"
+import (
+	"encoding/binary"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
 
 // ApplyRequest defines the apply request entity.
 type ApplyRequest struct {
@@ -30,6 +36,11 @@ type FetchRequest struct {
 	proto.Envelope
 	Instance string
 	Index    uint64
+	// SnapshotIndex requests the chunk of snapshot file at SnapshotOffset instead of log if set.
+	SnapshotIndex  uint64
+	SnapshotOffset uint64
+	// Attachment requests the chunk of the named attachment file at SnapshotOffset if set.
+	Attachment string
 }
 
 // FetchResponse defines the fetch response entity.
@@ -37,4 +48,71 @@ type FetchResponse struct {
 	proto.Envelope
 	Instance string
 	Log      *Log
+	// Snapshot is returned instead of Log if the requested log is already compacted.
+	Snapshot *Snapshot
+	// SnapshotChunk is the requested chunk of snapshot file.
+	SnapshotChunk []byte
+}
+
+// VoteRequest defines the leader election vote request entity.
+type VoteRequest struct {
+	proto.Envelope
+	Instance   string
+	Term       uint64
+	Candidate  proto.NodeID
+	LastCommit uint64
+}
+
+// VoteResponse defines the leader election vote response entity.
+type VoteResponse struct {
+	proto.Envelope
+	Instance  string
+	Granted   bool
+	NextIndex uint64
+	// Signature is the signature of the granted vote by the voter, see VoteHash.
+	Signature *asymmetric.Signature
+}
+
+// GrantedVote defines a vote granted to the candidate, which is signed by the voter.
+type GrantedVote struct {
+	Voter     proto.NodeID
+	Signature *asymmetric.Signature
+}
+
+// VoteHash returns the hash signed by the voter to grant the vote of term to candidate.
+func VoteHash(instance string, term uint64, candidate proto.NodeID) hash.Hash {
+	var termBytes [8]byte
+	binary.BigEndian.PutUint64(termBytes[:], term)
+	buf := make([]byte, 0, len(instance)+len(termBytes)+len(candidate))
+	buf = append(buf, instance...)
+	buf = append(buf, termBytes[:]...)
+	buf = append(buf, candidate...)
+	return hash.THashH(buf)
+}
+
+// HeartbeatRequest defines the leader heartbeat request entity.
+type HeartbeatRequest struct {
+	proto.Envelope
+	Instance string
+	Peers    *proto.Peers
+	// Votes are the votes granted to the leader in the term of peers, which prove that the leader
+	// is elected by a quorum of servers.
+	Votes []*GrantedVote
+}
+
+// SyncRequest defines the new member sync request entity.
+type SyncRequest struct {
+	proto.Envelope
+	Instance string
+	// Snapshot is installed before the logs if the member is lagging behind the compacted logs.
+	Snapshot *Snapshot
+	Logs     []*Log
+}
+
+// SyncResponse defines the new member sync response entity.
+type SyncResponse struct {
+	proto.Envelope
+	Instance   string
+	LastCommit uint64
+	NextIndex  uint64
 }
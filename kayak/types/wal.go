@@ -16,6 +16,8 @@
 
 package types
 
+import "github.com/CovenantSQL/CovenantSQL/proto"
+
 // Wal defines the log storage interface.
 type Wal interface {
 	// sequential write
@@ -25,3 +27,28 @@ type Wal interface {
 	// random access
 	Get(index uint64) (*Log, error)
 }
+
+// SnapshotWal defines the log storage which supports snapshot and log compaction.
+type SnapshotWal interface {
+	Wal
+	// save snapshot and truncate logs with index less than truncateIndex
+	SaveSnapshot(s *Snapshot, truncateIndex uint64) error
+	// load latest saved snapshot, return nil if there is no snapshot
+	LoadSnapshot() (*Snapshot, error)
+}
+
+// Vote defines the leader election vote granted by the node.
+type Vote struct {
+	Term      uint64
+	Candidate proto.NodeID
+}
+
+// ElectionWal defines the log storage which persists the election vote, so that a restarted node
+// never votes twice in the same term.
+type ElectionWal interface {
+	Wal
+	// save the vote, the previous vote is overwritten
+	SaveVote(v *Vote) error
+	// load the latest saved vote, return nil if there is no vote
+	LoadVote() (*Vote, error)
+}
@@ -23,6 +23,7 @@ import (
 
 	kt "github.com/CovenantSQL/CovenantSQL/kayak/types"
 	"github.com/CovenantSQL/CovenantSQL/utils/trace"
+	"github.com/pkg/errors"
 )
 
 type waitItem struct {
@@ -48,6 +49,12 @@ func (r *Runtime) waitForLog(ctx context.Context, index uint64) (l *kt.Log, err
 			return
 		}
 
+		if r.isCompacted(index) {
+			// will never be fetched
+			err = errors.Wrapf(kt.ErrLogCompacted, "log %d", index)
+			return
+		}
+
 		rawItem, _ := r.waitLogMap.LoadOrStore(index, newWaitItem(index))
 		item := rawItem.(*waitItem)
 
@@ -27,4 +27,6 @@ var (
 	ErrAlreadyExists = errors.New("log already exists")
 	// ErrNotExists represents the log does not exists.
 	ErrNotExists = errors.New("log not exists")
+	// ErrInvalidSnapshot represents the snapshot object is invalid.
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
 )
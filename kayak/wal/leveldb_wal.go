@@ -28,6 +28,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -36,6 +37,10 @@ var (
 	logHeaderKeyPrefix = []byte{'L', 'H'}
 	// logDataKeyPrefix defines the leveldb data key prefix.
 	logDataKeyPrefix = []byte{'L', 'D'}
+	// snapshotKey defines the leveldb key of latest snapshot.
+	snapshotKey = []byte{'S', 'S'}
+	// voteKey defines the leveldb key of latest election vote.
+	voteKey = []byte{'V', 'T'}
 )
 
 // LevelDBWal defines a toy wal using leveldb as storage.
@@ -166,6 +171,7 @@ func (p *LevelDBWal) Get(i uint64) (l *kt.Log, err error) {
 	var headerData []byte
 	if headerData, err = p.db.Get(headerKey, nil); err == leveldb.ErrNotFound {
 		err = ErrNotExists
+		return
 	} else if err != nil {
 		err = errors.Wrap(err, "get log header failed")
 		return
@@ -174,6 +180,121 @@ func (p *LevelDBWal) Get(i uint64) (l *kt.Log, err error) {
 	return p.load(headerData)
 }
 
+// SaveSnapshot implements SnapshotWal.SaveSnapshot.
+func (p *LevelDBWal) SaveSnapshot(s *kt.Snapshot, truncateIndex uint64) (err error) {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		err = ErrWalClosed
+		return
+	}
+
+	if s == nil {
+		err = ErrInvalidSnapshot
+		return
+	}
+
+	var enc *bytes.Buffer
+	if enc, err = utils.EncodeMsgPack(s); err != nil {
+		err = errors.Wrap(err, "encode snapshot failed")
+		return
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(snapshotKey, enc.Bytes())
+
+	// remove logs below truncate index
+	for _, prefix := range [][]byte{logHeaderKeyPrefix, logDataKeyPrefix} {
+		it := p.db.NewIterator(&util.Range{
+			Start: append(append([]byte(nil), prefix...), p.uint64ToBytes(0)...),
+			Limit: append(append([]byte(nil), prefix...), p.uint64ToBytes(truncateIndex)...),
+		}, nil)
+		for it.Next() {
+			batch.Delete(append([]byte(nil), it.Key()...))
+		}
+		it.Release()
+		if err = it.Error(); err != nil {
+			err = errors.Wrap(err, "iterate compacted logs failed")
+			return
+		}
+	}
+
+	if err = p.db.Write(batch, nil); err != nil {
+		err = errors.Wrap(err, "write snapshot failed")
+	}
+
+	return
+}
+
+// LoadSnapshot implements SnapshotWal.LoadSnapshot.
+func (p *LevelDBWal) LoadSnapshot() (s *kt.Snapshot, err error) {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		err = ErrWalClosed
+		return
+	}
+
+	var enc []byte
+	if enc, err = p.db.Get(snapshotKey, nil); err == leveldb.ErrNotFound {
+		err = nil
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "get snapshot failed")
+		return
+	}
+
+	s = new(kt.Snapshot)
+	if err = utils.DecodeMsgPack(enc, s); err != nil {
+		err = errors.Wrap(err, "decode snapshot failed")
+		s = nil
+	}
+
+	return
+}
+
+// SaveVote implements ElectionWal.SaveVote.
+func (p *LevelDBWal) SaveVote(v *kt.Vote) (err error) {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		err = ErrWalClosed
+		return
+	}
+
+	var enc *bytes.Buffer
+	if enc, err = utils.EncodeMsgPack(v); err != nil {
+		err = errors.Wrap(err, "encode vote failed")
+		return
+	}
+
+	// the vote must be durable before it's granted
+	if err = p.db.Put(voteKey, enc.Bytes(), &opt.WriteOptions{Sync: true}); err != nil {
+		err = errors.Wrap(err, "write vote failed")
+	}
+
+	return
+}
+
+// LoadVote implements ElectionWal.LoadVote.
+func (p *LevelDBWal) LoadVote() (v *kt.Vote, err error) {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		err = ErrWalClosed
+		return
+	}
+
+	var enc []byte
+	if enc, err = p.db.Get(voteKey, nil); err == leveldb.ErrNotFound {
+		err = nil
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "get vote failed")
+		return
+	}
+
+	v = new(kt.Vote)
+	if err = utils.DecodeMsgPack(enc, v); err != nil {
+		err = errors.Wrap(err, "decode vote failed")
+		v = nil
+	}
+
+	return
+}
+
 // Close implements Wal.Close.
 func (p *LevelDBWal) Close() {
 	if !atomic.CompareAndSwapUint32(&p.closed, 0, 1) {
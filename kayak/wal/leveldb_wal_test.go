@@ -144,3 +144,105 @@ func TestLevelDBWal_Write(t *testing.T) {
 		So(err, ShouldNotBeNil)
 	})
 }
+
+func TestLevelDBWal_Snapshot(t *testing.T) {
+	Convey("wal snapshot/truncate", t, func() {
+		dbFile := "testSnapshot.ldb"
+
+		p, err := NewLevelDBWal(dbFile)
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dbFile)
+
+		s, err := p.LoadSnapshot()
+		So(err, ShouldBeNil)
+		So(s, ShouldBeNil)
+
+		for i := 0; i != 10; i++ {
+			err = p.Write(&kt.Log{
+				LogHeader: kt.LogHeader{
+					Index: uint64(i),
+					Type:  kt.LogPrepare,
+				},
+				Data: []byte("happy"),
+			})
+			So(err, ShouldBeNil)
+		}
+
+		err = p.SaveSnapshot(nil, 5)
+		So(err, ShouldEqual, ErrInvalidSnapshot)
+
+		err = p.SaveSnapshot(&kt.Snapshot{
+			Index: 6,
+			Meta:  []byte("snapshot"),
+		}, 5)
+		So(err, ShouldBeNil)
+
+		for i := 0; i != 10; i++ {
+			_, err = p.Get(uint64(i))
+			if i < 5 {
+				So(err, ShouldEqual, ErrNotExists)
+			} else {
+				So(err, ShouldBeNil)
+			}
+		}
+		p.Close()
+
+		_, err = p.LoadSnapshot()
+		So(err, ShouldEqual, ErrWalClosed)
+		err = p.SaveSnapshot(&kt.Snapshot{}, 0)
+		So(err, ShouldEqual, ErrWalClosed)
+
+		// load again
+		p, err = NewLevelDBWal(dbFile)
+		So(err, ShouldBeNil)
+		defer p.Close()
+
+		s, err = p.LoadSnapshot()
+		So(err, ShouldBeNil)
+		So(s.Index, ShouldEqual, 6)
+		So(s.Meta, ShouldResemble, []byte("snapshot"))
+
+		var l *kt.Log
+		for i := 5; i != 10; i++ {
+			l, err = p.Read()
+			So(err, ShouldBeNil)
+			So(l.Index, ShouldEqual, i)
+		}
+		_, err = p.Read()
+		So(err, ShouldEqual, io.EOF)
+	})
+}
+
+func TestLevelDBWal_Vote(t *testing.T) {
+	Convey("wal vote save/load", t, func() {
+		dbFile := "testVote.ldb"
+
+		p, err := NewLevelDBWal(dbFile)
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dbFile)
+
+		v, err := p.LoadVote()
+		So(err, ShouldBeNil)
+		So(v, ShouldBeNil)
+
+		node1 := proto.NodeID("000005aa62048f85da4ae9698ed59c14ec0d48a88a07c15a32265634e7e64ade")
+		node2 := proto.NodeID("000005f4f22c06f76c43c4f48d5a7ec1309cc94030cbf9ebae814172884ac8b5")
+		err = p.SaveVote(&kt.Vote{Term: 1, Candidate: node1})
+		So(err, ShouldBeNil)
+		err = p.SaveVote(&kt.Vote{Term: 2, Candidate: node2})
+		So(err, ShouldBeNil)
+		p.Close()
+
+		err = p.SaveVote(&kt.Vote{Term: 3})
+		So(err, ShouldEqual, ErrWalClosed)
+
+		// the vote survives restart
+		p, err = NewLevelDBWal(dbFile)
+		So(err, ShouldBeNil)
+		defer p.Close()
+
+		v, err = p.LoadVote()
+		So(err, ShouldBeNil)
+		So(v, ShouldResemble, &kt.Vote{Term: 2, Candidate: node2})
+	})
+}
@@ -31,6 +31,8 @@ type MemWal struct {
 	revIndex map[uint64]int
 	offset   uint64
 	closed   uint32
+	snapshot *kt.Snapshot
+	vote     *kt.Vote
 }
 
 // NewMemWal returns new memory wal instance.
@@ -105,6 +107,83 @@ func (p *MemWal) Get(index uint64) (l *kt.Log, err error) {
 	return
 }
 
+// SaveSnapshot implements SnapshotWal.SaveSnapshot.
+func (p *MemWal) SaveSnapshot(s *kt.Snapshot, truncateIndex uint64) (err error) {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		err = ErrWalClosed
+		return
+	}
+
+	if s == nil {
+		err = ErrInvalidSnapshot
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.snapshot = s
+
+	// remove logs below truncate index
+	logs := make([]*kt.Log, 0, len(p.logs))
+	for _, l := range p.logs {
+		if l.Index >= truncateIndex {
+			logs = append(logs, l)
+		} else {
+			delete(p.revIndex, l.Index)
+		}
+	}
+	for i, l := range logs {
+		p.revIndex[l.Index] = i
+	}
+	p.logs = logs
+	atomic.StoreUint64(&p.offset, uint64(len(logs)))
+
+	return
+}
+
+// LoadSnapshot implements SnapshotWal.LoadSnapshot.
+func (p *MemWal) LoadSnapshot() (s *kt.Snapshot, err error) {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		err = ErrWalClosed
+		return
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	s = p.snapshot
+	return
+}
+
+// SaveVote implements ElectionWal.SaveVote.
+func (p *MemWal) SaveVote(v *kt.Vote) (err error) {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		err = ErrWalClosed
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.vote = v
+	return
+}
+
+// LoadVote implements ElectionWal.LoadVote.
+func (p *MemWal) LoadVote() (v *kt.Vote, err error) {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		err = ErrWalClosed
+		return
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	v = p.vote
+	return
+}
+
 // Close implements Wal.Close.
 func (p *MemWal) Close() {
 	if !atomic.CompareAndSwapUint32(&p.closed, 0, 1) {
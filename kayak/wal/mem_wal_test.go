@@ -187,3 +187,67 @@ func TestMemWal_Write2(t *testing.T) {
 		So(p.offset, ShouldEqual, 5)
 	})
 }
+
+func TestMemWal_Snapshot(t *testing.T) {
+	Convey("test mem wal snapshot", t, func() {
+		p := NewMemWal()
+
+		s, err := p.LoadSnapshot()
+		So(err, ShouldBeNil)
+		So(s, ShouldBeNil)
+
+		for i := 0; i != 10; i++ {
+			err = p.Write(&kt.Log{
+				LogHeader: kt.LogHeader{
+					Index: uint64(i),
+					Type:  kt.LogPrepare,
+				},
+				Data: []byte("happy"),
+			})
+			So(err, ShouldBeNil)
+		}
+
+		err = p.SaveSnapshot(nil, 5)
+		So(err, ShouldEqual, ErrInvalidSnapshot)
+
+		snap := &kt.Snapshot{Index: 6}
+		err = p.SaveSnapshot(snap, 5)
+		So(err, ShouldBeNil)
+		So(p.logs, ShouldHaveLength, 5)
+		So(p.revIndex, ShouldHaveLength, 5)
+		So(p.offset, ShouldEqual, 5)
+
+		var l *kt.Log
+		for i := 0; i != 10; i++ {
+			l, err = p.Get(uint64(i))
+			if i < 5 {
+				So(err, ShouldEqual, ErrNotExists)
+			} else {
+				So(err, ShouldBeNil)
+				So(l.Index, ShouldEqual, i)
+			}
+		}
+
+		// write after truncate
+		err = p.Write(&kt.Log{
+			LogHeader: kt.LogHeader{
+				Index: 10,
+				Type:  kt.LogPrepare,
+			},
+		})
+		So(err, ShouldBeNil)
+		l, err = p.Get(10)
+		So(err, ShouldBeNil)
+		So(l.Index, ShouldEqual, 10)
+
+		s, err = p.LoadSnapshot()
+		So(err, ShouldBeNil)
+		So(s, ShouldEqual, snap)
+
+		p.Close()
+		_, err = p.LoadSnapshot()
+		So(err, ShouldEqual, ErrWalClosed)
+		err = p.SaveSnapshot(snap, 0)
+		So(err, ShouldEqual, ErrWalClosed)
+	})
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package merkle
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+)
+
+var (
+	// ErrIndexOutOfRange indicates the leaf index to prove is not in the tree.
+	ErrIndexOutOfRange = errors.New("leaf index out of range")
+	// ErrInvalidProof indicates a malformed serialized proof.
+	ErrInvalidProof = errors.New("invalid merkle proof")
+)
+
+// maxProofDepth is the max count of siblings in a proof, which is bounded by the direction bits.
+const maxProofDepth = 64
+
+// Proof is a merkle inclusion proof of a leaf, the siblings are ordered from the leaf level up to
+// the root, bit i of Directions is set if the sibling at level i is on the left.
+type Proof struct {
+	Siblings   []hash.Hash
+	Directions uint64
+}
+
+// Proof returns the inclusion proof of the leaf at index.
+func (merkle *Merkle) Proof(index int) (proof *Proof, err error) {
+	width := uint64(len(merkle.tree)+1) / 2
+	if index < 0 || uint64(index) >= width || merkle.tree[index] == nil {
+		err = ErrIndexOutOfRange
+		return
+	}
+	proof = &Proof{}
+	for i, start, level := uint64(index), uint64(0), uint(0); width > 1; level++ {
+		node, sibling := merkle.tree[start+i], merkle.tree[start+(i^1)]
+		if sibling == nil {
+			// the node without right sibling is merged with itself
+			sibling = node
+		}
+		proof.Siblings = append(proof.Siblings, *sibling)
+		if i&1 == 1 {
+			proof.Directions |= 1 << level
+		}
+		start += width
+		width /= 2
+		i /= 2
+	}
+	return
+}
+
+// Root computes the merkle root from the leaf with proof.
+func (p *Proof) Root(leaf *hash.Hash) *hash.Hash {
+	root := leaf
+	for i := range p.Siblings {
+		if p.Directions&(1<<uint(i)) != 0 {
+			root = MergeTwoHash(&p.Siblings[i], root)
+		} else {
+			root = MergeTwoHash(root, &p.Siblings[i])
+		}
+	}
+	return root
+}
+
+// Verify returns whether the leaf is included in the tree of root with proof.
+func (p *Proof) Verify(leaf, root *hash.Hash) bool {
+	return p.Root(leaf).IsEqual(root)
+}
+
+// VerifyProof returns whether the leaf is included in the tree of root with the serialized proof.
+func VerifyProof(leaf, root *hash.Hash, data []byte) bool {
+	var p Proof
+	if err := p.UnmarshalBinary(data); err != nil {
+		return false
+	}
+	return p.Verify(leaf, root)
+}
+
+// MarshalBinary encodes the proof as the uvarint directions and sibling count followed by the
+// sibling hashes.
+func (p *Proof) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 0, 2*binary.MaxVarintLen64+len(p.Siblings)*hash.HashSize)
+	data = appendUvarint(data, p.Directions)
+	data = appendUvarint(data, uint64(len(p.Siblings)))
+	for i := range p.Siblings {
+		data = append(data, p.Siblings[i][:]...)
+	}
+	return
+}
+
+// UnmarshalBinary decodes the proof encoded by MarshalBinary.
+func (p *Proof) UnmarshalBinary(data []byte) (err error) {
+	directions, n := binary.Uvarint(data)
+	if n <= 0 {
+		return ErrInvalidProof
+	}
+	data = data[n:]
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > maxProofDepth {
+		return ErrInvalidProof
+	}
+	data = data[n:]
+	if uint64(len(data)) != count*hash.HashSize || directions>>count != 0 {
+		return ErrInvalidProof
+	}
+	p.Directions = directions
+	p.Siblings = make([]hash.Hash, count)
+	for i := range p.Siblings {
+		copy(p.Siblings[i][:], data[i*hash.HashSize:])
+	}
+	return
+}
+
+func appendUvarint(data []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutUvarint(buf[:], v)]...)
+}
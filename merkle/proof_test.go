@@ -0,0 +1,112 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package merkle
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func randomLeaves(n int) (leaves []*hash.Hash) {
+	leaves = make([]*hash.Hash, n)
+	for i := range leaves {
+		leaves[i] = &hash.Hash{}
+		rand.Read(leaves[i][:])
+	}
+	return
+}
+
+func TestProof(t *testing.T) {
+	Convey("Proofs of all leaves should be verified against the root", t, func() {
+		for _, n := range []int{1, 2, 3, 4, 5, 7, 8, 9, 33} {
+			leaves := randomLeaves(n)
+			tree := NewMerkle(leaves)
+			root := tree.GetRoot()
+			for i, leaf := range leaves {
+				proof, err := tree.Proof(i)
+				So(err, ShouldBeNil)
+				So(proof.Root(leaf), ShouldResemble, root)
+				So(proof.Verify(leaf, root), ShouldBeTrue)
+				// the proof doesn't hold for other leaves
+				for j, other := range leaves {
+					if j != i && !other.IsEqual(leaf) {
+						So(proof.Verify(other, root), ShouldBeFalse)
+					}
+				}
+			}
+		}
+	})
+	Convey("Proof of the empty tree should prove the empty leaf", t, func() {
+		tree := NewMerkle(nil)
+		proof, err := tree.Proof(0)
+		So(err, ShouldBeNil)
+		So(proof.Siblings, ShouldBeEmpty)
+		So(proof.Verify(&hash.Hash{}, tree.GetRoot()), ShouldBeTrue)
+	})
+	Convey("Proof should be rejected for the leaves out of range", t, func() {
+		tree := NewMerkle(randomLeaves(5))
+		_, err := tree.Proof(-1)
+		So(err, ShouldEqual, ErrIndexOutOfRange)
+		_, err = tree.Proof(5)
+		So(err, ShouldEqual, ErrIndexOutOfRange)
+		_, err = tree.Proof(8)
+		So(err, ShouldEqual, ErrIndexOutOfRange)
+	})
+	Convey("Tampered proof should not be verified", t, func() {
+		leaves := randomLeaves(6)
+		tree := NewMerkle(leaves)
+		proof, err := tree.Proof(3)
+		So(err, ShouldBeNil)
+		So(proof.Directions, ShouldEqual, 3)
+		proof.Directions ^= 4
+		So(proof.Verify(leaves[3], tree.GetRoot()), ShouldBeFalse)
+		proof.Directions ^= 4
+		proof.Siblings[1][0]++
+		So(proof.Verify(leaves[3], tree.GetRoot()), ShouldBeFalse)
+	})
+}
+
+func TestProofSerialization(t *testing.T) {
+	Convey("Serialized proof should be decoded and verified", t, func() {
+		leaves := randomLeaves(9)
+		tree := NewMerkle(leaves)
+		proof, err := tree.Proof(8)
+		So(err, ShouldBeNil)
+		data, err := proof.MarshalBinary()
+		So(err, ShouldBeNil)
+		So(len(data), ShouldEqual, 2+len(proof.Siblings)*hash.HashSize)
+
+		var decoded Proof
+		So(decoded.UnmarshalBinary(data), ShouldBeNil)
+		So(&decoded, ShouldResemble, proof)
+		So(VerifyProof(leaves[8], tree.GetRoot(), data), ShouldBeTrue)
+		So(VerifyProof(leaves[7], tree.GetRoot(), data), ShouldBeFalse)
+
+		Convey("Malformed data should be rejected", func() {
+			So(decoded.UnmarshalBinary(nil), ShouldEqual, ErrInvalidProof)
+			So(decoded.UnmarshalBinary(data[:len(data)-1]), ShouldEqual, ErrInvalidProof)
+			So(decoded.UnmarshalBinary(append(data, 0)), ShouldEqual, ErrInvalidProof)
+			// direction bits beyond the siblings
+			bad := append([]byte{0xff, 0x01}, data[1:]...)
+			So(decoded.UnmarshalBinary(bad), ShouldEqual, ErrInvalidProof)
+			So(VerifyProof(leaves[8], tree.GetRoot(), bad), ShouldBeFalse)
+		})
+	})
+}
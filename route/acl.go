@@ -81,6 +81,26 @@ const (
 	DBSSubscribeTransactions
 	// DBSCancelSubscription is used by dbms to handle observer subscription cancellation request
 	DBSCancelSubscription
+	// DBSQueryPeers is used by client to query the current peers of database
+	DBSQueryPeers
+	// DBSBackup is used by client to take backup of database
+	DBSBackup
+	// DBSRestore is used by client to restore database from backup
+	DBSRestore
+	// DBSQueryUsage is used by client to query the resource usage of database
+	DBSQueryUsage
+	// DBSSetRateLimit is used by client to update the query rate limits of database
+	DBSSetRateLimit
+	// DBSSetQueryLimit is used by client to update the read query limits of database
+	DBSSetQueryLimit
+	// DBSFetchChanges is used by client to fetch the captured row changes of database
+	DBSFetchChanges
+	// DBSOpenCursor is used by client to open a server-side cursor of read query
+	DBSOpenCursor
+	// DBSFetchCursor is used by client to fetch the following rows of cursor
+	DBSFetchCursor
+	// DBSCloseCursor is used by client to close the cursor
+	DBSCloseCursor
 	// DBCCall is used by Miner for data consistency
 	DBCCall
 	// SQLCAdviseNewBlock is used by sqlchain to advise new block between adjacent node
@@ -91,12 +111,16 @@ const (
 	SQLCAdviseAckedQuery
 	// SQLCFetchBlock is used by sqlchain to fetch block from adjacent nodes
 	SQLCFetchBlock
+	// SQLCFetchInclusion is used by client to fetch block header with response inclusion proof
+	SQLCFetchInclusion
 	// SQLCSignBilling is used by sqlchain to response billing signature for periodic billing request
 	SQLCSignBilling
 	// SQLCLaunchBilling is used by blockproducer to trigger the billing process in sqlchain
 	SQLCLaunchBilling
 	// OBSAdviseNewBlock is used by sqlchain to push new block to observers
 	OBSAdviseNewBlock
+	// OBSFetchBlock is used by nodes to fetch sqlchain block from observers
+	OBSFetchBlock
 	// MCCAdviseNewBlock is used by block producer to push block to adjacent nodes
 	MCCAdviseNewBlock
 	// MCCAdviseTxBilling is used by block producer to push billing transaction to adjacent nodes
@@ -157,6 +181,26 @@ func (s RemoteFunc) String() string {
 		return "DBS.SubscribeTransactions"
 	case DBSCancelSubscription:
 		return "DBS.CancelSubscription"
+	case DBSQueryPeers:
+		return "DBS.QueryPeers"
+	case DBSBackup:
+		return "DBS.Backup"
+	case DBSRestore:
+		return "DBS.Restore"
+	case DBSQueryUsage:
+		return "DBS.QueryUsage"
+	case DBSSetRateLimit:
+		return "DBS.SetRateLimit"
+	case DBSSetQueryLimit:
+		return "DBS.SetQueryLimit"
+	case DBSFetchChanges:
+		return "DBS.FetchChanges"
+	case DBSOpenCursor:
+		return "DBS.OpenCursor"
+	case DBSFetchCursor:
+		return "DBS.FetchCursor"
+	case DBSCloseCursor:
+		return "DBS.CloseCursor"
 	case DBCCall:
 		return "DBC.Call"
 	case SQLCAdviseNewBlock:
@@ -167,12 +211,16 @@ func (s RemoteFunc) String() string {
 		return "SQLC.AdviseAckedQuery"
 	case SQLCFetchBlock:
 		return "SQLC.FetchBlock"
+	case SQLCFetchInclusion:
+		return "SQLC.FetchInclusion"
 	case SQLCSignBilling:
 		return "SQLC.SignBilling"
 	case SQLCLaunchBilling:
 		return "SQLC.LaunchBilling"
 	case OBSAdviseNewBlock:
 		return "OBS.AdviseNewBlock"
+	case OBSFetchBlock:
+		return "OBS.FetchBlock"
 	case MCCAdviseNewBlock:
 		return "MCC.AdviseNewBlock"
 	case MCCAdviseTxBilling:
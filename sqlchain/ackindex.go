@@ -105,6 +105,23 @@ func (i *multiAckIndex) remove(ack *types.SignedAckHeader) (err error) {
 	return
 }
 
+func (i *multiAckIndex) response(key types.QueryKey) (resp *types.ResponseHeader, ok bool) {
+	i.RLock()
+	defer i.RUnlock()
+	var (
+		sresp *types.SignedResponseHeader
+		ack   *types.SignedAckHeader
+	)
+	if sresp, ok = i.respIndex[key]; ok {
+		resp = &sresp.ResponseHeader
+		return
+	}
+	if ack, ok = i.ackIndex[key]; ok {
+		resp = &ack.Response
+	}
+	return
+}
+
 func (i *multiAckIndex) acks() (ret []*types.SignedAckHeader) {
 	i.RLock()
 	defer i.RUnlock()
@@ -221,6 +238,17 @@ func (i *ackIndex) remove(h int32, ack *types.SignedAckHeader) (err error) {
 	return mi.remove(ack)
 }
 
+func (i *ackIndex) response(h int32, key types.QueryKey) (resp *types.ResponseHeader, ok bool) {
+	var mi *multiAckIndex
+	i.RLock()
+	mi, ok = i.hi[h]
+	i.RUnlock()
+	if !ok {
+		return
+	}
+	return mi.response(key)
+}
+
 func (i *ackIndex) acks(h int32) (ret []*types.SignedAckHeader) {
 	var b = func() int32 {
 		i.RLock()
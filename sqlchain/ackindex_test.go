@@ -54,5 +54,22 @@ func TestAckIndex(t *testing.T) {
 			err = ai.remove(0, ack)
 			So(err, ShouldBeNil)
 		})
+		Convey("Indexed response should be found before and after ack", func() {
+			var key = resp.Request.GetQueryKey()
+			_, ok := ai.response(0, key)
+			So(ok, ShouldBeFalse)
+			err = ai.addResponse(0, resp)
+			So(err, ShouldBeNil)
+			hdr, ok := ai.response(0, key)
+			So(ok, ShouldBeTrue)
+			So(hdr, ShouldResemble, &resp.ResponseHeader)
+			err = ai.register(0, ack)
+			So(err, ShouldBeNil)
+			hdr, ok = ai.response(0, key)
+			So(ok, ShouldBeTrue)
+			So(hdr, ShouldResemble, &ack.Response)
+			_, ok = ai.response(1, key)
+			So(ok, ShouldBeFalse)
+		})
 	})
 }
@@ -30,7 +30,9 @@ import (
 
 	"github.com/CovenantSQL/CovenantSQL/crypto"
 	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/crypto/kms"
+	"github.com/CovenantSQL/CovenantSQL/merkle"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/route"
 	"github.com/CovenantSQL/CovenantSQL/rpc"
@@ -128,6 +130,9 @@ type Chain struct {
 	// replCh defines the replication trigger channel for replication check.
 	replCh chan struct{}
 
+	// hist retains the state history for the historical reads, nil if disabled.
+	hist *history
+
 	// Cached fileds, may need to renew some of this fields later.
 	//
 	// pk is the private key of the local miner.
@@ -220,9 +225,12 @@ func NewChainWithContext(ctx context.Context, c *Config) (chain *Chain, err erro
 		observerReplicators: make(map[proto.NodeID]*observerReplicator),
 		replCh:              make(chan struct{}),
 
+		hist: newHistory(c),
+
 		pk:   pk,
 		addr: &addr,
 	}
+	chain.st.SetChangeRetention(c.ChangeRetention)
 
 	if err = chain.pushBlock(c.Genesis); err != nil {
 		return nil, err
@@ -300,9 +308,12 @@ func LoadChainWithContext(ctx context.Context, c *Config) (chain *Chain, err err
 		observerReplicators: make(map[proto.NodeID]*observerReplicator),
 		replCh:              make(chan struct{}),
 
+		hist: newHistory(c),
+
 		pk:   pk,
 		addr: &addr,
 	}
+	chain.st.SetChangeRetention(c.ChangeRetention)
 
 	// Read state struct
 	stateEnc, err := chain.bdb.Get(metaState[:], nil)
@@ -477,6 +488,9 @@ func (c *Chain) pushBlock(b *types.Block) (err error) {
 	}
 	c.rt.setHead(st)
 	c.bi.addBlock(node)
+	if c.hist != nil {
+		c.hist.notify()
+	}
 
 	// Keep track of the queries from the new block
 	var ierr error
@@ -956,6 +970,12 @@ func (c *Chain) Start() (err error) {
 	c.rt.goFunc(c.processBlocks)
 	c.rt.goFunc(c.mainCycle)
 	c.rt.goFunc(c.replicationCycle)
+	if c.hist != nil {
+		if err = c.hist.open(); err != nil {
+			return
+		}
+		c.rt.goFunc(c.historyCycle)
+	}
 	c.rt.startService(c)
 	return
 }
@@ -974,6 +994,9 @@ func (c *Chain) Stop() (err error) {
 		"time": c.rt.getChainTimeString(),
 		"db":   c.databaseID,
 	}).Debug("chain service and workers stopped")
+	if c.hist != nil {
+		c.hist.close()
+	}
 	// Close LevelDB file
 	var ierr error
 	if ierr = c.bdb.Close(); ierr != nil && err == nil {
@@ -1027,6 +1050,28 @@ func (c *Chain) FetchBlock(height int32) (b *types.Block, err error) {
 	return
 }
 
+// FetchInclusion returns the header of the block at height with the serialized inclusion proof of
+// the response, the ack is also returned if the response is packed as an ack. The header is nil if
+// there is no block at this height, and the proof is nil if the response is not in the block.
+func (c *Chain) FetchInclusion(height int32, response *hash.Hash) (
+	header *types.SignedHeader, ack *types.SignedAckHeader, proof []byte, err error,
+) {
+	var b *types.Block
+	if b, err = c.FetchBlock(height); err != nil || b == nil {
+		return
+	}
+	header = &b.SignedHeader
+	if response.IsEqual(&hash.Hash{}) {
+		return
+	}
+	var p *merkle.Proof
+	if p, ack, err = b.ResponseProof(response); err != nil || p == nil {
+		return
+	}
+	proof, err = p.MarshalBinary()
+	return
+}
+
 // CheckAndPushNewBlock implements ChainRPCServer.CheckAndPushNewBlock.
 func (c *Chain) CheckAndPushNewBlock(block *types.Block) (err error) {
 	height := c.rt.getHeightFromTime(block.Timestamp())
@@ -1201,16 +1246,148 @@ func (c *Chain) replicationCycle(ctx context.Context) {
 func (c *Chain) Query(
 	req *types.Request, isLeader bool) (tracker *x.QueryTracker, resp *types.Response, err error,
 ) {
+	if req.Header.AsOfHeight != 0 {
+		return c.queryAsOf(req)
+	}
 	// TODO(leventeliu): we're using an external context passed by request. Make sure that
 	// cancelling will be propagated to this context before chain instance stops.
 	return c.st.QueryWithContext(req.GetContext(), req, isLeader)
 }
 
+// OpenCursor runs the read query of req in a server-side cursor of the local chain state, see
+// xenomint.State.OpenCursor for details.
+func (c *Chain) OpenCursor(req *types.Request, batch int) (
+	tracker *x.QueryTracker, resp *types.Response, cur *x.Cursor, err error,
+) {
+	if req.Header.AsOfHeight != 0 {
+		err = errors.Wrapf(x.ErrInvalidRequest, "cursor as of height %d", req.Header.AsOfHeight)
+		return
+	}
+	return c.st.OpenCursor(req.GetContext(), req, batch)
+}
+
+// queryAsOf queries the read request from the retained chain state as of the requested height.
+func (c *Chain) queryAsOf(
+	req *types.Request) (tracker *x.QueryTracker, resp *types.Response, err error,
+) {
+	if req.Header.QueryType != types.ReadQuery || req.Header.AsOfHeight < 0 {
+		err = errors.Wrapf(x.ErrInvalidRequest, "%s query as of height %d",
+			req.Header.QueryType, req.Header.AsOfHeight)
+		return
+	}
+	if c.hist == nil {
+		err = ErrHistoryDisabled
+		return
+	}
+	return c.hist.query(c, req)
+}
+
+// Head returns the height and block hash of the current chain head.
+func (c *Chain) Head() (height int32, head hash.Hash) {
+	st := c.rt.getHead()
+	return st.Height, st.Head
+}
+
+// snapshotMetaSize is the encoded size of SnapshotMeta.
+const snapshotMetaSize = 8 + 4 + hash.HashSize
+
+// SnapshotMeta describes the chain state pinned by snapshot.
+type SnapshotMeta struct {
+	// Seq is the state log offset.
+	Seq uint64
+	// Height and Head are the chain head captured under the state lock when the state is pinned,
+	// queries of blocks until the head are all included in the state.
+	Height int32
+	Head   hash.Hash
+}
+
+// Encode encodes the snapshot meta.
+func (m *SnapshotMeta) Encode() (meta []byte) {
+	meta = make([]byte, snapshotMetaSize)
+	binary.BigEndian.PutUint64(meta, m.Seq)
+	binary.BigEndian.PutUint32(meta[8:], uint32(m.Height))
+	copy(meta[12:], m.Head[:])
+	return
+}
+
+// DecodeSnapshotMeta decodes the snapshot meta returned by Snapshot.
+func DecodeSnapshotMeta(meta []byte) (m *SnapshotMeta, err error) {
+	if len(meta) != snapshotMetaSize {
+		err = errors.Errorf("invalid snapshot meta length: %d", len(meta))
+		return
+	}
+	m = &SnapshotMeta{
+		Seq:    binary.BigEndian.Uint64(meta),
+		Height: int32(binary.BigEndian.Uint32(meta[8:])),
+	}
+	copy(m.Head[:], meta[12:])
+	return
+}
+
+// Snapshot pins the local chain state, meta describes the pinned state and write copies it to the
+// database file at path.
+func (c *Chain) Snapshot() (meta []byte, write func(path string) error, err error) {
+	m := &SnapshotMeta{}
+	if m.Seq, write, err = c.st.Snapshot(func() {
+		st := c.rt.getHead()
+		m.Height, m.Head = st.Height, st.Head
+	}); err != nil {
+		return
+	}
+	meta = m.Encode()
+	return
+}
+
+// Restore replaces the local chain state with the database file at path described by meta.
+func (c *Chain) Restore(meta []byte, path string) (err error) {
+	var m *SnapshotMeta
+	if m, err = DecodeSnapshotMeta(meta); err != nil {
+		return
+	}
+	return c.st.Restore(path, m.Seq)
+}
+
+// Seed restores the local chain state which has not executed any write query with the database
+// file at path described by meta, e.g. from a backup of another database.
+func (c *Chain) Seed(meta []byte, path string) (err error) {
+	var m *SnapshotMeta
+	if m, err = DecodeSnapshotMeta(meta); err != nil {
+		return
+	}
+	return c.st.Seed(path, m.Seq)
+}
+
+// Usage returns the storage space used by the local chain state in bytes, and the count of open
+// storage connections.
+func (c *Chain) Usage() (space uint64, conns int, err error) {
+	return c.st.Usage()
+}
+
+// FetchChanges returns the captured row changes of the write queries from the log offset.
+func (c *Chain) FetchChanges(offset uint64, limit int) (changes []types.RowChange, next uint64, err error) {
+	return c.st.FetchChanges(offset, limit)
+}
+
 // AddResponse addes a response to the ackIndex, awaiting for acknowledgement.
 func (c *Chain) AddResponse(resp *types.SignedResponseHeader) (err error) {
 	return c.ai.addResponse(c.rt.getHeightFromTime(resp.GetRequestTimestamp()), resp)
 }
 
+// GetResponse returns the indexed response header of request, which is either awaiting for
+// acknowledgement or acknowledged but not yet produced in block.
+func (c *Chain) GetResponse(req *types.Request) (resp *types.ResponseHeader, err error) {
+	var (
+		key = req.Header.GetQueryKey()
+		h   = c.rt.getHeightFromTime(req.Header.Timestamp)
+		ok  bool
+	)
+	if resp, ok = c.ai.response(h, key); !ok || resp.RequestHash != req.Header.Hash() {
+		resp = nil
+		err = errors.Wrapf(ErrQueryNotFound, "get response of key %s", key)
+	}
+	return
+}
+
 func (c *Chain) register(ack *types.SignedAckHeader) (err error) {
 	return c.ai.register(c.rt.getHeightFromTime(ack.GetRequestTimestamp()), ack)
 }
@@ -1285,13 +1462,29 @@ func (c *Chain) billing(node *blockNode) (ub *types.UpdateBilling, err error) {
 			if _, ok := minersMap[userAddr]; !ok {
 				minersMap[userAddr] = make(map[proto.AccountAddress]uint64)
 			}
-			if tx.Request.Header.QueryType == types.ReadQuery {
-				minersMap[userAddr][minerAddr] += tx.Response.RowCount
-				usersMap[userAddr] += tx.Response.RowCount
-			} else {
-				minersMap[userAddr][minerAddr] += uint64(tx.Response.AffectedRows)
-				usersMap[userAddr] += uint64(tx.Response.AffectedRows)
+			// charge the metered cost of the response
+			cost := tx.Response.BillingCost()
+			minersMap[userAddr][minerAddr] += cost
+			usersMap[userAddr] += cost
+		}
+
+		for _, ack := range block.Acks {
+			// writes are charged by the query txs, reads are charged by the acknowledged cost,
+			// which includes the whole result set of a cursor
+			if ack.Response.Request.QueryType != types.ReadQuery {
+				continue
+			}
+			minerAddr = ack.Response.ResponseAccount
+			if userAddr, err = crypto.PubKeyHash(ack.Signee); err != nil {
+				log.WithError(err).WithField("db", c.databaseID).Warning("billing fail: user addr")
+				return
+			}
+			if _, ok := minersMap[userAddr]; !ok {
+				minersMap[userAddr] = make(map[proto.AccountAddress]uint64)
 			}
+			cost := ack.Response.BillingCost()
+			minersMap[userAddr][minerAddr] += cost
+			usersMap[userAddr] += cost
 		}
 
 		for _, req := range block.FailedReqs {
@@ -53,4 +53,13 @@ type Config struct {
 	UpdatePeriod uint64
 
 	IsolationLevel int
+
+	// ChangeRetention sets the count of captured row changes to retain, 0 disables the capture.
+	ChangeRetention int
+
+	// HistoryPeriod sets the block count between the state snapshots retained for the historical
+	// reads, 0 disables the historical reads.
+	HistoryPeriod int32
+	// HistoryRetention sets how many blocks below the head can be read as of.
+	HistoryRetention int32
 }
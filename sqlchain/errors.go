@@ -42,4 +42,13 @@ var (
 	// ErrResponseSeqNotMatch indicates that a response sequence id doesn't match the original one
 	// in the index.
 	ErrResponseSeqNotMatch = errors.New("response sequence id doesn't match")
+	// ErrDataFileExists indicates that the target data file of a reconstruction already exists.
+	ErrDataFileExists = errors.New("data file already exists")
+	// ErrGenesisNotFound indicates that the block source doesn't provide the genesis block.
+	ErrGenesisNotFound = errors.New("genesis block not found")
+	// ErrHistoryDisabled indicates that the historical reads are not enabled on the chain.
+	ErrHistoryDisabled = errors.New("history disabled")
+	// ErrHeightOutOfRange indicates that the height of a historical read is out of the retention
+	// window.
+	ErrHeightOutOfRange = errors.New("height out of history retention")
 )
@@ -0,0 +1,530 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	x "github.com/CovenantSQL/CovenantSQL/xenomint"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
+	"github.com/pkg/errors"
+)
+
+const (
+	historyReplicaFile = "replica.db"
+	historyReadPrefix  = "read-"
+	historyReadFileExt = ".db"
+	historySnapshotExt = ".snap"
+	historySeqFileExt  = ".seq"
+	historyTempFileExt = ".tmp"
+	historyDirSuffix   = "-history"
+	historyNoSnapshot  = int32(-1)
+
+	// historyCacheSize is the max count of the materialized states cached for the reads.
+	historyCacheSize = 4
+	// historyMaxMaterializing is the max count of the states being materialized concurrently.
+	historyMaxMaterializing = 2
+)
+
+// historySource defines the blocks to build the state history from, it's implemented by Chain.
+type historySource interface {
+	// Head returns the height and block hash of the chain head.
+	Head() (height int32, head hash.Hash)
+	// FetchBlock returns the block at height, or nil if there is no block at this height.
+	FetchBlock(height int32) (*types.Block, error)
+}
+
+// history retains the periodic snapshots of the chain state for the historical reads.
+//
+// A replica state replays the blocks behind the chain head and takes a snapshot every period
+// blocks. A read as of a past height is served by a state restored from the nearest snapshot
+// and replayed to that height. The recently read states are cached, and the states are
+// materialized out of the history lock with limited concurrency.
+type history struct {
+	dir       string
+	nodeID    proto.NodeID
+	period    int32
+	retention int32
+	notifyCh  chan struct{}
+	sem       chan struct{} // limits the concurrent materializations
+
+	// replica and replicaHeight are only accessed by the history cycle.
+	replica       *x.State
+	replicaHeight int32
+
+	sync.Mutex
+	snapshots []int32         // heights of the retained snapshots in ascending order
+	pinned    map[int32]int   // reference counts of the snapshots being restored
+	cached    []*historyState // cached states in the order of last use, the latest last
+	nextRead  uint64
+	closed    bool
+}
+
+// historyState is a state materialized as of a block height, shared by the concurrent reads.
+type historyState struct {
+	height  int32
+	file    string
+	ready   chan struct{} // closed once materialized
+	st      *x.State
+	err     error
+	refs    int
+	evicted bool
+}
+
+func newHistory(c *Config) *history {
+	if c.HistoryPeriod <= 0 {
+		return nil
+	}
+	return &history{
+		dir:           c.ChainFilePrefix + historyDirSuffix,
+		nodeID:        c.Server,
+		period:        c.HistoryPeriod,
+		retention:     c.HistoryRetention,
+		notifyCh:      make(chan struct{}, 1),
+		sem:           make(chan struct{}, historyMaxMaterializing),
+		replicaHeight: historyNoSnapshot,
+		pinned:        make(map[int32]int),
+	}
+}
+
+func removeStorageFiles(file string) {
+	for _, v := range []string{file, file + "-shm", file + "-wal"} {
+		_ = os.Remove(v)
+	}
+}
+
+func openHistoryState(file string, nodeID proto.NodeID) (st *x.State, err error) {
+	removeStorageFiles(file)
+	var strg *xs.SQLite3
+	if strg, err = xs.NewSqlite(file); err != nil {
+		return
+	}
+	st = x.NewState(sql.LevelReadUncommitted, nodeID, strg)
+	return
+}
+
+func (h *history) snapshotFile(height int32) string {
+	return filepath.Join(h.dir, strconv.FormatInt(int64(height), 10)+historySnapshotExt)
+}
+
+// open loads the retained snapshots and rebuilds the replica from the latest one.
+func (h *history) open() (err error) {
+	if err = os.MkdirAll(h.dir, 0700); err != nil {
+		err = errors.Wrapf(err, "create history directory %s", h.dir)
+		return
+	}
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(h.dir); err != nil {
+		err = errors.Wrapf(err, "read history directory %s", h.dir)
+		return
+	}
+	for _, v := range infos {
+		if !strings.HasSuffix(v.Name(), historySnapshotExt) {
+			continue
+		}
+		var height int64
+		if height, err = strconv.ParseInt(
+			strings.TrimSuffix(v.Name(), historySnapshotExt), 10, 32,
+		); err != nil {
+			err = errors.Wrapf(err, "parse history snapshot %s", v.Name())
+			return
+		}
+		h.snapshots = append(h.snapshots, int32(height))
+	}
+	sort.Slice(h.snapshots, func(i, j int) bool { return h.snapshots[i] < h.snapshots[j] })
+
+	if h.replica, err = openHistoryState(
+		filepath.Join(h.dir, historyReplicaFile), h.nodeID,
+	); err != nil {
+		return
+	}
+	if n := len(h.snapshots); n > 0 {
+		if err = restoreSnapshot(h.replica, h.snapshotFile(h.snapshots[n-1])); err != nil {
+			return
+		}
+		h.replicaHeight = h.snapshots[n-1]
+	}
+	return
+}
+
+// restoreSnapshot restores the state from the snapshot file, the state seq is read from the
+// seq file next to it.
+func restoreSnapshot(st *x.State, file string) (err error) {
+	var (
+		data []byte
+		seq  uint64
+	)
+	if data, err = ioutil.ReadFile(file + historySeqFileExt); err != nil {
+		err = errors.Wrapf(err, "read history snapshot seq %s", file)
+		return
+	}
+	if seq, err = strconv.ParseUint(string(data), 10, 64); err != nil {
+		err = errors.Wrapf(err, "parse history snapshot seq %s", file)
+		return
+	}
+	if err = st.Restore(file, seq); err != nil {
+		err = errors.Wrapf(err, "restore history snapshot %s", file)
+	}
+	return
+}
+
+func (h *history) close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	for _, v := range h.cached {
+		h.evict(v)
+	}
+	h.cached = nil
+	if h.replica != nil {
+		_ = h.replica.Close(false)
+		h.replica = nil
+	}
+}
+
+// notify wakes up the history cycle to replay the newly pushed blocks.
+func (h *history) notify() {
+	select {
+	case h.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// advance replays the blocks behind the chain head on the replica, and takes snapshots at the
+// period boundaries.
+func (h *history) advance(ctx context.Context, src historySource) (err error) {
+	var head, _ = src.Head()
+	for height := h.replicaHeight + 1; height <= head; height++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		var block *types.Block
+		if block, err = src.FetchBlock(height); err != nil {
+			return
+		}
+		if block != nil {
+			if err = h.replica.ReplayBlockWithContext(ctx, block); err != nil {
+				err = errors.Wrapf(err, "replay block %s at height %d", block.BlockHash(), height)
+				return
+			}
+		}
+		h.replicaHeight = height
+		if height > 0 && height%h.period == 0 {
+			if err = h.takeSnapshot(height); err != nil {
+				return
+			}
+			h.prune(head)
+		}
+	}
+	return
+}
+
+func (h *history) takeSnapshot(height int32) (err error) {
+	var (
+		seq   uint64
+		write func(string) error
+		file  = h.snapshotFile(height)
+	)
+	if seq, write, err = h.replica.Snapshot(nil); err != nil {
+		return
+	}
+	if err = write(file + historyTempFileExt); err != nil {
+		err = errors.Wrapf(err, "write history snapshot %s", file)
+		return
+	}
+	// the seq file is written first, so that a snapshot file always comes with its seq
+	if err = ioutil.WriteFile(
+		file+historySeqFileExt, []byte(strconv.FormatUint(seq, 10)), 0600,
+	); err != nil {
+		err = errors.Wrapf(err, "write history snapshot seq %s", file)
+		return
+	}
+	if err = os.Rename(file+historyTempFileExt, file); err != nil {
+		err = errors.Wrapf(err, "write history snapshot %s", file)
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.snapshots = append(h.snapshots, height)
+	return
+}
+
+// prune removes the snapshots which are not needed to serve the retention window any more.
+func (h *history) prune(head int32) {
+	h.Lock()
+	defer h.Unlock()
+	var (
+		low = head - h.retention
+		i   = sort.Search(len(h.snapshots), func(i int) bool { return h.snapshots[i] > low })
+	)
+	// keep the latest snapshot at or below the window as the base of the lowest heights
+	i--
+	// keep the snapshots being restored by the reads
+	for j := 0; j < i; j++ {
+		if h.pinned[h.snapshots[j]] > 0 {
+			i = j
+			break
+		}
+	}
+	if i <= 0 {
+		return
+	}
+	for _, v := range h.snapshots[:i] {
+		for _, f := range []string{h.snapshotFile(v), h.snapshotFile(v) + historySeqFileExt} {
+			if err := os.Remove(f); err != nil {
+				log.WithError(err).WithField("height", v).Warning("failed to remove history snapshot")
+			}
+		}
+	}
+	h.snapshots = append([]int32(nil), h.snapshots[i:]...)
+}
+
+// base returns the height of the latest snapshot at or below height.
+func (h *history) base(height int32) int32 {
+	var i = sort.Search(len(h.snapshots), func(i int) bool { return h.snapshots[i] > height })
+	if i == 0 {
+		return historyNoSnapshot
+	}
+	return h.snapshots[i-1]
+}
+
+// acquire returns the cached state as of height with a reference, a new state is added to the
+// cache if not found, which should be materialized by the caller.
+func (h *history) acquire(height int32) (hs *historyState, found bool, err error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		err = errors.Wrap(ErrHistoryDisabled, "history closed")
+		return
+	}
+	for i, v := range h.cached {
+		if v.height == height {
+			hs, found = v, true
+			h.cached = append(h.cached[:i], h.cached[i+1:]...)
+			break
+		}
+	}
+	if hs == nil {
+		h.nextRead++
+		hs = &historyState{
+			height: height,
+			file: filepath.Join(h.dir,
+				historyReadPrefix+strconv.FormatUint(h.nextRead, 10)+historyReadFileExt),
+			ready: make(chan struct{}),
+		}
+	}
+	hs.refs++
+	h.cached = append(h.cached, hs)
+	for len(h.cached) > historyCacheSize {
+		h.evict(h.cached[0])
+		h.cached = h.cached[1:]
+	}
+	return
+}
+
+// release drops the reference of the state, the state is closed with the last reference if it's
+// evicted from the cache.
+func (h *history) release(hs *historyState) {
+	h.Lock()
+	defer h.Unlock()
+	hs.refs--
+	h.closeEvicted(hs)
+}
+
+// evict marks the state as evicted, the caller should remove it from the cache.
+func (h *history) evict(hs *historyState) {
+	hs.evicted = true
+	h.closeEvicted(hs)
+}
+
+func (h *history) closeEvicted(hs *historyState) {
+	if !hs.evicted || hs.refs > 0 {
+		return
+	}
+	if hs.st != nil {
+		_ = hs.st.Close(false)
+		hs.st = nil
+	}
+	removeStorageFiles(hs.file)
+}
+
+// drop removes the failed state from the cache.
+func (h *history) drop(hs *historyState) {
+	h.Lock()
+	defer h.Unlock()
+	for i, v := range h.cached {
+		if v == hs {
+			h.cached = append(h.cached[:i], h.cached[i+1:]...)
+			h.evict(hs)
+			break
+		}
+	}
+}
+
+// pin returns the base snapshot of height and keeps it from pruning until unpinned.
+func (h *history) pin(height int32) (base int32) {
+	h.Lock()
+	defer h.Unlock()
+	if base = h.base(height); base != historyNoSnapshot {
+		h.pinned[base]++
+	}
+	return
+}
+
+func (h *history) unpin(base int32) {
+	if base == historyNoSnapshot {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.pinned[base]--; h.pinned[base] <= 0 {
+		delete(h.pinned, base)
+	}
+}
+
+// materialize rebuilds the state as of the block at height.
+func (h *history) materialize(
+	ctx context.Context, src historySource, hs *historyState, asOf int32) (err error,
+) {
+	select {
+	case h.sem <- struct{}{}:
+		defer func() { <-h.sem }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var (
+		base = h.pin(asOf)
+		st   *x.State
+	)
+	defer h.unpin(base)
+	if hs.height-base > h.retention+h.period {
+		err = errors.Wrapf(ErrHeightOutOfRange, "no history snapshot near height %d", asOf)
+		return
+	}
+	if st, err = openHistoryState(hs.file, h.nodeID); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = st.Close(false)
+			removeStorageFiles(hs.file)
+		}
+	}()
+	if base != historyNoSnapshot {
+		if err = restoreSnapshot(st, h.snapshotFile(base)); err != nil {
+			return
+		}
+	}
+	for i := base + 1; i <= hs.height; i++ {
+		var block *types.Block
+		if block, err = src.FetchBlock(i); err != nil {
+			return
+		}
+		if block == nil {
+			continue
+		}
+		if err = st.ReplayBlockWithContext(ctx, block); err != nil {
+			err = errors.Wrapf(err, "replay block %s at height %d", block.BlockHash(), i)
+			return
+		}
+	}
+	hs.st = st
+	return
+}
+
+// query executes the read request on the state as of the requested height, the height of the
+// last block applied to the state is set to the response.
+func (h *history) query(
+	src historySource, req *types.Request) (tracker *x.QueryTracker, resp *types.Response, err error,
+) {
+	var (
+		asOf    = req.Header.AsOfHeight
+		head, _ = src.Head()
+		height  int32
+		ctx     = req.GetContext()
+	)
+	if asOf > head || asOf < head-h.retention {
+		err = errors.Wrapf(ErrHeightOutOfRange,
+			"height %d, retained from %d to %d", asOf, head-h.retention, head)
+		return
+	}
+	// find the last block at or below the height, the genesis block always exists
+	for height = asOf; height > 0; height-- {
+		var block *types.Block
+		if block, err = src.FetchBlock(height); err != nil {
+			return
+		}
+		if block != nil {
+			break
+		}
+	}
+
+	var (
+		hs    *historyState
+		found bool
+	)
+	if hs, found, err = h.acquire(height); err != nil {
+		return
+	}
+	defer h.release(hs)
+	if found {
+		select {
+		case <-hs.ready:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	} else {
+		hs.err = h.materialize(ctx, src, hs, asOf)
+		close(hs.ready)
+	}
+	if err = hs.err; err != nil {
+		h.drop(hs)
+		return
+	}
+	if tracker, resp, err = hs.st.QueryWithContext(ctx, req, false); err != nil {
+		return
+	}
+	resp.Header.AsOfHeight = height
+	return
+}
+
+// historyCycle keeps the history replica up to the chain head.
+func (c *Chain) historyCycle(ctx context.Context) {
+	for {
+		if err := c.hist.advance(ctx, c); err != nil && ctx.Err() == nil {
+			log.WithError(err).WithField("db", c.databaseID).Warning("failed to advance history")
+		}
+		select {
+		case <-c.hist.notifyCh:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
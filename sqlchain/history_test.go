@@ -0,0 +1,197 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type memHistorySource []*types.Block
+
+func (s memHistorySource) Head() (height int32, head hash.Hash) {
+	return int32(len(s)) - 1, hash.Hash{}
+}
+
+func (s memHistorySource) FetchBlock(height int32) (*types.Block, error) {
+	if height < 0 || height >= int32(len(s)) {
+		return nil, nil
+	}
+	return s[height], nil
+}
+
+func queryHistoryRows(h *history, src historySource, asOf int32) (
+	rows map[int]string, height int32, err error,
+) {
+	var (
+		req = &types.Request{
+			Header: types.SignedRequestHeader{
+				RequestHeader: types.RequestHeader{
+					QueryType:  types.ReadQuery,
+					AsOfHeight: asOf,
+				},
+			},
+			Payload: types.RequestPayload{
+				Queries: []types.Query{{Pattern: "SELECT k, v FROM t"}},
+			},
+		}
+		resp *types.Response
+	)
+	if _, resp, err = h.query(src, req); err != nil {
+		return
+	}
+	rows = make(map[int]string)
+	for _, v := range resp.Payload.Rows {
+		rows[int(v.Values[0].(int64))] = string(v.Values[1].([]byte))
+	}
+	height = resp.Header.AsOfHeight
+	return
+}
+
+func TestHistory(t *testing.T) {
+	Convey("Given a sqlchain history with retained snapshots", t, func() {
+		var (
+			cli, err = newRandomNode()
+			genesis  *types.Block
+			blocks   = make(memHistorySource, 5)
+			txs      = make([]*types.QueryAsTx, 4)
+			dir      = path.Join(testDataDir, "history")
+			ctx      = context.Background()
+			h        *history
+		)
+		So(err, ShouldBeNil)
+		So(os.MkdirAll(dir, 0755), ShouldBeNil)
+		Reset(func() { _ = os.RemoveAll(dir) })
+
+		genesis, err = createRandomBlock(genesisHash, true)
+		So(err, ShouldBeNil)
+		blocks[0] = genesis
+		txs[0], err = createWriteQueryTx(cli, 0,
+			"CREATE TABLE t (k INT PRIMARY KEY, v TEXT)", "INSERT INTO t VALUES (1, 'a')")
+		So(err, ShouldBeNil)
+		txs[1], err = createWriteQueryTx(cli, 2, "INSERT INTO t VALUES (2, 'b')")
+		So(err, ShouldBeNil)
+		txs[2], err = createWriteQueryTx(cli, 3, "UPDATE t SET v='c' WHERE k=1")
+		So(err, ShouldBeNil)
+		txs[3], err = createWriteQueryTx(cli, 4, "DELETE FROM t WHERE k=2")
+		So(err, ShouldBeNil)
+		blocks[1], err = createReconstructBlock(genesis, genesis, 1, txs[0])
+		So(err, ShouldBeNil)
+		// no block at height 2
+		blocks[3], err = createReconstructBlock(genesis, blocks[1], 3, txs[1], txs[2])
+		So(err, ShouldBeNil)
+		blocks[4], err = createReconstructBlock(genesis, blocks[3], 4, txs[3])
+		So(err, ShouldBeNil)
+
+		var cfg = &Config{
+			ChainFilePrefix:  path.Join(dir, "chain"),
+			Server:           cli.NodeID,
+			HistoryPeriod:    2,
+			HistoryRetention: 3,
+		}
+		h = newHistory(cfg)
+		So(h, ShouldNotBeNil)
+		So(h.open(), ShouldBeNil)
+		Reset(func() { h.close() })
+		So(h.advance(ctx, blocks), ShouldBeNil)
+		So(h.replicaHeight, ShouldEqual, 4)
+		So(h.snapshots, ShouldResemble, []int32{2, 4})
+
+		Convey("The reads as of past heights should be served", func() {
+			rows, height, err := queryHistoryRows(h, blocks, 2)
+			So(err, ShouldBeNil)
+			So(height, ShouldEqual, 1)
+			So(rows, ShouldResemble, map[int]string{1: "a"})
+			rows, height, err = queryHistoryRows(h, blocks, 3)
+			So(err, ShouldBeNil)
+			So(height, ShouldEqual, 3)
+			So(rows, ShouldResemble, map[int]string{1: "c", 2: "b"})
+			rows, height, err = queryHistoryRows(h, blocks, 4)
+			So(err, ShouldBeNil)
+			So(height, ShouldEqual, 4)
+			So(rows, ShouldResemble, map[int]string{1: "c"})
+		})
+		Convey("The concurrent reads of different heights should share the cached states", func() {
+			var (
+				wg     sync.WaitGroup
+				expect = map[int32]map[int]string{
+					2: {1: "a"},
+					3: {1: "c", 2: "b"},
+					4: {1: "c"},
+				}
+				errs = make(chan error, 30)
+			)
+			for i := 0; i < 30; i++ {
+				wg.Add(1)
+				go func(asOf int32) {
+					defer wg.Done()
+					rows, _, err := queryHistoryRows(h, blocks, asOf)
+					if err == nil && !reflect.DeepEqual(rows, expect[asOf]) {
+						err = errors.Errorf("unexpected rows %v as of %d", rows, asOf)
+					}
+					errs <- err
+				}(int32(2 + i%3))
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				So(err, ShouldBeNil)
+			}
+			So(h.cached, ShouldHaveLength, 3)
+			for _, v := range h.cached {
+				So(v.refs, ShouldEqual, 0)
+				So(v.st, ShouldNotBeNil)
+			}
+			So(h.pinned, ShouldBeEmpty)
+		})
+		Convey("The reads out of the retention window should be rejected", func() {
+			_, _, err = queryHistoryRows(h, blocks, 0)
+			So(errors.Cause(err), ShouldEqual, ErrHeightOutOfRange)
+			_, _, err = queryHistoryRows(h, blocks, 5)
+			So(errors.Cause(err), ShouldEqual, ErrHeightOutOfRange)
+		})
+		Convey("The snapshots out of the retention window should be pruned", func() {
+			// empty heights up to 8
+			blocks = append(blocks, nil, nil, nil, nil)
+			So(h.advance(ctx, blocks), ShouldBeNil)
+			So(h.snapshots, ShouldResemble, []int32{4, 6, 8})
+			_, err = os.Stat(h.snapshotFile(2))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			rows, height, err := queryHistoryRows(h, blocks, 5)
+			So(err, ShouldBeNil)
+			So(height, ShouldEqual, 4)
+			So(rows, ShouldResemble, map[int]string{1: "c"})
+
+			Convey("The history should be reloaded from the snapshots", func() {
+				h.close()
+				h = newHistory(cfg)
+				So(h.open(), ShouldBeNil)
+				So(h.snapshots, ShouldResemble, []int32{4, 6, 8})
+				So(h.replicaHeight, ShouldEqual, 8)
+			})
+		})
+	})
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/rpc"
+	"github.com/CovenantSQL/CovenantSQL/types"
 )
 
 // MuxService defines multiplexing service of sql-chain.
@@ -148,3 +149,16 @@ func (s *MuxService) FetchBlock(req *MuxFetchBlockReq, resp *MuxFetchBlockResp)
 
 	return ErrUnknownMuxRequest
 }
+
+// FetchInclusion is the RPC method to fetch a block header with the inclusion proof of a
+// response from the target server.
+func (s *MuxService) FetchInclusion(
+	req *types.FetchInclusionReq, resp *types.FetchInclusionResp) (err error,
+) {
+	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
+		resp.Envelope = req.Envelope
+		return v.(*ChainRPCService).FetchInclusion(req, resp)
+	}
+
+	return ErrUnknownMuxRequest
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/rpc"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	x "github.com/CovenantSQL/CovenantSQL/xenomint"
+	xi "github.com/CovenantSQL/CovenantSQL/xenomint/interfaces"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
+	"github.com/pkg/errors"
+)
+
+// BlockSource defines the block stream of a sqlchain used by Reconstruct.
+type BlockSource interface {
+	// FetchBlock returns the block of the specified height and the current head height of the
+	// source. A nil block is returned if there is no block at this height.
+	FetchBlock(ctx context.Context, height int32) (block *types.Block, head int32, err error)
+}
+
+// remoteBlockSource fetches blocks from a miner or an observer by the FetchBlock rpc method.
+type remoteBlockSource struct {
+	caller *rpc.Caller
+	node   proto.NodeID
+	method string
+	dbID   proto.DatabaseID
+}
+
+// NewMinerBlockSource returns a BlockSource reading blocks of database dbID from a miner node.
+func NewMinerBlockSource(node proto.NodeID, dbID proto.DatabaseID) BlockSource {
+	return &remoteBlockSource{
+		caller: rpc.NewCaller(),
+		node:   node,
+		method: route.SQLCFetchBlock.String(),
+		dbID:   dbID,
+	}
+}
+
+// NewObserverBlockSource returns a BlockSource reading blocks of database dbID from an observer
+// node, the observer must have replicated the chain from the genesis block.
+func NewObserverBlockSource(node proto.NodeID, dbID proto.DatabaseID) BlockSource {
+	return &remoteBlockSource{
+		caller: rpc.NewCaller(),
+		node:   node,
+		method: route.OBSFetchBlock.String(),
+		dbID:   dbID,
+	}
+}
+
+func (s *remoteBlockSource) FetchBlock(
+	ctx context.Context, height int32) (block *types.Block, head int32, err error,
+) {
+	var (
+		req = &MuxFetchBlockReq{
+			DatabaseID:    s.dbID,
+			FetchBlockReq: FetchBlockReq{Height: height},
+		}
+		resp = &MuxFetchBlockResp{}
+	)
+	if err = s.caller.CallNodeWithContext(ctx, s.node, s.method, req, resp); err != nil {
+		err = errors.Wrapf(err, "fetch block %d from %s", height, s.node)
+		return
+	}
+	block, head = resp.Block, resp.Head
+	return
+}
+
+// ReconstructConfig defines the parameters of a database state reconstruction.
+type ReconstructConfig struct {
+	// Source provides the genesis block and the following blocks to replay.
+	Source BlockSource
+	// DataFile is the sqlite file to write the reconstructed state into, it must not exist.
+	DataFile string
+	// GenesisHash, if set, is checked against the genesis block provided by the source.
+	GenesisHash hash.Hash
+	// Height is the highest block height to replay, a negative value means the source head.
+	Height int32
+	// Time, if set, stops the replay at the last block produced no later than it.
+	Time time.Time
+}
+
+// ReconstructResult describes the reconstructed database state.
+type ReconstructResult struct {
+	Genesis *types.Block
+	// Head is the last replayed block and Height is its height.
+	Head   *types.Block
+	Height int32
+	// Blocks and Queries count the replayed blocks (genesis included) and write queries.
+	Blocks  int
+	Queries int
+}
+
+// Reconstruct rebuilds the database state as of a given height or time from the block stream of
+// its sqlchain. Every block is verified against its signature and the chain it extends, and
+// every write query is verified against the signature of its issuer, so the reconstructed state
+// doesn't depend on trusting the data file of any single miner.
+func Reconstruct(ctx context.Context, cfg *ReconstructConfig) (res *ReconstructResult, err error) {
+	var (
+		genesis, block *types.Block
+		head           int32
+		strg           xi.Storage
+		st             *x.State
+	)
+
+	if _, err = os.Stat(cfg.DataFile); err == nil {
+		err = errors.Wrapf(ErrDataFileExists, "reconstruct to %s", cfg.DataFile)
+		return
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	// Fetch and verify genesis block
+	if genesis, head, err = cfg.Source.FetchBlock(ctx, 0); err != nil {
+		return
+	}
+	if genesis == nil {
+		err = ErrGenesisNotFound
+		return
+	}
+	if err = genesis.VerifyAsGenesis(); err != nil {
+		err = errors.Wrap(err, "verify genesis block")
+		return
+	}
+	if !cfg.GenesisHash.IsEqual(&hash.Hash{}) && !cfg.GenesisHash.IsEqual(genesis.BlockHash()) {
+		err = errors.Wrapf(ErrInvalidBlock,
+			"genesis hash mismatched: %s vs %s", genesis.BlockHash(), cfg.GenesisHash)
+		return
+	}
+	if !cfg.Time.IsZero() && genesis.Timestamp().After(cfg.Time) {
+		err = errors.Wrapf(ErrInvalidBlock,
+			"genesis block is produced after %s", cfg.Time.Format(time.RFC3339Nano))
+		return
+	}
+
+	// Open a fresh state to replay blocks into
+	if strg, err = xs.NewSqlite(cfg.DataFile); err != nil {
+		return
+	}
+	st = x.NewState(sql.LevelReadUncommitted, genesis.Producer(), strg)
+	defer func() {
+		if cerr := st.Close(err == nil); cerr != nil && err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(cfg.DataFile)
+		}
+	}()
+
+	res = &ReconstructResult{Genesis: genesis}
+	if err = replayReconstructBlock(ctx, st, res, genesis, 0); err != nil {
+		return
+	}
+
+	for h := int32(1); h <= head && (cfg.Height < 0 || h <= cfg.Height); h++ {
+		if block, head, err = cfg.Source.FetchBlock(ctx, h); err != nil {
+			return
+		}
+		if block == nil {
+			// no block produced at this height
+			continue
+		}
+		if !cfg.Time.IsZero() && block.Timestamp().After(cfg.Time) {
+			break
+		}
+		if err = verifyReconstructBlock(genesis, res.Head, block); err != nil {
+			err = errors.Wrapf(err, "verify block %s at height %d", block.BlockHash(), h)
+			return
+		}
+		if err = replayReconstructBlock(ctx, st, res, block, h); err != nil {
+			return
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"genesis": genesis.BlockHash().String(),
+		"head":    res.Head.BlockHash().String(),
+		"height":  res.Height,
+		"blocks":  res.Blocks,
+		"queries": res.Queries,
+		"file":    cfg.DataFile,
+	}).Info("database state reconstructed")
+
+	return
+}
+
+func replayReconstructBlock(
+	ctx context.Context, st *x.State, res *ReconstructResult, block *types.Block, height int32,
+) (err error) {
+	if err = st.ReplayBlockWithContext(ctx, block); err != nil {
+		err = errors.Wrapf(err, "replay block %s at height %d", block.BlockHash(), height)
+		return
+	}
+	for _, q := range block.QueryTxs {
+		if q.Request.Header.QueryType == types.WriteQuery {
+			res.Queries += len(q.Request.Payload.Queries)
+		}
+	}
+	res.Head, res.Height = block, height
+	res.Blocks++
+	return
+}
+
+func verifyReconstructBlock(genesis, parent, block *types.Block) (err error) {
+	if !block.GenesisHash().IsEqual(genesis.BlockHash()) {
+		return errors.Wrap(ErrInvalidBlock, "genesis hash mismatched")
+	}
+	if !block.ParentHash().IsEqual(parent.BlockHash()) {
+		return errors.Wrap(ErrParentNotFound, "block does not extend the replayed chain")
+	}
+	if err = block.Verify(); err != nil {
+		return
+	}
+	// The merkle root only covers response hashes, check the queries back to their issuers
+	for i, q := range block.QueryTxs {
+		if q.Request.Header.QueryType != types.WriteQuery {
+			continue
+		}
+		if err = q.Request.Verify(); err != nil {
+			return errors.Wrapf(err, "verify request #%d", i)
+		}
+		if err = q.Response.VerifyHash(); err != nil {
+			return errors.Wrapf(err, "verify response #%d", i)
+		}
+		if reqHash := q.Request.Header.Hash(); !q.Response.RequestHash.IsEqual(&reqHash) {
+			return errors.Wrapf(ErrInvalidBlock, "request hash mismatched in query #%d", i)
+		}
+	}
+	return
+}
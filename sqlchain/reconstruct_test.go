@@ -0,0 +1,243 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type memBlockSource []*types.Block
+
+func (s memBlockSource) FetchBlock(
+	ctx context.Context, height int32) (block *types.Block, head int32, err error,
+) {
+	head = int32(len(s)) - 1
+	if height <= head {
+		block = s[height]
+	}
+	return
+}
+
+func createWriteQueryTx(cli *nodeProfile, offset uint64, patterns ...string) (
+	tx *types.QueryAsTx, err error,
+) {
+	var req = &types.Request{
+		Header: types.SignedRequestHeader{
+			RequestHeader: types.RequestHeader{
+				QueryType: types.WriteQuery,
+				NodeID:    cli.NodeID,
+				Timestamp: time.Now().UTC(),
+			},
+		},
+	}
+	for _, v := range patterns {
+		req.Payload.Queries = append(req.Payload.Queries, types.Query{Pattern: v})
+	}
+	if err = req.Sign(cli.PrivateKey); err != nil {
+		return
+	}
+	var resp = &types.SignedResponseHeader{
+		ResponseHeader: types.ResponseHeader{
+			Request:     req.Header.RequestHeader,
+			RequestHash: req.Header.Hash(),
+			NodeID:      cli.NodeID,
+			Timestamp:   time.Now().UTC(),
+			LogOffset:   offset,
+		},
+	}
+	if err = resp.BuildHash(); err != nil {
+		return
+	}
+	tx = &types.QueryAsTx{Request: req, Response: resp}
+	return
+}
+
+func createReconstructBlock(genesis, parent *types.Block, height int32, txs ...*types.QueryAsTx) (
+	b *types.Block, err error,
+) {
+	b = &types.Block{
+		SignedHeader: types.SignedHeader{
+			Header: types.Header{
+				Version:     0x01000000,
+				Producer:    genesis.Producer(),
+				GenesisHash: *genesis.BlockHash(),
+				ParentHash:  *parent.BlockHash(),
+				Timestamp:   genesis.Timestamp().Add(time.Duration(height) * time.Second),
+			},
+		},
+		QueryTxs: txs,
+	}
+	err = b.PackAndSignBlock(testPrivKey)
+	return
+}
+
+func readReconstructedRows(file string) (rows map[int]string, err error) {
+	strg, err := xs.NewSqlite(file)
+	if err != nil {
+		return
+	}
+	defer strg.Close()
+	result, err := strg.Reader().Query("SELECT k, v FROM t")
+	if err != nil {
+		return
+	}
+	defer result.Close()
+	rows = make(map[int]string)
+	for result.Next() {
+		var (
+			k int
+			v string
+		)
+		if err = result.Scan(&k, &v); err != nil {
+			return
+		}
+		rows[k] = v
+	}
+	err = result.Err()
+	return
+}
+
+func TestReconstruct(t *testing.T) {
+	Convey("Given a sqlchain with write queries", t, func() {
+		var (
+			cli, err = newRandomNode()
+			genesis  *types.Block
+			blocks   = make(memBlockSource, 5)
+			txs      = make([]*types.QueryAsTx, 5)
+			dir      = path.Join(testDataDir, "reconstruct")
+			ctx      = context.Background()
+		)
+		So(err, ShouldBeNil)
+		So(os.MkdirAll(dir, 0755), ShouldBeNil)
+		Reset(func() { _ = os.RemoveAll(dir) })
+
+		genesis, err = createRandomBlock(genesisHash, true)
+		So(err, ShouldBeNil)
+		blocks[0] = genesis
+		txs[0], err = createWriteQueryTx(cli, 0,
+			"CREATE TABLE t (k INT PRIMARY KEY, v TEXT)", "INSERT INTO t VALUES (1, 'a')")
+		So(err, ShouldBeNil)
+		txs[1], err = createWriteQueryTx(cli, 2, "INSERT INTO t VALUES (2, 'b')")
+		So(err, ShouldBeNil)
+		txs[2], err = createWriteQueryTx(cli, 3, "UPDATE t SET v='c' WHERE k=1")
+		So(err, ShouldBeNil)
+		txs[3], err = createWriteQueryTx(cli, 4, "DELETE FROM t WHERE k=2")
+		So(err, ShouldBeNil)
+		blocks[1], err = createReconstructBlock(genesis, genesis, 1, txs[0])
+		So(err, ShouldBeNil)
+		// no block at height 2
+		blocks[3], err = createReconstructBlock(genesis, blocks[1], 3, txs[1], txs[2])
+		So(err, ShouldBeNil)
+		blocks[4], err = createReconstructBlock(genesis, blocks[3], 4, txs[3])
+		So(err, ShouldBeNil)
+
+		Convey("The state of the source head should be reconstructed", func() {
+			var file = path.Join(dir, "head.db")
+			res, err := Reconstruct(ctx, &ReconstructConfig{
+				Source:      blocks,
+				DataFile:    file,
+				GenesisHash: *genesis.BlockHash(),
+				Height:      -1,
+			})
+			So(err, ShouldBeNil)
+			So(res.Height, ShouldEqual, 4)
+			So(res.Head, ShouldEqual, blocks[4])
+			So(res.Blocks, ShouldEqual, 4)
+			So(res.Queries, ShouldEqual, 5)
+			rows, err := readReconstructedRows(file)
+			So(err, ShouldBeNil)
+			So(rows, ShouldResemble, map[int]string{1: "c"})
+
+			Convey("The existing data file should not be overwritten", func() {
+				_, err = Reconstruct(ctx, &ReconstructConfig{
+					Source:   blocks,
+					DataFile: file,
+					Height:   -1,
+				})
+				So(errors.Cause(err), ShouldEqual, ErrDataFileExists)
+			})
+		})
+		Convey("The state at a given height should be reconstructed", func() {
+			var file = path.Join(dir, "height.db")
+			res, err := Reconstruct(ctx, &ReconstructConfig{
+				Source:   blocks,
+				DataFile: file,
+				Height:   2,
+			})
+			So(err, ShouldBeNil)
+			So(res.Height, ShouldEqual, 1)
+			rows, err := readReconstructedRows(file)
+			So(err, ShouldBeNil)
+			So(rows, ShouldResemble, map[int]string{1: "a"})
+		})
+		Convey("The state at a given time should be reconstructed", func() {
+			var file = path.Join(dir, "time.db")
+			res, err := Reconstruct(ctx, &ReconstructConfig{
+				Source:   blocks,
+				DataFile: file,
+				Height:   -1,
+				Time:     blocks[3].Timestamp(),
+			})
+			So(err, ShouldBeNil)
+			So(res.Height, ShouldEqual, 3)
+			rows, err := readReconstructedRows(file)
+			So(err, ShouldBeNil)
+			So(rows, ShouldResemble, map[int]string{1: "c", 2: "b"})
+		})
+		Convey("A mismatched genesis should be rejected", func() {
+			_, err := Reconstruct(ctx, &ReconstructConfig{
+				Source:      blocks,
+				DataFile:    path.Join(dir, "genesis.db"),
+				GenesisHash: hash.Hash{0x01},
+				Height:      -1,
+			})
+			So(errors.Cause(err), ShouldEqual, ErrInvalidBlock)
+		})
+		Convey("A block not extending the chain should be rejected", func() {
+			var file = path.Join(dir, "fork.db")
+			blocks[4], err = createReconstructBlock(genesis, genesis, 4, txs[3])
+			So(err, ShouldBeNil)
+			_, err = Reconstruct(ctx, &ReconstructConfig{
+				Source:   blocks,
+				DataFile: file,
+				Height:   -1,
+			})
+			So(errors.Cause(err), ShouldEqual, ErrParentNotFound)
+			_, err = os.Stat(file)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("A tampered query should be rejected", func() {
+			txs[1].Request.Payload.Queries[0].Pattern = "INSERT INTO t VALUES (2, 'x')"
+			_, err = Reconstruct(ctx, &ReconstructConfig{
+				Source:   blocks,
+				DataFile: path.Join(dir, "tamper.db"),
+				Height:   -1,
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
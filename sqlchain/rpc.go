@@ -61,6 +61,8 @@ type FetchBlockReq struct {
 type FetchBlockResp struct {
 	Height int32
 	Block  *types.Block
+	// Head is the current head height of the serving node.
+	Head int32
 }
 
 // AdviseNewBlock is the RPC method to advise a new produced block to the target server.
@@ -85,6 +87,18 @@ func (s *ChainRPCService) AdviseAckedQuery(
 // FetchBlock is the RPC method to fetch a known block from the target server.
 func (s *ChainRPCService) FetchBlock(req *FetchBlockReq, resp *FetchBlockResp) (err error) {
 	resp.Height = req.Height
+	resp.Head = s.chain.rt.getHead().Height
 	resp.Block, err = s.chain.FetchBlock(req.Height)
 	return
 }
+
+// FetchInclusion is the RPC method to fetch a block header with the inclusion proof of a
+// response from the target server.
+func (s *ChainRPCService) FetchInclusion(
+	req *types.FetchInclusionReq, resp *types.FetchInclusionResp) (err error,
+) {
+	resp.Height = req.Height
+	resp.Head = s.chain.rt.getHead().Height
+	resp.Header, resp.Ack, resp.Proof, err = s.chain.FetchInclusion(req.Height, &req.Response)
+	return
+}
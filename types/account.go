@@ -50,6 +50,12 @@ type UserPermission struct {
 	// SQL pattern regulations for user queries
 	// only a fully matched (case-sensitive) sql query is permitted to execute.
 	Patterns []string
+	// Match the queries to patterns by fingerprint instead of the exact query,
+	// see QueryFingerprint for the normalization.
+	MatchFingerprint bool
+	// Table and column grants for user queries
+	// only the granted tables and columns are accessible if any grant is present.
+	Grants []TableGrant
 
 	// patterns map cache for matching
 	cachedPatternMapOnce sync.Once
@@ -77,6 +83,33 @@ const (
 	Void UserPermissionRole = 0
 )
 
+// GrantPrivilege defines the statement privileges of a table grant.
+type GrantPrivilege int32
+
+const (
+	// SelectPrivilege defines the privilege to read the table or columns.
+	SelectPrivilege GrantPrivilege = 1 << iota
+	// InsertPrivilege defines the privilege to insert rows to the table or columns.
+	InsertPrivilege
+	// UpdatePrivilege defines the privilege to update the table or columns.
+	UpdatePrivilege
+	// DeletePrivilege defines the privilege to delete rows from the table.
+	DeletePrivilege
+
+	// AllPrivileges defines all the privileges of the table.
+	AllPrivileges = SelectPrivilege | InsertPrivilege | UpdatePrivilege | DeletePrivilege
+)
+
+// TableGrant defines the privileges granted on a table or some columns of it.
+type TableGrant struct {
+	// Table name, case-insensitive.
+	Table string `json:"table"`
+	// Columns of the table, case-insensitive, empty for all columns.
+	Columns []string `json:"columns,omitempty"`
+	// Privileges granted.
+	Privileges GrantPrivilege `json:"privileges"`
+}
+
 // UnmarshalJSON implements the json.Unmarshler interface.
 func (r *UserPermissionRole) UnmarshalJSON(data []byte) (err error) {
 	var s string
@@ -139,6 +172,78 @@ func (r *UserPermissionRole) FromString(perm string) {
 	}
 }
 
+// UnmarshalJSON implements the json.Unmarshler interface.
+func (p *GrantPrivilege) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil {
+		return
+	}
+	p.FromString(s)
+	return
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (p GrantPrivilege) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// String implements the fmt.Stringer interface.
+func (p GrantPrivilege) String() string {
+	if p == AllPrivileges {
+		return "ALL"
+	}
+
+	var res []string
+	if p&SelectPrivilege != 0 {
+		res = append(res, "SELECT")
+	}
+	if p&InsertPrivilege != 0 {
+		res = append(res, "INSERT")
+	}
+	if p&UpdatePrivilege != 0 {
+		res = append(res, "UPDATE")
+	}
+	if p&DeletePrivilege != 0 {
+		res = append(res, "DELETE")
+	}
+
+	return strings.Join(res, ",")
+}
+
+// FromString converts string like "SELECT,UPDATE" to GrantPrivilege.
+func (p *GrantPrivilege) FromString(priv string) {
+	*p = 0
+
+	for _, v := range strings.Split(priv, ",") {
+		switch strings.ToUpper(strings.TrimSpace(v)) {
+		case "ALL":
+			*p |= AllPrivileges
+		case "SELECT":
+			*p |= SelectPrivilege
+		case "INSERT":
+			*p |= InsertPrivilege
+		case "UPDATE":
+			*p |= UpdatePrivilege
+		case "DELETE":
+			*p |= DeletePrivilege
+		}
+	}
+}
+
+// IsValid returns whether the grant is valid or not.
+func (g *TableGrant) IsValid() bool {
+	if g.Table == "" || g.Privileges == 0 || g.Privileges&^AllPrivileges != 0 {
+		return false
+	}
+	for _, c := range g.Columns {
+		if c == "" {
+			return false
+		}
+	}
+	// row level privilege is not applicable to columns
+	return len(g.Columns) == 0 || g.Privileges&DeletePrivilege == 0
+}
+
 // UserPermissionFromRole construct a new user permission instance from primitive user permission role enum.
 func UserPermissionFromRole(role UserPermissionRole) *UserPermission {
 	return &UserPermission{
@@ -172,7 +277,52 @@ func (up *UserPermission) HasSuperPermission() bool {
 
 // IsValid returns whether the permission object is valid or not.
 func (up *UserPermission) IsValid() bool {
-	return up != nil && up.Role != 0
+	if up == nil || up.Role == 0 {
+		return false
+	}
+	for i := range up.Grants {
+		g := &up.Grants[i]
+		if !g.IsValid() {
+			return false
+		}
+		// grants never exceed the role
+		if (g.Privileges&SelectPrivilege != 0 && !up.HasReadPermission()) ||
+			(g.Privileges&^SelectPrivilege != 0 && !up.HasWritePermission()) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasGrants returns true if user queries are restricted to the table grants.
+func (up *UserPermission) HasGrants() bool {
+	return up != nil && len(up.Grants) > 0
+}
+
+// IsGranted returns whether the privilege on column of table is granted to user. An empty column
+// checks the privilege on any column of the table, and "*" checks the privilege on all columns.
+func (up *UserPermission) IsGranted(table, column string, priv GrantPrivilege) bool {
+	if up == nil {
+		return false
+	}
+	if len(up.Grants) == 0 {
+		return true
+	}
+	for i := range up.Grants {
+		g := &up.Grants[i]
+		if g.Privileges&priv != priv || !strings.EqualFold(g.Table, table) {
+			continue
+		}
+		if column == "" || len(g.Columns) == 0 {
+			return true
+		}
+		for _, c := range g.Columns {
+			if strings.EqualFold(c, column) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // HasDisallowedQueryPatterns returns whether the queries are permitted.
@@ -189,12 +339,12 @@ func (up *UserPermission) HasDisallowedQueryPatterns(queries []Query) (query str
 	up.cachedPatternMapOnce.Do(func() {
 		up.cachedPatternMap = make(map[string]bool, len(up.Patterns))
 		for _, p := range up.Patterns {
-			up.cachedPatternMap[p] = true
+			up.cachedPatternMap[up.patternKey(p)] = true
 		}
 	})
 
 	for _, q := range queries {
-		if !up.cachedPatternMap[q.Pattern] {
+		if !up.cachedPatternMap[up.patternKey(q.Pattern)] {
 			// not permitted
 			query = q.Pattern
 			status = true
@@ -205,6 +355,18 @@ func (up *UserPermission) HasDisallowedQueryPatterns(queries []Query) (query str
 	return
 }
 
+// patternKey returns the key of query for pattern matching, which is the fingerprint of query if
+// MatchFingerprint is set, the unrecognized query is matched as is.
+func (up *UserPermission) patternKey(query string) string {
+	if !up.MatchFingerprint {
+		return query
+	}
+	if fingerprint, err := QueryFingerprint(query); err == nil {
+		return fingerprint
+	}
+	return query
+}
+
 // Status defines status of a SQLChain user/miner.
 type Status int32
 
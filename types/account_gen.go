@@ -36,6 +36,20 @@ func (z *Account) Msgsize() (s int) {
 	return
 }
 
+// MarshalHash marshals for hash
+func (z GrantPrivilege) MarshalHash() (o []byte, err error) {
+	var b []byte
+	o = hsp.Require(b, z.Msgsize())
+	o = hsp.AppendInt32(o, int32(z))
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z GrantPrivilege) Msgsize() (s int) {
+	s = hsp.Int32Size
+	return
+}
+
 // MarshalHash marshals for hash
 func (z *MinerInfo) MarshalHash() (o []byte, err error) {
 	var b []byte
@@ -250,13 +264,22 @@ func (z *SQLChainUser) MarshalHash() (o []byte, err error) {
 	if z.Permission == nil {
 		o = hsp.AppendNil(o)
 	} else {
-		// map header, size 2
-		o = append(o, 0x82)
+		// map header, size 4
+		o = append(o, 0x84)
 		o = hsp.AppendInt32(o, int32(z.Permission.Role))
 		o = hsp.AppendArrayHeader(o, uint32(len(z.Permission.Patterns)))
 		for za0001 := range z.Permission.Patterns {
 			o = hsp.AppendString(o, z.Permission.Patterns[za0001])
 		}
+		o = hsp.AppendBool(o, z.Permission.MatchFingerprint)
+		o = hsp.AppendArrayHeader(o, uint32(len(z.Permission.Grants)))
+		for za0002 := range z.Permission.Grants {
+			if oTemp, err := z.Permission.Grants[za0002].MarshalHash(); err != nil {
+				return nil, err
+			} else {
+				o = hsp.AppendBytes(o, oTemp)
+			}
+		}
 	}
 	o = hsp.AppendInt32(o, int32(z.Status))
 	return
@@ -272,6 +295,10 @@ func (z *SQLChainUser) Msgsize() (s int) {
 		for za0001 := range z.Permission.Patterns {
 			s += hsp.StringPrefixSize + len(z.Permission.Patterns[za0001])
 		}
+		s += 17 + hsp.BoolSize + 7 + hsp.ArrayHeaderSize
+		for za0002 := range z.Permission.Grants {
+			s += z.Permission.Grants[za0002].Msgsize()
+		}
 	}
 	s += 7 + hsp.Int32Size
 	return
@@ -291,6 +318,31 @@ func (z Status) Msgsize() (s int) {
 	return
 }
 
+// MarshalHash marshals for hash
+func (z *TableGrant) MarshalHash() (o []byte, err error) {
+	var b []byte
+	o = hsp.Require(b, z.Msgsize())
+	// map header, size 3
+	o = append(o, 0x83)
+	o = hsp.AppendArrayHeader(o, uint32(len(z.Columns)))
+	for za0001 := range z.Columns {
+		o = hsp.AppendString(o, z.Columns[za0001])
+	}
+	o = hsp.AppendInt32(o, int32(z.Privileges))
+	o = hsp.AppendString(o, z.Table)
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *TableGrant) Msgsize() (s int) {
+	s = 1 + 8 + hsp.ArrayHeaderSize
+	for za0001 := range z.Columns {
+		s += hsp.StringPrefixSize + len(z.Columns[za0001])
+	}
+	s += 11 + hsp.Int32Size + 6 + hsp.StringPrefixSize + len(z.Table)
+	return
+}
+
 // MarshalHash marshals for hash
 func (z *UserArrears) MarshalHash() (o []byte, err error) {
 	var b []byte
@@ -316,8 +368,17 @@ func (z *UserArrears) Msgsize() (s int) {
 func (z *UserPermission) MarshalHash() (o []byte, err error) {
 	var b []byte
 	o = hsp.Require(b, z.Msgsize())
-	// map header, size 2
-	o = append(o, 0x82)
+	// map header, size 4
+	o = append(o, 0x84)
+	o = hsp.AppendArrayHeader(o, uint32(len(z.Grants)))
+	for za0002 := range z.Grants {
+		if oTemp, err := z.Grants[za0002].MarshalHash(); err != nil {
+			return nil, err
+		} else {
+			o = hsp.AppendBytes(o, oTemp)
+		}
+	}
+	o = hsp.AppendBool(o, z.MatchFingerprint)
 	o = hsp.AppendArrayHeader(o, uint32(len(z.Patterns)))
 	for za0001 := range z.Patterns {
 		o = hsp.AppendString(o, z.Patterns[za0001])
@@ -328,7 +389,11 @@ func (z *UserPermission) MarshalHash() (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *UserPermission) Msgsize() (s int) {
-	s = 1 + 9 + hsp.ArrayHeaderSize
+	s = 1 + 7 + hsp.ArrayHeaderSize
+	for za0002 := range z.Grants {
+		s += z.Grants[za0002].Msgsize()
+	}
+	s += 17 + hsp.BoolSize + 9 + hsp.ArrayHeaderSize
 	for za0001 := range z.Patterns {
 		s += hsp.StringPrefixSize + len(z.Patterns[za0001])
 	}
@@ -96,5 +96,88 @@ func TestUserPermission(t *testing.T) {
 			},
 		})
 		So(state, ShouldBeFalse)
+
+		// fingerprint patterns
+		p := UserPermissionFromRole(Read)
+		p.Patterns = []string{"select * from test where id = 1", "not a query"}
+		// exact match by default
+		_, state = p.HasDisallowedQueryPatterns([]Query{
+			{
+				Pattern: "SELECT *  FROM test WHERE id=2",
+			},
+		})
+		So(state, ShouldBeTrue)
+		p = UserPermissionFromRole(Read)
+		p.Patterns = []string{"select * from test where id = 1", "not a query"}
+		p.MatchFingerprint = true
+		_, state = p.HasDisallowedQueryPatterns([]Query{
+			{
+				Pattern: "SELECT *  FROM test WHERE id=2",
+			},
+			{
+				Pattern: "not a query",
+			},
+		})
+		So(state, ShouldBeFalse)
+		query, state := p.HasDisallowedQueryPatterns([]Query{
+			{
+				Pattern: "select * from test where name = 'a'",
+			},
+		})
+		So(state, ShouldBeTrue)
+		So(query, ShouldEqual, "select * from test where name = 'a'")
+	})
+}
+
+func TestTableGrant(t *testing.T) {
+	Convey("test grant privilege marshal/unmarshal json", t, func() {
+		jsonBytes, err := json.Marshal(SelectPrivilege | UpdatePrivilege)
+		So(err, ShouldBeNil)
+		So(jsonBytes, ShouldResemble, []byte(`"SELECT,UPDATE"`))
+		var p GrantPrivilege
+		err = json.Unmarshal([]byte(`"ALL"`), &p)
+		So(err, ShouldBeNil)
+		So(p, ShouldEqual, AllPrivileges)
+		err = json.Unmarshal([]byte(`"select, insert"`), &p)
+		So(err, ShouldBeNil)
+		So(p, ShouldEqual, SelectPrivilege|InsertPrivilege)
+		err = json.Unmarshal([]byte(`"DROP"`), &p)
+		So(err, ShouldBeNil)
+		So(p, ShouldEqual, 0)
+	})
+	Convey("test grant validation", t, func() {
+		So((&TableGrant{Table: "t", Privileges: SelectPrivilege}).IsValid(), ShouldBeTrue)
+		So((&TableGrant{Privileges: SelectPrivilege}).IsValid(), ShouldBeFalse)
+		So((&TableGrant{Table: "t"}).IsValid(), ShouldBeFalse)
+		So((&TableGrant{Table: "t", Columns: []string{""}, Privileges: SelectPrivilege}).IsValid(), ShouldBeFalse)
+		So((&TableGrant{Table: "t", Columns: []string{"a"}, Privileges: DeletePrivilege}).IsValid(), ShouldBeFalse)
+
+		p := UserPermissionFromRole(Read)
+		p.Grants = []TableGrant{{Table: "t", Privileges: SelectPrivilege}}
+		So(p.IsValid(), ShouldBeTrue)
+		p.Grants = []TableGrant{{Table: "t", Privileges: SelectPrivilege | InsertPrivilege}}
+		So(p.IsValid(), ShouldBeFalse)
+		p = UserPermissionFromRole(Write)
+		p.Grants = []TableGrant{{Table: "t", Privileges: InsertPrivilege}}
+		So(p.IsValid(), ShouldBeTrue)
+		p.Grants = []TableGrant{{Table: "t", Privileges: SelectPrivilege}}
+		So(p.IsValid(), ShouldBeFalse)
+	})
+	Convey("test is granted", t, func() {
+		p := UserPermissionFromRole(ReadWrite)
+		So(p.HasGrants(), ShouldBeFalse)
+		So(p.IsGranted("t", "a", DeletePrivilege), ShouldBeTrue)
+		p.Grants = []TableGrant{
+			{Table: "t", Privileges: SelectPrivilege | DeletePrivilege},
+			{Table: "u", Columns: []string{"a", "b"}, Privileges: SelectPrivilege | UpdatePrivilege},
+		}
+		So(p.HasGrants(), ShouldBeTrue)
+		So(p.IsGranted("T", "", SelectPrivilege), ShouldBeTrue)
+		So(p.IsGranted("t", "*", DeletePrivilege), ShouldBeTrue)
+		So(p.IsGranted("t", "a", InsertPrivilege), ShouldBeFalse)
+		So(p.IsGranted("u", "A", UpdatePrivilege), ShouldBeTrue)
+		So(p.IsGranted("u", "c", SelectPrivilege), ShouldBeFalse)
+		So(p.IsGranted("u", "*", SelectPrivilege), ShouldBeFalse)
+		So(p.IsGranted("v", "", SelectPrivilege), ShouldBeFalse)
 	})
 }
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/crypto/verifier"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/pkg/errors"
+)
+
+//go:generate hsp
+
+const (
+	// BackupArchiveVersion defines the current backup archive format version.
+	BackupArchiveVersion int32 = 1
+	// BackupChunkSize defines the max byte size of the archive data transferred in a single
+	// backup or restore request.
+	BackupChunkSize = 1 << 20
+)
+
+// BackupHeader defines the header describing a database backup archive.
+type BackupHeader struct {
+	Version     int32            // archive format version
+	DatabaseID  proto.DatabaseID // source database id
+	NodeID      proto.NodeID     // miner node which takes the backup
+	Height      int32            // sqlchain head height at backup time
+	BlockHash   hash.Hash        // sqlchain head block hash at backup time
+	CommitIndex uint64           // kayak commit log index covered by the backup
+	Timestamp   time.Time        // time in UTC zone
+	PayloadHash hash.Hash        // hash of archive data
+	StateMeta   []byte           // state description of archive data, e.g. the state log offset
+}
+
+// SignedBackupHeader defines a backup header signed by the miner.
+type SignedBackupHeader struct {
+	BackupHeader
+	verifier.DefaultHashSignVerifierImpl
+}
+
+// BackupArchive defines a self-describing database backup archive.
+type BackupArchive struct {
+	Header SignedBackupHeader
+	Data   []byte
+}
+
+// BackupRequestHeader defines the header of a database backup request.
+type BackupRequestHeader struct {
+	DatabaseID proto.DatabaseID
+	Timestamp  time.Time
+}
+
+// SignedBackupRequestHeader defines a backup request header signed by the database user.
+type SignedBackupRequestHeader struct {
+	BackupRequestHeader
+	verifier.DefaultHashSignVerifierImpl
+}
+
+// RestoreRequestHeader defines the header of a database restore request.
+type RestoreRequestHeader struct {
+	DatabaseID  proto.DatabaseID // target database id, could differ from the source database
+	ArchiveHash hash.Hash        // hash of the signed backup header to restore
+	Timestamp   time.Time
+}
+
+// SignedRestoreRequestHeader defines a restore request header signed by the database user.
+type SignedRestoreRequestHeader struct {
+	RestoreRequestHeader
+	verifier.DefaultHashSignVerifierImpl
+}
+
+// Sign signs the backup header, the payload hash must be set to the hash of archive data.
+func (sh *SignedBackupHeader) Sign(signer *asymmetric.PrivateKey) (err error) {
+	sh.Version = BackupArchiveVersion
+	return sh.DefaultHashSignVerifierImpl.Sign(&sh.BackupHeader, signer)
+}
+
+// Verify checks the version and the signature of the backup header.
+func (sh *SignedBackupHeader) Verify() (err error) {
+	if sh.Version != BackupArchiveVersion {
+		return errors.Wrapf(ErrInvalidBackupArchive, "unsupported archive version: %d", sh.Version)
+	}
+	return sh.DefaultHashSignVerifierImpl.Verify(&sh.BackupHeader)
+}
+
+// Sign computes the data hash and signs the backup archive.
+func (a *BackupArchive) Sign(signer *asymmetric.PrivateKey) (err error) {
+	a.Header.PayloadHash = hash.THashH(a.Data)
+	return a.Header.Sign(signer)
+}
+
+// Verify checks the header signature and the data hash of the backup archive.
+func (a *BackupArchive) Verify() (err error) {
+	if err = a.Header.Verify(); err != nil {
+		return
+	}
+	if h := hash.THashH(a.Data); !h.IsEqual(&a.Header.PayloadHash) {
+		return errors.Wrap(ErrInvalidBackupArchive, "archive data hash mismatched")
+	}
+	return
+}
+
+// Sign the request.
+func (sh *SignedBackupRequestHeader) Sign(signer *asymmetric.PrivateKey) (err error) {
+	return sh.DefaultHashSignVerifierImpl.Sign(&sh.BackupRequestHeader, signer)
+}
+
+// Verify checks hash and signature in backup request header.
+func (sh *SignedBackupRequestHeader) Verify() (err error) {
+	return sh.DefaultHashSignVerifierImpl.Verify(&sh.BackupRequestHeader)
+}
+
+// Sign the request.
+func (sh *SignedRestoreRequestHeader) Sign(signer *asymmetric.PrivateKey) (err error) {
+	return sh.DefaultHashSignVerifierImpl.Sign(&sh.RestoreRequestHeader, signer)
+}
+
+// Verify checks hash and signature in restore request header.
+func (sh *SignedRestoreRequestHeader) Verify() (err error) {
+	return sh.DefaultHashSignVerifierImpl.Verify(&sh.RestoreRequestHeader)
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBackupArchive(t *testing.T) {
+	Convey("backup archive should be signed and verified", t, func() {
+		privKey, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+
+		archive := &BackupArchive{
+			Header: SignedBackupHeader{
+				BackupHeader: BackupHeader{
+					DatabaseID:  "db",
+					NodeID:      "00000bef611d346c0cbe1beaa76e7f0ed705a194fdf9ac3a248ec70e9c198bf9",
+					Height:      10,
+					CommitIndex: 100,
+					Timestamp:   time.Now().UTC(),
+				},
+			},
+			Data: []byte("data"),
+		}
+		err = archive.Sign(privKey)
+		So(err, ShouldBeNil)
+		So(archive.Verify(), ShouldBeNil)
+
+		// encode and decode
+		buf, err := utils.EncodeMsgPack(archive)
+		So(err, ShouldBeNil)
+		decoded := &BackupArchive{}
+		err = utils.DecodeMsgPack(buf.Bytes(), decoded)
+		So(err, ShouldBeNil)
+		So(decoded.Verify(), ShouldBeNil)
+		So(decoded.Header.Hash(), ShouldEqual, archive.Header.Hash())
+
+		// tampered data
+		decoded.Data = []byte("tampered")
+		So(errors.Cause(decoded.Verify()), ShouldEqual, ErrInvalidBackupArchive)
+
+		// tampered header
+		archive.Header.CommitIndex++
+		So(archive.Verify(), ShouldNotBeNil)
+
+		// unknown version
+		archive.Header.Version = BackupArchiveVersion + 1
+		So(errors.Cause(archive.Verify()), ShouldEqual, ErrInvalidBackupArchive)
+	})
+}
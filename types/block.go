@@ -167,7 +167,43 @@ func (b *Block) Signee() *ca.PublicKey {
 	return b.SignedHeader.HSV.Signee
 }
 
+// ResponseProof returns the merkle inclusion proof of the response packed in the block, the ack
+// is also returned if the response is packed as an ack, whose hash is the proved leaf. A nil
+// proof is returned if the response is not packed in the block.
+func (b *Block) ResponseProof(response *hash.Hash) (
+	proof *merkle.Proof, ack *SignedAckHeader, err error,
+) {
+	var index = -1
+	for i, v := range b.QueryTxs {
+		if v.Response == nil {
+			continue
+		}
+		if rh := v.Response.Hash(); rh.IsEqual(response) {
+			index = len(b.FailedReqs) + i
+			break
+		}
+	}
+	for i, v := range b.Acks {
+		if index >= 0 {
+			break
+		}
+		if rh := v.GetResponseHash(); rh.IsEqual(response) {
+			index, ack = len(b.FailedReqs)+len(b.QueryTxs)+i, v
+		}
+	}
+	if index < 0 {
+		return
+	}
+	proof, err = merkle.NewMerkle(b.leaves()).Proof(index)
+	return
+}
+
 func (b *Block) computeMerkleRoot() hash.Hash {
+	return *merkle.NewMerkle(b.leaves()).GetRoot()
+}
+
+// leaves returns the merkle leaves of the block: the failed requests, the query txs and the acks.
+func (b *Block) leaves() []*hash.Hash {
 	var hs = make([]*hash.Hash, 0, len(b.FailedReqs)+len(b.QueryTxs)+len(b.Acks))
 	for i := range b.FailedReqs {
 		h := b.FailedReqs[i].Header.Hash()
@@ -181,7 +217,7 @@ func (b *Block) computeMerkleRoot() hash.Hash {
 		h := b.Acks[i].Hash()
 		hs = append(hs, &h)
 	}
-	return *merkle.NewMerkle(hs).GetRoot()
+	return hs
 }
 
 // Blocks is Block (reference) array.
@@ -448,3 +448,51 @@ func Test(t *testing.T) {
 		}
 	})
 }
+
+func TestBlockResponseProof(t *testing.T) {
+	Convey("the responses packed in block should be proved against the merkle root", t, func() {
+		newResponse := func(seqNo uint64) *SignedResponseHeader {
+			resp := &SignedResponseHeader{
+				ResponseHeader: ResponseHeader{Request: RequestHeader{SeqNo: seqNo}},
+			}
+			So(resp.BuildHash(), ShouldBeNil)
+			return resp
+		}
+		var (
+			write = newResponse(1)
+			read  = newResponse(2)
+			other = newResponse(3)
+		)
+		block, err := createRandomBlock(genesisHash, false)
+		So(err, ShouldBeNil)
+		block.FailedReqs = []*Request{{}}
+		block.QueryTxs = []*QueryAsTx{{Response: newResponse(4)}, {Response: write}}
+		block.Acks = []*SignedAckHeader{{
+			AckHeader: AckHeader{Response: read.ResponseHeader, ResponseHash: read.Hash()},
+		}}
+		block.Acks[0].DataHash = generateRandomHash()
+		priv, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		So(block.PackAndSignBlock(priv), ShouldBeNil)
+
+		h := write.Hash()
+		proof, ack, err := block.ResponseProof(&h)
+		So(err, ShouldBeNil)
+		So(ack, ShouldBeNil)
+		So(proof.Verify(&h, &block.SignedHeader.MerkleRoot), ShouldBeTrue)
+
+		h = read.Hash()
+		proof, ack, err = block.ResponseProof(&h)
+		So(err, ShouldBeNil)
+		So(ack, ShouldEqual, block.Acks[0])
+		So(proof.Verify(&h, &block.SignedHeader.MerkleRoot), ShouldBeFalse)
+		leaf := ack.Hash()
+		So(proof.Verify(&leaf, &block.SignedHeader.MerkleRoot), ShouldBeTrue)
+
+		h = other.Hash()
+		proof, ack, err = block.ResponseProof(&h)
+		So(err, ShouldBeNil)
+		So(proof, ShouldBeNil)
+		So(ack, ShouldBeNil)
+	})
+}
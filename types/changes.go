@@ -0,0 +1,54 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+// RowChangeOp defines the operation of a row change.
+type RowChangeOp int32
+
+const (
+	// RowInsert is the operation of an inserted row.
+	RowInsert RowChangeOp = iota + 1
+	// RowUpdate is the operation of an updated row.
+	RowUpdate
+	// RowDelete is the operation of a deleted row.
+	RowDelete
+)
+
+func (o RowChangeOp) String() string {
+	switch o {
+	case RowInsert:
+		return "INSERT"
+	case RowUpdate:
+		return "UPDATE"
+	case RowDelete:
+		return "DELETE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// RowChange defines a row level change made by a write query.
+type RowChange struct {
+	LogOffset  uint64 // log offset of the write query
+	Table      string
+	Op         RowChangeOp
+	Columns    []string
+	PrimaryKey []string      // primary key columns, or "rowid" if the table declares no primary key
+	Key        []interface{} // primary key values of the row, the new ones for update
+	Old        []interface{} // column values before the change, nil for insert
+	New        []interface{} // column values after the change, nil for delete
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+// QueryPeersReq defines a request of the QueryPeers RPC method.
+type QueryPeersReq struct {
+	proto.Envelope
+	DatabaseID proto.DatabaseID
+}
+
+// QueryPeersResp defines a response of the QueryPeers RPC method.
+type QueryPeersResp struct {
+	proto.Envelope
+	Peers *proto.Peers
+}
+
+// DatabaseUsage defines the resource usage of a database instance on a miner.
+type DatabaseUsage struct {
+	SpaceUsed     uint64 // storage space used in bytes
+	SpaceLimit    uint64 // reserved storage space in bytes, 0 for unlimited
+	MemoryCeiling uint64 // upper bound of the page cache of the open storage connections in bytes
+	MemoryLimit   uint64 // reserved memory in bytes, 0 for unlimited
+}
+
+// QueryUsageReq defines a request of the QueryUsage RPC method.
+type QueryUsageReq struct {
+	proto.Envelope
+	DatabaseID proto.DatabaseID
+}
+
+// QueryUsageResp defines a response of the QueryUsage RPC method.
+type QueryUsageResp struct {
+	proto.Envelope
+	Usage DatabaseUsage
+}
+
+// BackupReq defines a request of the Backup RPC method, a new archive is taken if ArchiveHash is
+// empty, otherwise the data chunk of the taken archive at Offset is returned.
+type BackupReq struct {
+	proto.Envelope
+	Header      SignedBackupRequestHeader
+	ArchiveHash hash.Hash
+	Offset      uint64
+}
+
+// BackupResp defines a response of the Backup RPC method.
+type BackupResp struct {
+	proto.Envelope
+	Header *SignedBackupHeader // header of the archive
+	Size   uint64              // byte size of the archive data
+	Chunk  []byte              // archive data chunk at the requested offset
+}
+
+// RestoreReq defines a request of the Restore RPC method, the archive data is uploaded in chunks
+// and the restore is applied once the last chunk is received.
+type RestoreReq struct {
+	proto.Envelope
+	Header        SignedRestoreRequestHeader
+	ArchiveHeader *SignedBackupHeader
+	Size          uint64 // byte size of the archive data
+	Offset        uint64 // offset of the chunk in archive data
+	Chunk         []byte
+}
+
+// RestoreResp defines a response of the Restore RPC method.
+type RestoreResp struct {
+	proto.Envelope
+}
+
+// SetRateLimitReq defines a request of the SetRateLimit RPC method.
+type SetRateLimitReq struct {
+	proto.Envelope
+	Header SignedRateLimitRequestHeader
+}
+
+// SetRateLimitResp defines a response of the SetRateLimit RPC method.
+type SetRateLimitResp struct {
+	proto.Envelope
+}
+
+// FetchChangesReq defines a request of the FetchChanges RPC method.
+type FetchChangesReq struct {
+	proto.Envelope
+	DatabaseID proto.DatabaseID
+	Offset     uint64 // fetch the changes of the write queries from this log offset
+	Limit      int    // max change count, the changes of a query are never split
+}
+
+// FetchChangesResp defines a response of the FetchChanges RPC method.
+type FetchChangesResp struct {
+	proto.Envelope
+	Changes []RowChange
+	Next    uint64 // log offset to resume fetching from
+}
+
+// SetQueryLimitReq defines a request of the SetQueryLimit RPC method.
+type SetQueryLimitReq struct {
+	proto.Envelope
+	Header SignedQueryLimitRequestHeader
+}
+
+// SetQueryLimitResp defines a response of the SetQueryLimit RPC method.
+type SetQueryLimitResp struct {
+	proto.Envelope
+}
+
+// OpenCursorReq defines a request of the OpenCursor RPC method.
+type OpenCursorReq struct {
+	proto.Envelope
+	Request   Request // request of a single read query
+	BatchSize int     // max row count of the first batch
+}
+
+// OpenCursorResp defines a response of the OpenCursor RPC method.
+type OpenCursorResp struct {
+	proto.Envelope
+	Response Response // response with the first batch of rows
+	CursorID uint64   // cursor to fetch the following rows, 0 if all the rows are returned
+}
+
+// FetchCursorReq defines a request of the FetchCursor RPC method.
+type FetchCursorReq struct {
+	proto.Envelope
+	DatabaseID proto.DatabaseID
+	CursorID   uint64
+	BatchSize  int // max row count of the batch
+}
+
+// FetchCursorResp defines a response of the FetchCursor RPC method.
+type FetchCursorResp struct {
+	proto.Envelope
+	Rows     []ResponseRow
+	Done     bool                  // no more rows, the cursor is closed
+	Response *SignedResponseHeader // response of the whole cursor to acknowledge, set if done
+}
+
+// CloseCursorReq defines a request of the CloseCursor RPC method.
+type CloseCursorReq struct {
+	proto.Envelope
+	DatabaseID proto.DatabaseID
+	CursorID   uint64
+}
+
+// CloseCursorResp defines a response of the CloseCursor RPC method.
+type CloseCursorResp struct {
+	proto.Envelope
+	Response *SignedResponseHeader // response of the whole cursor to acknowledge
+}
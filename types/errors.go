@@ -32,4 +32,10 @@ var (
 	ErrBillingNotMatch = errors.New("billing request doesn't match")
 	// ErrHashVerification indicates a failed hash verification.
 	ErrHashVerification = errors.New("hash verification failed")
+	// ErrInvalidBackupArchive indicates that the backup archive is malformed or tampered.
+	ErrInvalidBackupArchive = errors.New("invalid backup archive")
+	// ErrStaleRead indicates the state lags behind the min log offset required by the read query.
+	ErrStaleRead = errors.New("stale read")
+	// ErrDatabaseNotExists indicates that the database instance is not served by the node.
+	ErrDatabaseNotExists = errors.New("database instance not exists")
 )
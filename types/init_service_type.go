@@ -38,7 +38,7 @@ type ResourceMeta struct {
 	LoadAvgPerCPU          float64                // max loadAvg15 per CPU
 	EncryptionKey          string                 // encryption key for database instance
 	UseEventualConsistency bool                   // use eventual consistency replication if enabled
-	ConsistencyLevel       float64                // customized strong consistency level
+	ConsistencyLevel       float64                // customized strong consistency level in [0, 1], 0 for default, commits always reach a peer majority
 	IsolationLevel         int                    // customized isolation level
 }
 
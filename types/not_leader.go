@@ -0,0 +1,65 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"regexp"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/pkg/errors"
+)
+
+// unknownLeader is the leader hint of NotLeaderError if the leader is unknown to the peer.
+const unknownLeader = "unknown"
+
+var notLeaderErrorRegexp = regexp.MustCompile(`not leader, leader hint: (\w+)`)
+
+// NotLeaderError defines the error of a write query sent to a peer which is not the leader of
+// the database, it carries the leader known by the peer as a hint for the client to retry. The
+// message is kept parsable by ParseNotLeaderError to be restored from the remote error.
+type NotLeaderError struct {
+	Leader proto.NodeID
+}
+
+// Error implements the error interface.
+func (e *NotLeaderError) Error() string {
+	var leader = string(e.Leader)
+	if leader == "" {
+		leader = unknownLeader
+	}
+	return "not leader, leader hint: " + leader
+}
+
+// ParseNotLeaderError parses the not leader error from the message of err.
+func ParseNotLeaderError(err error) (e *NotLeaderError, ok bool) {
+	if err == nil {
+		return
+	}
+	if e, ok = errors.Cause(err).(*NotLeaderError); ok {
+		return
+	}
+	m := notLeaderErrorRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return
+	}
+	e = &NotLeaderError{}
+	if m[1] != unknownLeader {
+		e.Leader = proto.NodeID(m[1])
+	}
+	ok = true
+	return
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"testing"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNotLeaderError(t *testing.T) {
+	Convey("not leader error should be restored from message", t, func() {
+		err := errors.Wrap(&NotLeaderError{Leader: proto.NodeID("00000abc")}, "apply failed")
+		e, ok := ParseNotLeaderError(err)
+		So(ok, ShouldBeTrue)
+		So(e, ShouldResemble, &NotLeaderError{Leader: proto.NodeID("00000abc")})
+		e, ok = ParseNotLeaderError(errors.New(err.Error()))
+		So(ok, ShouldBeTrue)
+		So(e, ShouldResemble, &NotLeaderError{Leader: proto.NodeID("00000abc")})
+	})
+	Convey("unknown leader should be restored as empty hint", t, func() {
+		err := errors.New((&NotLeaderError{}).Error())
+		So(err.Error(), ShouldEqual, "not leader, leader hint: unknown")
+		e, ok := ParseNotLeaderError(err)
+		So(ok, ShouldBeTrue)
+		So(e.Leader, ShouldBeEmpty)
+		_, ok = ParseNotLeaderError(errors.New("other error"))
+		So(ok, ShouldBeFalse)
+		_, ok = ParseNotLeaderError(nil)
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"strings"
+
+	"github.com/CovenantSQL/sqlparser"
+)
+
+// QueryFingerprint returns the normalized fingerprint of a query: the query is parsed,
+// literals and arguments are replaced by placeholders, whitespaces and letter cases are
+// normalized. Queries only differ in literal values share the same fingerprint.
+func QueryFingerprint(query string) (fingerprint string, err error) {
+	var statements []sqlparser.Statement
+	if _, statements, err = sqlparser.ParseMultiple(sqlparser.NewStringTokenizer(query)); err != nil {
+		return
+	}
+
+	parts := make([]string, 0, len(statements))
+	for _, stmt := range statements {
+		_ = sqlparser.Walk(normalizeLiterals, stmt)
+		if ins, ok := stmt.(*sqlparser.Insert); ok {
+			if rows, ok := ins.Rows.(sqlparser.Values); ok {
+				ins.Rows = dedupRows(rows)
+			}
+		}
+		parts = append(parts, strings.Join(strings.Fields(strings.ToLower(sqlparser.String(stmt))), " "))
+	}
+
+	fingerprint = strings.Join(parts, "; ")
+	return
+}
+
+func normalizeLiterals(node sqlparser.SQLNode) (bool, error) {
+	switch n := node.(type) {
+	case *sqlparser.SQLVal:
+		n.Type = sqlparser.PosArg
+		n.Val = nil
+	case *sqlparser.ComparisonExpr:
+		// collapse literal list of in operator
+		if n.Operator != sqlparser.InStr && n.Operator != sqlparser.NotInStr {
+			break
+		}
+		if tuple, ok := n.Right.(sqlparser.ValTuple); ok && len(tuple) > 1 {
+			for _, e := range tuple {
+				if _, ok := e.(*sqlparser.SQLVal); !ok {
+					return true, nil
+				}
+			}
+			n.Right = tuple[:1]
+		}
+	}
+	return true, nil
+}
+
+// dedupRows removes the duplicated rows of normalized insert values.
+func dedupRows(rows sqlparser.Values) (res sqlparser.Values) {
+	seen := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		key := sqlparser.String(row)
+		if !seen[key] {
+			seen[key] = true
+			res = append(res, row)
+		}
+	}
+	return
+}
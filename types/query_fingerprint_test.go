@@ -0,0 +1,43 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestQueryFingerprint(t *testing.T) {
+	Convey("test query fingerprint", t, func() {
+		cases := [][2]string{
+			{"SELECT  *  FROM `Foo` WHERE id = 1 AND name='x'", "select * from foo where id = ? and name = ?"},
+			{"select * from foo where ID = ? and name = :n", "select * from foo where id = ? and name = ?"},
+			{"insert into t values (1, 'a'), (2, 'b')", "insert into t values (?, ?)"},
+			{"select a from t where id in (1, 2, 3) limit 10", "select a from t where id in (?) limit ?"},
+			{"create table t (a int default 1)", "create table t ( a int default 1 )"},
+			{"select 1; select 2", "select ?; select ?"},
+		}
+		for _, c := range cases {
+			fingerprint, err := QueryFingerprint(c[0])
+			So(err, ShouldBeNil)
+			So(fingerprint, ShouldEqual, c[1])
+		}
+		_, err := QueryFingerprint("not a query")
+		So(err, ShouldNotBeNil)
+	})
+}
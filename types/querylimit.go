@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/verifier"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/pkg/errors"
+)
+
+//go:generate hsp
+//hsp:ignore QueryLimitKind QueryLimitError
+
+// QueryLimit defines the execution limits of a read query, zero means unlimited.
+type QueryLimit struct {
+	Timeout    uint64 // max execution time in milliseconds
+	MaxRows    uint64 // max returned rows of each query
+	MaxBytes   uint64 // max returned bytes of each query
+	MaxVMSteps uint64 // max SQLite VM steps of each request
+}
+
+// IsUnlimited returns whether all the limits are disabled.
+func (l QueryLimit) IsUnlimited() bool {
+	return l.Timeout == 0 && l.MaxRows == 0 && l.MaxBytes == 0 && l.MaxVMSteps == 0
+}
+
+// TimeoutDuration returns the max execution time as duration.
+func (l QueryLimit) TimeoutDuration() time.Duration {
+	return time.Duration(l.Timeout) * time.Millisecond
+}
+
+// Min returns the stricter limits of l and o.
+func (l QueryLimit) Min(o QueryLimit) QueryLimit {
+	return QueryLimit{
+		Timeout:    minLimit(l.Timeout, o.Timeout),
+		MaxRows:    minLimit(l.MaxRows, o.MaxRows),
+		MaxBytes:   minLimit(l.MaxBytes, o.MaxBytes),
+		MaxVMSteps: minLimit(l.MaxVMSteps, o.MaxVMSteps),
+	}
+}
+
+func minLimit(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// UserQueryLimit defines the query limits of a specified database user.
+type UserQueryLimit struct {
+	User  proto.AccountAddress
+	Limit QueryLimit
+}
+
+// QueryLimitConfig defines the per-user query limits of a database.
+type QueryLimitConfig struct {
+	Default QueryLimit       // default limits of each user
+	Users   []UserQueryLimit // overrides of specified users
+}
+
+// UserLimit returns the query limits of the user.
+func (c *QueryLimitConfig) UserLimit(user proto.AccountAddress) QueryLimit {
+	for _, u := range c.Users {
+		if u.User == user {
+			return u.Limit
+		}
+	}
+	return c.Default
+}
+
+// QueryLimitRequestHeader defines the header of a query limit update request.
+type QueryLimitRequestHeader struct {
+	DatabaseID proto.DatabaseID
+	Config     QueryLimitConfig
+	Timestamp  time.Time
+}
+
+// SignedQueryLimitRequestHeader defines a query limit request header signed by the database user.
+type SignedQueryLimitRequestHeader struct {
+	QueryLimitRequestHeader
+	verifier.DefaultHashSignVerifierImpl
+}
+
+// Sign the request.
+func (sh *SignedQueryLimitRequestHeader) Sign(signer *asymmetric.PrivateKey) (err error) {
+	return sh.DefaultHashSignVerifierImpl.Sign(&sh.QueryLimitRequestHeader, signer)
+}
+
+// Verify checks hash and signature in query limit request header.
+func (sh *SignedQueryLimitRequestHeader) Verify() (err error) {
+	return sh.DefaultHashSignVerifierImpl.Verify(&sh.QueryLimitRequestHeader)
+}
+
+// QueryLimitKind defines the kind of an exceeded query limit.
+type QueryLimitKind string
+
+const (
+	// TimeoutLimit is the max execution time limit.
+	TimeoutLimit QueryLimitKind = "timeout"
+	// MaxRowsLimit is the max returned rows limit.
+	MaxRowsLimit QueryLimitKind = "max_rows"
+	// MaxBytesLimit is the max returned bytes limit.
+	MaxBytesLimit QueryLimitKind = "max_bytes"
+	// MaxVMStepsLimit is the max SQLite VM steps limit.
+	MaxVMStepsLimit QueryLimitKind = "max_vm_steps"
+)
+
+var queryLimitErrorRegexp = regexp.MustCompile(`query limit exceeded: (\w+) (\d+)`)
+
+// QueryLimitError defines the error of a read query aborted by the query limits, the message
+// is kept parsable by ParseQueryLimitError to be restored from the remote error.
+type QueryLimitError struct {
+	Kind  QueryLimitKind
+	Limit uint64
+}
+
+// Error implements the error interface.
+func (e *QueryLimitError) Error() string {
+	return fmt.Sprintf("query limit exceeded: %s %d", e.Kind, e.Limit)
+}
+
+// ParseQueryLimitError parses the query limit error from the message of err.
+func ParseQueryLimitError(err error) (e *QueryLimitError, ok bool) {
+	if err == nil {
+		return
+	}
+	if e, ok = errors.Cause(err).(*QueryLimitError); ok {
+		return
+	}
+	m := queryLimitErrorRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return
+	}
+	e = &QueryLimitError{Kind: QueryLimitKind(m[1])}
+	e.Limit, _ = strconv.ParseUint(m[2], 10, 64)
+	ok = true
+	return
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestQueryLimitConfig(t *testing.T) {
+	Convey("user limit should fallback to database default", t, func() {
+		var user1, user2 proto.AccountAddress
+		user1[0], user2[0] = 1, 2
+		cfg := &QueryLimitConfig{
+			Default: QueryLimit{Timeout: 1000, MaxRows: 100},
+			Users: []UserQueryLimit{
+				{User: user1, Limit: QueryLimit{}},
+			},
+		}
+		So(cfg.UserLimit(user1).IsUnlimited(), ShouldBeTrue)
+		So(cfg.UserLimit(user2), ShouldResemble, QueryLimit{Timeout: 1000, MaxRows: 100})
+		So(cfg.UserLimit(user2).TimeoutDuration(), ShouldEqual, time.Second)
+	})
+	Convey("min limit should take the stricter limits", t, func() {
+		a := QueryLimit{Timeout: 1000, MaxRows: 100}
+		b := QueryLimit{Timeout: 2000, MaxBytes: 1 << 20, MaxVMSteps: 1 << 30}
+		So(a.Min(b), ShouldResemble, QueryLimit{
+			Timeout: 1000, MaxRows: 100, MaxBytes: 1 << 20, MaxVMSteps: 1 << 30,
+		})
+		So(a.Min(QueryLimit{}), ShouldResemble, a)
+	})
+	Convey("query limit error should be restored from message", t, func() {
+		err := errors.Wrap(&QueryLimitError{Kind: MaxRowsLimit, Limit: 100}, "query at #0 failed")
+		e, ok := ParseQueryLimitError(err)
+		So(ok, ShouldBeTrue)
+		So(e, ShouldResemble, &QueryLimitError{Kind: MaxRowsLimit, Limit: 100})
+		e, ok = ParseQueryLimitError(errors.New(err.Error()))
+		So(ok, ShouldBeTrue)
+		So(e, ShouldResemble, &QueryLimitError{Kind: MaxRowsLimit, Limit: 100})
+		_, ok = ParseQueryLimitError(errors.New("other error"))
+		So(ok, ShouldBeFalse)
+	})
+	Convey("query limit request should be signed and verified", t, func() {
+		privKey, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+
+		header := &SignedQueryLimitRequestHeader{
+			QueryLimitRequestHeader: QueryLimitRequestHeader{
+				DatabaseID: "db",
+				Config: QueryLimitConfig{
+					Default: QueryLimit{Timeout: 1000},
+					Users:   []UserQueryLimit{{Limit: QueryLimit{MaxRows: 1}}},
+				},
+				Timestamp: time.Now().UTC(),
+			},
+		}
+		So(header.Sign(privKey), ShouldBeNil)
+		So(header.Verify(), ShouldBeNil)
+
+		buf, err := utils.EncodeMsgPack(header)
+		So(err, ShouldBeNil)
+		decoded := &SignedQueryLimitRequestHeader{}
+		So(utils.DecodeMsgPack(buf.Bytes(), decoded), ShouldBeNil)
+		So(decoded.Verify(), ShouldBeNil)
+
+		decoded.Config.Users[0].Limit.MaxRows = 1000
+		So(decoded.Verify(), ShouldNotBeNil)
+	})
+}
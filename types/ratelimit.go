@@ -0,0 +1,90 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/verifier"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+//go:generate hsp
+
+// RateLimit defines a token bucket limit of queries.
+type RateLimit struct {
+	Rate  float64 // queries per second, 0 for unlimited
+	Burst uint32  // bucket size, defaults to the ceil of rate if 0
+}
+
+// IsUnlimited returns whether the rate limit is disabled.
+func (l RateLimit) IsUnlimited() bool {
+	return l.Rate <= 0
+}
+
+// UserRateLimit defines the rate limits of a specified database user.
+type UserRateLimit struct {
+	User  proto.AccountAddress
+	Read  RateLimit
+	Write RateLimit
+}
+
+// RateLimitConfig defines the per-user query rate limits of a database.
+type RateLimitConfig struct {
+	Read  RateLimit       // default read limit of each user
+	Write RateLimit       // default write limit of each user
+	Users []UserRateLimit // overrides of specified users
+}
+
+// UserLimit returns the rate limit of the user for the query type.
+func (c *RateLimitConfig) UserLimit(user proto.AccountAddress, queryType QueryType) RateLimit {
+	read, write := c.Read, c.Write
+	for _, u := range c.Users {
+		if u.User == user {
+			read, write = u.Read, u.Write
+			break
+		}
+	}
+	if queryType == WriteQuery {
+		return write
+	}
+	return read
+}
+
+// RateLimitRequestHeader defines the header of a rate limit update request.
+type RateLimitRequestHeader struct {
+	DatabaseID proto.DatabaseID
+	Config     RateLimitConfig
+	Timestamp  time.Time
+}
+
+// SignedRateLimitRequestHeader defines a rate limit request header signed by the database user.
+type SignedRateLimitRequestHeader struct {
+	RateLimitRequestHeader
+	verifier.DefaultHashSignVerifierImpl
+}
+
+// Sign the request.
+func (sh *SignedRateLimitRequestHeader) Sign(signer *asymmetric.PrivateKey) (err error) {
+	return sh.DefaultHashSignVerifierImpl.Sign(&sh.RateLimitRequestHeader, signer)
+}
+
+// Verify checks hash and signature in rate limit request header.
+func (sh *SignedRateLimitRequestHeader) Verify() (err error) {
+	return sh.DefaultHashSignVerifierImpl.Verify(&sh.RateLimitRequestHeader)
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRateLimitConfig(t *testing.T) {
+	Convey("user limit should fallback to database default", t, func() {
+		var user1, user2 proto.AccountAddress
+		user1[0], user2[0] = 1, 2
+		cfg := &RateLimitConfig{
+			Read:  RateLimit{Rate: 100, Burst: 200},
+			Write: RateLimit{Rate: 10},
+			Users: []UserRateLimit{
+				{User: user1, Read: RateLimit{Rate: 1}, Write: RateLimit{}},
+			},
+		}
+		So(cfg.UserLimit(user1, ReadQuery), ShouldResemble, RateLimit{Rate: 1})
+		So(cfg.UserLimit(user1, WriteQuery).IsUnlimited(), ShouldBeTrue)
+		So(cfg.UserLimit(user2, ReadQuery), ShouldResemble, RateLimit{Rate: 100, Burst: 200})
+		So(cfg.UserLimit(user2, WriteQuery), ShouldResemble, RateLimit{Rate: 10})
+	})
+	Convey("rate limit request should be signed and verified", t, func() {
+		privKey, _, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+
+		header := &SignedRateLimitRequestHeader{
+			RateLimitRequestHeader: RateLimitRequestHeader{
+				DatabaseID: "db",
+				Config: RateLimitConfig{
+					Read:  RateLimit{Rate: 100},
+					Users: []UserRateLimit{{Write: RateLimit{Rate: 1, Burst: 1}}},
+				},
+				Timestamp: time.Now().UTC(),
+			},
+		}
+		So(header.Sign(privKey), ShouldBeNil)
+		So(header.Verify(), ShouldBeNil)
+
+		buf, err := utils.EncodeMsgPack(header)
+		So(err, ShouldBeNil)
+		decoded := &SignedRateLimitRequestHeader{}
+		So(utils.DecodeMsgPack(buf.Bytes(), decoded), ShouldBeNil)
+		So(decoded.Verify(), ShouldBeNil)
+
+		decoded.Config.Users[0].Write.Rate = 1000
+		So(decoded.Verify(), ShouldNotBeNil)
+	})
+}
@@ -40,6 +40,16 @@ const (
 	NumberOfQueryType
 )
 
+// QueryDialect enumerates the SQL dialects the queries of a request are written in.
+type QueryDialect int32
+
+const (
+	// SQLiteDialect defines the native SQLite dialect.
+	SQLiteDialect QueryDialect = iota
+	// MySQLDialect defines the MySQL dialect, which is translated to SQLite before execution.
+	MySQLDialect
+)
+
 // NamedArg defines the named argument structure for database.
 type NamedArg struct {
 	Name  string
@@ -67,6 +77,9 @@ type RequestHeader struct {
 	Timestamp    time.Time        `json:"t"`  // time in UTC zone
 	BatchCount   uint64           `json:"bc"` // query count in this request
 	QueriesHash  hash.Hash        `json:"qh"` // hash of query payload
+	AsOfHeight   int32            `json:"ah"` // read as of the chain height, 0 for the latest state
+	Dialect      QueryDialect     `json:"dl"` // sql dialect of the queries
+	MinLogOffset uint64           `json:"mo"` // min log offset the serving node must have applied
 }
 
 // GetQueryKey returns a unique query key of this request.
@@ -116,6 +129,18 @@ func (t QueryType) String() string {
 	}
 }
 
+// String implements fmt.Stringer for logging purpose.
+func (d QueryDialect) String() string {
+	switch d {
+	case SQLiteDialect:
+		return "sqlite"
+	case MySQLDialect:
+		return "mysql"
+	default:
+		return "unknown"
+	}
+}
+
 // Verify checks hash and signature in request header.
 func (sh *SignedRequestHeader) Verify() (err error) {
 	return sh.DefaultHashSignVerifierImpl.Verify(&sh.RequestHeader)
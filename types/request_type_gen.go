@@ -56,6 +56,20 @@ func (z *Query) Msgsize() (s int) {
 	return
 }
 
+// MarshalHash marshals for hash
+func (z QueryDialect) MarshalHash() (o []byte, err error) {
+	var b []byte
+	o = hsp.Require(b, z.Msgsize())
+	o = hsp.AppendInt32(o, int32(z))
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z QueryDialect) Msgsize() (s int) {
+	s = hsp.Int32Size
+	return
+}
+
 // MarshalHash marshals for hash
 func (z *QueryKey) MarshalHash() (o []byte, err error) {
 	var b []byte
@@ -141,8 +155,9 @@ func (z *Request) Msgsize() (s int) {
 func (z *RequestHeader) MarshalHash() (o []byte, err error) {
 	var b []byte
 	o = hsp.Require(b, z.Msgsize())
-	// map header, size 8
-	o = append(o, 0x88)
+	// map header, size 11
+	o = append(o, 0x8b)
+	o = hsp.AppendInt32(o, z.AsOfHeight)
 	o = hsp.AppendUint64(o, z.BatchCount)
 	o = hsp.AppendUint64(o, z.ConnectionID)
 	if oTemp, err := z.DatabaseID.MarshalHash(); err != nil {
@@ -150,6 +165,8 @@ func (z *RequestHeader) MarshalHash() (o []byte, err error) {
 	} else {
 		o = hsp.AppendBytes(o, oTemp)
 	}
+	o = hsp.AppendInt32(o, int32(z.Dialect))
+	o = hsp.AppendUint64(o, z.MinLogOffset)
 	if oTemp, err := z.NodeID.MarshalHash(); err != nil {
 		return nil, err
 	} else {
@@ -168,7 +185,7 @@ func (z *RequestHeader) MarshalHash() (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *RequestHeader) Msgsize() (s int) {
-	s = 1 + 11 + hsp.Uint64Size + 13 + hsp.Uint64Size + 11 + z.DatabaseID.Msgsize() + 7 + z.NodeID.Msgsize() + 12 + z.QueriesHash.Msgsize() + 10 + hsp.Int32Size + 6 + hsp.Uint64Size + 10 + hsp.TimeSize
+	s = 1 + 11 + hsp.Int32Size + 11 + hsp.Uint64Size + 13 + hsp.Uint64Size + 11 + z.DatabaseID.Msgsize() + 8 + hsp.Int32Size + 13 + hsp.Uint64Size + 7 + z.NodeID.Msgsize() + 12 + z.QueriesHash.Msgsize() + 10 + hsp.Int32Size + 6 + hsp.Uint64Size + 10 + hsp.TimeSize
 	return
 }
 
@@ -19,6 +19,7 @@ package types
 import (
 	"time"
 
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
 	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/pkg/errors"
@@ -26,6 +27,40 @@ import (
 
 //go:generate hsp
 
+const (
+	// VMStepsPerCostUnit is the SQLite VM steps charged as a single cost unit.
+	VMStepsPerCostUnit = 10000
+	// BytesPerCostUnit is the returned payload bytes charged as a single cost unit.
+	BytesPerCostUnit = 1024
+	// MaxCostUnitsPerRow is the max metered cost units billed per returned or affected row, it
+	// bounds the VM steps and bytes reported by the responding node with the row count that is
+	// verifiable by the client.
+	MaxCostUnitsPerRow = 100
+)
+
+// QueryCost defines the resources consumed by a query request on the responding node.
+type QueryCost struct {
+	VMSteps       uint64 `json:"vs"` // SQLite VM steps evaluated
+	RowsRead      uint64 `json:"rr"` // rows fetched by the read queries
+	RowsWritten   uint64 `json:"rw"` // rows affected by the write queries
+	BytesReturned uint64 `json:"br"` // size of the returned rows
+}
+
+// IsZero returns whether the cost is not recorded.
+func (c *QueryCost) IsZero() bool {
+	return c.VMSteps == 0 && c.RowsRead == 0 && c.RowsWritten == 0 && c.BytesReturned == 0
+}
+
+// Units returns the billing units of the cost.
+func (c *QueryCost) Units() uint64 {
+	return c.RowsRead + c.RowsWritten + c.metered()
+}
+
+// metered returns the cost units of the metered resources, i.e. the VM steps and returned bytes.
+func (c *QueryCost) metered() uint64 {
+	return c.VMSteps/VMStepsPerCostUnit + c.BytesReturned/BytesPerCostUnit
+}
+
 // ResponseRow defines single row of query response.
 type ResponseRow struct {
 	Values []interface{}
@@ -50,6 +85,28 @@ type ResponseHeader struct {
 	AffectedRows    int64                `json:"a"`  // affected rows
 	PayloadHash     hash.Hash            `json:"dh"` // hash of query response payload
 	ResponseAccount proto.AccountAddress `json:"aa"` // response account
+	AsOfHeight      int32                `json:"ah"` // chain height of the state read, 0 for the latest state
+	Cost            QueryCost            `json:"qc"` // resources consumed by the request
+}
+
+// BillingCost returns the billing units of the response: the row count or the affected rows, plus
+// the metered units of the recorded cost.
+//
+// The cost is reported by the responding node itself, so the metered units are bounded by
+// MaxCostUnitsPerRow of the row count acknowledged by the client, and the reported row counts are
+// not used at all.
+func (h *ResponseHeader) BillingCost() (cost uint64) {
+	var rows uint64
+	if h.Request.QueryType == ReadQuery {
+		rows = h.RowCount
+	} else if h.AffectedRows > 0 {
+		rows = uint64(h.AffectedRows)
+	}
+	cost = h.Cost.metered()
+	if limit := (rows + 1) * MaxCostUnitsPerRow; cost > limit {
+		cost = limit
+	}
+	return rows + cost
 }
 
 // GetRequestHash returns the request hash.
@@ -62,10 +119,13 @@ func (h *ResponseHeader) GetRequestTimestamp() time.Time {
 	return h.Request.Timestamp
 }
 
-// SignedResponseHeader defines a signed query response header.
+// SignedResponseHeader defines a signed query response header. The signature covers the response
+// hash only, so the hash packed in blocks is not affected by signing.
 type SignedResponseHeader struct {
 	ResponseHeader
 	ResponseHash hash.Hash
+	Signee       *asymmetric.PublicKey // public key of the response node
+	Signature    *asymmetric.Signature // signature of the response hash
 }
 
 // Hash returns the response header hash.
@@ -85,6 +145,32 @@ func (sh *SignedResponseHeader) BuildHash() (err error) {
 		"compute response header hash failed")
 }
 
+// Sign computes the hash of the response header and signs the hash with signer.
+func (sh *SignedResponseHeader) Sign(signer *asymmetric.PrivateKey) (err error) {
+	if err = sh.BuildHash(); err != nil {
+		return
+	}
+	if sh.Signature, err = signer.Sign(sh.ResponseHash[:]); err != nil {
+		return errors.Wrap(err, "sign response header failed")
+	}
+	sh.Signee = signer.PubKey()
+	return
+}
+
+// Verify verifies the hash and the signature of the response header.
+func (sh *SignedResponseHeader) Verify() (err error) {
+	if err = sh.VerifyHash(); err != nil {
+		return
+	}
+	if sh.Signee == nil || sh.Signature == nil {
+		return errors.Wrap(ErrSignVerification, "response header is not signed")
+	}
+	if !sh.Signature.Verify(sh.ResponseHash[:], sh.Signee) {
+		return errors.Wrap(ErrSignVerification, "verify response header signature failed")
+	}
+	return
+}
+
 // Response defines a complete query response.
 type Response struct {
 	Header  SignedResponseHeader `json:"h"`
@@ -116,6 +202,24 @@ func (r *Response) VerifyHash() (err error) {
 	return r.Header.VerifyHash()
 }
 
+// Sign computes the hash of the response and signs the header hash with signer.
+func (r *Response) Sign(signer *asymmetric.PrivateKey) (err error) {
+	if err = r.BuildHash(); err != nil {
+		return
+	}
+	return r.Header.Sign(signer)
+}
+
+// Verify verifies the hash and the header signature of the response.
+func (r *Response) Verify() (err error) {
+	if err = verifyHash(&r.Payload, &r.Header.PayloadHash); err != nil {
+		err = errors.Wrap(err, "verify response payload hash failed")
+		return
+	}
+
+	return r.Header.Verify()
+}
+
 // Hash returns the response header hash.
 func (r *Response) Hash() hash.Hash {
 	return r.Header.Hash()
@@ -6,6 +6,25 @@ import (
 	hsp "github.com/CovenantSQL/HashStablePack/marshalhash"
 )
 
+// MarshalHash marshals for hash
+func (z *QueryCost) MarshalHash() (o []byte, err error) {
+	var b []byte
+	o = hsp.Require(b, z.Msgsize())
+	// map header, size 4
+	o = append(o, 0x84)
+	o = hsp.AppendUint64(o, z.BytesReturned)
+	o = hsp.AppendUint64(o, z.RowsRead)
+	o = hsp.AppendUint64(o, z.RowsWritten)
+	o = hsp.AppendUint64(o, z.VMSteps)
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *QueryCost) Msgsize() (s int) {
+	s = 1 + 14 + hsp.Uint64Size + 9 + hsp.Uint64Size + 12 + hsp.Uint64Size + 8 + hsp.Uint64Size
+	return
+}
+
 // MarshalHash marshals for hash
 func (z *Response) MarshalHash() (o []byte, err error) {
 	var b []byte
@@ -41,9 +60,16 @@ func (z *Response) Msgsize() (s int) {
 func (z *ResponseHeader) MarshalHash() (o []byte, err error) {
 	var b []byte
 	o = hsp.Require(b, z.Msgsize())
-	// map header, size 10
-	o = append(o, 0x8a)
+	// map header, size 12
+	o = append(o, 0x8c)
 	o = hsp.AppendInt64(o, z.AffectedRows)
+	o = hsp.AppendInt32(o, z.AsOfHeight)
+	// map header, size 4
+	o = append(o, 0x84)
+	o = hsp.AppendUint64(o, z.Cost.BytesReturned)
+	o = hsp.AppendUint64(o, z.Cost.RowsRead)
+	o = hsp.AppendUint64(o, z.Cost.RowsWritten)
+	o = hsp.AppendUint64(o, z.Cost.VMSteps)
 	o = hsp.AppendInt64(o, z.LastInsertID)
 	o = hsp.AppendUint64(o, z.LogOffset)
 	if oTemp, err := z.NodeID.MarshalHash(); err != nil {
@@ -78,7 +104,7 @@ func (z *ResponseHeader) MarshalHash() (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *ResponseHeader) Msgsize() (s int) {
-	s = 1 + 13 + hsp.Int64Size + 13 + hsp.Int64Size + 10 + hsp.Uint64Size + 7 + z.NodeID.Msgsize() + 12 + z.PayloadHash.Msgsize() + 8 + z.Request.Msgsize() + 12 + z.RequestHash.Msgsize() + 16 + z.ResponseAccount.Msgsize() + 9 + hsp.Uint64Size + 10 + hsp.TimeSize
+	s = 1 + 13 + hsp.Int64Size + 11 + hsp.Int32Size + 5 + 1 + 14 + hsp.Uint64Size + 9 + hsp.Uint64Size + 12 + hsp.Uint64Size + 8 + hsp.Uint64Size + 13 + hsp.Int64Size + 10 + hsp.Uint64Size + 7 + z.NodeID.Msgsize() + 12 + z.PayloadHash.Msgsize() + 8 + z.Request.Msgsize() + 12 + z.RequestHash.Msgsize() + 16 + z.ResponseAccount.Msgsize() + 9 + hsp.Uint64Size + 10 + hsp.TimeSize
 	return
 }
 
@@ -160,8 +186,8 @@ func (z *ResponseRow) Msgsize() (s int) {
 func (z *SignedResponseHeader) MarshalHash() (o []byte, err error) {
 	var b []byte
 	o = hsp.Require(b, z.Msgsize())
-	// map header, size 2
-	o = append(o, 0x82)
+	// map header, size 4
+	o = append(o, 0x84)
 	if oTemp, err := z.ResponseHash.MarshalHash(); err != nil {
 		return nil, err
 	} else {
@@ -172,11 +198,40 @@ func (z *SignedResponseHeader) MarshalHash() (o []byte, err error) {
 	} else {
 		o = hsp.AppendBytes(o, oTemp)
 	}
+	if z.Signature == nil {
+		o = hsp.AppendNil(o)
+	} else {
+		if oTemp, err := z.Signature.MarshalHash(); err != nil {
+			return nil, err
+		} else {
+			o = hsp.AppendBytes(o, oTemp)
+		}
+	}
+	if z.Signee == nil {
+		o = hsp.AppendNil(o)
+	} else {
+		if oTemp, err := z.Signee.MarshalHash(); err != nil {
+			return nil, err
+		} else {
+			o = hsp.AppendBytes(o, oTemp)
+		}
+	}
 	return
 }
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *SignedResponseHeader) Msgsize() (s int) {
-	s = 1 + 13 + z.ResponseHash.Msgsize() + 15 + z.ResponseHeader.Msgsize()
+	s = 1 + 13 + z.ResponseHash.Msgsize() + 15 + z.ResponseHeader.Msgsize() + 10
+	if z.Signature == nil {
+		s += hsp.NilSize
+	} else {
+		s += z.Signature.Msgsize()
+	}
+	s += 7
+	if z.Signee == nil {
+		s += hsp.NilSize
+	} else {
+		s += z.Signee.Msgsize()
+	}
 	return
 }
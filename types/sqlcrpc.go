@@ -0,0 +1,45 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+// FetchInclusionReq defines a request of the sqlchain FetchInclusion RPC method.
+type FetchInclusionReq struct {
+	proto.Envelope
+	DatabaseID proto.DatabaseID
+	Height     int32
+	// Response is the hash of the response to prove, the zero hash fetches the header only.
+	Response hash.Hash
+}
+
+// FetchInclusionResp defines a response of the sqlchain FetchInclusion RPC method.
+type FetchInclusionResp struct {
+	proto.Envelope
+	Height int32
+	// Header is the header of the block at Height, nil if there is no block at this height.
+	Header *SignedHeader
+	// Ack is the ack of the response if it's packed as an ack, the hash of which is the leaf.
+	Ack *SignedAckHeader
+	// Proof is the serialized merkle proof of the response, nil if it's not in the block.
+	Proof []byte
+	// Head is the current head height of the serving node.
+	Head int32
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/pkg/errors"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/ugorji/go/codec"
 )
@@ -250,6 +251,53 @@ func TestResponse_Sign(t *testing.T) {
 				err = res.VerifyHash()
 				So(err, ShouldNotBeNil)
 			})
+			Convey("cost change", func() {
+				res.Header.Cost.VMSteps++
+
+				err = res.VerifyHash()
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("signature verify", func() {
+			privKey, _ := getCommKeys()
+			h := res.Hash()
+
+			// unsigned response
+			err = res.Verify()
+			So(errors.Cause(err), ShouldEqual, ErrSignVerification)
+
+			err = res.Sign(privKey)
+			So(err, ShouldBeNil)
+			So(res.Hash(), ShouldEqual, h)
+			So(res.Header.Signee.IsEqual(privKey.PubKey()), ShouldBeTrue)
+			err = res.Verify()
+			So(err, ShouldBeNil)
+
+			Convey("encode/decode verify", func() {
+				buf, err := utils.EncodeMsgPack(res)
+				So(err, ShouldBeNil)
+				var r *Response
+				err = utils.DecodeMsgPack(buf.Bytes(), &r)
+				So(err, ShouldBeNil)
+				err = r.Verify()
+				So(err, ShouldBeNil)
+			})
+			Convey("header change", func() {
+				res.Header.RowCount++
+				So(res.Header.BuildHash(), ShouldBeNil)
+
+				err = res.Verify()
+				So(errors.Cause(err), ShouldEqual, ErrSignVerification)
+			})
+			Convey("signee change", func() {
+				_, pubKey, err := asymmetric.GenSecp256k1KeyPair()
+				So(err, ShouldBeNil)
+				res.Header.Signee = pubKey
+
+				err = res.Verify()
+				So(errors.Cause(err), ShouldEqual, ErrSignVerification)
+			})
 		})
 	})
 }
@@ -425,6 +473,43 @@ func TestOther_MarshalHash(t *testing.T) {
 	})
 }
 
+func TestResponseHeader_BillingCost(t *testing.T) {
+	Convey("billing cost should be charged by the metered cost", t, func() {
+		h := &ResponseHeader{
+			Request:      RequestHeader{QueryType: ReadQuery},
+			RowCount:     3,
+			AffectedRows: 5,
+		}
+		So(h.Cost.IsZero(), ShouldBeTrue)
+		So(h.BillingCost(), ShouldEqual, 3)
+		h.Request.QueryType = WriteQuery
+		So(h.BillingCost(), ShouldEqual, 5)
+
+		h.Cost = QueryCost{
+			VMSteps:       3*VMStepsPerCostUnit + 1,
+			RowsRead:      1,
+			RowsWritten:   2,
+			BytesReturned: 2*BytesPerCostUnit + 1,
+		}
+		So(h.Cost.Units(), ShouldEqual, 8)
+		// the affected rows plus the metered units, the reported row counts are not billed
+		So(h.BillingCost(), ShouldEqual, 5+5)
+		h.Request.QueryType = ReadQuery
+		So(h.BillingCost(), ShouldEqual, 3+5)
+	})
+	Convey("metered cost should be bounded by the row count", t, func() {
+		h := &ResponseHeader{
+			Request: RequestHeader{QueryType: WriteQuery},
+			Cost:    QueryCost{VMSteps: 1000 * MaxCostUnitsPerRow * VMStepsPerCostUnit},
+		}
+		So(h.BillingCost(), ShouldEqual, MaxCostUnitsPerRow)
+		h.AffectedRows = 2
+		So(h.BillingCost(), ShouldEqual, 2+3*MaxCostUnitsPerRow)
+		h.AffectedRows = -1
+		So(h.BillingCost(), ShouldEqual, MaxCostUnitsPerRow)
+	})
+}
+
 func TestQueryTypeStringer(t *testing.T) {
 	Convey("Query type stringer should return expected string", t, func() {
 		var cases = [...]struct {
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	x "github.com/CovenantSQL/CovenantSQL/xenomint"
+)
+
+// cursorOwner identifies the client connection which opens the cursor.
+type cursorOwner struct {
+	nodeID proto.NodeID
+	connID uint64
+}
+
+type cursorEntry struct {
+	cur   *x.Cursor
+	owner cursorOwner
+	timer *time.Timer
+}
+
+// cursorLimits defines the max open cursors of a client connection, a client node and the whole
+// database. The connection id is chosen by the client, so the connection limit alone doesn't
+// bound the cursors of a node.
+type cursorLimits struct {
+	perConn int
+	perNode int
+	total   int
+}
+
+// cursorPool holds the open cursors of a database. Each cursor is closed and passed to expired if
+// it's not accessed by its owner for ttl, and the open cursors at the same time are capped by
+// limits.
+type cursorPool struct {
+	sync.Mutex
+	ttl     time.Duration
+	limits  cursorLimits
+	expired func(cur *x.Cursor)
+	cursors map[uint64]*cursorEntry
+	conns   map[cursorOwner]int
+	nodes   map[proto.NodeID]int
+	total   int
+	closed  bool
+}
+
+func newCursorPool(ttl time.Duration, limits cursorLimits, expired func(cur *x.Cursor)) *cursorPool {
+	if ttl <= 0 {
+		ttl = DefaultCursorTTL
+	}
+	if limits.perConn <= 0 {
+		limits.perConn = DefaultMaxCursorsPerConn
+	}
+	if limits.perNode <= 0 {
+		limits.perNode = DefaultMaxCursorsPerNode
+	}
+	if limits.total <= 0 {
+		limits.total = DefaultMaxCursorsPerDB
+	}
+	return &cursorPool{
+		ttl:     ttl,
+		limits:  limits,
+		expired: expired,
+		cursors: make(map[uint64]*cursorEntry),
+		conns:   make(map[cursorOwner]int),
+		nodes:   make(map[proto.NodeID]int),
+	}
+}
+
+// reserve reserves a cursor slot of owner before the cursor is opened, the slot should be
+// released if no cursor is added finally.
+func (p *cursorPool) reserve(owner cursorOwner) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return ErrNotExists
+	}
+	if p.conns[owner] >= p.limits.perConn || p.nodes[owner.nodeID] >= p.limits.perNode ||
+		p.total >= p.limits.total {
+		return ErrTooManyCursors
+	}
+	p.conns[owner]++
+	p.nodes[owner.nodeID]++
+	p.total++
+	return
+}
+
+func (p *cursorPool) release(owner cursorOwner) {
+	p.Lock()
+	defer p.Unlock()
+	p.releaseLocked(owner)
+}
+
+func (p *cursorPool) releaseLocked(owner cursorOwner) {
+	if p.conns[owner] <= 1 {
+		delete(p.conns, owner)
+	} else {
+		p.conns[owner]--
+	}
+	if p.nodes[owner.nodeID] <= 1 {
+		delete(p.nodes, owner.nodeID)
+	} else {
+		p.nodes[owner.nodeID]--
+	}
+	p.total--
+}
+
+// add adds the cursor opened in the reserved slot of owner and returns its id.
+func (p *cursorPool) add(owner cursorOwner, cur *x.Cursor) (id uint64) {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		cur.Close()
+		return
+	}
+	for id == 0 || p.cursors[id] != nil {
+		id = rand.Uint64()
+	}
+	cursorID := id
+	p.cursors[id] = &cursorEntry{
+		cur:   cur,
+		owner: owner,
+		timer: time.AfterFunc(p.ttl, func() {
+			if p.remove(cursorID) {
+				if p.expired != nil {
+					p.expired(cur)
+				}
+				log.WithFields(log.Fields{
+					"node":   owner.nodeID,
+					"conn":   owner.connID,
+					"cursor": cursorID,
+				}).Debug("expired idle cursor")
+			}
+		}),
+	}
+	return
+}
+
+// get returns the cursor of id owned by node and resets its ttl.
+func (p *cursorPool) get(id uint64, node proto.NodeID) (cur *x.Cursor, err error) {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.cursors[id]
+	if !ok || e.owner.nodeID != node {
+		err = ErrCursorNotFound
+		return
+	}
+	e.timer.Reset(p.ttl)
+	cur = e.cur
+	return
+}
+
+// remove closes and removes the cursor of id, it returns false if the cursor is not found.
+func (p *cursorPool) remove(id uint64) bool {
+	p.Lock()
+	e, ok := p.cursors[id]
+	if ok {
+		delete(p.cursors, id)
+		p.releaseLocked(e.owner)
+	}
+	p.Unlock()
+	if !ok {
+		return false
+	}
+	e.timer.Stop()
+	e.cur.Close()
+	return true
+}
+
+// closeAll closes all the cursors, no more cursor can be added to the pool afterwards.
+func (p *cursorPool) closeAll() {
+	p.Lock()
+	var cursors = p.cursors
+	p.closed = true
+	p.cursors = make(map[uint64]*cursorEntry)
+	p.conns = make(map[cursorOwner]int)
+	p.nodes = make(map[proto.NodeID]int)
+	p.total = 0
+	p.Unlock()
+	for _, e := range cursors {
+		e.timer.Stop()
+		e.cur.Close()
+	}
+}
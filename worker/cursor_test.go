@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	x "github.com/CovenantSQL/CovenantSQL/xenomint"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCursorPool(t *testing.T) {
+	Convey("Given a chain state with cursors", t, func() {
+		dir, err := ioutil.TempDir("", "cursor")
+		So(err, ShouldBeNil)
+		strg, err := xs.NewSqlite(fmt.Sprint("file:", filepath.Join(dir, "state.db3")))
+		So(err, ShouldBeNil)
+		st := x.NewState(sql.LevelReadUncommitted, proto.NodeID("node"), strg)
+		Reset(func() {
+			So(st.Close(true), ShouldBeNil)
+			os.RemoveAll(dir)
+		})
+		open := func() *x.Cursor {
+			req := &types.Request{}
+			req.Header.QueryType = types.ReadQuery
+			req.Payload.Queries = []types.Query{
+				{Pattern: "select 1 union all select 2 union all select 3"},
+			}
+			_, _, cur, err := st.OpenCursor(req.GetContext(), req, 1)
+			So(err, ShouldBeNil)
+			So(cur, ShouldNotBeNil)
+			return cur
+		}
+		var (
+			owner1 = cursorOwner{nodeID: "node1", connID: 1}
+			owner2 = cursorOwner{nodeID: "node1", connID: 2}
+			owner3 = cursorOwner{nodeID: "node2", connID: 1}
+		)
+
+		Convey("The pool should cap the open cursors of a connection", func() {
+			p := newCursorPool(time.Minute, cursorLimits{perConn: 2}, nil)
+			defer p.closeAll()
+			So(p.reserve(owner1), ShouldBeNil)
+			id1 := p.add(owner1, open())
+			So(p.reserve(owner1), ShouldBeNil)
+			p.add(owner1, open())
+			So(p.reserve(owner1), ShouldEqual, ErrTooManyCursors)
+			So(p.reserve(owner2), ShouldBeNil)
+			p.release(owner2)
+
+			// cursors are only visible to the owner node
+			_, err = p.get(id1, "node2")
+			So(err, ShouldEqual, ErrCursorNotFound)
+			cur, err := p.get(id1, "node1")
+			So(err, ShouldBeNil)
+			rows, done, err := cur.Fetch(1)
+			So(err, ShouldBeNil)
+			So(done, ShouldBeFalse)
+			So(rows, ShouldHaveLength, 1)
+
+			So(p.remove(id1), ShouldBeTrue)
+			So(p.remove(id1), ShouldBeFalse)
+			So(p.reserve(owner1), ShouldBeNil)
+		})
+		Convey("The pool should cap the open cursors of a node and the database", func() {
+			p := newCursorPool(time.Minute, cursorLimits{perConn: 2, perNode: 3, total: 4}, nil)
+			defer p.closeAll()
+			So(p.reserve(owner1), ShouldBeNil)
+			So(p.reserve(owner1), ShouldBeNil)
+			So(p.reserve(owner2), ShouldBeNil)
+			// a new connection id of the same node doesn't bypass the node limit
+			So(p.reserve(cursorOwner{nodeID: "node1", connID: 3}), ShouldEqual, ErrTooManyCursors)
+			So(p.reserve(owner3), ShouldBeNil)
+			So(p.reserve(cursorOwner{nodeID: "node3", connID: 1}), ShouldEqual, ErrTooManyCursors)
+			p.release(owner1)
+			So(p.reserve(owner3), ShouldBeNil)
+			So(p.reserve(owner1), ShouldEqual, ErrTooManyCursors)
+		})
+		Convey("The pool should expire the idle cursors", func() {
+			var expired = make(chan *x.Cursor, 1)
+			p := newCursorPool(100*time.Millisecond, cursorLimits{perConn: 1}, func(cur *x.Cursor) {
+				expired <- cur
+			})
+			defer p.closeAll()
+			So(p.reserve(owner1), ShouldBeNil)
+			cur := open()
+			id := p.add(owner1, cur)
+			time.Sleep(60 * time.Millisecond)
+			_, err = p.get(id, "node1")
+			So(err, ShouldBeNil)
+			time.Sleep(60 * time.Millisecond)
+			_, err = p.get(id, "node1")
+			So(err, ShouldBeNil)
+			time.Sleep(200 * time.Millisecond)
+			_, err = p.get(id, "node1")
+			So(err, ShouldEqual, ErrCursorNotFound)
+			_, _, err = cur.Fetch(1)
+			So(err, ShouldEqual, x.ErrCursorClosed)
+			So(<-expired, ShouldEqual, cur)
+			So(p.reserve(owner1), ShouldBeNil)
+		})
+		Convey("The closed pool should close all cursors", func() {
+			p := newCursorPool(time.Minute, cursorLimits{perConn: 1}, nil)
+			So(p.reserve(owner1), ShouldBeNil)
+			cur := open()
+			p.add(owner1, cur)
+			p.closeAll()
+			_, _, err = cur.Fetch(1)
+			So(err, ShouldEqual, x.ErrCursorClosed)
+			So(p.reserve(owner1), ShouldEqual, ErrNotExists)
+		})
+	})
+}
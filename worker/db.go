@@ -18,8 +18,10 @@ package worker
 
 import (
 	"context"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,11 +34,13 @@ import (
 	kt "github.com/CovenantSQL/CovenantSQL/kayak/types"
 	kl "github.com/CovenantSQL/CovenantSQL/kayak/wal"
 	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/rpc"
 	"github.com/CovenantSQL/CovenantSQL/sqlchain"
 	"github.com/CovenantSQL/CovenantSQL/storage"
 	"github.com/CovenantSQL/CovenantSQL/types"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
 	x "github.com/CovenantSQL/CovenantSQL/xenomint"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
 	"github.com/pkg/errors"
 )
 
@@ -47,6 +51,9 @@ const (
 	// KayakWalFileName defines log pool name of database instance.
 	KayakWalFileName = "kayak.ldb"
 
+	// KayakSnapshotDirName defines kayak snapshot directory name of database instance.
+	KayakSnapshotDirName = "kayak.snap"
+
 	// SQLChainFileName defines sqlchain storage file name.
 	SQLChainFileName = "chain.db"
 
@@ -56,7 +63,8 @@ const (
 	// PrepareThreshold defines the prepare complete threshold.
 	PrepareThreshold = 1.0
 
-	// CommitThreshold defines the commit complete threshold.
+	// CommitThreshold defines the commit complete threshold, the commit is fired asynchronously
+	// by default. Note that kayak raises it to a majority of peers as leader election is enabled.
 	CommitThreshold = 0.0
 
 	// PrepareTimeout defines the prepare timeout config.
@@ -68,6 +76,15 @@ const (
 	// LogWaitTimeout defines the missing log wait timeout config.
 	LogWaitTimeout = 1 * time.Second
 
+	// ElectionTimeout defines the max leader silence before followers start leader election.
+	ElectionTimeout = 10 * time.Second
+
+	// HeartbeatInterval defines the leader heartbeat interval.
+	HeartbeatInterval = 2 * time.Second
+
+	// SnapshotInterval defines the commit log count between kayak snapshots.
+	SnapshotInterval = 10000
+
 	// SlowQuerySampleSize defines the maximum slow query log size (default: 1KB).
 	SlowQuerySampleSize = 1 << 10
 )
@@ -80,12 +97,20 @@ type Database struct {
 	kayakRuntime   *kayak.Runtime
 	kayakConfig    *kt.RuntimeConfig
 	connSeqs       sync.Map
+	connApplied    sync.Map
 	connSeqEvictCh chan uint64
 	chain          *sqlchain.Chain
 	nodeID         proto.NodeID
 	mux            *DBKayakMuxService
 	privateKey     *asymmetric.PrivateKey
 	accountAddr    proto.AccountAddress
+	membershipLock sync.Mutex
+	cursors        *cursorPool
+	backupLock     sync.Mutex
+	backupName     string
+	archiveLock    sync.Mutex
+	limitsLock     sync.Mutex
+	limits         AdminLimits
 }
 
 // NewDatabase create a single database instance using config.
@@ -119,8 +144,14 @@ func NewDatabase(cfg *DBConfig, peers *proto.Peers,
 		mux:            cfg.KayakMux,
 		connSeqEvictCh: make(chan uint64, 1),
 		privateKey:     privateKey,
+		limits:         cfg.Limits,
 		accountAddr:    accountAddr,
 	}
+	// the expired cursors are settled as well, though the responses would never be acknowledged
+	// if the client is gone
+	db.cursors = newCursorPool(cfg.CursorTTL, cfg.cursorLimits(), func(cur *x.Cursor) {
+		db.settleCursor(cur)
+	})
 
 	defer func() {
 		// on error recycle all resources
@@ -148,6 +179,11 @@ func NewDatabase(cfg *DBConfig, peers *proto.Peers,
 		storageDSN.AddParam("_crypto_key", cfg.EncryptionKey)
 	}
 
+	// apply reserved memory as storage cache limit, reserved space is checked by leader on writes
+	if cfg.MemoryLimit > 0 {
+		storageDSN.AddParam(xs.CacheLimitParam, strconv.FormatUint(cfg.MemoryLimit, 10))
+	}
+
 	// init chain
 	chainFile := filepath.Join(cfg.DataDir, SQLChainFileName)
 	if db.nodeID, err = kms.GetLocalNodeID(); err != nil {
@@ -171,7 +207,11 @@ func NewDatabase(cfg *DBConfig, peers *proto.Peers,
 
 		UpdatePeriod: cfg.UpdateBlockCount,
 
-		IsolationLevel: cfg.IsolationLevel,
+		IsolationLevel:  cfg.IsolationLevel,
+		ChangeRetention: cfg.ChangeRetention,
+
+		HistoryPeriod:    cfg.HistoryPeriod,
+		HistoryRetention: cfg.HistoryRetention,
 	}
 	if db.chain, err = sqlchain.NewChain(chainCfg); err != nil {
 		return
@@ -186,20 +226,32 @@ func NewDatabase(cfg *DBConfig, peers *proto.Peers,
 		return
 	}
 
+	prepareThreshold, commitThreshold := quorumThresholds(cfg.ConsistencyLevel)
+
 	db.kayakConfig = &kt.RuntimeConfig{
-		Handler:          db,
-		PrepareThreshold: PrepareThreshold,
-		CommitThreshold:  CommitThreshold,
-		PrepareTimeout:   PrepareTimeout,
-		CommitTimeout:    CommitTimeout,
-		LogWaitTimeout:   LogWaitTimeout,
-		Peers:            peers,
-		Wal:              db.kayakWal,
-		NodeID:           db.nodeID,
-		InstanceID:       string(db.dbID),
-		ServiceName:      DBKayakRPCName,
-		ApplyMethodName:  DBKayakApplyMethodName,
-		FetchMethodName:  DBKayakFetchMethodName,
+		Handler:             db,
+		PrepareThreshold:    prepareThreshold,
+		CommitThreshold:     commitThreshold,
+		PrepareTimeout:      PrepareTimeout,
+		CommitTimeout:       CommitTimeout,
+		LogWaitTimeout:      LogWaitTimeout,
+		ElectionTimeout:     ElectionTimeout,
+		HeartbeatInterval:   HeartbeatInterval,
+		Peers:               peers,
+		Wal:                 db.kayakWal,
+		NodeID:              db.nodeID,
+		InstanceID:          string(db.dbID),
+		ServiceName:         DBKayakRPCName,
+		ApplyMethodName:     DBKayakApplyMethodName,
+		FetchMethodName:     DBKayakFetchMethodName,
+		VoteMethodName:      DBKayakVoteMethodName,
+		HeartbeatMethodName: DBKayakHeartbeatMethodName,
+		SyncMethodName:      DBKayakSyncMethodName,
+		OnPeersChange:       cfg.OnPeersChange,
+		SnapshotInterval:    SnapshotInterval,
+		SnapshotDir:         filepath.Join(cfg.DataDir, KayakSnapshotDirName),
+		PrivateKey:          db.privateKey,
+		NodeKey:             getNodeKey,
 	}
 
 	// create kayak runtime
@@ -207,6 +259,26 @@ func NewDatabase(cfg *DBConfig, peers *proto.Peers,
 		return
 	}
 
+	// kayak re-applies the membership change committed before the node stopped
+	if current := db.kayakRuntime.Peers(); current != peers {
+		if err = db.chain.UpdatePeers(current); err != nil {
+			return
+		}
+	}
+
+	// leader election raises the commit quorum to a majority of peers, log the effective quorum
+	// along with the configured thresholds
+	minPreparedFollowers, minCommitFollowers := db.kayakRuntime.Quorum()
+	log.WithFields(log.Fields{
+		"db":                     cfg.DatabaseID,
+		"consistency_level":      cfg.ConsistencyLevel,
+		"prepare_threshold":      prepareThreshold,
+		"commit_threshold":       commitThreshold,
+		"min_prepared_followers": minPreparedFollowers,
+		"min_commit_followers":   minCommitFollowers,
+		"election_majority":      ElectionTimeout > 0,
+	}).Info("init kayak quorum config")
+
 	// register kayak runtime rpc
 	db.mux.register(db.dbID, db.kayakRuntime)
 
@@ -219,8 +291,47 @@ func NewDatabase(cfg *DBConfig, peers *proto.Peers,
 	return
 }
 
+// quorumThresholds returns the kayak prepare/commit thresholds for the consistency level.
+//
+// A zero consistency level keeps the default thresholds: all peers must prepare and commit
+// is fired asynchronously. Otherwise the level defines the minimum fraction of peers
+// (including the leader) to succeed in both the prepare and commit phases.
+//
+// As leader election is enabled for every database, kayak never commits to less than a majority
+// of peers, so that any elected leader has all the commits returned to clients. A commit
+// threshold below the majority, including the default asynchronous commit, only takes effect
+// in the prepare phase. The effective quorum is logged when the database starts.
+func quorumThresholds(level float64) (prepare, commit float64) {
+	if level <= 0.0 || level > 1.0 || math.IsNaN(level) {
+		return PrepareThreshold, CommitThreshold
+	}
+
+	return level, level
+}
+
 // UpdatePeers defines peers update query interface.
+//
+// Server list changes are replicated through kayak config logs by the leader, one server at a time
+// in background. Followers learn server list changes from the committed config logs.
 func (db *Database) UpdatePeers(peers *proto.Peers) (err error) {
+	if peers == nil {
+		return ErrInvalidDBConfig
+	}
+
+	current := db.kayakRuntime.Peers()
+
+	if !sameServers(current, peers) {
+		if current.Leader.IsEqual(&db.nodeID) {
+			go db.changeMembership(peers)
+		} else {
+			log.WithFields(log.Fields{
+				"db":      db.dbID,
+				"servers": peers.Servers,
+			}).Debug("wait for membership change from kayak leader")
+		}
+		return
+	}
+
 	if err = db.kayakRuntime.UpdatePeers(peers); err != nil {
 		return
 	}
@@ -228,6 +339,72 @@ func (db *Database) UpdatePeers(peers *proto.Peers) (err error) {
 	return db.chain.UpdatePeers(peers)
 }
 
+// changeMembership changes the kayak servers to the target peers in single-server steps.
+func (db *Database) changeMembership(target *proto.Peers) {
+	db.membershipLock.Lock()
+	defer db.membershipLock.Unlock()
+
+	for {
+		next, ok := nextMembershipStep(db.kayakRuntime.Peers(), target)
+		if !ok {
+			return
+		}
+
+		if err := next.Sign(db.privateKey); err != nil {
+			log.WithField("db", db.dbID).WithError(err).Warning("sign peers for membership change failed")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), CommitTimeout)
+		_, err := db.kayakRuntime.ChangePeers(ctx, next)
+		cancel()
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"db":      db.dbID,
+				"servers": next.Servers,
+			}).WithError(err).Warning("kayak membership change failed")
+			return
+		}
+	}
+}
+
+// nextMembershipStep returns the peers with a single server added or removed towards the target servers.
+func nextMembershipStep(current *proto.Peers, target *proto.Peers) (next *proto.Peers, ok bool) {
+	n := current.Clone()
+	n.Version++
+
+	for _, s := range target.Servers {
+		if _, found := current.Find(s); !found {
+			n.Servers = append(n.Servers, s)
+			return &n, true
+		}
+	}
+
+	for i, s := range current.Servers {
+		if _, found := target.Find(s); !found && !s.IsEqual(&current.Leader) {
+			n.Servers = append(n.Servers[:i:i], n.Servers[i+1:]...)
+			return &n, true
+		}
+	}
+
+	return
+}
+
+func sameServers(a *proto.Peers, b *proto.Peers) bool {
+	if len(a.Servers) != len(b.Servers) {
+		return false
+	}
+
+	for _, s := range a.Servers {
+		if _, found := b.Find(s); !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Query defines database query interface.
 func (db *Database) Query(request *types.Request) (response *types.Response, err error) {
 	// Just need to verify signature in db.saveAck
@@ -255,6 +432,10 @@ func (db *Database) Query(request *types.Request) (response *types.Response, err
 		}
 	}()
 
+	if request.Header.QueryType != types.ReadQuery && request.Header.AsOfHeight != 0 {
+		return nil, errors.Wrap(ErrInvalidRequest, "only read query can be executed as of height")
+	}
+
 	switch request.Header.QueryType {
 	case types.ReadQuery:
 		if tracker, response, err = db.chain.Query(request, false); err != nil {
@@ -274,17 +455,114 @@ func (db *Database) Query(request *types.Request) (response *types.Response, err
 				err = errors.Wrap(err, "failed to execute")
 				return
 			}
+			if tracker == nil {
+				// replayed response of a duplicate request, which is signed already
+				return
+			}
 		}
 	default:
 		// TODO(xq262144): verbose errors with custom error structure
 		return nil, errors.Wrap(ErrInvalidRequest, "invalid query type")
 	}
 
-	response.Header.ResponseAccount = db.accountAddr
+	err = db.signResponse(tracker, response)
+	return
+}
 
-	// build hash
-	if err = response.BuildHash(); err != nil {
-		err = errors.Wrap(err, "failed to build response hash")
+// OpenCursor runs the single read query of request in a server-side cursor owned by the request
+// connection. The first batch of rows is returned in response, and the following rows could be
+// fetched with cursor id, which is 0 if all the rows are returned.
+func (db *Database) OpenCursor(
+	request *types.Request, batch int) (response *types.Response, cursorID uint64, err error,
+) {
+	var (
+		owner   = cursorOwner{nodeID: request.Header.NodeID, connID: request.Header.ConnectionID}
+		tracker *x.QueryTracker
+		cur     *x.Cursor
+	)
+	if err = db.cursors.reserve(owner); err != nil {
+		return
+	}
+	defer func() {
+		if cursorID == 0 {
+			if cur != nil {
+				cur.Close()
+			}
+			db.cursors.release(owner)
+		}
+	}()
+	if tracker, response, cur, err = db.chain.OpenCursor(request, batch); err != nil {
+		err = errors.Wrap(err, "failed to open cursor")
+		return
+	}
+	if cur == nil {
+		err = db.signResponse(tracker, response)
+		return
+	}
+	// acks are keyed by request, so the response of the first batch is not indexed, the whole
+	// cursor is acknowledged once it's closed, see settleCursor
+	if err = db.sign(response); err != nil {
+		return
+	}
+	cursorID = db.cursors.add(owner, cur)
+	return
+}
+
+// FetchCursor returns at most batch following rows of the cursor opened by node, done is set if
+// there are no more rows and the cursor is closed, along with the response of the whole cursor to
+// acknowledge.
+func (db *Database) FetchCursor(node proto.NodeID, cursorID uint64, batch int) (
+	rows []types.ResponseRow, done bool, header *types.SignedResponseHeader, err error,
+) {
+	var cur *x.Cursor
+	if cur, err = db.cursors.get(cursorID, node); err != nil {
+		return
+	}
+	if rows, done, err = cur.Fetch(batch); err != nil || done {
+		if db.cursors.remove(cursorID) {
+			header, _ = db.settleCursor(cur)
+		}
+	}
+	return
+}
+
+// CloseCursor closes the cursor opened by node and returns the response of the whole cursor to
+// acknowledge.
+func (db *Database) CloseCursor(
+	node proto.NodeID, cursorID uint64) (header *types.SignedResponseHeader, err error,
+) {
+	var cur *x.Cursor
+	if cur, err = db.cursors.get(cursorID, node); err != nil {
+		return
+	}
+	if !db.cursors.remove(cursorID) {
+		err = ErrCursorNotFound
+		return
+	}
+	return db.settleCursor(cur)
+}
+
+// settleCursor signs the response header of the closed cursor and adds it to the response index of
+// the chain, so that the rows and cost of all the fetched batches are acknowledged and billed.
+func (db *Database) settleCursor(cur *x.Cursor) (header *types.SignedResponseHeader, err error) {
+	header = &types.SignedResponseHeader{ResponseHeader: cur.Header()}
+	header.ResponseAccount = db.accountAddr
+	header.Timestamp = getLocalTime()
+	if err = header.Sign(db.privateKey); err != nil {
+		err = errors.Wrap(err, "failed to sign cursor response")
+		header = nil
+		return
+	}
+	if err = db.chain.AddResponse(header); err != nil {
+		log.WithError(err).Debug("failed to add cursor response to index")
+		header = nil
+	}
+	return
+}
+
+// signResponse signs the response and adds it to the response index of the chain.
+func (db *Database) signResponse(tracker *x.QueryTracker, response *types.Response) (err error) {
+	if err = db.sign(response); err != nil {
 		return
 	}
 
@@ -297,6 +575,15 @@ func (db *Database) Query(request *types.Request) (response *types.Response, err
 	return
 }
 
+// sign signs the response, so that clients could verify the response against the node key.
+func (db *Database) sign(response *types.Response) (err error) {
+	response.Header.ResponseAccount = db.accountAddr
+	if err = response.Sign(db.privateKey); err != nil {
+		err = errors.Wrap(err, "failed to sign response")
+	}
+	return
+}
+
 func (db *Database) logSlow(request *types.Request, isFinished bool, tmStart time.Time) {
 	if request == nil {
 		return
@@ -344,6 +631,11 @@ func (db *Database) Ack(ack *types.Ack) (err error) {
 
 // Shutdown stop database handles and stop service the database.
 func (db *Database) Shutdown() (err error) {
+	if db.cursors != nil {
+		// release the read transactions of cursors
+		db.cursors.closeAll()
+	}
+
 	if db.kayakRuntime != nil {
 		// shutdown, stop kayak
 		if err = db.kayakRuntime.Shutdown(); err != nil {
@@ -394,26 +686,27 @@ func (db *Database) Destroy() (err error) {
 }
 
 func (db *Database) writeQuery(request *types.Request) (tracker *x.QueryTracker, response *types.Response, err error) {
-	// check database size first, wal/kayak/chain database size is not included
-	if db.cfg.SpaceLimit > 0 {
-		path := filepath.Join(db.cfg.DataDir, StorageFileName)
-		var statInfo os.FileInfo
-		if statInfo, err = os.Stat(path); err != nil {
-			if !os.IsNotExist(err) {
-				return
-			}
-		} else {
-			if uint64(statInfo.Size()) > db.cfg.SpaceLimit {
-				// rejected
-				err = ErrSpaceLimitExceeded
-				return
-			}
+	// check database size first on leader, kayak/chain database size is not included
+	if db.leader() == db.nodeID {
+		if err = db.checkSpaceLimit(); err != nil {
+			return
 		}
 	}
 
 	// call kayak runtime Process
 	var result interface{}
 	if result, _, err = db.kayakRuntime.Apply(request.GetContext(), request); err != nil {
+		switch errors.Cause(err) {
+		case kt.ErrNotLeader:
+			// give the client a hint of the current leader to retry with
+			err = &types.NotLeaderError{Leader: db.leader()}
+		case ErrInvalidRequestSeq:
+			// the request may be a retry of an applied write, reply with the original response
+			if response = db.replayResponse(request); response != nil {
+				err = nil
+				return
+			}
+		}
 		err = errors.Wrap(err, "apply failed")
 		return
 	}
@@ -431,10 +724,64 @@ func (db *Database) writeQuery(request *types.Request) (tracker *x.QueryTracker,
 	return
 }
 
+// replayResponse returns the signed response of the applied request, or nil if the request is not
+// found applied or signing fails. The original response is replayed if it's served by this node,
+// otherwise the response is rebuilt from the applied write recorded on commit, e.g. the request is
+// retried against the new leader after leader changes.
+func (db *Database) replayResponse(request *types.Request) (response *types.Response) {
+	var (
+		hdr *types.ResponseHeader
+		err error
+	)
+	if hdr, err = db.chain.GetResponse(request); err != nil || hdr.NodeID != db.nodeID {
+		if hdr = db.appliedResponse(request); hdr == nil {
+			return
+		}
+	}
+	// write responses carry no payload, re-signing the header reproduces the original response
+	response = &types.Response{Header: types.SignedResponseHeader{ResponseHeader: *hdr}}
+	if err = response.Sign(db.privateKey); err != nil {
+		log.WithError(err).Warning("failed to sign replayed response")
+		response = nil
+		return
+	}
+	log.WithFields(log.Fields{
+		"db":  db.dbID,
+		"key": request.Header.GetQueryKey(),
+	}).Debug("replay response of duplicate request")
+	return
+}
+
+func (db *Database) leader() (leader proto.NodeID) {
+	if peers := db.kayakRuntime.Peers(); peers != nil {
+		leader = peers.Leader
+	}
+	return
+}
+
+// replicas returns the count of miners serving the database.
+func (db *Database) replicas() (n int) {
+	if peers := db.kayakRuntime.Peers(); peers != nil {
+		n = len(peers.Servers)
+	}
+	return
+}
+
 func (db *Database) saveAck(ackHeader *types.SignedAckHeader) (err error) {
 	return db.chain.VerifyAndPushAckedQuery(ackHeader)
 }
 
+// getNodeKey returns the registered public key of node, the key is resolved from block producers
+// if it's not cached locally.
+func getNodeKey(node proto.NodeID) (key *asymmetric.PublicKey, err error) {
+	var nodeInfo *proto.Node
+	if nodeInfo, err = rpc.GetNodeInfo(node.ToRawNodeID()); err != nil {
+		return
+	}
+	key = nodeInfo.PublicKey
+	return
+}
+
 func getLocalTime() time.Time {
 	return time.Now().UTC()
 }
@@ -0,0 +1,295 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	kt "github.com/CovenantSQL/CovenantSQL/kayak/types"
+	"github.com/CovenantSQL/CovenantSQL/sqlchain"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	"github.com/pkg/errors"
+)
+
+// Backup takes a consistent backup archive of the database signed by the local miner. The archive
+// data is kept as a kayak attachment and fetched by FetchBackup in chunks, only the latest backup of
+// the database is kept.
+func (db *Database) Backup() (header *types.SignedBackupHeader, size uint64, err error) {
+	var (
+		s    *kt.Snapshot
+		sm   *snapshotMeta
+		m    *sqlchain.SnapshotMeta
+		file string
+	)
+	if file, err = db.tempSnapshotFile(); err != nil {
+		return
+	}
+	defer func() { _ = os.Remove(file) }()
+	// the commit index, state and chain head are pinned together under the kayak commit lock and
+	// the state lock
+	if s, err = db.kayakRuntime.CurrentSnapshot(file); err != nil {
+		return
+	}
+	if sm, err = decodeSnapshotMeta(s.Meta); err != nil {
+		return
+	}
+	if m, err = sqlchain.DecodeSnapshotMeta(sm.Chain); err != nil {
+		return
+	}
+
+	header = &types.SignedBackupHeader{
+		BackupHeader: types.BackupHeader{
+			DatabaseID:  db.dbID,
+			NodeID:      db.nodeID,
+			Height:      m.Height,
+			BlockHash:   m.Head,
+			CommitIndex: s.Index,
+			Timestamp:   time.Now().UTC(),
+			StateMeta:   sm.Chain,
+		},
+	}
+	if header.PayloadHash, err = hashFile(file); err != nil {
+		header = nil
+		return
+	}
+	if err = header.Sign(db.privateKey); err != nil {
+		header = nil
+		return
+	}
+
+	name := backupAttachment(header.Hash())
+	if err = os.Rename(file, db.kayakRuntime.AttachmentFile(name)); err != nil {
+		header = nil
+		return
+	}
+	size = s.Size
+
+	db.backupLock.Lock()
+	prev := db.backupName
+	db.backupName = name
+	db.backupLock.Unlock()
+	if prev != "" {
+		_ = os.Remove(db.kayakRuntime.AttachmentFile(prev))
+	}
+
+	log.WithFields(log.Fields{
+		"db":     db.dbID,
+		"height": m.Height,
+		"commit": s.Index,
+		"size":   size,
+	}).Info("database backup taken")
+
+	return
+}
+
+// FetchBackup returns the data chunk at offset of the latest backup archive.
+func (db *Database) FetchBackup(archiveHash hash.Hash, offset uint64) (chunk []byte, err error) {
+	name := backupAttachment(archiveHash)
+
+	db.backupLock.Lock()
+	current := db.backupName
+	db.backupLock.Unlock()
+
+	if name != current {
+		err = errors.Wrapf(ErrInvalidRequest, "backup archive %s is replaced or not found", archiveHash)
+		return
+	}
+
+	return db.kayakRuntime.FetchAttachment(context.Background(), name, offset)
+}
+
+// RestoreBackup uploads the archive data chunk of the restore request, and seeds the database with
+// the archive once the last chunk is uploaded. Only the archive header is replicated through kayak,
+// followers fetch the archive data from the leader in chunks, so that every miner seeds the state
+// at the same log. The database must not have executed any write query, new miners of the
+// database are seeded by kayak snapshot.
+func (db *Database) RestoreBackup(req *types.RestoreReq) (err error) {
+	var uploaded bool
+	if uploaded, err = db.uploadArchive(req); err != nil || !uploaded {
+		return
+	}
+
+	return db.applyAdmin(adminCmdRestore, &types.RestoreReq{
+		Header:        req.Header,
+		ArchiveHeader: req.ArchiveHeader,
+		Size:          req.Size,
+	})
+}
+
+// uploadArchive appends the archive data chunk of the restore request to the upload file, the
+// chunks must be uploaded in order. It reports whether the whole archive is uploaded and verified.
+func (db *Database) uploadArchive(req *types.RestoreReq) (uploaded bool, err error) {
+	db.archiveLock.Lock()
+	defer db.archiveLock.Unlock()
+
+	var (
+		file = db.kayakRuntime.AttachmentFile(restoreAttachment(req.ArchiveHeader.PayloadHash))
+		temp = file + ".tmp"
+		flag = os.O_WRONLY | os.O_APPEND
+		f    *os.File
+		info os.FileInfo
+	)
+	if _, err = os.Stat(file); err == nil {
+		// already uploaded, e.g. the restore is retried
+		uploaded = true
+		return
+	}
+
+	if req.Offset == 0 {
+		flag |= os.O_CREATE | os.O_TRUNC
+	}
+	if f, err = os.OpenFile(temp, flag, 0600); err != nil {
+		err = errors.Wrap(err, "open archive upload file failed")
+		return
+	}
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+		if err != nil {
+			_ = os.Remove(temp)
+		}
+	}()
+
+	if info, err = f.Stat(); err != nil {
+		return
+	}
+	if uint64(info.Size()) != req.Offset {
+		err = errors.Wrapf(ErrInvalidRequest, "unexpected archive chunk at %d, uploaded: %d",
+			req.Offset, info.Size())
+		return
+	}
+	if _, err = f.Write(req.Chunk); err != nil {
+		return
+	}
+	if req.Offset+uint64(len(req.Chunk)) < req.Size {
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		return
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return
+	}
+	if err = verifyArchiveFile(temp, req.ArchiveHeader); err != nil {
+		return
+	}
+	if err = os.Rename(temp, file); err != nil {
+		return
+	}
+	uploaded = true
+
+	return
+}
+
+// seedBackup seeds the state with the archive of the restore request on commit, the archive is
+// fetched from the leader if it's not uploaded to the local miner.
+func (db *Database) seedBackup(req *types.RestoreReq) (err error) {
+	var (
+		header = req.ArchiveHeader
+		name   = restoreAttachment(header.PayloadHash)
+		file   string
+	)
+	if file, err = db.kayakRuntime.DownloadAttachment(context.Background(), name, req.Size); err != nil {
+		return
+	}
+	if err = verifyArchiveFile(file, header); err != nil {
+		_ = os.Remove(file)
+		return
+	}
+
+	err = db.chain.Seed(header.StateMeta, file)
+
+	log.WithFields(log.Fields{
+		"db":     db.dbID,
+		"source": header.DatabaseID,
+		"height": header.Height,
+		"commit": header.CommitIndex,
+	}).WithError(err).Info("database backup restored")
+
+	return
+}
+
+// verifyRestoreReq checks the signatures and the archive header of the restore request, and the
+// archive data chunk if it's uploaded.
+func verifyRestoreReq(req *types.RestoreReq) (err error) {
+	if req == nil || req.ArchiveHeader == nil {
+		return errors.Wrap(ErrInvalidRequest, "nil backup archive")
+	}
+	if err = req.Header.Verify(); err != nil {
+		return
+	}
+	if h := req.ArchiveHeader.Hash(); !h.IsEqual(&req.Header.ArchiveHash) {
+		return errors.Wrap(ErrInvalidRequest, "backup archive hash mismatched")
+	}
+	if req.Size == 0 || len(req.Chunk) > types.BackupChunkSize ||
+		req.Offset+uint64(len(req.Chunk)) > req.Size {
+		return errors.Wrapf(ErrInvalidRequest, "invalid archive chunk at %d of size %d", req.Offset, req.Size)
+	}
+	return req.ArchiveHeader.Verify()
+}
+
+// verifyArchiveFile checks the archive data file against the payload hash of the archive header.
+func verifyArchiveFile(file string, header *types.SignedBackupHeader) (err error) {
+	var h hash.Hash
+	if h, err = hashFile(file); err != nil {
+		return
+	}
+	if !h.IsEqual(&header.PayloadHash) {
+		err = errors.Wrap(types.ErrInvalidBackupArchive, "archive data hash mismatched")
+	}
+	return
+}
+
+func hashFile(file string) (h hash.Hash, err error) {
+	var f *os.File
+	if f, err = os.Open(file); err != nil {
+		return
+	}
+	defer func() { _ = f.Close() }()
+	return hash.THashReader(f)
+}
+
+// backupAttachment returns the kayak attachment name of the backup archive.
+func backupAttachment(archiveHash hash.Hash) string {
+	return "backup-" + archiveHash.String()
+}
+
+// restoreAttachment returns the kayak attachment name of the restore archive data.
+func restoreAttachment(payloadHash hash.Hash) string {
+	return "restore-" + payloadHash.String()
+}
+
+// tempSnapshotFile creates a temporary file in the kayak snapshot directory, so that it could be
+// moved into the snapshots.
+func (db *Database) tempSnapshotFile() (file string, err error) {
+	var f *os.File
+	if f, err = ioutil.TempFile(db.kayakConfig.SnapshotDir, "backup-*.tmp"); err != nil {
+		return
+	}
+	file = f.Name()
+	err = f.Close()
+	return
+}
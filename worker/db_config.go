@@ -32,9 +32,28 @@ type DBConfig struct {
 	MaxWriteTimeGap        time.Duration
 	EncryptionKey          string
 	SpaceLimit             uint64
+	MemoryLimit            uint64
 	UpdateBlockCount       uint64
 	UseEventualConsistency bool
 	ConsistencyLevel       float64
 	IsolationLevel         int
 	SlowQueryTime          time.Duration
+	ChangeRetention        int
+	HistoryPeriod          int32
+	HistoryRetention       int32
+	CursorTTL              time.Duration
+	MaxCursorsPerConn      int
+	MaxCursorsPerNode      int
+	MaxCursorsPerDB        int
+	Limits                 AdminLimits
+	OnPeersChange          func(peers *proto.Peers) error
+	OnLimitsChange         func(limits AdminLimits) error
+}
+
+func (cfg *DBConfig) cursorLimits() cursorLimits {
+	return cursorLimits{
+		perConn: cfg.MaxCursorsPerConn,
+		perNode: cfg.MaxCursorsPerNode,
+		total:   cfg.MaxCursorsPerDB,
+	}
 }
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/pkg/errors"
+)
+
+// AdminLimits defines the limits of database set by the database admin, the limits are replicated
+// through kayak and carried by kayak snapshots, so that every miner of the database applies the
+// same limits.
+type AdminLimits struct {
+	RateLimit  *types.RateLimitConfig
+	QueryLimit *types.QueryLimitConfig
+}
+
+// SetRateLimit replicates the per-user query rate limits of the request to all miners of the
+// database.
+func (db *Database) SetRateLimit(req *types.SetRateLimitReq) (err error) {
+	return db.applyAdmin(adminCmdRateLimit, req)
+}
+
+// SetQueryLimit replicates the per-user read query limits of the request to all miners of the
+// database.
+func (db *Database) SetQueryLimit(req *types.SetQueryLimitReq) (err error) {
+	return db.applyAdmin(adminCmdQueryLimit, req)
+}
+
+// applyAdmin encodes the admin request and replicates it through kayak.
+func (db *Database) applyAdmin(command string, req interface{}) (err error) {
+	var buf *bytes.Buffer
+	if buf, err = utils.EncodeMsgPack(req); err != nil {
+		return
+	}
+	_, _, err = db.kayakRuntime.Apply(context.Background(), &adminPayload{
+		Command: command,
+		Data:    buf.Bytes(),
+	})
+	return
+}
+
+// compileRateLimit decodes and verifies the rate limit request of the admin command.
+func (db *Database) compileRateLimit(data []byte) (req *types.SetRateLimitReq, err error) {
+	if err = utils.DecodeMsgPack(data, &req); err != nil {
+		err = errors.Wrap(err, "decode rate limit request failed")
+		return
+	}
+	if req == nil {
+		err = errors.Wrap(ErrInvalidRequest, "nil rate limit request")
+		return
+	}
+	if err = req.Header.Verify(); err != nil {
+		return
+	}
+	if req.Header.DatabaseID != db.dbID {
+		err = errors.Wrap(ErrInvalidRequest, "rate limit request of another database")
+	}
+	return
+}
+
+// compileQueryLimit decodes and verifies the query limit request of the admin command.
+func (db *Database) compileQueryLimit(data []byte) (req *types.SetQueryLimitReq, err error) {
+	if err = utils.DecodeMsgPack(data, &req); err != nil {
+		err = errors.Wrap(err, "decode query limit request failed")
+		return
+	}
+	if req == nil {
+		err = errors.Wrap(ErrInvalidRequest, "nil query limit request")
+		return
+	}
+	if err = req.Header.Verify(); err != nil {
+		return
+	}
+	if req.Header.DatabaseID != db.dbID {
+		err = errors.Wrap(ErrInvalidRequest, "query limit request of another database")
+	}
+	return
+}
+
+// Limits returns the current limits set by the database admin.
+func (db *Database) Limits() AdminLimits {
+	db.limitsLock.Lock()
+	defer db.limitsLock.Unlock()
+	return db.limits
+}
+
+// updateLimits updates the limits set by the database admin and notifies the change.
+func (db *Database) updateLimits(update func(limits *AdminLimits)) (err error) {
+	db.limitsLock.Lock()
+	update(&db.limits)
+	limits := db.limits
+	db.limitsLock.Unlock()
+
+	if db.cfg.OnLimitsChange != nil {
+		err = db.cfg.OnLimitsChange(limits)
+	}
+	return
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"github.com/CovenantSQL/CovenantSQL/types"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
+	"github.com/pkg/errors"
+)
+
+// Usage returns the current resource usage of the database storage.
+func (db *Database) Usage() (usage *types.DatabaseUsage, err error) {
+	var (
+		space uint64
+		conns int
+	)
+	if space, conns, err = db.chain.Usage(); err != nil {
+		return
+	}
+	usage = &types.DatabaseUsage{
+		SpaceUsed:   space,
+		SpaceLimit:  db.cfg.SpaceLimit,
+		MemoryLimit: db.cfg.MemoryLimit,
+	}
+	if db.cfg.MemoryLimit > 0 {
+		usage.MemoryCeiling = uint64(conns) * xs.ConnectionCacheLimit(db.cfg.MemoryLimit)
+	}
+	return
+}
+
+// checkSpaceLimit rejects writes if the storage already reaches the reserved space. It's checked
+// by the leader before the write is proposed only, replicated writes are always applied so that
+// replicas never diverge, thus the last accepted write may exceed the limit slightly.
+func (db *Database) checkSpaceLimit() (err error) {
+	if db.cfg.SpaceLimit == 0 {
+		return
+	}
+	var usage *types.DatabaseUsage
+	if usage, err = db.Usage(); err != nil {
+		return
+	}
+	if usage.SpaceUsed >= usage.SpaceLimit {
+		err = errors.Wrapf(ErrSpaceLimitExceeded,
+			"used %d of %d bytes", usage.SpaceUsed, usage.SpaceLimit)
+	}
+	return
+}
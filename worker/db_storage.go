@@ -21,6 +21,7 @@ import (
 	"container/list"
 	"context"
 
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/types"
 	"github.com/CovenantSQL/CovenantSQL/utils"
 	x "github.com/CovenantSQL/CovenantSQL/xenomint"
@@ -29,6 +30,32 @@ import (
 
 // Following contains storage related logic extracted from main database instance definition.
 
+const (
+	// adminPayloadMagic prefixes the encoded admin payload, it never starts a msgpack value so
+	// that the admin payload is distinguished from the query request.
+	adminPayloadMagic byte = 0xc1
+
+	// adminCmdRestore is the admin command to seed the database with a backup archive.
+	adminCmdRestore = "restore"
+	// adminCmdRateLimit is the admin command to update the per-user query rate limits.
+	adminCmdRateLimit = "rate_limit"
+	// adminCmdQueryLimit is the admin command to update the per-user read query limits.
+	adminCmdQueryLimit = "query_limit"
+)
+
+// adminPayload defines a database admin command replicated through kayak.
+type adminPayload struct {
+	Command string
+	Data    []byte
+}
+
+// snapshotMeta defines the kayak snapshot meta of database, which carries the admin limits along
+// with the state meta of chain.
+type snapshotMeta struct {
+	Chain  []byte
+	Limits AdminLimits
+}
+
 // EncodePayload implements kayak.types.Handler.EncodePayload.
 func (db *Database) EncodePayload(request interface{}) (data []byte, err error) {
 	if req, ok := request.(*types.Request); ok {
@@ -46,11 +73,26 @@ func (db *Database) EncodePayload(request interface{}) (data []byte, err error)
 	}
 
 	data = buf.Bytes()
+
+	if _, ok := request.(*adminPayload); ok {
+		data = append([]byte{adminPayloadMagic}, data...)
+	}
+
 	return
 }
 
 // DecodePayload implements kayak.types.Handler.DecodePayload.
 func (db *Database) DecodePayload(data []byte) (request interface{}, err error) {
+	if len(data) > 0 && data[0] == adminPayloadMagic {
+		var ap *adminPayload
+		if err = utils.DecodeMsgPack(data[1:], &ap); err != nil {
+			err = errors.Wrap(err, "decode admin payload failed")
+			return
+		}
+		request = ap
+		return
+	}
+
 	var req *types.Request
 
 	if err = utils.DecodeMsgPack(data, &req); err != nil {
@@ -66,6 +108,11 @@ func (db *Database) DecodePayload(data []byte) (request interface{}, err error)
 
 // Check implements kayak.types.Handler.Check.
 func (db *Database) Check(rawReq interface{}) (err error) {
+	if ap, ok := rawReq.(*adminPayload); ok && ap != nil {
+		_, err = db.compileAdmin(ap)
+		return
+	}
+
 	var req *types.Request
 	var ok bool
 	if req, ok = rawReq.(*types.Request); !ok || req == nil {
@@ -114,6 +161,10 @@ func (db *Database) Commit(rawReq interface{}, isLeader bool) (result interface{
 		tracker  *x.QueryTracker
 		ok       bool
 	)
+	if ap, ok := rawReq.(*adminPayload); ok && ap != nil {
+		err = db.commitAdmin(ap)
+		return
+	}
 	if req, ok = rawReq.(*types.Request); !ok || req == nil {
 		err = errors.Wrap(ErrInvalidRequest, "invalid request payload")
 		return
@@ -122,10 +173,17 @@ func (db *Database) Commit(rawReq interface{}, isLeader bool) (result interface{
 	// reset context, commit should never be canceled
 	req.SetContext(context.Background())
 
+	// record sequence on followers as well, so that a retried write is still rejected as
+	// duplicate after leader changes
+	if !isLeader {
+		db.recordSequence(req.Header.ConnectionID, req.Header.SeqNo)
+	}
+
 	// execute
 	if tracker, response, err = db.chain.Query(req, isLeader); err != nil {
 		return
 	}
+	db.recordApplied(req, response)
 	result = &TrackerAndResponse{
 		Tracker:  tracker,
 		Response: response,
@@ -133,6 +191,142 @@ func (db *Database) Commit(rawReq interface{}, isLeader bool) (result interface{
 	return
 }
 
+// Snapshot implements kayak.types.Snapshotter.Snapshot.
+func (db *Database) Snapshot() (meta []byte, write func(path string) error, err error) {
+	// the snapshot is taken under the kayak commit lock, so the limits could not be changed by
+	// admin commands concurrently
+	m := &snapshotMeta{Limits: db.Limits()}
+	if m.Chain, write, err = db.chain.Snapshot(); err != nil {
+		return
+	}
+	var buf *bytes.Buffer
+	if buf, err = utils.EncodeMsgPack(m); err != nil {
+		return
+	}
+	meta = buf.Bytes()
+	return
+}
+
+// Restore implements kayak.types.Snapshotter.Restore.
+func (db *Database) Restore(meta []byte, path string) (err error) {
+	var m *snapshotMeta
+	if m, err = decodeSnapshotMeta(meta); err != nil {
+		return
+	}
+	if err = db.chain.Restore(m.Chain, path); err != nil {
+		return
+	}
+	return db.updateLimits(func(limits *AdminLimits) { *limits = m.Limits })
+}
+
+func decodeSnapshotMeta(meta []byte) (m *snapshotMeta, err error) {
+	if err = utils.DecodeMsgPack(meta, &m); err != nil {
+		err = errors.Wrap(err, "decode snapshot meta failed")
+		return
+	}
+	if m == nil {
+		err = errors.Wrap(ErrInvalidRequest, "nil snapshot meta")
+	}
+	return
+}
+
+// compileAdmin decodes and verifies the admin command, the verification must be deterministic as
+// it's done by every replica.
+func (db *Database) compileAdmin(ap *adminPayload) (cmd interface{}, err error) {
+	switch ap.Command {
+	case adminCmdRestore:
+		var req *types.RestoreReq
+		if err = utils.DecodeMsgPack(ap.Data, &req); err != nil {
+			err = errors.Wrap(err, "decode restore request failed")
+			return
+		}
+		if err = verifyRestoreReq(req); err != nil {
+			return
+		}
+		if req.Header.DatabaseID != db.dbID {
+			err = errors.Wrap(ErrInvalidRequest, "restore request of another database")
+			return
+		}
+		if len(req.Chunk) != 0 {
+			// archive data is fetched from the leader instead
+			err = errors.Wrap(ErrInvalidRequest, "archive data in replicated restore request")
+			return
+		}
+		cmd = req
+	case adminCmdRateLimit:
+		cmd, err = db.compileRateLimit(ap.Data)
+	case adminCmdQueryLimit:
+		cmd, err = db.compileQueryLimit(ap.Data)
+	default:
+		err = errors.Wrapf(ErrInvalidRequest, "unknown admin command: %s", ap.Command)
+	}
+	return
+}
+
+// commitAdmin executes the admin command on commit.
+func (db *Database) commitAdmin(ap *adminPayload) (err error) {
+	var cmd interface{}
+	if cmd, err = db.compileAdmin(ap); err != nil {
+		return
+	}
+
+	switch c := cmd.(type) {
+	case *types.RestoreReq:
+		err = db.seedBackup(c)
+	case *types.SetRateLimitReq:
+		cfg := c.Header.Config
+		err = db.updateLimits(func(limits *AdminLimits) { limits.RateLimit = &cfg })
+	case *types.SetQueryLimitReq:
+		cfg := c.Header.Config
+		err = db.updateLimits(func(limits *AdminLimits) { limits.QueryLimit = &cfg })
+	}
+
+	return
+}
+
+// appliedWrite defines the result of the latest write applied on a connection, it's recorded by
+// every replica on commit so that a retried write could be answered after leader changes.
+type appliedWrite struct {
+	requestHash  hash.Hash
+	logOffset    uint64
+	affectedRows int64
+	lastInsertID int64
+}
+
+func (db *Database) recordApplied(req *types.Request, resp *types.Response) {
+	db.connApplied.Store(req.Header.ConnectionID, &appliedWrite{
+		requestHash:  req.Header.Hash(),
+		logOffset:    resp.Header.LogOffset,
+		affectedRows: resp.Header.AffectedRows,
+		lastInsertID: resp.Header.LastInsertID,
+	})
+}
+
+// appliedResponse rebuilds the response header of request from the applied write of its
+// connection, or returns nil if it's not the latest applied request. The cost is left empty as the
+// write is billed by its original response.
+func (db *Database) appliedResponse(request *types.Request) (hdr *types.ResponseHeader) {
+	var v, ok = db.connApplied.Load(request.Header.ConnectionID)
+	if !ok {
+		return
+	}
+	var applied = v.(*appliedWrite)
+	if applied.requestHash != request.Header.Hash() {
+		return
+	}
+	hdr = &types.ResponseHeader{
+		Request:         request.Header.RequestHeader,
+		RequestHash:     applied.requestHash,
+		NodeID:          db.nodeID,
+		Timestamp:       getLocalTime(),
+		LogOffset:       applied.logOffset,
+		AffectedRows:    applied.affectedRows,
+		LastInsertID:    applied.lastInsertID,
+		ResponseAccount: db.accountAddr,
+	}
+	return
+}
+
 func (db *Database) recordSequence(connID uint64, seqNo uint64) {
 	db.connSeqs.Store(connID, seqNo)
 }
@@ -173,6 +367,7 @@ func (db *Database) evictSequences() {
 				evictSeq := e.Value.(uint64)
 				delete(m, evictSeq)
 				db.connSeqs.Delete(evictSeq)
+				db.connApplied.Delete(evictSeq)
 			}
 		}
 	}
@@ -45,6 +45,7 @@ import (
 	"github.com/CovenantSQL/CovenantSQL/utils"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
 	"github.com/fortytw2/leaktest"
+	"github.com/pkg/errors"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -529,6 +530,102 @@ func TestDatabaseRecycle(t *testing.T) {
 	})
 }
 
+func TestDatabaseQuota(t *testing.T) {
+	Convey("test database resource quota", t, func() {
+		var err error
+		var server *rpc.Server
+		var cleanup func()
+		cleanup, server, err = initNode()
+		So(err, ShouldBeNil)
+
+		defer cleanup()
+
+		var rootDir string
+		rootDir, err = ioutil.TempDir("", "db_test_")
+		So(err, ShouldBeNil)
+
+		// create mux service
+		kayakMuxService, err := NewDBKayakMuxService("DBKayak", server)
+		So(err, ShouldBeNil)
+
+		chainMuxService, err := sqlchain.NewMuxService("sqlchain", server)
+		So(err, ShouldBeNil)
+
+		// create peers
+		var peers *proto.Peers
+		peers, err = getPeers(1)
+		So(err, ShouldBeNil)
+
+		// create file
+		cfg := &DBConfig{
+			DatabaseID:       "TEST",
+			DataDir:          rootDir,
+			KayakMux:         kayakMuxService,
+			ChainMux:         chainMuxService,
+			MaxWriteTimeGap:  time.Duration(5 * time.Second),
+			UpdateBlockCount: 2,
+			SpaceLimit:       64 << 10,
+			MemoryLimit:      12 << 20,
+		}
+
+		// create genesis block
+		var block *types.Block
+		block, err = createRandomBlock(rootHash, true)
+		So(err, ShouldBeNil)
+
+		// create database
+		var db *Database
+		db, err = NewDatabase(cfg, peers, block)
+		So(err, ShouldBeNil)
+		defer db.Destroy()
+
+		var writeQuery *types.Request
+		writeQuery, err = buildQuery(types.WriteQuery, 1, 1, []string{
+			"create table test (k int, v blob)",
+		})
+		So(err, ShouldBeNil)
+		_, err = db.Query(writeQuery)
+		So(err, ShouldBeNil)
+
+		// fill the database until the space limit is exceeded
+		for i := 0; i < 64 && err == nil; i++ {
+			writeQuery, err = buildQuery(types.WriteQuery, 1, uint64(i+2), []string{
+				fmt.Sprintf("insert into test values(%d, zeroblob(4096))", i),
+			})
+			So(err, ShouldBeNil)
+			_, err = db.Query(writeQuery)
+		}
+		So(errors.Cause(err), ShouldEqual, ErrSpaceLimitExceeded)
+
+		var usage *types.DatabaseUsage
+		usage, err = db.Usage()
+		So(err, ShouldBeNil)
+		So(usage.SpaceUsed, ShouldBeGreaterThanOrEqualTo, cfg.SpaceLimit)
+		So(usage.SpaceUsed, ShouldBeLessThan, cfg.SpaceLimit+(16<<10))
+		So(usage.SpaceLimit, ShouldEqual, cfg.SpaceLimit)
+		So(usage.MemoryCeiling, ShouldBeGreaterThan, 0)
+		So(usage.MemoryCeiling, ShouldBeLessThanOrEqualTo, cfg.MemoryLimit)
+		So(usage.MemoryLimit, ShouldEqual, cfg.MemoryLimit)
+
+		// further writes are rejected before execution
+		writeQuery, err = buildQuery(types.WriteQuery, 1, 100, []string{
+			"insert into test values(100, zeroblob(4096))",
+		})
+		So(err, ShouldBeNil)
+		_, err = db.Query(writeQuery)
+		So(errors.Cause(err), ShouldEqual, ErrSpaceLimitExceeded)
+
+		// reads are still served
+		var readQuery *types.Request
+		readQuery, err = buildQuery(types.ReadQuery, 1, 101, []string{
+			"select count(1) from test",
+		})
+		So(err, ShouldBeNil)
+		_, err = db.Query(readQuery)
+		So(err, ShouldBeNil)
+	})
+}
+
 func TestDatabase_EncodePayload(t *testing.T) {
 	Convey("encode payload cache", t, func() {
 		db := &Database{}
@@ -575,6 +672,44 @@ func TestDatabase_EncodePayload(t *testing.T) {
 	})
 }
 
+func TestQuorumThresholds(t *testing.T) {
+	Convey("map consistency level to kayak thresholds", t, func() {
+		prepare, commit := quorumThresholds(0.0)
+		So(prepare, ShouldEqual, PrepareThreshold)
+		So(commit, ShouldEqual, CommitThreshold)
+		prepare, commit = quorumThresholds(0.5)
+		So(prepare, ShouldEqual, 0.5)
+		So(commit, ShouldEqual, 0.5)
+		prepare, commit = quorumThresholds(1.0)
+		So(prepare, ShouldEqual, 1.0)
+		So(commit, ShouldEqual, 1.0)
+		prepare, commit = quorumThresholds(1.5)
+		So(prepare, ShouldEqual, PrepareThreshold)
+		So(commit, ShouldEqual, CommitThreshold)
+	})
+}
+
+func TestNextMembershipStep(t *testing.T) {
+	Convey("change membership one server at a time", t, func() {
+		n1, n2, n3, n4 := proto.NodeID("n1"), proto.NodeID("n2"), proto.NodeID("n3"), proto.NodeID("n4")
+		newPeers := func(servers ...proto.NodeID) *proto.Peers {
+			return &proto.Peers{PeersHeader: proto.PeersHeader{Version: 1, Leader: n1, Servers: servers}}
+		}
+
+		next, ok := nextMembershipStep(newPeers(n1, n2), newPeers(n1, n3, n4))
+		So(ok, ShouldBeTrue)
+		So(next.Version, ShouldEqual, 2)
+		So(next.Servers, ShouldResemble, []proto.NodeID{n1, n2, n3})
+		next, ok = nextMembershipStep(newPeers(n1, n2, n3, n4), newPeers(n1, n3, n4))
+		So(ok, ShouldBeTrue)
+		So(next.Servers, ShouldResemble, []proto.NodeID{n1, n3, n4})
+		_, ok = nextMembershipStep(newPeers(n1, n3, n4), newPeers(n4, n3))
+		So(ok, ShouldBeFalse)
+		So(sameServers(newPeers(n1, n3, n4), newPeers(n4, n3, n1)), ShouldBeTrue)
+		So(sameServers(newPeers(n1, n3), newPeers(n1, n4)), ShouldBeFalse)
+	})
+}
+
 func buildAck(res *types.Response) (ack *types.Ack, err error) {
 	// get node id
 	var nodeID proto.NodeID
@@ -29,6 +29,7 @@ import (
 	"github.com/CovenantSQL/CovenantSQL/conf"
 	"github.com/CovenantSQL/CovenantSQL/crypto"
 	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/crypto/kms"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/route"
@@ -36,6 +37,8 @@ import (
 	"github.com/CovenantSQL/CovenantSQL/types"
 	"github.com/CovenantSQL/CovenantSQL/utils"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	x "github.com/CovenantSQL/CovenantSQL/xenomint"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
 	"github.com/pkg/errors"
 )
 
@@ -48,6 +51,30 @@ const (
 
 	// DefaultSlowQueryTime defines the default slow query log time
 	DefaultSlowQueryTime = time.Second * 5
+
+	// MaxFetchChanges defines the max count of row changes returned by a single fetch.
+	MaxFetchChanges = 1000
+
+	// DefaultCursorTTL defines the default idle time before a cursor of streaming read expires.
+	DefaultCursorTTL = time.Minute
+
+	// DefaultMaxCursorsPerConn defines the default max open cursors of a client connection.
+	DefaultMaxCursorsPerConn = 4
+
+	// DefaultMaxCursorsPerNode defines the default max open cursors of a client node.
+	DefaultMaxCursorsPerNode = 16
+
+	// DefaultMaxCursorsPerDB defines the default max open cursors of a database.
+	DefaultMaxCursorsPerDB = 256
+
+	// DefaultCursorBatch defines the default count of rows returned by a cursor fetch.
+	DefaultCursorBatch = 100
+
+	// MaxCursorBatch defines the max count of rows returned by a cursor fetch.
+	MaxCursorBatch = 10000
+
+	// AdminRequestTTL defines the max allowed time skew of signed backup/restore requests.
+	AdminRequestTTL = 5 * time.Minute
 )
 
 // DBMS defines a database management instance.
@@ -60,12 +87,16 @@ type DBMS struct {
 	busService *BusService
 	address    proto.AccountAddress
 	privKey    *asymmetric.PrivateKey
+	limiter    *rateLimiter
+	qlimiter   *queryLimiter
 }
 
 // NewDBMS returns new database management instance.
 func NewDBMS(cfg *DBMSConfig) (dbms *DBMS, err error) {
 	dbms = &DBMS{
-		cfg: cfg,
+		cfg:      cfg,
+		limiter:  newRateLimiter(cfg.RateLimit),
+		qlimiter: newQueryLimiter(cfg.QueryLimit),
 	}
 
 	// init kayak rpc mux
@@ -135,6 +166,12 @@ func (dbms *DBMS) readMeta() (meta *DBMSMeta, err error) {
 	if err == nil && meta.DBS == nil {
 		meta = NewDBMSMeta()
 	}
+	if err == nil && meta.RateLimits == nil {
+		meta.RateLimits = make(map[proto.DatabaseID]*types.RateLimitConfig)
+	}
+	if err == nil && meta.QueryLimits == nil {
+		meta.QueryLimits = make(map[proto.DatabaseID]*types.QueryLimitConfig)
+	}
 
 	return
 }
@@ -145,6 +182,12 @@ func (dbms *DBMS) writeMeta() (err error) {
 	dbms.dbMap.Range(func(key, value interface{}) bool {
 		dbID := key.(proto.DatabaseID)
 		meta.DBS[dbID] = true
+		if cfg, ok := dbms.limiter.getConfig(dbID); ok {
+			meta.RateLimits[dbID] = cfg
+		}
+		if cfg, ok := dbms.qlimiter.getConfig(dbID); ok {
+			meta.QueryLimits[dbID] = cfg
+		}
 		return true
 	})
 
@@ -168,6 +211,14 @@ func (dbms *DBMS) Init() (err error) {
 		return
 	}
 
+	// load rate limits set by database admins
+	for dbID, cfg := range localMeta.RateLimits {
+		dbms.limiter.setConfig(dbID, cfg)
+	}
+	for dbID, cfg := range localMeta.QueryLimits {
+		dbms.qlimiter.setConfig(dbID, cfg)
+	}
+
 	// load current peers info from block producer
 	var dbMapping = dbms.busService.GetCurrentDBMapping()
 
@@ -391,11 +442,26 @@ func (dbms *DBMS) Create(instance *types.ServiceInstance, cleanup bool) (err err
 		MaxWriteTimeGap:        dbms.cfg.MaxReqTimeGap,
 		EncryptionKey:          instance.ResourceMeta.EncryptionKey,
 		SpaceLimit:             instance.ResourceMeta.Space,
+		MemoryLimit:            instance.ResourceMeta.Memory,
 		UpdateBlockCount:       conf.GConf.BillingBlockCount,
 		UseEventualConsistency: instance.ResourceMeta.UseEventualConsistency,
 		ConsistencyLevel:       instance.ResourceMeta.ConsistencyLevel,
 		IsolationLevel:         instance.ResourceMeta.IsolationLevel,
 		SlowQueryTime:          DefaultSlowQueryTime,
+		ChangeRetention:        dbms.cfg.ChangeRetention,
+		HistoryPeriod:          dbms.cfg.HistoryPeriod,
+		HistoryRetention:       dbms.cfg.HistoryRetention,
+		CursorTTL:              dbms.cfg.CursorTTL,
+		MaxCursorsPerConn:      dbms.cfg.MaxCursorsPerConn,
+		MaxCursorsPerNode:      dbms.cfg.MaxCursorsPerNode,
+		MaxCursorsPerDB:        dbms.cfg.MaxCursorsPerDB,
+		Limits:                 dbms.adminLimits(instance.DatabaseID),
+		OnPeersChange: func(peers *proto.Peers) error {
+			return dbms.publishPeers(instance.DatabaseID, peers)
+		},
+		OnLimitsChange: func(limits AdminLimits) error {
+			return dbms.applyAdminLimits(instance.DatabaseID, limits)
+		},
 	}
 
 	if db, err = NewDatabase(dbCfg, instance.Peers, instance.GenesisBlock); err != nil {
@@ -439,9 +505,35 @@ func (dbms *DBMS) Update(instance *types.ServiceInstance) (err error) {
 	return db.UpdatePeers(instance.Peers)
 }
 
+// publishPeers applies peers changed by kayak leader election to the database, the peers are
+// signed by the elected leader and verified by kayak.
+func (dbms *DBMS) publishPeers(dbID proto.DatabaseID, peers *proto.Peers) (err error) {
+	log.WithFields(log.Fields{
+		"db":     dbID,
+		"term":   peers.Term,
+		"leader": peers.Leader,
+	}).Info("publish peers of new leader")
+
+	return dbms.Update(&types.ServiceInstance{
+		DatabaseID: dbID,
+		Peers:      peers,
+	})
+}
+
 // Query handles query request in dbms.
 func (dbms *DBMS) Query(req *types.Request) (res *types.Response, err error) {
 	var db *Database
+
+	if db, err = dbms.admitQuery(req); err != nil {
+		return
+	}
+
+	return db.Query(req)
+}
+
+// admitQuery checks the permission and rate limit of the query request, applies the execution
+// limits to read queries and returns the requested database.
+func (dbms *DBMS) admitQuery(req *types.Request) (db *Database, err error) {
 	var exists bool
 
 	// check permission
@@ -460,7 +552,140 @@ func (dbms *DBMS) Query(req *types.Request) (res *types.Response, err error) {
 		return
 	}
 
-	return db.Query(req)
+	// check rate limit, reads of the database are shared by its miners
+	if err = dbms.limiter.admit(
+		req.Header.DatabaseID, addr, req.Header.QueryType, db.replicas(),
+	); err != nil {
+		return
+	}
+
+	// apply execution limits to read queries
+	if req.Header.QueryType == types.ReadQuery {
+		if limit := dbms.qlimiter.limit(req.Header.DatabaseID, addr); !limit.IsUnlimited() {
+			req.SetContext(x.WithQueryLimit(req.GetContext(), limit))
+		}
+	}
+
+	return
+}
+
+// OpenCursor runs the read query of request in a server-side cursor, see Database.OpenCursor.
+func (dbms *DBMS) OpenCursor(req *types.OpenCursorReq) (resp *types.OpenCursorResp, err error) {
+	var (
+		db     *Database
+		res    *types.Response
+		cursor uint64
+	)
+	req.Request.SetContext(req.GetContext())
+	if db, err = dbms.admitQuery(&req.Request); err != nil {
+		return
+	}
+	if res, cursor, err = db.OpenCursor(&req.Request, cursorBatch(req.BatchSize)); err != nil {
+		return
+	}
+	resp = &types.OpenCursorResp{Response: *res, CursorID: cursor}
+	return
+}
+
+// FetchCursor returns the following rows of the cursor opened by the requesting node.
+func (dbms *DBMS) FetchCursor(req *types.FetchCursorReq) (resp *types.FetchCursorResp, err error) {
+	var (
+		db     *Database
+		exists bool
+	)
+	if db, exists = dbms.getMeta(req.DatabaseID); !exists {
+		err = ErrNotExists
+		return
+	}
+	resp = &types.FetchCursorResp{}
+	resp.Rows, resp.Done, resp.Response, err = db.FetchCursor(
+		req.GetNodeID().ToNodeID(), req.CursorID, cursorBatch(req.BatchSize))
+	return
+}
+
+// CloseCursor closes the cursor opened by the requesting node.
+func (dbms *DBMS) CloseCursor(req *types.CloseCursorReq) (resp *types.CloseCursorResp, err error) {
+	var (
+		db     *Database
+		exists bool
+	)
+	if db, exists = dbms.getMeta(req.DatabaseID); !exists {
+		err = ErrNotExists
+		return
+	}
+	resp = &types.CloseCursorResp{}
+	resp.Response, err = db.CloseCursor(req.GetNodeID().ToNodeID(), req.CursorID)
+	return
+}
+
+func cursorBatch(batch int) int {
+	if batch <= 0 {
+		return DefaultCursorBatch
+	}
+	if batch > MaxCursorBatch {
+		return MaxCursorBatch
+	}
+	return batch
+}
+
+// QueryPeers returns the current peers of database.
+func (dbms *DBMS) QueryPeers(dbID proto.DatabaseID) (peers *proto.Peers, err error) {
+	var db *Database
+	var exists bool
+
+	if db, exists = dbms.getMeta(dbID); !exists {
+		err = ErrNotExists
+		return
+	}
+
+	peers = db.kayakRuntime.Peers()
+	return
+}
+
+// QueryUsage returns the current resource usage of database.
+func (dbms *DBMS) QueryUsage(dbID proto.DatabaseID) (usage *types.DatabaseUsage, err error) {
+	var db *Database
+	var exists bool
+
+	if db, exists = dbms.getMeta(dbID); !exists {
+		err = ErrNotExists
+		return
+	}
+
+	return db.Usage()
+}
+
+// FetchChanges returns the captured row changes of database from the log offset of request,
+// the requesting node should have read permission of database.
+func (dbms *DBMS) FetchChanges(req *types.FetchChangesReq) (resp *types.FetchChangesResp, err error) {
+	var (
+		nodeID = req.GetNodeID().ToNodeID()
+		limit  = req.Limit
+		pubKey *asymmetric.PublicKey
+		addr   proto.AccountAddress
+		db     *Database
+		exists bool
+	)
+	if pubKey, err = kms.GetPublicKey(nodeID); err != nil {
+		err = errors.Wrap(err, "get public key failed")
+		return
+	}
+	if addr, err = crypto.PubKeyHash(pubKey); err != nil {
+		return
+	}
+	if err = dbms.checkUnrestrictedReadPermission(addr, req.DatabaseID); err != nil {
+		return
+	}
+	if db, exists = dbms.getMeta(req.DatabaseID); !exists {
+		err = ErrNotExists
+		return
+	}
+	if limit <= 0 || limit > MaxFetchChanges {
+		limit = MaxFetchChanges
+	}
+	resp = &types.FetchChangesResp{}
+	resp.Changes, resp.Next, err = db.chain.FetchChanges(req.Offset, limit)
+	return
 }
 
 // Ack handles ack of previous response.
@@ -487,6 +712,161 @@ func (dbms *DBMS) Ack(ack *types.Ack) (err error) {
 	return db.Ack(ack)
 }
 
+// Backup takes a backup archive of database if the archive hash of request is empty, otherwise it
+// returns the data chunk of the taken archive, admin permission is required.
+func (dbms *DBMS) Backup(req *types.BackupReq) (resp *types.BackupResp, err error) {
+	if err = req.Header.Verify(); err != nil {
+		return
+	}
+
+	db, err := dbms.checkAdminRequest(req.Header.Signee, req.Header.DatabaseID, req.Header.Timestamp)
+	if err != nil {
+		return
+	}
+
+	resp = &types.BackupResp{}
+	archiveHash := req.ArchiveHash
+	if archiveHash.IsEqual(&hash.Hash{}) {
+		if resp.Header, resp.Size, err = db.Backup(); err != nil {
+			return
+		}
+		archiveHash = resp.Header.Hash()
+	}
+
+	resp.Chunk, err = db.FetchBackup(archiveHash, req.Offset)
+
+	return
+}
+
+// Restore uploads the backup archive data chunk to database, and seeds database with the archive
+// once the last chunk is uploaded, admin permission of the target database is required. The
+// archive must be signed by a registered miner of the source database.
+func (dbms *DBMS) Restore(req *types.RestoreReq) (err error) {
+	if err = verifyRestoreReq(req); err != nil {
+		return
+	}
+
+	db, err := dbms.checkAdminRequest(req.Header.Signee, req.Header.DatabaseID, req.Header.Timestamp)
+	if err != nil {
+		return
+	}
+
+	if err = dbms.checkArchiveSigner(req.ArchiveHeader); err != nil {
+		return
+	}
+
+	return db.RestoreBackup(req)
+}
+
+// checkArchiveSigner checks the backup archive is signed by a registered miner of the source
+// database, the archive signature only proves the archive is not modified.
+func (dbms *DBMS) checkArchiveSigner(header *types.SignedBackupHeader) (err error) {
+	profile, ok := dbms.busService.RequestSQLProfile(header.DatabaseID)
+	if !ok {
+		err = errors.Wrapf(types.ErrInvalidBackupArchive, "source database %s not exists", header.DatabaseID)
+		return
+	}
+
+	var registered bool
+	for _, m := range profile.Miners {
+		if m.NodeID.IsEqual(&header.NodeID) {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		err = errors.Wrapf(types.ErrInvalidBackupArchive,
+			"node %s is not a miner of source database %s", header.NodeID, header.DatabaseID)
+		return
+	}
+
+	key, err := getNodeKey(header.NodeID)
+	if err != nil {
+		return
+	}
+	if !key.IsEqual(header.Signee) {
+		err = errors.Wrapf(types.ErrInvalidBackupArchive, "archive is not signed by node %s", header.NodeID)
+	}
+
+	return
+}
+
+// SetRateLimit updates the per-user query rate limits of database, admin permission is required.
+// The limits are replicated to all miners of the database through kayak.
+func (dbms *DBMS) SetRateLimit(req *types.SetRateLimitReq) (err error) {
+	if err = req.Header.Verify(); err != nil {
+		return
+	}
+
+	db, err := dbms.checkAdminRequest(req.Header.Signee, req.Header.DatabaseID, req.Header.Timestamp)
+	if err != nil {
+		return
+	}
+
+	if err = db.SetRateLimit(req); err != nil {
+		return
+	}
+
+	cfg := req.Header.Config
+	log.WithFields(log.Fields{
+		"db":    req.Header.DatabaseID,
+		"read":  cfg.Read,
+		"write": cfg.Write,
+		"users": len(cfg.Users),
+	}).Info("database rate limits updated")
+
+	return
+}
+
+// SetQueryLimit updates the per-user read query limits of database, admin permission is required.
+// The limits are replicated to all miners of the database through kayak.
+func (dbms *DBMS) SetQueryLimit(req *types.SetQueryLimitReq) (err error) {
+	if err = req.Header.Verify(); err != nil {
+		return
+	}
+
+	db, err := dbms.checkAdminRequest(req.Header.Signee, req.Header.DatabaseID, req.Header.Timestamp)
+	if err != nil {
+		return
+	}
+
+	if err = db.SetQueryLimit(req); err != nil {
+		return
+	}
+
+	cfg := req.Header.Config
+	log.WithFields(log.Fields{
+		"db":      req.Header.DatabaseID,
+		"default": cfg.Default,
+		"users":   len(cfg.Users),
+	}).Info("database query limits updated")
+
+	return
+}
+
+// adminLimits returns the persisted limits of database set by the database admin.
+func (dbms *DBMS) adminLimits(dbID proto.DatabaseID) (limits AdminLimits) {
+	limits.RateLimit, _ = dbms.limiter.getConfig(dbID)
+	limits.QueryLimit, _ = dbms.qlimiter.getConfig(dbID)
+	return
+}
+
+// applyAdminLimits applies the replicated limits of database set by the database admin and
+// persists them in meta.
+func (dbms *DBMS) applyAdminLimits(dbID proto.DatabaseID, limits AdminLimits) (err error) {
+	if limits.RateLimit != nil {
+		dbms.limiter.setConfig(dbID, limits.RateLimit)
+	} else {
+		dbms.limiter.removeDatabase(dbID)
+	}
+	if limits.QueryLimit != nil {
+		dbms.qlimiter.setConfig(dbID, limits.QueryLimit)
+	} else {
+		dbms.qlimiter.removeDatabase(dbID)
+	}
+	return dbms.writeMeta()
+}
+
 func (dbms *DBMS) getMeta(dbID proto.DatabaseID) (db *Database, exists bool) {
 	var rawDB interface{}
 
@@ -504,14 +884,37 @@ func (dbms *DBMS) addMeta(dbID proto.DatabaseID, db *Database) (err error) {
 		return ErrAlreadyExists
 	}
 
+	dbms.updateSoftHeapLimit()
+
 	return dbms.writeMeta()
 }
 
 func (dbms *DBMS) removeMeta(dbID proto.DatabaseID) (err error) {
 	dbms.dbMap.Delete(dbID)
+	dbms.limiter.removeDatabase(dbID)
+	dbms.qlimiter.removeDatabase(dbID)
+	dbms.updateSoftHeapLimit()
 	return dbms.writeMeta()
 }
 
+// updateSoftHeapLimit sets the process-wide sqlite soft heap limit to the total reserved memory of
+// the hosted databases, it's left unlimited if any database has no memory reservation.
+func (dbms *DBMS) updateSoftHeapLimit() {
+	var total uint64
+	dbms.dbMap.Range(func(_, rawDB interface{}) bool {
+		limit := rawDB.(*Database).cfg.MemoryLimit
+		if limit == 0 {
+			total = 0
+			return false
+		}
+		total += limit
+		return true
+	})
+	if err := xs.SetSoftHeapLimit(total); err != nil {
+		log.WithError(err).WithField("limit", total).Warning("set sqlite soft heap limit failed")
+	}
+}
+
 func (dbms *DBMS) checkPermission(addr proto.AccountAddress,
 	dbID proto.DatabaseID, queryType types.QueryType, queries []types.Query) (err error) {
 	log.Debugf("in checkPermission, database id: %s, user addr: %s", dbID, addr.String())
@@ -569,6 +972,85 @@ func (dbms *DBMS) checkPermission(addr proto.AccountAddress,
 		return
 	}
 
+	// check for table grants
+	if permStat.Permission.HasGrants() {
+		if err = checkGrants(permStat.Permission, queries); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"permission": permStat.Permission,
+			}).Debug("can not query")
+			return
+		}
+	}
+
+	return
+}
+
+// checkUnrestrictedReadPermission checks that the user could read the whole database, the row
+// changes of all the tables bypass the query patterns and the table grants of a restricted user.
+func (dbms *DBMS) checkUnrestrictedReadPermission(addr proto.AccountAddress, dbID proto.DatabaseID) (err error) {
+	if err = dbms.checkPermission(addr, dbID, types.ReadQuery, nil); err != nil {
+		return
+	}
+	permStat, ok := dbms.busService.RequestPermStat(dbID, addr)
+	if !ok {
+		err = errors.Wrap(ErrPermissionDeny, "database not exists")
+		return
+	}
+	if len(permStat.Permission.Patterns) > 0 || permStat.Permission.HasGrants() {
+		err = errors.Wrap(ErrPermissionDeny, "cannot read whole database with restricted permission")
+	}
+	return
+}
+
+func (dbms *DBMS) checkAdminPermission(addr proto.AccountAddress, dbID proto.DatabaseID) (err error) {
+	permStat, ok := dbms.busService.RequestPermStat(dbID, addr)
+	if !ok {
+		err = errors.Wrap(ErrPermissionDeny, "database not exists")
+		return
+	}
+
+	if !permStat.Status.EnableQuery() {
+		err = errors.Wrapf(ErrPermissionDeny, "cannot query, status: %d", permStat.Status)
+		return
+	}
+
+	if !permStat.Permission.HasSuperPermission() {
+		err = errors.Wrapf(ErrPermissionDeny, "cannot manage database, permission: %v", permStat.Permission)
+		return
+	}
+
+	return
+}
+
+// checkAdminRequest checks the time and the admin permission of the verified admin request, and
+// returns the target database.
+func (dbms *DBMS) checkAdminRequest(signee *asymmetric.PublicKey,
+	dbID proto.DatabaseID, timestamp time.Time) (db *Database, err error) {
+	if err = checkAdminRequestTime(timestamp); err != nil {
+		return
+	}
+
+	addr, err := crypto.PubKeyHash(signee)
+	if err != nil {
+		return
+	}
+
+	if err = dbms.checkAdminPermission(addr, dbID); err != nil {
+		return
+	}
+
+	var exists bool
+	if db, exists = dbms.getMeta(dbID); !exists {
+		err = ErrNotExists
+	}
+
+	return
+}
+
+func checkAdminRequestTime(t time.Time) (err error) {
+	if skew := time.Since(t); skew > AdminRequestTTL || skew < -AdminRequestTTL {
+		err = errors.Wrapf(ErrInvalidRequest, "request time skew too large: %v", skew)
+	}
 	return
 }
 
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/CovenantSQL/CovenantSQL/rpc"
+	"github.com/CovenantSQL/CovenantSQL/types"
 )
 
 var (
@@ -29,8 +30,17 @@ var (
 
 // DBMSConfig defines the local multi-database management system config.
 type DBMSConfig struct {
-	RootDir          string
-	Server           *rpc.Server
-	MaxReqTimeGap    time.Duration
-	OnCreateDatabase func()
+	RootDir           string
+	Server            *rpc.Server
+	MaxReqTimeGap     time.Duration
+	OnCreateDatabase  func()
+	RateLimit         types.RateLimitConfig  // default per-user rate limits of databases
+	QueryLimit        types.QueryLimitConfig // default per-user read query limits of databases
+	HistoryPeriod     int32                  // block count between state snapshots of databases
+	HistoryRetention  int32                  // block count below the head to read as of
+	CursorTTL         time.Duration          // idle time before a cursor of streaming read expires
+	MaxCursorsPerConn int                    // max open cursors of a client connection
+	MaxCursorsPerNode int                    // max open cursors of a client node
+	MaxCursorsPerDB   int                    // max open cursors of a database
+	ChangeRetention   int                    // count of captured row changes, 0 disables capture
 }
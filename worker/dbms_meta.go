@@ -18,16 +18,21 @@ package worker
 
 import (
 	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
 )
 
 // DBMSMeta defines the meta structure.
 type DBMSMeta struct {
-	DBS map[proto.DatabaseID]bool
+	DBS         map[proto.DatabaseID]bool
+	RateLimits  map[proto.DatabaseID]*types.RateLimitConfig
+	QueryLimits map[proto.DatabaseID]*types.QueryLimitConfig
 }
 
 // NewDBMSMeta returns new DBMSMeta struct.
 func NewDBMSMeta() (meta *DBMSMeta) {
 	return &DBMSMeta{
-		DBS: make(map[proto.DatabaseID]bool),
+		DBS:         make(map[proto.DatabaseID]bool),
+		RateLimits:  make(map[proto.DatabaseID]*types.RateLimitConfig),
+		QueryLimits: make(map[proto.DatabaseID]*types.QueryLimitConfig),
 	}
 }
@@ -31,6 +31,12 @@ const (
 	DBKayakApplyMethodName = "Apply"
 	// DBKayakFetchMethodName defines the database kayak fetch rpc method name.
 	DBKayakFetchMethodName = "Fetch"
+	// DBKayakVoteMethodName defines the database kayak leader election vote rpc method name.
+	DBKayakVoteMethodName = "Vote"
+	// DBKayakHeartbeatMethodName defines the database kayak leader heartbeat rpc method name.
+	DBKayakHeartbeatMethodName = "Heartbeat"
+	// DBKayakSyncMethodName defines the database kayak new member sync rpc method name.
+	DBKayakSyncMethodName = "Sync"
 )
 
 // DBKayakMuxService defines a mux service for sqlchain kayak.
@@ -75,12 +81,56 @@ func (s *DBKayakMuxService) Fetch(req *kt.FetchRequest, resp *kt.FetchResponse)
 	id := proto.DatabaseID(req.Instance)
 
 	if v, ok := s.serviceMap.Load(id); ok {
-		var l *kt.Log
-		if l, err = v.(*kayak.Runtime).Fetch(req.GetContext(), req.Index); err != nil {
-			resp.Log = l
-			resp.Instance = req.Instance
-			return err
+		resp.Instance = req.Instance
+		if req.Attachment != "" {
+			resp.SnapshotChunk, err = v.(*kayak.Runtime).FetchAttachment(
+				req.GetContext(), req.Attachment, req.SnapshotOffset)
+			return
 		}
+		if req.SnapshotIndex != 0 {
+			resp.SnapshotChunk, err = v.(*kayak.Runtime).FetchSnapshot(
+				req.GetContext(), req.SnapshotIndex, req.SnapshotOffset)
+			return
+		}
+		resp.Log, resp.Snapshot, err = v.(*kayak.Runtime).Fetch(req.GetContext(), req.Index)
+		return
+	}
+
+	return errors.Wrapf(ErrUnknownMuxRequest, "instance %v", req.Instance)
+}
+
+// Vote handles kayak leader election vote call.
+func (s *DBKayakMuxService) Vote(req *kt.VoteRequest, resp *kt.VoteResponse) (err error) {
+	id := proto.DatabaseID(req.Instance)
+
+	if v, ok := s.serviceMap.Load(id); ok {
+		resp.Instance = req.Instance
+		resp.Granted, resp.NextIndex, resp.Signature, err = v.(*kayak.Runtime).Vote(req.GetContext(), req)
+		return
+	}
+
+	return errors.Wrapf(ErrUnknownMuxRequest, "instance %v", req.Instance)
+}
+
+// Heartbeat handles kayak leader heartbeat call.
+func (s *DBKayakMuxService) Heartbeat(req *kt.HeartbeatRequest, _ *interface{}) (err error) {
+	id := proto.DatabaseID(req.Instance)
+
+	if v, ok := s.serviceMap.Load(id); ok {
+		return v.(*kayak.Runtime).Heartbeat(req.GetContext(), req)
+	}
+
+	return errors.Wrapf(ErrUnknownMuxRequest, "instance %v", req.Instance)
+}
+
+// Sync handles kayak new member sync call.
+func (s *DBKayakMuxService) Sync(req *kt.SyncRequest, resp *kt.SyncResponse) (err error) {
+	id := proto.DatabaseID(req.Instance)
+
+	if v, ok := s.serviceMap.Load(id); ok {
+		resp.Instance = req.Instance
+		resp.LastCommit, resp.NextIndex, err = v.(*kayak.Runtime).Sync(req.GetContext(), req)
+		return
 	}
 
 	return errors.Wrapf(ErrUnknownMuxRequest, "instance %v", req.Instance)
@@ -100,6 +100,48 @@ func (rpc *DBMSRPCService) Query(req *types.Request, res *types.Response) (err e
 	return
 }
 
+// OpenCursor rpc, called by client to open a server-side cursor of read query.
+func (rpc *DBMSRPCService) OpenCursor(req *types.OpenCursorReq, resp *types.OpenCursorResp) (err error) {
+	// verify query is sent from the request node
+	if req.Envelope.NodeID.String() != string(req.Request.Header.NodeID) {
+		// node id mismatch
+		err = errors.Wrap(ErrInvalidRequest, "request node id mismatch in cursor")
+		dbQueryFailCounter.Mark(1)
+		return
+	}
+
+	var r *types.OpenCursorResp
+	if r, err = rpc.dbms.OpenCursor(req); err != nil {
+		dbQueryFailCounter.Mark(1)
+		return
+	}
+
+	*resp = *r
+	dbQuerySuccCounter.Mark(1)
+
+	return
+}
+
+// FetchCursor rpc, called by client to fetch the following rows of cursor.
+func (rpc *DBMSRPCService) FetchCursor(req *types.FetchCursorReq, resp *types.FetchCursorResp) (err error) {
+	var r *types.FetchCursorResp
+	if r, err = rpc.dbms.FetchCursor(req); err != nil {
+		return
+	}
+	*resp = *r
+	return
+}
+
+// CloseCursor rpc, called by client to close cursor.
+func (rpc *DBMSRPCService) CloseCursor(req *types.CloseCursorReq, resp *types.CloseCursorResp) (err error) {
+	var r *types.CloseCursorResp
+	if r, err = rpc.dbms.CloseCursor(req); err != nil {
+		return
+	}
+	*resp = *r
+	return
+}
+
 // Ack rpc, called by client to confirm read request.
 func (rpc *DBMSRPCService) Ack(ack *types.Ack, _ *types.AckResponse) (err error) {
 	// Just need to verify signature in db.saveAck
@@ -157,3 +199,55 @@ func (rpc *DBMSRPCService) CancelSubscription(req *CancelSubscriptionReq, _ *Can
 	err = rpc.dbms.cancelTxSubscription(req.DatabaseID, nodeID)
 	return
 }
+
+// FetchChanges is the RPC method to fetch the captured row changes of database from a log offset,
+// which is resumed with the returned next offset.
+func (rpc *DBMSRPCService) FetchChanges(req *types.FetchChangesReq, resp *types.FetchChangesResp) (err error) {
+	var r *types.FetchChangesResp
+	if r, err = rpc.dbms.FetchChanges(req); err != nil {
+		return
+	}
+	*resp = *r
+	return
+}
+
+// QueryPeers rpc, called by client to get the current peers of database.
+func (rpc *DBMSRPCService) QueryPeers(req *types.QueryPeersReq, resp *types.QueryPeersResp) (err error) {
+	resp.Peers, err = rpc.dbms.QueryPeers(req.DatabaseID)
+	return
+}
+
+// QueryUsage rpc, called by client to get the current resource usage of database.
+func (rpc *DBMSRPCService) QueryUsage(req *types.QueryUsageReq, resp *types.QueryUsageResp) (err error) {
+	var usage *types.DatabaseUsage
+	if usage, err = rpc.dbms.QueryUsage(req.DatabaseID); err != nil {
+		return
+	}
+	resp.Usage = *usage
+	return
+}
+
+// Backup rpc, called by client to take backup archive of database and fetch it in chunks.
+func (rpc *DBMSRPCService) Backup(req *types.BackupReq, resp *types.BackupResp) (err error) {
+	var r *types.BackupResp
+	if r, err = rpc.dbms.Backup(req); err != nil {
+		return
+	}
+	*resp = *r
+	return
+}
+
+// Restore rpc, called by client to upload backup archive in chunks and seed database with it.
+func (rpc *DBMSRPCService) Restore(req *types.RestoreReq, _ *types.RestoreResp) (err error) {
+	return rpc.dbms.Restore(req)
+}
+
+// SetRateLimit rpc, called by client to update the per-user query rate limits of database.
+func (rpc *DBMSRPCService) SetRateLimit(req *types.SetRateLimitReq, _ *types.SetRateLimitResp) (err error) {
+	return rpc.dbms.SetRateLimit(req)
+}
+
+// SetQueryLimit rpc, called by client to update the per-user read query limits of database.
+func (rpc *DBMSRPCService) SetQueryLimit(req *types.SetQueryLimitReq, _ *types.SetQueryLimitResp) (err error) {
+	return rpc.dbms.SetQueryLimit(req)
+}
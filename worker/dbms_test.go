@@ -55,9 +55,10 @@ func TestDBMS(t *testing.T) {
 		So(err, ShouldBeNil)
 
 		cfg := &DBMSConfig{
-			RootDir:       rootDir,
-			Server:        server,
-			MaxReqTimeGap: time.Second * 5,
+			RootDir:         rootDir,
+			Server:          server,
+			MaxReqTimeGap:   time.Second * 5,
+			ChangeRetention: 100,
 		}
 
 		var dbms *DBMS
@@ -414,7 +415,8 @@ func TestDBMS(t *testing.T) {
 			// enforce query pattern regulations
 			err = dbms.UpdatePermission(dbAddr.DatabaseID(), userAddr,
 				&types.PermStat{Permission: &types.UserPermission{
-					Role: types.Admin,
+					Role:             types.Admin,
+					MatchFingerprint: true,
 					Patterns: []string{
 						"create table test (test int)",
 						"SELECT 1",
@@ -438,6 +440,8 @@ func TestDBMS(t *testing.T) {
 					dbID, []string{
 						"create table test (test int)",
 						"INSERT INTO TEST VALUES(1)",
+						// matched by query fingerprint
+						"insert into test values (2)",
 					})
 				So(err, ShouldBeNil)
 
@@ -465,7 +469,7 @@ func TestDBMS(t *testing.T) {
 				writeQuery, err = buildQueryWithDatabaseID(types.WriteQuery,
 					1, atomic.AddUint64(&seqNo, 1),
 					dbID, []string{
-						"insert into test values(1)",
+						"insert into test (test) values(1)",
 					})
 				So(err, ShouldBeNil)
 				err = testRequest(route.DBSQuery, writeQuery, &queryRes)
@@ -476,7 +480,7 @@ func TestDBMS(t *testing.T) {
 					1, atomic.AddUint64(&seqNo, 1),
 					dbID, []string{
 						"INSERT INTO TEST VALUES(1)",
-						"insert into test values(1)",
+						"insert into test (test) values(1)",
 					})
 				So(err, ShouldBeNil)
 				err = testRequest(route.DBSQuery, writeQuery, &queryRes)
@@ -548,6 +552,419 @@ func TestDBMS(t *testing.T) {
 				So(err, ShouldBeNil)
 			})
 
+			Convey("backup and restore database", func() {
+				var writeQuery *types.Request
+				var queryRes *types.Response
+				writeQuery, err = buildQueryWithDatabaseID(types.WriteQuery,
+					1, atomic.AddUint64(&seqNo, 1),
+					dbID, []string{
+						"create table test (test int)",
+						"insert into test values(1)",
+					})
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSQuery, writeQuery, &queryRes)
+				So(err, ShouldBeNil)
+
+				// backup
+				newBackupReq := func(archiveHash hash.Hash, offset uint64) *types.BackupReq {
+					backupReq := &types.BackupReq{ArchiveHash: archiveHash, Offset: offset}
+					backupReq.Header.DatabaseID = dbID
+					backupReq.Header.Timestamp = time.Now().UTC()
+					So(backupReq.Header.Sign(privateKey), ShouldBeNil)
+					return backupReq
+				}
+				var backupRes types.BackupResp
+				err = testRequest(route.DBSBackup, newBackupReq(hash.Hash{}, 0), &backupRes)
+				So(err, ShouldBeNil)
+				So(backupRes.Header, ShouldNotBeNil)
+				So(backupRes.Size, ShouldBeGreaterThan, 0)
+				So(uint64(len(backupRes.Chunk)), ShouldEqual, backupRes.Size)
+				archive := &types.BackupArchive{Header: *backupRes.Header, Data: backupRes.Chunk}
+				So(archive.Verify(), ShouldBeNil)
+				So(archive.Header.DatabaseID, ShouldEqual, dbID)
+				So(archive.Header.NodeID, ShouldEqual, nodeID)
+				So(archive.Header.CommitIndex, ShouldBeGreaterThan, 0)
+
+				// archive data is fetched in chunks
+				var chunkRes types.BackupResp
+				err = testRequest(route.DBSBackup, newBackupReq(archive.Header.Hash(), 1), &chunkRes)
+				So(err, ShouldBeNil)
+				So(chunkRes.Chunk, ShouldResemble, archive.Data[1:])
+				err = testRequest(route.DBSBackup, newBackupReq(hash.Hash{1}, 0), &chunkRes)
+				So(err, ShouldNotBeNil)
+
+				// create new database to restore
+				req = new(types.UpdateService)
+				req.Header.Op = types.CreateDB
+				req.Header.Instance = types.ServiceInstance{
+					DatabaseID:   dbID2,
+					Peers:        peers,
+					GenesisBlock: block,
+				}
+				err = req.Sign(privateKey)
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSDeploy, req, &res)
+				So(err, ShouldBeNil)
+				err = dbms.UpdatePermission(dbID2, userAddr,
+					&types.PermStat{Permission: types.UserPermissionFromRole(types.Admin), Status: types.Normal})
+				So(err, ShouldBeNil)
+
+				newRestoreReq := func(target proto.DatabaseID) *types.RestoreReq {
+					restoreReq := &types.RestoreReq{
+						ArchiveHeader: &archive.Header,
+						Size:          uint64(len(archive.Data)),
+						Chunk:         archive.Data,
+					}
+					restoreReq.Header.DatabaseID = target
+					restoreReq.Header.ArchiveHash = archive.Header.Hash()
+					restoreReq.Header.Timestamp = time.Now().UTC()
+					So(restoreReq.Header.Sign(privateKey), ShouldBeNil)
+					return restoreReq
+				}
+
+				// archive must be signed by a registered miner of the source database
+				var restoreRes types.RestoreResp
+				err = testRequest(route.DBSRestore, newRestoreReq(dbID2), &restoreRes)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "is not a miner of source database")
+				dbms.busService.lock.Lock()
+				dbms.busService.sqlChainProfiles[dbID].Miners = []*types.MinerInfo{{NodeID: nodeID}}
+				dbms.busService.lock.Unlock()
+
+				// archive data is uploaded in order, the restore is applied with the last chunk
+				restoreReq := newRestoreReq(dbID2)
+				restoreReq.Offset, restoreReq.Chunk = 1, archive.Data[1:]
+				err = testRequest(route.DBSRestore, restoreReq, &restoreRes)
+				So(err, ShouldNotBeNil)
+				restoreReq = newRestoreReq(dbID2)
+				restoreReq.Chunk = archive.Data[:1]
+				err = testRequest(route.DBSRestore, restoreReq, &restoreRes)
+				So(err, ShouldBeNil)
+				restoreReq = newRestoreReq(dbID2)
+				restoreReq.Offset, restoreReq.Chunk = 1, archive.Data[1:]
+				err = testRequest(route.DBSRestore, restoreReq, &restoreRes)
+				So(err, ShouldBeNil)
+
+				var readQuery *types.Request
+				readQuery, err = buildQueryWithDatabaseID(types.ReadQuery,
+					1, atomic.AddUint64(&seqNo, 1),
+					dbID2, []string{
+						"select * from test",
+					})
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSQuery, readQuery, &queryRes)
+				So(err, ShouldBeNil)
+				So(queryRes.Header.RowCount, ShouldEqual, uint64(1))
+
+				// database with committed writes could not be restored
+				err = testRequest(route.DBSRestore, newRestoreReq(dbID), &restoreRes)
+				So(err, ShouldNotBeNil)
+
+				// tampered archive
+				tampered := archive.Header
+				tampered.PayloadHash = hash.THashH([]byte("tampered"))
+				So(tampered.Sign(privateKey), ShouldBeNil)
+				restoreReq = newRestoreReq(dbID2)
+				restoreReq.ArchiveHeader = &tampered
+				restoreReq.Header.ArchiveHash = tampered.Hash()
+				So(restoreReq.Header.Sign(privateKey), ShouldBeNil)
+				err = testRequest(route.DBSRestore, restoreReq, &restoreRes)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "archive data hash mismatched")
+			})
+
+			Convey("rate limit queries of user", func() {
+				newRateLimitReq := func() *types.SetRateLimitReq {
+					rateLimitReq := &types.SetRateLimitReq{}
+					rateLimitReq.Header.DatabaseID = dbID
+					rateLimitReq.Header.Config = types.RateLimitConfig{
+						Read: types.RateLimit{Rate: 0.01, Burst: 2},
+					}
+					rateLimitReq.Header.Timestamp = time.Now().UTC()
+					So(rateLimitReq.Header.Sign(privateKey), ShouldBeNil)
+					return rateLimitReq
+				}
+
+				var rateLimitRes types.SetRateLimitResp
+				err = testRequest(route.DBSSetRateLimit, newRateLimitReq(), &rateLimitRes)
+				So(err, ShouldBeNil)
+
+				var queryRes *types.Response
+				for i := 0; i < 3; i++ {
+					var readQuery *types.Request
+					readQuery, err = buildQueryWithDatabaseID(types.ReadQuery,
+						1, atomic.AddUint64(&seqNo, 1),
+						dbID, []string{
+							"select 1",
+						})
+					So(err, ShouldBeNil)
+					err = testRequest(route.DBSQuery, readQuery, &queryRes)
+					if i < 2 {
+						So(err, ShouldBeNil)
+					} else {
+						So(err, ShouldNotBeNil)
+						So(err.Error(), ShouldContainSubstring, ErrRateLimitExceeded.Error())
+					}
+				}
+
+				// write queries are not limited
+				var writeQuery *types.Request
+				writeQuery, err = buildQueryWithDatabaseID(types.WriteQuery,
+					1, atomic.AddUint64(&seqNo, 1),
+					dbID, []string{
+						"create table test (test int)",
+					})
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSQuery, writeQuery, &queryRes)
+				So(err, ShouldBeNil)
+
+				// rate limits are replicated to the database and persisted in meta
+				db, ok := dbms.getMeta(dbID)
+				So(ok, ShouldBeTrue)
+				So(db.Limits().RateLimit, ShouldNotBeNil)
+				So(db.Limits().RateLimit.Read.Burst, ShouldEqual, 2)
+				meta, err := dbms.readMeta()
+				So(err, ShouldBeNil)
+				So(meta.RateLimits, ShouldContainKey, dbID)
+				So(meta.RateLimits[dbID].Read.Burst, ShouldEqual, 2)
+			})
+
+			Convey("limit read queries of user", func() {
+				queryLimitReq := &types.SetQueryLimitReq{}
+				queryLimitReq.Header.DatabaseID = dbID
+				queryLimitReq.Header.Config = types.QueryLimitConfig{
+					Default: types.QueryLimit{MaxRows: 1},
+				}
+				queryLimitReq.Header.Timestamp = time.Now().UTC()
+				So(queryLimitReq.Header.Sign(privateKey), ShouldBeNil)
+
+				var queryLimitRes types.SetQueryLimitResp
+				err = testRequest(route.DBSSetQueryLimit, queryLimitReq, &queryLimitRes)
+				So(err, ShouldBeNil)
+				db, ok := dbms.getMeta(dbID)
+				So(ok, ShouldBeTrue)
+				So(db.Limits().QueryLimit, ShouldNotBeNil)
+				So(db.Limits().QueryLimit.Default.MaxRows, ShouldEqual, 1)
+
+				var (
+					readQuery *types.Request
+					queryRes  *types.Response
+				)
+				readQuery, err = buildQueryWithDatabaseID(types.ReadQuery,
+					1, atomic.AddUint64(&seqNo, 1),
+					dbID, []string{
+						"select 1",
+					})
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSQuery, readQuery, &queryRes)
+				So(err, ShouldBeNil)
+
+				readQuery, err = buildQueryWithDatabaseID(types.ReadQuery,
+					1, atomic.AddUint64(&seqNo, 1),
+					dbID, []string{
+						"select 1 union all select 2",
+					})
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSQuery, readQuery, &queryRes)
+				So(err, ShouldNotBeNil)
+				qle, ok := types.ParseQueryLimitError(err)
+				So(ok, ShouldBeTrue)
+				So(qle.Kind, ShouldEqual, types.MaxRowsLimit)
+				So(qle.Limit, ShouldEqual, 1)
+
+				// query limits are persisted in meta
+				meta, err := dbms.readMeta()
+				So(err, ShouldBeNil)
+				So(meta.QueryLimits, ShouldContainKey, dbID)
+				So(meta.QueryLimits[dbID].Default.MaxRows, ShouldEqual, 1)
+			})
+
+			Convey("fetch row changes of database", func() {
+				var (
+					writeQuery *types.Request
+					queryRes   *types.Response
+				)
+				writeQuery, err = buildQueryWithDatabaseID(types.WriteQuery,
+					1, atomic.AddUint64(&seqNo, 1),
+					dbID, []string{
+						"create table change_test (k int primary key, v text)",
+						"insert into change_test values (1, 'a')",
+						"update change_test set v = 'b' where k = 1",
+					})
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSQuery, writeQuery, &queryRes)
+				So(err, ShouldBeNil)
+
+				var changesRes types.FetchChangesResp
+				err = testRequest(route.DBSFetchChanges, &types.FetchChangesReq{
+					DatabaseID: dbID,
+				}, &changesRes)
+				So(err, ShouldBeNil)
+				So(changesRes.Changes, ShouldHaveLength, 2)
+				So(changesRes.Changes[0].Table, ShouldEqual, "change_test")
+				So(changesRes.Changes[0].Op, ShouldEqual, types.RowInsert)
+				So(changesRes.Changes[1].Op, ShouldEqual, types.RowUpdate)
+				So(changesRes.Next, ShouldEqual, changesRes.Changes[1].LogOffset+1)
+
+				// resume from the next offset
+				err = testRequest(route.DBSFetchChanges, &types.FetchChangesReq{
+					DatabaseID: dbID,
+					Offset:     changesRes.Next,
+				}, &changesRes)
+				So(err, ShouldBeNil)
+				So(changesRes.Changes, ShouldBeEmpty)
+
+				// restricted users could not read the changes of all the tables
+				for _, perm := range []*types.UserPermission{
+					{Role: types.Admin, Patterns: []string{"SELECT 1"}},
+					{Role: types.Admin, Grants: []types.TableGrant{
+						{Table: "change_test", Columns: []string{"k"}, Privileges: types.SelectPrivilege},
+					}},
+				} {
+					err = dbms.UpdatePermission(dbID, userAddr,
+						&types.PermStat{Permission: perm, Status: types.Normal})
+					So(err, ShouldBeNil)
+					var restrictedRes types.FetchChangesResp
+					err = testRequest(route.DBSFetchChanges, &types.FetchChangesReq{
+						DatabaseID: dbID,
+					}, &restrictedRes)
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldContainSubstring, "restricted permission")
+				}
+			})
+
+			Convey("replay the response of duplicate write", func() {
+				var (
+					writeQuery       *types.Request
+					queryRes, dupRes *types.Response
+				)
+				writeQuery, err = buildQueryWithDatabaseID(types.WriteQuery,
+					1, atomic.AddUint64(&seqNo, 1),
+					dbID, []string{
+						"create table dup_test (k int)",
+						"insert into dup_test values (1)",
+					})
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSQuery, writeQuery, &queryRes)
+				So(err, ShouldBeNil)
+
+				// resend the same request as a retry
+				err = testRequest(route.DBSQuery, writeQuery, &dupRes)
+				So(err, ShouldBeNil)
+				So(dupRes.Header.Hash(), ShouldEqual, queryRes.Header.Hash())
+				So(dupRes.Header.LogOffset, ShouldEqual, queryRes.Header.LogOffset)
+				So(dupRes.Verify(), ShouldBeNil)
+
+				// the response is rebuilt from the applied write on other replicas
+				db, exists := dbms.getMeta(dbID)
+				So(exists, ShouldBeTrue)
+				hdr := db.appliedResponse(writeQuery)
+				So(hdr, ShouldNotBeNil)
+				So(hdr.NodeID, ShouldEqual, db.nodeID)
+				So(hdr.RequestHash, ShouldEqual, writeQuery.Header.Hash())
+				So(hdr.LogOffset, ShouldEqual, queryRes.Header.LogOffset)
+				So(hdr.AffectedRows, ShouldEqual, queryRes.Header.AffectedRows)
+				So(hdr.LastInsertID, ShouldEqual, queryRes.Header.LastInsertID)
+
+				// stale sequence with different queries is still rejected
+				writeQuery, err = buildQueryWithDatabaseID(types.WriteQuery,
+					1, writeQuery.Header.SeqNo,
+					dbID, []string{
+						"insert into dup_test values (2)",
+					})
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSQuery, writeQuery, &dupRes)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, ErrInvalidRequestSeq.Error())
+				So(db.appliedResponse(writeQuery), ShouldBeNil)
+			})
+
+			Convey("stream read results through cursor", func() {
+				var readQuery *types.Request
+				readQuery, err = buildQueryWithDatabaseID(types.ReadQuery,
+					1, atomic.AddUint64(&seqNo, 1),
+					dbID, []string{
+						"select 1 union all select 2 union all select 3",
+					})
+				So(err, ShouldBeNil)
+
+				var openRes types.OpenCursorResp
+				err = testRequest(route.DBSOpenCursor, &types.OpenCursorReq{
+					Request:   *readQuery,
+					BatchSize: 2,
+				}, &openRes)
+				So(err, ShouldBeNil)
+				So(openRes.CursorID, ShouldNotEqual, 0)
+				So(openRes.Response.Payload.Rows, ShouldHaveLength, 2)
+				So(openRes.Response.Verify(), ShouldBeNil)
+
+				var fetchRes types.FetchCursorResp
+				err = testRequest(route.DBSFetchCursor, &types.FetchCursorReq{
+					DatabaseID: dbID,
+					CursorID:   openRes.CursorID,
+					BatchSize:  2,
+				}, &fetchRes)
+				So(err, ShouldBeNil)
+				So(fetchRes.Done, ShouldBeTrue)
+				So(fetchRes.Rows, ShouldHaveLength, 1)
+
+				// the whole cursor is acknowledged on close
+				So(fetchRes.Response, ShouldNotBeNil)
+				So(fetchRes.Response.Verify(), ShouldBeNil)
+				So(fetchRes.Response.RequestHash, ShouldEqual, readQuery.Header.Hash())
+				So(fetchRes.Response.RowCount, ShouldEqual, 3)
+				So(fetchRes.Response.Cost.RowsRead, ShouldEqual, 3)
+				var ack *types.Ack
+				ack, err = buildAck(&types.Response{Header: *fetchRes.Response})
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSAck, ack, &types.AckResponse{})
+				So(err, ShouldBeNil)
+
+				// the cursor is closed after all rows are fetched
+				err = testRequest(route.DBSFetchCursor, &types.FetchCursorReq{
+					DatabaseID: dbID,
+					CursorID:   openRes.CursorID,
+				}, &fetchRes)
+				So(err, ShouldNotBeNil)
+				err = testRequest(route.DBSCloseCursor, &types.CloseCursorReq{
+					DatabaseID: dbID,
+					CursorID:   openRes.CursorID,
+				}, &types.CloseCursorResp{})
+				So(err, ShouldNotBeNil)
+
+				// the cursor closed by client returns the response of the fetched rows
+				readQuery, err = buildQueryWithDatabaseID(types.ReadQuery,
+					1, atomic.AddUint64(&seqNo, 1),
+					dbID, []string{
+						"select 1 union all select 2 union all select 3",
+					})
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSOpenCursor, &types.OpenCursorReq{
+					Request:   *readQuery,
+					BatchSize: 1,
+				}, &openRes)
+				So(err, ShouldBeNil)
+				So(openRes.CursorID, ShouldNotEqual, 0)
+				var closeRes types.CloseCursorResp
+				err = testRequest(route.DBSCloseCursor, &types.CloseCursorReq{
+					DatabaseID: dbID,
+					CursorID:   openRes.CursorID,
+				}, &closeRes)
+				So(err, ShouldBeNil)
+				So(closeRes.Response, ShouldNotBeNil)
+				So(closeRes.Response.Verify(), ShouldBeNil)
+				So(closeRes.Response.RowCount, ShouldEqual, 1)
+
+				// write query is not allowed
+				readQuery.Header.QueryType = types.WriteQuery
+				err = readQuery.Sign(privateKey)
+				So(err, ShouldBeNil)
+				err = testRequest(route.DBSOpenCursor, &types.OpenCursorReq{
+					Request: *readQuery,
+				}, &openRes)
+				So(err, ShouldNotBeNil)
+			})
+
 			Convey("drop database before shutdown", func() {
 				// drop database
 				req = new(types.UpdateService)
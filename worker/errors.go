@@ -16,7 +16,11 @@
 
 package worker
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
 
 var (
 	// ErrInvalidRequest defines invalid request structure during request.
@@ -26,7 +30,7 @@ var (
 	// ErrAlreadyExists defines error on re-creating existing database instance.
 	ErrAlreadyExists = errors.New("database instance already exists")
 	// ErrNotExists defines errors on manipulating a non-exists database instance.
-	ErrNotExists = errors.New("database instance not exists")
+	ErrNotExists = types.ErrDatabaseNotExists
 	// ErrInvalidDBConfig defines errors on received invalid db config from block producer.
 	ErrInvalidDBConfig = errors.New("invalid database configuration")
 	// ErrSpaceLimitExceeded defines errors on disk space exceeding limit.
@@ -39,4 +43,11 @@ var (
 	ErrInvalidPermission = errors.New("invalid permission")
 	// ErrInvalidTransactionType indicates that the transaction type is invalid.
 	ErrInvalidTransactionType = errors.New("invalid transaction type")
+	// ErrRateLimitExceeded indicates that the query is throttled by the rate limits of database user.
+	ErrRateLimitExceeded = errors.New("rate limit exceeded")
+	// ErrTooManyCursors indicates that the client connection, the client node or the database has
+	// too many open cursors.
+	ErrTooManyCursors = errors.New("too many open cursors")
+	// ErrCursorNotFound indicates that the cursor is not found or already closed.
+	ErrCursorNotFound = errors.New("cursor not found")
 )
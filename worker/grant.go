@@ -0,0 +1,339 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"strings"
+
+	"github.com/CovenantSQL/sqlparser"
+	"github.com/pkg/errors"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// tableAccess defines a privilege required by a statement on a table or a column of it.
+type tableAccess struct {
+	table  string
+	column string
+	priv   types.GrantPrivilege
+}
+
+// String implements fmt.Stringer for error message.
+func (a *tableAccess) String() string {
+	var priv = a.priv.String()
+	if priv == "" {
+		priv = "any"
+	}
+	switch a.column {
+	case "":
+		return priv + " privilege on table " + a.table
+	case "*":
+		return priv + " privilege on all columns of table " + a.table
+	default:
+		return priv + " privilege on column " + a.column + " of table " + a.table
+	}
+}
+
+// accessCollector collects the table accesses of a parsed statement.
+type accessCollector struct {
+	// real tables by lowered name and alias
+	tables map[string]string
+	// aliases of derived tables
+	derived  map[string]bool
+	accesses []*tableAccess
+}
+
+// checkGrants checks the parsed statements of queries against the table grants of permission.
+func checkGrants(perm *types.UserPermission, queries []types.Query) (err error) {
+	for _, q := range queries {
+		var statements []sqlparser.Statement
+		if _, statements, err = sqlparser.ParseMultiple(sqlparser.NewStringTokenizer(q.Pattern)); err != nil {
+			return errors.Wrapf(ErrPermissionDeny, "unrecognized query %s: %v", q.Pattern, err)
+		}
+		for _, stmt := range statements {
+			if err = checkStatementGrants(perm, stmt); err != nil {
+				return errors.Wrapf(err, "in query %s", q.Pattern)
+			}
+		}
+	}
+	return
+}
+
+// checkStatementGrants checks a parsed statement against the table grants of permission.
+func checkStatementGrants(perm *types.UserPermission, stmt sqlparser.Statement) (err error) {
+	var accesses []*tableAccess
+	if accesses, err = collectTableAccesses(stmt); err != nil {
+		return errors.Wrapf(ErrPermissionDeny, "%v", err)
+	}
+	for _, a := range accesses {
+		if !perm.IsGranted(a.table, a.column, a.priv) {
+			return errors.Wrapf(ErrPermissionDeny, "no %s", a)
+		}
+	}
+	return
+}
+
+func collectTableAccesses(stmt sqlparser.Statement) (accesses []*tableAccess, err error) {
+	c := &accessCollector{
+		tables:  make(map[string]string),
+		derived: make(map[string]bool),
+	}
+	// collect table references
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.AliasedTableExpr:
+			switch e := n.Expr.(type) {
+			case sqlparser.TableName:
+				name := e.Name.String()
+				c.tables[strings.ToLower(name)] = name
+				if !n.As.IsEmpty() {
+					c.tables[strings.ToLower(n.As.String())] = name
+				}
+			case *sqlparser.Subquery:
+				c.derived[strings.ToLower(n.As.String())] = true
+			}
+		}
+		return true, nil
+	}, stmt)
+
+	switch s := stmt.(type) {
+	case *sqlparser.Select, *sqlparser.Union, *sqlparser.ParenSelect:
+		c.addTables(types.SelectPrivilege)
+		c.addReads(s)
+	case *sqlparser.Insert:
+		var (
+			table = s.Table.Name.String()
+			privs = []types.GrantPrivilege{types.InsertPrivilege}
+		)
+		if s.Action == sqlparser.ReplaceStr {
+			// replace deletes the conflicting rows
+			privs = append(privs, types.DeletePrivilege)
+		}
+		for _, priv := range privs {
+			if len(s.Columns) == 0 || priv == types.DeletePrivilege {
+				c.add(table, "*", priv)
+				continue
+			}
+			for _, col := range s.Columns {
+				c.add(table, col.String(), priv)
+			}
+		}
+		// the conflicting row is updated by the on duplicate expressions, in which the
+		// unqualified columns are the columns of the conflicting row
+		for _, e := range s.OnDup {
+			c.add(table, e.Name.Name.String(), types.UpdatePrivilege)
+			_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+				if col, ok := node.(*sqlparser.ColName); ok && col.Qualifier.IsEmpty() {
+					c.add(table, col.Name.String(), types.SelectPrivilege)
+				}
+				return true, nil
+			}, e.Expr)
+			c.addReads(e.Expr)
+		}
+		c.addTables(types.SelectPrivilege)
+		c.addReads(s.Rows)
+	case *sqlparser.Update:
+		// the unqualified columns to set are the columns of the updated tables only
+		targets := targetTables(s.TableExprs)
+		for _, e := range s.Exprs {
+			if e.Name.Qualifier.IsEmpty() {
+				for _, t := range targets {
+					c.add(t, e.Name.Name.String(), types.UpdatePrivilege)
+				}
+			} else {
+				c.addColumn(e.Name, types.UpdatePrivilege)
+			}
+			c.addReads(e.Expr)
+		}
+		c.addReads(s.Where, s.OrderBy, s.Limit)
+	case *sqlparser.Delete:
+		// the rows are deleted from the targets only, the other tables like the ones of the
+		// subqueries are read
+		targets := targetTables(s.TableExprs)
+		if len(s.Targets) > 0 {
+			targets = targets[:0]
+			for _, t := range s.Targets {
+				name, ok := c.tables[strings.ToLower(t.Name.String())]
+				if !ok {
+					name = t.Name.String()
+				}
+				targets = append(targets, name)
+			}
+		}
+		deleted := make(map[string]bool)
+		for _, t := range targets {
+			deleted[t] = true
+			c.add(t, "", types.DeletePrivilege)
+		}
+		for _, t := range c.realTables() {
+			if !deleted[t] {
+				c.add(t, "", types.SelectPrivilege)
+			}
+		}
+		c.addReads(s.Where, s.OrderBy, s.Limit)
+	case *sqlparser.Show:
+		if !s.OnTable.IsEmpty() {
+			c.add(s.OnTable.Name.String(), "", 0)
+		}
+	default:
+		err = errors.Errorf("statement %s not allowed with table grants", sqlparser.String(stmt))
+		return
+	}
+
+	accesses = c.accesses
+	return
+}
+
+// targetTables returns the real tables of the table expressions of an update or delete
+// statement, excluding the tables of the subqueries.
+func targetTables(exprs sqlparser.TableExprs) (tables []string) {
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			return false, nil
+		case sqlparser.TableName:
+			tables = append(tables, n.Name.String())
+		}
+		return true, nil
+	}, exprs)
+	return
+}
+
+func (c *accessCollector) add(table, column string, priv types.GrantPrivilege) {
+	c.accesses = append(c.accesses, &tableAccess{table: table, column: column, priv: priv})
+}
+
+// realTables returns the distinct real tables referenced by the statement.
+func (c *accessCollector) realTables() (tables []string) {
+	seen := make(map[string]bool)
+	for _, t := range c.tables {
+		if !seen[t] {
+			seen[t] = true
+			tables = append(tables, t)
+		}
+	}
+	return
+}
+
+func (c *accessCollector) addTables(priv types.GrantPrivilege) {
+	for _, t := range c.realTables() {
+		c.add(t, "", priv)
+	}
+}
+
+// addColumn adds column access, the unqualified column is accessed on each table of the
+// statement as the table schema is unknown.
+func (c *accessCollector) addColumn(col *sqlparser.ColName, priv types.GrantPrivilege) {
+	if !col.Qualifier.IsEmpty() {
+		qualifier := strings.ToLower(col.Qualifier.Name.String())
+		if c.derived[qualifier] {
+			return
+		}
+		table, ok := c.tables[qualifier]
+		if !ok {
+			table = col.Qualifier.Name.String()
+		}
+		c.add(table, col.Name.String(), priv)
+		return
+	}
+	for _, t := range c.realTables() {
+		c.add(t, col.Name.String(), priv)
+	}
+}
+
+// addReads adds the select accesses of the columns read by nodes.
+func (c *accessCollector) addReads(nodes ...sqlparser.SQLNode) {
+	var visit func(node sqlparser.SQLNode) (bool, error)
+	visit = func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Select:
+			c.addReads(n.SelectExprs, n.From, n.Where, n.GroupBy, n.Having, n.Limit)
+			c.addOrderReads(n.OrderBy, n)
+			return false, nil
+		case *sqlparser.Union:
+			c.addReads(n.Left, n.Right, n.Limit)
+			c.addOrderReads(n.OrderBy, n)
+			return false, nil
+		case *sqlparser.ColName:
+			c.addColumn(n, types.SelectPrivilege)
+		case *sqlparser.StarExpr:
+			if n.TableName.IsEmpty() {
+				for _, t := range c.realTables() {
+					c.add(t, "*", types.SelectPrivilege)
+				}
+				break
+			}
+			qualifier := strings.ToLower(n.TableName.Name.String())
+			if c.derived[qualifier] {
+				break
+			}
+			table, ok := c.tables[qualifier]
+			if !ok {
+				table = n.TableName.Name.String()
+			}
+			c.add(table, "*", types.SelectPrivilege)
+		case *sqlparser.FuncExpr:
+			// star argument of aggregate function like count(*) reads no column
+			for _, e := range n.Exprs {
+				if _, ok := e.(*sqlparser.StarExpr); !ok {
+					_ = sqlparser.Walk(visit, e)
+				}
+			}
+			return false, nil
+		}
+		return true, nil
+	}
+	for _, n := range nodes {
+		if n != nil {
+			_ = sqlparser.Walk(visit, n)
+		}
+	}
+}
+
+// addOrderReads adds the select accesses of the order by terms of the select statement. A bare
+// identifier term is resolved to the result column alias of the select first, which is the only
+// place an alias shadows the real column, thus it reads no column if such alias exists.
+func (c *accessCollector) addOrderReads(orderBy sqlparser.OrderBy, stmt sqlparser.SelectStatement) {
+	aliases := make(map[string]bool)
+	if s := firstSelect(stmt); s != nil {
+		for _, e := range s.SelectExprs {
+			if ae, ok := e.(*sqlparser.AliasedExpr); ok && !ae.As.IsEmpty() {
+				aliases[ae.As.Lowered()] = true
+			}
+		}
+	}
+	for _, o := range orderBy {
+		if col, ok := o.Expr.(*sqlparser.ColName); ok && col.Qualifier.IsEmpty() &&
+			aliases[col.Name.Lowered()] {
+			continue
+		}
+		c.addReads(o.Expr)
+	}
+}
+
+// firstSelect returns the leftmost select of the statement, which names the result columns.
+func firstSelect(stmt sqlparser.SelectStatement) *sqlparser.Select {
+	switch s := stmt.(type) {
+	case *sqlparser.Select:
+		return s
+	case *sqlparser.Union:
+		return firstSelect(s.Left)
+	case *sqlparser.ParenSelect:
+		return firstSelect(s.Select)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"testing"
+
+	"github.com/CovenantSQL/sqlparser"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestCheckGrants(t *testing.T) {
+	Convey("check queries against table grants", t, func() {
+		perm := types.UserPermissionFromRole(types.ReadWrite)
+		perm.Grants = []types.TableGrant{
+			{Table: "t", Privileges: types.SelectPrivilege | types.InsertPrivilege},
+			{Table: "u", Columns: []string{"id", "name"}, Privileges: types.SelectPrivilege | types.UpdatePrivilege},
+			{Table: "w", Privileges: types.InsertPrivilege},
+			{Table: "w", Columns: []string{"n"}, Privileges: types.SelectPrivilege | types.UpdatePrivilege},
+			{Table: "d", Privileges: types.SelectPrivilege | types.DeletePrivilege},
+		}
+		check := func(q string) error {
+			return checkGrants(perm, []types.Query{{Pattern: q}})
+		}
+
+		allowed := []string{
+			"SELECT * FROM t",
+			"SELECT count(*) FROM u",
+			"SELECT u.id, t.v FROM t JOIN u ON t.id = u.id",
+			"SELECT x.name AS n FROM u AS x WHERE x.id = 1 ORDER BY n",
+			"SELECT s.id FROM (SELECT id FROM u) AS s",
+			"INSERT INTO t VALUES (1, 2)",
+			"INSERT INTO t (id) SELECT id FROM u",
+			"UPDATE u SET name = 'a' WHERE id = 1",
+			"SHOW CREATE TABLE u",
+			"SHOW TABLES",
+			"SELECT id AS i FROM u UNION SELECT id FROM u ORDER BY i",
+			"DELETE FROM d WHERE id IN (SELECT id FROM t)",
+			"UPDATE u SET name = (SELECT t.v FROM t WHERE t.id = 1) WHERE id = 1",
+		}
+		for _, q := range allowed {
+			So(check(q), ShouldBeNil)
+		}
+
+		denied := []string{
+			"SELECT * FROM u",
+			"SELECT secret FROM u",
+			"SELECT v FROM t, u",
+			"SELECT * FROM v",
+			"INSERT INTO u (id) VALUES (1)",
+			"REPLACE INTO t VALUES (1, 2)",
+			"UPDATE t SET v = 1",
+			"UPDATE u SET name = 'a' WHERE secret = 1",
+			"DELETE FROM t",
+			"DROP TABLE t",
+			"SHOW CREATE TABLE v",
+			"SELECT * FROM t; DELETE FROM t",
+			"not a query",
+			"SELECT secret AS secret FROM u",
+			"SELECT 1 AS secret FROM u WHERE secret LIKE 'a%'",
+			"SELECT id AS secret FROM u GROUP BY secret",
+			"SELECT id AS n FROM u ORDER BY n + secret",
+			"INSERT INTO t VALUES (1, 2) ON DUPLICATE KEY UPDATE v = 3",
+			"DELETE FROM t WHERE id IN (SELECT id FROM d)",
+			"DELETE FROM d WHERE id IN (SELECT x.secret FROM u AS x)",
+			"UPDATE t SET v = (SELECT d.v FROM d)",
+			"UPDATE u SET secret = (SELECT t.v FROM t)",
+		}
+		for _, q := range denied {
+			err := check(q)
+			So(err, ShouldNotBeNil)
+			So(errors.Cause(err), ShouldEqual, ErrPermissionDeny)
+		}
+	})
+	Convey("check upserts against table grants", t, func() {
+		perm := types.UserPermissionFromRole(types.ReadWrite)
+		perm.Grants = []types.TableGrant{
+			{Table: "w", Privileges: types.InsertPrivilege},
+			{Table: "w", Columns: []string{"n"}, Privileges: types.SelectPrivilege | types.UpdatePrivilege},
+		}
+		// the on duplicate key update clause is only built by the mysql dialect
+		check := func(set string) error {
+			stmt, err := sqlparser.Parse("INSERT INTO w (id, n) VALUES (1, 2)")
+			So(err, ShouldBeNil)
+			update, err := sqlparser.Parse("UPDATE w SET " + set)
+			So(err, ShouldBeNil)
+			stmt.(*sqlparser.Insert).OnDup = sqlparser.OnDup(update.(*sqlparser.Update).Exprs)
+			return checkStatementGrants(perm, stmt)
+		}
+		So(check("n = n + 1"), ShouldBeNil)
+		for _, set := range []string{"id = 3", "n = id"} {
+			err := check(set)
+			So(err, ShouldNotBeNil)
+			So(errors.Cause(err), ShouldEqual, ErrPermissionDeny)
+		}
+	})
+}
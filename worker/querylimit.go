@@ -0,0 +1,73 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"sync"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// queryLimiter holds the execution limits of the read queries of database users. Limits set by
+// the database admin are capped by the miner defaults, so a database can't lift the limits
+// protecting the other databases on the same miner.
+type queryLimiter struct {
+	sync.RWMutex
+	defaults types.QueryLimitConfig
+	configs  map[proto.DatabaseID]*types.QueryLimitConfig
+}
+
+func newQueryLimiter(defaults types.QueryLimitConfig) *queryLimiter {
+	return &queryLimiter{
+		defaults: defaults,
+		configs:  make(map[proto.DatabaseID]*types.QueryLimitConfig),
+	}
+}
+
+// limit returns the effective query limits of the user.
+func (l *queryLimiter) limit(dbID proto.DatabaseID, user proto.AccountAddress) types.QueryLimit {
+	l.RLock()
+	defer l.RUnlock()
+	limit := l.defaults.UserLimit(user)
+	if cfg, ok := l.configs[dbID]; ok {
+		limit = limit.Min(cfg.UserLimit(user))
+	}
+	return limit
+}
+
+// setConfig sets the query limits of database.
+func (l *queryLimiter) setConfig(dbID proto.DatabaseID, cfg *types.QueryLimitConfig) {
+	l.Lock()
+	defer l.Unlock()
+	l.configs[dbID] = cfg
+}
+
+// removeDatabase removes the query limits of database.
+func (l *queryLimiter) removeDatabase(dbID proto.DatabaseID) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.configs, dbID)
+}
+
+// getConfig returns the query limits set by the database admin.
+func (l *queryLimiter) getConfig(dbID proto.DatabaseID) (cfg *types.QueryLimitConfig, ok bool) {
+	l.RLock()
+	defer l.RUnlock()
+	cfg, ok = l.configs[dbID]
+	return
+}
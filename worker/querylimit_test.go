@@ -0,0 +1,66 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"testing"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestQueryLimiter(t *testing.T) {
+	Convey("query limiter should apply the stricter limits", t, func() {
+		var user1, user2 proto.AccountAddress
+		user1[0], user2[0] = 1, 2
+		l := newQueryLimiter(types.QueryLimitConfig{
+			Default: types.QueryLimit{Timeout: 1000, MaxRows: 100},
+		})
+
+		So(l.limit("db", user1), ShouldResemble, types.QueryLimit{Timeout: 1000, MaxRows: 100})
+
+		// database config could not lift the miner defaults
+		l.setConfig("db", &types.QueryLimitConfig{
+			Default: types.QueryLimit{Timeout: 5000, MaxBytes: 1024},
+			Users: []types.UserQueryLimit{
+				{User: user1, Limit: types.QueryLimit{MaxRows: 10, MaxVMSteps: 10000}},
+			},
+		})
+		So(l.limit("db", user1), ShouldResemble,
+			types.QueryLimit{Timeout: 1000, MaxRows: 10, MaxVMSteps: 10000})
+		So(l.limit("db", user2), ShouldResemble,
+			types.QueryLimit{Timeout: 1000, MaxRows: 100, MaxBytes: 1024})
+		So(l.limit("db2", user1), ShouldResemble, types.QueryLimit{Timeout: 1000, MaxRows: 100})
+
+		cfg, ok := l.getConfig("db")
+		So(ok, ShouldBeTrue)
+		So(cfg.Users, ShouldHaveLength, 1)
+
+		l.removeDatabase("db")
+		_, ok = l.getConfig("db")
+		So(ok, ShouldBeFalse)
+		So(l.limit("db", user1), ShouldResemble, types.QueryLimit{Timeout: 1000, MaxRows: 100})
+	})
+	Convey("unlimited defaults should be tightened by database config", t, func() {
+		var user proto.AccountAddress
+		l := newQueryLimiter(types.QueryLimitConfig{})
+		So(l.limit("db", user).IsUnlimited(), ShouldBeTrue)
+		l.setConfig("db", &types.QueryLimitConfig{Default: types.QueryLimit{MaxRows: 1}})
+		So(l.limit("db", user), ShouldResemble, types.QueryLimit{MaxRows: 1})
+	})
+}
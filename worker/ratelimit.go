@@ -0,0 +1,190 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/pkg/errors"
+)
+
+// rateLimitKey identifies the token bucket of a user querying a database.
+type rateLimitKey struct {
+	dbID      proto.DatabaseID
+	user      proto.AccountAddress
+	queryType types.QueryType
+}
+
+// tokenBucket implements a token bucket refilled at the rate of limit.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit types.RateLimit, now time.Time) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst == 0 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// take refills the bucket and takes one token from it, returns false if the bucket is empty.
+func (b *tokenBucket) take(now time.Time) bool {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// minRateLimit returns the stricter one of the two rate limits.
+func minRateLimit(a, b types.RateLimit) types.RateLimit {
+	if a.IsUnlimited() {
+		return b
+	}
+	if b.IsUnlimited() {
+		return a
+	}
+	limit := types.RateLimit{Rate: math.Min(a.Rate, b.Rate), Burst: a.Burst}
+	if b.Burst != 0 && (a.Burst == 0 || b.Burst < a.Burst) {
+		limit.Burst = b.Burst
+	}
+	return limit
+}
+
+// shareRateLimit returns the share of the rate limit on each of the n replicas.
+func shareRateLimit(limit types.RateLimit, n int) types.RateLimit {
+	if limit.IsUnlimited() || n <= 1 {
+		return limit
+	}
+	limit.Rate /= float64(n)
+	if limit.Burst > 0 {
+		limit.Burst = uint32(math.Max(1, math.Ceil(float64(limit.Burst)/float64(n))))
+	}
+	return limit
+}
+
+// rateLimiter admits queries of database users with per-user read and write token buckets.
+// Limits set by the database admin are capped by the miner defaults, so a database can't
+// lift the limits protecting the other databases on the same miner. Reads could be served by
+// any miner of the database, so the read limits set by the database admin are shared by the
+// replicas, writes are served by the leader only.
+type rateLimiter struct {
+	sync.Mutex
+	defaults types.RateLimitConfig
+	configs  map[proto.DatabaseID]*types.RateLimitConfig
+	buckets  map[rateLimitKey]*tokenBucket
+}
+
+func newRateLimiter(defaults types.RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		defaults: defaults,
+		configs:  make(map[proto.DatabaseID]*types.RateLimitConfig),
+		buckets:  make(map[rateLimitKey]*tokenBucket),
+	}
+}
+
+// limit returns the effective rate limit of the user on one of the replicas of database, the
+// caller must hold the lock.
+func (l *rateLimiter) limit(dbID proto.DatabaseID,
+	user proto.AccountAddress, queryType types.QueryType, replicas int) types.RateLimit {
+	limit := l.defaults.UserLimit(user, queryType)
+	if cfg, ok := l.configs[dbID]; ok {
+		dbLimit := cfg.UserLimit(user, queryType)
+		if queryType == types.ReadQuery {
+			dbLimit = shareRateLimit(dbLimit, replicas)
+		}
+		limit = minRateLimit(limit, dbLimit)
+	}
+	return limit
+}
+
+// admit takes a token from the bucket of the user, returns ErrRateLimitExceeded if throttled.
+func (l *rateLimiter) admit(dbID proto.DatabaseID,
+	user proto.AccountAddress, queryType types.QueryType, replicas int) (err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	limit := l.limit(dbID, user, queryType, replicas)
+	if limit.IsUnlimited() {
+		return
+	}
+
+	var (
+		now    = time.Now()
+		key    = rateLimitKey{dbID: dbID, user: user, queryType: queryType}
+		bucket = l.buckets[key]
+	)
+	if bucket == nil || bucket.rate != limit.Rate {
+		// the bucket is renewed if the share of limit changes with the replicas
+		bucket = newTokenBucket(limit, now)
+		l.buckets[key] = bucket
+	}
+	if !bucket.take(now) {
+		err = errors.Wrapf(ErrRateLimitExceeded, "%s queries of user %s limited to %.2f/s",
+			queryType.String(), user.String(), limit.Rate)
+	}
+	return
+}
+
+// setConfig sets the rate limits of database and resets the token buckets of its users.
+func (l *rateLimiter) setConfig(dbID proto.DatabaseID, cfg *types.RateLimitConfig) {
+	l.Lock()
+	defer l.Unlock()
+	l.configs[dbID] = cfg
+	l.resetBuckets(dbID)
+}
+
+// removeDatabase removes the rate limits and the token buckets of database.
+func (l *rateLimiter) removeDatabase(dbID proto.DatabaseID) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.configs, dbID)
+	l.resetBuckets(dbID)
+}
+
+func (l *rateLimiter) resetBuckets(dbID proto.DatabaseID) {
+	for key := range l.buckets {
+		if key.dbID == dbID {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// getConfig returns the rate limits set by the database admin.
+func (l *rateLimiter) getConfig(dbID proto.DatabaseID) (cfg *types.RateLimitConfig, ok bool) {
+	l.Lock()
+	defer l.Unlock()
+	cfg, ok = l.configs[dbID]
+	return
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenBucket(t *testing.T) {
+	Convey("token bucket should refill at rate", t, func() {
+		now := time.Now()
+		b := newTokenBucket(types.RateLimit{Rate: 10, Burst: 2}, now)
+		So(b.take(now), ShouldBeTrue)
+		So(b.take(now), ShouldBeTrue)
+		So(b.take(now), ShouldBeFalse)
+		So(b.take(now.Add(50*time.Millisecond)), ShouldBeFalse)
+		So(b.take(now.Add(100*time.Millisecond)), ShouldBeTrue)
+		// refill no more than burst
+		later := now.Add(time.Hour)
+		So(b.take(later), ShouldBeTrue)
+		So(b.take(later), ShouldBeTrue)
+		So(b.take(later), ShouldBeFalse)
+	})
+	Convey("burst should default to the rate", t, func() {
+		So(newTokenBucket(types.RateLimit{Rate: 0.5}, time.Now()).burst, ShouldEqual, 1)
+		So(newTokenBucket(types.RateLimit{Rate: 2.5}, time.Now()).burst, ShouldEqual, 3)
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	Convey("rate limiter should apply the stricter limits", t, func() {
+		var user1, user2 proto.AccountAddress
+		user1[0], user2[0] = 1, 2
+		l := newRateLimiter(types.RateLimitConfig{
+			Read:  types.RateLimit{Rate: 100, Burst: 100},
+			Write: types.RateLimit{Rate: 0.01, Burst: 1},
+		})
+
+		So(l.admit("db", user1, types.WriteQuery, 1), ShouldBeNil)
+		So(errors.Cause(l.admit("db", user1, types.WriteQuery, 1)), ShouldEqual, ErrRateLimitExceeded)
+		// buckets are separated by database and user
+		So(l.admit("db", user2, types.WriteQuery, 1), ShouldBeNil)
+		So(l.admit("db2", user1, types.WriteQuery, 1), ShouldBeNil)
+
+		// database config could not lift the miner defaults
+		l.setConfig("db", &types.RateLimitConfig{
+			Users: []types.UserRateLimit{
+				{User: user1, Read: types.RateLimit{Rate: 0.01, Burst: 1}},
+			},
+		})
+		So(l.limit("db", user1, types.WriteQuery, 1), ShouldResemble, types.RateLimit{Rate: 0.01, Burst: 1})
+		So(l.limit("db", user1, types.ReadQuery, 1), ShouldResemble, types.RateLimit{Rate: 0.01, Burst: 1})
+		So(l.limit("db", user2, types.ReadQuery, 1), ShouldResemble, types.RateLimit{Rate: 100, Burst: 100})
+
+		// buckets are reset by config updates
+		So(l.admit("db", user1, types.WriteQuery, 1), ShouldBeNil)
+		So(l.admit("db", user1, types.ReadQuery, 1), ShouldBeNil)
+		So(errors.Cause(l.admit("db", user1, types.ReadQuery, 1)), ShouldEqual, ErrRateLimitExceeded)
+		So(l.admit("db", user2, types.ReadQuery, 1), ShouldBeNil)
+
+		cfg, ok := l.getConfig("db")
+		So(ok, ShouldBeTrue)
+		So(cfg.Users, ShouldHaveLength, 1)
+
+		l.removeDatabase("db")
+		_, ok = l.getConfig("db")
+		So(ok, ShouldBeFalse)
+		So(l.admit("db", user1, types.ReadQuery, 1), ShouldBeNil)
+	})
+	Convey("read limits of database should be shared by the replicas", t, func() {
+		var user proto.AccountAddress
+		l := newRateLimiter(types.RateLimitConfig{
+			Read:  types.RateLimit{Rate: 100, Burst: 100},
+			Write: types.RateLimit{Rate: 100, Burst: 100},
+		})
+		l.setConfig("db", &types.RateLimitConfig{
+			Read:  types.RateLimit{Rate: 3, Burst: 5},
+			Write: types.RateLimit{Rate: 3, Burst: 5},
+		})
+		So(l.limit("db", user, types.ReadQuery, 3), ShouldResemble, types.RateLimit{Rate: 1, Burst: 2})
+		So(l.limit("db", user, types.WriteQuery, 3), ShouldResemble, types.RateLimit{Rate: 3, Burst: 5})
+		// miner defaults are not shared
+		l.removeDatabase("db")
+		So(l.limit("db", user, types.ReadQuery, 3), ShouldResemble, types.RateLimit{Rate: 100, Burst: 100})
+		So(shareRateLimit(types.RateLimit{Rate: 1}, 4), ShouldResemble, types.RateLimit{Rate: 0.25})
+		So(shareRateLimit(types.RateLimit{Rate: 1, Burst: 1}, 4).Burst, ShouldEqual, 1)
+
+		// buckets are renewed with the share of limit
+		l.setConfig("db", &types.RateLimitConfig{Read: types.RateLimit{Rate: 0.02, Burst: 2}})
+		So(l.admit("db", user, types.ReadQuery, 2), ShouldBeNil)
+		So(errors.Cause(l.admit("db", user, types.ReadQuery, 2)), ShouldEqual, ErrRateLimitExceeded)
+		So(l.admit("db", user, types.ReadQuery, 1), ShouldBeNil)
+	})
+	Convey("unlimited rate limiter should admit all queries", t, func() {
+		l := newRateLimiter(types.RateLimitConfig{})
+		for i := 0; i < 100; i++ {
+			So(l.admit("db", proto.AccountAddress{}, types.ReadQuery, 1), ShouldBeNil)
+		}
+		So(l.buckets, ShouldBeEmpty)
+	})
+}
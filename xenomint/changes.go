@@ -0,0 +1,169 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xenomint
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
+	"github.com/pkg/errors"
+)
+
+// changeLog is the bounded in-memory log of the row changes captured by State, ordered by the
+// log offsets of the write queries.
+type changeLog struct {
+	sync.RWMutex
+	retention int
+	started   bool
+	start     uint64 // changes of the queries before start are not retained
+	changes   []types.RowChange
+}
+
+func newChangeLog(retention int) *changeLog {
+	return &changeLog{retention: retention}
+}
+
+// begin marks the log offset of the first write query when the log is not started yet.
+func (l *changeLog) begin(offset uint64) {
+	l.Lock()
+	defer l.Unlock()
+	if !l.started {
+		l.started, l.start = true, offset
+	}
+}
+
+func (l *changeLog) append(changes []types.RowChange) {
+	if len(changes) == 0 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.changes = append(l.changes, changes...)
+	// Compact the log lazily to amortize the copying, the changes of a query are always dropped
+	// together
+	if len(l.changes) <= l.retention+l.retention/4 {
+		return
+	}
+	var n = len(l.changes) - l.retention
+	for n < len(l.changes) && l.changes[n].LogOffset == l.changes[n-1].LogOffset {
+		n++
+	}
+	l.start = l.changes[n-1].LogOffset + 1
+	l.changes = append([]types.RowChange(nil), l.changes[n:]...)
+}
+
+// fetch returns the changes of the queries from offset, the changes of a single query are never
+// split by limit. Offset 0 fetches from the earliest retained change.
+func (l *changeLog) fetch(offset uint64, limit int) (changes []types.RowChange, next uint64, err error) {
+	l.RLock()
+	defer l.RUnlock()
+	if offset == 0 {
+		offset = l.start
+	}
+	if offset < l.start {
+		err = errors.Wrapf(ErrChangesTruncated, "fetch from %d, retained from %d", offset, l.start)
+		return
+	}
+	var (
+		i = sort.Search(len(l.changes), func(i int) bool { return l.changes[i].LogOffset >= offset })
+		j = i
+	)
+	for j < len(l.changes) && (limit <= 0 || j-i < limit) {
+		var last = l.changes[j].LogOffset
+		for j++; j < len(l.changes) && l.changes[j].LogOffset == last; j++ {
+		}
+	}
+	next = offset
+	if j > i {
+		changes = append([]types.RowChange(nil), l.changes[i:j]...)
+		next = changes[len(changes)-1].LogOffset + 1
+	}
+	return
+}
+
+func convertChanges(offset uint64, captured []xs.Change) (changes []types.RowChange) {
+	changes = make([]types.RowChange, len(captured))
+	for i, v := range captured {
+		changes[i] = types.RowChange{
+			LogOffset:  offset,
+			Table:      v.Table,
+			Op:         types.RowChangeOp(v.Op),
+			Columns:    v.Columns,
+			PrimaryKey: v.PrimaryKey,
+			Key:        v.Key,
+			Old:        v.Old,
+			New:        v.New,
+		}
+	}
+	return
+}
+
+// SetChangeRetention enables the row level change capture of the write queries and retains the
+// latest n changes at least for fetching, n <= 0 disables the capture.
+func (s *State) SetChangeRetention(n int) {
+	s.Lock()
+	defer s.Unlock()
+	if n <= 0 {
+		s.changes = nil
+		return
+	}
+	s.changes = newChangeLog(n)
+}
+
+// FetchChanges returns the row changes of the write queries from the log offset, limit is the
+// max change count except that the changes of a single query are never split. The returned next
+// offset should be used to resume fetching.
+func (s *State) FetchChanges(offset uint64, limit int) (changes []types.RowChange, next uint64, err error) {
+	s.RLock()
+	var l = s.changes
+	s.RUnlock()
+	if l == nil {
+		err = ErrChangeCaptureDisabled
+		return
+	}
+	return l.fetch(offset, limit)
+}
+
+// beginChanges resets the pending changes before executing a write request at offset.
+func (s *State) beginChanges(offset uint64) {
+	s.pending = nil
+	if s.changes != nil {
+		s.changes.begin(offset)
+	}
+}
+
+// commitChanges appends the pending changes of a successfully executed write request to the log.
+func (s *State) commitChanges() {
+	if s.changes != nil {
+		s.changes.append(s.pending)
+	}
+	s.pending = nil
+}
+
+// captureChanges drains the row changes made by the last query on the connection of e into the
+// pending changes of the current request.
+func (s *State) captureChanges(e xs.Querier) (err error) {
+	var captured []xs.Change
+	if captured, err = xs.DrainChanges(context.Background(), e); err != nil {
+		return
+	}
+	s.pending = append(s.pending, convertChanges(s.getSeq(), captured)...)
+	return
+}
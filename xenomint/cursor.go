@@ -0,0 +1,251 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xenomint
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
+)
+
+// Cursor is a server-side cursor of a read query, which keeps the read transaction open and
+// returns the result rows batch by batch. The query limits apply to the whole result set, and the
+// rows and cost of all the batches are accounted in the response header of the cursor.
+type Cursor struct {
+	sync.Mutex
+	tx      *sql.Tx
+	rows    *sql.Rows
+	ctx     context.Context
+	cancel  context.CancelFunc
+	limit   types.QueryLimit
+	limiter *resultLimiter
+	steps   uint64
+	columns int
+	header  types.ResponseHeader
+	closed  bool
+}
+
+// Fetch returns at most n following rows of the cursor, done is set if there are no more rows
+// and the cursor is closed.
+func (c *Cursor) Fetch(n int) (rows []types.ResponseRow, done bool, err error) {
+	c.Lock()
+	defer c.Unlock()
+	var data [][]interface{}
+	data, done, err = c.fetch(n)
+	if !c.closed {
+		c.account(data)
+	}
+	if err != nil || done {
+		c.close()
+	}
+	rows = buildRowsFromNativeData(data)
+	return
+}
+
+// Header returns the response header of the whole cursor, which accounts the rows and the cost of
+// all the batches fetched so far.
+func (c *Cursor) Header() types.ResponseHeader {
+	c.Lock()
+	defer c.Unlock()
+	return c.header
+}
+
+// Close closes the cursor and releases the read transaction.
+func (c *Cursor) Close() (err error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.close()
+}
+
+func (c *Cursor) fetch(n int) (data [][]interface{}, done bool, err error) {
+	if c.closed {
+		err = ErrCursorClosed
+		return
+	}
+	data = make([][]interface{}, 0, n)
+	for len(data) < n {
+		if !c.rows.Next() {
+			done = true
+			err = c.limitError(c.rows.Err())
+			return
+		}
+		var row []interface{}
+		if row, err = scanRow(c.rows, c.columns); err != nil {
+			err = c.limitError(err)
+			return
+		}
+		if err = c.limiter.add(row); err != nil {
+			return
+		}
+		data = append(data, row)
+	}
+	return
+}
+
+// account adds the fetched rows to the response header of the cursor.
+func (c *Cursor) account(data [][]interface{}) {
+	c.header.RowCount += uint64(len(data))
+	c.header.Cost.RowsRead += uint64(len(data))
+	c.header.Cost.BytesReturned += payloadSize(data)
+	if steps, err := c.vmSteps(context.Background()); err == nil {
+		c.header.Cost.VMSteps = steps
+	}
+}
+
+// vmSteps returns the vm steps consumed by the cursor.
+func (c *Cursor) vmSteps(ctx context.Context) (steps uint64, err error) {
+	if steps, err = readVMSteps(ctx, c.tx); err == nil {
+		steps -= c.steps
+	}
+	return
+}
+
+func (c *Cursor) limitError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var steps uint64
+	if c.limit.MaxVMSteps > 0 {
+		steps, _ = c.vmSteps(context.Background())
+	}
+	return queryLimitError(c.ctx, c.limit, steps, err)
+}
+
+func (c *Cursor) close() (err error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.rows != nil {
+		c.rows.Close()
+	}
+	if c.limit.MaxVMSteps > 0 {
+		// clear the budget before the connection is released
+		xs.SetVMStepBudget(context.Background(), c.tx, 0)
+	}
+	// clear the query context before the connection is released
+	xs.ClearQueryContext(context.Background(), c.tx)
+	c.cancel()
+	return c.tx.Rollback()
+}
+
+// OpenCursor runs the single read query of req in a server-side cursor, and returns at most
+// batch rows in resp. The returned cursor is nil if all the rows are returned in resp, otherwise
+// the caller should fetch the following rows from the cursor and close it after use.
+//
+// The cursor reads a snapshot of the state in its own transaction, so the query limits in ctx
+// apply from the opening of the cursor until it's closed. The cost in resp only accounts the first
+// batch, while the header of the cursor accounts the whole result set.
+func (s *State) OpenCursor(ctx context.Context, req *types.Request, batch int) (
+	ref *QueryTracker, resp *types.Response, cur *Cursor, err error,
+) {
+	if req.Header.QueryType != types.ReadQuery || len(req.Payload.Queries) != 1 || batch <= 0 {
+		err = errors.Wrap(ErrInvalidRequest, "cursor requires a single read query")
+		return
+	}
+	if err = s.checkStaleness(req); err != nil {
+		return
+	}
+	if s.level == sql.LevelReadUncommitted && atomic.LoadUint32(&s.hasSchemaChange) == 1 {
+		// uncommitted schema changes are only visible to the executer, read the whole result
+		ref, resp, err = s.readTx(ctx, req)
+		return
+	}
+
+	var (
+		id    = s.getSeq()
+		limit = queryLimitFromContext(ctx)
+		c     = &Cursor{limit: limit, limiter: newResultLimiter(limit)}
+		names []string
+		decls []string
+		data  [][]interface{}
+		done  bool
+		cost  types.QueryCost
+	)
+	if c.tx, err = s.reader().Begin(); err != nil {
+		err = errors.Wrap(err, "open tx failed")
+		return
+	}
+	// the cursor outlives the request, so the timeout starts from the opening of the cursor
+	c.ctx, c.cancel = limitedQueryContext(context.Background(), limit)
+	defer func() {
+		if err != nil || done {
+			c.close()
+		}
+	}()
+	if err = setQueryContext(ctx, c.tx, req); err != nil {
+		return
+	}
+	if c.steps, err = readVMSteps(ctx, c.tx); err != nil {
+		return
+	}
+	if limit.MaxVMSteps > 0 {
+		if err = xs.SetVMStepBudget(ctx, c.tx, limit.MaxVMSteps); err != nil {
+			err = errors.Wrap(err, "set vm step budget failed")
+			return
+		}
+	}
+	if c.rows, names, decls, err = openRows(
+		c.ctx, c.tx, req.Header.Dialect, &req.Payload.Queries[0],
+	); err != nil {
+		err = errors.Wrap(c.limitError(err), "query at #0 failed")
+		s.pool.setFailed(req)
+		return
+	}
+	c.columns = len(names)
+	if data, done, err = c.fetch(batch); err != nil {
+		err = errors.Wrap(err, "query at #0 failed")
+		s.pool.setFailed(req)
+		return
+	}
+	if cost.VMSteps, err = c.vmSteps(ctx); err != nil {
+		return
+	}
+	cost.RowsRead = uint64(len(data))
+	cost.BytesReturned = payloadSize(data)
+	// Build query response
+	ref = &QueryTracker{Req: req}
+	resp = &types.Response{
+		Header: types.SignedResponseHeader{
+			ResponseHeader: types.ResponseHeader{
+				Request:     req.Header.RequestHeader,
+				RequestHash: req.Header.Hash(),
+				NodeID:      s.nodeID,
+				Timestamp:   s.getLocalTime(),
+				RowCount:    uint64(len(data)),
+				LogOffset:   id,
+				Cost:        cost,
+			},
+		},
+		Payload: types.ResponsePayload{
+			Columns:   names,
+			DeclTypes: decls,
+			Rows:      buildRowsFromNativeData(data),
+		},
+	}
+	if !done {
+		c.header = resp.Header.ResponseHeader
+		cur = c
+	}
+	return
+}
@@ -18,6 +18,8 @@ package xenomint
 
 import (
 	"errors"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
 )
 
 var (
@@ -33,4 +35,16 @@ var (
 	ErrStatefulQueryParts = errors.New("query contains stateful query parts")
 	// ErrInvalidTableName indicates query contains invalid table name in ddl statement.
 	ErrInvalidTableName = errors.New("invalid table name in ddl")
+	// ErrUnsupportedDialectQuery indicates the query can't be translated from its sql dialect.
+	ErrUnsupportedDialectQuery = errors.New("unsupported dialect query")
+	// ErrChangeCaptureDisabled indicates the row level change capture is not enabled.
+	ErrChangeCaptureDisabled = errors.New("change capture disabled")
+	// ErrChangesTruncated indicates the requested row changes are no longer retained.
+	ErrChangesTruncated = errors.New("changes truncated")
+	// ErrCursorClosed indicates the cursor is already closed.
+	ErrCursorClosed = errors.New("cursor closed")
+	// ErrStaleRead indicates the state lags behind the min log offset required by the read query.
+	ErrStaleRead = types.ErrStaleRead
+	// ErrStateWritten indicates the state to be seeded has already executed write queries.
+	ErrStateWritten = errors.New("state already written")
 )
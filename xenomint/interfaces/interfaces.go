@@ -17,14 +17,20 @@
 package interfaces
 
 import (
+	"context"
 	"database/sql"
 )
 
 // Storage is the interface implemented by an object that returns standard *sql.DB as DirtyReader,
-// Reader, or Writer and can be closed by Close.
+// Reader, or Writer, copies its content from or to a standalone database file by Backup and
+// Restore, and can be closed by Close.
 type Storage interface {
 	DirtyReader() *sql.DB
 	Reader() *sql.DB
 	Writer() *sql.DB
+	// Backup copies the database content visible to conn to the file at path.
+	Backup(ctx context.Context, conn *sql.Conn, path string) error
+	// Restore replaces the database content with the file at path written by Backup.
+	Restore(ctx context.Context, path string) error
 	Close() error
 }
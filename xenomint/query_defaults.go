@@ -0,0 +1,240 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xenomint
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/CovenantSQL/sqlparser"
+	"github.com/pkg/errors"
+)
+
+// columnDefault defines a table column with its default value expression, such as
+// CURRENT_TIMESTAMP, the expression is empty if the column has no default value.
+type columnDefault struct {
+	name string
+	expr string
+}
+
+// defaultsResolver looks up the columns of table with their default values, no columns are
+// returned if table does not exist.
+type defaultsResolver func(table string) (defaults []columnDefault, err error)
+
+// newDefaultsResolver returns the resolver looking up the table schema with qer.
+func newDefaultsResolver(ctx context.Context, qer contextQuerier) defaultsResolver {
+	return func(table string) (defaults []columnDefault, err error) {
+		var rows *sql.Rows
+		if rows, err = qer.QueryContext(ctx,
+			`SELECT name, dflt_value FROM pragma_table_info(?)`, table,
+		); err != nil {
+			err = errors.Wrapf(err, "look up column defaults of table %s", table)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				name string
+				expr sql.NullString
+			)
+			if err = rows.Scan(&name, &expr); err != nil {
+				return
+			}
+			defaults = append(defaults, columnDefault{name: name, expr: expr.String})
+		}
+		err = rows.Err()
+		return
+	}
+}
+
+// isStatefulDefault returns whether the default value expression would be rewritten to the
+// deterministic functions.
+func isStatefulDefault(expr string) bool {
+	rewritten, err := rewriteStatefulQueryParts(expr, false)
+	return err != nil || rewritten != expr
+}
+
+// tableSpecDefaults returns the columns with stateful default values of the table created by stmt.
+func tableSpecDefaults(stmt *sqlparser.DDL) (defaults []columnDefault) {
+	if stmt.TableSpec == nil {
+		return
+	}
+	for _, c := range stmt.TableSpec.Columns {
+		if c == nil || c.Type.Default == nil || c.Type.Default.Type != sqlparser.ValArg {
+			continue
+		}
+		if expr := string(c.Type.Default.Val); isStatefulDefault(expr) {
+			defaults = append(defaults, columnDefault{name: c.Name.String(), expr: expr})
+		}
+	}
+	return
+}
+
+// appendStatefulDefaults appends the omitted columns of the insert statement which have stateful
+// default values to query, with the default value expressions as the explicit column values.
+//
+// The stateful default values are kept as is in the table schema, so that the database file stays
+// usable by the other SQLite tools, while the explicit values are rewritten to the deterministic
+// functions like the other parts of the query.
+func appendStatefulDefaults(
+	query string, stmt *sqlparser.Insert, defaults []columnDefault,
+) (rewritten string, err error) {
+	rewritten = query
+	if len(stmt.Columns) == 0 {
+		// all the columns are given explicitly
+		return
+	}
+
+	var cols, vals string
+	for _, d := range defaults {
+		if !isStatefulDefault(d.expr) {
+			continue
+		}
+		if stmt.Columns.FindColumn(sqlparser.NewColIdent(d.name)) < 0 {
+			cols += ", " + quoteIdentifier(d.name)
+			vals += ", " + d.expr
+		}
+	}
+	if cols == "" {
+		return
+	}
+
+	// locate the column list following the table name
+	var (
+		tokens = scanQueryTokens(query)
+		i      int
+	)
+	for i < len(tokens) && tokens[i].lowered() != "into" {
+		i++
+	}
+	// skip the table name, which may be qualified by the schema name
+	for i += 2; i+1 < len(tokens) && tokens[i].typ == '.'; {
+		i += 2
+	}
+	if i >= len(tokens) || tokens[i].typ != '(' {
+		err = errors.Wrapf(ErrStatefulQueryParts, "unrecognized column list in %s", query)
+		return
+	}
+	end := matchParen(tokens, i)
+	if end < 0 {
+		err = errors.Wrapf(ErrStatefulQueryParts, "unrecognized column list in %s", query)
+		return
+	}
+	edits := []queryEdit{{start: tokens[end].start, end: tokens[end].start, with: cols}}
+
+	switch rows := stmt.Rows.(type) {
+	case sqlparser.Values:
+		var n int
+		for j := end + 1; j < len(tokens) && n < len(rows); j++ {
+			if tokens[j].typ != '(' {
+				continue
+			}
+			if j = matchParen(tokens, j); j < 0 {
+				break
+			}
+			edits = append(edits, queryEdit{start: tokens[j].start, end: tokens[j].start, with: vals})
+			n++
+		}
+		if n != len(rows) {
+			err = errors.Wrapf(ErrStatefulQueryParts, "unrecognized values in %s", query)
+			return
+		}
+	default:
+		// wrap the select statement, which ends before the ON DUPLICATE KEY UPDATE clause if any
+		if end+1 >= len(tokens) {
+			err = errors.Wrapf(ErrStatefulQueryParts, "unrecognized select in %s", query)
+			return
+		}
+		start, stop, depth := tokens[end+1].start, len(query), 0
+		for j := end + 1; j+1 < len(tokens); j++ {
+			switch tokens[j].typ {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			if depth == 0 && tokens[j].lowered() == "on" && tokens[j+1].lowered() == "duplicate" {
+				stop = tokens[j].start
+				break
+			}
+		}
+		edits = append(edits,
+			queryEdit{start: start, end: start, with: "SELECT *" + vals + " FROM ("},
+			queryEdit{start: stop, end: stop, with: ") "},
+		)
+	}
+
+	rewritten = strings.TrimRight(applyQueryEdits(query, edits), " ")
+	return
+}
+
+// expandDefaultValues expands the DEFAULT VALUES clauses of the insert statements in query to the
+// explicit column lists, with the default value expressions of all the columns as the values.
+//
+// The expanded values are rewritten to the deterministic functions like the other parts of the
+// query, as the stateful default values would be evaluated by each replica otherwise.
+func expandDefaultValues(query string, defaults defaultsResolver) (rewritten string, err error) {
+	var (
+		tokens = scanQueryTokens(query)
+		edits  []queryEdit
+	)
+	for i := 1; i+1 < len(tokens); i++ {
+		if tokens[i].typ != sqlparser.DEFAULT || tokens[i+1].typ != sqlparser.VALUES {
+			continue
+		}
+		// locate INTO preceding the table name, which may be qualified by the schema name
+		table, j := &tokens[i-1], i-2
+		if j > 0 && tokens[j].typ == '.' {
+			j -= 2
+		}
+		if j < 0 || tokens[j].typ != sqlparser.INTO {
+			err = errors.Wrapf(ErrStatefulQueryParts, "unrecognized default values in %s", query)
+			return
+		}
+
+		var cols []columnDefault
+		if cols, err = defaults(string(table.val)); err != nil {
+			return
+		}
+		if len(cols) == 0 {
+			err = errors.Wrapf(ErrStatefulQueryParts, "default values of unknown table %s", table.val)
+			return
+		}
+		names, vals := make([]string, len(cols)), make([]string, len(cols))
+		for k, c := range cols {
+			// the column list is parsed with the other parts of the query, which takes the double
+			// quoted names as strings
+			names[k], vals[k] = "`"+strings.Replace(c.name, "`", "``", -1)+"`", c.expr
+			if vals[k] == "" {
+				vals[k] = "NULL"
+			}
+		}
+		edits = append(edits, queryEdit{
+			start: tokens[i].start,
+			end:   tokens[i+1].end,
+			with:  "(" + strings.Join(names, ", ") + ") VALUES (" + strings.Join(vals, ", ") + ")",
+		})
+		i++
+	}
+	rewritten = applyQueryEdits(query, edits)
+	return
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
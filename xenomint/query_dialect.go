@@ -0,0 +1,729 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xenomint
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/sqlparser"
+	"github.com/pkg/errors"
+)
+
+const (
+	// mysqlDescribeQuery lists the table columns in the format of the MySQL DESCRIBE statement.
+	mysqlDescribeQuery = `SELECT name AS "Field", type AS "Type",
+	CASE WHEN "notnull" THEN 'NO' ELSE 'YES' END AS "Null",
+	CASE WHEN pk > 0 THEN 'PRI' ELSE '' END AS "Key",
+	dflt_value AS "Default",
+	CASE WHEN pk = 1 AND upper(type) = 'INTEGER'
+		AND (SELECT count(*) FROM pragma_table_info(%[1]s) WHERE pk > 0) = 1
+		THEN 'auto_increment' ELSE '' END AS "Extra"
+FROM pragma_table_info(%[1]s)`
+	// mysqlShowDatabasesQuery lists the schema of the database.
+	mysqlShowDatabasesQuery = "SELECT 'main' AS `Database`"
+)
+
+var (
+	// MySQL column types which are not understood by SQLite or fall into the wrong type affinity,
+	// other types are kept as is
+	mysqlColumnTypeMap = map[string]string{
+		"bit":                "INTEGER",
+		"bool":               "BOOLEAN",
+		"boolean":            "BOOLEAN",
+		"year":               "INTEGER",
+		"enum":               "TEXT",
+		"set":                "TEXT",
+		"json":               "TEXT",
+		"binary":             "BLOB",
+		"varbinary":          "BLOB",
+		"geometry":           "BLOB",
+		"point":              "BLOB",
+		"linestring":         "BLOB",
+		"polygon":            "BLOB",
+		"multipoint":         "BLOB",
+		"multilinestring":    "BLOB",
+		"multipolygon":       "BLOB",
+		"geometrycollection": "BLOB",
+	}
+
+	// keywords which end the LIMIT clause of a statement
+	mysqlLimitEndMap = map[string]bool{
+		"on":        true,
+		"union":     true,
+		"for":       true,
+		"lock":      true,
+		"into":      true,
+		"except":    true,
+		"intersect": true,
+	}
+)
+
+// queryDialect translates the queries written in a foreign sql dialect to SQLite.
+type queryDialect interface {
+	// translate rewrites query to SQLite statements which can be parsed by sqlparser, the SQLite
+	// clauses sqlparser doesn't understand are returned by statement index.
+	translate(query string) (translated string, clauses map[int]*dialectClause, err error)
+	// translateShow rewrites the show statement stmt parsed from query.
+	translateShow(stmt *sqlparser.Show, query string) (translated string, ok bool)
+}
+
+// dialectClause defines a translated SQLite clause which is appended to its statement after
+// the statement is sanitized.
+type dialectClause struct {
+	clause string
+	// nodes are the expressions of the clause to sanitize
+	nodes []sqlparser.SQLNode
+}
+
+// contextQuerier defines the querier to look up the database schema for query translation.
+type contextQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// newQueryDialect returns the translator of the sql dialect d, or nil for the native SQLite.
+func newQueryDialect(ctx context.Context, qer contextQuerier, d types.QueryDialect) queryDialect {
+	switch d {
+	case types.MySQLDialect:
+		return &mysqlDialect{ctx: ctx, qer: qer}
+	default:
+		return nil
+	}
+}
+
+// mysqlDialect translates the common MySQL syntax to SQLite, including:
+//
+//   - double quoted and backslash escaped string literals, and # comments,
+//   - column types, AUTO_INCREMENT column, inline indexes and table options of CREATE TABLE,
+//   - INSERT ... ON DUPLICATE KEY UPDATE to the SQLite UPSERT,
+//   - LIMIT offset, count,
+//   - DESCRIBE table, SHOW COLUMNS and SHOW DATABASES.
+type mysqlDialect struct {
+	ctx context.Context
+	qer contextQuerier
+}
+
+func (d *mysqlDialect) translate(query string) (
+	translated string, clauses map[int]*dialectClause, err error,
+) {
+	var (
+		tokenizer = sqlparser.NewStringTokenizer(query)
+		tokens    []queryToken
+		edits     []queryEdit
+		begin     int
+		index     int
+	)
+	tokenizer.AllowBackSlashEscape = true
+	tokens = scanTokens(query, tokenizer)
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && tokens[i].typ != ';' {
+			continue
+		}
+		if stmt := tokens[begin:i]; len(stmt) > 0 {
+			var (
+				parts  []string
+				clause *dialectClause
+				start  = stmt[0].start
+				end    = stmt[len(stmt)-1].end
+			)
+			if parts, clause, err = d.translateStatement(query, stmt); err != nil {
+				err = errors.Wrapf(err, "translate mysql query failed: %s", query[start:end])
+				return
+			}
+			if clause != nil {
+				if clauses == nil {
+					clauses = make(map[int]*dialectClause)
+				}
+				clauses[index] = clause
+			}
+			index += len(parts)
+			if with := strings.Join(parts, "; "); with != query[start:end] {
+				edits = append(edits, queryEdit{start: start, end: end, with: with})
+			}
+		}
+		begin = i + 1
+	}
+	translated = applyQueryEdits(query, edits)
+	return
+}
+
+func (d *mysqlDialect) translateShow(stmt *sqlparser.Show, query string) (translated string, ok bool) {
+	if stmt.Type != "table" || stmt.ShowCreate {
+		return
+	}
+	// the native SHOW TABLE statement keeps the output of table_info pragma
+	tokens := scanQueryTokens(query)
+	for len(tokens) > 0 && tokens[0].typ == sqlparser.COMMENT {
+		tokens = tokens[1:]
+	}
+	if len(tokens) < 2 {
+		return
+	}
+	switch tokens[0].lowered() {
+	case "desc", "describe":
+	case "show":
+		if tokens = skipTokens(query, tokens[1:], "full"); len(tokens) == 0 ||
+			tokens[0].lowered() != "columns" {
+			return
+		}
+	default:
+		return
+	}
+	return fmt.Sprintf(mysqlDescribeQuery, quoteSQLString(stmt.OnTable.Name.String())), true
+}
+
+func (d *mysqlDialect) translateStatement(query string, tokens []queryToken) (
+	parts []string, clause *dialectClause, err error,
+) {
+	// skip the leading comments
+	head := tokens
+	for len(head) > 0 && head[0].typ == sqlparser.COMMENT {
+		head = head[1:]
+	}
+	if len(head) > 1 {
+		switch head[0].lowered() {
+		case "show":
+			if name := head[1].lowered(); len(head) == 2 && (name == "databases" || name == "schemas") {
+				parts = []string{mysqlShowDatabasesQuery}
+				return
+			}
+		case "create":
+			if tableTokens := skipTokens(query, head[1:], "temporary"); len(tableTokens) > 0 &&
+				tableTokens[0].lowered() == "table" {
+				parts, err = d.translateCreateTable(query, tokens)
+				return
+			}
+		case "insert":
+			for i := range tokens {
+				if i+3 < len(tokens) && mysqlKeyword(query, &tokens[i]) == "on" &&
+					tokens[i+1].lowered() == "duplicate" && tokens[i+2].lowered() == "key" &&
+					tokens[i+3].lowered() == "update" {
+					var stmt string
+					if stmt, clause, err = d.translateUpsert(query, tokens[:i], tokens[i+4:]); err != nil {
+						return
+					}
+					parts = []string{stmt}
+					return
+				}
+			}
+		}
+	}
+	parts = []string{renderMySQLTokens(query, tokens, false)}
+	return
+}
+
+// translateCreateTable translates the CREATE TABLE statement, the secondary indexes defined in
+// the table are created by the following CREATE INDEX statements.
+func (d *mysqlDialect) translateCreateTable(query string, tokens []queryToken) (parts []string, err error) {
+	var lparen, rparen = -1, -1
+	for i := range tokens {
+		if tokens[i].typ == '(' {
+			lparen, rparen = i, matchParen(tokens, i)
+			break
+		}
+	}
+	if lparen < 1 || rparen < 0 {
+		// CREATE TABLE ... AS SELECT or CREATE TABLE ... LIKE
+		parts = []string{renderMySQLTokens(query, tokens, false)}
+		return
+	}
+
+	var (
+		head        = renderMySQLTokens(query, tokens[:lparen], false)
+		table       = mysqlTokenText(query, &tokens[lparen-1])
+		ifNotExists = strings.Contains(strings.ToLower(head), "not exists")
+		defs        [][]queryToken
+		primaryKey  []string
+		primaryDef  = -1
+		autoColumn  string
+	)
+	// split definitions
+	for i, begin := lparen+1, lparen+1; i <= rparen; i++ {
+		switch tokens[i].typ {
+		case '(':
+			i = matchParen(tokens, i)
+		case ',', ')':
+			if i > begin {
+				defs = append(defs, tokens[begin:i])
+			}
+			begin = i + 1
+		}
+	}
+	// find primary key and auto increment column
+	for i, def := range defs {
+		if def = skipConstraintName(query, def); len(def) > 1 && mysqlKeyword(query, &def[0]) == "primary" {
+			primaryKey, primaryDef = indexColumnNames(def), i
+		}
+	}
+	for _, def := range defs {
+		var isPrimary bool
+		for i := range def {
+			switch mysqlKeyword(query, &def[i]) {
+			case "auto_increment":
+				autoColumn = string(def[0].val)
+			case "primary":
+				isPrimary = true
+			case "key":
+				isPrimary = isPrimary || (i > 0 && mysqlKeyword(query, &def[i-1]) != "unique")
+			}
+		}
+		if autoColumn != "" {
+			if primaryDef < 0 && isPrimary {
+				primaryKey = []string{autoColumn}
+			}
+			break
+		}
+	}
+	if autoColumn != "" && (len(primaryKey) != 1 || !strings.EqualFold(primaryKey[0], autoColumn)) {
+		err = errors.Wrapf(ErrUnsupportedDialectQuery,
+			"auto increment column %s must be the single primary key", autoColumn)
+		return
+	}
+
+	var columns []string
+	for i, def := range defs {
+		keyDef := skipConstraintName(query, def)
+		if len(keyDef) == 0 {
+			err = errors.Wrapf(ErrUnsupportedDialectQuery, "invalid constraint definition #%d", i)
+			return
+		}
+		switch mysqlKeyword(query, &keyDef[0]) {
+		case "primary":
+			if autoColumn == "" {
+				columns = append(columns, renderMySQLPrimaryKey(query, def[:len(def)-len(keyDef)], primaryKey))
+			}
+			continue
+		case "unique", "key", "index", "fulltext", "spatial":
+			var (
+				unique = keyDef[0].lowered() == "unique"
+				name   string
+			)
+			keyDef = skipTokens(query, keyDef, "unique", "fulltext", "spatial", "key", "index")
+			if len(keyDef) > 0 && keyDef[0].typ != '(' && mysqlKeyword(query, &keyDef[0]) != "using" {
+				name = mysqlTokenText(query, &keyDef[0])
+			} else if len(def) > 2 && mysqlKeyword(query, &def[0]) == "constraint" &&
+				mysqlKeyword(query, &def[1]) != "unique" {
+				name = mysqlTokenText(query, &def[1])
+			}
+			cols := indexColumnNames(keyDef)
+			if len(cols) == 0 {
+				err = errors.Wrapf(ErrUnsupportedDialectQuery, "invalid index definition #%d", i)
+				return
+			}
+			if name == "" {
+				if unique {
+					columns = append(columns, "UNIQUE ("+quoteMySQLIdentifiers(cols)+")")
+					continue
+				}
+				name = quoteMySQLIdentifier(cols[0])
+			}
+			stmt := "CREATE INDEX "
+			if unique {
+				stmt = "CREATE UNIQUE INDEX "
+			}
+			if ifNotExists {
+				stmt += "IF NOT EXISTS "
+			}
+			parts = append(parts, stmt+name+" ON "+table+" ("+quoteMySQLIdentifiers(cols)+")")
+			continue
+		case "foreign", "check", "constraint":
+			columns = append(columns, renderMySQLTokens(query, def, false))
+			continue
+		}
+		var column string
+		if column, err = translateMySQLColumn(query, def, autoColumn); err != nil {
+			return
+		}
+		columns = append(columns, column)
+	}
+
+	parts = append([]string{head + " (" + strings.Join(columns, ", ") + ")"}, parts...)
+	return
+}
+
+// translateMySQLColumn translates the column definition def, an AUTO_INCREMENT column is
+// translated to the SQLite INTEGER PRIMARY KEY AUTOINCREMENT column.
+func translateMySQLColumn(query string, def []queryToken, autoColumn string) (column string, err error) {
+	var (
+		name     = mysqlTokenText(query, &def[0])
+		typ      string
+		typeArgs string
+		auto     = autoColumn != "" && strings.EqualFold(string(def[0].val), autoColumn)
+		items    []string
+		i        = 1
+	)
+	if len(def) < 2 {
+		err = errors.Wrapf(ErrUnsupportedDialectQuery, "missing type of column %s", name)
+		return
+	}
+	typ = query[def[1].start:def[1].end]
+	if i++; i < len(def) && strings.EqualFold(typ, "double") && def[i].lowered() == "precision" {
+		typ, i = typ+" "+query[def[i].start:def[i].end], i+1
+	}
+	if i < len(def) && def[i].typ == '(' {
+		end := matchParen(def, i)
+		if end < 0 {
+			err = errors.Wrapf(ErrUnsupportedDialectQuery, "invalid type of column %s", name)
+			return
+		}
+		typeArgs, i = renderMySQLTokens(query, def[i:end+1], false), end+1
+	}
+	if mapped, ok := mysqlColumnTypeMap[strings.ToLower(typ)]; ok {
+		typ, typeArgs = mapped, ""
+	}
+	if auto {
+		typ, typeArgs = "INTEGER", ""
+		items = append(items, "PRIMARY KEY AUTOINCREMENT")
+	}
+	items = append([]string{name, typ + typeArgs}, items...)
+
+	for ; i < len(def); i++ {
+		switch mysqlKeyword(query, &def[i]) {
+		case "unsigned", "signed", "zerofill", "auto_increment":
+		case "character", "charset", "collate", "comment":
+			// the column charset, collation and comment are dropped
+			if def[i].lowered() == "character" {
+				i++
+			}
+			i++
+		case "on":
+			// ON UPDATE CURRENT_TIMESTAMP is dropped
+			if i+2 < len(def) && def[i+1].lowered() == "update" {
+				if i += 2; i+1 < len(def) && def[i+1].typ == '(' {
+					i = matchParen(def, i+1)
+				}
+				continue
+			}
+			items = append(items, mysqlTokenText(query, &def[i]))
+		case "primary":
+			// PRIMARY KEY
+			i++
+			if !auto {
+				items = append(items, "PRIMARY KEY")
+			}
+		case "key":
+			// KEY of column is the synonym of PRIMARY KEY
+			if !auto {
+				items = append(items, "PRIMARY KEY")
+			}
+		case "unique":
+			if i+1 < len(def) && def[i+1].lowered() == "key" {
+				i++
+			}
+			items = append(items, "UNIQUE")
+		default:
+			if def[i].typ == '(' {
+				end := matchParen(def, i)
+				if end < 0 {
+					end = len(def) - 1
+				}
+				items = append(items, renderMySQLTokens(query, def[i:end+1], false))
+				i = end
+				continue
+			}
+			items = append(items, mysqlTokenText(query, &def[i]))
+		}
+	}
+
+	column = strings.Join(items, " ")
+	return
+}
+
+// translateUpsert translates the INSERT ... ON DUPLICATE KEY UPDATE statement to the SQLite UPSERT,
+// the conflict target is the first primary or unique key covered by the inserted columns.
+func (d *mysqlDialect) translateUpsert(query string, insert, updates []queryToken) (
+	stmt string, clause *dialectClause, err error,
+) {
+	var (
+		parsed sqlparser.Statement
+		ins    *sqlparser.Insert
+		ok     bool
+		keys   [][]string
+		target []string
+	)
+	if len(insert) == 0 || len(updates) == 0 {
+		err = errors.Wrap(ErrUnsupportedDialectQuery, "invalid on duplicate key update clause")
+		return
+	}
+	stmt = renderMySQLTokens(query, insert, false)
+	if parsed, err = sqlparser.Parse(stmt); err != nil {
+		return
+	}
+	if ins, ok = parsed.(*sqlparser.Insert); !ok || ins.Action != sqlparser.InsertStr {
+		err = errors.Wrap(ErrUnsupportedDialectQuery, "on duplicate key update of non-insert statement")
+		return
+	}
+	if keys, err = d.uniqueKeys(ins.Table.Name.String()); err != nil || len(keys) == 0 {
+		// nothing conflicts without unique keys
+		return
+	}
+	target = keys[0]
+	if len(ins.Columns) > 0 {
+		inserted := make(map[string]bool)
+		for _, c := range ins.Columns {
+			inserted[c.Lowered()] = true
+		}
+	findKey:
+		for _, key := range keys {
+			for _, c := range key {
+				if !inserted[strings.ToLower(c)] {
+					continue findKey
+				}
+			}
+			target = key
+			break
+		}
+	}
+	if sel, ok := ins.Rows.(*sqlparser.Select); ok && sel.Where == nil && sel.GroupBy == nil &&
+		sel.Having == nil && sel.OrderBy == nil && sel.Limit == nil {
+		// a WHERE clause is required to avoid parsing ambiguity of INSERT ... SELECT upsert
+		stmt += " WHERE 1"
+	}
+
+	var (
+		set    = renderMySQLTokens(query, updates, true)
+		update sqlparser.Statement
+	)
+	if update, err = sqlparser.Parse("UPDATE " + sqlparser.String(ins.Table) + " SET " + set); err != nil {
+		return
+	}
+	clause = &dialectClause{
+		clause: " ON CONFLICT (" + quoteMySQLIdentifiers(target) + ") DO UPDATE SET " + set,
+		nodes:  []sqlparser.SQLNode{update.(*sqlparser.Update).Exprs},
+	}
+	return
+}
+
+// uniqueKeys returns the primary key and unique index columns of table.
+func (d *mysqlDialect) uniqueKeys(table string) (keys [][]string, err error) {
+	var pk []string
+	if pk, err = d.queryNames(
+		`SELECT name FROM pragma_table_info(?) WHERE pk > 0 ORDER BY pk`, table); err != nil {
+		return
+	}
+	if len(pk) > 0 {
+		keys = append(keys, pk)
+	}
+	var indexes []string
+	if indexes, err = d.queryNames(
+		`SELECT name FROM pragma_index_list(?) WHERE "unique" AND origin <> 'pk' ORDER BY seq`,
+		table); err != nil {
+		return
+	}
+	for _, index := range indexes {
+		var cols []string
+		if cols, err = d.queryNames(
+			`SELECT name FROM pragma_index_info(?) ORDER BY seqno`, index); err != nil {
+			return
+		}
+		if len(cols) > 0 {
+			keys = append(keys, cols)
+		}
+	}
+	return
+}
+
+func (d *mysqlDialect) queryNames(query string, args ...interface{}) (names []string, err error) {
+	if d.qer == nil {
+		err = errors.Wrap(ErrUnsupportedDialectQuery, "schema lookup not available")
+		return
+	}
+	var rows *sql.Rows
+	if rows, err = d.qer.QueryContext(d.ctx, query, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name sql.NullString
+		if err = rows.Scan(&name); err != nil {
+			return
+		}
+		if !name.Valid {
+			// index on expressions
+			return nil, nil
+		}
+		names = append(names, name.String)
+	}
+	err = rows.Err()
+	return
+}
+
+// renderMySQLTokens renders the translated text of tokens, the VALUES(column) function of
+// ON DUPLICATE KEY UPDATE clause is rendered as the excluded column if values is set.
+func renderMySQLTokens(query string, tokens []queryToken, values bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(tokens); i++ {
+		if i > 0 {
+			buf.WriteString(query[tokens[i-1].end:tokens[i].start])
+		}
+		t := &tokens[i]
+		switch name := mysqlKeyword(query, t); {
+		case values && name == "values" && i+3 < len(tokens) && tokens[i+1].typ == '(' &&
+			tokens[i+3].typ == ')':
+			buf.WriteString("excluded.")
+			buf.WriteString(mysqlTokenText(query, &tokens[i+2]))
+			i += 3
+			continue
+		case name == "limit":
+			// LIMIT offset, count
+			var comma, end = -1, len(tokens)
+		findLimit:
+			for j, depth := i+1, 0; j < len(tokens); j++ {
+				switch tokens[j].typ {
+				case '(':
+					depth++
+				case ')':
+					if depth--; depth < 0 {
+						end = j
+						break findLimit
+					}
+				case ',':
+					if depth == 0 {
+						if comma >= 0 {
+							end = j
+							break findLimit
+						}
+						comma = j
+					}
+				default:
+					if depth == 0 && mysqlLimitEndMap[tokens[j].lowered()] {
+						end = j
+						break findLimit
+					}
+				}
+			}
+			if comma > i+1 && end > comma+1 {
+				buf.WriteString(query[t.start:t.end])
+				buf.WriteString(" ")
+				buf.WriteString(renderMySQLTokens(query, tokens[comma+1:end], values))
+				buf.WriteString(" OFFSET ")
+				buf.WriteString(renderMySQLTokens(query, tokens[i+1:comma], values))
+				i = end - 1
+				continue
+			}
+		}
+		buf.WriteString(mysqlTokenText(query, t))
+	}
+	return buf.String()
+}
+
+// renderMySQLPrimaryKey renders the PRIMARY KEY definition of columns.
+func renderMySQLPrimaryKey(query string, constraint []queryToken, columns []string) string {
+	prefix := renderMySQLTokens(query, constraint, false)
+	if prefix != "" {
+		prefix += " "
+	}
+	return prefix + "PRIMARY KEY (" + quoteMySQLIdentifiers(columns) + ")"
+}
+
+// mysqlTokenText returns the SQLite text of token.
+func mysqlTokenText(query string, t *queryToken) string {
+	raw := query[t.start:t.end]
+	switch t.typ {
+	case sqlparser.STRING:
+		// double quoted string and escape sequences
+		return quoteSQLString(string(t.val))
+	case sqlparser.COMMENT:
+		if strings.HasPrefix(raw, "#") {
+			return "--" + raw[1:]
+		}
+	}
+	return raw
+}
+
+// mysqlKeyword returns the lowered keyword of token, or empty string for the quoted ones.
+func mysqlKeyword(query string, t *queryToken) string {
+	if t.typ == sqlparser.STRING || query[t.start] == '`' {
+		return ""
+	}
+	return t.lowered()
+}
+
+// skipTokens skips the leading tokens of keywords.
+func skipTokens(query string, tokens []queryToken, keywords ...string) []queryToken {
+	for len(tokens) > 0 {
+		var skip bool
+		for _, k := range keywords {
+			if mysqlKeyword(query, &tokens[0]) == k {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	return tokens
+}
+
+// skipConstraintName skips the leading CONSTRAINT [name] of key definition.
+func skipConstraintName(query string, def []queryToken) []queryToken {
+	if len(def) > 1 && mysqlKeyword(query, &def[0]) == "constraint" {
+		switch mysqlKeyword(query, &def[1]) {
+		case "primary", "unique", "foreign", "check":
+			return def[1:]
+		}
+		if len(def) > 2 {
+			return def[2:]
+		}
+	}
+	return def
+}
+
+// indexColumnNames returns the column names of key definition, the prefix lengths are ignored.
+func indexColumnNames(def []queryToken) (names []string) {
+	for i := range def {
+		if def[i].typ != '(' {
+			continue
+		}
+		end := matchParen(def, i)
+		for j, expect := i+1, true; j < end; j++ {
+			switch def[j].typ {
+			case '(':
+				j = matchParen(def, j)
+			case ',':
+				expect = true
+			default:
+				if expect {
+					names, expect = append(names, string(def[j].val)), false
+				}
+			}
+		}
+		return
+	}
+	return
+}
+
+func quoteMySQLIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func quoteMySQLIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, v := range names {
+		quoted[i] = quoteMySQLIdentifier(v)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func quoteSQLString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xenomint
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMySQLDialect(t *testing.T) {
+	Convey("Given a mysql dialect without schema lookup", t, func() {
+		var d = &mysqlDialect{}
+
+		Convey("The common mysql syntax should be translated", func() {
+			for _, v := range []struct {
+				query, translated string
+			}{
+				{
+					query:      `SELECT * FROM t WHERE a = "x" AND b = 'it\'s'`,
+					translated: `SELECT * FROM t WHERE a = 'x' AND b = 'it''s'`,
+				}, {
+					query:      "SELECT `id` FROM `t` LIMIT 10, 20",
+					translated: "SELECT `id` FROM `t` LIMIT 20 OFFSET 10",
+				}, {
+					query:      "SELECT * FROM t WHERE id IN (SELECT id FROM s LIMIT 1, 2) LIMIT 3; SELECT 1 LIMIT ?, ?",
+					translated: "SELECT * FROM t WHERE id IN (SELECT id FROM s LIMIT 2 OFFSET 1) LIMIT 3; SELECT 1 LIMIT ? OFFSET ?",
+				}, {
+					query:      "# comment\nSELECT 1",
+					translated: "-- comment\nSELECT 1",
+				}, {
+					query:      "SHOW DATABASES",
+					translated: mysqlShowDatabasesQuery,
+				}, {
+					query: "CREATE TABLE IF NOT EXISTS `t` (" +
+						"`id` INT(11) UNSIGNED NOT NULL AUTO_INCREMENT, " +
+						"`name` VARCHAR(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin DEFAULT NULL COMMENT 'the name', " +
+						"`e` ENUM('a','b') NOT NULL DEFAULT \"a\", " +
+						"`ts` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, " +
+						"`key` bit(1), " +
+						"PRIMARY KEY (`id`), UNIQUE KEY `uk_name` (`name`(10)), KEY `k_e` (`e`, `ts`), " +
+						"CONSTRAINT `fk` FOREIGN KEY (`e`) REFERENCES `s` (`e`)" +
+						") ENGINE=InnoDB AUTO_INCREMENT=5 DEFAULT CHARSET=utf8mb4",
+					translated: "CREATE TABLE IF NOT EXISTS `t` (" +
+						"`id` INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, " +
+						"`name` VARCHAR(32) DEFAULT NULL, " +
+						"`e` TEXT NOT NULL DEFAULT 'a', " +
+						"`ts` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+						"`key` INTEGER, " +
+						"CONSTRAINT `fk` FOREIGN KEY (`e`) REFERENCES `s` (`e`)); " +
+						"CREATE UNIQUE INDEX IF NOT EXISTS `uk_name` ON `t` (`name`); " +
+						"CREATE INDEX IF NOT EXISTS `k_e` ON `t` (`e`, `ts`)",
+				}, {
+					query:      "CREATE TABLE t (id bigint AUTO_INCREMENT KEY, v double precision, UNIQUE (v))",
+					translated: "CREATE TABLE t (id INTEGER PRIMARY KEY AUTOINCREMENT, v double precision, UNIQUE (`v`))",
+				},
+			} {
+				translated, clauses, err := d.translate(v.query)
+				So(err, ShouldBeNil)
+				So(clauses, ShouldBeEmpty)
+				So(translated, ShouldEqual, v.translated)
+			}
+		})
+		Convey("The untranslatable queries should be rejected", func() {
+			for _, v := range []string{
+				"CREATE TABLE t (id bigint AUTO_INCREMENT UNIQUE, v text)",
+				"CREATE TABLE t (id bigint AUTO_INCREMENT, v text, PRIMARY KEY (id, v))",
+				"INSERT INTO t (a) VALUES (1) ON DUPLICATE KEY UPDATE a = VALUES(a)",
+			} {
+				_, _, err := d.translate(v)
+				So(errors.Cause(err), ShouldEqual, ErrUnsupportedDialectQuery)
+			}
+		})
+		Convey("The describe statements should be translated to the mysql format", func() {
+			_, p, _, err := convertQueryAndBuildArgs("DESCRIBE `t`", nil, d, nil)
+			So(err, ShouldBeNil)
+			So(p, ShouldEqual, fmt.Sprintf(mysqlDescribeQuery, "'t'"))
+			_, p, _, err = convertQueryAndBuildArgs("SHOW FULL COLUMNS FROM t", nil, d, nil)
+			So(err, ShouldBeNil)
+			So(p, ShouldEqual, fmt.Sprintf(mysqlDescribeQuery, "'t'"))
+			_, p, _, err = convertQueryAndBuildArgs("SHOW TABLE t", nil, d, nil)
+			So(err, ShouldBeNil)
+			So(p, ShouldEqual, "PRAGMA table_info(t)")
+		})
+	})
+	Convey("Given a chain state object", t, func() {
+		var (
+			fl  = path.Join(testingDataDir, t.Name())
+			st  *State
+			err error
+		)
+		strg, err := xs.NewSqlite(fmt.Sprint("file:", fl))
+		So(err, ShouldBeNil)
+		st = NewState(sql.LevelReadUncommitted, nodeID, strg)
+		Reset(func() {
+			So(st.Close(true), ShouldBeNil)
+			So(os.Remove(fl), ShouldBeNil)
+			_ = os.Remove(fmt.Sprint(fl, "-shm"))
+			_ = os.Remove(fmt.Sprint(fl, "-wal"))
+		})
+		query := func(qt types.QueryType, qs ...types.Query) (*types.Response, error) {
+			req := buildRequest(qt, qs)
+			req.Header.Dialect = types.MySQLDialect
+			_, resp, err := st.Query(req, true)
+			return resp, err
+		}
+
+		Convey("The mysql queries should be executed", func() {
+			_, err = query(types.WriteQuery, buildQuery("CREATE TABLE `t` ("+
+				"`id` INT(11) UNSIGNED NOT NULL AUTO_INCREMENT, "+
+				"`name` VARCHAR(32) CHARACTER SET utf8mb4 NOT NULL, "+
+				"`score` INT NOT NULL DEFAULT 0, "+
+				"`updated` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, "+
+				"PRIMARY KEY (`id`), UNIQUE KEY `uk_name` (`name`)"+
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"))
+			So(err, ShouldBeNil)
+			_, err = query(types.WriteQuery,
+				buildQuery(`INSERT INTO t (name, score) VALUES ("a", 1), ("b", 2), ("c", 3)`),
+				buildQuery("INSERT INTO t (name, score) VALUES (?, ?) "+
+					"ON DUPLICATE KEY UPDATE score = score + VALUES(score)", "b", 10),
+			)
+			So(err, ShouldBeNil)
+
+			resp, err := query(types.ReadQuery, buildQuery("SELECT `id`, `name`, `score` FROM `t` ORDER BY id LIMIT 1, 1"))
+			So(err, ShouldBeNil)
+			So(resp.Payload.Rows, ShouldResemble, []types.ResponseRow{
+				{Values: []interface{}{int64(2), []byte("b"), int64(12)}},
+			})
+
+			resp, err = query(types.ReadQuery, buildQuery("DESC t"))
+			So(err, ShouldBeNil)
+			So(resp.Payload.Columns, ShouldResemble, []string{"Field", "Type", "Null", "Key", "Default", "Extra"})
+			So(resp.Payload.Rows, ShouldHaveLength, 4)
+			So(resp.Payload.Rows[0].Values, ShouldResemble, []interface{}{
+				[]byte("id"), []byte("INTEGER"), []byte("NO"), []byte("PRI"), nil, []byte("auto_increment"),
+			})
+
+			resp, err = query(types.ReadQuery, buildQuery("SHOW DATABASES"))
+			So(err, ShouldBeNil)
+			So(resp.Payload.Rows, ShouldHaveLength, 1)
+		})
+		Convey("The upsert without unique keys should insert rows", func() {
+			_, err = query(types.WriteQuery,
+				buildQuery("CREATE TABLE `t` (`name` TEXT, `score` INT)"),
+				buildQuery("INSERT INTO t (name, score) VALUES ('a', 1) ON DUPLICATE KEY UPDATE score = 0"),
+				buildQuery("INSERT INTO t (name, score) VALUES ('a', 1) ON DUPLICATE KEY UPDATE score = 0"),
+			)
+			So(err, ShouldBeNil)
+			resp, err := query(types.ReadQuery, buildQuery("SELECT count(*) FROM t WHERE score = 1"))
+			So(err, ShouldBeNil)
+			So(resp.Payload.Rows[0].Values, ShouldResemble, []interface{}{int64(2)})
+		})
+	})
+}
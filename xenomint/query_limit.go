@@ -0,0 +1,90 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xenomint
+
+import (
+	"context"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+type queryLimitKey struct{}
+
+// WithQueryLimit returns a copy of ctx carrying the execution limits of the read queries, which
+// are enforced by the state reading with the context.
+func WithQueryLimit(ctx context.Context, limit types.QueryLimit) context.Context {
+	return context.WithValue(ctx, queryLimitKey{}, limit)
+}
+
+// queryLimitFromContext returns the execution limits carried by ctx.
+func queryLimitFromContext(ctx context.Context) (limit types.QueryLimit) {
+	limit, _ = ctx.Value(queryLimitKey{}).(types.QueryLimit)
+	return
+}
+
+// resultLimiter checks the rows returned by a query against the max rows and bytes limits.
+type resultLimiter struct {
+	limit types.QueryLimit
+	rows  uint64
+	bytes uint64
+}
+
+// newResultLimiter returns the result limiter of limit, or nil if limit is unlimited.
+func newResultLimiter(limit types.QueryLimit) *resultLimiter {
+	if limit.IsUnlimited() {
+		return nil
+	}
+	return &resultLimiter{limit: limit}
+}
+
+func (l *resultLimiter) add(row []interface{}) (err error) {
+	if l == nil {
+		return
+	}
+	l.rows++
+	l.bytes += rowSize(row)
+	if l.limit.MaxRows > 0 && l.rows > l.limit.MaxRows {
+		return &types.QueryLimitError{Kind: types.MaxRowsLimit, Limit: l.limit.MaxRows}
+	}
+	if l.limit.MaxBytes > 0 && l.bytes > l.limit.MaxBytes {
+		return &types.QueryLimitError{Kind: types.MaxBytesLimit, Limit: l.limit.MaxBytes}
+	}
+	return
+}
+
+// limitedQueryContext returns the context with the timeout of limit.
+func limitedQueryContext(
+	ctx context.Context, limit types.QueryLimit) (context.Context, context.CancelFunc,
+) {
+	if limit.Timeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, limit.TimeoutDuration())
+}
+
+// queryLimitError returns the query limit error of a failed query, or err itself if no limit
+// is exceeded.
+func queryLimitError(ctx context.Context, limit types.QueryLimit, steps uint64, err error) error {
+	switch {
+	case limit.Timeout > 0 && ctx.Err() == context.DeadlineExceeded:
+		return &types.QueryLimitError{Kind: types.TimeoutLimit, Limit: limit.Timeout}
+	case limit.MaxVMSteps > 0 && steps > limit.MaxVMSteps:
+		return &types.QueryLimitError{Kind: types.MaxVMStepsLimit, Limit: limit.MaxVMSteps}
+	default:
+		return err
+	}
+}
@@ -20,10 +20,12 @@ import (
 	"bytes"
 	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/CovenantSQL/CovenantSQL/types"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
 	"github.com/CovenantSQL/sqlparser"
 	"github.com/pkg/errors"
 )
@@ -36,27 +38,21 @@ var (
 		"likely":         nil,
 		"affinity":       nil,
 		"typeof":         nil,
-		"random":         nil,
-		"randomblob":     nil,
 		"unknown":        nil,
+		// "now" argument of the time functions is rewritten to the deterministic function
 		"date": {
-			"now":       true,
 			"localtime": true,
 		},
 		"time": {
-			"now":       true,
 			"localtime": true,
 		},
 		"datetime": {
-			"now":       true,
 			"localtime": true,
 		},
 		"julianday": {
-			"now":       true,
 			"localtime": true,
 		},
 		"strftime": {
-			"now":       true,
 			"localtime": true,
 		},
 
@@ -71,22 +67,237 @@ var (
 		//"sqlite_rename_parent":      nil,
 		//"sqlite_record":             nil,
 	}
+
+	// time functions defaulting to or accepting "now" as time value
+	nowFunctionMap = map[string]bool{
+		"date":      true,
+		"time":      true,
+		"datetime":  true,
+		"julianday": true,
+		"strftime":  true,
+	}
+
+	// random functions and their deterministic replacements
+	randomFunctionMap = map[string]string{
+		"random":     xs.RandomFunc,
+		"randomblob": xs.RandomBlobFunc,
+	}
+
+	// time literals and their deterministic replacements
+	timeLiteralMap = map[int]string{
+		sqlparser.CURRENT_TIMESTAMP: "(datetime(" + xs.NowFunc + "()))",
+		sqlparser.CURRENT_DATE:      "(date(" + xs.NowFunc + "()))",
+		sqlparser.CURRENT_TIME:      "(time(" + xs.NowFunc + "()))",
+	}
+
+	// preceding keywords of an identifier which is not a function name
+	nonFunctionPrecedingMap = map[string]bool{
+		"into":       true,
+		"table":      true,
+		"exists":     true,
+		"references": true,
+		"on":         true,
+		"view":       true,
+		"with":       true,
+	}
 )
 
-func convertQueryAndBuildArgs(pattern string, args []types.NamedArg) (containsDDL bool, p string, ifs []interface{}, err error) {
-	if lower := strings.ToLower(pattern); strings.Contains(lower, "begin") ||
-		strings.Contains(lower, "rollback") {
+// queryToken defines a scanned token and its position in query.
+type queryToken struct {
+	typ        int
+	val        []byte
+	start, end int
+}
+
+func (t *queryToken) lowered() string {
+	return strings.ToLower(string(t.val))
+}
+
+func scanQueryTokens(query string) (tokens []queryToken) {
+	return scanTokens(query, sqlparser.NewStringTokenizer(query))
+}
+
+func scanTokens(query string, tokenizer *sqlparser.Tokenizer) (tokens []queryToken) {
+	for {
+		// the tokenizer is positioned at the character next to the last token
+		start := tokenizer.Position - 1
+		if start < 0 {
+			start = 0
+		}
+		typ, val := tokenizer.Scan()
+		if typ == 0 || typ == sqlparser.LEX_ERROR {
+			return
+		}
+		end := tokenizer.Position - 1
+		for start < end && strings.IndexByte(" \n\r\t", query[start]) >= 0 {
+			start++
+		}
+		tokens = append(tokens, queryToken{typ: typ, val: val, start: start, end: end})
+	}
+}
+
+// matchParen returns the index of the closing parenthesis matching the opening one at i.
+func matchParen(tokens []queryToken, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i].typ {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// queryEdit defines a replacement of query in range [start, end).
+type queryEdit struct {
+	start, end int
+	with       string
+}
+
+// rewriteStatefulQueryParts rewrites the time and random functions of query to the deterministic
+// functions, which are evaluated with the query context set by the request on the connection.
+// The column default values are kept as is if keepDefaults is set, they are rewritten by the
+// inserts instead.
+func rewriteStatefulQueryParts(query string, keepDefaults bool) (rewritten string, err error) {
+	var (
+		tokens = scanQueryTokens(query)
+		edits  []queryEdit
+	)
+	replace := func(start, end int, with string) {
+		edits = append(edits, queryEdit{start: start, end: end, with: with})
+	}
+	isCall := func(i int) bool {
+		if i+2 >= len(tokens) || tokens[i].typ == sqlparser.STRING || tokens[i+1].typ != '(' {
+			return false
+		}
+		if i > 0 && (tokens[i-1].typ == '.' || nonFunctionPrecedingMap[tokens[i-1].lowered()]) {
+			return false
+		}
+		// common table expression like: WITH a AS (...), random(x) AS (...)
+		if j := matchParen(tokens, i+1); j > 0 && j+1 < len(tokens) && tokens[j+1].lowered() == "as" {
+			return false
+		}
+		return true
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		t := &tokens[i]
+		if keepDefaults && t.typ == sqlparser.DEFAULT && i+1 < len(tokens) {
+			// skip the default value expression
+			if i++; tokens[i].typ == '(' {
+				if j := matchParen(tokens, i); j > 0 {
+					i = j
+				}
+			}
+			continue
+		}
+		if with, ok := timeLiteralMap[t.typ]; ok {
+			replace(t.start, t.end, with)
+			continue
+		}
+		if !isCall(i) {
+			continue
+		}
+		name := t.lowered()
+		if with, ok := randomFunctionMap[name]; ok {
+			replace(t.start, t.end, with)
+			continue
+		}
+		if !nowFunctionMap[name] {
+			continue
+		}
+		if tokens[i+2].typ == ')' {
+			// time functions without arguments default to "now"
+			if name != "strftime" {
+				replace(tokens[i+2].start, tokens[i+2].start, xs.NowFunc+"()")
+			}
+			continue
+		}
+		// rewrite "now" arguments of the time function
+		for j, end := i+2, matchParen(tokens, i+1); j < end; j++ {
+			a := &tokens[j]
+			if a.typ != sqlparser.STRING || a.lowered() != "now" ||
+				(tokens[j-1].typ != '(' && tokens[j-1].typ != ',') ||
+				(tokens[j+1].typ != ')' && tokens[j+1].typ != ',') {
+				continue
+			}
+			if a.start < 0 || (query[a.start] != '\'' && query[a.start] != '"') {
+				err = errors.Wrapf(ErrStatefulQueryParts, "unrecognized time value in %s", query)
+				return
+			}
+			replace(a.start, a.end, xs.NowFunc+"()")
+		}
+	}
+	rewritten = applyQueryEdits(query, edits)
+	return
+}
+
+// applyQueryEdits applies the non-overlapping edits to query.
+func applyQueryEdits(query string, edits []queryEdit) string {
+	if len(edits) == 0 {
+		return query
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var (
+		buf  = bytes.NewBuffer(make([]byte, 0, len(query)))
+		last int
+	)
+	for _, e := range edits {
+		buf.WriteString(query[last:e.start])
+		buf.WriteString(e.with)
+		last = e.end
+	}
+	buf.WriteString(query[last:])
+	return buf.String()
+}
+
+// convertQueryAndBuildArgs sanitizes the query pattern and rewrites it to SQLite with the
+// deterministic functions, the stateful column defaults are resolved by defaults for inserts, which
+// could be nil for read queries.
+func convertQueryAndBuildArgs(
+	pattern string, args []types.NamedArg, dialect queryDialect, defaults defaultsResolver,
+) (
+	containsDDL bool, p string, ifs []interface{}, err error,
+) {
+	tokens := scanQueryTokens(pattern)
+	if isTransactionStatement(pattern, tokens) {
 		return false, pattern, nil, nil
 	}
+	if isCreateTrigger(pattern, tokens) {
+		if p, err = convertTrigger(pattern, tokens, dialect, defaults); err != nil {
+			return
+		}
+		return true, p, buildNamedArgs(args), nil
+	}
+
 	var (
-		tokenizer  = sqlparser.NewStringTokenizer(pattern)
+		clauses    map[int]*dialectClause
 		queryParts []string
 		statements []sqlparser.Statement
 		i          int
 		origQuery  string
 		query      string
+		// stateful column defaults of the tables created by the previous statements
+		created = make(map[string][]columnDefault)
 	)
 
+	if dialect != nil {
+		if pattern, clauses, err = dialect.translate(pattern); err != nil {
+			return
+		}
+	}
+	if defaults != nil {
+		if pattern, err = expandDefaultValues(pattern, defaults); err != nil {
+			return
+		}
+	}
+
+	tokenizer := sqlparser.NewStringTokenizer(pattern)
 	if queryParts, statements, err = sqlparser.ParseMultiple(tokenizer); err != nil {
 		err = errors.Wrap(err, "parse sql failed")
 		return
@@ -99,8 +310,14 @@ func convertQueryAndBuildArgs(pattern string, args []types.NamedArg) (containsDD
 		case *sqlparser.Show:
 			origQuery = queryParts[i]
 
-			switch stmt.Type {
-			case "table":
+			var translated bool
+			if dialect != nil {
+				query, translated = dialect.translateShow(stmt, origQuery)
+			}
+
+			switch {
+			case translated:
+			case stmt.Type == "table":
 				if stmt.ShowCreate {
 					query = fmt.Sprintf(`SELECT sql
 FROM sqlite_master
@@ -110,12 +327,12 @@ WHERE type = "table" AND tbl_name = "%s"
 				} else {
 					query = fmt.Sprintf(`PRAGMA table_info(%s)`, stmt.OnTable.Name.String())
 				}
-			case "index":
+			case stmt.Type == "index":
 				query = fmt.Sprintf(`SELECT name
 FROM sqlite_master
 WHERE type = "index" AND tbl_name = "%s"
 	AND name NOT LIKE "sqlite%%"`, stmt.OnTable.Name.String())
-			case "tables":
+			case stmt.Type == "tables":
 				query = `SELECT name FROM sqlite_master WHERE type = "table" AND name NOT LIKE "sqlite%"`
 			}
 
@@ -127,6 +344,9 @@ WHERE type = "index" AND tbl_name = "%s"
 			queryParts[i] = query
 		case *sqlparser.DDL:
 			containsDDL = true
+			if stmt.Action == sqlparser.CreateStr && stmt.TableSpec != nil {
+				created[strings.ToLower(stmt.NewName.Name.String())] = tableSpecDefaults(stmt)
+			}
 			if stmt.TableSpec != nil {
 				// walk table default values for invalid stateful expressions
 				for _, c := range stmt.TableSpec.Columns {
@@ -151,22 +371,18 @@ WHERE type = "index" AND tbl_name = "%s"
 			}
 		}
 
+		// the translated clause which can't be parsed is sanitized by its expressions
+		clause := clauses[i]
+		if clause != nil {
+			walkNodes = append(walkNodes, clause.nodes...)
+		}
+
 		// scan query and test if there is any stateful query logic like time expression or random function
 		err = sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
 			switch n := node.(type) {
-			case *sqlparser.SQLVal:
-				if n.Type == sqlparser.ValArg && bytes.EqualFold([]byte("CURRENT_TIMESTAMP"), n.Val) {
-					// current_timestamp literal in default expression
-					err = errors.Wrap(ErrStatefulQueryParts, "DEFAULT CURRENT_TIMESTAMP not supported")
-					return
-				}
-			case *sqlparser.TimeExpr:
-				tb := sqlparser.NewTrackedBuffer(nil)
-				err = errors.Wrapf(ErrStatefulQueryParts, "time expression %s not supported",
-					tb.WriteNode(n).String())
-				return
 			case *sqlparser.FuncExpr:
-				if strings.HasPrefix(n.Name.Lowered(), "sqlite") {
+				if strings.HasPrefix(n.Name.Lowered(), "sqlite") ||
+					strings.HasPrefix(n.Name.Lowered(), xs.DeterministicFuncPrefix) {
 					tb := sqlparser.NewTrackedBuffer(nil)
 					err = errors.Wrapf(ErrStatefulQueryParts, "function call %s not supported",
 						tb.WriteNode(n).String())
@@ -195,8 +411,10 @@ WHERE type = "index" AND tbl_name = "%s"
 							}
 						}
 						return true, nil
-					})
+					}, n.Exprs)
 
+					// continue to check the nested function calls
+					kontinue = err == nil
 					return
 				}
 			}
@@ -206,10 +424,42 @@ WHERE type = "index" AND tbl_name = "%s"
 			err = errors.Wrap(err, "parse sql failed")
 			return
 		}
+
+		// give the omitted columns with stateful default values explicitly
+		if stmt, ok := statements[i].(*sqlparser.Insert); ok && defaults != nil {
+			table := strings.ToLower(stmt.Table.Name.String())
+			cols, ok := created[table]
+			if !ok {
+				if cols, err = defaults(stmt.Table.Name.String()); err != nil {
+					return
+				}
+			}
+			if queryParts[i], err = appendStatefulDefaults(queryParts[i], stmt, cols); err != nil {
+				return
+			}
+		}
+
+		// rewrite time and random functions to deterministic ones
+		if _, isShow := statements[i].(*sqlparser.Show); !isShow {
+			if queryParts[i], err = rewriteStatefulQueryParts(queryParts[i], true); err != nil {
+				return
+			}
+		}
+		if clause != nil {
+			var rewritten string
+			if rewritten, err = rewriteStatefulQueryParts(clause.clause, true); err != nil {
+				return
+			}
+			queryParts[i] += rewritten
+		}
 	}
 
 	p = strings.Join(queryParts, "; ")
+	ifs = buildNamedArgs(args)
+	return
+}
 
+func buildNamedArgs(args []types.NamedArg) (ifs []interface{}) {
 	ifs = make([]interface{}, len(args))
 	for i, v := range args {
 		ifs[i] = sql.NamedArg{
@@ -219,3 +469,128 @@ WHERE type = "index" AND tbl_name = "%s"
 	}
 	return
 }
+
+// rawToken returns the lowered text of token t in query, the quoted identifiers are kept quoted.
+func rawToken(query string, t *queryToken) string {
+	return strings.ToLower(query[t.start:t.end])
+}
+
+// isTransactionStatement returns whether query is a single BEGIN or ROLLBACK statement, which is
+// executed as is.
+func isTransactionStatement(query string, tokens []queryToken) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	if w := rawToken(query, &tokens[0]); w != "begin" && w != "rollback" {
+		return false
+	}
+	for i := range tokens {
+		if tokens[i].typ == ';' && i+1 < len(tokens) {
+			return false
+		}
+	}
+	return true
+}
+
+// isCreateTrigger returns whether query is a CREATE TRIGGER statement.
+func isCreateTrigger(query string, tokens []queryToken) bool {
+	i := 1
+	if len(tokens) < 2 || tokens[0].typ != sqlparser.CREATE {
+		return false
+	}
+	if w := rawToken(query, &tokens[i]); w == "temp" || w == "temporary" {
+		i++
+	}
+	return i < len(tokens) && rawToken(query, &tokens[i]) == "trigger"
+}
+
+// convertTrigger sanitizes the CREATE TRIGGER statement query, the WHEN clause and the statements
+// of the trigger body are converted like the other queries, so that the trigger is evaluated
+// deterministically by each replica.
+//
+// The inserts of the trigger body must target the existing tables, whose stateful column defaults
+// are given explicitly by the trigger.
+func convertTrigger(
+	query string, tokens []queryToken, dialect queryDialect, defaults defaultsResolver,
+) (rewritten string, err error) {
+	var (
+		when, begin = -1, -1
+		end         = len(tokens) - 1
+		edits       []queryEdit
+	)
+	if end > 0 && tokens[end].typ == ';' {
+		end--
+	}
+	for i := 3; i < end && begin < 0; i++ {
+		if tokens[i-1].typ == '.' {
+			continue
+		}
+		switch rawToken(query, &tokens[i]) {
+		case "when":
+			if when < 0 {
+				when = i
+			}
+		case "begin":
+			begin = i
+		}
+	}
+	if begin < 0 || tokens[end].typ != sqlparser.END || tokens[end-1].typ != ';' {
+		err = errors.Wrapf(ErrStatefulQueryParts, "unrecognized trigger body in %s", query)
+		return
+	}
+
+	convert := func(start, stop int, prefix string, defaults defaultsResolver) (err error) {
+		var (
+			part = query[tokens[start].start:tokens[stop].end]
+			p    string
+		)
+		if _, p, _, err = convertQueryAndBuildArgs(prefix+part, nil, dialect, defaults); err != nil {
+			return
+		}
+		if !strings.HasPrefix(p, prefix) {
+			return errors.Wrapf(ErrStatefulQueryParts, "unrecognized trigger clause %s", part)
+		}
+		edits = append(edits, queryEdit{
+			start: tokens[start].start, end: tokens[stop].end, with: strings.TrimPrefix(p, prefix),
+		})
+		return
+	}
+
+	// the WHEN clause is converted as a select expression
+	if when > 0 {
+		if when+1 >= begin {
+			err = errors.Wrapf(ErrStatefulQueryParts, "unrecognized trigger condition in %s", query)
+			return
+		}
+		if err = convert(when+1, begin-1, "SELECT ", nil); err != nil {
+			return
+		}
+	}
+
+	var bodyDefaults defaultsResolver
+	if defaults != nil {
+		bodyDefaults = func(table string) (cols []columnDefault, err error) {
+			// the stateful defaults of the tables created later are unknown to the trigger
+			if cols, err = defaults(table); err == nil && len(cols) == 0 {
+				err = errors.Wrapf(ErrStatefulQueryParts, "trigger inserts into unknown table %s", table)
+			}
+			return
+		}
+	}
+	for i, start := begin+1, begin+1; i < end; i++ {
+		if tokens[i].typ != ';' {
+			continue
+		}
+		if i == start {
+			err = errors.Wrapf(ErrStatefulQueryParts, "unrecognized trigger body in %s", query)
+			return
+		}
+		if err = convert(start, i-1, "", bodyDefaults); err != nil {
+			return
+		}
+		start = i + 1
+	}
+
+	rewritten = applyQueryEdits(query, edits)
+	return
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xenomint
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	"github.com/pkg/errors"
+)
+
+// Snapshot pins the current state content including the uncommitted transaction, it returns the
+// state seq and the write function which copies the pinned content to the database file at path.
+//
+// The state is only locked to flush the ongoing transaction and pin a read transaction, so the
+// following queries are not blocked by write. The write function must be called exactly once to
+// release the pinned read transaction. If pinned is not nil, it's called under the state lock once
+// the content is pinned, e.g. to capture the chain head matching the content.
+func (s *State) Snapshot(pinned func()) (seq uint64, write func(path string) error, err error) {
+	var (
+		ctx  = context.Background()
+		conn *sql.Conn
+		n    int
+	)
+
+	s.Lock()
+	defer s.Unlock()
+
+	// flush the ongoing transaction so that it's visible to the snapshot reader
+	s.flushSQLExecuter()
+	seq = s.getSeq()
+
+	if conn, err = s.strg.Reader().Conn(ctx); err != nil {
+		err = errors.Wrap(err, "open snapshot connection failed")
+		return
+	}
+	// a read transaction is started by the first read, it pins the content until rollback
+	if _, err = conn.ExecContext(ctx, "BEGIN"); err == nil {
+		err = conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM "sqlite_master"`).Scan(&n)
+	}
+	if err != nil {
+		_ = conn.Close()
+		err = errors.Wrap(err, "pin snapshot content failed")
+		return
+	}
+
+	if pinned != nil {
+		pinned()
+	}
+
+	write = func(path string) (err error) {
+		defer func() {
+			_, _ = conn.ExecContext(ctx, "ROLLBACK")
+			_ = conn.Close()
+		}()
+		if err = s.strg.Backup(ctx, conn, path); err != nil {
+			err = errors.Wrap(err, "write snapshot failed")
+		}
+		return
+	}
+	return
+}
+
+// Restore replaces the state content with the database file written by Snapshot, the state seq
+// is set to seq and all the pooled queries are discarded.
+func (s *State) Restore(path string, seq uint64) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.restore(path, seq)
+}
+
+// Seed restores the state which has not executed any write query with the database file written
+// by Snapshot, e.g. from a backup of another database.
+func (s *State) Seed(path string, seq uint64) (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if current := s.getSeq(); current > 0 {
+		err = errors.Wrapf(ErrStateWritten, "state at log offset %d", current)
+		return
+	}
+
+	return s.restore(path, seq)
+}
+
+func (s *State) restore(path string, seq uint64) (err error) {
+	// close ongoing transaction and reopen it after restore
+	s.rollbackSQLExecuter()
+	defer s.openSQLExecuter()
+
+	if err = s.strg.Restore(context.Background(), path); err != nil {
+		err = errors.Wrap(err, "restore snapshot failed")
+		return
+	}
+
+	s.pool = newPool()
+	s.SetSeq(seq)
+	atomic.StoreUint64(&s.lastCommitPoint, seq)
+
+	log.WithFields(log.Fields{
+		"seq":  seq,
+		"file": path,
+	}).Info("restored state from snapshot")
+
+	return
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"time"
+
+	sqlite3 "github.com/CovenantSQL/go-sqlite3-encrypt"
+	"github.com/pkg/errors"
+)
+
+// backupRetryInterval is the wait interval before retrying a backup step blocked by other
+// connections.
+const backupRetryInterval = 10 * time.Millisecond
+
+// openFile opens a raw connection to the database file at path, it shares the encryption key of
+// the instance so that pages can be copied between them.
+func (s *SQLite3) openFile(path string) (c *sqlite3.SQLiteConn, err error) {
+	dsn := s.dsn.Clone()
+	dsn.SetFileName(path)
+	var conn interface{}
+	if conn, err = (&sqlite3.SQLiteDriver{}).Open(dsn.Format()); err != nil {
+		err = errors.Wrapf(err, "open database file %s", path)
+		return
+	}
+	c = conn.(*sqlite3.SQLiteConn)
+	return
+}
+
+// Backup implements Backup method of the xenomint/interfaces.Storage interface. The content is
+// copied by the SQLite online backup API, it's consistent with the transaction conn is in if any.
+func (s *SQLite3) Backup(ctx context.Context, conn *sql.Conn, path string) (err error) {
+	var dest *sqlite3.SQLiteConn
+	if dest, err = s.openFile(path); err != nil {
+		return
+	}
+	defer func() { _ = dest.Close() }()
+	return conn.Raw(func(src interface{}) error {
+		return backup(ctx, dest, src.(*sqlite3.SQLiteConn))
+	})
+}
+
+// Restore implements Restore method of the xenomint/interfaces.Storage interface. The caller
+// should make sure that there is no ongoing write transaction on the instance.
+func (s *SQLite3) Restore(ctx context.Context, path string) (err error) {
+	// sqlite creates an empty database for a missing file, check it first
+	if _, err = os.Stat(path); err != nil {
+		err = errors.Wrapf(err, "stat database file %s", path)
+		return
+	}
+	var (
+		src  *sqlite3.SQLiteConn
+		conn *sql.Conn
+	)
+	if src, err = s.openFile(path); err != nil {
+		return
+	}
+	defer func() { _ = src.Close() }()
+	if conn, err = s.writer.Conn(ctx); err != nil {
+		return
+	}
+	err = conn.Raw(func(dest interface{}) error {
+		return backup(ctx, dest.(*sqlite3.SQLiteConn), src)
+	})
+	_ = conn.Close()
+	// reopen the writer connections to apply the recursive triggers recorded by the new content
+	s.writer.SetMaxIdleConns(0)
+	s.writer.SetMaxIdleConns(defaultMaxIdleConns)
+	return
+}
+
+// backup copies the main database of src to dest, it retries until the pages are copied in a
+// single step, so that the copy is never restarted by the writes in between.
+func backup(ctx context.Context, dest, src *sqlite3.SQLiteConn) (err error) {
+	var (
+		b    *sqlite3.SQLiteBackup
+		done bool
+	)
+	if b, err = dest.Backup("main", src, "main"); err != nil {
+		err = errors.Wrap(err, "init backup")
+		return
+	}
+	defer func() {
+		if ferr := b.Finish(); ferr != nil && err == nil {
+			err = errors.Wrap(ferr, "finish backup")
+		}
+	}()
+	for {
+		if done, err = b.Step(-1); err != nil {
+			err = errors.Wrap(err, "copy database pages")
+			return
+		} else if done {
+			return
+		}
+		// blocked by other connections
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(backupRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,492 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	sqlite3 "github.com/CovenantSQL/go-sqlite3-encrypt"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ChangeInsert is the operation of an inserted row.
+	ChangeInsert = iota + 1
+	// ChangeUpdate is the operation of an updated row.
+	ChangeUpdate
+	// ChangeDelete is the operation of a deleted row.
+	ChangeDelete
+
+	captureChangeFunc    = "cql_capture_change"
+	captureOldFunc       = "cql_capture_old"
+	captureNewFunc       = "cql_capture_new"
+	captureCheckFunc     = "cql_capture_check"
+	captureSetupFunc     = "cql_capture_setup"
+	captureDrainFunc     = "cql_capture_drain"
+	captureTriggerPrefix = "cql_capture_"
+
+	// captureChunkSize is the max count of values passed to a single capture function call, the
+	// row images of the wide tables are split into chunks as sqlite functions take at most 127
+	// arguments.
+	captureChunkSize = 100
+	// rowIDColumn is the primary key column of the tables without a declared primary key.
+	rowIDColumn = "rowid"
+)
+
+// Change is a row level change captured on a connection.
+type Change struct {
+	Table      string
+	Op         int
+	Columns    []string
+	PrimaryKey []string // primary key columns, or the rowid if the table declares no primary key
+	Key        []interface{}
+	Old        []interface{}
+	New        []interface{}
+}
+
+// captureTable is the column set of a captured table.
+type captureTable struct {
+	name    string
+	columns []string
+	pk      []string
+	pkIndex []int // indexes of the primary key columns, empty if the rowid is used as key
+	// VM steps of a single capture trigger run by op, which are excluded from the step meter
+	steps [ChangeDelete + 1]int64
+}
+
+func (t *captureTable) key(values []interface{}) (key []interface{}) {
+	if len(t.pkIndex) == 0 {
+		return values[len(values)-1:]
+	}
+	key = make([]interface{}, len(t.pkIndex))
+	for i, v := range t.pkIndex {
+		key[i] = values[v]
+	}
+	return
+}
+
+// imageSize returns the value count of a row image, including the rowid if it's used as key.
+func (t *captureTable) imageSize() int {
+	if len(t.pkIndex) == 0 {
+		return len(t.columns) + 1
+	}
+	return len(t.columns)
+}
+
+// rowImage returns the calls passing the row image of prefix to the capture function fn in chunks.
+func (t *captureTable) rowImage(fn, prefix string) string {
+	var values = make([]string, 0, len(t.columns)+1)
+	for _, v := range t.columns {
+		values = append(values, prefix+"."+quoteIdentifier(v))
+	}
+	if len(t.pkIndex) == 0 {
+		values = append(values, prefix+"."+rowIDColumn)
+	}
+	var calls []string
+	for len(values) > 0 {
+		n := len(values)
+		if n > captureChunkSize {
+			n = captureChunkSize
+		}
+		calls = append(calls, fmt.Sprintf("%s(%s)", fn, strings.Join(values[:n], ", ")))
+		values = values[n:]
+	}
+	return strings.Join(calls, ", ")
+}
+
+// captureHandles passes the table sets and the captured changes between the go side and the
+// functions of a connection, which are only reachable by sql.
+var (
+	captureHandles    sync.Map
+	nextCaptureHandle int64
+)
+
+func putCaptureHandle(v interface{}) int64 {
+	h := atomic.AddInt64(&nextCaptureHandle, 1)
+	captureHandles.Store(h, v)
+	return h
+}
+
+func takeCaptureHandle(h int64) (v interface{}) {
+	v, _ = captureHandles.Load(h)
+	captureHandles.Delete(h)
+	return
+}
+
+// changeCapture holds the per-connection state of the change capture triggers.
+//
+// The preupdate hook is not compiled in the bundled sqlite and the update hook only reports the
+// rowid of a changed row, so the row images are captured by temporary triggers calling the
+// functions of changeCapture instead. The triggers are local to the connection and invisible to
+// the database file.
+type changeCapture struct {
+	installed                bool
+	mainVersion, tempVersion int64
+	tables                   []captureTable
+	changes                  []Change
+	pending                  *captureTable // table of the last change whose images are being built
+	meter                    *stepMeter    // excludes the VM steps of the triggers
+}
+
+func (c *changeCapture) check(mainVersion, tempVersion int64) int64 {
+	if c.installed && c.mainVersion == mainVersion && c.tempVersion == tempVersion {
+		return 1
+	}
+	return 0
+}
+
+func (c *changeCapture) setup(h, mainVersion, tempVersion int64) int64 {
+	c.tables, _ = takeCaptureHandle(h).([]captureTable)
+	c.mainVersion, c.tempVersion, c.installed = mainVersion, tempVersion, true
+	return 1
+}
+
+// change begins a row change of table tid, the row images are passed by the following old and new
+// calls in chunks.
+func (c *changeCapture) change(tid, op int64) int64 {
+	c.finish()
+	if tid < 0 || tid >= int64(len(c.tables)) || op < ChangeInsert || op > ChangeDelete {
+		return 0
+	}
+	var t = &c.tables[tid]
+	if c.meter != nil {
+		c.meter.exclude(t.steps[op])
+	}
+	c.changes = append(c.changes, Change{
+		Table:      t.name,
+		Op:         int(op),
+		Columns:    t.columns,
+		PrimaryKey: t.pk,
+	})
+	c.pending = t
+	return 1
+}
+
+func (c *changeCapture) old(values ...interface{}) int64 {
+	if c.pending == nil {
+		return 0
+	}
+	var ch = &c.changes[len(c.changes)-1]
+	ch.Old = append(ch.Old, values...)
+	return 1
+}
+
+func (c *changeCapture) new(values ...interface{}) int64 {
+	if c.pending == nil {
+		return 0
+	}
+	var ch = &c.changes[len(c.changes)-1]
+	ch.New = append(ch.New, values...)
+	return 1
+}
+
+// finish completes the row images of the last change with the key, the key is taken from the new
+// image except for deletes.
+func (c *changeCapture) finish() {
+	var t = c.pending
+	if t == nil {
+		return
+	}
+	c.pending = nil
+	var (
+		ch    = &c.changes[len(c.changes)-1]
+		image = ch.New
+	)
+	if ch.Op == ChangeDelete {
+		image = ch.Old
+	}
+	if len(image) != t.imageSize() || (ch.Old != nil && len(ch.Old) != t.imageSize()) {
+		// incomplete images, which should never happen
+		log.WithField("table", t.name).Warning("incomplete row images of captured change")
+		c.changes = c.changes[:len(c.changes)-1]
+		return
+	}
+	ch.Key = t.key(image)
+	if ch.Old != nil {
+		ch.Old = ch.Old[:len(t.columns)]
+	}
+	if ch.New != nil {
+		ch.New = ch.New[:len(t.columns)]
+	}
+}
+
+func (c *changeCapture) drain() int64 {
+	c.finish()
+	if len(c.changes) == 0 {
+		return 0
+	}
+	var h = putCaptureHandle(c.changes)
+	c.changes = nil
+	return h
+}
+
+func (c *changeCapture) register(conn *sqlite3.SQLiteConn) (err error) {
+	if err = conn.RegisterFunc(captureCheckFunc, c.check, false); err != nil {
+		return
+	}
+	if err = conn.RegisterFunc(captureSetupFunc, c.setup, false); err != nil {
+		return
+	}
+	if err = conn.RegisterFunc(captureChangeFunc, c.change, false); err != nil {
+		return
+	}
+	if err = conn.RegisterFunc(captureOldFunc, c.old, false); err != nil {
+		return
+	}
+	if err = conn.RegisterFunc(captureNewFunc, c.new, false); err != nil {
+		return
+	}
+	return conn.RegisterFunc(captureDrainFunc, c.drain, false)
+}
+
+// Querier defines the sql executer to capture row changes on, it should be bound to a single
+// connection such as sql.Conn or sql.Tx.
+type Querier interface {
+	Execer
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+const schemaVersions = `(SELECT schema_version FROM main.pragma_schema_version),
+	(SELECT schema_version FROM temp.pragma_schema_version)`
+
+// PrepareChangeCapture installs the change capture triggers of all the tables on the connection
+// of q, the triggers are only rebuilt if the schema is changed since the last preparation.
+func PrepareChangeCapture(ctx context.Context, q Querier) (err error) {
+	var installed int64
+	if err = q.QueryRowContext(
+		ctx, "SELECT "+captureCheckFunc+"("+schemaVersions+")",
+	).Scan(&installed); err != nil {
+		err = errors.Wrap(err, "check change capture triggers failed")
+		return
+	}
+	if installed != 0 {
+		return
+	}
+	var tables []captureTable
+	if tables, err = installCaptureTriggers(ctx, q); err != nil {
+		err = errors.Wrap(err, "install change capture triggers failed")
+		return
+	}
+	var mainVersion, tempVersion int64
+	if err = q.QueryRowContext(ctx, "SELECT "+schemaVersions).Scan(&mainVersion, &tempVersion); err != nil {
+		err = errors.Wrap(err, "read schema versions failed")
+		return
+	}
+	var h = putCaptureHandle(tables)
+	if _, err = q.ExecContext(
+		ctx, "SELECT "+captureSetupFunc+"(?, ?, ?)", h, mainVersion, tempVersion,
+	); err != nil {
+		takeCaptureHandle(h)
+		err = errors.Wrap(err, "setup change capture failed")
+	}
+	return
+}
+
+// DrainChanges returns and clears the row changes captured on the connection of q since the last
+// drain.
+func DrainChanges(ctx context.Context, q Querier) (changes []Change, err error) {
+	var h int64
+	if err = q.QueryRowContext(ctx, "SELECT "+captureDrainFunc+"()").Scan(&h); err != nil {
+		err = errors.Wrap(err, "drain captured changes failed")
+		return
+	}
+	if h != 0 {
+		changes, _ = takeCaptureHandle(h).([]Change)
+	}
+	return
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func queryStrings(ctx context.Context, q Querier, query string) (list []string, err error) {
+	var rows *sql.Rows
+	if rows, err = q.QueryContext(ctx, query); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return
+		}
+		list = append(list, s)
+	}
+	err = rows.Err()
+	return
+}
+
+func queryCaptureTable(ctx context.Context, q Querier, name string) (t captureTable, err error) {
+	var rows *sql.Rows
+	if rows, err = q.QueryContext(
+		ctx, "SELECT name, pk FROM main.pragma_table_info(?) ORDER BY cid", name,
+	); err != nil {
+		return
+	}
+	defer rows.Close()
+	var pks = map[int64]int{}
+	t.name = name
+	for rows.Next() {
+		var (
+			column string
+			pk     int64
+		)
+		if err = rows.Scan(&column, &pk); err != nil {
+			return
+		}
+		if pk > 0 {
+			pks[pk] = len(t.columns)
+		}
+		t.columns = append(t.columns, column)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if len(pks) == 0 {
+		t.pk = []string{rowIDColumn}
+		return
+	}
+	for i := int64(1); i <= int64(len(pks)); i++ {
+		t.pk = append(t.pk, t.columns[pks[i]])
+		t.pkIndex = append(t.pkIndex, pks[i])
+	}
+	return
+}
+
+func installCaptureTriggers(ctx context.Context, q Querier) (tables []captureTable, err error) {
+	var names []string
+	if names, err = queryStrings(ctx, q, `SELECT name FROM temp.sqlite_master
+WHERE type = 'trigger' AND name LIKE '`+captureTriggerPrefix+`%'`); err != nil {
+		return
+	}
+	for _, v := range names {
+		if _, err = q.ExecContext(ctx, "DROP TRIGGER temp."+quoteIdentifier(v)); err != nil {
+			return
+		}
+	}
+	if names, err = queryStrings(ctx, q, `SELECT name FROM main.sqlite_master
+WHERE type = 'table' AND name NOT LIKE 'sqlite!_%' ESCAPE '!'
+AND sql NOT LIKE 'CREATE VIRTUAL%' ORDER BY name`); err != nil {
+		return
+	}
+	for _, v := range names {
+		var t captureTable
+		if t, err = queryCaptureTable(ctx, q, v); err != nil {
+			return
+		}
+		var (
+			tid    = len(tables)
+			table  = "main." + quoteIdentifier(v)
+			oldRow = t.rowImage(captureOldFunc, "OLD")
+			newRow = t.rowImage(captureNewFunc, "NEW")
+			prefix = fmt.Sprintf("%s%d_", captureTriggerPrefix, tid)
+			// the calls are made by a single statement evaluating the result columns in order,
+			// the probes are the statements compiling the triggers to count their VM steps
+			actions = []struct {
+				op                 int
+				event, body, probe string
+			}{
+				{ChangeInsert, "INSERT", fmt.Sprintf("SELECT %s(%d, %d), %s;",
+					captureChangeFunc, tid, ChangeInsert, newRow),
+					"INSERT INTO " + table + " DEFAULT VALUES"},
+				{ChangeUpdate, "UPDATE", fmt.Sprintf("SELECT %s(%d, %d), %s, %s;",
+					captureChangeFunc, tid, ChangeUpdate, oldRow, newRow),
+					"UPDATE " + table + " SET " + quoteIdentifier(t.columns[0]) + " = NULL"},
+				{ChangeDelete, "DELETE", fmt.Sprintf("SELECT %s(%d, %d), %s;",
+					captureChangeFunc, tid, ChangeDelete, oldRow),
+					"DELETE FROM " + table},
+			}
+		)
+		for _, a := range actions {
+			var trigger = prefix + strings.ToLower(a.event)
+			if _, err = q.ExecContext(ctx, fmt.Sprintf(
+				"CREATE TEMP TRIGGER %s AFTER %s ON %s BEGIN %s END",
+				trigger, a.event, table, a.body,
+			)); err != nil {
+				return
+			}
+			if t.steps[a.op], err = triggerSteps(ctx, q, a.probe, trigger); err != nil {
+				log.WithError(err).WithField("trigger", trigger).Warning(
+					"count capture trigger steps failed, the trigger is metered")
+				err = nil
+			}
+		}
+		tables = append(tables, t)
+	}
+	return
+}
+
+// triggerSteps returns the VM steps of a single run of trigger, which is compiled as a sub-program
+// of the probe statement. The trigger program has no branch, so every instruction listed by
+// EXPLAIN is evaluated once per run, plus the Program instruction of the probe invoking it.
+func triggerSteps(ctx context.Context, q Querier, probe, trigger string) (steps int64, err error) {
+	var rows *sql.Rows
+	if rows, err = q.QueryContext(ctx, "EXPLAIN "+probe); err != nil {
+		return
+	}
+	defer rows.Close()
+	var (
+		columns []string
+		comment = "-- TRIGGER " + trigger
+		found   bool
+	)
+	if columns, err = rows.Columns(); err != nil {
+		return
+	}
+	for rows.Next() {
+		var (
+			values = make([]interface{}, len(columns))
+			addr   int64
+			opcode string
+			p4     sql.NullString
+		)
+		for i := range values {
+			values[i] = new(interface{})
+		}
+		values[0], values[1], values[5] = &addr, &opcode, &p4
+		if err = rows.Scan(values...); err != nil {
+			return
+		}
+		if addr == 0 {
+			// each sub-program is listed from address 0 after the main program
+			if found {
+				break
+			}
+			found = opcode == "Init" && p4.String == comment
+		}
+		if found {
+			steps++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if !found {
+		err = errors.Errorf("trigger program of %s not found", trigger)
+		return
+	}
+	steps++
+	return
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+
+	sqlite3 "github.com/CovenantSQL/go-sqlite3-encrypt"
+)
+
+const (
+	// ProgressStepInterval is the VM instruction count between the progress handler calls, the VM
+	// steps of a connection are metered at this granularity.
+	ProgressStepInterval = 1000
+
+	vmStepsFunc      = "cql_vm_steps"
+	vmStepBudgetFunc = "cql_set_vm_step_budget"
+)
+
+// stepMeter counts the VM steps evaluated on a connection with the progress handler, and
+// interrupts the statement once the step budget is exhausted.
+//
+// The internal work evaluated by the user statements, i.e. the change capture triggers, is
+// excluded by its exact VM steps, while the plan changes of the statements for the triggers are
+// still metered. The progress handler counts at a coarser granularity, so the metered steps are
+// kept monotonic rather than going below the steps read last.
+type stepMeter struct {
+	steps    int64
+	budget   int64 // step count to interrupt at, 0 for no budget
+	excluded int64
+	last     int64
+}
+
+func (m *stepMeter) exclude(steps int64) {
+	atomic.AddInt64(&m.excluded, steps)
+}
+
+func (m *stepMeter) metered() int64 {
+	steps := atomic.LoadInt64(&m.steps) - atomic.LoadInt64(&m.excluded)
+	if last := atomic.LoadInt64(&m.last); steps < last {
+		return last
+	}
+	atomic.StoreInt64(&m.last, steps)
+	return steps
+}
+
+func (m *stepMeter) progress() int {
+	atomic.AddInt64(&m.steps, ProgressStepInterval)
+	if budget := atomic.LoadInt64(&m.budget); budget > 0 && m.metered() > budget {
+		return 1
+	}
+	return 0
+}
+
+func (m *stepMeter) setBudget(budget int64) int64 {
+	if budget > 0 {
+		budget += m.metered()
+	} else {
+		budget = 0
+	}
+	atomic.StoreInt64(&m.budget, budget)
+	return 1
+}
+
+func (m *stepMeter) get() int64 {
+	return m.metered()
+}
+
+func (m *stepMeter) register(conn *sqlite3.SQLiteConn) (err error) {
+	if err = setProgressHandler(conn, ProgressStepInterval, m.progress); err != nil {
+		return
+	}
+	if err = conn.RegisterFunc(vmStepBudgetFunc, m.setBudget, false); err != nil {
+		return
+	}
+	return conn.RegisterFunc(vmStepsFunc, m.get, false)
+}
+
+// RowQuerier defines the single row querier to read the VM steps from, it should be bound to a
+// single connection such as sql.Conn or sql.Tx.
+type RowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// VMSteps returns the accumulated VM steps evaluated on the connection of q, the steps of queries
+// are measured by the difference before and after the execution.
+func VMSteps(ctx context.Context, q RowQuerier) (steps uint64, err error) {
+	var v int64
+	if err = q.QueryRowContext(ctx, "SELECT "+vmStepsFunc+"()").Scan(&v); err != nil {
+		return
+	}
+	steps = uint64(v)
+	return
+}
+
+// SetVMStepBudget sets the VM step budget of the following statements on the connection of q, a
+// statement exceeding the budget is interrupted. The budget should be cleared with 0 before the
+// connection is released.
+func SetVMStepBudget(ctx context.Context, q RowQuerier, budget uint64) (err error) {
+	var v int64
+	return q.QueryRowContext(ctx, "SELECT "+vmStepBudgetFunc+"(?)", int64(budget)).Scan(&v)
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"time"
+
+	sqlite3 "github.com/CovenantSQL/go-sqlite3-encrypt"
+	"github.com/pkg/errors"
+)
+
+const (
+	// NowFunc is the name of the deterministic function returning the current time of query
+	// context, it replaces the "now" argument of the sqlite date and time functions.
+	NowFunc = "cql_now"
+	// RandomFunc is the name of the deterministic replacement of the sqlite random function.
+	RandomFunc = "cql_random"
+	// RandomBlobFunc is the name of the deterministic replacement of the sqlite randomblob
+	// function.
+	RandomBlobFunc = "cql_randomblob"
+	// DeterministicFuncPrefix is the name prefix of the deterministic functions, which should not
+	// be called from user queries directly.
+	DeterministicFuncPrefix = "cql_"
+
+	setQueryContextFunc = "cql_set_context"
+	nowLayout           = "2006-01-02 15:04:05.000"
+)
+
+var (
+	// ErrMissingQueryContext indicates the deterministic functions are called without the query
+	// context set on the connection.
+	ErrMissingQueryContext = errors.New("missing query context of deterministic functions")
+)
+
+// queryContext holds the per-connection state of the deterministic functions, the functions fail
+// without the state, as falling back to the local time or random source would make the results
+// differ on the peers.
+type queryContext struct {
+	now  string
+	rand *rand.Rand
+}
+
+func (c *queryContext) set(now string, seed int64) int64 {
+	c.now, c.rand = now, nil
+	if now != "" {
+		c.rand = rand.New(rand.NewSource(seed))
+	}
+	return 1
+}
+
+func (c *queryContext) getNow() (string, error) {
+	if c.now == "" {
+		return "", ErrMissingQueryContext
+	}
+	return c.now, nil
+}
+
+func (c *queryContext) random() (int64, error) {
+	if c.rand == nil {
+		return 0, ErrMissingQueryContext
+	}
+	return int64(c.rand.Uint64()), nil
+}
+
+func (c *queryContext) randomBlob(n int64) ([]byte, error) {
+	if c.rand == nil {
+		return nil, ErrMissingQueryContext
+	}
+	if n < 1 {
+		n = 1
+	}
+	b := make([]byte, n)
+	c.rand.Read(b)
+	return b, nil
+}
+
+func (c *queryContext) register(conn *sqlite3.SQLiteConn) (err error) {
+	if err = conn.RegisterFunc(setQueryContextFunc, c.set, false); err != nil {
+		return
+	}
+	if err = conn.RegisterFunc(NowFunc, c.getNow, false); err != nil {
+		return
+	}
+	if err = conn.RegisterFunc(RandomFunc, c.random, false); err != nil {
+		return
+	}
+	return conn.RegisterFunc(RandomBlobFunc, c.randomBlob, false)
+}
+
+// Execer defines the sql executer to set query context on, it should be bound to a single
+// connection such as sql.Conn or sql.Tx.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// SetQueryContext sets the current time and the random seed of the deterministic functions on
+// the connection of e, the following queries on the connection will get the same results with
+// the same context.
+func SetQueryContext(ctx context.Context, e Execer, now time.Time, seed int64) (err error) {
+	_, err = e.ExecContext(ctx, "SELECT "+setQueryContextFunc+"(?, ?)",
+		now.UTC().Format(nowLayout), seed)
+	return
+}
+
+// ClearQueryContext clears the query context on the connection of e, it should be called before
+// the connection is released, so that the following queries without context fail instead of
+// using a stale one.
+func ClearQueryContext(ctx context.Context, e Execer) (err error) {
+	_, err = e.ExecContext(ctx, "SELECT "+setQueryContextFunc+"('', 0)")
+	return
+}
@@ -0,0 +1,31 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+#include <stdint.h>
+
+// sqlite3_progress_handler is linked from the sqlite library of the driver.
+typedef struct sqlite3 sqlite3;
+void sqlite3_progress_handler(sqlite3 *db, int n, int (*callback)(void *), void *arg);
+
+extern int cqlProgressTrampoline(uintptr_t handle);
+
+static int cql_progress(void *arg) {
+	return cqlProgressTrampoline((uintptr_t)arg);
+}
+
+void cql_set_progress_handler(void *db, int n, uintptr_t handle) {
+	sqlite3_progress_handler((sqlite3 *)db, n, cql_progress, (void *)handle);
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlite
+
+/*
+#include <stdint.h>
+
+void cql_set_progress_handler(void *db, int n, uintptr_t handle);
+*/
+import "C"
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+
+	sqlite3 "github.com/CovenantSQL/go-sqlite3-encrypt"
+	"github.com/pkg/errors"
+)
+
+// progressHandlers maps the sqlite3 handles to the progress handlers, the handler of a closed
+// connection is replaced once the handle address is reused by a new connection.
+var progressHandlers sync.Map // handle -> func() int
+
+//export cqlProgressTrampoline
+func cqlProgressTrampoline(handle C.uintptr_t) C.int {
+	if v, ok := progressHandlers.Load(uintptr(handle)); ok {
+		return C.int(v.(func() int)())
+	}
+	return 0
+}
+
+// setProgressHandler sets the progress handler of the connection, which is called after about n
+// VM instructions are evaluated by a statement, the statement is interrupted if callback returns
+// non-zero.
+//
+// The driver doesn't expose sqlite3_progress_handler, so it's called on the sqlite3 handle of
+// the connection directly.
+func setProgressHandler(conn *sqlite3.SQLiteConn, n int, callback func() int) (err error) {
+	var db = reflect.ValueOf(conn).Elem().FieldByName("db")
+	if !db.IsValid() || db.Kind() != reflect.Ptr || db.IsNil() {
+		return errors.New("sqlite3 handle of connection not found")
+	}
+	var handle = db.Pointer()
+	progressHandlers.Store(handle, callback)
+	C.cql_set_progress_handler(unsafe.Pointer(db.Pointer()), C.int(n), C.uintptr_t(handle))
+	return
+}
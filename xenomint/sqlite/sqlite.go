@@ -17,50 +17,207 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/CovenantSQL/CovenantSQL/storage"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
 	sqlite3 "github.com/CovenantSQL/go-sqlite3-encrypt"
+	"github.com/pkg/errors"
 )
 
 const (
 	serializableDriver = "sqlite3-custom"
 	dirtyReadDriver    = "sqlite3-dirty-reader"
+
+	// CacheLimitParam is the DSN parameter to limit the page cache of the instance in bytes, it's
+	// shared by the connections and applied as PRAGMA cache_size on each connection.
+	CacheLimitParam = "_cache_limit"
+
+	// LimitedPoolSize is the max open connections of each connection pool of a cache limited
+	// instance.
+	LimitedPoolSize = 4
+
+	// poolCount is the connection pool count of an instance: dirty reader, reader and writer.
+	poolCount = 3
+
+	// defaultMaxIdleConns is the default max idle connections of a connection pool in
+	// database/sql.
+	defaultMaxIdleConns = 2
+
+	// recursiveTriggersAppID is the application id recorded in the header of the databases created
+	// with recursive triggers on. The existing databases without it keep the non-recursive
+	// triggers, and the id is copied with the database content by snapshots, so that the triggers
+	// behave the same on every replica.
+	recursiveTriggersAppID = 0x43514c01
 )
 
-func init() {
-	sleepFunc := func(t int64) int64 {
-		log.Info("sqlite func sleep start")
-		time.Sleep(time.Duration(t))
-		log.Info("sqlite func sleep end")
-		return t
+// ConnectionCacheLimit returns the page cache limit of each connection in bytes for a cache
+// limited instance.
+func ConnectionCacheLimit(limit uint64) uint64 {
+	return limit / (poolCount * LimitedPoolSize)
+}
+
+func sleepFunc(t int64) int64 {
+	log.Info("sqlite func sleep start")
+	time.Sleep(time.Duration(t))
+	log.Info("sqlite func sleep end")
+	return t
+}
+
+// limits defines the per-connection resource limits of a SQLite3 instance.
+//
+// The storage space is deliberately not limited here: a storage error on a replicated write would
+// make replicas diverge, so the reserved space is checked by the leader before the write is
+// proposed.
+type limits struct {
+	cache uint64
+}
+
+func (l *limits) apply(c *sqlite3.SQLiteConn) (err error) {
+	if l.cache > 0 {
+		// negative cache_size is the cache limit in KiB
+		cacheKiB := int64(l.cache) >> 10
+		if cacheKiB < 1 {
+			cacheKiB = 1
+		}
+		if _, err = c.Exec(fmt.Sprintf("PRAGMA cache_size=-%d", cacheKiB), nil); err != nil {
+			return
+		}
 	}
-	sql.Register(dirtyReadDriver, &sqlite3.SQLiteDriver{
+	return
+}
+
+func newDriver(dirtyRead bool, l *limits) *sqlite3.SQLiteDriver {
+	return &sqlite3.SQLiteDriver{
 		ConnectHook: func(c *sqlite3.SQLiteConn) (err error) {
-			if _, err = c.Exec("PRAGMA read_uncommitted=1", nil); err != nil {
+			if dirtyRead {
+				if _, err = c.Exec("PRAGMA read_uncommitted=1", nil); err != nil {
+					return
+				}
+			}
+			// rows deleted by REPLACE conflict resolution only fire the delete triggers with
+			// recursive triggers on, it's enabled by the database no matter if the change capture
+			// is enabled
+			if err = setRecursiveTriggers(c); err != nil {
 				return
 			}
 			if err = c.RegisterFunc("sleep", sleepFunc, true); err != nil {
 				return
 			}
-			return
-		},
-	})
-	sql.Register(serializableDriver, &sqlite3.SQLiteDriver{
-		ConnectHook: func(c *sqlite3.SQLiteConn) (err error) {
-			if err = c.RegisterFunc("sleep", sleepFunc, true); err != nil {
+			if err = new(queryContext).register(c); err != nil {
 				return
 			}
+			var meter = new(stepMeter)
+			if err = meter.register(c); err != nil {
+				return
+			}
+			if err = (&changeCapture{meter: meter}).register(c); err != nil {
+				return
+			}
+			if l != nil {
+				return l.apply(c)
+			}
 			return
 		},
-	})
+	}
+}
+
+// setRecursiveTriggers enables the recursive triggers on c if it's recorded by the database.
+func setRecursiveTriggers(c *sqlite3.SQLiteConn) (err error) {
+	var id int64
+	if id, err = queryInt(c, "PRAGMA application_id"); err != nil || id != recursiveTriggersAppID {
+		return
+	}
+	_, err = c.Exec("PRAGMA recursive_triggers=1", nil)
+	return
+}
+
+// markNewDatabase records the recursive triggers in the header of the database of dsn if it's
+// created just now.
+func markNewDatabase(dsn string) (err error) {
+	var (
+		conn   driver.Conn
+		c      *sqlite3.SQLiteConn
+		id, n  int64
+		commit bool
+	)
+	if conn, err = (&sqlite3.SQLiteDriver{}).Open(dsn); err != nil {
+		return
+	}
+	c = conn.(*sqlite3.SQLiteConn)
+	defer func() { _ = c.Close() }()
+	isNew := func() (ok bool, err error) {
+		if id, err = queryInt(c, "PRAGMA application_id"); err != nil || id != 0 {
+			return
+		}
+		if n, err = queryInt(c, `SELECT COUNT(*) FROM "sqlite_master"`); err != nil || n != 0 {
+			return
+		}
+		return true, nil
+	}
+	// the existing databases are checked without locking, as they may be opened elsewhere
+	if ok, err := isNew(); err != nil || !ok {
+		return err
+	}
+	if _, err = c.Exec("BEGIN IMMEDIATE", nil); err != nil {
+		return
+	}
+	defer func() {
+		if commit && err == nil {
+			_, err = c.Exec("COMMIT", nil)
+		} else {
+			_, _ = c.Exec("ROLLBACK", nil)
+		}
+	}()
+	if commit, err = isNew(); err != nil || !commit {
+		return
+	}
+	_, err = c.Exec(fmt.Sprintf("PRAGMA application_id=%d", recursiveTriggersAppID), nil)
+	return
+}
+
+func queryInt(c *sqlite3.SQLiteConn, query string) (v int64, err error) {
+	var rows driver.Rows
+	if rows, err = c.Query(query, nil); err != nil {
+		return
+	}
+	defer func() { _ = rows.Close() }()
+	var dest = make([]driver.Value, 1)
+	if err = rows.Next(dest); err != nil {
+		return
+	}
+	v, _ = dest[0].(int64)
+	return
+}
+
+// connector opens connections of dsn from a dedicated driver instance.
+type connector struct {
+	dsn string
+	drv driver.Driver
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return c.drv.Open(c.dsn)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.drv
+}
+
+func init() {
+	sql.Register(dirtyReadDriver, newDriver(true, nil))
+	sql.Register(serializableDriver, newDriver(false, nil))
 }
 
 // SQLite3 is the sqlite3 implementation of the xenomint/interfaces.Storage interface.
 type SQLite3 struct {
 	filename    string
+	dsn         *storage.DSN
 	dirtyReader *sql.DB
 	reader      *sql.DB
 	writer      *sql.DB
@@ -74,11 +231,16 @@ func NewSqlite(filename string) (s *SQLite3, err error) {
 		privRODSN string
 		shmRWDSN  string
 		dsn       *storage.DSN
+		l         *limits
 	)
 
 	if dsn, err = storage.NewDSN(filename); err != nil {
 		return
 	}
+	if l, err = parseLimits(dsn); err != nil {
+		return
+	}
+	instance.dsn = dsn
 
 	dsnRO := dsn.Clone()
 	dsnRO.AddParam("_journal_mode", "WAL")
@@ -96,16 +258,61 @@ func NewSqlite(filename string) (s *SQLite3, err error) {
 	dsnSHMRW.AddParam("cache", "shared")
 	shmRWDSN = dsnSHMRW.Format()
 
-	if instance.dirtyReader, err = sql.Open(dirtyReadDriver, shmRODSN); err != nil {
+	if err = markNewDatabase(shmRWDSN); err != nil {
+		err = errors.Wrap(err, "mark new database")
 		return
 	}
-	if instance.reader, err = sql.Open(serializableDriver, privRODSN); err != nil {
-		return
+
+	if l == nil {
+		if instance.dirtyReader, err = sql.Open(dirtyReadDriver, shmRODSN); err != nil {
+			return
+		}
+		if instance.reader, err = sql.Open(serializableDriver, privRODSN); err != nil {
+			return
+		}
+		if instance.writer, err = sql.Open(serializableDriver, shmRWDSN); err != nil {
+			return
+		}
+	} else {
+		// limits are applied by dedicated drivers of this instance
+		instance.dirtyReader = sql.OpenDB(&connector{dsn: shmRODSN, drv: newDriver(true, l)})
+		instance.reader = sql.OpenDB(&connector{dsn: privRODSN, drv: newDriver(false, l)})
+		instance.writer = sql.OpenDB(&connector{dsn: shmRWDSN, drv: newDriver(false, l)})
+		if l.cache > 0 {
+			for _, v := range []*sql.DB{instance.dirtyReader, instance.reader, instance.writer} {
+				v.SetMaxOpenConns(LimitedPoolSize)
+			}
+		}
+	}
+	s = instance
+	return
+}
+
+// parseLimits removes the limit parameters from dsn and returns the parsed limits, or nil if
+// there is no limit.
+func parseLimits(dsn *storage.DSN) (l *limits, err error) {
+	var cache uint64
+	if raw, ok := dsn.GetParam(CacheLimitParam); ok {
+		if cache, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			err = errors.Wrapf(err, "parse dsn parameter %s", CacheLimitParam)
+			return
+		}
+		dsn.AddParam(CacheLimitParam, "")
 	}
-	if instance.writer, err = sql.Open(serializableDriver, shmRWDSN); err != nil {
+	if cache > 0 {
+		l = &limits{cache: ConnectionCacheLimit(cache)}
+	}
+	return
+}
+
+// SetSoftHeapLimit sets the process-wide soft heap limit of SQLite in bytes, 0 means no limit.
+func SetSoftHeapLimit(limit uint64) (err error) {
+	var db *sql.DB
+	if db, err = sql.Open(serializableDriver, ":memory:"); err != nil {
 		return
 	}
-	s = instance
+	defer db.Close()
+	_, err = db.Exec(fmt.Sprintf("PRAGMA soft_heap_limit=%d", limit))
 	return
 }
 
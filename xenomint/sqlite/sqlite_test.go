@@ -17,6 +17,7 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"math/rand"
@@ -28,6 +29,7 @@ import (
 	"time"
 
 	xi "github.com/CovenantSQL/CovenantSQL/xenomint/interfaces"
+	sqlite3 "github.com/CovenantSQL/go-sqlite3-encrypt"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -1142,3 +1144,262 @@ func idleWriteTx(
 //	})
 //	teardownBenchmarkStorage(b, st)
 //}
+
+func TestStorageLimits(t *testing.T) {
+	Convey("Given a sqlite storage with resource limits", t, func() {
+		var (
+			fl         = path.Join(testingDataDir, t.Name())
+			cacheLimit = 12 << 20
+			st         xi.Storage
+			err        error
+		)
+		st, err = NewSqlite(fmt.Sprintf("file:%s?%s=%d", fl, CacheLimitParam, cacheLimit))
+		So(err, ShouldBeNil)
+		Reset(func() {
+			err = st.Close()
+			So(err, ShouldBeNil)
+			for _, v := range []string{fl, fmt.Sprint(fl, "-shm"), fmt.Sprint(fl, "-wal")} {
+				err = os.Remove(v)
+				So(err == nil || os.IsNotExist(err), ShouldBeTrue)
+			}
+		})
+		Convey("The limits should be applied to the connections", func() {
+			var cacheSize int64
+			err = st.Reader().QueryRow("PRAGMA cache_size").Scan(&cacheSize)
+			So(err, ShouldBeNil)
+			So(cacheSize, ShouldEqual, -int64(ConnectionCacheLimit(uint64(cacheLimit))>>10))
+			So(st.Writer().Stats().MaxOpenConnections, ShouldEqual, LimitedPoolSize)
+		})
+		Convey("The storage should not limit the space of replicated writes", func() {
+			_, err = st.Writer().Exec(`CREATE TABLE "t1" ("k" INT, "v" BLOB, PRIMARY KEY("k"))`)
+			So(err, ShouldBeNil)
+			for i := 0; i < 64; i++ {
+				_, err = st.Writer().Exec(
+					`INSERT INTO "t1" ("k", "v") VALUES (?, ?)`, i, make([]byte, 4<<10))
+				So(err, ShouldBeNil)
+			}
+		})
+		Convey("The storage should reject invalid limit parameters", func() {
+			_, err := NewSqlite(fmt.Sprintf("file:%s?%s=abc", fl, CacheLimitParam))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestRecursiveTriggers(t *testing.T) {
+	Convey("Given sqlite storages of a new and an existing database", t, func() {
+		var (
+			fl1 = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x1"))
+			fl2 = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x2"))
+			fl3 = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x3"))
+			st1 *SQLite3
+			st2 *SQLite3
+			err error
+		)
+		st1, err = NewSqlite(fmt.Sprint("file:", fl1))
+		So(err, ShouldBeNil)
+		// the existing database is created without the recursive triggers recorded
+		conn, err := (&sqlite3.SQLiteDriver{}).Open(fl2)
+		So(err, ShouldBeNil)
+		_, err = conn.(*sqlite3.SQLiteConn).Exec(`CREATE TABLE "t0" ("k" INT)`, nil)
+		So(err, ShouldBeNil)
+		So(conn.Close(), ShouldBeNil)
+		st2, err = NewSqlite(fmt.Sprint("file:", fl2))
+		So(err, ShouldBeNil)
+		Reset(func() {
+			So(st1.Close(), ShouldBeNil)
+			So(st2.Close(), ShouldBeNil)
+			for _, fl := range []string{fl1, fl2, fl3} {
+				for _, v := range []string{fl, fmt.Sprint(fl, "-shm"), fmt.Sprint(fl, "-wal")} {
+					err = os.Remove(v)
+					So(err == nil || os.IsNotExist(err), ShouldBeTrue)
+				}
+			}
+		})
+		replace := func(st *SQLite3) (deleted int) {
+			for _, q := range []string{
+				`CREATE TABLE "t1" ("k" INT PRIMARY KEY, "v" TEXT)`,
+				`CREATE TABLE "t2" ("k" INT)`,
+				`CREATE TRIGGER "t1_delete" AFTER DELETE ON "t1" BEGIN INSERT INTO "t2" VALUES (old."k"); END`,
+				`INSERT INTO "t1" VALUES (1, 'a')`,
+				`REPLACE INTO "t1" VALUES (1, 'b')`,
+			} {
+				_, err := st.Writer().Exec(q)
+				So(err, ShouldBeNil)
+			}
+			err := st.Writer().QueryRow(`SELECT COUNT(*) FROM "t2"`).Scan(&deleted)
+			So(err, ShouldBeNil)
+			return
+		}
+		Convey("The new database should fire the delete triggers on replace", func() {
+			So(replace(st1), ShouldEqual, 1)
+		})
+		Convey("The existing database should keep the triggers non-recursive", func() {
+			So(replace(st2), ShouldEqual, 0)
+		})
+		Convey("The recursive triggers should be restored with the database content", func() {
+			var (
+				ctx  = context.Background()
+				conn *sql.Conn
+			)
+			conn, err = st1.Reader().Conn(ctx)
+			So(err, ShouldBeNil)
+			err = st1.Backup(ctx, conn, fl3)
+			So(conn.Close(), ShouldBeNil)
+			So(err, ShouldBeNil)
+			err = st2.Restore(ctx, fl3)
+			So(err, ShouldBeNil)
+			So(replace(st2), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestDeterministicFunctions(t *testing.T) {
+	Convey("Given a sqlite storage with deterministic functions", t, func() {
+		var (
+			fl  = path.Join(testingDataDir, t.Name())
+			st  xi.Storage
+			err error
+			now = time.Date(2019, 3, 1, 12, 30, 45, 0, time.UTC)
+			ctx = context.Background()
+		)
+		st, err = NewSqlite(fmt.Sprint("file:", fl))
+		So(err, ShouldBeNil)
+		Reset(func() {
+			err = st.Close()
+			So(err, ShouldBeNil)
+			for _, v := range []string{fl, fmt.Sprint(fl, "-shm"), fmt.Sprint(fl, "-wal")} {
+				err = os.Remove(v)
+				So(err == nil || os.IsNotExist(err), ShouldBeTrue)
+			}
+		})
+		query := func(seed int64) (ts string, r int64, b []byte) {
+			tx, err := st.Writer().Begin()
+			So(err, ShouldBeNil)
+			defer tx.Rollback()
+			err = SetQueryContext(ctx, tx, now, seed)
+			So(err, ShouldBeNil)
+			err = tx.QueryRow(fmt.Sprintf("SELECT datetime(%s()), %s(), %s(4)",
+				NowFunc, RandomFunc, RandomBlobFunc)).Scan(&ts, &r, &b)
+			So(err, ShouldBeNil)
+			return
+		}
+		Convey("The functions should return the same results with the same context", func() {
+			ts1, r1, b1 := query(1)
+			ts2, r2, b2 := query(1)
+			So(ts1, ShouldEqual, "2019-03-01 12:30:45")
+			So(ts2, ShouldEqual, ts1)
+			So(r2, ShouldEqual, r1)
+			So(b1, ShouldHaveLength, 4)
+			So(b2, ShouldResemble, b1)
+			_, r3, _ := query(2)
+			So(r3, ShouldNotEqual, r1)
+		})
+		Convey("The functions should fail without query context", func() {
+			conn, err := st.Writer().Conn(ctx)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			var v interface{}
+			for _, f := range []string{NowFunc + "()", RandomFunc + "()", RandomBlobFunc + "(4)"} {
+				err = conn.QueryRowContext(ctx, "SELECT "+f).Scan(&v)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, ErrMissingQueryContext.Error())
+			}
+			err = SetQueryContext(ctx, conn, now, 0)
+			So(err, ShouldBeNil)
+			err = conn.QueryRowContext(ctx, "SELECT "+NowFunc+"()").Scan(&v)
+			So(err, ShouldBeNil)
+			err = ClearQueryContext(ctx, conn)
+			So(err, ShouldBeNil)
+			err = conn.QueryRowContext(ctx, "SELECT "+NowFunc+"()").Scan(&v)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("The now function should be usable as column default value", func() {
+			_, err = st.Writer().Exec(fmt.Sprintf(
+				`CREATE TABLE "t1" ("k" INT, "ts" TEXT DEFAULT (datetime(%s())))`, NowFunc))
+			So(err, ShouldBeNil)
+			conn, err := st.Writer().Conn(ctx)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			err = SetQueryContext(ctx, conn, now, 0)
+			So(err, ShouldBeNil)
+			_, err = conn.ExecContext(ctx, `INSERT INTO "t1" ("k") VALUES (1)`)
+			So(err, ShouldBeNil)
+			var ts string
+			err = conn.QueryRowContext(ctx, `SELECT "ts" FROM "t1"`).Scan(&ts)
+			So(err, ShouldBeNil)
+			So(ts, ShouldEqual, "2019-03-01 12:30:45")
+		})
+	})
+}
+
+func TestVMSteps(t *testing.T) {
+	Convey("Given a sqlite storage with vm step meter", t, func() {
+		var (
+			fl  = path.Join(testingDataDir, t.Name())
+			st  xi.Storage
+			err error
+			ctx = context.Background()
+		)
+		st, err = NewSqlite(fmt.Sprint("file:", fl))
+		So(err, ShouldBeNil)
+		Reset(func() {
+			err = st.Close()
+			So(err, ShouldBeNil)
+			for _, v := range []string{fl, fmt.Sprint(fl, "-shm"), fmt.Sprint(fl, "-wal")} {
+				err = os.Remove(v)
+				So(err == nil || os.IsNotExist(err), ShouldBeTrue)
+			}
+		})
+		Convey("The steps should be metered by the query work", func() {
+			conn, err := st.Writer().Conn(ctx)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			measure := func(query string) (steps uint64) {
+				start, err := VMSteps(ctx, conn)
+				So(err, ShouldBeNil)
+				_, err = conn.ExecContext(ctx, query)
+				So(err, ShouldBeNil)
+				end, err := VMSteps(ctx, conn)
+				So(err, ShouldBeNil)
+				return end - start
+			}
+			So(measure(`SELECT 1`), ShouldEqual, 0)
+			steps := measure(`WITH RECURSIVE "c"("x") AS (SELECT 1 UNION ALL SELECT "x" + 1 FROM "c" LIMIT 10000)
+SELECT count(*) FROM "c"`)
+			So(steps, ShouldBeGreaterThanOrEqualTo, 10000)
+			So(steps%ProgressStepInterval, ShouldEqual, 0)
+		})
+		Convey("The change capture triggers should not be metered", func() {
+			conn, err := st.Writer().Conn(ctx)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			const insert = `INSERT INTO "t" WITH RECURSIVE "c"("x") AS
+(SELECT 1 UNION ALL SELECT "x" + 1 FROM "c" LIMIT 5000) SELECT "x", 'v' || "x" FROM "c"`
+			measure := func() (steps uint64) {
+				start, err := VMSteps(ctx, conn)
+				So(err, ShouldBeNil)
+				_, err = conn.ExecContext(ctx, insert)
+				So(err, ShouldBeNil)
+				end, err := VMSteps(ctx, conn)
+				So(err, ShouldBeNil)
+				_, err = conn.ExecContext(ctx, `DELETE FROM "t"`)
+				So(err, ShouldBeNil)
+				return end - start
+			}
+			_, err = conn.ExecContext(ctx, `CREATE TABLE "t" ("k" INT PRIMARY KEY, "v" TEXT)`)
+			So(err, ShouldBeNil)
+			plain := measure()
+			So(plain, ShouldBeGreaterThan, 0)
+			err = PrepareChangeCapture(ctx, conn)
+			So(err, ShouldBeNil)
+			captured := measure()
+			changes, err := DrainChanges(ctx, conn)
+			So(err, ShouldBeNil)
+			So(len(changes), ShouldEqual, 10000)
+			// the trigger programs are excluded, only the plan changes of the statement for the
+			// triggers, e.g. buffering the selected rows, are still metered
+			So(captured, ShouldBeLessThan, plain*3/2)
+		})
+	})
+}
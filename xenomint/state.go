@@ -19,6 +19,7 @@ package xenomint
 import (
 	"context"
 	"database/sql"
+	"encoding/binary"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,12 +28,14 @@ import (
 	"github.com/CovenantSQL/CovenantSQL/types"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
 	xi "github.com/CovenantSQL/CovenantSQL/xenomint/interfaces"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
 	"github.com/pkg/errors"
 )
 
 type sqlQuerier interface {
 	Query(query string, args ...interface{}) (*sql.Rows, error)
 	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 type sqlExecuter interface {
@@ -70,6 +73,9 @@ type State struct {
 	lastCommitPoint uint64
 	current         uint64 // current is the current lastSeq of the current transaction
 	hasSchemaChange uint32 // indicates schema change happens in this uncommitted transaction
+
+	changes *changeLog        // captured row changes, nil if the change capture is disabled
+	pending []types.RowChange // captured row changes of the current request
 }
 
 // NewState returns a new State bound to strg.
@@ -116,6 +122,16 @@ func (s *State) getSeq() uint64 {
 	return atomic.LoadUint64(&s.current)
 }
 
+// checkStaleness checks the state has applied the min log offset required by the read query
+// before it's executed.
+func (s *State) checkStaleness(req *types.Request) (err error) {
+	if seq := s.getSeq(); seq < req.Header.MinLogOffset {
+		err = errors.Wrapf(ErrStaleRead, "state at log offset %d, required %d",
+			seq, req.Header.MinLogOffset)
+	}
+	return
+}
+
 func (s *State) getLastCommitPoint() uint64 {
 	return atomic.LoadUint64(&s.lastCommitPoint)
 }
@@ -150,46 +166,148 @@ func buildTypeNamesFromSQLColumnTypes(types []*sql.ColumnType) (names []string)
 }
 
 func readSingle(
-	ctx context.Context, qer sqlQuerier, q *types.Query,
+	ctx context.Context, qer sqlQuerier, dialect types.QueryDialect, q *types.Query,
+	limiter *resultLimiter,
 ) (
 	names []string, types []string, data [][]interface{}, err error,
+) {
+	var rows *sql.Rows
+	if rows, names, types, err = openRows(ctx, qer, dialect, q); err != nil {
+		return
+	}
+	defer rows.Close()
+	// Scan data row by row
+	data = make([][]interface{}, 0)
+	for rows.Next() {
+		var row []interface{}
+		if row, err = scanRow(rows, len(names)); err != nil {
+			return
+		}
+		if err = limiter.add(row); err != nil {
+			return
+		}
+		data = append(data, row)
+	}
+	// Check the iteration error of limited queries, e.g., interrupted by the query limits.
+	// Unlimited queries keep ignoring it, as writes in read queries are silently discarded.
+	if limiter != nil {
+		err = rows.Err()
+	}
+	return
+}
+
+// openRows runs the read query q and returns the result rows with the column names and types,
+// the rows should be closed by the caller.
+func openRows(
+	ctx context.Context, qer sqlQuerier, dialect types.QueryDialect, q *types.Query,
+) (
+	rows *sql.Rows, names []string, types []string, err error,
 ) {
 	var (
-		rows    *sql.Rows
 		cols    []*sql.ColumnType
 		pattern string
 		args    []interface{}
 	)
-
-	if _, pattern, args, err = convertQueryAndBuildArgs(q.Pattern, q.Args); err != nil {
+	if _, pattern, args, err = convertQueryAndBuildArgs(
+		q.Pattern, q.Args, newQueryDialect(ctx, qer, dialect), nil,
+	); err != nil {
 		return
 	}
 	if rows, err = qer.QueryContext(ctx, pattern, args...); err != nil {
 		return
 	}
-	defer rows.Close()
 	// Fetch column names and types
-	if names, err = rows.Columns(); err != nil {
-		return
+	if names, err = rows.Columns(); err == nil {
+		cols, err = rows.ColumnTypes()
 	}
-	if cols, err = rows.ColumnTypes(); err != nil {
+	if err != nil {
+		rows.Close()
+		rows = nil
 		return
 	}
 	types = buildTypeNamesFromSQLColumnTypes(cols)
-	// Scan data row by row
-	data = make([][]interface{}, 0)
-	for rows.Next() {
-		var (
-			row  = make([]interface{}, len(cols))
-			dest = make([]interface{}, len(cols))
-		)
-		for i := range row {
-			dest[i] = &row[i]
-		}
-		if err = rows.Scan(dest...); err != nil {
+	return
+}
+
+// scanRow scans the current row of rows with n columns.
+func scanRow(rows *sql.Rows, n int) (row []interface{}, err error) {
+	var dest = make([]interface{}, n)
+	row = make([]interface{}, n)
+	for i := range row {
+		dest[i] = &row[i]
+	}
+	err = rows.Scan(dest...)
+	return
+}
+
+// setQueryContext sets the request time and the random seed derived from the request hash to the
+// connection of e, so that the rewritten time and random functions produce the same results on
+// all the peers executing the request.
+func setQueryContext(ctx context.Context, e xs.Execer, req *types.Request) (err error) {
+	h := req.Header.Hash()
+	if err = xs.SetQueryContext(
+		ctx, e, req.Header.Timestamp, int64(binary.BigEndian.Uint64(h[:8])),
+	); err != nil {
+		err = errors.Wrap(err, "set query context failed")
+	}
+	return
+}
+
+// requestExecuter returns the executer bound to a single connection with the query context of req,
+// the release function should be called after the queries of req are executed.
+func (s *State) requestExecuter(
+	ctx context.Context, req *types.Request) (e xs.Querier, release func(), err error,
+) {
+	var closeConn = func() {}
+	e = s.executer
+	if db, ok := s.executer.(*sqlDB); ok {
+		var conn *sql.Conn
+		if conn, err = db.Conn(ctx); err != nil {
+			err = errors.Wrap(err, "get connection failed")
 			return
 		}
-		data = append(data, row)
+		e, closeConn = conn, func() { conn.Close() }
+	}
+	if err = setQueryContext(ctx, e, req); err != nil {
+		closeConn()
+		return
+	}
+	release = func() {
+		// clear the context before the connection is released
+		xs.ClearQueryContext(context.Background(), e)
+		closeConn()
+	}
+	return
+}
+
+// readVMSteps returns the accumulated VM steps of the connection of q.
+func readVMSteps(ctx context.Context, q xs.RowQuerier) (steps uint64, err error) {
+	if steps, err = xs.VMSteps(ctx, q); err != nil {
+		err = errors.Wrap(err, "read vm steps failed")
+	}
+	return
+}
+
+// rowSize returns the approximate size of a native data row returned to client.
+func rowSize(row []interface{}) (size uint64) {
+	for _, v := range row {
+		switch v := v.(type) {
+		case nil:
+		case []byte:
+			size += uint64(len(v))
+		case string:
+			size += uint64(len(v))
+		default:
+			size += 8
+		}
+	}
+	return
+}
+
+// payloadSize returns the approximate size of the native data returned to client.
+func payloadSize(data [][]interface{}) (size uint64) {
+	for _, row := range data {
+		size += rowSize(row)
 	}
 	return
 }
@@ -213,16 +331,28 @@ func (s *State) readWithContext(
 		ierr           error
 		cnames, ctypes []string
 		data           [][]interface{}
+		cost           types.QueryCost
 	)
+	if err = s.checkStaleness(req); err != nil {
+		return
+	}
+	limit := queryLimitFromContext(ctx)
+	ctx, cancel := limitedQueryContext(ctx, limit)
+	defer cancel()
 	// TODO(leventeliu): no need to run every read query here.
 	for i, v := range req.Payload.Queries {
-		if cnames, ctypes, data, ierr = readSingle(ctx, s.reader(), &v); ierr != nil {
-			err = errors.Wrapf(ierr, "query at #%d failed", i)
+		if cnames, ctypes, data, ierr = readSingle(
+			ctx, s.reader(), req.Header.Dialect, &v, newResultLimiter(limit),
+		); ierr != nil {
+			err = errors.Wrapf(queryLimitError(ctx, limit, 0, ierr), "query at #%d failed", i)
 			// Add to failed pool list
 			s.pool.setFailed(req)
 			return
 		}
+		cost.RowsRead += uint64(len(data))
 	}
+	// VM steps are not metered on the connection pool
+	cost.BytesReturned = payloadSize(data)
 	// Build query response
 	ref = &QueryTracker{Req: req}
 	resp = &types.Response{
@@ -234,6 +364,7 @@ func (s *State) readWithContext(
 				Timestamp:   s.getLocalTime(),
 				RowCount:    uint64(len(data)),
 				LogOffset:   s.getSeq(),
+				Cost:        cost,
 			},
 		},
 		Payload: types.ResponsePayload{
@@ -250,15 +381,25 @@ func (s *State) readTx(
 ) {
 	var (
 		id             = s.getSeq()
+		limit          = queryLimitFromContext(ctx)
 		ierr           error
 		cnames, ctypes []string
 		data           [][]interface{}
 		querier        sqlQuerier
+		cost           types.QueryCost
+		steps          uint64
 	)
+	if err = s.checkStaleness(req); err != nil {
+		return
+	}
 	if s.level == sql.LevelReadUncommitted && atomic.LoadUint32(&s.hasSchemaChange) == 1 {
 		// lock transaction
 		s.Lock()
 		defer s.Unlock()
+		if err = setQueryContext(ctx, s.executer, req); err != nil {
+			return
+		}
+		defer xs.ClearQueryContext(context.Background(), s.executer)
 		querier = s.executer
 	} else {
 		var tx *sql.Tx
@@ -266,8 +407,13 @@ func (s *State) readTx(
 			err = errors.Wrap(ierr, "open tx failed")
 			return
 		}
-		querier = tx
 		defer tx.Rollback()
+		if err = setQueryContext(ctx, tx, req); err != nil {
+			return
+		}
+		// clear the context before the connection is released
+		defer xs.ClearQueryContext(context.Background(), tx)
+		querier = tx
 	}
 
 	defer func() {
@@ -280,14 +426,42 @@ func (s *State) readTx(
 		}
 	}()
 
+	if steps, err = readVMSteps(ctx, querier); err != nil {
+		return
+	}
+	if limit.MaxVMSteps > 0 {
+		if err = xs.SetVMStepBudget(ctx, querier, limit.MaxVMSteps); err != nil {
+			err = errors.Wrap(err, "set vm step budget failed")
+			return
+		}
+		// clear the budget before the connection is released
+		defer xs.SetVMStepBudget(context.Background(), querier, 0)
+	}
+	queryCtx, cancel := limitedQueryContext(ctx, limit)
+	defer cancel()
 	for i, v := range req.Payload.Queries {
-		if cnames, ctypes, data, ierr = readSingle(ctx, querier, &v); ierr != nil {
+		if cnames, ctypes, data, ierr = readSingle(
+			queryCtx, querier, req.Header.Dialect, &v, newResultLimiter(limit),
+		); ierr != nil {
+			if limit.MaxVMSteps > 0 {
+				if cur, serr := readVMSteps(context.Background(), querier); serr == nil {
+					ierr = queryLimitError(queryCtx, limit, cur-steps, ierr)
+				}
+			} else {
+				ierr = queryLimitError(queryCtx, limit, 0, ierr)
+			}
 			err = errors.Wrapf(ierr, "query at #%d failed", i)
 			// Add to failed pool list
 			s.pool.setFailed(req)
 			return
 		}
+		cost.RowsRead += uint64(len(data))
+	}
+	if cost.VMSteps, err = readVMSteps(ctx, querier); err != nil {
+		return
 	}
+	cost.VMSteps -= steps
+	cost.BytesReturned = payloadSize(data)
 	// Build query response
 	ref = &QueryTracker{Req: req}
 	resp = &types.Response{
@@ -299,6 +473,7 @@ func (s *State) readTx(
 				Timestamp:   s.getLocalTime(),
 				RowCount:    uint64(len(data)),
 				LogOffset:   id,
+				Cost:        cost,
 			},
 		},
 		Payload: types.ResponsePayload{
@@ -310,8 +485,13 @@ func (s *State) readTx(
 	return
 }
 
+// writeSingle executes the write query q, the VM steps of the query are added to steps if it's not
+// nil. Only the query itself is metered, the internal statements like the query translation and
+// the change capture are excluded.
 func (s *State) writeSingle(
-	ctx context.Context, q *types.Query) (res sql.Result, err error,
+	ctx context.Context, e xs.Querier, dialect types.QueryDialect, q *types.Query, steps *uint64,
+) (
+	res sql.Result, err error,
 ) {
 	var (
 		containsDDL bool
@@ -333,11 +513,39 @@ func (s *State) writeSingle(
 	//	}
 	//	log.WithFields(fields).Debug("writeSingle duration stat (us)")
 	//}()
-	if containsDDL, pattern, args, err = convertQueryAndBuildArgs(q.Pattern, q.Args); err != nil {
+	if containsDDL, pattern, args, err = convertQueryAndBuildArgs(
+		q.Pattern, q.Args, newQueryDialect(context.Background(), e, dialect),
+		newDefaultsResolver(context.Background(), e),
+	); err != nil {
 		return
 	}
 	//parsed = time.Since(start)
-	if res, err = s.executer.Exec(pattern, args...); err == nil {
+	if s.changes != nil {
+		if err = xs.PrepareChangeCapture(context.Background(), e); err != nil {
+			return
+		}
+	}
+	var start uint64
+	if steps != nil {
+		if start, err = readVMSteps(ctx, e); err != nil {
+			return
+		}
+	}
+	res, err = e.ExecContext(context.Background(), pattern, args...)
+	if steps != nil && err == nil {
+		var end uint64
+		if end, err = readVMSteps(context.Background(), e); err != nil {
+			return
+		}
+		*steps += end - start
+	}
+	if s.changes != nil {
+		// Always drain the captured changes, which may be partial on failure
+		if ierr := s.captureChanges(e); err == nil {
+			err = ierr
+		}
+	}
+	if err == nil {
 		if containsDDL {
 			atomic.StoreUint32(&s.hasSchemaChange, 1)
 		}
@@ -356,6 +564,7 @@ func (s *State) write(
 		totalAffectedRows int64
 		curAffectedRows   int64
 		lastInsertID      int64
+		cost              types.QueryCost
 		start             = time.Now()
 
 		lockAcquired, writeDone, enqueued, lockReleased, respBuilt time.Duration
@@ -403,9 +612,19 @@ func (s *State) write(
 			}
 			defer s.executer.Exec(`ROLLBACK TO "?"`, lastSeq)
 		}
+		var (
+			e       xs.Querier
+			release func()
+		)
+		s.beginChanges(lastSeq)
+		if e, release, err = s.requestExecuter(ctx, req); err != nil {
+			s.pool.setFailed(req)
+			return
+		}
+		defer release()
 		for i, v := range req.Payload.Queries {
 			var res sql.Result
-			if res, ierr = s.writeSingle(ctx, &v); ierr != nil {
+			if res, ierr = s.writeSingle(ctx, e, req.Header.Dialect, &v, &cost.VMSteps); ierr != nil {
 				err = errors.Wrapf(ierr, "execute at #%d failed", i)
 				// TODO(leventeliu): request may actually be partial successed without
 				// rolling back.
@@ -417,6 +636,8 @@ func (s *State) write(
 			lastInsertID, _ = res.LastInsertId()
 			totalAffectedRows += curAffectedRows
 		}
+		cost.RowsWritten = uint64(totalAffectedRows)
+		s.commitChanges()
 		if s.level == sql.LevelReadUncommitted {
 			if qcnt > 1 {
 				// Release savepoint
@@ -428,7 +649,7 @@ func (s *State) write(
 		} else {
 			// NOTE(leventeliu): this will cancel any uncommitted transaction, and do not harm to
 			// committed ones.
-			s.executer.Exec(`ROLLBACK`)
+			e.ExecContext(context.Background(), `ROLLBACK`)
 		}
 		// Try to commit if the ongoing tx is too large or schema is changed
 		if s.getSeq()-s.getLastCommitPoint() > s.maxTx ||
@@ -457,6 +678,7 @@ func (s *State) write(
 				LogOffset:    lastSeq,
 				AffectedRows: totalAffectedRows,
 				LastInsertID: lastInsertID,
+				Cost:         cost,
 			},
 		},
 	}
@@ -480,12 +702,19 @@ func (s *State) replay(ctx context.Context, req *types.Request, resp *types.Resp
 		)
 		return
 	}
+	s.beginChanges(lastSeq)
+	e, release, err := s.requestExecuter(ctx, req)
+	if err != nil {
+		return
+	}
+	defer release()
 	for i, v := range req.Payload.Queries {
-		if _, ierr = s.writeSingle(ctx, &v); ierr != nil {
+		if _, ierr = s.writeSingle(ctx, e, req.Header.Dialect, &v, nil); ierr != nil {
 			err = errors.Wrapf(ierr, "execute at #%d failed", i)
 			return
 		}
 	}
+	s.commitChanges()
 	// Try to commit if the ongoing tx is too large or schema is changed
 	if s.getSeq()-s.getLastCommitPoint() > s.maxTx ||
 		atomic.LoadUint32(&s.hasSchemaChange) != 0 {
@@ -505,7 +734,6 @@ func (s *State) ReplayBlock(block *types.Block) (err error) {
 // skips some preceding pooled queries.
 func (s *State) ReplayBlockWithContext(ctx context.Context, block *types.Block) (err error) {
 	var (
-		ierr   error
 		lastsp uint64 // Last lastSeq
 	)
 	s.Lock()
@@ -529,15 +757,8 @@ func (s *State) ReplayBlockWithContext(ctx context.Context, block *types.Block)
 			continue
 		}
 		// Replay query
-		for j, v := range q.Request.Payload.Queries {
-			if q.Request.Header.QueryType != types.WriteQuery {
-				err = errors.Wrapf(ErrInvalidRequest, "replay block at %d:%d", i, j)
-				return
-			}
-			if _, ierr = s.writeSingle(ctx, &v); ierr != nil {
-				err = errors.Wrapf(ierr, "execute at %d:%d failed", i, j)
-				return
-			}
+		if err = s.replayBlockQuery(ctx, i, q.Request); err != nil {
+			return
 		}
 		s.pool.enqueue(lastsp, query)
 	}
@@ -552,6 +773,28 @@ func (s *State) ReplayBlockWithContext(ctx context.Context, block *types.Block)
 	return
 }
 
+// replayBlockQuery replays the write queries of the i-th request in block.
+func (s *State) replayBlockQuery(ctx context.Context, i int, req *types.Request) (err error) {
+	if req.Header.QueryType != types.WriteQuery {
+		err = errors.Wrapf(ErrInvalidRequest, "replay block at %d", i)
+		return
+	}
+	s.beginChanges(s.getSeq())
+	e, release, err := s.requestExecuter(ctx, req)
+	if err != nil {
+		return
+	}
+	defer release()
+	for j, v := range req.Payload.Queries {
+		if _, err = s.writeSingle(ctx, e, req.Header.Dialect, &v, nil); err != nil {
+			err = errors.Wrapf(err, "execute at %d:%d failed", i, j)
+			return
+		}
+	}
+	s.commitChanges()
+	return
+}
+
 func (s *State) commit() (err error) {
 	var (
 		start = time.Now()
@@ -710,6 +953,23 @@ func (s *State) ReplayWithContext(
 	return
 }
 
+// Usage returns the storage space used by the State in bytes, and the count of open storage
+// connections.
+func (s *State) Usage() (space uint64, conns int, err error) {
+	var pageCount, pageSize uint64
+	if err = s.reader().QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return
+	}
+	if err = s.reader().QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return
+	}
+	space = pageCount * pageSize
+	for _, v := range []*sql.DB{s.strg.DirtyReader(), s.strg.Reader(), s.strg.Writer()} {
+		conns += v.Stats().OpenConnections
+	}
+	return
+}
+
 // Stat prints the statistic message of the State object.
 func (s *State) Stat(id proto.DatabaseID) {
 	var (
@@ -20,10 +20,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/crypto/verifier"
@@ -144,6 +147,19 @@ func TestState(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(resp.Header.RowCount, ShouldEqual, 0)
 			})
+			Convey("The state should reject read query requiring a later log offset", func() {
+				req = buildRequest(types.ReadQuery, []types.Query{
+					buildQuery(`SELECT v FROM t1 WHERE k=?`, 1),
+				})
+				req.Header.MinLogOffset = st1.getSeq() + 1
+				_, resp, err = st1.Query(req, true)
+				So(errors.Cause(err), ShouldEqual, ErrStaleRead)
+				So(resp, ShouldBeNil)
+				req.Header.MinLogOffset = st1.getSeq()
+				_, resp, err = st1.Query(req, true)
+				So(err, ShouldBeNil)
+				So(resp, ShouldNotBeNil)
+			})
 			Convey("The state should report invalid request with unknown query type", func() {
 				req = buildRequest(types.QueryType(0xff), []types.Query{
 					buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, values[0]...),
@@ -248,6 +264,17 @@ INSERT INTO t1 (k, v) VALUES (?, ?)`, concat(values[2:4])...),
 					},
 				})
 				st1.Stat(id1)
+				So(resp.Header.Cost.RowsRead, ShouldEqual, 4)
+				So(resp.Header.Cost.BytesReturned, ShouldBeGreaterThan, 0)
+
+				// heavy query costs more vm steps
+				_, resp, err = st1.Query(buildRequest(types.ReadQuery, []types.Query{
+					buildQuery(`SELECT count(*) FROM t1 a, t1 b, t1 c, t1 d, t1 e, t1 f`),
+				}), true)
+				So(err, ShouldBeNil)
+				So(resp.Header.RowCount, ShouldEqual, 1)
+				So(resp.Header.Cost.RowsRead, ShouldEqual, 1)
+				So(resp.Header.Cost.VMSteps, ShouldBeGreaterThan, 0)
 
 				_, resp, err = st1.Query(buildRequest(types.ReadQuery, []types.Query{
 					buildQuery(`SELECT * FROM t1`),
@@ -366,6 +393,74 @@ INSERT INTO t1 (k, v) VALUES (?, ?)`, concat(values[2:4])...),
 					So(resp1.Payload, ShouldResemble, resp2.Payload)
 				}
 			})
+			Convey("The state should be restorable from snapshot in another instance", func() {
+				_, resp, err = st1.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, values[0]...),
+					buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, values[1]...),
+					buildQuery(`CREATE INDEX t1_v ON t1 (v)`),
+					buildQuery(`CREATE TABLE t2 (id INTEGER PRIMARY KEY AUTOINCREMENT, v BLOB)`),
+					buildQuery(`INSERT INTO t2 (v) VALUES (?)`, []byte{0, 1, 2}),
+				}), true)
+				So(err, ShouldBeNil)
+				var (
+					seq   uint64
+					write func(string) error
+					file  = fmt.Sprint(fl1, ".snap")
+				)
+				defer os.Remove(file)
+				var pinnedSeq uint64
+				seq, write, err = st1.Snapshot(func() { pinnedSeq = st1.getSeq() })
+				So(err, ShouldBeNil)
+				So(seq, ShouldEqual, st1.getSeq())
+				So(pinnedSeq, ShouldEqual, seq)
+
+				// queries after the snapshot is pinned are not in the snapshot
+				_, resp, err = st1.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`CREATE TABLE t4 (k INT)`),
+				}), true)
+				So(err, ShouldBeNil)
+				err = write(file)
+				So(err, ShouldBeNil)
+
+				// st2 has different content before restore
+				_, resp, err = st2.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, values[3]...),
+					buildQuery(`CREATE TABLE t3 (k INT)`),
+				}), true)
+				So(err, ShouldBeNil)
+				err = st2.Seed(file, seq)
+				So(errors.Cause(err), ShouldEqual, ErrStateWritten)
+				err = st2.Restore(file, seq)
+				So(err, ShouldBeNil)
+				So(st2.getSeq(), ShouldEqual, seq)
+
+				for _, q := range []string{
+					`SELECT k, v FROM t1 ORDER BY k`,
+					`SELECT id, v FROM t2`,
+					`SELECT name FROM sqlite_master WHERE name <> 't4' ORDER BY name`,
+					`SELECT seq FROM sqlite_sequence WHERE name='t2'`,
+				} {
+					var resp1, resp2 *types.Response
+					req = buildRequest(types.ReadQuery, []types.Query{buildQuery(q)})
+					_, resp1, err = st1.Query(req, true)
+					So(err, ShouldBeNil)
+					_, resp2, err = st2.Query(req, true)
+					So(err, ShouldBeNil)
+					So(resp2.Payload, ShouldResemble, resp1.Payload)
+				}
+				_, resp, err = st2.Query(buildRequest(types.ReadQuery, []types.Query{
+					buildQuery(`SELECT COUNT(*) FROM sqlite_master WHERE name = 't4'`),
+				}), true)
+				So(err, ShouldBeNil)
+				So(resp.Payload.Rows[0].Values[0], ShouldEqual, 0)
+
+				err = st2.Restore(fmt.Sprint(fl1, ".missing"), seq)
+				So(err, ShouldNotBeNil)
+				err = ioutil.WriteFile(file, []byte("invalid"), 0600)
+				So(err, ShouldBeNil)
+				err = st2.Restore(file, seq)
+				So(err, ShouldNotBeNil)
+			})
 			Convey("When queries are committed to blocks on state instance #1", func() {
 				var (
 					qt   *QueryTracker
@@ -537,7 +632,7 @@ func TestConvertQueryAndBuildArgs(t *testing.T) {
 
 		// show tables query
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"SHOW TABLES", []types.NamedArg{})
+			"SHOW TABLES", []types.NamedArg{}, nil, nil)
 		So(containsDDL, ShouldBeFalse)
 		So(sanitizedQuery, ShouldContainSubstring, "sqlite_master")
 		So(sanitizedArgs, ShouldHaveLength, 0)
@@ -545,7 +640,7 @@ func TestConvertQueryAndBuildArgs(t *testing.T) {
 
 		// show index query
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"SHOW INDEX FROM TABLE a", []types.NamedArg{})
+			"SHOW INDEX FROM TABLE a", []types.NamedArg{}, nil, nil)
 		So(containsDDL, ShouldBeFalse)
 		So(sanitizedQuery, ShouldContainSubstring, "sqlite_master")
 		So(sanitizedArgs, ShouldHaveLength, 0)
@@ -553,7 +648,7 @@ func TestConvertQueryAndBuildArgs(t *testing.T) {
 
 		// show create table query
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"SHOW CREATE TABLE a", []types.NamedArg{})
+			"SHOW CREATE TABLE a", []types.NamedArg{}, nil, nil)
 		So(containsDDL, ShouldBeFalse)
 		So(sanitizedQuery, ShouldContainSubstring, "sqlite_master")
 		So(sanitizedArgs, ShouldHaveLength, 0)
@@ -561,7 +656,7 @@ func TestConvertQueryAndBuildArgs(t *testing.T) {
 
 		// desc table query
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"DESC a", []types.NamedArg{})
+			"DESC a", []types.NamedArg{}, nil, nil)
 		So(containsDDL, ShouldBeFalse)
 		So(sanitizedQuery, ShouldContainSubstring, "table_info")
 		So(sanitizedArgs, ShouldHaveLength, 0)
@@ -570,7 +665,7 @@ func TestConvertQueryAndBuildArgs(t *testing.T) {
 		// contains ddl query
 		ddlQuery := "CREATE TABLE test (test int)"
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			ddlQuery, []types.NamedArg{})
+			ddlQuery, []types.NamedArg{}, nil, nil)
 		So(containsDDL, ShouldBeTrue)
 		So(sanitizedQuery, ShouldEqual, ddlQuery)
 		So(sanitizedArgs, ShouldHaveLength, 0)
@@ -578,53 +673,138 @@ func TestConvertQueryAndBuildArgs(t *testing.T) {
 
 		// test invalid query
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"CREATE 1", []types.NamedArg{})
+			"CREATE 1", []types.NamedArg{}, nil, nil)
 		So(err, ShouldNotBeNil)
 
-		// contains stateful query parts, create table with default current_timestamp
-		ddlQuery = "CREATE TABLE test (test datetime default current_timestamp)"
-		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			ddlQuery, []types.NamedArg{})
-		So(err, ShouldNotBeNil)
-		So(errors.Cause(err), ShouldEqual, ErrStatefulQueryParts)
+		// stateful query parts are rewritten to deterministic functions
+		for _, v := range []struct {
+			query     string
+			rewritten string
+		}{
+			{
+				// column defaults are kept standard and rewritten by the inserts
+				"CREATE TABLE test (test datetime default current_timestamp)",
+				"CREATE TABLE test (test datetime default current_timestamp)",
+			},
+			{"SELECT current_timestamp", "SELECT (datetime(cql_now()))"},
+			{"SELECT current_date", "SELECT (date(cql_now()))"},
+			{"SELECT current_time", "SELECT (time(cql_now()))"},
+			{"SELECT random()", "SELECT cql_random()"},
+			{"SELECT RandomBlob(16), random ( )", "SELECT cql_randomblob(16), cql_random ( )"},
+			{"SELECT date('now'), date()", "SELECT date(cql_now()), date(cql_now())"},
+			{
+				"SELECT strftime('%s', 'NOW'), julianday(\"now\", '+1 day')",
+				"SELECT strftime('%s', cql_now()), julianday(cql_now(), '+1 day')",
+			},
+			{
+				"SELECT datetime(current_timestamp, 'now'); SELECT time('12:00', 'now')",
+				"SELECT datetime((datetime(cql_now())), cql_now()); SELECT time('12:00', cql_now())",
+			},
+			{"SELECT date('2019-01-01'), 'now'", "SELECT date('2019-01-01'), 'now'"},
+			{"INSERT INTO random (a) VALUES (1)", "INSERT INTO random (a) VALUES (1)"},
+		} {
+			_, sanitizedQuery, _, err = convertQueryAndBuildArgs(v.query, nil, nil, nil)
+			So(err, ShouldBeNil)
+			So(sanitizedQuery, ShouldEqual, v.rewritten)
+		}
 
-		// contains stateful query parts, using time expression
-		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"SELECT current_timestamp", []types.NamedArg{})
-		So(err, ShouldNotBeNil)
-		So(errors.Cause(err), ShouldEqual, ErrStatefulQueryParts)
+		// omitted columns with stateful defaults are given explicitly by the inserts
+		defaults := func(table string) ([]columnDefault, error) {
+			switch table {
+			case "t":
+				return []columnDefault{{name: "k"}, {name: "ts", expr: "CURRENT_TIMESTAMP"}}, nil
+			case "v":
+				return []columnDefault{{name: "k", expr: "1"}}, nil
+			}
+			return nil, nil
+		}
+		for _, v := range []struct {
+			query     string
+			rewritten string
+		}{
+			{
+				"INSERT INTO t (k) VALUES (1), (abs(-2))",
+				`INSERT INTO t (k, "ts") VALUES (1, (datetime(cql_now()))), (abs(-2), (datetime(cql_now())))`,
+			},
+			{
+				"INSERT INTO t (k) SELECT k FROM s",
+				`INSERT INTO t (k, "ts") SELECT *, (datetime(cql_now())) FROM (SELECT k FROM s)`,
+			},
+			{"INSERT INTO t (k, ts) VALUES (1, '2019-01-01')", "INSERT INTO t (k, ts) VALUES (1, '2019-01-01')"},
+			{"INSERT INTO t VALUES (1, '2019-01-01')", "INSERT INTO t VALUES (1, '2019-01-01')"},
+			{"INSERT INTO s (k) VALUES (1)", "INSERT INTO s (k) VALUES (1)"},
+			{
+				"CREATE TABLE u (k int, ts datetime default current_timestamp); INSERT INTO u (k) VALUES (1)",
+				`CREATE TABLE u (k int, ts datetime default current_timestamp); ` +
+					`INSERT INTO u (k, "ts") VALUES (1, (datetime(cql_now())))`,
+			},
+			{
+				"INSERT INTO t DEFAULT VALUES; INSERT INTO v DEFAULT VALUES",
+				"INSERT INTO t (`k`, `ts`) VALUES (NULL, (datetime(cql_now()))); INSERT INTO v (`k`) VALUES (1)",
+			},
+			{
+				"CREATE TRIGGER tr AFTER INSERT ON v WHEN random() > 0 BEGIN " +
+					"INSERT INTO t (k) VALUES (new.k); UPDATE v SET k = random() WHERE k = new.k; END",
+				"CREATE TRIGGER tr AFTER INSERT ON v WHEN cql_random() > 0 BEGIN " +
+					`INSERT INTO t (k, "ts") VALUES (new.k, (datetime(cql_now()))); ` +
+					"UPDATE v SET k = cql_random() WHERE k = new.k; END",
+			},
+			{
+				"CREATE TEMP TRIGGER tr AFTER DELETE ON v BEGIN INSERT INTO t DEFAULT VALUES; END;",
+				`CREATE TEMP TRIGGER tr AFTER DELETE ON v BEGIN ` +
+					"INSERT INTO t (`k`, `ts`) VALUES (NULL, (datetime(cql_now()))); END;",
+			},
+			{"BEGIN", "BEGIN"},
+			{"ROLLBACK", "ROLLBACK"},
+		} {
+			_, sanitizedQuery, _, err = convertQueryAndBuildArgs(v.query, nil, nil, defaults)
+			So(err, ShouldBeNil)
+			So(sanitizedQuery, ShouldEqual, v.rewritten)
+		}
 
+		// stateful defaults of the unknown tables could not be given explicitly
+		for _, q := range []string{
+			"INSERT INTO s DEFAULT VALUES",
+			"CREATE TRIGGER tr AFTER INSERT ON v BEGIN INSERT INTO s (k) VALUES (new.k); END",
+			"CREATE TRIGGER tr AFTER INSERT ON v BEGIN SELECT datetime('now', 'localtime'); END",
+			"CREATE TRIGGER tr AFTER INSERT ON v BEGIN INSERT INTO t (k) VALUES (new.k) END",
+			"BEGIN; SELECT random()",
+		} {
+			_, _, _, err = convertQueryAndBuildArgs(q, nil, nil, defaults)
+			So(err, ShouldNotBeNil)
+		}
+
+		// contains stateful query parts, using local time
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"SELECT current_date", []types.NamedArg{})
+			"SELECT datetime('now', 'localtime')", []types.NamedArg{}, nil, nil)
 		So(err, ShouldNotBeNil)
 		So(errors.Cause(err), ShouldEqual, ErrStatefulQueryParts)
 
+		// deterministic functions could not be called directly
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"SELECT current_time", []types.NamedArg{})
+			"SELECT cql_set_context('2019-01-01', 1)", []types.NamedArg{}, nil, nil)
 		So(err, ShouldNotBeNil)
 		So(errors.Cause(err), ShouldEqual, ErrStatefulQueryParts)
-
-		// contains stateful query parts, using random function
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"SELECT random()", []types.NamedArg{})
+			"SELECT date(cql_now(), '+1 day')", []types.NamedArg{}, nil, nil)
 		So(err, ShouldNotBeNil)
 		So(errors.Cause(err), ShouldEqual, ErrStatefulQueryParts)
 
 		// counterpart to prove successful parsing of normal query
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"SELECT 1; SELECT func(); SELECT * FROM a", []types.NamedArg{})
+			"SELECT 1; SELECT func(); SELECT * FROM a", []types.NamedArg{}, nil, nil)
 		So(err, ShouldBeNil)
 
 		// counterpart with args
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			"SELECT ?", []types.NamedArg{{Value: "1"}})
+			"SELECT ?", []types.NamedArg{{Value: "1"}}, nil, nil)
 		So(err, ShouldBeNil)
 		So(sanitizedArgs, ShouldHaveLength, 1)
 
 		// counterpart with valid default value of column definition
 		ddlQuery = "CREATE TABLE test (test int default 1)"
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			ddlQuery, []types.NamedArg{})
+			ddlQuery, []types.NamedArg{}, nil, nil)
 		So(containsDDL, ShouldBeTrue)
 		So(err, ShouldBeNil)
 		So(sanitizedQuery, ShouldEqual, ddlQuery)
@@ -633,34 +813,34 @@ func TestConvertQueryAndBuildArgs(t *testing.T) {
 		// invalid table name to create
 		ddlQuery = "CREATE TABLE sqlite_test (test int)"
 		_, _, _, err = convertQueryAndBuildArgs(
-			ddlQuery, nil)
+			ddlQuery, nil, nil, nil)
 		So(err, ShouldNotBeNil)
 		So(errors.Cause(err), ShouldEqual, ErrInvalidTableName)
 
 		// invalid table name to drop
 		ddlQuery = "DROP TABLE sqlite_test"
 		_, _, _, err = convertQueryAndBuildArgs(
-			ddlQuery, nil)
+			ddlQuery, nil, nil, nil)
 		So(err, ShouldNotBeNil)
 		So(errors.Cause(err), ShouldEqual, ErrInvalidTableName)
 
 		// invalid table name to alter
 		ddlQuery = "ALTER TABLE sqlite_test RENAME TO normal"
 		_, _, _, err = convertQueryAndBuildArgs(
-			ddlQuery, nil)
+			ddlQuery, nil, nil, nil)
 		So(err, ShouldNotBeNil)
 		So(errors.Cause(err), ShouldEqual, ErrInvalidTableName)
 
 		ddlQuery = "ALTER TABLE test RENAME TO sqlite_test"
 		_, _, _, err = convertQueryAndBuildArgs(
-			ddlQuery, nil)
+			ddlQuery, nil, nil, nil)
 		So(err, ShouldNotBeNil)
 		So(errors.Cause(err), ShouldEqual, ErrInvalidTableName)
 
 		// valid counterpart of alter statement
 		ddlQuery = "ALTER TABLE test RENAME to test2"
 		containsDDL, sanitizedQuery, sanitizedArgs, err = convertQueryAndBuildArgs(
-			ddlQuery, nil)
+			ddlQuery, nil, nil, nil)
 		So(err, ShouldBeNil)
 		So(containsDDL, ShouldBeTrue)
 		So(sanitizedQuery, ShouldEqual, ddlQuery)
@@ -753,3 +933,471 @@ func TestSerializableState(t *testing.T) {
 		})
 	})
 }
+
+func TestDeterministicQuery(t *testing.T) {
+	Convey("Given states of different isolation levels", t, func() {
+		var (
+			fl1    = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x1"))
+			fl2    = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x2"))
+			states []*State
+		)
+		for _, v := range []struct {
+			fl    string
+			level sql.IsolationLevel
+		}{
+			{fl1, sql.LevelReadUncommitted},
+			{fl2, sql.LevelSerializable},
+		} {
+			strg, err := xs.NewSqlite(fmt.Sprint("file:", v.fl))
+			So(err, ShouldBeNil)
+			states = append(states, NewState(v.level, nodeID, strg))
+		}
+		Reset(func() {
+			for i, fl := range []string{fl1, fl2} {
+				So(states[i].Close(true), ShouldBeNil)
+				for _, v := range []string{fl, fmt.Sprint(fl, "-shm"), fmt.Sprint(fl, "-wal")} {
+					err := os.Remove(v)
+					So(err == nil || os.IsNotExist(err), ShouldBeTrue)
+				}
+			}
+		})
+		Convey("The time and random functions should produce the same results", func() {
+			var (
+				req = buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`CREATE TABLE t1 (k INT, ts TEXT DEFAULT CURRENT_TIMESTAMP, d TEXT, r INT, b BLOB)`),
+					buildQuery(`INSERT INTO t1 (k, d, r, b) VALUES (1, date('now'), random(), randomblob(8))`),
+					buildQuery(`INSERT INTO t1 (k, d, r, b) VALUES (2, datetime(), random(), randomblob(8))`),
+					buildQuery(`INSERT INTO t1 (k, d, r, b) SELECT 3, d, r, b FROM t1 WHERE k = 1`),
+				})
+				results [][]types.ResponseRow
+			)
+			req.Header.Timestamp = time.Date(2019, 3, 1, 12, 30, 45, 0, time.UTC)
+			for _, st := range states {
+				_, _, err := st.Query(req, true)
+				So(err, ShouldBeNil)
+				_, resp, err := st.Query(buildRequest(types.ReadQuery, []types.Query{
+					buildQuery(`SELECT k, ts, d, r, b FROM t1 ORDER BY k`),
+				}), true)
+				So(err, ShouldBeNil)
+				So(resp.Payload.Rows, ShouldHaveLength, 3)
+				results = append(results, resp.Payload.Rows)
+
+				// the column default is kept standard in the schema
+				_, resp, err = st.Query(buildRequest(types.ReadQuery, []types.Query{
+					buildQuery(`SELECT sql FROM sqlite_master WHERE name = 't1'`),
+				}), true)
+				So(err, ShouldBeNil)
+				So(string(resp.Payload.Rows[0].Values[0].([]byte)), ShouldContainSubstring,
+					"DEFAULT CURRENT_TIMESTAMP")
+			}
+			So(results[1], ShouldResemble, results[0])
+			rows := results[0]
+			So(rows[0].Values[1], ShouldResemble, []byte("2019-03-01 12:30:45"))
+			So(rows[2].Values[1], ShouldResemble, []byte("2019-03-01 12:30:45"))
+			So(rows[0].Values[2], ShouldResemble, []byte("2019-03-01"))
+			So(rows[1].Values[2], ShouldResemble, []byte("2019-03-01 12:30:45"))
+			So(rows[1].Values[3], ShouldNotEqual, rows[0].Values[3])
+		})
+		Convey("The stateful defaults of default values and trigger inserts should be the same", func() {
+			var (
+				req = buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`CREATE TABLE t1 (k INTEGER PRIMARY KEY, ts TEXT DEFAULT CURRENT_TIMESTAMP)`),
+					buildQuery(`CREATE TABLE t2 (k INT, ts TEXT DEFAULT CURRENT_TIMESTAMP, r INT DEFAULT (random()))`),
+					buildQuery(`CREATE TRIGGER t1_log AFTER INSERT ON t1 WHEN new.k > 0 BEGIN
+	INSERT INTO t2 (k) VALUES (new.k);
+END`),
+					buildQuery(`INSERT INTO t1 DEFAULT VALUES`),
+					buildQuery(`INSERT INTO t2 DEFAULT VALUES`),
+				})
+				results [][]types.ResponseRow
+			)
+			req.Header.Timestamp = time.Date(2019, 3, 1, 12, 30, 45, 0, time.UTC)
+			for _, st := range states {
+				_, _, err := st.Query(req, true)
+				So(err, ShouldBeNil)
+				_, resp, err := st.Query(buildRequest(types.ReadQuery, []types.Query{
+					buildQuery(`SELECT k, ts, r FROM t2 ORDER BY k`),
+				}), true)
+				So(err, ShouldBeNil)
+				So(resp.Payload.Rows, ShouldHaveLength, 2)
+				results = append(results, resp.Payload.Rows)
+			}
+			So(results[1], ShouldResemble, results[0])
+			rows := results[0]
+			So(rows[0].Values[0], ShouldBeNil)
+			So(rows[0].Values[1], ShouldResemble, []byte("2019-03-01 12:30:45"))
+			So(rows[1].Values[0], ShouldEqual, 1)
+			So(rows[1].Values[1], ShouldResemble, []byte("2019-03-01 12:30:45"))
+		})
+	})
+}
+
+func TestChangeCapture(t *testing.T) {
+	Convey("Given states of different isolation levels with change capture", t, func() {
+		var (
+			fl1    = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x1"))
+			fl2    = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x2"))
+			states []*State
+		)
+		for _, v := range []struct {
+			fl    string
+			level sql.IsolationLevel
+		}{
+			{fl1, sql.LevelReadUncommitted},
+			{fl2, sql.LevelSerializable},
+		} {
+			strg, err := xs.NewSqlite(fmt.Sprint("file:", v.fl))
+			So(err, ShouldBeNil)
+			st := NewState(v.level, nodeID, strg)
+			_, _, err = st.FetchChanges(0, 0)
+			So(errors.Cause(err), ShouldEqual, ErrChangeCaptureDisabled)
+			st.SetChangeRetention(100)
+			states = append(states, st)
+		}
+		Reset(func() {
+			for i, fl := range []string{fl1, fl2} {
+				So(states[i].Close(true), ShouldBeNil)
+				for _, v := range []string{fl, fmt.Sprint(fl, "-shm"), fmt.Sprint(fl, "-wal")} {
+					err := os.Remove(v)
+					So(err == nil || os.IsNotExist(err), ShouldBeTrue)
+				}
+			}
+		})
+		Convey("The row changes of write queries should be captured in order", func() {
+			for _, st := range states {
+				for _, v := range [][]types.Query{
+					{
+						buildQuery(`CREATE TABLE t1 (k INT PRIMARY KEY, v TEXT)`),
+						buildQuery(`INSERT INTO t1 VALUES (1, 'a'), (2, 'b')`),
+					},
+					{
+						buildQuery(`UPDATE t1 SET v = 'c' WHERE k = 1`),
+						buildQuery(`DELETE FROM t1 WHERE k = 2`),
+					},
+					{
+						buildQuery(`CREATE TABLE t2 (v TEXT)`),
+						buildQuery(`INSERT INTO t2 VALUES ('x')`),
+					},
+				} {
+					_, _, err := st.Query(buildRequest(types.WriteQuery, v), true)
+					So(err, ShouldBeNil)
+				}
+				// Failed request should not leave any change
+				_, _, err := st.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`INSERT INTO t1 VALUES (3, 'd')`),
+					buildQuery(`INSERT INTO t1 VALUES (1, 'e')`),
+				}), true)
+				So(err, ShouldNotBeNil)
+
+				changes, next, err := st.FetchChanges(0, 0)
+				So(err, ShouldBeNil)
+				So(next, ShouldEqual, 6)
+				So(changes, ShouldHaveLength, 5)
+				So(changes[0], ShouldResemble, types.RowChange{
+					LogOffset:  1,
+					Table:      "t1",
+					Op:         types.RowInsert,
+					Columns:    []string{"k", "v"},
+					PrimaryKey: []string{"k"},
+					Key:        []interface{}{int64(1)},
+					New:        []interface{}{int64(1), "a"},
+				})
+				So(changes[1].LogOffset, ShouldEqual, 1)
+				So(changes[1].Key, ShouldResemble, []interface{}{int64(2)})
+				So(changes[2], ShouldResemble, types.RowChange{
+					LogOffset:  2,
+					Table:      "t1",
+					Op:         types.RowUpdate,
+					Columns:    []string{"k", "v"},
+					PrimaryKey: []string{"k"},
+					Key:        []interface{}{int64(1)},
+					Old:        []interface{}{int64(1), "a"},
+					New:        []interface{}{int64(1), "c"},
+				})
+				So(changes[3].LogOffset, ShouldEqual, 3)
+				So(changes[3].Op, ShouldEqual, types.RowDelete)
+				So(changes[3].Old, ShouldResemble, []interface{}{int64(2), "b"})
+				So(changes[3].New, ShouldBeNil)
+				So(changes[4], ShouldResemble, types.RowChange{
+					LogOffset:  5,
+					Table:      "t2",
+					Op:         types.RowInsert,
+					Columns:    []string{"v"},
+					PrimaryKey: []string{"rowid"},
+					Key:        []interface{}{int64(1)},
+					New:        []interface{}{"x"},
+				})
+
+				// Resume with limit, the changes of a query are not split
+				changes, next, err = st.FetchChanges(1, 1)
+				So(err, ShouldBeNil)
+				So(changes, ShouldHaveLength, 2)
+				So(next, ShouldEqual, 2)
+				changes, next, err = st.FetchChanges(next, 1)
+				So(err, ShouldBeNil)
+				So(changes, ShouldHaveLength, 1)
+				So(changes[0].Op, ShouldEqual, types.RowUpdate)
+				So(next, ShouldEqual, 3)
+				changes, next, err = st.FetchChanges(6, 0)
+				So(err, ShouldBeNil)
+				So(changes, ShouldBeEmpty)
+				So(next, ShouldEqual, 6)
+			}
+		})
+		Convey("The rows deleted by replace should be captured", func() {
+			for _, st := range states {
+				_, _, err := st.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`CREATE TABLE t1 (k INT PRIMARY KEY, u TEXT UNIQUE)`),
+					buildQuery(`INSERT INTO t1 VALUES (1, 'a'), (2, 'b')`),
+				}), true)
+				So(err, ShouldBeNil)
+				_, _, err = st.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`REPLACE INTO t1 VALUES (3, 'a')`),
+				}), true)
+				So(err, ShouldBeNil)
+				changes, _, err := st.FetchChanges(2, 0)
+				So(err, ShouldBeNil)
+				So(changes, ShouldHaveLength, 2)
+				So(changes[0].Op, ShouldEqual, types.RowDelete)
+				So(changes[0].Key, ShouldResemble, []interface{}{int64(1)})
+				So(changes[1].Op, ShouldEqual, types.RowInsert)
+				So(changes[1].Key, ShouldResemble, []interface{}{int64(3)})
+			}
+		})
+		Convey("The row changes of wide tables should be captured", func() {
+			var (
+				n       = 150
+				columns = make([]string, n)
+				defs    = make([]string, n)
+				values  = make([]string, n)
+			)
+			for i := range columns {
+				columns[i] = fmt.Sprintf("c%d", i)
+				defs[i] = columns[i] + " INT"
+				values[i] = fmt.Sprint(i)
+			}
+			for _, st := range states {
+				_, _, err := st.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(fmt.Sprintf(`CREATE TABLE t1 (%s)`, strings.Join(defs, ", "))),
+					buildQuery(fmt.Sprintf(`INSERT INTO t1 VALUES (%s)`, strings.Join(values, ", "))),
+					buildQuery(`UPDATE t1 SET c149 = 0`),
+				}), true)
+				So(err, ShouldBeNil)
+				changes, _, err := st.FetchChanges(0, 0)
+				So(err, ShouldBeNil)
+				So(changes, ShouldHaveLength, 2)
+				So(changes[0].Columns, ShouldResemble, columns)
+				So(changes[0].Key, ShouldResemble, []interface{}{int64(1)})
+				So(changes[0].New, ShouldHaveLength, n)
+				So(changes[0].New[n-1], ShouldEqual, int64(n-1))
+				So(changes[1].Op, ShouldEqual, types.RowUpdate)
+				So(changes[1].Old, ShouldResemble, changes[0].New)
+				So(changes[1].New, ShouldHaveLength, n)
+				So(changes[1].New[n-1], ShouldEqual, int64(0))
+			}
+		})
+		Convey("The changes out of retention should be truncated", func() {
+			for _, st := range states {
+				st.SetChangeRetention(4)
+				_, _, err := st.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`CREATE TABLE t1 (k INT PRIMARY KEY, v TEXT)`),
+				}), true)
+				So(err, ShouldBeNil)
+				for i := 0; i < 4; i++ {
+					_, _, err = st.Query(buildRequest(types.WriteQuery, []types.Query{
+						buildQuery(`INSERT INTO t1 VALUES (?, 'a'), (?, 'b')`, 2*i, 2*i+1),
+					}), true)
+					So(err, ShouldBeNil)
+				}
+				_, _, err = st.FetchChanges(1, 0)
+				So(errors.Cause(err), ShouldEqual, ErrChangesTruncated)
+				changes, next, err := st.FetchChanges(0, 0)
+				So(err, ShouldBeNil)
+				So(changes, ShouldHaveLength, 4)
+				So(changes[0].LogOffset, ShouldEqual, 3)
+				So(next, ShouldEqual, 5)
+			}
+		})
+	})
+}
+
+func TestQueryLimit(t *testing.T) {
+	Convey("Given states of different isolation levels", t, func() {
+		var (
+			fl1    = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x1"))
+			fl2    = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x2"))
+			states []*State
+		)
+		for _, v := range []struct {
+			fl    string
+			level sql.IsolationLevel
+		}{
+			{fl1, sql.LevelReadUncommitted},
+			{fl2, sql.LevelSerializable},
+		} {
+			strg, err := xs.NewSqlite(fmt.Sprint("file:", v.fl))
+			So(err, ShouldBeNil)
+			states = append(states, NewState(v.level, nodeID, strg))
+		}
+		Reset(func() {
+			for i, fl := range []string{fl1, fl2} {
+				So(states[i].Close(true), ShouldBeNil)
+				for _, v := range []string{fl, fmt.Sprint(fl, "-shm"), fmt.Sprint(fl, "-wal")} {
+					err := os.Remove(v)
+					So(err == nil || os.IsNotExist(err), ShouldBeTrue)
+				}
+			}
+		})
+		Convey("The read queries should be aborted by the query limits", func() {
+			var (
+				heavy = `SELECT count(*) FROM t1 a, t1 b, t1 c, t1 d, t1 e, t1 f, t1 g, t1 h, t1 i, t1 j`
+				query = func(st *State, limit types.QueryLimit, q string) (*types.Response, error) {
+					_, resp, err := st.QueryWithContext(
+						WithQueryLimit(context.Background(), limit),
+						buildRequest(types.ReadQuery, []types.Query{buildQuery(q)}), true)
+					return resp, err
+				}
+				limitKind = func(err error) types.QueryLimitKind {
+					e, ok := types.ParseQueryLimitError(err)
+					So(ok, ShouldBeTrue)
+					return e.Kind
+				}
+			)
+			for _, st := range states {
+				_, _, err := st.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`CREATE TABLE t1 (k INT, v TEXT)`),
+					buildQuery(`INSERT INTO t1 VALUES (1, 'a'), (2, 'b'), (3, 'c'), (4, 'd'), (5, 'e')`),
+				}), true)
+				So(err, ShouldBeNil)
+
+				resp, err := query(st, types.QueryLimit{MaxRows: 5, MaxBytes: 100}, `SELECT * FROM t1`)
+				So(err, ShouldBeNil)
+				So(resp.Payload.Rows, ShouldHaveLength, 5)
+
+				_, err = query(st, types.QueryLimit{MaxRows: 4}, `SELECT * FROM t1`)
+				So(limitKind(err), ShouldEqual, types.MaxRowsLimit)
+				_, err = query(st, types.QueryLimit{MaxBytes: 20}, `SELECT * FROM t1`)
+				So(limitKind(err), ShouldEqual, types.MaxBytesLimit)
+				_, err = query(st, types.QueryLimit{MaxVMSteps: 10000}, heavy)
+				So(limitKind(err), ShouldEqual, types.MaxVMStepsLimit)
+				_, err = query(st, types.QueryLimit{Timeout: 10}, heavy)
+				So(limitKind(err), ShouldEqual, types.TimeoutLimit)
+
+				// budget is cleared after the request
+				resp, err = query(st, types.QueryLimit{}, `SELECT count(*) FROM t1 a, t1 b, t1 c, t1 d, t1 e`)
+				So(err, ShouldBeNil)
+				So(resp.Payload.Rows[0].Values[0], ShouldEqual, 3125)
+			}
+		})
+	})
+}
+
+func TestCursor(t *testing.T) {
+	Convey("Given states of different isolation levels", t, func() {
+		var (
+			fl1    = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x1"))
+			fl2    = path.Join(testingDataDir, fmt.Sprint(t.Name(), "x2"))
+			states []*State
+		)
+		for _, v := range []struct {
+			fl    string
+			level sql.IsolationLevel
+		}{
+			{fl1, sql.LevelReadUncommitted},
+			{fl2, sql.LevelSerializable},
+		} {
+			strg, err := xs.NewSqlite(fmt.Sprint("file:", v.fl))
+			So(err, ShouldBeNil)
+			states = append(states, NewState(v.level, nodeID, strg))
+		}
+		Reset(func() {
+			for i, fl := range []string{fl1, fl2} {
+				So(states[i].Close(true), ShouldBeNil)
+				for _, v := range []string{fl, fmt.Sprint(fl, "-shm"), fmt.Sprint(fl, "-wal")} {
+					err := os.Remove(v)
+					So(err == nil || os.IsNotExist(err), ShouldBeTrue)
+				}
+			}
+		})
+		for _, st := range states {
+			_, _, err := st.Query(buildRequest(types.WriteQuery, []types.Query{
+				buildQuery(`CREATE TABLE t1 (k INT, v TEXT)`),
+				buildQuery(`INSERT INTO t1 VALUES (1, 'a'), (2, 'b'), (3, 'c'), (4, 'd'), (5, 'e')`),
+			}), true)
+			So(err, ShouldBeNil)
+			_, _, err = st.CommitEx()
+			So(err, ShouldBeNil)
+		}
+		var open = func(
+			st *State, limit types.QueryLimit, batch int, q string) (*types.Response, *Cursor, error,
+		) {
+			_, resp, cur, err := st.OpenCursor(
+				WithQueryLimit(context.Background(), limit),
+				buildRequest(types.ReadQuery, []types.Query{buildQuery(q)}), batch)
+			return resp, cur, err
+		}
+		Convey("The cursor should return the result rows batch by batch", func() {
+			for _, st := range states {
+				resp, cur, err := open(st, types.QueryLimit{}, 2, `SELECT * FROM t1 ORDER BY k`)
+				So(err, ShouldBeNil)
+				So(cur, ShouldNotBeNil)
+				So(resp.Payload.Columns, ShouldResemble, []string{"k", "v"})
+				So(resp.Payload.Rows, ShouldHaveLength, 2)
+				So(resp.Header.RowCount, ShouldEqual, 2)
+				So(resp.Payload.Rows[0].Values[0], ShouldEqual, 1)
+				rows, done, err := cur.Fetch(2)
+				So(err, ShouldBeNil)
+				So(done, ShouldBeFalse)
+				So(rows, ShouldHaveLength, 2)
+				So(rows[0].Values[0], ShouldEqual, 3)
+				rows, done, err = cur.Fetch(2)
+				So(err, ShouldBeNil)
+				So(done, ShouldBeTrue)
+				So(rows, ShouldHaveLength, 1)
+				So(rows[0].Values[1], ShouldResemble, []byte("e"))
+				_, _, err = cur.Fetch(2)
+				So(err, ShouldEqual, ErrCursorClosed)
+				So(cur.Close(), ShouldBeNil)
+
+				// the cursor header accounts all the batches
+				header := cur.Header()
+				So(header.RequestHash, ShouldEqual, resp.Header.RequestHash)
+				So(header.RowCount, ShouldEqual, 5)
+				So(header.Cost.RowsRead, ShouldEqual, 5)
+				So(header.Cost.BytesReturned, ShouldBeGreaterThan, resp.Header.Cost.BytesReturned)
+				So(header.Cost.VMSteps, ShouldBeGreaterThanOrEqualTo, resp.Header.Cost.VMSteps)
+
+				// all rows are returned in the first batch
+				resp, cur, err = open(st, types.QueryLimit{}, 6, `SELECT * FROM t1`)
+				So(err, ShouldBeNil)
+				So(cur, ShouldBeNil)
+				So(resp.Payload.Rows, ShouldHaveLength, 5)
+			}
+		})
+		Convey("The cursor should apply the query limits to the whole result set", func() {
+			for _, st := range states {
+				resp, cur, err := open(st, types.QueryLimit{MaxRows: 3}, 2, `SELECT * FROM t1`)
+				So(err, ShouldBeNil)
+				So(resp.Payload.Rows, ShouldHaveLength, 2)
+				_, _, err = cur.Fetch(2)
+				e, ok := types.ParseQueryLimitError(err)
+				So(ok, ShouldBeTrue)
+				So(e.Kind, ShouldEqual, types.MaxRowsLimit)
+				_, _, err = cur.Fetch(2)
+				So(err, ShouldEqual, ErrCursorClosed)
+			}
+		})
+		Convey("The state should reject invalid cursor requests", func() {
+			for _, st := range states {
+				_, _, _, err := st.OpenCursor(context.Background(), buildRequest(types.WriteQuery,
+					[]types.Query{buildQuery(`SELECT * FROM t1`)}), 2)
+				So(errors.Cause(err), ShouldEqual, ErrInvalidRequest)
+				_, _, _, err = st.OpenCursor(context.Background(), buildRequest(types.ReadQuery,
+					[]types.Query{buildQuery(`SELECT * FROM t1`), buildQuery(`SELECT * FROM t1`)}), 2)
+				So(errors.Cause(err), ShouldEqual, ErrInvalidRequest)
+				_, _, err = open(st, types.QueryLimit{}, 2, `SELECT * FROM t2`)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}